@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Formats of the access log, set with ACCESS_LOG_FORMAT.
+const (
+	AccessLogEntries  = "log"      // A Request entry in the log, in LOG_FORMAT
+	AccessLogCombined = "combined" // Apache's combined log format on standard output
+)
+
+var accessLogFormats = []string{AccessLogEntries, AccessLogCombined}
+
+// combinedLog receives the access log in Apache's combined log format, which
+// web log analyzers read, instead of the log. Nil logs entries.
+var combinedLog io.Writer
+
+// combinedTimeFormat is the time format of Apache's %t.
+const combinedTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+// accessRecord collects what is known about a request only deeper in the
+// handler chain, for loggingMiddleware.
+type accessRecord struct {
+	principal Principal
+}
+
+type accessRecordKey struct{}
+
+// recordPrincipal notes the authenticated caller of the request of ctx for
+// its access log entry.
+func recordPrincipal(ctx context.Context, principal Principal) {
+	if record, ok := ctx.Value(accessRecordKey{}).(*accessRecord); ok {
+		record.principal = principal
+	}
+}
+
+// countingBody counts the bytes read from a request body.
+type countingBody struct {
+	io.ReadCloser
+	read int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	return n, err
+}
+
+// loggingMiddleware logs each request once it has been answered, with its
+// status, duration, the bytes read from its body and written in the
+// response, and the authenticated caller.
+func loggingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		record := &accessRecord{principal: Principal{Method: "none"}}
+		r = r.WithContext(context.WithValue(r.Context(), accessRecordKey{}, record))
+		var body *countingBody
+		if r.Body != nil && r.Body != http.NoBody {
+			body = &countingBody{ReadCloser: r.Body}
+			r.Body = body
+		}
+		rw := newResponseWriter(w)
+
+		next.ServeHTTP(rw, r)
+
+		var read int64
+		if body != nil {
+			read = body.read
+		}
+		if combinedLog != nil {
+			_, _ = io.WriteString(combinedLog, combinedLine(r, record.principal, rw.statusCode, rw.written, start))
+			return
+		}
+		slog.Info("Request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rw.statusCode,
+			"duration", time.Since(start),
+			"bytes_in", read,
+			"bytes_out", rw.written,
+			"auth", record.principal.Method,
+			"user", record.principal.Username,
+			"addr", requestSource(r).Addr,
+			"request_id", w.Header().Get(requestIDHeader))
+	})
+}
+
+// combinedLine formats a request received at start in Apache's combined log
+// format, ending in a newline.
+func combinedLine(r *http.Request, principal Principal, status int, written int64, start time.Time) string {
+	host, user, size := requestSource(r).Addr, principal.Username, strconv.FormatInt(written, 10)
+	if host == "" {
+		host = "-"
+	}
+	if user == "" {
+		user = "-"
+	}
+	if written == 0 {
+		size = "-"
+	}
+	request := fmt.Sprintf("%s %s %s", r.Method, r.RequestURI, r.Proto)
+	return fmt.Sprintf("%s - %s [%s] %s %d %s %s %s\n",
+		host, user, start.Format(combinedTimeFormat), strconv.Quote(request), status, size,
+		quoteOrDash(r.Referer()), quoteOrDash(r.UserAgent()))
+}
+
+// quoteOrDash quotes a header value of the combined log format, which is a
+// dash when it is missing.
+func quoteOrDash(s string) string {
+	if s == "" {
+		return `"-"`
+	}
+	return strconv.Quote(s)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// captureLog sends the log to a buffer, in JSON, for the rest of the test.
+func captureLog(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(slog.New(newLogHandler(&buf, slog.LevelInfo, LogFormatJSON)))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	return &buf
+}
+
+func TestLoggingMiddleware_Entry(t *testing.T) {
+	buf := captureLog(t)
+	handler := loggingMiddleware(authMiddleware(func() string { return "secret" }, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte("saved"))
+	})))
+
+	req := httptest.NewRequest(http.MethodPost, "/network?ID=abc", strings.NewReader(`{"a":1}`))
+	req.SetBasicAuth("ci", "secret")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	var entry map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("expected one JSON entry, got %q: %v", buf.String(), err)
+	}
+	want := map[string]any{
+		"msg":       "Request",
+		"method":    "POST",
+		"path":      "/network",
+		"status":    float64(http.StatusCreated),
+		"bytes_in":  float64(7),
+		"bytes_out": float64(5),
+		"auth":      "basic",
+		"user":      "ci",
+		"addr":      "192.0.2.1",
+	}
+	for key, value := range want {
+		if entry[key] != value {
+			t.Errorf("%s: expected %v, got %v", key, value, entry[key])
+		}
+	}
+	if _, ok := entry["duration"]; !ok {
+		t.Error("expected the duration to be logged")
+	}
+}
+
+func TestLoggingMiddleware_Unauthenticated(t *testing.T) {
+	buf := captureLog(t)
+	handler := loggingMiddleware(authMiddleware(func() string { return "secret" }, http.NotFoundHandler()))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/network", nil))
+
+	var entry map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("expected one JSON entry, got %q: %v", buf.String(), err)
+	}
+	if entry["status"] != float64(http.StatusUnauthorized) || entry["auth"] != "none" || entry["bytes_in"] != float64(0) {
+		t.Errorf("unexpected entry %v", entry)
+	}
+}
+
+func TestLoggingMiddleware_Combined(t *testing.T) {
+	buf := captureLog(t)
+	var combined bytes.Buffer
+	combinedLog = &combined
+	t.Cleanup(func() { combinedLog = nil })
+
+	handler := loggingMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("{}"))
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/network", nil))
+
+	if buf.Len() != 0 {
+		t.Errorf("expected no log entry, got %q", buf.String())
+	}
+	if line := combined.String(); !strings.HasPrefix(line, "192.0.2.1 - - [") || !strings.HasSuffix(line, `] "GET /network HTTP/1.1" 200 2 "-" "-"`+"\n") {
+		t.Errorf("unexpected combined log line %q", line)
+	}
+}
+
+func TestCombinedLine(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/network?ID=abc", nil)
+	req.RemoteAddr = "10.0.0.5:52144"
+	req.Header.Set("User-Agent", `Terraform/1.9.5 "test"`)
+	start := time.Date(2026, time.October, 16, 18, 9, 23, 0, time.UTC)
+
+	got := combinedLine(req, Principal{Method: "basic", Username: "ci"}, http.StatusOK, 0, start)
+	want := `10.0.0.5 - ci [16/Oct/2026:18:09:23 +0000] "POST /network?ID=abc HTTP/1.1" 200 - "-" "Terraform/1.9.5 \"test\""` + "\n"
+	if got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// newACMEManager creates the manager getting the certificates of the TLS
+// listeners from Let's Encrypt for the domains in cfg.ACMEDomains. Certificates and the account key are kept in
+// cfg.ACMECacheDir, and renewed before they expire.
+//
+// The CA validates a domain by connecting to it on port 443, where a TLS
+// listener answers its TLS-ALPN challenge, or on port 80, where a plaintext
+// listener answers its HTTP challenge.
+func newACMEManager(cfg *Config) *autocert.Manager {
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(cfg.ACMECacheDir),
+		HostPolicy: autocert.HostWhitelist(cfg.ACMEDomains...),
+		Email:      cfg.ACMEEmail,
+	}
+}
@@ -0,0 +1,16 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestNewACMEManager_OnlyServesConfiguredDomains(t *testing.T) {
+	m := newACMEManager(&Config{ACMEDomains: []string{"tf-state.example.com"}, ACMECacheDir: t.TempDir()})
+	if err := m.HostPolicy(context.Background(), "tf-state.example.com"); err != nil {
+		t.Errorf("expected the configured domain to be allowed, got %v", err)
+	}
+	if err := m.HostPolicy(context.Background(), "other.example.com"); err == nil {
+		t.Error("expected other domains to be refused")
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// whoamiResponse describes how the backend sees the caller.
+type whoamiResponse struct {
+	Authenticated bool             `json:"authenticated"`
+	AuthMethod    string           `json:"auth_method"`
+	Username      string           `json:"username,omitempty"`
+	Tenant        string           `json:"tenant,omitempty"`
+	Scopes        []string         `json:"scopes"`
+	AllowedStates []string         `json:"allowed_states"`
+	RateLimit     *whoamiRateLimit `json:"rate_limit,omitempty"`
+}
+
+// whoamiRateLimit describes the caller's REQUEST_RATE_LIMIT budget.
+type whoamiRateLimit struct {
+	RequestsPerMinute int `json:"requests_per_minute"`
+	Remaining         int `json:"remaining"`
+}
+
+// whoamiHandler reports the caller's resolved identity and permissions, so
+// pipeline authors can debug which credentials their CI actually sends.
+// limits, if set, reports the caller's rate limit.
+func whoamiHandler(limits *ClientLimiter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal := principalFromContext(r.Context())
+
+		// The server-wide token grants full access to every state, a
+		// tenant's token only to the states of the tenant
+		resp := whoamiResponse{
+			Authenticated: principal.Method != "none",
+			AuthMethod:    principal.Method,
+			Username:      principal.Username,
+			Tenant:        principal.Tenant,
+			Scopes:        []string{"state:read", "state:write", "state:lock", "admin"},
+			AllowedStates: []string{"*"},
+		}
+		if principal.Tenant != "" {
+			resp.Scopes = []string{"state:read", "state:write", "state:lock"}
+			resp.AllowedStates = []string{principal.Tenant + "/*"}
+		}
+		if limits != nil {
+			if perMinute, remaining := limits.Budget(r); perMinute > 0 {
+				resp.RateLimit = &whoamiRateLimit{RequestsPerMinute: perMinute, Remaining: remaining}
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(resp)
+	})
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestWhoami_Unauthenticated(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/whoami", nil)
+	w := httptest.NewRecorder()
+
+	whoamiHandler(nil).ServeHTTP(w, req)
+
+	var resp whoamiResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+	if resp.Authenticated || resp.AuthMethod != "none" {
+		t.Errorf("expected unauthenticated caller, got %+v", resp)
+	}
+}
+
+func TestWhoami_BasicAuth(t *testing.T) {
+	handler := authMiddleware(func() string { return "secret-token" }, whoamiHandler(nil))
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/whoami", nil)
+	req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("ci-runner:secret-token")))
+	w := httptest.NewRecorder()
+
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+	var resp whoamiResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+	if !resp.Authenticated || resp.AuthMethod != "basic" || resp.Username != "ci-runner" {
+		t.Errorf("unexpected identity: %+v", resp)
+	}
+}
+
+func TestWhoami_Bearer(t *testing.T) {
+	handler := authMiddleware(func() string { return "secret-token" }, whoamiHandler(nil))
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/whoami", nil)
+	req.Header.Set("Authorization", "Bearer secret-token")
+	w := httptest.NewRecorder()
+
+	handler.ServeHTTP(w, req)
+
+	var resp whoamiResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+	if resp.AuthMethod != "bearer" {
+		t.Errorf("expected bearer auth, got %q", resp.AuthMethod)
+	}
+}
+
+func TestWhoami_TenantToken(t *testing.T) {
+	router, _, _ := newTestTenantRouter(t, "tenants:\n  - prefix: team-a\n    repo: a\n    auth_token: token-a\n")
+	limiter := NewClientLimiter(60, router.Authenticates)
+	whoami := whoamiHandler(limiter)
+	handler := limiter.Middleware(router.Protect(whoami, authMiddleware(func() string { return "server-token" }, whoami)))
+
+	w := serveAs(handler, http.MethodGet, "/api/v1/whoami", "token-a", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+	var resp whoamiResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+	if !resp.Authenticated || resp.Tenant != "team-a" || !slices.Equal(resp.AllowedStates, []string{"team-a/*"}) || slices.Contains(resp.Scopes, "admin") {
+		t.Errorf("unexpected access for a tenant token: %+v", resp)
+	}
+	// The burst is ten requests, one of which was this one
+	if resp.RateLimit == nil || resp.RateLimit.RequestsPerMinute != 60 || resp.RateLimit.Remaining != 9 {
+		t.Errorf("unexpected rate limit: %+v", resp.RateLimit)
+	}
+
+	// The server-wide token still sees every state, other tokens nothing
+	w = serveAs(handler, http.MethodGet, "/api/v1/whoami", "server-token", "")
+	resp = whoamiResponse{}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+	if resp.Tenant != "" || !slices.Equal(resp.AllowedStates, []string{"*"}) {
+		t.Errorf("unexpected access for the server token: %+v", resp)
+	}
+	if w := serveAs(handler, http.MethodGet, "/api/v1/whoami", "token-b", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected status 401 for an unknown token, got %d", w.Code)
+	}
+}
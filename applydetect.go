@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+)
+
+// lockSource is where a lock was acquired from. Writes made under the lock
+// are compared with it to spot concurrent applies, such as CI pipelines
+// that share a lock ID or write with -lock=false.
+type lockSource struct {
+	Addr     string `json:"addr"`
+	Username string `json:"username,omitempty"`
+}
+
+// requestSource returns the source of r: the client's IP address, which is
+// the proxy's behind a reverse proxy, and the basic auth username, if any.
+func requestSource(r *http.Request) lockSource {
+	addr := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	return lockSource{Addr: addr, Username: principalFromContext(r.Context()).Username}
+}
+
+// differs reports whether s and other look like different clients. Usernames
+// are only compared when both requests carry one.
+func (s lockSource) differs(other lockSource) bool {
+	if s.Addr != other.Addr {
+		return true
+	}
+	return s.Username != "" && other.Username != "" && s.Username != other.Username
+}
+
+func (s lockSource) String() string {
+	if s.Username == "" {
+		return s.Addr
+	}
+	return s.Username + "@" + s.Addr
+}
+
+// Reasons a write is suspected to be part of a concurrent apply.
+const (
+	suspectSharedLock  = "shared_lock"  // The lock ID was used from another source than the lock
+	suspectForeignLock = "foreign_lock" // Another source wrote while the lock was held
+)
+
+// checkConcurrentApply looks for signs that the write r to the named state,
+// made with lockID while lock is held from holder, comes from a different
+// apply than the holder's. A write with the lock's ID from another source
+// goes ahead with a Warning header, as the same runner may have changed
+// address; writes with another ID are refused by the caller regardless.
+// Suspected writes are logged, counted, audited and announced.
+func (h *StateHandler) checkConcurrentApply(w http.ResponseWriter, r *http.Request, name, lockID string, lock LockInfo, holder lockSource) {
+	if !h.applyChecks || holder == (lockSource{}) {
+		return
+	}
+	source := requestSource(r)
+	if !source.differs(holder) {
+		return
+	}
+
+	reason := suspectSharedLock
+	message := fmt.Sprintf("state %s was written with lock %s from %s, but %s acquired the lock from %s", name, lock.ID, source, lock.Who, holder)
+	if lockID != lock.ID {
+		reason = suspectForeignLock
+		message = fmt.Sprintf("state %s was written with lock ID %q from %s while %s holds lock %s from %s", name, lockID, source, lock.Who, lock.ID, holder)
+	} else {
+		w.Header().Add("Warning", fmt.Sprintf("299 gitea-tf-backend %q", message+"; another apply may be sharing the lock"))
+	}
+
+	slog.Warn("Possible concurrent apply", "state", name, "lock_id", lockID, "detail", message)
+	IncrementConcurrentApplySuspects(reason)
+	h.recordAudit("concurrent-apply", name, message)
+	h.notifier.Notify(EventConcurrentApplySuspected, name, fmt.Sprintf("Possible concurrent apply on %s: %s.", name, message),
+		map[string]any{"reason": reason, "lock_id": lockID, "source": source, "holder": lock, "holder_source": holder})
+}
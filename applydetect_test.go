@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// serveFrom sends a request with a Lock-Id header from the client at addr.
+func serveFrom(handler http.Handler, method, target, addr, lockID, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	r.RemoteAddr = addr
+	if lockID != "" {
+		r.Header.Set("Lock-Id", lockID)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+func newTestApplyCheckHandler(t *testing.T) (*StateHandler, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	auditLog, err := OpenAuditLog(path)
+	if err != nil {
+		t.Fatalf("failed to open audit log: %v", err)
+	}
+	handler, _ := newTestHandler()
+	handler.audit = auditLog
+
+	w := serveFrom(handler, "LOCK", "/network", "10.0.0.1:50000", "", `{"ID":"lock-1","Operation":"OperationTypeApply","Who":"ci@runner-1"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected lock to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+	return handler, path
+}
+
+func TestConcurrentApply_SharedLock(t *testing.T) {
+	handler, path := newTestApplyCheckHandler(t)
+
+	// The holder's own writes are not suspicious
+	w := serveFrom(handler, http.MethodPost, "/network", "10.0.0.1:50001", "lock-1", `{"version":4,"serial":1,"lineage":"abc"}`)
+	if w.Code != http.StatusOK || w.Header().Get("Warning") != "" {
+		t.Fatalf("expected a plain write, got %d with warning %q", w.Code, w.Header().Get("Warning"))
+	}
+
+	w = serveFrom(handler, http.MethodPost, "/network", "10.0.0.2:50000", "lock-1", `{"version":4,"serial":2,"lineage":"abc"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected the write to go ahead, got %d: %s", w.Code, w.Body.String())
+	}
+	if warning := w.Header().Get("Warning"); !strings.Contains(warning, "10.0.0.2") || !strings.Contains(warning, "sharing the lock") {
+		t.Errorf("expected a warning about the shared lock, got %q", warning)
+	}
+
+	entries, err := ReadAuditLog(path)
+	if err != nil {
+		t.Fatalf("failed to read audit log: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Action != "concurrent-apply" || !strings.Contains(entries[0].Message, "ci@runner-1") {
+		t.Errorf("expected one concurrent-apply audit entry, got %+v", entries)
+	}
+}
+
+func TestConcurrentApply_ForeignLock(t *testing.T) {
+	handler, path := newTestApplyCheckHandler(t)
+
+	// A stale lock ID from the holder's address is only a conflict
+	if w := serveFrom(handler, http.MethodPost, "/network", "10.0.0.1:50001", "lock-0", `{"version":4,"serial":1,"lineage":"abc"}`); w.Code != http.StatusLocked {
+		t.Fatalf("expected status 423, got %d", w.Code)
+	}
+	w := serveFrom(handler, http.MethodPost, "/network", "10.0.0.2:50000", "", `{"version":4,"serial":1,"lineage":"abc"}`)
+	if w.Code != http.StatusLocked {
+		t.Fatalf("expected status 423, got %d", w.Code)
+	}
+
+	entries, err := ReadAuditLog(path)
+	if err != nil {
+		t.Fatalf("failed to read audit log: %v", err)
+	}
+	if len(entries) != 1 || !strings.Contains(entries[0].Message, "10.0.0.2") || !strings.Contains(entries[0].Message, "lock-1") {
+		t.Errorf("expected one audit entry for the write from 10.0.0.2, got %+v", entries)
+	}
+}
+
+func TestConcurrentApply_Disabled(t *testing.T) {
+	handler, path := newTestApplyCheckHandler(t)
+	handler.applyChecks = false
+
+	w := serveFrom(handler, http.MethodPost, "/network", "10.0.0.2:50000", "lock-1", `{"version":4,"serial":1,"lineage":"abc"}`)
+	if w.Code != http.StatusOK || w.Header().Get("Warning") != "" {
+		t.Errorf("expected a plain write, got %d with warning %q", w.Code, w.Header().Get("Warning"))
+	}
+	if entries, _ := ReadAuditLog(path); len(entries) != 0 {
+		t.Errorf("expected no audit entries, got %+v", entries)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// ArchiveStorage defines the repository operations needed to move states
+// between the active area and the archive.
+type ArchiveStorage interface {
+	StateStorage
+	DeleteFile(ctx context.Context, path string, sha string, message string) error
+	ListFiles(prefix string) ([]string, error)
+	LastCommitTime(path string) (time.Time, error)
+}
+
+// archivePath returns the path to the archived state file for a given state name.
+func archivePath(name string) string {
+	return fmt.Sprintf("archive/%s/terraform.tfstate", name)
+}
+
+// Archiver moves states that have not been written for a while out of the
+// active states/ tree, keeping the hot repository small.
+type Archiver struct {
+	active   ArchiveStorage
+	archive  ArchiveStorage
+	months   int
+	isLocked func(name string) bool
+	now      func() time.Time
+	reads    *ReadGroup // Optional - forgets rehydrated states found missing
+}
+
+// NewArchiver creates an Archiver that archives states inactive for the given number of months.
+// The archive storage may point at the same repository as the active storage.
+func NewArchiver(active, archive ArchiveStorage, months int, isLocked func(name string) bool) *Archiver {
+	return &Archiver{
+		active:   active,
+		archive:  archive,
+		months:   months,
+		isLocked: isLocked,
+		now:      time.Now,
+	}
+}
+
+// Run performs one archiving pass over all active states.
+func (a *Archiver) Run(ctx context.Context) error {
+	paths, err := a.active.ListFiles(layout.prefix)
+	if err != nil {
+		return err
+	}
+
+	cutoff := a.now().AddDate(0, -a.months, 0)
+	for _, path := range paths {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		name, ok := stateNameFromPath(path)
+		if !ok || a.isLocked(name) {
+			continue
+		}
+
+		modified, err := a.active.LastCommitTime(path)
+		if err != nil {
+			return err
+		}
+		if modified.IsZero() || modified.After(cutoff) {
+			continue
+		}
+
+		archived, err := a.archiveState(ctx, name)
+		if err != nil {
+			return err
+		}
+		if !archived {
+			continue
+		}
+		slog.Info("Archived state", "state", name, "modified", modified.Format(time.RFC3339))
+		IncrementArchivedStates()
+	}
+	return nil
+}
+
+// archiveState copies a state into the archive and then removes it from the
+// active area. Copying first ensures a failure never loses the state. States
+// split into chunks are left where they are: the archive keeps a state in a
+// single file, which is what their size does not allow.
+func (a *Archiver) archiveState(ctx context.Context, name string) (bool, error) {
+	content, sha, err := a.active.GetFile(ctx, statePath(name))
+	if err != nil {
+		return false, err
+	}
+	if content == nil {
+		return false, nil
+	}
+	if _, chunked := parseChunkManifest(content); chunked {
+		slog.Info("Not archiving state: it is split into chunks", "state", name)
+		return false, nil
+	}
+
+	message := stateCommitMessage(OpArchive, name, fmt.Sprintf("Archive state: %s", name))
+	if err := a.archive.CreateOrUpdateFile(ctx, archivePath(name), content, message); err != nil {
+		return false, err
+	}
+	// Remove the state together with its sidecars
+	if committer, ok := a.active.(FileCommitter); ok {
+		err := committer.CommitFiles(ctx, message, []FileChange{
+			{Path: statePath(name), SHA: sha},
+			{Path: checksumPath(name)},
+			{Path: metadataPath(name)},
+		})
+		return err == nil, err
+	}
+	err = a.active.DeleteFile(ctx, statePath(name), sha, message)
+	return err == nil, err
+}
+
+// IsArchived reports whether an archived copy of the named state exists.
+func (a *Archiver) IsArchived(ctx context.Context, name string) (bool, error) {
+	content, _, err := a.archive.GetFile(ctx, archivePath(name))
+	if err != nil {
+		return false, err
+	}
+	return content != nil, nil
+}
+
+// Rehydrate moves an archived state back into the active area.
+func (a *Archiver) Rehydrate(ctx context.Context, name string) error {
+	content, sha, err := a.archive.GetFile(ctx, archivePath(name))
+	if err != nil {
+		return err
+	}
+	if content == nil {
+		return ErrStateNotArchived
+	}
+
+	existing, _, err := a.active.GetFile(ctx, statePath(name))
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		return ErrStateActive
+	}
+
+	message := stateCommitMessage(OpRehydrate, name, fmt.Sprintf("Rehydrate state: %s", name))
+	err = a.active.CreateOrUpdateFile(ctx, statePath(name), content, message)
+	a.reads.Forget(name)
+	if err != nil {
+		return err
+	}
+	return a.archive.DeleteFile(ctx, archivePath(name), sha, message)
+}
+
+// ServeHTTP handles rehydration requests of the form POST /admin/rehydrate/{name...}.
+func (a *Archiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := extractStateName(r.PathValue("name"))
+	if name == "" {
+		writeError(w, fmt.Errorf("%w: state name required", ErrInvalidRequest))
+		return
+	}
+
+	err := a.Rehydrate(r.Context(), name)
+	switch {
+	case errors.Is(err, ErrStateNotArchived), errors.Is(err, ErrStateActive):
+		writeError(w, err)
+	case err != nil:
+		slog.Error("Error rehydrating state", "state", name, "error", err)
+		writeError(w, err)
+	default:
+		slog.Info("Rehydrated state", "state", name)
+		w.WriteHeader(http.StatusOK)
+	}
+}
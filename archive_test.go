@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newTestArchiver() (*Archiver, *MockStorage, *MockStorage) {
+	active := NewMockStorage()
+	archive := NewMockStorage()
+	archiver := NewArchiver(active, archive, 6, func(name string) bool { return name == "locked" })
+	archiver.now = func() time.Time { return time.Date(2024, 12, 1, 0, 0, 0, 0, time.UTC) }
+	return archiver, active, archive
+}
+
+func TestArchiver_Run(t *testing.T) {
+	archiver, active, archive := newTestArchiver()
+
+	old := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	recent := time.Date(2024, 11, 1, 0, 0, 0, 0, time.UTC)
+	for name, modified := range map[string]time.Time{"stale": old, "fresh": recent, "locked": old} {
+		active.files[statePath(name)] = []byte(`{"version":4}`)
+		active.modified[statePath(name)] = modified
+	}
+
+	if err := archiver.Run(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, exists := active.files[statePath("stale")]; exists {
+		t.Error("stale state should be removed from the active area")
+	}
+	if _, exists := archive.files[archivePath("stale")]; !exists {
+		t.Error("stale state should be archived")
+	}
+	if _, exists := active.files[statePath("fresh")]; !exists {
+		t.Error("recently modified state should not be archived")
+	}
+	if _, exists := active.files[statePath("locked")]; !exists {
+		t.Error("locked state should not be archived")
+	}
+}
+
+func TestArchiver_Rehydrate(t *testing.T) {
+	archiver, active, archive := newTestArchiver()
+	archive.files[archivePath("myproject")] = []byte(`{"version":4}`)
+
+	if err := archiver.Rehydrate(context.Background(), "myproject"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if string(active.files[statePath("myproject")]) != `{"version":4}` {
+		t.Error("state was not restored to the active area")
+	}
+	if _, exists := archive.files[archivePath("myproject")]; exists {
+		t.Error("archived copy should be removed after rehydration")
+	}
+}
+
+func TestArchiver_RehydrateNotArchived(t *testing.T) {
+	archiver, _, _ := newTestArchiver()
+
+	if err := archiver.Rehydrate(context.Background(), "myproject"); !errors.Is(err, ErrStateNotArchived) {
+		t.Errorf("expected ErrStateNotArchived, got %v", err)
+	}
+}
+
+func TestArchiver_RehydrateActiveExists(t *testing.T) {
+	archiver, active, archive := newTestArchiver()
+	active.files[statePath("myproject")] = []byte(`{"version":4,"serial":2}`)
+	archive.files[archivePath("myproject")] = []byte(`{"version":4,"serial":1}`)
+
+	if err := archiver.Rehydrate(context.Background(), "myproject"); !errors.Is(err, ErrStateActive) {
+		t.Errorf("expected ErrStateActive, got %v", err)
+	}
+	if string(active.files[statePath("myproject")]) != `{"version":4,"serial":2}` {
+		t.Error("active state must not be overwritten")
+	}
+}
+
+func TestArchiver_ServeHTTP(t *testing.T) {
+	archiver, _, archive := newTestArchiver()
+	archive.files[archivePath("org/project")] = []byte(`{"version":4}`)
+
+	mux := http.NewServeMux()
+	mux.Handle("POST /admin/rehydrate/{name...}", archiver)
+
+	req := httptest.NewRequest(http.MethodPost, "/admin/rehydrate/org/project", nil)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status 200, got %d", w.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/admin/rehydrate/org/project", nil)
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected status 404 for second rehydration, got %d", w.Code)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuditEntry records a single commit made by the backend.
+type AuditEntry struct {
+	Seq     int64     `json:"seq"`
+	Time    time.Time `json:"time"`
+	Repo    string    `json:"repo"`
+	Action  string    `json:"action"`
+	Path    string    `json:"path"`
+	Commit  string    `json:"commit"`
+	Message string    `json:"message"`
+}
+
+// AuditLog is an append-only JSON-lines log of every commit the backend makes.
+type AuditLog struct {
+	mu       sync.Mutex
+	file     *os.File
+	seq      int64
+	counters *CounterStore // Optional - persists seq independently of the file
+}
+
+// OpenAuditLog opens (or creates) the audit log at path and resumes its sequence numbering.
+func OpenAuditLog(path string) (*AuditLog, error) {
+	entries, err := ReadAuditLog(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+
+	auditLog := &AuditLog{file: file}
+	if len(entries) > 0 {
+		auditLog.seq = entries[len(entries)-1].Seq
+	}
+	return auditLog, nil
+}
+
+// PersistSeq keeps the sequence number in counters, so numbering continues
+// where it left off even if the log file is rotated or removed.
+func (a *AuditLog) PersistSeq(counters *CounterStore) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.counters = counters
+	if seq := counters.Get(auditSeqCounter); seq > a.seq {
+		a.seq = seq
+	}
+}
+
+// Record appends an entry to the log, assigning it the next sequence number.
+func (a *AuditLog) Record(entry AuditEntry) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.seq++
+	entry.Seq = a.seq
+	if entry.Time.IsZero() {
+		entry.Time = time.Now().UTC()
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode audit entry: %w", err)
+	}
+	if _, err := a.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write audit entry: %w", err)
+	}
+	a.counters.Set(auditSeqCounter, a.seq)
+	return nil
+}
+
+// Close closes the underlying file.
+func (a *AuditLog) Close() error {
+	return a.file.Close()
+}
+
+// ReadAuditLog reads all entries from the audit log at path.
+func ReadAuditLog(path string) ([]AuditEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []AuditEntry
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("invalid audit entry on line %d: %w", line, err)
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read audit log: %w", err)
+	}
+	return entries, nil
+}
+
+// AuditReport is the result of cross-checking repository history against the audit log.
+type AuditReport struct {
+	// Unaudited lists commits touching state paths that the backend did not make.
+	Unaudited []CommitInfo `json:"unaudited"`
+	// Missing lists audit entries whose commit is no longer in the history.
+	Missing []AuditEntry `json:"missing"`
+}
+
+// OK reports whether history and audit log agree.
+func (r *AuditReport) OK() bool {
+	return len(r.Unaudited) == 0 && len(r.Missing) == 0
+}
+
+// VerifyAudit compares the commits touching the given path prefixes in a
+// repository's history with the audit log entries recorded for them. Commits
+// older than since are ignored, which allows excluding history from before the
+// backend was adopted.
+func VerifyAudit(commits []CommitInfo, entries []AuditEntry, repo string, prefixes []string, since time.Time) *AuditReport {
+	var relevant []AuditEntry
+	audited := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		if entry.Repo != repo || !hasAnyPrefix(entry.Path, prefixes) {
+			continue
+		}
+		relevant = append(relevant, entry)
+		audited[entry.Commit] = true
+	}
+
+	inHistory := make(map[string]bool, len(commits))
+	report := &AuditReport{}
+	for _, commit := range commits {
+		inHistory[commit.SHA] = true
+		if commit.Created.Before(since) {
+			continue
+		}
+		if !audited[commit.SHA] {
+			report.Unaudited = append(report.Unaudited, commit)
+		}
+	}
+
+	for _, entry := range relevant {
+		if entry.Commit != "" && !inHistory[entry.Commit] {
+			report.Missing = append(report.Missing, entry)
+		}
+	}
+	return report
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAuditLog_RecordAndResume(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+
+	auditLog, err := OpenAuditLog(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_ = auditLog.Record(AuditEntry{Repo: "o/r", Action: "create", Path: "states/a/terraform.tfstate", Commit: "c1"})
+	_ = auditLog.Record(AuditEntry{Repo: "o/r", Action: "update", Path: "states/a/terraform.tfstate", Commit: "c2"})
+	_ = auditLog.Close()
+
+	// Reopening must continue the sequence
+	auditLog, err = OpenAuditLog(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_ = auditLog.Record(AuditEntry{Repo: "o/r", Action: "delete", Path: "states/a/terraform.tfstate", Commit: "c3"})
+	_ = auditLog.Close()
+
+	entries, err := ReadAuditLog(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 entries, got %d", len(entries))
+	}
+	for i, entry := range entries {
+		if entry.Seq != int64(i+1) {
+			t.Errorf("entry %d: expected seq %d, got %d", i, i+1, entry.Seq)
+		}
+		if entry.Time.IsZero() {
+			t.Errorf("entry %d: time not set", i)
+		}
+	}
+}
+
+func TestVerifyAudit(t *testing.T) {
+	adopted := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	commits := []CommitInfo{
+		{SHA: "manual", Created: adopted.Add(48 * time.Hour)},
+		{SHA: "backend", Created: adopted.Add(24 * time.Hour)},
+		{SHA: "legacy", Created: adopted.Add(-24 * time.Hour)},
+	}
+	entries := []AuditEntry{
+		{Seq: 1, Repo: "o/r", Path: "states/a/terraform.tfstate", Commit: "backend"},
+		{Seq: 2, Repo: "o/r", Path: "states/a/terraform.tfstate", Commit: "rewritten"},
+		{Seq: 3, Repo: "o/other", Path: "states/a/terraform.tfstate", Commit: "elsewhere"},
+		{Seq: 4, Repo: "o/r", Path: "unrelated/file", Commit: "elsewhere"},
+	}
+
+	report := VerifyAudit(commits, entries, "o/r", auditPrefixes(), adopted)
+
+	if report.OK() {
+		t.Fatal("expected discrepancies")
+	}
+	if len(report.Unaudited) != 1 || report.Unaudited[0].SHA != "manual" {
+		t.Errorf("expected only the manual commit to be unaudited, got %+v", report.Unaudited)
+	}
+	if len(report.Missing) != 1 || report.Missing[0].Commit != "rewritten" {
+		t.Errorf("expected only the rewritten commit to be missing, got %+v", report.Missing)
+	}
+}
+
+func TestVerifyAudit_Clean(t *testing.T) {
+	commits := []CommitInfo{{SHA: "c1"}, {SHA: "c2"}}
+	entries := []AuditEntry{
+		{Repo: "o/r", Path: "states/a/terraform.tfstate", Commit: "c1"},
+		{Repo: "o/r", Path: "archive/a/terraform.tfstate", Commit: "c2"},
+	}
+
+	if report := VerifyAudit(commits, entries, "o/r", auditPrefixes(), time.Time{}); !report.OK() {
+		t.Errorf("expected clean report, got %+v", report)
+	}
+}
+
+func TestParseDate(t *testing.T) {
+	if _, err := parseDate("2024-03-01"); err != nil {
+		t.Errorf("unexpected error for plain date: %v", err)
+	}
+	if _, err := parseDate("2024-03-01T10:00:00Z"); err != nil {
+		t.Errorf("unexpected error for RFC3339: %v", err)
+	}
+	if _, err := parseDate("yesterday"); err == nil {
+		t.Error("expected error for invalid date")
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// giteaBudget limits the Gitea API calls of every client of the primary
+// Gitea instance, if GITEA_API_BUDGET is set.
+var giteaBudget *APIBudget
+
+// Priorities of Gitea API calls under a budget.
+const (
+	PriorityForeground = "foreground" // Made while serving a request
+	PriorityBackground = "background" // Made by background jobs
+)
+
+// foregroundKey marks the contexts of requests being served.
+type foregroundKey struct{}
+
+// foregroundMiddleware marks the Gitea API calls made while serving a
+// request as foreground calls, which background jobs yield to.
+func foregroundMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), foregroundKey{}, true)))
+	})
+}
+
+// callPriority returns the priority of a Gitea API call made with ctx.
+func callPriority(ctx context.Context) string {
+	if foreground, _ := ctx.Value(foregroundKey{}).(bool); foreground {
+		return PriorityForeground
+	}
+	return PriorityBackground
+}
+
+// APIBudget is a token bucket limiting Gitea API calls per minute, so that
+// the backend cannot starve a Gitea instance it shares with people and CI.
+// The bucket holds ten seconds' worth of calls. Background calls leave the
+// bottom half of it to foreground ones, and wait while any foreground call
+// is waiting, so that a job listing every state does not hold up the plans
+// and applies served meanwhile.
+type APIBudget struct {
+	rate     float64 // Calls per second
+	capacity float64
+
+	mu      sync.Mutex
+	tokens  float64
+	last    time.Time
+	waiting int // Foreground calls waiting for a token
+	now     func() time.Time
+}
+
+// NewAPIBudget creates an APIBudget allowing perMinute calls a minute.
+func NewAPIBudget(perMinute int) *APIBudget {
+	capacity := max(2, float64(perMinute)/6)
+	return &APIBudget{
+		rate:     float64(perMinute) / 60,
+		capacity: capacity,
+		tokens:   capacity,
+		last:     time.Now(),
+		now:      time.Now,
+	}
+}
+
+// Wait blocks until a call made with ctx fits the budget, or ctx is done.
+func (b *APIBudget) Wait(ctx context.Context) error {
+	priority := callPriority(ctx)
+	reserve := 0.0
+	if priority == PriorityBackground {
+		reserve = b.capacity / 2
+	}
+
+	start := b.now()
+	queued := false
+	defer func() {
+		if queued {
+			b.mu.Lock()
+			b.waiting--
+			b.mu.Unlock()
+		}
+	}()
+	for {
+		b.mu.Lock()
+		b.refill()
+		yield := priority == PriorityBackground && b.waiting > 0
+		if b.tokens >= 1+reserve && !yield {
+			b.tokens--
+			b.mu.Unlock()
+			ObserveGiteaBudgetWait(priority, b.now().Sub(start))
+			return nil
+		}
+		if !queued && priority == PriorityForeground {
+			b.waiting++
+			queued = true
+		}
+		wait := time.Duration((1 + reserve - b.tokens) / b.rate * float64(time.Second))
+		if wait <= 0 {
+			wait = time.Duration(float64(time.Second) / b.rate)
+		}
+		b.mu.Unlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// Strained reports whether request traffic is using up the budget: foreground
+// calls are waiting, or have taken it into the reserve background calls
+// leave them.
+func (b *APIBudget) Strained() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill()
+	return b.waiting > 0 || b.tokens < b.capacity/2
+}
+
+// refill adds the tokens accrued since the last call. b.mu must be held.
+func (b *APIBudget) refill() {
+	now := b.now()
+	b.tokens = min(b.capacity, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// budgetTransport makes every request, retries included, wait for the budget.
+type budgetTransport struct {
+	next   http.RoundTripper
+	budget *APIBudget
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *budgetTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.budget.Wait(req.Context()); err != nil {
+		// Like any RoundTripper, close the body even when not sending it
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	return t.next.RoundTrip(req)
+}
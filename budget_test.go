@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func foregroundContext() context.Context {
+	return context.WithValue(context.Background(), foregroundKey{}, true)
+}
+
+func TestAPIBudget_WaitsForTokens(t *testing.T) {
+	budget := NewAPIBudget(6000) // 100 calls a second
+	budget.tokens = 0
+
+	start := time.Now()
+	if err := budget.Wait(foregroundContext()); err != nil {
+		t.Fatal(err)
+	}
+	if waited := time.Since(start); waited < 5*time.Millisecond {
+		t.Errorf("expected the call to wait for a token, waited %v", waited)
+	}
+
+	ctx, cancel := context.WithCancel(foregroundContext())
+	cancel()
+	budget.tokens = 0
+	if err := budget.Wait(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected a cancelled wait to fail, got %v", err)
+	}
+}
+
+func TestAPIBudget_BackgroundYields(t *testing.T) {
+	budget := NewAPIBudget(60)
+	budget.tokens = budget.capacity / 2
+
+	// The bottom half of the bucket is left to foreground calls
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := budget.Wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the background call to wait, got %v", err)
+	}
+	if err := budget.Wait(foregroundContext()); err != nil {
+		t.Errorf("expected the foreground call to go ahead, got %v", err)
+	}
+
+	// Background calls wait while a foreground call is waiting
+	budget.tokens = budget.capacity
+	budget.waiting = 1
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := budget.Wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the background call to yield, got %v", err)
+	}
+}
+
+func TestForegroundMiddleware(t *testing.T) {
+	var priority string
+	handler := foregroundMiddleware(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		priority = callPriority(r.Context())
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/network", nil))
+
+	if priority != PriorityForeground {
+		t.Errorf("expected requests to be served in the foreground, got %s", priority)
+	}
+	if got := callPriority(context.Background()); got != PriorityBackground {
+		t.Errorf("expected calls outside requests to be background calls, got %s", got)
+	}
+}
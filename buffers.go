@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"sync"
+)
+
+// A large state passes through several transient buffers per request: the
+// body as it is read, its indented and compressed forms, and the requests
+// sending it to Gitea. Growing a fresh buffer for each leaves garbage of
+// several times the state's size behind every write, which makes the heap
+// spike under concurrent writes of large states. Such buffers are pooled
+// instead; bytes that outlive the request are copied out at their exact size.
+
+// maxPooledBuffer is the capacity above which a buffer is dropped after use
+// rather than pooled, so that one outsized state does not keep its buffer
+// alive for the life of the process.
+const maxPooledBuffer = 64 << 20
+
+// streamBufferSize is the size of the buffers request bodies are streamed
+// through.
+const streamBufferSize = 64 << 10
+
+var (
+	bufferPool = sync.Pool{New: func() any { return new(bytes.Buffer) }}
+	writerPool = sync.Pool{New: func() any { return bufio.NewWriterSize(nil, streamBufferSize) }}
+)
+
+// pooledBytes returns what write writes to the buffer it is given, a pooled
+// one, copied out at its exact size.
+func pooledBytes(write func(b *bytes.Buffer) error) ([]byte, error) {
+	b, ok := bufferPool.Get().(*bytes.Buffer)
+	if !ok {
+		b = new(bytes.Buffer)
+	}
+	defer func() {
+		if b.Cap() <= maxPooledBuffer {
+			b.Reset()
+			bufferPool.Put(b)
+		}
+	}()
+	if err := write(b); err != nil {
+		return nil, err
+	}
+	return append(make([]byte, 0, b.Len()), b.Bytes()...), nil
+}
+
+// readAllSized reads r to the end. If its size is known, the bytes are read
+// into a buffer of that size; otherwise through a pooled buffer, rather than
+// one that grows as it fills, holding up to twice a large state in memory
+// and leaving the smaller copies as garbage.
+func readAllSized(r io.Reader, size int64) ([]byte, error) {
+	if size <= 0 {
+		return pooledBytes(func(b *bytes.Buffer) error {
+			_, err := b.ReadFrom(r)
+			return err
+		})
+	}
+	// ReadFrom grows a buffer without MinRead bytes to spare before reading EOF
+	buf := bytes.NewBuffer(make([]byte, 0, size+bytes.MinRead))
+	_, err := buf.ReadFrom(r)
+	return buf.Bytes(), err
+}
+
+// withPooledWriter calls write with a pooled buffered writer to w, and
+// flushes it afterwards.
+func withPooledWriter(w io.Writer, write func(w io.Writer) error) error {
+	bw, ok := writerPool.Get().(*bufio.Writer)
+	if !ok {
+		bw = bufio.NewWriterSize(w, streamBufferSize)
+	}
+	bw.Reset(w)
+	defer func() {
+		bw.Reset(nil)
+		writerPool.Put(bw)
+	}()
+	if err := write(bw); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
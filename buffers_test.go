@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestPooledBytes_CopiesOut(t *testing.T) {
+	first, err := pooledBytes(func(b *bytes.Buffer) error {
+		_, err := b.WriteString("first")
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The buffer is reused without affecting the bytes returned before
+	for range 3 {
+		if _, err := pooledBytes(func(b *bytes.Buffer) error {
+			if b.Len() != 0 {
+				t.Errorf("expected a pooled buffer to be empty, got %q", b.String())
+			}
+			_, err := b.WriteString("overwritten")
+			return err
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if string(first) != "first" || cap(first) != len(first) {
+		t.Errorf("expected an exact copy, got %q with capacity %d", first, cap(first))
+	}
+}
+
+func TestReadAllSized(t *testing.T) {
+	content := strings.Repeat("x", 100000)
+	for _, size := range []int64{-1, 0, int64(len(content)), 10} {
+		got, err := readAllSized(strings.NewReader(content), size)
+		if err != nil {
+			t.Fatalf("size %d: unexpected error: %v", size, err)
+		}
+		if string(got) != content {
+			t.Errorf("size %d: expected the whole content, got %d bytes", size, len(got))
+		}
+	}
+}
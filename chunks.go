@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// stateChunkSize is the size above which state files are split into chunks,
+// set from STATE_CHUNK_SIZE_MB; 0 never splits them.
+var stateChunkSize int
+
+// chunkManifestPrefix starts a chunk manifest, which is stored in place of a
+// state file split into chunks. No tfstate starts like this.
+var chunkManifestPrefix = []byte(`{"chunked_state":`)
+
+// errChunksChanged is returned when a state's chunks do not add up to its
+// manifest, as when they were read while a commit replaced them.
+var errChunksChanged = errors.New("state chunks do not match their manifest")
+
+// chunkManifest describes a state file split into chunks.
+type chunkManifest struct {
+	Version int    `json:"chunked_state"` // Format version, 1
+	Chunks  int    `json:"chunks"`
+	Size    int    `json:"size"`   // Of the state file as stored, reassembled
+	SHA256  string `json:"sha256"` // Of the state file as stored, reassembled
+}
+
+// chunkPath returns the path of the i-th chunk of the named state's file.
+func chunkPath(name string, i int) string {
+	return sidecarPath(name, fmt.Sprintf("chunk-%03d", i))
+}
+
+// parseChunkManifest returns the manifest stored in place of a chunked state
+// file, or false if stored is the state file itself.
+func parseChunkManifest(stored []byte) (*chunkManifest, bool) {
+	if !bytes.HasPrefix(stored, chunkManifestPrefix) {
+		return nil, false
+	}
+	var m chunkManifest
+	if err := json.Unmarshal(stored, &m); err != nil || m.Version != 1 || m.Chunks <= 0 {
+		return nil, false
+	}
+	return &m, true
+}
+
+// chunkChanges returns the file changes storing stored, the state file as it
+// is to be committed: as is, or split into chunks of stateChunkSize with a
+// manifest in its place. Chunks of the current version that are no longer
+// needed are deleted. Git stores unchanged chunks only once, so a large state
+// that changes in one place grows the repository by about one chunk.
+func chunkChanges(name string, stored []byte, current *storedState) ([]FileChange, error) {
+	state := FileChange{Path: statePath(name), Content: stored, SHA: current.sha, Create: !current.exists}
+	chunks := 0
+	var chunkFiles []FileChange
+	if stateChunkSize > 0 && len(stored) > stateChunkSize {
+		chunks = (len(stored) + stateChunkSize - 1) / stateChunkSize
+		manifest, err := json.Marshal(chunkManifest{Version: 1, Chunks: chunks, Size: len(stored), SHA256: stateChecksum(stored)})
+		if err != nil {
+			return nil, err
+		}
+		state.Content = manifest
+		for i := range chunks {
+			chunk := stored[i*stateChunkSize : min(len(stored), (i+1)*stateChunkSize)]
+			chunkFiles = append(chunkFiles, FileChange{Path: chunkPath(name, i), Content: chunk})
+		}
+	}
+	for i := chunks; i < current.chunks; i++ {
+		chunkFiles = append(chunkFiles, FileChange{Path: chunkPath(name, i)})
+	}
+	return append([]FileChange{state}, chunkFiles...), nil
+}
+
+// chunkDeletions returns the file changes deleting the chunks of a state
+// file stored as stored.
+func chunkDeletions(name string, stored []byte) []FileChange {
+	m, ok := parseChunkManifest(stored)
+	if !ok {
+		return nil
+	}
+	changes := make([]FileChange, m.Chunks)
+	for i := range changes {
+		changes[i] = FileChange{Path: chunkPath(name, i)}
+	}
+	return changes
+}
+
+// joinChunks returns the named state's file as stored, reassembled from its
+// chunks if stored is a chunk manifest, with the number of chunks.
+func joinChunks(ctx context.Context, storage StateStorage, name string, stored []byte) ([]byte, int, error) {
+	m, ok := parseChunkManifest(stored)
+	if !ok {
+		return stored, 0, nil
+	}
+	joined := make([]byte, 0, m.Size)
+	for i := range m.Chunks {
+		chunk, _, err := storage.GetFile(ctx, chunkPath(name, i))
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to read chunk %d of state %s: %w", i, name, err)
+		}
+		joined = append(joined, chunk...)
+	}
+	if len(joined) != m.Size || stateChecksum(joined) != m.SHA256 {
+		return nil, 0, fmt.Errorf("%w: %s", errChunksChanged, name)
+	}
+	return joined, m.Chunks, nil
+}
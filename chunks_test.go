@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// withStateChunkSize splits states written in the test into chunks of size bytes.
+func withStateChunkSize(t *testing.T, size int) {
+	t.Helper()
+	previous := stateChunkSize
+	t.Cleanup(func() { stateChunkSize = previous })
+	stateChunkSize = size
+}
+
+// largeState returns a state of about size bytes.
+func largeState(serial, size int) string {
+	return fmt.Sprintf(`{"version":4,"serial":%d,"lineage":"abc","outputs":{"padding":{"value":"%s","type":"string"}}}`, serial, strings.Repeat("x", size))
+}
+
+func TestStateChunks_RoundTrip(t *testing.T) {
+	withStateChunkSize(t, 100)
+	storage := newTestLocalGitClient(t)
+	handler := NewStateHandler(storage, DefaultMaxBodySize)
+	ctx := context.Background()
+
+	postState(t, handler, largeState(1, 350))
+	stored, _, _ := storage.GetFile(ctx, statePath("network"))
+	m, ok := parseChunkManifest(stored)
+	if !ok || m.Chunks < 4 {
+		t.Fatalf("expected a manifest of at least 4 chunks in place of the state, got %s", stored)
+	}
+	if chunk, _, _ := storage.GetFile(ctx, chunkPath("network", m.Chunks-1)); chunk == nil {
+		t.Fatalf("expected the last chunk to be stored")
+	}
+
+	w := serve(handler, http.MethodGet, "/network")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), strings.Repeat("x", 350)) {
+		t.Fatalf("expected the reassembled state, got %d: %.100s", w.Code, w.Body.String())
+	}
+
+	// The serial check reads the chunked state
+	if w := serveAs(handler, http.MethodPost, "/network", "", largeState(0, 350)); w.Code != http.StatusConflict {
+		t.Errorf("expected a serial regression to be detected, got %d", w.Code)
+	}
+
+	// A state that fits again is stored as is, and its chunks are deleted
+	postState(t, handler, `{"version":4,"serial":2,"lineage":"abc"}`)
+	if stored, _, _ := storage.GetFile(ctx, statePath("network")); !strings.Contains(string(stored), `"serial": 2`) {
+		t.Errorf("expected the state file itself, got %s", stored)
+	}
+	for i := range m.Chunks {
+		if chunk, _, _ := storage.GetFile(ctx, chunkPath("network", i)); chunk != nil {
+			t.Errorf("expected chunk %d to be deleted", i)
+		}
+	}
+}
+
+func TestStateChunks_Changed(t *testing.T) {
+	withStateChunkSize(t, 100)
+	storage := newTestLocalGitClient(t)
+	handler := NewStateHandler(storage, DefaultMaxBodySize)
+	handler.verifyReads = false
+	postState(t, handler, largeState(1, 350))
+
+	if err := storage.CreateOrUpdateFile(context.Background(), chunkPath("network", 1), []byte("tampered"), "manual edit"); err != nil {
+		t.Fatal(err)
+	}
+	if w := serve(handler, http.MethodGet, "/network"); w.Code != http.StatusInternalServerError {
+		t.Errorf("expected chunks not matching their manifest to fail the read, got %d", w.Code)
+	}
+}
+
+func TestStateChunks_Delete(t *testing.T) {
+	withStateChunkSize(t, 100)
+	storage := newTestLocalGitClient(t)
+	handler := NewStateHandler(storage, DefaultMaxBodySize)
+	handler.deleter = NewStateDeleter(storage, 0, handler.IsLocked)
+	postState(t, handler, largeState(1, 350))
+
+	if w := serve(handler, http.MethodDelete, "/network?confirm=network"); w.Code >= 300 {
+		t.Fatalf("expected the state to be deleted, got %d: %s", w.Code, w.Body.String())
+	}
+	files, err := storage.ListFiles(layout.prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Errorf("expected the state to be deleted with its chunks, got %v", files)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// minClientBurst is the least number of requests a client may make at once:
+// enough for the GET, LOCK, POST and UNLOCK of one Terraform apply.
+const minClientBurst = 5
+
+// unlimitedPaths are the paths served without touching the storage, which
+// monitoring polls. They are never rate-limited or shed.
+var unlimitedPaths = []string{"/health", "/ready", "/metrics", "/docs"}
+
+// unlimited reports whether path is served without limits.
+func unlimited(path string) bool {
+	for _, p := range unlimitedPaths {
+		if path == p || strings.HasPrefix(path, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientLimiter limits the requests each client makes per minute, so that
+// runaway automation, such as a CI loop planning on every commit, cannot
+// flood a small Gitea instance through the backend. Clients are told apart
+// by the token they authenticate with, or by their address when they
+// present no valid token or authentication is disabled. Each has a token
+// bucket holding ten seconds' worth of requests, at least minClientBurst;
+// requests beyond it get a 429 with a Retry-After, which Terraform waits for
+// before retrying.
+type ClientLimiter struct {
+	authenticates func(token string) bool // Whether a token is valid; nil tells clients apart by address
+
+	mu        sync.Mutex
+	perMinute int
+	rate      float64 // Requests per second; 0 is unlimited
+	capacity  float64
+	clients   map[string]*clientBucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// clientBucket is the token bucket of one client.
+type clientBucket struct {
+	tokens  float64
+	last    time.Time
+	limited bool // The last request was refused
+}
+
+// NewClientLimiter creates a ClientLimiter allowing perMinute requests a
+// minute per client, unlimited if 0. Clients presenting a token for which
+// authenticates returns true are told apart by it.
+func NewClientLimiter(perMinute int, authenticates func(token string) bool) *ClientLimiter {
+	l := &ClientLimiter{
+		authenticates: authenticates,
+		clients:       make(map[string]*clientBucket),
+		lastSweep:     time.Now(),
+		now:           time.Now,
+	}
+	l.SetLimit(perMinute)
+	return l
+}
+
+// SetLimit changes the requests allowed per minute per client, unlimited if
+// 0. Clients keep the requests left in their buckets, up to the new burst.
+func (l *ClientLimiter) SetLimit(perMinute int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.perMinute = perMinute
+	l.rate = float64(perMinute) / 60
+	l.capacity = max(minClientBurst, float64(perMinute)/6)
+}
+
+// clientKey returns the key r is limited by: a hash of its token, so that
+// tokens are not kept in memory, or its address. Only valid tokens count, so
+// that made-up ones neither escape the limit nor fill the buckets.
+func (l *ClientLimiter) clientKey(r *http.Request) string {
+	if l.authenticates != nil {
+		token := ""
+		if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+			token = strings.TrimPrefix(auth, "Bearer ")
+		} else if _, password, ok := r.BasicAuth(); ok {
+			token = password
+		}
+		if token != "" && l.authenticates(token) {
+			sum := sha256.Sum256([]byte(token))
+			return "token:" + hex.EncodeToString(sum[:8])
+		}
+	}
+	addr := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	return "addr:" + addr
+}
+
+// Allow takes a request from the bucket of the client key, and returns how
+// long it must wait otherwise.
+func (l *ClientLimiter) Allow(key string) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate == 0 {
+		return 0, true
+	}
+	now := l.now()
+	l.sweep(now)
+
+	b, ok := l.clients[key]
+	if !ok {
+		b = &clientBucket{tokens: l.capacity, last: now}
+		l.clients[key] = b
+	}
+	b.tokens = min(l.capacity, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		b.limited = false
+		return 0, true
+	}
+	if !b.limited {
+		slog.Warn("Client exceeds the request rate limit; refusing its requests until it slows down", "client", key)
+		b.limited = true
+	}
+	return time.Duration((1 - b.tokens) / l.rate * float64(time.Second)), false
+}
+
+// Budget returns the requests allowed per minute per client, 0 if
+// unlimited, and how many the client of r can still make at once.
+func (l *ClientLimiter) Budget(r *http.Request) (perMinute, remaining int) {
+	key := l.clientKey(r)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate == 0 {
+		return 0, 0
+	}
+	tokens := l.capacity
+	if b, ok := l.clients[key]; ok {
+		tokens = min(l.capacity, b.tokens+l.now().Sub(b.last).Seconds()*l.rate)
+	}
+	return l.perMinute, int(tokens)
+}
+
+// sweep drops the buckets of the clients that have been idle long enough for
+// them to be full again, at most once a minute. l.mu must be held.
+func (l *ClientLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	full := time.Duration(l.capacity / l.rate * float64(time.Second))
+	for key, b := range l.clients {
+		if now.Sub(b.last) >= full {
+			delete(l.clients, key)
+		}
+	}
+}
+
+// Middleware refuses the requests of clients over their limit with a 429.
+func (l *ClientLimiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if unlimited(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		wait, ok := l.Allow(l.clientKey(r))
+		if !ok {
+			seconds := max(1, int(math.Ceil(wait.Seconds())))
+			w.Header().Set("Retry-After", strconv.Itoa(seconds))
+			writeError(w, fmt.Errorf("%w: retry in %ds", ErrRateLimited, seconds))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
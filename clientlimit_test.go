@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// validTokens accepts the tokens the tests of ClientLimiter authenticate with.
+func validTokens(token string) bool {
+	return strings.HasPrefix(token, "token-")
+}
+
+func TestClientLimiter_LimitsEachClient(t *testing.T) {
+	now := time.Now()
+	limiter := NewClientLimiter(60, validTokens)
+	limiter.now = func() time.Time { return now }
+	handler := limiter.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	// The burst of a client is ten seconds' worth of requests
+	for i := range 10 {
+		if rec := serveAs(handler, http.MethodGet, "/myproject", "token-a", ""); rec.Code != http.StatusOK {
+			t.Fatalf("request %d: expected 200, got %d", i, rec.Code)
+		}
+	}
+	rec := serveAs(handler, http.MethodGet, "/myproject", "token-a", "")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429 beyond the burst, got %d", rec.Code)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "1" {
+		t.Errorf("expected Retry-After 1, got %q", got)
+	}
+
+	// Other clients and unlimited paths are not held back
+	if rec := serveAs(handler, http.MethodGet, "/myproject", "token-b", ""); rec.Code != http.StatusOK {
+		t.Errorf("expected another token to be allowed, got %d", rec.Code)
+	}
+	if rec := serveAs(handler, http.MethodGet, "/health", "token-a", ""); rec.Code != http.StatusOK {
+		t.Errorf("expected /health not to be limited, got %d", rec.Code)
+	}
+
+	now = now.Add(time.Second)
+	if rec := serveAs(handler, http.MethodGet, "/myproject", "token-a", ""); rec.Code != http.StatusOK {
+		t.Errorf("expected a request once the bucket refilled, got %d", rec.Code)
+	}
+}
+
+func TestClientLimiter_KeysByAddressWithoutAuth(t *testing.T) {
+	limiter := NewClientLimiter(1, nil)
+	key := func(token, addr string) string {
+		req := httptest.NewRequest(http.MethodGet, "/myproject", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.RemoteAddr = addr
+		return limiter.clientKey(req)
+	}
+	if key("a", "10.0.0.1:1234") != key("b", "10.0.0.1:5678") {
+		t.Error("expected tokens to be ignored when authentication is disabled")
+	}
+	if key("a", "10.0.0.1:1234") == key("a", "10.0.0.2:1234") {
+		t.Error("expected addresses to be told apart")
+	}
+
+	limiter.authenticates = validTokens
+	if key("token-a", "10.0.0.1:1234") == key("token-b", "10.0.0.1:1234") {
+		t.Error("expected tokens to be told apart")
+	}
+}
+
+func TestClientLimiter_KeysInvalidTokensByAddress(t *testing.T) {
+	limiter := NewClientLimiter(60, validTokens)
+	handler := limiter.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	// Made-up tokens share the bucket of their address
+	for i := range 10 {
+		if rec := serveAs(handler, http.MethodGet, "/myproject", fmt.Sprintf("bogus-%d", i), ""); rec.Code != http.StatusOK {
+			t.Fatalf("request %d: expected 200, got %d", i, rec.Code)
+		}
+	}
+	if rec := serveAs(handler, http.MethodGet, "/myproject", "bogus-10", ""); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("expected 429 for another made-up token, got %d", rec.Code)
+	}
+	if len(limiter.clients) != 1 {
+		t.Errorf("expected 1 client, got %d", len(limiter.clients))
+	}
+	if rec := serveAs(handler, http.MethodGet, "/myproject", "token-a", ""); rec.Code != http.StatusOK {
+		t.Errorf("expected a valid token to have its own bucket, got %d", rec.Code)
+	}
+}
+
+func TestClientLimiter_DropsIdleClients(t *testing.T) {
+	now := time.Now()
+	limiter := NewClientLimiter(60, validTokens)
+	limiter.now = func() time.Time { return now }
+	limiter.Allow("token:a")
+
+	now = now.Add(2 * time.Minute)
+	limiter.Allow("token:b")
+	if _, ok := limiter.clients["token:a"]; ok {
+		t.Error("expected the idle client to be dropped")
+	}
+	if len(limiter.clients) != 1 {
+		t.Errorf("expected 1 client, got %d", len(limiter.clients))
+	}
+}
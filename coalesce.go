@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Commits of spooled writes started by the coalescer itself, at the end of
+// the window, give up after spooledCommitTimeout, and are retried
+// maxSpooledCommitAttempts times in all. A write that still is not committed
+// stays spooled, and is committed with the lock holder's next write, its
+// unlock or the next start, which report the error if it persists.
+const (
+	spooledCommitTimeout     = time.Minute
+	maxSpooledCommitAttempts = 5
+)
+
+// WriteCoalescer turns state writes that a lock holder makes in quick
+// succession into fewer commits. A write made within the window after the
+// holder's previous commit is spooled to disk instead of committed, and only
+// the latest spooled content is committed when the window ends, or earlier
+// when the lock is released. Spooled writes are durable: they are fsynced
+// before the write is acknowledged and committed on the next start if the
+// backend stops before committing them.
+type WriteCoalescer struct {
+	window time.Duration
+	dir    string
+	lock   func(ctx context.Context, name string) (func(), error) // Serializes the commit with the state's other writes
+	commit func(ctx context.Context, name, lockID string, content []byte) error
+
+	flushMu sync.Mutex // Serializes commits of spooled writes
+
+	mu         sync.Mutex
+	pending    map[string]*spooledWrite // keyed by state name
+	lastCommit map[string]lockCommit    // Last commit made under a lock, keyed by state name
+}
+
+// spooledWrite is a write waiting to be committed, in its on-disk format.
+type spooledWrite struct {
+	Name    string `json:"name"`
+	LockID  string `json:"lock_id"`
+	Content []byte `json:"content"`
+
+	seq      int         // Incremented by every write spooled over this one
+	timer    *time.Timer // Commits the write at the end of the window
+	attempts int         // Failed commits started by the timer
+}
+
+// lockCommit records when a state was last committed under a lock.
+type lockCommit struct {
+	lockID string
+	at     time.Time
+}
+
+// NewWriteCoalescer creates a WriteCoalescer spooling to dir, which is
+// created if needed. commit saves a state, and is called by the coalescer
+// holding the state as locked by lock; writes spooled before a restart are
+// committed with it right away.
+func NewWriteCoalescer(window time.Duration, dir string, lock func(ctx context.Context, name string) (func(), error), commit func(ctx context.Context, name, lockID string, content []byte) error) (*WriteCoalescer, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create spool directory: %w", err)
+	}
+	c := &WriteCoalescer{
+		window:     window,
+		dir:        dir,
+		lock:       lock,
+		commit:     commit,
+		pending:    make(map[string]*spooledWrite),
+		lastCommit: make(map[string]lockCommit),
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read spool directory: %w", err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read spooled write: %w", err)
+		}
+		var write spooledWrite
+		if err := json.Unmarshal(data, &write); err != nil || write.Name == "" {
+			return nil, fmt.Errorf("invalid spooled write %s", entry.Name())
+		}
+		slog.Info("Committing write spooled before the restart", "state", write.Name)
+		c.pending[write.Name] = &write
+		c.schedule(&write, 0)
+	}
+	return c, nil
+}
+
+// spoolPath returns the path of the spool file of the named state.
+func (c *WriteCoalescer) spoolPath(name string) string {
+	return filepath.Join(c.dir, url.PathEscape(name)+".json")
+}
+
+// Defer spools a write of body to the named state if lockID committed it
+// within the window, or already has a write spooled. It returns false if the
+// write is to be committed directly. It is safe to call on a nil coalescer.
+func (c *WriteCoalescer) Defer(name, lockID string, body []byte) (bool, error) {
+	if c == nil || lockID == "" {
+		return false, nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.defersLocked(name, lockID) {
+		return false, nil
+	}
+	write := c.pending[name]
+	if write == nil {
+		write = &spooledWrite{Name: name, LockID: lockID}
+	}
+
+	next := *write
+	next.Content = indentState(body)
+	data, err := json.Marshal(&next)
+	if err != nil {
+		return false, err
+	}
+	if err := writeFileSync(c.spoolPath(name), data); err != nil {
+		return false, fmt.Errorf("failed to spool write: %w", err)
+	}
+
+	if c.pending[name] == nil {
+		c.pending[name] = write
+		c.schedule(write, c.window-time.Since(c.lastCommit[name].at))
+	}
+	write.Content = next.Content
+	write.seq++
+	IncrementCoalescedWrites()
+	return true, nil
+}
+
+// Defers reports whether a write of lockID to the named state would be
+// spooled by Defer now. It is safe to call on a nil coalescer.
+func (c *WriteCoalescer) Defers(name, lockID string) bool {
+	if c == nil || lockID == "" {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.defersLocked(name, lockID)
+}
+
+// defersLocked reports whether a write of lockID to the named state is
+// spooled. Must be called with c.mu held.
+func (c *WriteCoalescer) defersLocked(name, lockID string) bool {
+	if write := c.pending[name]; write != nil {
+		// A write that could not be committed is retried with the next one
+		return write.LockID == lockID && write.attempts < maxSpooledCommitAttempts
+	}
+	last, ok := c.lastCommit[name]
+	return ok && last.lockID == lockID && time.Since(last.at) < c.window
+}
+
+// Committed records that lockID committed the named state directly, starting
+// a window in which its further writes are spooled. It is safe to call on a
+// nil coalescer.
+func (c *WriteCoalescer) Committed(name, lockID string) {
+	if c == nil || lockID == "" {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastCommit[name] = lockCommit{lockID: lockID, at: time.Now()}
+}
+
+// Content returns the spooled content of the named state, if a write is
+// waiting to be committed. It is safe to call on a nil coalescer.
+func (c *WriteCoalescer) Content(name string) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if write, ok := c.pending[name]; ok {
+		return write.Content, true
+	}
+	return nil, false
+}
+
+// schedule commits write after delay, retrying up to
+// maxSpooledCommitAttempts times. Must be called with c.mu held.
+func (c *WriteCoalescer) schedule(write *spooledWrite, delay time.Duration) {
+	write.timer = time.AfterFunc(delay, func() {
+		err := c.lockedFlush(write.Name)
+		if err == nil {
+			return
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.pending[write.Name] != write {
+			return
+		}
+		if write.attempts++; write.attempts >= maxSpooledCommitAttempts {
+			slog.Error("Error committing spooled write; giving up until the lock holder writes or unlocks, or the next start",
+				"state", write.Name, "lock_id", write.LockID, "attempts", write.attempts, "error", err)
+			return
+		}
+		slog.Error("Error committing spooled write; retrying", "state", write.Name, "delay", c.window, "attempts", write.attempts, "error", err)
+		c.schedule(write, c.window)
+	})
+}
+
+// lockedFlush commits the spooled write to the named state holding the
+// state's lock, within spooledCommitTimeout.
+func (c *WriteCoalescer) lockedFlush(name string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), spooledCommitTimeout)
+	defer cancel()
+	release, err := c.lock(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return c.Flush(ctx, name)
+}
+
+// Flush commits the spooled write to the named state, if any. The caller
+// must hold the state's lock. It is safe to call on a nil coalescer.
+func (c *WriteCoalescer) Flush(ctx context.Context, name string) error {
+	if c == nil {
+		return nil
+	}
+	c.flushMu.Lock()
+	defer c.flushMu.Unlock()
+
+	c.mu.Lock()
+	write, ok := c.pending[name]
+	if !ok {
+		c.mu.Unlock()
+		return nil
+	}
+	lockID, content, seq := write.LockID, write.Content, write.seq
+	c.mu.Unlock()
+
+	if err := c.commit(ctx, name, lockID, content); err != nil {
+		IncrementSpooledCommitFailures()
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastCommit[name] = lockCommit{lockID: lockID, at: time.Now()}
+	write.timer.Stop()
+	write.attempts = 0
+	if write.seq != seq {
+		// Written again while committing; the newer content gets its own window
+		c.schedule(write, c.window)
+		return nil
+	}
+	delete(c.pending, name)
+	if err := os.Remove(c.spoolPath(name)); err != nil {
+		slog.Error("Error removing spooled write", "state", name, "error", err)
+	}
+	return nil
+}
+
+// FlushAll commits all spooled writes, for a clean shutdown. Writes that
+// cannot be committed stay spooled for the next start. It is safe to call on
+// a nil coalescer.
+func (c *WriteCoalescer) FlushAll(ctx context.Context) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	names := make([]string, 0, len(c.pending))
+	for name := range c.pending {
+		names = append(names, name)
+	}
+	c.mu.Unlock()
+
+	for _, name := range names {
+		release, err := c.lock(ctx, name)
+		if err == nil {
+			err = c.Flush(ctx, name)
+			release()
+		}
+		if err != nil {
+			slog.Error("Error committing spooled write; it is committed on the next start", "state", name, "error", err)
+		}
+	}
+}
+
+// writeFileSync replaces the file at path with data, which is on disk when it
+// returns.
+func writeFileSync(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
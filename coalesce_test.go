@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestWriteCoalescing(t *testing.T) {
+	handler, mock := newTestHandler()
+	dir := t.TempDir()
+	coalescer, err := NewWriteCoalescer(time.Hour, dir, handler.writes.Lock, handler.commitSpooled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler.coalescer = coalescer
+
+	send := func(method, target, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Lock-Id", "lock-1")
+		handler.ServeHTTP(w, req)
+		return w
+	}
+	stored := func() *uint64 {
+		header, err := parseStateHeader(mock.files[statePath("myproject")])
+		if err != nil {
+			t.Fatalf("expected a stored state: %v", err)
+		}
+		return header.Serial
+	}
+
+	send("LOCK", "/myproject", `{"ID":"lock-1"}`)
+	for serial := 1; serial <= 3; serial++ {
+		w := send(http.MethodPost, "/myproject", fmt.Sprintf(`{"version":4,"serial":%d,"lineage":"abc"}`, serial))
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+	}
+
+	// Only the first write is committed; reads see the latest one
+	if serial := stored(); *serial != 1 {
+		t.Errorf("expected serial 1 to be committed, got %d", *serial)
+	}
+	header, _ := parseStateHeader(serve(handler, http.MethodGet, "/myproject").Body.Bytes())
+	if header == nil || *header.Serial != 3 {
+		t.Errorf("expected reads to return serial 3, got %+v", header)
+	}
+
+	// Unlocking commits the latest write
+	if w := send("UNLOCK", "/myproject", `{"ID":"lock-1"}`); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+	if serial := stored(); *serial != 3 {
+		t.Errorf("expected serial 3 to be committed, got %d", *serial)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("expected the spool to be empty, got %d files", len(entries))
+	}
+}
+
+func TestWriteCoalescer_CommitsSpoolAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+	noCommit := func(context.Context, string, string, []byte) error { return nil }
+	coalescer, err := NewWriteCoalescer(time.Hour, dir, NewStateMutex().Lock, noCommit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	coalescer.Committed("network/prod", "lock-1")
+	if deferred, err := coalescer.Defer("network/prod", "lock-1", []byte(`{"serial":2}`)); !deferred || err != nil {
+		t.Fatalf("expected the write to be deferred, got %v, %v", deferred, err)
+	}
+
+	committed := make(chan string, 1)
+	_, err = NewWriteCoalescer(time.Hour, dir, NewStateMutex().Lock, func(_ context.Context, name, lockID string, content []byte) error {
+		committed <- name + " " + lockID + " " + string(content)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-committed:
+		if got != "network/prod lock-1 {\n  \"serial\": 2\n}" {
+			t.Errorf("unexpected commit %q", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the spooled write to be committed on start")
+	}
+}
+
+func TestWriteCoalescing_ChecksSerialBeforeSpooling(t *testing.T) {
+	handler, mock := newTestHandler()
+	coalescer, err := NewWriteCoalescer(time.Hour, t.TempDir(), handler.writes.Lock, handler.commitSpooled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler.coalescer = coalescer
+
+	send := func(target string, serial int) int {
+		req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(fmt.Sprintf(`{"version":4,"serial":%d,"lineage":"abc"}`, serial)))
+		req.Header.Set("Lock-Id", "lock-1")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+	handler.locks["myproject"] = LockInfo{ID: "lock-1"}
+	if code := send("/myproject", 5); code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", code)
+	}
+	if code := send("/myproject", 7); code != http.StatusOK {
+		t.Fatalf("expected the write to be spooled, got %d", code)
+	}
+
+	// Older serials are refused against the spooled write, unless forced
+	if code := send("/myproject", 6); code != http.StatusConflict {
+		t.Errorf("expected status 409 for a serial behind the spooled write, got %d", code)
+	}
+	if code := send("/myproject?force=true", 6); code != http.StatusOK {
+		t.Errorf("expected a forced write to be spooled, got %d", code)
+	}
+	if content, _ := coalescer.Content("myproject"); !strings.Contains(string(content), `"serial": 6`) {
+		t.Errorf("expected the forced write to be spooled, got %s", content)
+	}
+	if header, _ := parseStateHeader(mock.files[statePath("myproject")]); header == nil || *header.Serial != 5 {
+		t.Errorf("expected serial 5 to stay committed, got %+v", header)
+	}
+}
+
+func TestWriteCoalescer_FlushesHoldingStateLock(t *testing.T) {
+	writes := NewStateMutex()
+	committed := make(chan struct{}, 1)
+	coalescer, err := NewWriteCoalescer(10*time.Millisecond, t.TempDir(), writes.Lock, func(context.Context, string, string, []byte) error {
+		committed <- struct{}{}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A write in flight holds the state
+	release, err := writes.Lock(context.Background(), "network")
+	if err != nil {
+		t.Fatal(err)
+	}
+	coalescer.Committed("network", "lock-1")
+	if deferred, err := coalescer.Defer("network", "lock-1", []byte(`{"serial":2}`)); !deferred || err != nil {
+		t.Fatalf("expected the write to be deferred, got %v, %v", deferred, err)
+	}
+	select {
+	case <-committed:
+		t.Fatal("expected the commit to wait for the write in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	release()
+	select {
+	case <-committed:
+	case <-time.After(time.Second):
+		t.Fatal("expected the spooled write to be committed")
+	}
+}
+
+func TestWriteCoalescer_GivesUpAfterAttempts(t *testing.T) {
+	var attempts atomic.Int32
+	coalescer, err := NewWriteCoalescer(time.Millisecond, t.TempDir(), NewStateMutex().Lock, func(context.Context, string, string, []byte) error {
+		attempts.Add(1)
+		return errors.New("gitea is down")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	failures := testutil.ToFloat64(spooledCommitFailuresTotal)
+	coalescer.Committed("network", "lock-1")
+	if deferred, _ := coalescer.Defer("network", "lock-1", []byte(`{"serial":2}`)); !deferred {
+		t.Fatal("expected the write to be deferred")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if n := attempts.Load(); n != maxSpooledCommitAttempts {
+		t.Errorf("expected %d attempts, got %d", maxSpooledCommitAttempts, n)
+	}
+	if got := testutil.ToFloat64(spooledCommitFailuresTotal) - failures; got != maxSpooledCommitAttempts {
+		t.Errorf("expected %d failures counted, got %v", maxSpooledCommitAttempts, got)
+	}
+
+	// The write stays spooled, and the next one is committed directly after it
+	if _, ok := coalescer.Content("network"); !ok {
+		t.Error("expected the write to stay spooled")
+	}
+	if coalescer.Defers("network", "lock-1") {
+		t.Error("expected the next write not to be spooled over it")
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// auditPrefixes returns the repository paths written by the backend.
+func auditPrefixes() []string {
+	return []string{layout.prefix, "archive/"}
+}
+
+// runCommand executes a CLI subcommand and returns the process exit code.
+func runCommand(args []string) int {
+	switch {
+	case len(args) >= 2 && args[0] == "audit" && args[1] == "verify":
+		return runAuditVerify(args[2:], os.Stdout, os.Stderr)
+	case len(args) == 2 && args[0] == "config" && args[1] == "schema":
+		return runConfigSchema(os.Stdout)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command: %s\n", strings.Join(args, " "))
+		fmt.Fprintln(os.Stderr, "usage: gitea-tf-backend audit verify [-since YYYY-MM-DD] [-json]")
+		fmt.Fprintln(os.Stderr, "       gitea-tf-backend config schema")
+		return 2
+	}
+}
+
+// runConfigSchema prints the JSON Schema of the configuration, for checking
+// it into a Helm chart as values.schema.json or pointing an editor at.
+func runConfigSchema(stdout io.Writer) int {
+	encoder := json.NewEncoder(stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(configSchema()); err != nil {
+		return 2
+	}
+	return 0
+}
+
+// runAuditVerify cross-checks the state repository history against the audit log.
+// Exits 0 if they agree, 1 if discrepancies were found and 2 on error.
+func runAuditVerify(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("audit verify", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	sinceFlag := flags.String("since", "", "ignore commits before this date (YYYY-MM-DD or RFC3339)")
+	jsonFlag := flags.Bool("json", false, "print the report as JSON")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	var since time.Time
+	if *sinceFlag != "" {
+		var err error
+		if since, err = parseDate(*sinceFlag); err != nil {
+			fmt.Fprintf(stderr, "invalid -since: %v\n", err)
+			return 2
+		}
+	}
+
+	cfg, err := LoadConfig()
+	if err == nil {
+		err = useStatePathTemplate(cfg.StatePathTemplate)
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "Failed to load configuration: %v\n", err)
+		return 2
+	}
+	if cfg.AuditLogFile == "" {
+		fmt.Fprintln(stderr, "AUDIT_LOG_FILE is required for audit verify")
+		return 2
+	}
+
+	entries, err := ReadAuditLog(cfg.AuditLogFile)
+	if err != nil {
+		fmt.Fprintf(stderr, "Failed to read audit log: %v\n", err)
+		return 2
+	}
+
+	client, err := NewRepository(cfg)
+	if err != nil {
+		fmt.Fprintf(stderr, "Failed to create %s client: %v\n", cfg.StorageBackend, err)
+		return 2
+	}
+
+	repos := []string{cfg.GiteaRepo}
+	if cfg.ArchiveRepo != cfg.GiteaRepo {
+		repos = append(repos, cfg.ArchiveRepo)
+	}
+
+	reports := make(map[string]*AuditReport, len(repos))
+	ok := true
+	for _, repo := range repos {
+		commits, err := listCommitsUnder(client.WithRepo(repo), auditPrefixes())
+		if err != nil {
+			fmt.Fprintf(stderr, "Failed to list commits: %v\n", err)
+			return 2
+		}
+
+		fullName := cfg.GiteaOwner + "/" + repo
+		report := VerifyAudit(commits, entries, fullName, auditPrefixes(), since)
+		reports[fullName] = report
+		ok = ok && report.OK()
+	}
+
+	if *jsonFlag {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(reports)
+	} else {
+		for _, repo := range repos {
+			printAuditReport(stdout, cfg.GiteaOwner+"/"+repo, reports[cfg.GiteaOwner+"/"+repo])
+		}
+	}
+
+	if !ok {
+		return 1
+	}
+	return 0
+}
+
+// listCommitsUnder returns the commits touching any of the prefixes, without duplicates.
+func listCommitsUnder(client Repository, prefixes []string) ([]CommitInfo, error) {
+	seen := make(map[string]bool)
+	var result []CommitInfo
+	for _, prefix := range prefixes {
+		commits, err := client.ListCommits(strings.TrimSuffix(prefix, "/"), 0)
+		if err != nil {
+			return nil, err
+		}
+		for _, commit := range commits {
+			if !seen[commit.SHA] {
+				seen[commit.SHA] = true
+				result = append(result, commit)
+			}
+		}
+	}
+	return result, nil
+}
+
+func printAuditReport(w io.Writer, repo string, report *AuditReport) {
+	if report.OK() {
+		fmt.Fprintf(w, "%s: history matches audit log\n", repo)
+		return
+	}
+
+	if len(report.Unaudited) > 0 {
+		fmt.Fprintf(w, "%s: %d commit(s) not made through the backend:\n", repo, len(report.Unaudited))
+		for _, c := range report.Unaudited {
+			message, _, _ := strings.Cut(c.Message, "\n")
+			fmt.Fprintf(w, "  %s  %s  %-20s  %s\n", shortSHA(c.SHA), c.Created.Format(time.RFC3339), c.Author, message)
+		}
+	}
+	if len(report.Missing) > 0 {
+		fmt.Fprintf(w, "%s: %d audited commit(s) missing from history:\n", repo, len(report.Missing))
+		for _, e := range report.Missing {
+			fmt.Fprintf(w, "  #%d  %s  %s  %-7s %s\n", e.Seq, shortSHA(e.Commit), e.Time.Format(time.RFC3339), e.Action, e.Path)
+		}
+	}
+}
+
+func shortSHA(sha string) string {
+	if len(sha) > 10 {
+		return sha[:10]
+	}
+	return sha
+}
+
+// parseDate accepts either a plain date or an RFC3339 timestamp.
+func parseDate(s string) (time.Time, error) {
+	if t, err := time.Parse(time.DateOnly, s); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
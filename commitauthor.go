@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"strings"
+)
+
+// commitAuthor is the author of a commit, when it is not the identity the
+// storage commits as.
+type commitAuthor struct {
+	Name  string
+	Email string
+}
+
+// lockAuthor returns the author named by a lock's Who field, which Terraform
+// sets to user@host: the user becomes the name and Who the email address.
+// Returns false if who does not have that form.
+func lockAuthor(who string) (commitAuthor, bool) {
+	user, host, ok := strings.Cut(who, "@")
+	if !ok || user == "" || host == "" || strings.ContainsAny(who, "<>\r\n") {
+		return commitAuthor{}, false
+	}
+	return commitAuthor{Name: user, Email: who}, true
+}
+
+type commitAuthorKey struct{}
+
+// withCommitAuthor returns a context making the storages commit as author.
+func withCommitAuthor(ctx context.Context, author commitAuthor) context.Context {
+	return context.WithValue(ctx, commitAuthorKey{}, author)
+}
+
+// commitAuthorFrom returns the author set with withCommitAuthor, if any.
+// Without one, the storages commit with their configured identity.
+func commitAuthorFrom(ctx context.Context) (commitAuthor, bool) {
+	author, ok := ctx.Value(commitAuthorKey{}).(commitAuthor)
+	return author, ok
+}
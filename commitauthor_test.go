@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLockAuthor(t *testing.T) {
+	tests := []struct {
+		who  string
+		want commitAuthor
+		ok   bool
+	}{
+		{"alice@laptop", commitAuthor{Name: "alice", Email: "alice@laptop"}, true},
+		{"ci@runner-7.example.com", commitAuthor{Name: "ci", Email: "ci@runner-7.example.com"}, true},
+		{"", commitAuthor{}, false},
+		{"alice", commitAuthor{}, false},
+		{"@laptop", commitAuthor{}, false},
+		{"alice@", commitAuthor{}, false},
+		{"alice <alice@laptop>", commitAuthor{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := lockAuthor(tt.who)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("lockAuthor(%q) = %+v, %v; expected %+v, %v", tt.who, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+// writeUnderLock locks the state network as who and writes it.
+func writeUnderLock(t *testing.T, handler *StateHandler, who string) {
+	t.Helper()
+	lock := `{"ID":"lock-1","Operation":"OperationTypeApply","Who":"` + who + `"}`
+	if w := serveAs(handler, "LOCK", "/network", "", lock); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/network?ID=lock-1", strings.NewReader(`{"version":4,"serial":1,"lineage":"abc"}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestSaveState_AuthorFromLock(t *testing.T) {
+	storage := newTestLocalGitClient(t)
+	writeUnderLock(t, NewStateHandler(storage, DefaultMaxBodySize), "alice@laptop")
+
+	commits, err := storage.ListCommits(statePath("network"), 1)
+	if err != nil || len(commits) != 1 {
+		t.Fatalf("expected a commit, got %v, %v", commits, err)
+	}
+	if commits[0].Author != "alice" {
+		t.Errorf("expected the lock holder as author, got %q", commits[0].Author)
+	}
+}
+
+func TestSaveState_AuthorFromLockDisabled(t *testing.T) {
+	storage := newTestLocalGitClient(t)
+	handler := NewStateHandler(storage, DefaultMaxBodySize)
+	handler.lockAuthors = false
+	writeUnderLock(t, handler, "alice@laptop")
+
+	commits, err := storage.ListCommits(statePath("network"), 1)
+	if err != nil || len(commits) != 1 {
+		t.Fatalf("expected a commit, got %v, %v", commits, err)
+	}
+	if commits[0].Author != localGitAuthor.Name {
+		t.Errorf("expected the backend as author, got %q", commits[0].Author)
+	}
+}
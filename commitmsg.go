@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"text/template"
+)
+
+// Operations named in commit messages.
+const (
+	OpUpdate           = "update"
+	OpDelete           = "delete"
+	OpScheduleDeletion = "schedule-deletion"
+	OpCancelDeletion   = "cancel-deletion"
+	OpArchive          = "archive"
+	OpRehydrate        = "rehydrate"
+	OpMigrate          = "migrate"
+)
+
+// commitMessageData is what a COMMIT_MESSAGE_TEMPLATE can refer to.
+type commitMessageData struct {
+	Name             string // State name
+	Operation        string // One of the Op constants
+	LockID           string // ID of the lock the write was made under, if any
+	LockHolder       string // Who field of that lock, as sent by Terraform
+	TerraformVersion string // Terraform version that wrote the state, for updates
+	Serial           uint64 // Serial of the state written, 0 if unknown
+	UploadChecksum   string // Checksum sent with the state and verified, as algorithm:hex, for updates
+	Default          string // The message used without a template
+}
+
+// commitTemplate renders commit messages, when COMMIT_MESSAGE_TEMPLATE is set.
+var commitTemplate *template.Template
+
+// parseCommitMessageTemplate parses a COMMIT_MESSAGE_TEMPLATE and checks that
+// it renders, so mistakes are reported at startup.
+func parseCommitMessageTemplate(s string) (*template.Template, error) {
+	tmpl, err := template.New("commit").Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, commitMessageData{Name: "example", Operation: OpUpdate, Default: "Update state: example"}); err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+// useCommitMessageTemplate renders commit messages with s from now on; an
+// empty s restores the built-in messages.
+func useCommitMessageTemplate(s string) error {
+	if s == "" {
+		commitTemplate = nil
+		return nil
+	}
+	tmpl, err := parseCommitMessageTemplate(s)
+	if err != nil {
+		return fmt.Errorf("COMMIT_MESSAGE_TEMPLATE: %w", err)
+	}
+	commitTemplate = tmpl
+	return nil
+}
+
+// commitMessage returns the message of a commit made for data.Operation.
+// Without a template, or if it fails or renders nothing, it is data.Default.
+func commitMessage(data commitMessageData) string {
+	if commitTemplate == nil {
+		return data.Default
+	}
+	var b strings.Builder
+	if err := commitTemplate.Execute(&b, data); err != nil {
+		slog.Error("Error rendering commit message, using the default", "state", data.Name, "operation", data.Operation, "error", err)
+		return data.Default
+	}
+	message := strings.TrimSpace(b.String())
+	if message == "" {
+		return data.Default
+	}
+	return message
+}
+
+// stateCommitMessage returns the message of a commit made for op on the
+// named state, which has no further details.
+func stateCommitMessage(op, name, defaultMessage string) string {
+	return commitMessage(commitMessageData{Name: name, Operation: op, Default: defaultMessage})
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// withCommitMessageTemplate renders commit messages with tmpl for the test.
+func withCommitMessageTemplate(t *testing.T, tmpl string) {
+	t.Helper()
+	previous := commitTemplate
+	t.Cleanup(func() { commitTemplate = previous })
+	if err := useCommitMessageTemplate(tmpl); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseCommitMessageTemplate(t *testing.T) {
+	for _, tmpl := range []string{"{{.Name", "{{.Unknown}}", "{{template \"missing\"}}"} {
+		if _, err := parseCommitMessageTemplate(tmpl); err == nil {
+			t.Errorf("expected error for %q", tmpl)
+		}
+	}
+}
+
+func TestCommitMessage(t *testing.T) {
+	data := commitMessageData{Name: "network", Operation: OpUpdate, Serial: 7, Default: "Update state: network"}
+	if got := commitMessage(data); got != data.Default {
+		t.Errorf("expected the default message without a template, got %q", got)
+	}
+
+	withCommitMessageTemplate(t, "chore(state): {{.Operation}} {{.Name}}{{if .Serial}} (serial {{.Serial}}){{end}}")
+	if got := commitMessage(data); got != "chore(state): update network (serial 7)" {
+		t.Errorf("unexpected message %q", got)
+	}
+
+	withCommitMessageTemplate(t, "{{if eq .Operation \"update\"}}{{.Default}}{{end}}")
+	if got := stateCommitMessage(OpArchive, "network", "Archive state: network"); got != "Archive state: network" {
+		t.Errorf("expected an empty rendering to fall back to the default, got %q", got)
+	}
+}
+
+func TestCommitMessage_StateUpdate(t *testing.T) {
+	withCommitMessageTemplate(t, "feat(tfstate): update {{.Name}}\n\nSerial: {{.Serial}}\nTerraform: {{.TerraformVersion}}\nLock-Holder: {{.LockHolder}}")
+	storage := newTestLocalGitClient(t)
+	handler := NewStateHandler(storage, DefaultMaxBodySize)
+
+	lock := `{"ID":"lock-1","Operation":"OperationTypeApply","Who":"alice@ci"}`
+	if w := serveAs(handler, "LOCK", "/network", "", lock); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/network?ID=lock-1", strings.NewReader(`{"version":4,"serial":5,"lineage":"abc","terraform_version":"1.9.0"}`))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	commits, err := storage.ListCommits(statePath("network"), 1)
+	if err != nil || len(commits) != 1 {
+		t.Fatalf("expected a commit, got %v, %v", commits, err)
+	}
+	want := "feat(tfstate): update network\n\nSerial: 5\nTerraform: 1.9.0\nLock-Holder: alice@ci"
+	if strings.TrimSpace(commits[0].Message) != want {
+		t.Errorf("expected message %q, got %q", want, commits[0].Message)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Formats states can be compressed with at rest, selectable with
+// STATE_COMPRESSION.
+const (
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+// stateCompressions are the values STATE_COMPRESSION accepts.
+var stateCompressions = []string{CompressionGzip, CompressionZstd}
+
+// stateCompression is the format states are written in, set from
+// STATE_COMPRESSION at startup; empty writes them uncompressed.
+var stateCompression string
+
+// Magic numbers starting compressed state files. A tfstate document starts
+// with "{", so they cannot be mistaken for a state stored uncompressed.
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+var (
+	zstdEncoder = sync.OnceValue(func() *zstd.Encoder {
+		enc, _ := zstd.NewWriter(nil) // Cannot fail without options
+		return enc
+	})
+	zstdDecoder = sync.OnceValue(func() *zstd.Decoder {
+		dec, _ := zstd.NewReader(nil)
+		return dec
+	})
+
+	// A gzip writer holds several hundred KiB of compressor state
+	gzipWriterPool = sync.Pool{New: func() any { return gzip.NewWriter(nil) }}
+)
+
+// storedCompression returns the format a state file is compressed with, or
+// "" if it is stored as is.
+func storedCompression(content []byte) string {
+	switch {
+	case bytes.HasPrefix(content, gzipMagic):
+		return CompressionGzip
+	case bytes.HasPrefix(content, zstdMagic):
+		return CompressionZstd
+	}
+	return ""
+}
+
+// encodeState returns a state as it is to be committed: compressed with
+// STATE_COMPRESSION, if set.
+func encodeState(content []byte) ([]byte, error) {
+	switch stateCompression {
+	case CompressionGzip:
+		return pooledBytes(func(b *bytes.Buffer) error {
+			zw, ok := gzipWriterPool.Get().(*gzip.Writer)
+			if !ok {
+				zw = gzip.NewWriter(b)
+			}
+			defer gzipWriterPool.Put(zw)
+			zw.Reset(b)
+			if _, err := zw.Write(content); err != nil {
+				return err
+			}
+			return zw.Close()
+		})
+	case CompressionZstd:
+		return zstdEncoder().EncodeAll(content, nil), nil
+	}
+	return content, nil
+}
+
+// decodeState returns the state stored in a state file, decompressing it if
+// it was committed compressed. The format is recognized by its magic number
+// rather than the current setting, so states stay readable after
+// STATE_COMPRESSION is changed.
+func decodeState(content []byte) ([]byte, error) {
+	switch storedCompression(content) {
+	case CompressionGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(content))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress state: %w", err)
+		}
+		decoded, err := pooledBytes(func(b *bytes.Buffer) error {
+			_, err := b.ReadFrom(zr)
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress state: %w", err)
+		}
+		return decoded, nil
+	case CompressionZstd:
+		decoded, err := zstdDecoder().DecodeAll(content, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress state: %w", err)
+		}
+		return decoded, nil
+	}
+	return content, nil
+}
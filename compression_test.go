@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// withStateCompression compresses states written in the test with format.
+func withStateCompression(t *testing.T, format string) {
+	t.Helper()
+	previous := stateCompression
+	t.Cleanup(func() { stateCompression = previous })
+	stateCompression = format
+}
+
+func TestStateCompression_RoundTrip(t *testing.T) {
+	for _, format := range stateCompressions {
+		t.Run(format, func(t *testing.T) {
+			withStateCompression(t, format)
+			handler, storage := newTestHandler()
+
+			body := `{"version":4,"serial":1,"lineage":"abc","resources":[]}`
+			postState(t, handler, body)
+
+			stored := storage.files[statePath("network")]
+			if got := storedCompression(stored); got != format {
+				t.Fatalf("expected the state to be stored with %s, got %q", format, got)
+			}
+
+			w := serve(handler, http.MethodGet, "/network")
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d", w.Code)
+			}
+			var got, want any
+			_ = json.Unmarshal([]byte(body), &want)
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatalf("expected GET to return the decompressed state, got %q", w.Body.String())
+			}
+
+			// The serial check reads the compressed state
+			w = serveAs(handler, http.MethodPost, "/network", "", `{"version":4,"serial":0,"lineage":"abc"}`)
+			if w.Code != http.StatusConflict {
+				t.Errorf("expected a serial regression to be detected, got %d", w.Code)
+			}
+		})
+	}
+}
+
+func TestStateCompression_ReadsEitherFormat(t *testing.T) {
+	handler, storage := newTestHandler()
+
+	withStateCompression(t, CompressionZstd)
+	postState(t, handler, `{"version":4,"serial":1,"lineage":"abc"}`)
+
+	// Turning compression off keeps compressed states readable, and the
+	// next write stores the state as is
+	stateCompression = ""
+	if w := serve(handler, http.MethodGet, "/network"); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"lineage"`) {
+		t.Fatalf("expected the compressed state to be served, got %d: %q", w.Code, w.Body.String())
+	}
+	postState(t, handler, `{"version":4,"serial":2,"lineage":"abc"}`)
+	if got := storedCompression(storage.files[statePath("network")]); got != "" {
+		t.Errorf("expected the state to be stored uncompressed, got %s", got)
+	}
+}
+
+func TestStateCompression_Sidecars(t *testing.T) {
+	withStateCompression(t, CompressionGzip)
+	storage := newTestLocalGitClient(t)
+	handler := NewStateHandler(storage, DefaultMaxBodySize)
+
+	body := `{"version":4,"serial":1,"lineage":"abc"}`
+	postState(t, handler, body)
+
+	ctx := context.Background()
+	checksum, _, _ := storage.GetFile(ctx, checksumPath("network"))
+	content, _, _ := storage.GetFile(ctx, statePath("network"))
+	decoded, err := decodeState(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(decoded)
+	if !strings.HasPrefix(string(checksum), hex.EncodeToString(sum[:])) {
+		t.Errorf("expected the checksum of the uncompressed state, got %q", checksum)
+	}
+
+	raw, _, _ := storage.GetFile(ctx, metadataPath("network"))
+	var metadata stateMetadata
+	if err := json.Unmarshal(raw, &metadata); err != nil {
+		t.Fatal(err)
+	}
+	if metadata.Compression != CompressionGzip || metadata.Size != len(decoded) {
+		t.Errorf("expected gzip and the uncompressed size %d in the metadata, got %+v", len(decoded), metadata)
+	}
+}
+
+func TestDecodeState_Corrupt(t *testing.T) {
+	for _, content := range [][]byte{append(gzipMagic, 0, 1, 2), append(zstdMagic, 0, 1, 2)} {
+		if _, err := decodeState(content); err == nil {
+			t.Errorf("expected an error decoding %x", content)
+		}
+	}
+}
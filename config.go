@@ -2,42 +2,358 @@ package main
 
 import (
 	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"slices"
 	"strconv"
+	"strings"
+	"time"
 )
 
 // Default maximum request body size (50 MB).
 const DefaultMaxBodySize = 50 << 20
 
+// Default interval between archiving passes.
+const DefaultArchiveInterval = 24 * time.Hour
+
+// Default interval between repository size samples.
+const DefaultRepoSizeInterval = time.Hour
+
+// Default repository growth, in MB per day, above which a warning is logged.
+const DefaultRepoGrowthWarnMB = 100
+
+// Default interval between replica health probes.
+const DefaultReplicaProbeInterval = 30 * time.Second
+
+// Default interval between checks of secret files for rotated credentials.
+const DefaultCredentialReloadInterval = time.Minute
+
+// Default time a lock holder has to object to a takeover.
+const DefaultLockStealGrace = 5 * time.Minute
+
 type Config struct {
-	GiteaURL    string
-	GiteaToken  string
-	GiteaOwner  string
-	GiteaRepo   string
-	GiteaBranch string
-	ListenAddr  string
-	AuthToken   string // Optional - if empty, no auth required
-	MaxBodySize int64  // Maximum request body size in bytes
+	GiteaURL        string      `env:"GITEA_URL,GITHUB_API_URL,GITLAB_URL"`
+	GiteaToken      string      `env:"GITEA_TOKEN,GITHUB_TOKEN,GITLAB_TOKEN"`
+	GiteaUsername   string      `env:"GITEA_USERNAME"` // With GiteaPassword, authenticates instead of GiteaToken
+	GiteaPassword   string      `env:"GITEA_PASSWORD"`
+	GiteaTOTPSecret []byte      `env:"GITEA_TOTP_SECRET"` // Optional - generates one-time passwords for accounts with 2FA
+	GiteaOwner      string      `env:"GITEA_OWNER,GITHUB_OWNER,GITLAB_PROJECT,GIT_REPO_PATH"`
+	GiteaRepo       string      `env:"GITEA_REPO,GITHUB_REPO"`
+	GiteaBranch     string      `env:"GITEA_BRANCH,GITHUB_BRANCH,GITLAB_BRANCH,GIT_BRANCH"`
+	ListenAddr      string      `env:"LISTEN_ADDR"`
+	Listeners       []Listener  `env:"LISTENERS"`         // Addresses to listen on with their options; defaults to ListenAddr
+	TLSCertFile     string      `env:"TLS_CERT_FILE"`     // Certificate of the tls listeners, or of LISTEN_ADDR without LISTENERS
+	TLSKeyFile      string      `env:"TLS_KEY_FILE"`      // Private key of TLSCertFile
+	AuthToken       string      `env:"AUTH_TOKEN"`        // Optional - if empty, no auth required
+	MaxBodySize     int64       `env:"MAX_BODY_SIZE_MB"`  // Maximum request body size in bytes
+	SizeLimits      []SizeLimit `env:"BODY_SIZE_LIMITS"`  // Per-state overrides of MaxBodySize
+	SizeWarnPercent int         `env:"SIZE_WARN_PERCENT"` // Share of the size limit above which writes are warned about; 0 disables
+	RequireLock     bool        `env:"REQUIRE_LOCK"`      // Reject state writes not made under a lock
+
+	VersionLimits []VersionLimit `env:"MAX_STATE_VERSIONS"` // Versions to keep of the states matching each pattern
+
+	ACMEDomains  []string `env:"ACME_DOMAIN"`    // Domains the TLS listeners get certificates for from Let's Encrypt, instead of TLSCertFile
+	ACMEEmail    string   `env:"ACME_EMAIL"`     // Optional - contact of the ACME account, told about expiring certificates
+	ACMECacheDir string   `env:"ACME_CACHE_DIR"` // Directory the ACME account key and certificates are kept in
+
+	RequestRateLimit      int `env:"REQUEST_RATE_LIMIT"`      // Requests allowed per minute per client; 0 is unlimited
+	MaxConcurrentRequests int `env:"MAX_CONCURRENT_REQUESTS"` // Requests served at once, beyond which they are shed; 0 is unlimited
+
+	ProtectedStates     []string      `env:"PROTECTED_STATES"`      // Patterns of the states whose commits shutdown waits for
+	ProtectedWriteDrain time.Duration `env:"PROTECTED_WRITE_DRAIN"` // How long shutdown waits for them beyond its grace period
+
+	LockWait     time.Duration `env:"LOCK_WAIT_TIMEOUT"` // How long LOCK waits for a held lock; 0 fails immediately
+	LockMethod   string        `env:"LOCK_METHOD"`       // HTTP method that acquires a lock
+	UnlockMethod string        `env:"UNLOCK_METHOD"`     // HTTP method that releases a lock
+
+	AllowRawState bool `env:"ALLOW_RAW_STATE"` // Store request bodies that are not well-formed tfstate as-is
+	RouteHints    bool `env:"ROUTE_HINTS"`     // List the supported operations in 404 and 405 responses
+
+	ArchiveAfterMonths int           `env:"ARCHIVE_AFTER_MONTHS"` // Archive states inactive this long; 0 disables archiving
+	ArchiveRepo        string        `env:"ARCHIVE_REPO"`         // Repository receiving archived states (defaults to GiteaRepo)
+	ArchiveInterval    time.Duration `env:"ARCHIVE_INTERVAL"`     // Time between archiving passes
+
+	SearchIndexInterval time.Duration `env:"SEARCH_INDEX_INTERVAL"` // Time between passes of the search index; 0 disables search
+	StartupWarmup       bool          `env:"STARTUP_WARMUP"`        // Report /ready only once the search index is built
+
+	RepoSizeInterval    time.Duration `env:"REPO_SIZE_INTERVAL"`          // Time between repository size samples
+	RepoGrowthWarnMBDay int           `env:"REPO_GROWTH_WARN_MB_PER_DAY"` // Warn when the repository grows faster than this; 0 disables
+
+	DegradeHeapMB     int `env:"DEGRADE_HEAP_MB"`    // Heap above which non-essential background jobs are paused; 0 disables
+	DegradeGoroutines int `env:"DEGRADE_GOROUTINES"` // Goroutines above which non-essential background jobs are paused; 0 disables
+
+	JobTimeout     time.Duration            `env:"JOB_TIMEOUT"`     // Limit on each run of a background job; 0 is none
+	JobTimeouts    map[string]time.Duration `env:"JOB_TIMEOUTS"`    // Per-job limits overriding JobTimeout
+	JobConcurrency int                      `env:"JOB_CONCURRENCY"` // Background job runs allowed at once; 0 is unlimited
+	JobsPaused     []string                 `env:"JOBS_PAUSED"`     // Background jobs paused at startup
+
+	ReadReplicas         []ReplicaConfig `env:"READ_REPLICAS"`          // Read-only Gitea pull mirrors serving unlocked reads
+	ReadReplicaToken     string          `env:"READ_REPLICA_TOKEN"`     // Token for the replicas (defaults to GiteaToken)
+	ReplicaProbeInterval time.Duration   `env:"REPLICA_PROBE_INTERVAL"` // Time between replica health probes
+
+	AuditLogFile string `env:"AUDIT_LOG_FILE"` // Optional - append-only log of every commit made by the backend
+	CountersFile string `env:"COUNTERS_FILE"`  // Optional - keeps operational counters across restarts
+
+	LogLevel        slog.Level `env:"LOG_LEVEL"`         // Least severe level of the entries logged
+	LogFormat       string     `env:"LOG_FORMAT"`        // Format of the log: text or json
+	AccessLogFormat string     `env:"ACCESS_LOG_FORMAT"` // Requests are logged as entries of the log, or as combined log lines on stdout
+
+	DevMode bool `env:"DEV_MODE"` // Serve states from an in-memory Gitea stub instead of a real instance
+
+	NotifyWebhookURL string        `env:"NOTIFY_WEBHOOK_URL"` // Optional - receives state and lock events
+	LockStealGrace   time.Duration `env:"LOCK_STEAL_GRACE"`   // Time a lock holder has to object to a takeover
+	RunHistory       int           `env:"RUN_HISTORY"`        // Finished runs kept per state for GET /{name}/runs; 0 disables
+	StateDeleteGrace time.Duration `env:"STATE_DELETE_GRACE"` // Time before a requested state deletion is carried out; 0 deletes immediately
+
+	// StorageBackend selects the Git hosting service. For "github" and "gitlab",
+	// the Gitea* fields describe that service's repository and are read from
+	// GITHUB_* or GITLAB_* variables. For "localgit", GiteaOwner and GiteaRepo
+	// are the parent directory and name of the bare repository at GIT_REPO_PATH.
+	StorageBackend string `env:"STORAGE_BACKEND"`
+
+	// GiteaWriteMode selects how the Gitea backend writes: "api" uses the
+	// contents API, "git" pushes from a local shallow clone.
+	GiteaWriteMode  string `env:"GITEA_WRITE_MODE"`
+	PRMergeStyle    string `env:"PR_MERGE_STYLE"`     // How pull requests are merged in the pr write mode
+	GiteaGitURL     string `env:"GITEA_GIT_URL"`      // Clone URL for the git write mode (defaults to the HTTPS URL)
+	GiteaSSHKeyFile string `env:"GITEA_SSH_KEY_FILE"` // Private key for pushing over SSH
+	GiteaCloneDir   string `env:"GITEA_CLONE_DIR"`    // Directory of the local clone
+
+	MultiRepo          bool     `env:"MULTI_REPO"`           // Serve /{owner}/{repo}/{name} from other repositories of the Gitea instance
+	MultiRepoAllowlist []string `env:"MULTI_REPO_ALLOWLIST"` // owner/repo patterns MultiRepo may serve, besides GiteaOwner/GiteaRepo
+
+	StatePathTemplate       string `env:"STATE_PATH_TEMPLATE"`       // Path of a state file in the repository, with {name} standing for the state name
+	StateCompression        string `env:"STATE_COMPRESSION"`         // Compress state files in the repository with gzip or zstd; empty stores them as is
+	StateChunkSize          int    `env:"STATE_CHUNK_SIZE_MB"`       // Size above which state files are split into chunk files, in bytes; 0 never splits them
+	CommitMessageTemplate   string `env:"COMMIT_MESSAGE_TEMPLATE"`   // text/template for the messages of commits made by the backend; empty uses the built-in ones
+	CommitAuthorFromLock    bool   `env:"COMMIT_AUTHOR_FROM_LOCK"`   // Author commits made under a lock as the lock's Who
+	ConcurrentApplyWarnings bool   `env:"CONCURRENT_APPLY_WARNINGS"` // Warn about writes that look like concurrent applies
+	TagOnUpdate             bool   `env:"TAG_ON_UPDATE"`             // Tag every state update as tfstate/{name}/serial-{n}
+	VerifyChecksums         bool   `env:"VERIFY_CHECKSUMS"`          // Check states read against their checksum sidecars
+	ReadFallback            bool   `env:"READ_FALLBACK"`             // Serve the last valid version of a state whose current version is corrupt
+
+	TenantsFile string `env:"TENANTS_FILE"` // YAML file of tenants served from their own repositories under a URL prefix
+
+	RepoTopics []string `env:"REPO_TOPICS"` // Topics kept on the repositories holding states
+
+	Shadow          bool   // Repeat state writes against a shadow branch or repository and report divergences; set by SHADOW_BRANCH or SHADOW_REPO
+	ShadowOwner     string // Owner of the shadow repository, from SHADOW_REPO (defaults to GiteaOwner)
+	ShadowRepo      string `env:"SHADOW_REPO"`       // Shadow repository (defaults to GiteaRepo)
+	ShadowBranch    string `env:"SHADOW_BRANCH"`     // Shadow branch (defaults to GiteaBranch)
+	ShadowWriteMode string `env:"SHADOW_WRITE_MODE"` // Write mode used for the shadow (defaults to GiteaWriteMode)
+
+	MetricsLabels      map[string]string `env:"METRICS_LABELS"`       // Static labels added to every exported metric
+	MetricsTenantLabel bool              `env:"METRICS_TENANT_LABEL"` // Label the HTTP request metrics with the tenant of the state
+
+	Retry RetryPolicy // Retries of transient Gitea API failures, from the RETRY_* variables its fields are tagged with
+
+	GiteaTimeout         time.Duration `env:"GITEA_TIMEOUT"`           // Limit on each Gitea API call, retries included
+	GiteaAPIBudget       int           `env:"GITEA_API_BUDGET"`        // Gitea API calls allowed per minute; 0 is unlimited
+	GiteaMaxConcurrency  int           `env:"GITEA_MAX_CONCURRENCY"`   // Gitea API calls allowed at once; 0 is unlimited
+	GiteaMaxIdleConns    int           `env:"GITEA_MAX_IDLE_CONNS"`    // Idle connections kept open to Gitea
+	GiteaIdleConnTimeout time.Duration `env:"GITEA_IDLE_CONN_TIMEOUT"` // Time after which an idle connection is closed
+	GiteaKeepAlive       time.Duration `env:"GITEA_KEEP_ALIVE"`        // Interval of TCP keep-alive probes; 0 disables connection reuse
+	GiteaProxy           *url.URL      `env:"GITEA_PROXY"`             // Optional - proxy for Gitea API calls, overriding HTTP(S)_PROXY
+	RepoMoves            string        `env:"REPO_MOVES"`              // How a renamed or transferred repository is handled: follow or confirm
+
+	SecurityHeaders bool          `env:"SECURITY_HEADERS"` // Add hardening headers to every response
+	HSTSMaxAge      time.Duration `env:"HSTS_MAX_AGE"`     // max-age of the HSTS header sent over HTTPS; 0 disables it
+	HideVersion     bool          `env:"HIDE_VERSION"`     // Leave the build version out of the documentation pages
+
+	CredentialReloadInterval time.Duration `env:"CREDENTIAL_RELOAD_INTERVAL"` // Time between checks of *_FILE secrets for rotation; 0 reloads on SIGHUP only
+
+	WriteCoalesceWindow time.Duration `env:"WRITE_COALESCE_WINDOW"` // Time after a commit in which the lock holder's writes are spooled; 0 disables
+	WriteCoalesceDir    string        `env:"WRITE_COALESCE_DIR"`    // Directory spooled writes are kept in until committed
+
+	ReadMissCacheTTL time.Duration `env:"READ_MISS_CACHE_TTL"` // Time a state found missing is reported missing without another fetch; 0 disables
+}
+
+// secretVars are the variables holding secrets. Each can instead be read from
+// the file named by the variable with a _FILE suffix, such as a mounted
+// Docker or Kubernetes secret.
+var secretVars = []string{
+	"GITEA_TOKEN", "GITEA_PASSWORD", "GITEA_TOTP_SECRET", "GITHUB_TOKEN", "GITLAB_TOKEN",
+	"AUTH_TOKEN", "READ_REPLICA_TOKEN", "NOTIFY_WEBHOOK_URL",
+}
+
+// secretFilesSet reports whether any secret is read from a file.
+func secretFilesSet() bool {
+	for _, key := range secretVars {
+		if os.Getenv(key+"_FILE") != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// readSecret returns the value of the secret variable key, or the trimmed
+// content of the file named by key_FILE.
+func readSecret(key string) (string, error) {
+	value, file := os.Getenv(key), os.Getenv(key+"_FILE")
+	if file == "" {
+		return value, nil
+	}
+	if value != "" {
+		return "", fmt.Errorf("%s and %s_FILE must not both be set", key, key)
+	}
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("%s_FILE: %w", key, err)
+	}
+	return strings.TrimSpace(string(content)), nil
 }
 
 func LoadConfig() (*Config, error) {
+	secrets := make(map[string]string, len(secretVars))
+	for _, key := range secretVars {
+		value, err := readSecret(key)
+		if err != nil {
+			return nil, err
+		}
+		secrets[key] = value
+	}
+
 	cfg := &Config{
 		GiteaURL:    os.Getenv("GITEA_URL"),
-		GiteaToken:  os.Getenv("GITEA_TOKEN"),
+		GiteaToken:  secrets["GITEA_TOKEN"],
 		GiteaOwner:  os.Getenv("GITEA_OWNER"),
 		GiteaRepo:   os.Getenv("GITEA_REPO"),
 		GiteaBranch: os.Getenv("GITEA_BRANCH"),
 		ListenAddr:  os.Getenv("LISTEN_ADDR"),
-		AuthToken:   os.Getenv("AUTH_TOKEN"),
+		AuthToken:   secrets["AUTH_TOKEN"],
+		ArchiveRepo: os.Getenv("ARCHIVE_REPO"),
+
+		GiteaUsername: os.Getenv("GITEA_USERNAME"),
+		GiteaPassword: secrets["GITEA_PASSWORD"],
+
+		StorageBackend: os.Getenv("STORAGE_BACKEND"),
+
+		GiteaWriteMode:  strings.ToLower(os.Getenv("GITEA_WRITE_MODE")),
+		GiteaGitURL:     os.Getenv("GITEA_GIT_URL"),
+		GiteaSSHKeyFile: os.Getenv("GITEA_SSH_KEY_FILE"),
+		GiteaCloneDir:   os.Getenv("GITEA_CLONE_DIR"),
+
+		LockMethod:   strings.ToUpper(os.Getenv("LOCK_METHOD")),
+		UnlockMethod: strings.ToUpper(os.Getenv("UNLOCK_METHOD")),
+
+		AuditLogFile: os.Getenv("AUDIT_LOG_FILE"),
+		CountersFile: os.Getenv("COUNTERS_FILE"),
+
+		ReadReplicaToken: secrets["READ_REPLICA_TOKEN"],
+
+		NotifyWebhookURL: secrets["NOTIFY_WEBHOOK_URL"],
+	}
+
+	// Select the storage backend
+	envPrefix := "GITEA"
+	switch cfg.StorageBackend {
+	case "":
+		cfg.StorageBackend = BackendGitea
+	case BackendGitea:
+	case BackendGitHub:
+		envPrefix = "GITHUB"
+		cfg.GiteaURL = os.Getenv("GITHUB_API_URL")
+		if cfg.GiteaURL == "" {
+			cfg.GiteaURL = DefaultGitHubURL
+		}
+		cfg.GiteaToken = secrets["GITHUB_TOKEN"]
+		cfg.GiteaOwner = os.Getenv("GITHUB_OWNER")
+		cfg.GiteaRepo = os.Getenv("GITHUB_REPO")
+		cfg.GiteaBranch = os.Getenv("GITHUB_BRANCH")
+	case BackendGitLab:
+		envPrefix = "GITLAB"
+		cfg.GiteaURL = os.Getenv("GITLAB_URL")
+		if cfg.GiteaURL == "" {
+			cfg.GiteaURL = DefaultGitLabURL
+		}
+		cfg.GiteaToken = secrets["GITLAB_TOKEN"]
+		cfg.GiteaBranch = os.Getenv("GITLAB_BRANCH")
+		// Projects are addressed by their full path; the namespace takes the role of the owner
+		project := strings.Trim(os.Getenv("GITLAB_PROJECT"), "/")
+		if project == "" {
+			return nil, fmt.Errorf("GITLAB_PROJECT is required")
+		}
+		i := strings.LastIndex(project, "/")
+		if i < 0 {
+			return nil, fmt.Errorf("GITLAB_PROJECT must be a project path such as group/project")
+		}
+		cfg.GiteaOwner, cfg.GiteaRepo = project[:i], project[i+1:]
+	case BackendLocalGit:
+		envPrefix = "GIT"
+		path := os.Getenv("GIT_REPO_PATH")
+		if path == "" {
+			return nil, fmt.Errorf("GIT_REPO_PATH is required")
+		}
+		path, err := filepath.Abs(path)
+		if err != nil {
+			return nil, fmt.Errorf("GIT_REPO_PATH must be a valid path: %w", err)
+		}
+		cfg.GiteaURL = "file://"
+		cfg.GiteaOwner, cfg.GiteaRepo = filepath.Dir(path), filepath.Base(path)
+		cfg.GiteaBranch = os.Getenv("GIT_BRANCH")
+	default:
+		return nil, fmt.Errorf("STORAGE_BACKEND must be %q, %q, %q or %q", BackendGitea, BackendGitHub, BackendGitLab, BackendLocalGit)
 	}
 
 	// Set defaults
 	if cfg.GiteaBranch == "" {
 		cfg.GiteaBranch = "main"
 	}
+	if cfg.ListenAddr == "" && os.Getenv("LISTENERS") == "" && (systemdActivated() || upgradedFrom(systemdPrefix)) {
+		// Serve the socket of the unit that started the backend
+		cfg.ListenAddr = systemdPrefix
+	}
 	if cfg.ListenAddr == "" {
 		cfg.ListenAddr = ":8080"
 	}
+	cfg.Listeners = []Listener{{Addr: cfg.ListenAddr}}
+	if listeners := os.Getenv("LISTENERS"); listeners != "" {
+		if os.Getenv("LISTEN_ADDR") != "" {
+			return nil, fmt.Errorf("LISTEN_ADDR and LISTENERS are mutually exclusive; list the address in LISTENERS")
+		}
+		l, err := parseListeners(listeners)
+		if err != nil {
+			return nil, fmt.Errorf("LISTENERS: %w", err)
+		}
+		cfg.Listeners = l
+	}
+	cfg.TLSCertFile, cfg.TLSKeyFile = os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE")
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		return nil, fmt.Errorf("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	if domains := os.Getenv("ACME_DOMAIN"); domains != "" {
+		for _, domain := range strings.Split(domains, ",") {
+			if domain = strings.TrimSpace(domain); domain != "" {
+				cfg.ACMEDomains = append(cfg.ACMEDomains, domain)
+			}
+		}
+		if cfg.TLSCertFile != "" {
+			return nil, fmt.Errorf("ACME_DOMAIN and TLS_CERT_FILE are mutually exclusive")
+		}
+		cfg.ACMECacheDir = os.Getenv("ACME_CACHE_DIR")
+		if cfg.ACMECacheDir == "" {
+			return nil, fmt.Errorf("ACME_CACHE_DIR is required with ACME_DOMAIN")
+		}
+		cfg.ACMEEmail = os.Getenv("ACME_EMAIL")
+	}
+	if os.Getenv("LISTENERS") == "" && (cfg.TLSCertFile != "" || len(cfg.ACMEDomains) > 0) {
+		// A certificate alone makes the single listener serve HTTPS
+		cfg.Listeners[0].TLS = true
+	}
+	for _, l := range cfg.Listeners {
+		if l.TLS && cfg.TLSCertFile == "" && len(cfg.ACMEDomains) == 0 {
+			return nil, fmt.Errorf("TLS_CERT_FILE and TLS_KEY_FILE, or ACME_DOMAIN, are required by the tls listener %s", l.Addr)
+		}
+	}
+	if cfg.LockMethod == "" {
+		cfg.LockMethod = "LOCK"
+	}
+	if cfg.UnlockMethod == "" {
+		cfg.UnlockMethod = "UNLOCK"
+	}
 
 	// Parse max body size (in MB)
 	cfg.MaxBodySize = DefaultMaxBodySize
@@ -52,19 +368,767 @@ func LoadConfig() (*Config, error) {
 		cfg.MaxBodySize = mb << 20 // Convert MB to bytes
 	}
 
+	if level := os.Getenv("LOG_LEVEL"); level != "" {
+		l, err := parseLogLevel(level)
+		if err != nil {
+			return nil, err
+		}
+		cfg.LogLevel = l
+	}
+	cfg.LogFormat = LogFormatText
+	if format := strings.ToLower(os.Getenv("LOG_FORMAT")); format != "" {
+		if !slices.Contains(logFormats, format) {
+			return nil, fmt.Errorf("LOG_FORMAT must be one of %s", strings.Join(logFormats, ", "))
+		}
+		cfg.LogFormat = format
+	}
+	cfg.AccessLogFormat = AccessLogEntries
+	if format := strings.ToLower(os.Getenv("ACCESS_LOG_FORMAT")); format != "" {
+		if !slices.Contains(accessLogFormats, format) {
+			return nil, fmt.Errorf("ACCESS_LOG_FORMAT must be one of %s", strings.Join(accessLogFormats, ", "))
+		}
+		cfg.AccessLogFormat = format
+	}
+
+	if limit := os.Getenv("REQUEST_RATE_LIMIT"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil {
+			return nil, fmt.Errorf("REQUEST_RATE_LIMIT must be a valid integer: %w", err)
+		}
+		if n < 0 {
+			return nil, fmt.Errorf("REQUEST_RATE_LIMIT must not be negative")
+		}
+		cfg.RequestRateLimit = n
+	}
+	if limit := os.Getenv("MAX_CONCURRENT_REQUESTS"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil {
+			return nil, fmt.Errorf("MAX_CONCURRENT_REQUESTS must be a valid integer: %w", err)
+		}
+		if n < 0 {
+			return nil, fmt.Errorf("MAX_CONCURRENT_REQUESTS must not be negative")
+		}
+		cfg.MaxConcurrentRequests = n
+	}
+
+	if limits := os.Getenv("BODY_SIZE_LIMITS"); limits != "" {
+		l, err := parseSizeLimits(limits)
+		if err != nil {
+			return nil, fmt.Errorf("BODY_SIZE_LIMITS: %w", err)
+		}
+		cfg.SizeLimits = l
+	}
+
+	if limits := os.Getenv("MAX_STATE_VERSIONS"); limits != "" {
+		l, err := parseVersionLimits(limits)
+		if err != nil {
+			return nil, fmt.Errorf("MAX_STATE_VERSIONS: %w", err)
+		}
+		cfg.VersionLimits = l
+	}
+
+	cfg.SizeWarnPercent = DefaultSizeWarnPercent
+	if pct := os.Getenv("SIZE_WARN_PERCENT"); pct != "" {
+		n, err := strconv.Atoi(pct)
+		if err != nil {
+			return nil, fmt.Errorf("SIZE_WARN_PERCENT must be a valid integer: %w", err)
+		}
+		if n < 0 || n > 100 {
+			return nil, fmt.Errorf("SIZE_WARN_PERCENT must be between 0 and 100")
+		}
+		cfg.SizeWarnPercent = n
+	}
+
+	if requireLock := os.Getenv("REQUIRE_LOCK"); requireLock != "" {
+		b, err := strconv.ParseBool(requireLock)
+		if err != nil {
+			return nil, fmt.Errorf("REQUIRE_LOCK must be a boolean: %w", err)
+		}
+		cfg.RequireLock = b
+	}
+
+	cfg.ProtectedStates = parseStatePatterns(os.Getenv("PROTECTED_STATES"))
+	cfg.ProtectedWriteDrain = DefaultProtectedWriteDrain
+	if drain := os.Getenv("PROTECTED_WRITE_DRAIN"); drain != "" {
+		d, err := time.ParseDuration(drain)
+		if err != nil {
+			return nil, fmt.Errorf("PROTECTED_WRITE_DRAIN must be a valid duration: %w", err)
+		}
+		if d < 0 {
+			return nil, fmt.Errorf("PROTECTED_WRITE_DRAIN must not be negative")
+		}
+		cfg.ProtectedWriteDrain = d
+	}
+
+	if wait := os.Getenv("LOCK_WAIT_TIMEOUT"); wait != "" {
+		d, err := time.ParseDuration(wait)
+		if err != nil {
+			return nil, fmt.Errorf("LOCK_WAIT_TIMEOUT must be a valid duration: %w", err)
+		}
+		if d < 0 {
+			return nil, fmt.Errorf("LOCK_WAIT_TIMEOUT must not be negative")
+		}
+		cfg.LockWait = d
+	}
+
+	if allowRaw := os.Getenv("ALLOW_RAW_STATE"); allowRaw != "" {
+		b, err := strconv.ParseBool(allowRaw)
+		if err != nil {
+			return nil, fmt.Errorf("ALLOW_RAW_STATE must be a boolean: %w", err)
+		}
+		cfg.AllowRawState = b
+	}
+
+	cfg.RouteHints = true
+	if hints := os.Getenv("ROUTE_HINTS"); hints != "" {
+		b, err := strconv.ParseBool(hints)
+		if err != nil {
+			return nil, fmt.Errorf("ROUTE_HINTS must be a boolean: %w", err)
+		}
+		cfg.RouteHints = b
+	}
+
+	cfg.SecurityHeaders = true
+	if headers := os.Getenv("SECURITY_HEADERS"); headers != "" {
+		b, err := strconv.ParseBool(headers)
+		if err != nil {
+			return nil, fmt.Errorf("SECURITY_HEADERS must be a boolean: %w", err)
+		}
+		cfg.SecurityHeaders = b
+	}
+	cfg.HSTSMaxAge = DefaultHSTSMaxAge
+	if maxAge := os.Getenv("HSTS_MAX_AGE"); maxAge != "" {
+		d, err := time.ParseDuration(maxAge)
+		if err != nil {
+			return nil, fmt.Errorf("HSTS_MAX_AGE must be a valid duration: %w", err)
+		}
+		if d < 0 {
+			return nil, fmt.Errorf("HSTS_MAX_AGE must not be negative")
+		}
+		cfg.HSTSMaxAge = d
+	}
+	if hide := os.Getenv("HIDE_VERSION"); hide != "" {
+		b, err := strconv.ParseBool(hide)
+		if err != nil {
+			return nil, fmt.Errorf("HIDE_VERSION must be a boolean: %w", err)
+		}
+		cfg.HideVersion = b
+	}
+
+	// Parse archiving policy
+	if months := os.Getenv("ARCHIVE_AFTER_MONTHS"); months != "" {
+		n, err := strconv.Atoi(months)
+		if err != nil {
+			return nil, fmt.Errorf("ARCHIVE_AFTER_MONTHS must be a valid integer: %w", err)
+		}
+		if n < 0 {
+			return nil, fmt.Errorf("ARCHIVE_AFTER_MONTHS must not be negative")
+		}
+		cfg.ArchiveAfterMonths = n
+	}
+	cfg.ArchiveInterval = DefaultArchiveInterval
+	if interval := os.Getenv("ARCHIVE_INTERVAL"); interval != "" {
+		d, err := time.ParseDuration(interval)
+		if err != nil {
+			return nil, fmt.Errorf("ARCHIVE_INTERVAL must be a valid duration: %w", err)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("ARCHIVE_INTERVAL must be positive")
+		}
+		cfg.ArchiveInterval = d
+	}
+
+	if interval := os.Getenv("SEARCH_INDEX_INTERVAL"); interval != "" {
+		d, err := time.ParseDuration(interval)
+		if err != nil {
+			return nil, fmt.Errorf("SEARCH_INDEX_INTERVAL must be a valid duration: %w", err)
+		}
+		if d < 0 {
+			return nil, fmt.Errorf("SEARCH_INDEX_INTERVAL must not be negative")
+		}
+		cfg.SearchIndexInterval = d
+	}
+	if warmup := os.Getenv("STARTUP_WARMUP"); warmup != "" {
+		b, err := strconv.ParseBool(warmup)
+		if err != nil {
+			return nil, fmt.Errorf("STARTUP_WARMUP must be a boolean: %w", err)
+		}
+		cfg.StartupWarmup = b
+	}
+
+	cfg.LockStealGrace = DefaultLockStealGrace
+	if grace := os.Getenv("LOCK_STEAL_GRACE"); grace != "" {
+		d, err := time.ParseDuration(grace)
+		if err != nil {
+			return nil, fmt.Errorf("LOCK_STEAL_GRACE must be a valid duration: %w", err)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("LOCK_STEAL_GRACE must be positive")
+		}
+		cfg.LockStealGrace = d
+	}
+
+	cfg.RunHistory = DefaultRunHistory
+	if history := os.Getenv("RUN_HISTORY"); history != "" {
+		n, err := strconv.Atoi(history)
+		if err != nil {
+			return nil, fmt.Errorf("RUN_HISTORY must be a valid integer: %w", err)
+		}
+		if n < 0 {
+			return nil, fmt.Errorf("RUN_HISTORY must not be negative")
+		}
+		cfg.RunHistory = n
+	}
+
+	if grace := os.Getenv("STATE_DELETE_GRACE"); grace != "" {
+		d, err := time.ParseDuration(grace)
+		if err != nil {
+			return nil, fmt.Errorf("STATE_DELETE_GRACE must be a valid duration: %w", err)
+		}
+		if d < 0 {
+			return nil, fmt.Errorf("STATE_DELETE_GRACE must not be negative")
+		}
+		cfg.StateDeleteGrace = d
+	}
+
+	// Parse the retry policy for Gitea API calls
+	cfg.Retry = RetryPolicy{MaxAttempts: DefaultRetryMaxAttempts, BaseDelay: DefaultRetryBaseDelay, Jitter: DefaultRetryJitter}
+	if attempts := os.Getenv("RETRY_MAX_ATTEMPTS"); attempts != "" {
+		n, err := strconv.Atoi(attempts)
+		if err != nil {
+			return nil, fmt.Errorf("RETRY_MAX_ATTEMPTS must be a valid integer: %w", err)
+		}
+		if n < 1 {
+			return nil, fmt.Errorf("RETRY_MAX_ATTEMPTS must be at least 1")
+		}
+		cfg.Retry.MaxAttempts = n
+	}
+	if delay := os.Getenv("RETRY_BASE_DELAY"); delay != "" {
+		d, err := time.ParseDuration(delay)
+		if err != nil {
+			return nil, fmt.Errorf("RETRY_BASE_DELAY must be a valid duration: %w", err)
+		}
+		if d < 0 {
+			return nil, fmt.Errorf("RETRY_BASE_DELAY must not be negative")
+		}
+		cfg.Retry.BaseDelay = d
+	}
+	if jitter := os.Getenv("RETRY_JITTER"); jitter != "" {
+		f, err := strconv.ParseFloat(jitter, 64)
+		if err != nil {
+			return nil, fmt.Errorf("RETRY_JITTER must be a valid number: %w", err)
+		}
+		if f < 0 || f > 1 {
+			return nil, fmt.Errorf("RETRY_JITTER must be between 0 and 1")
+		}
+		cfg.Retry.Jitter = f
+	}
+
+	// Parse the HTTP client settings for Gitea API calls
+	cfg.GiteaTimeout = DefaultGiteaTimeout
+	if timeout := os.Getenv("GITEA_TIMEOUT"); timeout != "" {
+		d, err := time.ParseDuration(timeout)
+		if err != nil {
+			return nil, fmt.Errorf("GITEA_TIMEOUT must be a valid duration: %w", err)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("GITEA_TIMEOUT must be positive")
+		}
+		cfg.GiteaTimeout = d
+	}
+	cfg.GiteaMaxIdleConns = DefaultGiteaMaxIdleConns
+	if conns := os.Getenv("GITEA_MAX_IDLE_CONNS"); conns != "" {
+		n, err := strconv.Atoi(conns)
+		if err != nil {
+			return nil, fmt.Errorf("GITEA_MAX_IDLE_CONNS must be a valid integer: %w", err)
+		}
+		if n < 0 {
+			return nil, fmt.Errorf("GITEA_MAX_IDLE_CONNS must not be negative")
+		}
+		cfg.GiteaMaxIdleConns = n
+	}
+	cfg.GiteaIdleConnTimeout = DefaultGiteaIdleConnTimeout
+	if timeout := os.Getenv("GITEA_IDLE_CONN_TIMEOUT"); timeout != "" {
+		d, err := time.ParseDuration(timeout)
+		if err != nil {
+			return nil, fmt.Errorf("GITEA_IDLE_CONN_TIMEOUT must be a valid duration: %w", err)
+		}
+		if d < 0 {
+			return nil, fmt.Errorf("GITEA_IDLE_CONN_TIMEOUT must not be negative")
+		}
+		cfg.GiteaIdleConnTimeout = d
+	}
+	cfg.GiteaKeepAlive = DefaultGiteaKeepAlive
+	if keepAlive := os.Getenv("GITEA_KEEP_ALIVE"); keepAlive != "" {
+		d, err := time.ParseDuration(keepAlive)
+		if err != nil {
+			return nil, fmt.Errorf("GITEA_KEEP_ALIVE must be a valid duration: %w", err)
+		}
+		if d < 0 {
+			return nil, fmt.Errorf("GITEA_KEEP_ALIVE must not be negative")
+		}
+		cfg.GiteaKeepAlive = d
+	}
+
+	if proxy := os.Getenv("GITEA_PROXY"); proxy != "" {
+		u, err := url.Parse(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("GITEA_PROXY must be a valid URL: %w", err)
+		}
+		switch u.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return nil, fmt.Errorf("GITEA_PROXY must be an http, https or socks5 URL")
+		}
+		cfg.GiteaProxy = u
+	}
+
+	// Parse repository size monitoring
+	cfg.RepoSizeInterval = DefaultRepoSizeInterval
+	if interval := os.Getenv("REPO_SIZE_INTERVAL"); interval != "" {
+		d, err := time.ParseDuration(interval)
+		if err != nil {
+			return nil, fmt.Errorf("REPO_SIZE_INTERVAL must be a valid duration: %w", err)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("REPO_SIZE_INTERVAL must be positive")
+		}
+		cfg.RepoSizeInterval = d
+	}
+	cfg.RepoGrowthWarnMBDay = DefaultRepoGrowthWarnMB
+	if warn := os.Getenv("REPO_GROWTH_WARN_MB_PER_DAY"); warn != "" {
+		n, err := strconv.Atoi(warn)
+		if err != nil {
+			return nil, fmt.Errorf("REPO_GROWTH_WARN_MB_PER_DAY must be a valid integer: %w", err)
+		}
+		if n < 0 {
+			return nil, fmt.Errorf("REPO_GROWTH_WARN_MB_PER_DAY must not be negative")
+		}
+		cfg.RepoGrowthWarnMBDay = n
+	}
+
+	if heap := os.Getenv("DEGRADE_HEAP_MB"); heap != "" {
+		n, err := strconv.Atoi(heap)
+		if err != nil {
+			return nil, fmt.Errorf("DEGRADE_HEAP_MB must be a valid integer: %w", err)
+		}
+		if n < 0 {
+			return nil, fmt.Errorf("DEGRADE_HEAP_MB must not be negative")
+		}
+		cfg.DegradeHeapMB = n
+	}
+	if goroutines := os.Getenv("DEGRADE_GOROUTINES"); goroutines != "" {
+		n, err := strconv.Atoi(goroutines)
+		if err != nil {
+			return nil, fmt.Errorf("DEGRADE_GOROUTINES must be a valid integer: %w", err)
+		}
+		if n < 0 {
+			return nil, fmt.Errorf("DEGRADE_GOROUTINES must not be negative")
+		}
+		cfg.DegradeGoroutines = n
+	}
+
+	// Parse background job controls
+	if timeout := os.Getenv("JOB_TIMEOUT"); timeout != "" {
+		d, err := time.ParseDuration(timeout)
+		if err != nil {
+			return nil, fmt.Errorf("JOB_TIMEOUT must be a valid duration: %w", err)
+		}
+		if d < 0 {
+			return nil, fmt.Errorf("JOB_TIMEOUT must not be negative")
+		}
+		cfg.JobTimeout = d
+	}
+	if timeouts := os.Getenv("JOB_TIMEOUTS"); timeouts != "" {
+		t, err := parseJobTimeouts(timeouts)
+		if err != nil {
+			return nil, fmt.Errorf("JOB_TIMEOUTS: %w", err)
+		}
+		cfg.JobTimeouts = t
+	}
+	if concurrency := os.Getenv("JOB_CONCURRENCY"); concurrency != "" {
+		n, err := strconv.Atoi(concurrency)
+		if err != nil {
+			return nil, fmt.Errorf("JOB_CONCURRENCY must be a valid integer: %w", err)
+		}
+		if n < 0 {
+			return nil, fmt.Errorf("JOB_CONCURRENCY must not be negative")
+		}
+		cfg.JobConcurrency = n
+	}
+	if paused := os.Getenv("JOBS_PAUSED"); paused != "" {
+		p, err := parseJobNames(paused)
+		if err != nil {
+			return nil, fmt.Errorf("JOBS_PAUSED: %w", err)
+		}
+		cfg.JobsPaused = p
+	}
+
+	// Parse read replicas
+	if replicas := os.Getenv("READ_REPLICAS"); replicas != "" {
+		r, err := parseReplicas(replicas)
+		if err != nil {
+			return nil, fmt.Errorf("READ_REPLICAS: %w", err)
+		}
+		cfg.ReadReplicas = r
+	}
+	cfg.ReplicaProbeInterval = DefaultReplicaProbeInterval
+	if interval := os.Getenv("REPLICA_PROBE_INTERVAL"); interval != "" {
+		d, err := time.ParseDuration(interval)
+		if err != nil {
+			return nil, fmt.Errorf("REPLICA_PROBE_INTERVAL must be a valid duration: %w", err)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("REPLICA_PROBE_INTERVAL must be positive")
+		}
+		cfg.ReplicaProbeInterval = d
+	}
+
+	cfg.WriteCoalesceDir = os.Getenv("WRITE_COALESCE_DIR")
+	if window := os.Getenv("WRITE_COALESCE_WINDOW"); window != "" {
+		d, err := time.ParseDuration(window)
+		if err != nil {
+			return nil, fmt.Errorf("WRITE_COALESCE_WINDOW must be a valid duration: %w", err)
+		}
+		if d < 0 {
+			return nil, fmt.Errorf("WRITE_COALESCE_WINDOW must not be negative")
+		}
+		if d > 0 && cfg.WriteCoalesceDir == "" {
+			return nil, fmt.Errorf("WRITE_COALESCE_DIR is required with WRITE_COALESCE_WINDOW")
+		}
+		cfg.WriteCoalesceWindow = d
+	}
+
+	cfg.ReadMissCacheTTL = DefaultReadMissCacheTTL
+	if ttl := os.Getenv("READ_MISS_CACHE_TTL"); ttl != "" {
+		d, err := time.ParseDuration(ttl)
+		if err != nil {
+			return nil, fmt.Errorf("READ_MISS_CACHE_TTL must be a valid duration: %w", err)
+		}
+		if d < 0 {
+			return nil, fmt.Errorf("READ_MISS_CACHE_TTL must not be negative")
+		}
+		cfg.ReadMissCacheTTL = d
+	}
+
+	cfg.CredentialReloadInterval = DefaultCredentialReloadInterval
+	if interval := os.Getenv("CREDENTIAL_RELOAD_INTERVAL"); interval != "" {
+		d, err := time.ParseDuration(interval)
+		if err != nil {
+			return nil, fmt.Errorf("CREDENTIAL_RELOAD_INTERVAL must be a valid duration: %w", err)
+		}
+		if d < 0 {
+			return nil, fmt.Errorf("CREDENTIAL_RELOAD_INTERVAL must not be negative")
+		}
+		cfg.CredentialReloadInterval = d
+	}
+
+	if devMode := os.Getenv("DEV_MODE"); devMode != "" {
+		b, err := strconv.ParseBool(devMode)
+		if err != nil {
+			return nil, fmt.Errorf("DEV_MODE must be a boolean: %w", err)
+		}
+		cfg.DevMode = b
+	}
+	if cfg.DevMode {
+		// The embedded Gitea stub accepts any credentials; its URL is set at startup
+		if cfg.GiteaToken == "" && cfg.GiteaUsername == "" {
+			cfg.GiteaToken = "dev"
+		}
+		if cfg.GiteaOwner == "" {
+			cfg.GiteaOwner = "dev"
+		}
+		if cfg.GiteaRepo == "" {
+			cfg.GiteaRepo = "terraform-state"
+		}
+	}
+
+	switch cfg.GiteaWriteMode {
+	case "":
+		cfg.GiteaWriteMode = WriteModeAPI
+	case WriteModeAPI, WriteModeGit, WriteModePR:
+	default:
+		return nil, fmt.Errorf("GITEA_WRITE_MODE must be %q, %q or %q", WriteModeAPI, WriteModeGit, WriteModePR)
+	}
+
+	cfg.PRMergeStyle = DefaultPRMergeStyle
+	if style := os.Getenv("PR_MERGE_STYLE"); style != "" {
+		if !slices.Contains(prMergeStyles, style) {
+			return nil, fmt.Errorf("PR_MERGE_STYLE must be one of %s", strings.Join(prMergeStyles, ", "))
+		}
+		cfg.PRMergeStyle = style
+	}
+
+	// Parse multi-repository routing
+	if multiRepo := os.Getenv("MULTI_REPO"); multiRepo != "" {
+		b, err := strconv.ParseBool(multiRepo)
+		if err != nil {
+			return nil, fmt.Errorf("MULTI_REPO must be a boolean: %w", err)
+		}
+		cfg.MultiRepo = b
+	}
+	if allowlist := os.Getenv("MULTI_REPO_ALLOWLIST"); allowlist != "" {
+		patterns, err := parseRepoPatterns(allowlist)
+		if err != nil {
+			return nil, fmt.Errorf("MULTI_REPO_ALLOWLIST: %w", err)
+		}
+		cfg.MultiRepoAllowlist = patterns
+	}
+	if cfg.MultiRepo {
+		if cfg.StorageBackend != BackendGitea || cfg.GiteaWriteMode != WriteModeAPI {
+			return nil, fmt.Errorf("MULTI_REPO is only supported by the %s backend with GITEA_WRITE_MODE=%s", BackendGitea, WriteModeAPI)
+		}
+		if len(cfg.MultiRepoAllowlist) == 0 {
+			return nil, fmt.Errorf("MULTI_REPO_ALLOWLIST is required with MULTI_REPO")
+		}
+	}
+
+	// Parse the state layout
+	cfg.StatePathTemplate = DefaultStatePathTemplate
+	if tmpl := os.Getenv("STATE_PATH_TEMPLATE"); tmpl != "" {
+		if _, err := parseStatePathTemplate(tmpl); err != nil {
+			return nil, fmt.Errorf("STATE_PATH_TEMPLATE %w", err)
+		}
+		cfg.StatePathTemplate = tmpl
+	}
+	if compression := os.Getenv("STATE_COMPRESSION"); compression != "" {
+		if !slices.Contains(stateCompressions, compression) {
+			return nil, fmt.Errorf("STATE_COMPRESSION must be one of %s", strings.Join(stateCompressions, ", "))
+		}
+		cfg.StateCompression = compression
+	}
+	if chunkMB := os.Getenv("STATE_CHUNK_SIZE_MB"); chunkMB != "" {
+		mb, err := strconv.Atoi(chunkMB)
+		if err != nil {
+			return nil, fmt.Errorf("STATE_CHUNK_SIZE_MB must be a valid integer: %w", err)
+		}
+		if mb < 0 {
+			return nil, fmt.Errorf("STATE_CHUNK_SIZE_MB must not be negative")
+		}
+		if mb > 0 && cfg.StorageBackend != BackendGitea && cfg.StorageBackend != BackendLocalGit {
+			return nil, fmt.Errorf("STATE_CHUNK_SIZE_MB is only supported by the %s and %s backends", BackendGitea, BackendLocalGit)
+		}
+		cfg.StateChunkSize = mb << 20
+	}
+
+	// Parse the commit message template
+	if tmpl := os.Getenv("COMMIT_MESSAGE_TEMPLATE"); tmpl != "" {
+		if _, err := parseCommitMessageTemplate(tmpl); err != nil {
+			return nil, fmt.Errorf("COMMIT_MESSAGE_TEMPLATE: %w", err)
+		}
+		cfg.CommitMessageTemplate = tmpl
+	}
+
+	if tag := os.Getenv("TAG_ON_UPDATE"); tag != "" {
+		b, err := strconv.ParseBool(tag)
+		if err != nil {
+			return nil, fmt.Errorf("TAG_ON_UPDATE must be a boolean: %w", err)
+		}
+		cfg.TagOnUpdate = b
+	}
+
+	cfg.CommitAuthorFromLock = true
+	if fromLock := os.Getenv("COMMIT_AUTHOR_FROM_LOCK"); fromLock != "" {
+		b, err := strconv.ParseBool(fromLock)
+		if err != nil {
+			return nil, fmt.Errorf("COMMIT_AUTHOR_FROM_LOCK must be a boolean: %w", err)
+		}
+		cfg.CommitAuthorFromLock = b
+	}
+
+	cfg.ConcurrentApplyWarnings = true
+	if warn := os.Getenv("CONCURRENT_APPLY_WARNINGS"); warn != "" {
+		b, err := strconv.ParseBool(warn)
+		if err != nil {
+			return nil, fmt.Errorf("CONCURRENT_APPLY_WARNINGS must be a boolean: %w", err)
+		}
+		cfg.ConcurrentApplyWarnings = b
+	}
+
+	cfg.VerifyChecksums = true
+	if verify := os.Getenv("VERIFY_CHECKSUMS"); verify != "" {
+		b, err := strconv.ParseBool(verify)
+		if err != nil {
+			return nil, fmt.Errorf("VERIFY_CHECKSUMS must be a boolean: %w", err)
+		}
+		cfg.VerifyChecksums = b
+	}
+
+	if fallback := os.Getenv("READ_FALLBACK"); fallback != "" {
+		b, err := strconv.ParseBool(fallback)
+		if err != nil {
+			return nil, fmt.Errorf("READ_FALLBACK must be a boolean: %w", err)
+		}
+		if b && cfg.StorageBackend != BackendGitea && cfg.StorageBackend != BackendLocalGit {
+			return nil, fmt.Errorf("READ_FALLBACK is only supported by the %s and %s backends", BackendGitea, BackendLocalGit)
+		}
+		cfg.ReadFallback = b
+	}
+
+	// Tenants are read from their file by the TenantRouter
+	cfg.TenantsFile = os.Getenv("TENANTS_FILE")
+	if cfg.TenantsFile != "" && (cfg.StorageBackend != BackendGitea || cfg.GiteaWriteMode != WriteModeAPI) {
+		return nil, fmt.Errorf("TENANTS_FILE is only supported by the %s backend with GITEA_WRITE_MODE=%s", BackendGitea, WriteModeAPI)
+	}
+
+	if budget := os.Getenv("GITEA_API_BUDGET"); budget != "" {
+		n, err := strconv.Atoi(budget)
+		if err != nil {
+			return nil, fmt.Errorf("GITEA_API_BUDGET must be a valid integer: %w", err)
+		}
+		if n < 0 {
+			return nil, fmt.Errorf("GITEA_API_BUDGET must not be negative")
+		}
+		if n > 0 && cfg.StorageBackend != BackendGitea {
+			return nil, fmt.Errorf("GITEA_API_BUDGET is only supported by the %s backend", BackendGitea)
+		}
+		cfg.GiteaAPIBudget = n
+	}
+	if concurrency := os.Getenv("GITEA_MAX_CONCURRENCY"); concurrency != "" {
+		n, err := strconv.Atoi(concurrency)
+		if err != nil {
+			return nil, fmt.Errorf("GITEA_MAX_CONCURRENCY must be a valid integer: %w", err)
+		}
+		if n < 0 {
+			return nil, fmt.Errorf("GITEA_MAX_CONCURRENCY must not be negative")
+		}
+		if n > 0 && cfg.StorageBackend != BackendGitea {
+			return nil, fmt.Errorf("GITEA_MAX_CONCURRENCY is only supported by the %s backend", BackendGitea)
+		}
+		cfg.GiteaMaxConcurrency = n
+	}
+	cfg.RepoMoves = RepoMovesFollow
+	if moves := os.Getenv("REPO_MOVES"); moves != "" {
+		if moves != RepoMovesFollow && moves != RepoMovesConfirm {
+			return nil, fmt.Errorf("REPO_MOVES must be %q or %q", RepoMovesFollow, RepoMovesConfirm)
+		}
+		if cfg.StorageBackend != BackendGitea {
+			return nil, fmt.Errorf("REPO_MOVES is only supported by the %s backend", BackendGitea)
+		}
+		cfg.RepoMoves = moves
+	}
+
+	// Parse repository topics
+	if topics := os.Getenv("REPO_TOPICS"); topics != "" {
+		t, err := parseRepoTopics(topics)
+		if err != nil {
+			return nil, fmt.Errorf("REPO_TOPICS: %w", err)
+		}
+		if cfg.StorageBackend != BackendGitea {
+			return nil, fmt.Errorf("REPO_TOPICS is only supported by the %s backend", BackendGitea)
+		}
+		cfg.RepoTopics = t
+	}
+
+	// Parse shadow verification; the shadow is any repository and branch
+	// other than the primary ones
+	shadowRepo, shadowBranch := os.Getenv("SHADOW_REPO"), os.Getenv("SHADOW_BRANCH")
+	if shadowRepo != "" || shadowBranch != "" {
+		cfg.Shadow = true
+		cfg.ShadowOwner, cfg.ShadowRepo, cfg.ShadowBranch = cfg.GiteaOwner, cfg.GiteaRepo, cfg.GiteaBranch
+		if shadowRepo != "" {
+			owner, repo, ok := strings.Cut(shadowRepo, "/")
+			if !ok || owner == "" || repo == "" || strings.Contains(repo, "/") {
+				return nil, fmt.Errorf("SHADOW_REPO must be owner/repo")
+			}
+			cfg.ShadowOwner, cfg.ShadowRepo = owner, repo
+		}
+		if shadowBranch != "" {
+			cfg.ShadowBranch = shadowBranch
+		}
+		if cfg.ShadowOwner == cfg.GiteaOwner && cfg.ShadowRepo == cfg.GiteaRepo && cfg.ShadowBranch == cfg.GiteaBranch {
+			return nil, fmt.Errorf("SHADOW_REPO and SHADOW_BRANCH must name a branch other than the primary one")
+		}
+		if cfg.StorageBackend != BackendGitea {
+			return nil, fmt.Errorf("SHADOW_REPO and SHADOW_BRANCH are only supported by the %s backend", BackendGitea)
+		}
+		switch cfg.ShadowWriteMode = os.Getenv("SHADOW_WRITE_MODE"); cfg.ShadowWriteMode {
+		case "":
+			cfg.ShadowWriteMode = cfg.GiteaWriteMode
+		case WriteModeAPI, WriteModeGit, WriteModePR:
+		default:
+			return nil, fmt.Errorf("SHADOW_WRITE_MODE must be %q, %q or %q", WriteModeAPI, WriteModeGit, WriteModePR)
+		}
+	}
+
+	// Parse metric labels
+	if labels := os.Getenv("METRICS_LABELS"); labels != "" {
+		l, err := parseMetricLabels(labels)
+		if err != nil {
+			return nil, fmt.Errorf("METRICS_LABELS: %w", err)
+		}
+		cfg.MetricsLabels = l
+	}
+	if tenantLabel := os.Getenv("METRICS_TENANT_LABEL"); tenantLabel != "" {
+		b, err := strconv.ParseBool(tenantLabel)
+		if err != nil {
+			return nil, fmt.Errorf("METRICS_TENANT_LABEL must be a boolean: %w", err)
+		}
+		cfg.MetricsTenantLabel = b
+	}
+
 	// Validate required fields
-	if cfg.GiteaURL == "" {
-		return nil, fmt.Errorf("GITEA_URL is required")
+	if cfg.GiteaURL == "" && !cfg.DevMode {
+		return nil, fmt.Errorf("%s_URL is required", envPrefix)
+	}
+	passwordAuth := cfg.GiteaUsername != "" || cfg.GiteaPassword != ""
+	if passwordAuth {
+		switch {
+		case cfg.StorageBackend != BackendGitea:
+			return nil, fmt.Errorf("GITEA_USERNAME and GITEA_PASSWORD are only supported by the %s backend", BackendGitea)
+		case cfg.GiteaUsername == "" || cfg.GiteaPassword == "":
+			return nil, fmt.Errorf("GITEA_USERNAME and GITEA_PASSWORD must be set together")
+		case cfg.GiteaToken != "":
+			return nil, fmt.Errorf("set either GITEA_TOKEN or GITEA_USERNAME and GITEA_PASSWORD, not both")
+		}
 	}
-	if cfg.GiteaToken == "" {
-		return nil, fmt.Errorf("GITEA_TOKEN is required")
+	if secret := secrets["GITEA_TOTP_SECRET"]; secret != "" {
+		if !passwordAuth {
+			return nil, fmt.Errorf("GITEA_TOTP_SECRET requires GITEA_USERNAME and GITEA_PASSWORD")
+		}
+		s, err := parseTOTPSecret(secret)
+		if err != nil {
+			return nil, fmt.Errorf("GITEA_TOTP_SECRET must be a base32 secret: %w", err)
+		}
+		cfg.GiteaTOTPSecret = s
+	}
+	if cfg.GiteaToken == "" && !passwordAuth && cfg.StorageBackend != BackendLocalGit {
+		return nil, fmt.Errorf("%s_TOKEN is required", envPrefix)
 	}
 	if cfg.GiteaOwner == "" {
-		return nil, fmt.Errorf("GITEA_OWNER is required")
+		return nil, fmt.Errorf("%s_OWNER is required", envPrefix)
 	}
 	if cfg.GiteaRepo == "" {
-		return nil, fmt.Errorf("GITEA_REPO is required")
+		return nil, fmt.Errorf("%s_REPO is required", envPrefix)
+	}
+	if cfg.ArchiveRepo == "" {
+		cfg.ArchiveRepo = cfg.GiteaRepo
+	}
+	if cfg.ReadReplicaToken == "" {
+		cfg.ReadReplicaToken = cfg.GiteaToken
+		if len(cfg.ReadReplicas) > 0 && passwordAuth {
+			return nil, fmt.Errorf("READ_REPLICA_TOKEN is required with password authentication")
+		}
+	}
+	if cfg.LockMethod == cfg.UnlockMethod {
+		return nil, fmt.Errorf("LOCK_METHOD and UNLOCK_METHOD must differ")
+	}
+	for _, method := range []string{cfg.LockMethod, cfg.UnlockMethod} {
+		if method == http.MethodGet || method == http.MethodPost {
+			return nil, fmt.Errorf("LOCK_METHOD and UNLOCK_METHOD must not be GET or POST, which read and write state")
+		}
+		if method == http.MethodTrace || method == "TRACK" {
+			return nil, fmt.Errorf("LOCK_METHOD and UNLOCK_METHOD must not be %s, which is always rejected", method)
+		}
 	}
 
 	return cfg, nil
 }
+
+// RepoURL returns the URL of the state repository, used to identify it in logs and events.
+func (c *Config) RepoURL() string {
+	if c.StorageBackend == BackendLocalGit {
+		return "file://" + filepath.Join(c.GiteaOwner, c.GiteaRepo)
+	}
+	return fmt.Sprintf("%s/%s/%s", strings.TrimSuffix(c.GiteaURL, "/"), c.GiteaOwner, c.GiteaRepo)
+}
@@ -1,7 +1,13 @@
 package main
 
 import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"testing"
+	"time"
 )
 
 func TestLoadConfig_Success(t *testing.T) {
@@ -116,6 +122,19 @@ func TestLoadConfig_NegativeMaxBodySize(t *testing.T) {
 	}
 }
 
+func TestLoadConfig_InvalidSizeWarnPercent(t *testing.T) {
+	t.Setenv("GITEA_URL", "https://gitea.example.com")
+	t.Setenv("GITEA_TOKEN", "test-token")
+	t.Setenv("GITEA_OWNER", "testowner")
+	t.Setenv("GITEA_REPO", "testrepo")
+	t.Setenv("SIZE_WARN_PERCENT", "120")
+
+	_, err := LoadConfig()
+	if err == nil {
+		t.Fatal("expected error for SIZE_WARN_PERCENT above 100")
+	}
+}
+
 func TestLoadConfig_MissingGiteaURL(t *testing.T) {
 	t.Setenv("GITEA_URL", "")
 	t.Setenv("GITEA_TOKEN", "test-token")
@@ -175,3 +194,1363 @@ func TestLoadConfig_MissingGiteaRepo(t *testing.T) {
 		t.Errorf("expected error message %q, got %q", "GITEA_REPO is required", err.Error())
 	}
 }
+
+func TestLoadConfig_Archive(t *testing.T) {
+	t.Setenv("GITEA_URL", "https://gitea.example.com")
+	t.Setenv("GITEA_TOKEN", "test-token")
+	t.Setenv("GITEA_OWNER", "testowner")
+	t.Setenv("GITEA_REPO", "testrepo")
+	t.Setenv("ARCHIVE_AFTER_MONTHS", "6")
+	t.Setenv("ARCHIVE_INTERVAL", "1h")
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if cfg.ArchiveAfterMonths != 6 {
+		t.Errorf("expected ArchiveAfterMonths 6, got %d", cfg.ArchiveAfterMonths)
+	}
+	if cfg.ArchiveInterval != time.Hour {
+		t.Errorf("expected ArchiveInterval 1h, got %s", cfg.ArchiveInterval)
+	}
+	if cfg.ArchiveRepo != "testrepo" {
+		t.Errorf("expected ArchiveRepo to default to GITEA_REPO, got %q", cfg.ArchiveRepo)
+	}
+}
+
+func TestLoadConfig_InvalidArchiveInterval(t *testing.T) {
+	t.Setenv("GITEA_URL", "https://gitea.example.com")
+	t.Setenv("GITEA_TOKEN", "test-token")
+	t.Setenv("GITEA_OWNER", "testowner")
+	t.Setenv("GITEA_REPO", "testrepo")
+	t.Setenv("ARCHIVE_INTERVAL", "daily")
+
+	_, err := LoadConfig()
+	if err == nil {
+		t.Fatal("expected error for invalid ARCHIVE_INTERVAL")
+	}
+}
+
+func TestLoadConfig_RequireLock(t *testing.T) {
+	t.Setenv("GITEA_URL", "https://gitea.example.com")
+	t.Setenv("GITEA_TOKEN", "test-token")
+	t.Setenv("GITEA_OWNER", "testowner")
+	t.Setenv("GITEA_REPO", "testrepo")
+	t.Setenv("REQUIRE_LOCK", "true")
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !cfg.RequireLock {
+		t.Error("expected RequireLock to be true")
+	}
+
+	t.Setenv("REQUIRE_LOCK", "sometimes")
+	if _, err := LoadConfig(); err == nil {
+		t.Fatal("expected error for invalid REQUIRE_LOCK")
+	}
+}
+
+func TestLoadConfig_GiteaWriteMode(t *testing.T) {
+	t.Setenv("GITEA_URL", "https://gitea.example.com")
+	t.Setenv("GITEA_TOKEN", "test-token")
+	t.Setenv("GITEA_OWNER", "testowner")
+	t.Setenv("GITEA_REPO", "testrepo")
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.GiteaWriteMode != WriteModeAPI {
+		t.Errorf("expected write mode %s, got %s", WriteModeAPI, cfg.GiteaWriteMode)
+	}
+
+	t.Setenv("GITEA_WRITE_MODE", "Git")
+	cfg, err = LoadConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.GiteaWriteMode != WriteModeGit {
+		t.Errorf("expected write mode %s, got %s", WriteModeGit, cfg.GiteaWriteMode)
+	}
+
+	t.Setenv("GITEA_WRITE_MODE", "rsync")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("expected error for invalid GITEA_WRITE_MODE")
+	}
+}
+
+func TestLoadConfig_PullRequestWriteMode(t *testing.T) {
+	t.Setenv("GITEA_URL", "https://gitea.example.com")
+	t.Setenv("GITEA_TOKEN", "test-token")
+	t.Setenv("GITEA_OWNER", "testowner")
+	t.Setenv("GITEA_REPO", "testrepo")
+	t.Setenv("GITEA_WRITE_MODE", "pr")
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.GiteaWriteMode != WriteModePR || cfg.PRMergeStyle != DefaultPRMergeStyle {
+		t.Errorf("expected write mode %s with merge style %s, got %s with %s", WriteModePR, DefaultPRMergeStyle, cfg.GiteaWriteMode, cfg.PRMergeStyle)
+	}
+
+	t.Setenv("PR_MERGE_STYLE", "squash")
+	cfg, err = LoadConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.PRMergeStyle != "squash" {
+		t.Errorf("expected merge style squash, got %s", cfg.PRMergeStyle)
+	}
+
+	t.Setenv("PR_MERGE_STYLE", "octopus")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("expected error for invalid PR_MERGE_STYLE")
+	}
+}
+
+func TestLoadConfig_StateDeleteGrace(t *testing.T) {
+	t.Setenv("GITEA_URL", "https://gitea.example.com")
+	t.Setenv("GITEA_TOKEN", "test-token")
+	t.Setenv("GITEA_OWNER", "testowner")
+	t.Setenv("GITEA_REPO", "testrepo")
+	t.Setenv("STATE_DELETE_GRACE", "168h")
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.StateDeleteGrace != 168*time.Hour {
+		t.Errorf("expected grace 168h, got %v", cfg.StateDeleteGrace)
+	}
+
+	t.Setenv("STATE_DELETE_GRACE", "-1h")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("expected error for negative STATE_DELETE_GRACE")
+	}
+}
+
+func TestLoadConfig_Retry(t *testing.T) {
+	t.Setenv("GITEA_URL", "https://gitea.example.com")
+	t.Setenv("GITEA_TOKEN", "test-token")
+	t.Setenv("GITEA_OWNER", "testowner")
+	t.Setenv("GITEA_REPO", "testrepo")
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.Retry.MaxAttempts != DefaultRetryMaxAttempts || cfg.Retry.BaseDelay != DefaultRetryBaseDelay || cfg.Retry.Jitter != DefaultRetryJitter {
+		t.Errorf("expected default retry policy, got %+v", cfg.Retry)
+	}
+
+	t.Setenv("RETRY_MAX_ATTEMPTS", "5")
+	t.Setenv("RETRY_BASE_DELAY", "1s")
+	t.Setenv("RETRY_JITTER", "0")
+	cfg, err = LoadConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.Retry.MaxAttempts != 5 || cfg.Retry.BaseDelay != time.Second || cfg.Retry.Jitter != 0 {
+		t.Errorf("unexpected retry policy: %+v", cfg.Retry)
+	}
+
+	for key, value := range map[string]string{"RETRY_MAX_ATTEMPTS": "0", "RETRY_BASE_DELAY": "soon", "RETRY_JITTER": "1.5"} {
+		t.Run(key, func(t *testing.T) {
+			t.Setenv(key, value)
+			if _, err := LoadConfig(); err == nil {
+				t.Errorf("expected error for %s=%s", key, value)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_GiteaHTTPClient(t *testing.T) {
+	t.Setenv("GITEA_URL", "https://gitea.example.com")
+	t.Setenv("GITEA_TOKEN", "test-token")
+	t.Setenv("GITEA_OWNER", "testowner")
+	t.Setenv("GITEA_REPO", "testrepo")
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.GiteaTimeout != DefaultGiteaTimeout || cfg.GiteaMaxIdleConns != DefaultGiteaMaxIdleConns ||
+		cfg.GiteaIdleConnTimeout != DefaultGiteaIdleConnTimeout || cfg.GiteaKeepAlive != DefaultGiteaKeepAlive {
+		t.Errorf("expected default HTTP client settings, got %v %d %v %v", cfg.GiteaTimeout, cfg.GiteaMaxIdleConns, cfg.GiteaIdleConnTimeout, cfg.GiteaKeepAlive)
+	}
+
+	t.Setenv("GITEA_TIMEOUT", "2m")
+	t.Setenv("GITEA_MAX_IDLE_CONNS", "4")
+	t.Setenv("GITEA_IDLE_CONN_TIMEOUT", "0")
+	t.Setenv("GITEA_KEEP_ALIVE", "0")
+	cfg, err = LoadConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.GiteaTimeout != 2*time.Minute || cfg.GiteaMaxIdleConns != 4 || cfg.GiteaIdleConnTimeout != 0 || cfg.GiteaKeepAlive != 0 {
+		t.Errorf("unexpected HTTP client settings: %v %d %v %v", cfg.GiteaTimeout, cfg.GiteaMaxIdleConns, cfg.GiteaIdleConnTimeout, cfg.GiteaKeepAlive)
+	}
+
+	for key, value := range map[string]string{"GITEA_TIMEOUT": "0", "GITEA_MAX_IDLE_CONNS": "many", "GITEA_IDLE_CONN_TIMEOUT": "-1s", "GITEA_KEEP_ALIVE": "often"} {
+		t.Run(key, func(t *testing.T) {
+			t.Setenv(key, value)
+			if _, err := LoadConfig(); err == nil {
+				t.Errorf("expected error for %s=%s", key, value)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_GiteaProxy(t *testing.T) {
+	t.Setenv("GITEA_URL", "https://gitea.example.com")
+	t.Setenv("GITEA_TOKEN", "test-token")
+	t.Setenv("GITEA_OWNER", "testowner")
+	t.Setenv("GITEA_REPO", "testrepo")
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.GiteaProxy != nil {
+		t.Errorf("expected no proxy override, got %v", cfg.GiteaProxy)
+	}
+
+	t.Setenv("GITEA_PROXY", "http://proxy.example.com:3128")
+	cfg, err = LoadConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.GiteaProxy == nil || cfg.GiteaProxy.Host != "proxy.example.com:3128" {
+		t.Errorf("unexpected proxy %v", cfg.GiteaProxy)
+	}
+
+	t.Setenv("GITEA_PROXY", "proxy.example.com")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("expected error for GITEA_PROXY without a scheme")
+	}
+}
+
+func TestLoadConfig_PasswordAuth(t *testing.T) {
+	t.Setenv("GITEA_URL", "https://gitea.example.com")
+	t.Setenv("GITEA_OWNER", "testowner")
+	t.Setenv("GITEA_REPO", "testrepo")
+	t.Setenv("GITEA_USERNAME", "tf-backend")
+	t.Setenv("GITEA_PASSWORD", "secret")
+	t.Setenv("GITEA_TOTP_SECRET", "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ")
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.GiteaUsername != "tf-backend" || cfg.GiteaPassword != "secret" || string(cfg.GiteaTOTPSecret) != "12345678901234567890" {
+		t.Errorf("unexpected credentials: %q %q %q", cfg.GiteaUsername, cfg.GiteaPassword, cfg.GiteaTOTPSecret)
+	}
+
+	for key, value := range map[string]string{"GITEA_TOKEN": "test-token", "GITEA_PASSWORD": "", "GITEA_TOTP_SECRET": "not base32!", "READ_REPLICAS": "https://mirror.example.com/testowner/testrepo"} {
+		t.Run(key, func(t *testing.T) {
+			t.Setenv(key, value)
+			if _, err := LoadConfig(); err == nil {
+				t.Errorf("expected error for %s=%s", key, value)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_SecretFiles(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{"gitea-token": "file-token\n", "auth-token": "  auth-secret  "} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("GITEA_URL", "https://gitea.example.com")
+	t.Setenv("GITEA_TOKEN_FILE", filepath.Join(dir, "gitea-token"))
+	t.Setenv("AUTH_TOKEN_FILE", filepath.Join(dir, "auth-token"))
+	t.Setenv("GITEA_OWNER", "testowner")
+	t.Setenv("GITEA_REPO", "testrepo")
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.GiteaToken != "file-token" || cfg.AuthToken != "auth-secret" {
+		t.Errorf("expected trimmed secrets from files, got %q and %q", cfg.GiteaToken, cfg.AuthToken)
+	}
+
+	t.Run("both set", func(t *testing.T) {
+		t.Setenv("GITEA_TOKEN", "env-token")
+		if _, err := LoadConfig(); err == nil {
+			t.Error("expected error for GITEA_TOKEN and GITEA_TOKEN_FILE")
+		}
+	})
+	t.Run("missing file", func(t *testing.T) {
+		t.Setenv("AUTH_TOKEN_FILE", filepath.Join(dir, "missing"))
+		if _, err := LoadConfig(); err == nil {
+			t.Error("expected error for a missing AUTH_TOKEN_FILE")
+		}
+	})
+}
+
+func TestLoadConfig_SecurityHeaders(t *testing.T) {
+	t.Setenv("GITEA_URL", "https://gitea.example.com")
+	t.Setenv("GITEA_TOKEN", "test-token")
+	t.Setenv("GITEA_OWNER", "testowner")
+	t.Setenv("GITEA_REPO", "testrepo")
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !cfg.SecurityHeaders || cfg.HSTSMaxAge != DefaultHSTSMaxAge || cfg.HideVersion {
+		t.Errorf("unexpected defaults: headers=%v hsts=%v hide=%v", cfg.SecurityHeaders, cfg.HSTSMaxAge, cfg.HideVersion)
+	}
+
+	t.Setenv("SECURITY_HEADERS", "false")
+	t.Setenv("HSTS_MAX_AGE", "0")
+	t.Setenv("HIDE_VERSION", "true")
+	cfg, err = LoadConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.SecurityHeaders || cfg.HSTSMaxAge != 0 || !cfg.HideVersion {
+		t.Errorf("unexpected config: headers=%v hsts=%v hide=%v", cfg.SecurityHeaders, cfg.HSTSMaxAge, cfg.HideVersion)
+	}
+
+	t.Setenv("UNLOCK_METHOD", "TRACE")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("expected error for UNLOCK_METHOD=TRACE")
+	}
+}
+
+func TestLoadConfig_AllowRawState(t *testing.T) {
+	t.Setenv("GITEA_URL", "https://gitea.example.com")
+	t.Setenv("GITEA_TOKEN", "test-token")
+	t.Setenv("GITEA_OWNER", "testowner")
+	t.Setenv("GITEA_REPO", "testrepo")
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.AllowRawState {
+		t.Error("expected AllowRawState to default to false")
+	}
+
+	t.Setenv("ALLOW_RAW_STATE", "true")
+	cfg, err = LoadConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !cfg.AllowRawState {
+		t.Error("expected AllowRawState to be true")
+	}
+}
+
+func TestLoadConfig_LockMethods(t *testing.T) {
+	t.Setenv("GITEA_URL", "https://gitea.example.com")
+	t.Setenv("GITEA_TOKEN", "test-token")
+	t.Setenv("GITEA_OWNER", "testowner")
+	t.Setenv("GITEA_REPO", "testrepo")
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.LockMethod != "LOCK" || cfg.UnlockMethod != "UNLOCK" {
+		t.Errorf("expected LOCK/UNLOCK defaults, got %s/%s", cfg.LockMethod, cfg.UnlockMethod)
+	}
+
+	t.Setenv("LOCK_METHOD", "put")
+	t.Setenv("UNLOCK_METHOD", "delete")
+	cfg, err = LoadConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.LockMethod != "PUT" || cfg.UnlockMethod != "DELETE" {
+		t.Errorf("expected PUT/DELETE, got %s/%s", cfg.LockMethod, cfg.UnlockMethod)
+	}
+
+	t.Setenv("UNLOCK_METHOD", "PUT")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("expected error for identical lock and unlock methods")
+	}
+
+	t.Setenv("LOCK_METHOD", "POST")
+	t.Setenv("UNLOCK_METHOD", "DELETE")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("expected error for POST as lock method")
+	}
+}
+
+func TestLoadConfig_GitHubBackend(t *testing.T) {
+	t.Setenv("GITEA_URL", "")
+	t.Setenv("STORAGE_BACKEND", "github")
+	t.Setenv("GITHUB_TOKEN", "gh-token")
+	t.Setenv("GITHUB_OWNER", "ghowner")
+	t.Setenv("GITHUB_REPO", "ghrepo")
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.GiteaURL != DefaultGitHubURL {
+		t.Errorf("expected GitHub API URL %s, got %s", DefaultGitHubURL, cfg.GiteaURL)
+	}
+	if cfg.GiteaToken != "gh-token" || cfg.GiteaOwner != "ghowner" || cfg.GiteaRepo != "ghrepo" || cfg.GiteaBranch != "main" {
+		t.Errorf("unexpected repository settings: %+v", cfg)
+	}
+
+	t.Setenv("GITHUB_TOKEN", "")
+	if _, err := LoadConfig(); err == nil || err.Error() != "GITHUB_TOKEN is required" {
+		t.Errorf("expected GITHUB_TOKEN error, got %v", err)
+	}
+
+	t.Setenv("STORAGE_BACKEND", "bitbucket")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("expected error for unknown STORAGE_BACKEND")
+	}
+}
+
+func TestLoadConfig_GitLabBackend(t *testing.T) {
+	t.Setenv("GITEA_URL", "")
+	t.Setenv("STORAGE_BACKEND", "gitlab")
+	t.Setenv("GITLAB_TOKEN", "gl-token")
+	t.Setenv("GITLAB_PROJECT", "infra/platform/tf-state")
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.GiteaURL != DefaultGitLabURL {
+		t.Errorf("expected GitLab URL %s, got %s", DefaultGitLabURL, cfg.GiteaURL)
+	}
+	if cfg.GiteaOwner != "infra/platform" || cfg.GiteaRepo != "tf-state" {
+		t.Errorf("expected namespace infra/platform and project tf-state, got %s and %s", cfg.GiteaOwner, cfg.GiteaRepo)
+	}
+
+	t.Setenv("GITLAB_PROJECT", "12345")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("expected error for numeric GITLAB_PROJECT")
+	}
+}
+
+func TestLoadConfig_LocalGitBackend(t *testing.T) {
+	t.Setenv("GITEA_URL", "")
+	t.Setenv("GITEA_TOKEN", "")
+	t.Setenv("STORAGE_BACKEND", "localgit")
+	t.Setenv("GIT_REPO_PATH", "/var/lib/tf-backend/state.git")
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.GiteaOwner != "/var/lib/tf-backend" || cfg.GiteaRepo != "state.git" {
+		t.Errorf("expected directory /var/lib/tf-backend and repository state.git, got %s and %s", cfg.GiteaOwner, cfg.GiteaRepo)
+	}
+	if cfg.RepoURL() != "file:///var/lib/tf-backend/state.git" {
+		t.Errorf("expected file URL, got %s", cfg.RepoURL())
+	}
+
+	t.Setenv("GIT_REPO_PATH", "")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("expected error for missing GIT_REPO_PATH")
+	}
+}
+
+func TestLoadConfig_DevMode(t *testing.T) {
+	t.Setenv("GITEA_URL", "")
+	t.Setenv("GITEA_TOKEN", "")
+	t.Setenv("GITEA_OWNER", "")
+	t.Setenv("GITEA_REPO", "")
+	t.Setenv("DEV_MODE", "true")
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !cfg.DevMode {
+		t.Error("expected DevMode to be true")
+	}
+	if cfg.GiteaOwner == "" || cfg.GiteaRepo == "" || cfg.GiteaToken == "" {
+		t.Errorf("expected dev defaults for Gitea settings, got %+v", cfg)
+	}
+	if cfg.ArchiveRepo != cfg.GiteaRepo {
+		t.Errorf("expected ArchiveRepo to default to GiteaRepo, got %q", cfg.ArchiveRepo)
+	}
+}
+
+func TestLoadConfig_MultiRepo(t *testing.T) {
+	t.Setenv("GITEA_URL", "https://gitea.example.com")
+	t.Setenv("GITEA_TOKEN", "test-token")
+	t.Setenv("GITEA_OWNER", "testowner")
+	t.Setenv("GITEA_REPO", "testrepo")
+	t.Setenv("MULTI_REPO", "true")
+
+	if _, err := LoadConfig(); err == nil {
+		t.Error("expected error for MULTI_REPO without an allowlist")
+	}
+
+	t.Setenv("MULTI_REPO_ALLOWLIST", "infra/*, platform/state")
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !cfg.MultiRepo || !slices.Equal(cfg.MultiRepoAllowlist, []string{"infra/*", "platform/state"}) {
+		t.Errorf("unexpected multi-repo config %v %v", cfg.MultiRepo, cfg.MultiRepoAllowlist)
+	}
+
+	for name, value := range map[string]string{"no repo": "infra", "nested": "infra/a/b", "bad pattern": "infra/["} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv("MULTI_REPO_ALLOWLIST", value)
+			if _, err := LoadConfig(); err == nil {
+				t.Errorf("expected error for MULTI_REPO_ALLOWLIST=%q", value)
+			}
+		})
+	}
+
+	t.Setenv("GITEA_WRITE_MODE", "git")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("expected error for MULTI_REPO with the git write mode")
+	}
+}
+
+func TestLoadConfig_TenantsFile(t *testing.T) {
+	t.Setenv("GITEA_URL", "https://gitea.example.com")
+	t.Setenv("GITEA_TOKEN", "test-token")
+	t.Setenv("GITEA_OWNER", "testowner")
+	t.Setenv("GITEA_REPO", "testrepo")
+	t.Setenv("TENANTS_FILE", "/etc/tfstate/tenants.yaml")
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.TenantsFile != "/etc/tfstate/tenants.yaml" {
+		t.Errorf("expected TenantsFile to be set, got %q", cfg.TenantsFile)
+	}
+
+	t.Setenv("GITEA_WRITE_MODE", "git")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("expected error for TENANTS_FILE with the git write mode")
+	}
+}
+
+func TestLoadConfig_MetricsLabels(t *testing.T) {
+	t.Setenv("GITEA_URL", "https://gitea.example.com")
+	t.Setenv("GITEA_TOKEN", "test-token")
+	t.Setenv("GITEA_OWNER", "testowner")
+	t.Setenv("GITEA_REPO", "testrepo")
+	t.Setenv("METRICS_LABELS", "cluster=eu-1,team=platform")
+	t.Setenv("METRICS_TENANT_LABEL", "true")
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.MetricsLabels["cluster"] != "eu-1" || cfg.MetricsLabels["team"] != "platform" || !cfg.MetricsTenantLabel {
+		t.Errorf("unexpected metrics config %v %v", cfg.MetricsLabels, cfg.MetricsTenantLabel)
+	}
+
+	t.Setenv("METRICS_LABELS", "cluster")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("expected error for an invalid METRICS_LABELS")
+	}
+}
+
+func TestLoadConfig_Shadow(t *testing.T) {
+	t.Setenv("GITEA_URL", "https://gitea.example.com")
+	t.Setenv("GITEA_TOKEN", "test-token")
+	t.Setenv("GITEA_OWNER", "testowner")
+	t.Setenv("GITEA_REPO", "testrepo")
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.Shadow {
+		t.Error("expected the shadow to be disabled by default")
+	}
+
+	t.Setenv("SHADOW_BRANCH", "shadow")
+	t.Setenv("SHADOW_WRITE_MODE", "git")
+	cfg, err = LoadConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !cfg.Shadow || cfg.ShadowOwner != "testowner" || cfg.ShadowRepo != "testrepo" || cfg.ShadowBranch != "shadow" || cfg.ShadowWriteMode != "git" {
+		t.Errorf("unexpected shadow config %+v", cfg)
+	}
+
+	for name, env := range map[string][2]string{
+		"primary branch": {"", "main"},
+		"invalid repo":   {"testrepo", "shadow"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv("SHADOW_REPO", env[0])
+			t.Setenv("SHADOW_BRANCH", env[1])
+			if _, err := LoadConfig(); err == nil {
+				t.Errorf("expected error for SHADOW_REPO=%q SHADOW_BRANCH=%q", env[0], env[1])
+			}
+		})
+	}
+
+	t.Setenv("SHADOW_WRITE_MODE", "ftp")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("expected error for an invalid SHADOW_WRITE_MODE")
+	}
+}
+
+func TestLoadConfig_StatePathTemplate(t *testing.T) {
+	t.Setenv("GITEA_URL", "https://gitea.example.com")
+	t.Setenv("GITEA_TOKEN", "test-token")
+	t.Setenv("GITEA_OWNER", "testowner")
+	t.Setenv("GITEA_REPO", "testrepo")
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.StatePathTemplate != DefaultStatePathTemplate {
+		t.Errorf("expected the default template, got %q", cfg.StatePathTemplate)
+	}
+
+	t.Setenv("STATE_PATH_TEMPLATE", "{name}.tfstate")
+	if cfg, err = LoadConfig(); err != nil || cfg.StatePathTemplate != "{name}.tfstate" {
+		t.Errorf("unexpected template %q, %v", cfg.StatePathTemplate, err)
+	}
+
+	t.Setenv("STATE_PATH_TEMPLATE", "terraform.tfstate")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("expected error for a template without {name}")
+	}
+}
+
+func TestLoadConfig_CommitMessageTemplate(t *testing.T) {
+	t.Setenv("GITEA_URL", "https://gitea.example.com")
+	t.Setenv("GITEA_TOKEN", "test-token")
+	t.Setenv("GITEA_OWNER", "testowner")
+	t.Setenv("GITEA_REPO", "testrepo")
+	t.Setenv("COMMIT_MESSAGE_TEMPLATE", "chore(state): {{.Operation}} {{.Name}}")
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.CommitMessageTemplate != "chore(state): {{.Operation}} {{.Name}}" {
+		t.Errorf("unexpected template %q", cfg.CommitMessageTemplate)
+	}
+
+	t.Setenv("COMMIT_MESSAGE_TEMPLATE", "{{.Nmae}}")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("expected error for a template naming an unknown field")
+	}
+}
+
+func TestLoadConfig_CommitAuthorFromLock(t *testing.T) {
+	t.Setenv("GITEA_URL", "https://gitea.example.com")
+	t.Setenv("GITEA_TOKEN", "test-token")
+	t.Setenv("GITEA_OWNER", "testowner")
+	t.Setenv("GITEA_REPO", "testrepo")
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !cfg.CommitAuthorFromLock {
+		t.Error("expected commits to be authored by lock holders by default")
+	}
+
+	t.Setenv("COMMIT_AUTHOR_FROM_LOCK", "false")
+	if cfg, err = LoadConfig(); err != nil || cfg.CommitAuthorFromLock {
+		t.Errorf("expected COMMIT_AUTHOR_FROM_LOCK=false to be honored, got %v, %v", cfg, err)
+	}
+
+	t.Setenv("COMMIT_AUTHOR_FROM_LOCK", "sometimes")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("expected error for a non-boolean COMMIT_AUTHOR_FROM_LOCK")
+	}
+}
+
+func TestLoadConfig_SearchIndexInterval(t *testing.T) {
+	t.Setenv("GITEA_URL", "https://gitea.example.com")
+	t.Setenv("GITEA_TOKEN", "test-token")
+	t.Setenv("GITEA_OWNER", "testowner")
+	t.Setenv("GITEA_REPO", "testrepo")
+	t.Setenv("SEARCH_INDEX_INTERVAL", "10m")
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.SearchIndexInterval != 10*time.Minute {
+		t.Errorf("expected 10m, got %s", cfg.SearchIndexInterval)
+	}
+
+	t.Setenv("SEARCH_INDEX_INTERVAL", "-1m")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("expected error for a negative SEARCH_INDEX_INTERVAL")
+	}
+}
+
+func TestLoadConfig_TagOnUpdate(t *testing.T) {
+	t.Setenv("GITEA_URL", "https://gitea.example.com")
+	t.Setenv("GITEA_TOKEN", "test-token")
+	t.Setenv("GITEA_OWNER", "testowner")
+	t.Setenv("GITEA_REPO", "testrepo")
+	t.Setenv("TAG_ON_UPDATE", "true")
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !cfg.TagOnUpdate {
+		t.Error("expected TagOnUpdate to be set")
+	}
+
+	t.Setenv("TAG_ON_UPDATE", "always")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("expected error for a non-boolean TAG_ON_UPDATE")
+	}
+}
+
+func TestLoadConfig_ConcurrentApplyWarnings(t *testing.T) {
+	t.Setenv("GITEA_URL", "https://gitea.example.com")
+	t.Setenv("GITEA_TOKEN", "test-token")
+	t.Setenv("GITEA_OWNER", "testowner")
+	t.Setenv("GITEA_REPO", "testrepo")
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !cfg.ConcurrentApplyWarnings {
+		t.Error("expected concurrent apply warnings by default")
+	}
+
+	t.Setenv("CONCURRENT_APPLY_WARNINGS", "false")
+	if cfg, err = LoadConfig(); err != nil || cfg.ConcurrentApplyWarnings {
+		t.Errorf("expected CONCURRENT_APPLY_WARNINGS=false to be honored, got %v, %v", cfg, err)
+	}
+
+	t.Setenv("CONCURRENT_APPLY_WARNINGS", "often")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("expected error for a non-boolean CONCURRENT_APPLY_WARNINGS")
+	}
+}
+
+func TestLoadConfig_ProtectedStates(t *testing.T) {
+	t.Setenv("GITEA_URL", "https://gitea.example.com")
+	t.Setenv("GITEA_TOKEN", "test-token")
+	t.Setenv("GITEA_OWNER", "testowner")
+	t.Setenv("GITEA_REPO", "testrepo")
+	t.Setenv("PROTECTED_STATES", "prod/*, /billing/ ,")
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(cfg.ProtectedStates) != 2 || cfg.ProtectedStates[0] != "prod/*" || cfg.ProtectedStates[1] != "billing" {
+		t.Errorf("expected patterns [prod/* billing], got %v", cfg.ProtectedStates)
+	}
+	if cfg.ProtectedWriteDrain != DefaultProtectedWriteDrain {
+		t.Errorf("expected drain %v, got %v", DefaultProtectedWriteDrain, cfg.ProtectedWriteDrain)
+	}
+
+	t.Setenv("PROTECTED_WRITE_DRAIN", "5m")
+	if cfg, err = LoadConfig(); err != nil || cfg.ProtectedWriteDrain != 5*time.Minute {
+		t.Errorf("expected drain 5m, got %v, %v", cfg, err)
+	}
+
+	t.Setenv("PROTECTED_WRITE_DRAIN", "-1m")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("expected error for a negative PROTECTED_WRITE_DRAIN")
+	}
+}
+
+func TestLoadConfig_StateCompression(t *testing.T) {
+	t.Setenv("GITEA_URL", "https://gitea.example.com")
+	t.Setenv("GITEA_TOKEN", "test-token")
+	t.Setenv("GITEA_OWNER", "testowner")
+	t.Setenv("GITEA_REPO", "testrepo")
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.StateCompression != "" {
+		t.Errorf("expected no compression by default, got %q", cfg.StateCompression)
+	}
+
+	t.Setenv("STATE_COMPRESSION", "zstd")
+	if cfg, err = LoadConfig(); err != nil || cfg.StateCompression != CompressionZstd {
+		t.Errorf("unexpected compression %q, %v", cfg.StateCompression, err)
+	}
+
+	t.Setenv("STATE_COMPRESSION", "brotli")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("expected error for an unknown compression format")
+	}
+}
+
+func TestLoadConfig_RunHistory(t *testing.T) {
+	t.Setenv("GITEA_URL", "https://gitea.example.com")
+	t.Setenv("GITEA_TOKEN", "test-token")
+	t.Setenv("GITEA_OWNER", "testowner")
+	t.Setenv("GITEA_REPO", "testrepo")
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.RunHistory != DefaultRunHistory {
+		t.Errorf("expected %d runs by default, got %d", DefaultRunHistory, cfg.RunHistory)
+	}
+
+	t.Setenv("RUN_HISTORY", "0")
+	if cfg, err = LoadConfig(); err != nil || cfg.RunHistory != 0 {
+		t.Errorf("unexpected run history %d, %v", cfg.RunHistory, err)
+	}
+
+	t.Setenv("RUN_HISTORY", "-1")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("expected error for a negative run history")
+	}
+}
+
+func TestLoadConfig_RepoTopics(t *testing.T) {
+	t.Setenv("GITEA_URL", "https://gitea.example.com")
+	t.Setenv("GITEA_TOKEN", "test-token")
+	t.Setenv("GITEA_OWNER", "testowner")
+	t.Setenv("GITEA_REPO", "testrepo")
+
+	t.Setenv("REPO_TOPICS", "terraform-state,managed-by-gitea-tf-backend")
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(cfg.RepoTopics) != 2 || cfg.RepoTopics[0] != "terraform-state" {
+		t.Errorf("unexpected topics %v", cfg.RepoTopics)
+	}
+
+	t.Setenv("REPO_TOPICS", "Terraform State")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("expected error for an invalid topic")
+	}
+
+	t.Setenv("REPO_TOPICS", "terraform-state")
+	t.Setenv("STORAGE_BACKEND", "github")
+	t.Setenv("GITHUB_TOKEN", "test-token")
+	t.Setenv("GITHUB_OWNER", "testowner")
+	t.Setenv("GITHUB_REPO", "testrepo")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("expected error for topics with the github backend")
+	}
+}
+
+func TestLoadConfig_StartupWarmup(t *testing.T) {
+	t.Setenv("GITEA_URL", "https://gitea.example.com")
+	t.Setenv("GITEA_TOKEN", "test-token")
+	t.Setenv("GITEA_OWNER", "testowner")
+	t.Setenv("GITEA_REPO", "testrepo")
+
+	t.Setenv("STARTUP_WARMUP", "true")
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !cfg.StartupWarmup {
+		t.Error("expected the warm-up to be enabled")
+	}
+
+	t.Setenv("STARTUP_WARMUP", "sometimes")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("expected error for an invalid boolean")
+	}
+}
+
+func TestLoadConfig_ReadMissCacheTTL(t *testing.T) {
+	t.Setenv("GITEA_URL", "https://gitea.example.com")
+	t.Setenv("GITEA_TOKEN", "test-token")
+	t.Setenv("GITEA_OWNER", "testowner")
+	t.Setenv("GITEA_REPO", "testrepo")
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.ReadMissCacheTTL != DefaultReadMissCacheTTL {
+		t.Errorf("expected the default TTL, got %v", cfg.ReadMissCacheTTL)
+	}
+
+	t.Setenv("READ_MISS_CACHE_TTL", "0")
+	cfg, err = LoadConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.ReadMissCacheTTL != 0 {
+		t.Errorf("expected 0 to disable the cache, got %v", cfg.ReadMissCacheTTL)
+	}
+
+	t.Setenv("READ_MISS_CACHE_TTL", "-1s")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("expected error for a negative TTL")
+	}
+}
+
+func TestLoadConfig_GiteaAPIBudget(t *testing.T) {
+	t.Setenv("GITEA_URL", "https://gitea.example.com")
+	t.Setenv("GITEA_TOKEN", "test-token")
+	t.Setenv("GITEA_OWNER", "testowner")
+	t.Setenv("GITEA_REPO", "testrepo")
+
+	t.Setenv("GITEA_API_BUDGET", "600")
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.GiteaAPIBudget != 600 {
+		t.Errorf("expected a budget of 600 calls a minute, got %d", cfg.GiteaAPIBudget)
+	}
+
+	for _, invalid := range []string{"-1", "lots"} {
+		t.Setenv("GITEA_API_BUDGET", invalid)
+		if _, err := LoadConfig(); err == nil {
+			t.Errorf("expected error for %q", invalid)
+		}
+	}
+}
+
+func TestLoadConfig_VerifyChecksums(t *testing.T) {
+	t.Setenv("GITEA_URL", "https://gitea.example.com")
+	t.Setenv("GITEA_TOKEN", "test-token")
+	t.Setenv("GITEA_OWNER", "testowner")
+	t.Setenv("GITEA_REPO", "testrepo")
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !cfg.VerifyChecksums {
+		t.Error("expected checksums to be verified by default")
+	}
+
+	t.Setenv("VERIFY_CHECKSUMS", "false")
+	cfg, err = LoadConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.VerifyChecksums {
+		t.Error("expected checksum verification to be disabled")
+	}
+
+	t.Setenv("VERIFY_CHECKSUMS", "maybe")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("expected error for an invalid boolean")
+	}
+}
+
+func TestLoadConfig_Listeners(t *testing.T) {
+	t.Setenv("GITEA_URL", "https://gitea.example.com")
+	t.Setenv("GITEA_TOKEN", "test-token")
+	t.Setenv("GITEA_OWNER", "testowner")
+	t.Setenv("GITEA_REPO", "testrepo")
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(cfg.Listeners) != 1 || cfg.Listeners[0].Addr != ":8080" {
+		t.Errorf("expected a single listener on the default address, got %v", cfg.Listeners)
+	}
+
+	t.Setenv("LISTENERS", ":8080 redirect, :8443 tls")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("expected error for a tls listener without a certificate")
+	}
+
+	t.Setenv("TLS_CERT_FILE", "/etc/tls.crt")
+	t.Setenv("TLS_KEY_FILE", "/etc/tls.key")
+	cfg, err = LoadConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(cfg.Listeners) != 2 || !cfg.Listeners[1].TLS {
+		t.Errorf("expected the listeners to be parsed, got %v", cfg.Listeners)
+	}
+
+	t.Setenv("LISTEN_ADDR", ":9090")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("expected error for both LISTEN_ADDR and LISTENERS")
+	}
+}
+
+func TestLoadConfig_TLSWithoutListeners(t *testing.T) {
+	t.Setenv("GITEA_URL", "https://gitea.example.com")
+	t.Setenv("GITEA_TOKEN", "test-token")
+	t.Setenv("GITEA_OWNER", "testowner")
+	t.Setenv("GITEA_REPO", "testrepo")
+
+	t.Setenv("TLS_CERT_FILE", "/etc/tls.crt")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("expected error for a certificate without a key")
+	}
+
+	t.Setenv("TLS_KEY_FILE", "/etc/tls.key")
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(cfg.Listeners) != 1 || !cfg.Listeners[0].TLS {
+		t.Errorf("expected LISTEN_ADDR to serve HTTPS, got %v", cfg.Listeners)
+	}
+}
+
+func TestLoadConfig_StateChunkSize(t *testing.T) {
+	t.Setenv("GITEA_URL", "https://gitea.example.com")
+	t.Setenv("GITEA_TOKEN", "test-token")
+	t.Setenv("GITEA_OWNER", "testowner")
+	t.Setenv("GITEA_REPO", "testrepo")
+
+	t.Setenv("STATE_CHUNK_SIZE_MB", "2")
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.StateChunkSize != 2<<20 {
+		t.Errorf("expected chunks of 2 MiB, got %d bytes", cfg.StateChunkSize)
+	}
+
+	for _, invalid := range []string{"-1", "big"} {
+		t.Setenv("STATE_CHUNK_SIZE_MB", invalid)
+		if _, err := LoadConfig(); err == nil {
+			t.Errorf("expected error for %q", invalid)
+		}
+	}
+
+	t.Setenv("STATE_CHUNK_SIZE_MB", "2")
+	t.Setenv("STORAGE_BACKEND", "github")
+	t.Setenv("GITHUB_TOKEN", "test-token")
+	t.Setenv("GITHUB_OWNER", "testowner")
+	t.Setenv("GITHUB_REPO", "testrepo")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("expected error for chunks on the github backend")
+	}
+}
+
+func TestLoadConfig_ReadFallback(t *testing.T) {
+	t.Setenv("GITEA_URL", "https://gitea.example.com")
+	t.Setenv("GITEA_TOKEN", "test-token")
+	t.Setenv("GITEA_OWNER", "testowner")
+	t.Setenv("GITEA_REPO", "testrepo")
+
+	t.Setenv("READ_FALLBACK", "true")
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !cfg.ReadFallback {
+		t.Error("expected reads to fall back")
+	}
+
+	t.Setenv("READ_FALLBACK", "sometimes")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("expected error for an invalid boolean")
+	}
+
+	t.Setenv("READ_FALLBACK", "true")
+	t.Setenv("STORAGE_BACKEND", "github")
+	t.Setenv("GITHUB_TOKEN", "test-token")
+	t.Setenv("GITHUB_OWNER", "testowner")
+	t.Setenv("GITHUB_REPO", "testrepo")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("expected error for a fallback on the github backend")
+	}
+}
+
+func TestLoadConfig_Degrade(t *testing.T) {
+	t.Setenv("GITEA_URL", "https://gitea.example.com")
+	t.Setenv("GITEA_TOKEN", "test-token")
+	t.Setenv("GITEA_OWNER", "testowner")
+	t.Setenv("GITEA_REPO", "testrepo")
+
+	t.Setenv("DEGRADE_HEAP_MB", "512")
+	t.Setenv("DEGRADE_GOROUTINES", "10000")
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.DegradeHeapMB != 512 || cfg.DegradeGoroutines != 10000 {
+		t.Errorf("expected limits of 512 MB and 10000 goroutines, got %d and %d", cfg.DegradeHeapMB, cfg.DegradeGoroutines)
+	}
+
+	for _, name := range []string{"DEGRADE_HEAP_MB", "DEGRADE_GOROUTINES"} {
+		for _, invalid := range []string{"-1", "many"} {
+			t.Setenv(name, invalid)
+			if _, err := LoadConfig(); err == nil {
+				t.Errorf("expected error for %s=%q", name, invalid)
+			}
+			t.Setenv(name, "0")
+		}
+	}
+}
+
+func TestLoadConfig_Jobs(t *testing.T) {
+	t.Setenv("GITEA_URL", "https://gitea.example.com")
+	t.Setenv("GITEA_TOKEN", "test-token")
+	t.Setenv("GITEA_OWNER", "testowner")
+	t.Setenv("GITEA_REPO", "testrepo")
+
+	t.Setenv("JOB_TIMEOUT", "10m")
+	t.Setenv("JOB_TIMEOUTS", "archive=1h")
+	t.Setenv("JOB_CONCURRENCY", "2")
+	t.Setenv("JOBS_PAUSED", "repo-topics, repo-size")
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.JobTimeout != 10*time.Minute || cfg.JobTimeouts["archive"] != time.Hour || cfg.JobConcurrency != 2 {
+		t.Errorf("unexpected job limits %s, %v and %d", cfg.JobTimeout, cfg.JobTimeouts, cfg.JobConcurrency)
+	}
+	if len(cfg.JobsPaused) != 2 || cfg.JobsPaused[0] != "repo-topics" || cfg.JobsPaused[1] != "repo-size" {
+		t.Errorf("unexpected paused jobs %v", cfg.JobsPaused)
+	}
+
+	for name, invalid := range map[string]string{
+		"JOB_TIMEOUT":     "-1s",
+		"JOB_TIMEOUTS":    "reaper=1m",
+		"JOB_CONCURRENCY": "-1",
+		"JOBS_PAUSED":     "gc",
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv(name, invalid)
+			if _, err := LoadConfig(); err == nil {
+				t.Errorf("expected error for %s=%q", name, invalid)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_RepoMoves(t *testing.T) {
+	t.Setenv("GITEA_URL", "https://gitea.example.com")
+	t.Setenv("GITEA_TOKEN", "test-token")
+	t.Setenv("GITEA_OWNER", "testowner")
+	t.Setenv("GITEA_REPO", "testrepo")
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.RepoMoves != RepoMovesFollow {
+		t.Errorf("expected moves to be followed by default, got %q", cfg.RepoMoves)
+	}
+
+	t.Setenv("REPO_MOVES", "confirm")
+	if cfg, err = LoadConfig(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.RepoMoves != RepoMovesConfirm {
+		t.Errorf("expected moves to wait for confirmation, got %q", cfg.RepoMoves)
+	}
+
+	t.Setenv("REPO_MOVES", "ignore")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("expected error for an unknown mode")
+	}
+}
+
+func TestLoadConfig_GiteaMaxConcurrency(t *testing.T) {
+	t.Setenv("GITEA_URL", "https://gitea.example.com")
+	t.Setenv("GITEA_TOKEN", "test-token")
+	t.Setenv("GITEA_OWNER", "testowner")
+	t.Setenv("GITEA_REPO", "testrepo")
+
+	t.Setenv("GITEA_MAX_CONCURRENCY", "8")
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.GiteaMaxConcurrency != 8 {
+		t.Errorf("expected 8 calls at once, got %d", cfg.GiteaMaxConcurrency)
+	}
+
+	for _, invalid := range []string{"-1", "some"} {
+		t.Setenv("GITEA_MAX_CONCURRENCY", invalid)
+		if _, err := LoadConfig(); err == nil {
+			t.Errorf("expected error for %q", invalid)
+		}
+	}
+}
+
+func TestLoadConfig_RequestRateLimit(t *testing.T) {
+	t.Setenv("GITEA_URL", "https://gitea.example.com")
+	t.Setenv("GITEA_TOKEN", "test-token")
+	t.Setenv("GITEA_OWNER", "testowner")
+	t.Setenv("GITEA_REPO", "testrepo")
+
+	t.Setenv("REQUEST_RATE_LIMIT", "120")
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.RequestRateLimit != 120 {
+		t.Errorf("expected 120 requests a minute, got %d", cfg.RequestRateLimit)
+	}
+
+	for _, invalid := range []string{"-1", "some"} {
+		t.Setenv("REQUEST_RATE_LIMIT", invalid)
+		if _, err := LoadConfig(); err == nil {
+			t.Errorf("expected error for %q", invalid)
+		}
+	}
+}
+
+func TestLoadConfig_MaxConcurrentRequests(t *testing.T) {
+	t.Setenv("GITEA_URL", "https://gitea.example.com")
+	t.Setenv("GITEA_TOKEN", "test-token")
+	t.Setenv("GITEA_OWNER", "testowner")
+	t.Setenv("GITEA_REPO", "testrepo")
+
+	t.Setenv("MAX_CONCURRENT_REQUESTS", "200")
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.MaxConcurrentRequests != 200 {
+		t.Errorf("expected 200 requests at once, got %d", cfg.MaxConcurrentRequests)
+	}
+
+	for _, invalid := range []string{"-1", "some"} {
+		t.Setenv("MAX_CONCURRENT_REQUESTS", invalid)
+		if _, err := LoadConfig(); err == nil {
+			t.Errorf("expected error for %q", invalid)
+		}
+	}
+}
+
+func TestLoadConfig_ACME(t *testing.T) {
+	t.Setenv("GITEA_URL", "https://gitea.example.com")
+	t.Setenv("GITEA_TOKEN", "test-token")
+	t.Setenv("GITEA_OWNER", "testowner")
+	t.Setenv("GITEA_REPO", "testrepo")
+
+	t.Setenv("ACME_DOMAIN", "tf-state.example.com, tf.example.com")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("expected error for ACME_DOMAIN without ACME_CACHE_DIR")
+	}
+
+	t.Setenv("ACME_CACHE_DIR", t.TempDir())
+	t.Setenv("ACME_EMAIL", "ops@example.com")
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(cfg.ACMEDomains) != 2 || cfg.ACMEDomains[1] != "tf.example.com" {
+		t.Errorf("expected 2 domains, got %v", cfg.ACMEDomains)
+	}
+	if cfg.ACMEEmail != "ops@example.com" {
+		t.Errorf("expected the contact address, got %q", cfg.ACMEEmail)
+	}
+	if len(cfg.Listeners) != 1 || !cfg.Listeners[0].TLS {
+		t.Errorf("expected LISTEN_ADDR to serve HTTPS, got %v", cfg.Listeners)
+	}
+
+	t.Setenv("LISTENERS", ":80 redirect, :443 tls")
+	if _, err := LoadConfig(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	t.Setenv("TLS_CERT_FILE", "/etc/tls.crt")
+	t.Setenv("TLS_KEY_FILE", "/etc/tls.key")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("expected error for both ACME_DOMAIN and TLS_CERT_FILE")
+	}
+}
+
+func TestLoadConfig_SystemdActivation(t *testing.T) {
+	t.Setenv("GITEA_URL", "https://gitea.example.com")
+	t.Setenv("GITEA_TOKEN", "test-token")
+	t.Setenv("GITEA_OWNER", "testowner")
+	t.Setenv("GITEA_REPO", "testrepo")
+
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	t.Setenv("LISTEN_FDS", "1")
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(cfg.Listeners) != 1 || cfg.Listeners[0].Addr != systemdPrefix {
+		t.Errorf("expected the systemd socket to be served, got %v", cfg.Listeners)
+	}
+
+	t.Setenv("LISTENERS", "systemd:http redirect, systemd:https tls")
+	t.Setenv("TLS_CERT_FILE", "/etc/tls.crt")
+	t.Setenv("TLS_KEY_FILE", "/etc/tls.key")
+	cfg, err = LoadConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(cfg.Listeners) != 2 || cfg.Listeners[1].Addr != "systemd:https" || !cfg.Listeners[1].TLS {
+		t.Errorf("expected the named sockets to be listed, got %v", cfg.Listeners)
+	}
+}
+
+func TestLoadConfig_Logging(t *testing.T) {
+	t.Setenv("GITEA_URL", "https://gitea.example.com")
+	t.Setenv("GITEA_TOKEN", "test-token")
+	t.Setenv("GITEA_OWNER", "testowner")
+	t.Setenv("GITEA_REPO", "testrepo")
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.LogLevel != slog.LevelInfo || cfg.LogFormat != LogFormatText {
+		t.Errorf("expected info text logs by default, got %v %s", cfg.LogLevel, cfg.LogFormat)
+	}
+
+	t.Setenv("LOG_LEVEL", "debug")
+	t.Setenv("LOG_FORMAT", "JSON")
+	if cfg, err = LoadConfig(); err != nil || cfg.LogLevel != slog.LevelDebug || cfg.LogFormat != LogFormatJSON {
+		t.Errorf("unexpected logging %v %s, %v", cfg.LogLevel, cfg.LogFormat, err)
+	}
+
+	t.Setenv("LOG_LEVEL", "verbose")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("expected error for an unknown log level")
+	}
+
+	t.Setenv("LOG_LEVEL", "")
+	t.Setenv("LOG_FORMAT", "logfmt")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("expected error for an unknown log format")
+	}
+}
+
+func TestLoadConfig_AccessLogFormat(t *testing.T) {
+	t.Setenv("GITEA_URL", "https://gitea.example.com")
+	t.Setenv("GITEA_TOKEN", "test-token")
+	t.Setenv("GITEA_OWNER", "testowner")
+	t.Setenv("GITEA_REPO", "testrepo")
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.AccessLogFormat != AccessLogEntries {
+		t.Errorf("expected requests logged as entries by default, got %q", cfg.AccessLogFormat)
+	}
+
+	t.Setenv("ACCESS_LOG_FORMAT", "combined")
+	if cfg, err = LoadConfig(); err != nil || cfg.AccessLogFormat != AccessLogCombined {
+		t.Errorf("unexpected access log format %q, %v", cfg.AccessLogFormat, err)
+	}
+
+	t.Setenv("ACCESS_LOG_FORMAT", "common")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("expected error for an unknown access log format")
+	}
+}
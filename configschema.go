@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// The configuration is read from environment variables, named by the env
+// tags of Config's fields. configSchema turns them into a JSON Schema of an
+// object holding the variables, such as the env map of a Helm chart's
+// values, with the descriptions and defaults documented in the README.
+
+// configSchemaID identifies the schema in its $id.
+const configSchemaID = "https://github.com/nbenn/gitea-tf-backend/config.schema.json"
+
+// Patterns of the values accepted by strconv.ParseBool and time.ParseDuration.
+const (
+	boolPattern     = `^(1|0|t|f|T|F|true|false|TRUE|FALSE|True|False)$`
+	durationPattern = `^([0-9]+(\.[0-9]*)?(ns|us|µs|ms|s|m|h))+$|^0$`
+)
+
+// configDoc is a variable's row in the README's configuration tables.
+type configDoc struct {
+	Default     string
+	Description string
+}
+
+var (
+	configRow    = regexp.MustCompile("(?m)^\\| ((?:`[A-Z][A-Z0-9_]*`(?: / )?)+) \\| [^|]* \\| ([^|]*) \\| (.*) \\|$")
+	markdownLink = regexp.MustCompile(`\[([^\]]+)\]\([^)]*\)`)
+)
+
+// configDocs returns the documentation of the variables in the README.
+func configDocs() map[string]configDoc {
+	readme, err := docsFS.ReadFile("README.md")
+	if err != nil {
+		return nil
+	}
+	docs := make(map[string]configDoc)
+	for _, m := range configRow.FindAllStringSubmatch(string(readme), -1) {
+		doc := configDoc{Description: markdownLink.ReplaceAllString(strings.TrimSpace(m[3]), "$1")}
+		if d := strings.TrimSpace(m[2]); strings.Count(d, "`") == 2 && strings.HasPrefix(d, "`") && strings.HasSuffix(d, "`") {
+			doc.Default = strings.Trim(d, "`")
+		}
+		for _, name := range strings.Split(m[1], " / ") {
+			docs[strings.Trim(name, "`")] = doc
+		}
+	}
+	return docs
+}
+
+// configSchema returns the JSON Schema of the configuration variables.
+func configSchema() map[string]any {
+	vars := make(map[string]reflect.Type)
+	collectConfigVars(reflect.TypeOf(Config{}), vars)
+
+	docs := configDocs()
+	properties := make(map[string]any, len(vars))
+	for name, typ := range vars {
+		property := typeSchema(typ)
+		doc := docs[name]
+		if doc.Description != "" {
+			property["description"] = doc.Description
+		}
+		// Defaults naming other variables, such as GITEA_REPO, are not values
+		if doc.Default != "" && vars[strings.Split(doc.Default, "/")[0]] == nil {
+			property["default"] = doc.Default
+		}
+		properties[name] = property
+	}
+	for _, name := range secretVars {
+		properties[name+"_FILE"] = map[string]any{
+			"type":        "string",
+			"description": "File to read " + name + " from, such as a mounted secret; mutually exclusive with " + name,
+		}
+	}
+
+	return map[string]any{
+		"$schema":     "https://json-schema.org/draft/2020-12/schema",
+		"$id":         configSchemaID,
+		"title":       "gitea-tf-backend configuration",
+		"description": "Environment variables read by gitea-tf-backend",
+		"type":        "object",
+		"properties":  properties,
+	}
+}
+
+// collectConfigVars records the type of every variable named by the env tags
+// of typ's fields, descending into fields without one.
+func collectConfigVars(typ reflect.Type, vars map[string]reflect.Type) {
+	for i := range typ.NumField() {
+		field := typ.Field(i)
+		tag, ok := field.Tag.Lookup("env")
+		if !ok {
+			if field.Type.Kind() == reflect.Struct {
+				collectConfigVars(field.Type, vars)
+			}
+			continue
+		}
+		for _, name := range strings.Split(tag, ",") {
+			vars[name] = field.Type
+		}
+	}
+}
+
+// typeSchema returns the schema of a variable parsed into typ. Numbers and
+// booleans may also be given as strings, as environment variables are.
+func typeSchema(typ reflect.Type) map[string]any {
+	switch {
+	case typ == reflect.TypeOf(time.Duration(0)):
+		return map[string]any{"type": "string", "pattern": durationPattern}
+	case typ == reflect.TypeOf(slog.Level(0)):
+		return map[string]any{"type": "string", "enum": logLevels}
+	case typ == reflect.TypeOf(&url.URL{}):
+		return map[string]any{"type": "string", "format": "uri"}
+	}
+	switch typ.Kind() {
+	case reflect.Bool:
+		return map[string]any{"type": []string{"boolean", "string"}, "pattern": boolPattern}
+	case reflect.Int, reflect.Int64:
+		return map[string]any{"type": []string{"integer", "string"}, "pattern": `^-?[0-9]+$`}
+	case reflect.Float64:
+		return map[string]any{"type": []string{"number", "string"}, "pattern": `^[0-9]*\.?[0-9]+$`}
+	default:
+		return map[string]any{"type": "string"}
+	}
+}
+
+// handleConfigSchema serves the configuration's JSON Schema at
+// GET /admin/config-schema.
+func handleConfigSchema(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/schema+json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	_ = encoder.Encode(configSchema())
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+func TestConfigSchema_CoversEveryVariable(t *testing.T) {
+	source, err := os.ReadFile("config.go")
+	if err != nil {
+		t.Fatalf("failed to read config.go: %v", err)
+	}
+	properties := configSchema()["properties"].(map[string]any)
+
+	// Variables read through helpers are named in config.go too
+	read := regexp.MustCompile(`"([A-Z][A-Z0-9]*_[A-Z0-9_]+)"`).FindAllStringSubmatch(string(source), -1)
+	if len(read) == 0 {
+		t.Fatal("expected to find the variables read by LoadConfig")
+	}
+	for _, m := range read {
+		property, ok := properties[m[1]].(map[string]any)
+		if !ok {
+			t.Errorf("%s is read by LoadConfig but missing from the schema; tag its Config field", m[1])
+			continue
+		}
+		if property["description"] == nil {
+			t.Errorf("%s has no description; document it in the README", m[1])
+		}
+	}
+}
+
+func TestConfigSchema_TagsEveryField(t *testing.T) {
+	// Fields set from other variables rather than read from their own
+	derived := map[string]bool{
+		"Shadow":      true, // SHADOW_BRANCH or SHADOW_REPO
+		"ShadowOwner": true, // SHADOW_REPO
+	}
+	var check func(typ reflect.Type)
+	check = func(typ reflect.Type) {
+		for i := range typ.NumField() {
+			field := typ.Field(i)
+			if _, ok := field.Tag.Lookup("env"); ok || derived[field.Name] {
+				continue
+			}
+			if field.Type.Kind() == reflect.Struct {
+				check(field.Type)
+				continue
+			}
+			t.Errorf("%s.%s has no env tag, so its variable is missing from the schema", typ.Name(), field.Name)
+		}
+	}
+	check(reflect.TypeOf(Config{}))
+
+	properties := configSchema()["properties"].(map[string]any)
+	for _, name := range []string{"SHADOW_BRANCH", "SHADOW_REPO", "SHADOW_WRITE_MODE", "RETRY_MAX_ATTEMPTS", "RETRY_BASE_DELAY", "RETRY_JITTER"} {
+		if _, ok := properties[name]; !ok {
+			t.Errorf("expected %s in the schema", name)
+		}
+	}
+}
+
+func TestConfigSchema_Types(t *testing.T) {
+	properties := configSchema()["properties"].(map[string]any)
+
+	tests := map[string]string{
+		"REQUIRE_LOCK":       boolPattern,
+		"LOCK_WAIT_TIMEOUT":  durationPattern,
+		"RETRY_MAX_ATTEMPTS": `^-?[0-9]+$`,
+		"GITEA_URL":          "",
+	}
+	for name, pattern := range tests {
+		property := properties[name].(map[string]any)
+		if got, _ := property["pattern"].(string); got != pattern {
+			t.Errorf("%s: expected pattern %q, got %q", name, pattern, got)
+		}
+	}
+
+	if d := properties["LISTEN_ADDR"].(map[string]any)["default"]; d != ":8080" {
+		t.Errorf("expected LISTEN_ADDR to default to :8080, got %v", d)
+	}
+	if d, ok := properties["ARCHIVE_REPO"].(map[string]any)["default"]; ok {
+		t.Errorf("expected no default for ARCHIVE_REPO, which defaults to another variable, got %v", d)
+	}
+	if e, _ := properties["LOG_LEVEL"].(map[string]any)["enum"].([]string); len(e) != len(logLevels) {
+		t.Errorf("expected LOG_LEVEL to be one of %v, got %v", logLevels, e)
+	}
+	if _, ok := properties["GITEA_TOKEN_FILE"]; !ok {
+		t.Error("expected the _FILE variant of secrets")
+	}
+}
+
+func TestHandleConfigSchema(t *testing.T) {
+	w := httptest.NewRecorder()
+	handleConfigSchema(w, httptest.NewRequest(http.MethodGet, "/admin/config-schema", nil))
+
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/schema+json" {
+		t.Fatalf("expected a schema, got %d with %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	var schema struct {
+		Schema     string         `json:"$schema"`
+		Properties map[string]any `json:"properties"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&schema); err != nil {
+		t.Fatalf("failed to decode schema: %v", err)
+	}
+	if schema.Schema == "" || schema.Properties["GITEA_URL"] == nil {
+		t.Errorf("unexpected schema %+v", schema)
+	}
+}
@@ -0,0 +1,220 @@
+// Package conformance checks that a state backend behaves the way
+// Terraform's http backend expects. The suites can be run against any
+// storage implementation or state handler, so that new backends can be shown
+// to behave like the existing ones:
+//
+//	func TestConformance(t *testing.T) {
+//		conformance.RunStorage(t, func(t *testing.T) conformance.Storage { return newMyStorage(t) })
+//		conformance.RunHandler(t, func(t *testing.T) http.Handler { return newMyHandler(t) })
+//	}
+package conformance
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Storage is the file storage a state handler is built on.
+type Storage interface {
+	// GetFile returns a file's content and a version identifier, or nil
+	// content and no error if the file does not exist.
+	GetFile(ctx context.Context, path string) ([]byte, string, error)
+	// CreateOrUpdateFile writes a file, creating it if needed.
+	CreateOrUpdateFile(ctx context.Context, path string, content []byte, message string) error
+}
+
+// RunStorage runs the storage suite. newStorage must return an empty
+// storage for each test.
+func RunStorage(t *testing.T, newStorage func(t *testing.T) Storage) {
+	t.Run("MissingFile", func(t *testing.T) {
+		content, sha, err := newStorage(t).GetFile(context.Background(), "states/missing/terraform.tfstate")
+		if err != nil || content != nil || sha != "" {
+			t.Errorf("expected no content, version or error for a missing file, got %q, %q, %v", content, sha, err)
+		}
+	})
+
+	t.Run("CreateAndUpdate", func(t *testing.T) {
+		storage := newStorage(t)
+		ctx := context.Background()
+		path := "states/team/network/terraform.tfstate"
+
+		if err := storage.CreateOrUpdateFile(ctx, path, []byte("first\n"), "create"); err != nil {
+			t.Fatalf("create failed: %v", err)
+		}
+		content, first, err := storage.GetFile(ctx, path)
+		if err != nil || string(content) != "first\n" || first == "" {
+			t.Fatalf("expected the created content with a version, got %q, %q, %v", content, first, err)
+		}
+
+		if err := storage.CreateOrUpdateFile(ctx, path, []byte("second\n"), "update"); err != nil {
+			t.Fatalf("update failed: %v", err)
+		}
+		content, second, err := storage.GetFile(ctx, path)
+		if err != nil || string(content) != "second\n" {
+			t.Fatalf("expected the updated content, got %q, %v", content, err)
+		}
+		if second == first {
+			t.Errorf("expected the version to change with the content, got %q twice", first)
+		}
+	})
+
+	t.Run("Isolation", func(t *testing.T) {
+		storage := newStorage(t)
+		ctx := context.Background()
+		if err := storage.CreateOrUpdateFile(ctx, "states/a/terraform.tfstate", []byte("a"), "create"); err != nil {
+			t.Fatal(err)
+		}
+		if content, _, err := storage.GetFile(ctx, "states/b/terraform.tfstate"); err != nil || content != nil {
+			t.Errorf("expected other files to be unaffected, got %q, %v", content, err)
+		}
+	})
+}
+
+// Lock bodies and states used by the handler suite.
+const (
+	lockA  = `{"ID":"lock-a","Operation":"OperationTypeApply","Who":"a@host"}`
+	lockB  = `{"ID":"lock-b","Operation":"OperationTypePlan","Who":"b@host"}`
+	state1 = `{"version":4,"serial":1,"lineage":"conformance"}`
+	state2 = `{"version":4,"serial":2,"lineage":"conformance"}`
+)
+
+// RunHandler runs the handler suite against Terraform's http backend
+// protocol, with the LOCK and UNLOCK methods. newHandler must return a
+// handler serving states at /{name} from an empty storage for each test.
+func RunHandler(t *testing.T, newHandler func(t *testing.T) http.Handler) {
+	t.Run("GetMissingState", func(t *testing.T) {
+		if w := do(newHandler(t), http.MethodGet, "/network", ""); w.Code != http.StatusNotFound {
+			t.Errorf("expected status 404, got %d", w.Code)
+		}
+	})
+
+	t.Run("WriteAndRead", func(t *testing.T) {
+		h := newHandler(t)
+		expectStatus(t, do(h, http.MethodPost, "/network", state1), http.StatusOK)
+		w := expectStatus(t, do(h, http.MethodGet, "/network", ""), http.StatusOK)
+		if !sameJSON(w.Body.Bytes(), []byte(state1)) {
+			t.Errorf("expected the written state, got %s", w.Body.String())
+		}
+	})
+
+	t.Run("LockIsIdempotent", func(t *testing.T) {
+		h := newHandler(t)
+		for range 2 {
+			w := expectStatus(t, do(h, "LOCK", "/network", lockA), http.StatusOK)
+			if holder := decodeLock(t, w); holder.ID != "lock-a" {
+				t.Errorf("expected the lock info to be returned, got %+v", holder)
+			}
+		}
+	})
+
+	t.Run("LockConflict", func(t *testing.T) {
+		h := newHandler(t)
+		expectStatus(t, do(h, "LOCK", "/network", lockA), http.StatusOK)
+		w := expectStatus(t, do(h, "LOCK", "/network", lockB), http.StatusLocked)
+		if holder := decodeLock(t, w); holder.ID != "lock-a" || holder.Who != "a@host" {
+			t.Errorf("expected the holder's lock info, got %+v", holder)
+		}
+		// Locks are per state
+		expectStatus(t, do(h, "LOCK", "/other", lockB), http.StatusOK)
+	})
+
+	t.Run("WriteUnderLock", func(t *testing.T) {
+		h := newHandler(t)
+		expectStatus(t, do(h, "LOCK", "/network", lockA), http.StatusOK)
+		expectStatus(t, do(h, http.MethodPost, "/network?ID=lock-a", state1), http.StatusOK)
+		w := expectStatus(t, do(h, http.MethodPost, "/network?ID=lock-b", state2), http.StatusLocked)
+		if holder := decodeLock(t, w); holder.ID != "lock-a" {
+			t.Errorf("expected the holder's lock info, got %+v", holder)
+		}
+		w = expectStatus(t, do(h, http.MethodGet, "/network", ""), http.StatusOK)
+		if !sameJSON(w.Body.Bytes(), []byte(state1)) {
+			t.Errorf("expected the rejected write not to be stored, got %s", w.Body.String())
+		}
+	})
+
+	t.Run("UnlockMismatch", func(t *testing.T) {
+		h := newHandler(t)
+		expectStatus(t, do(h, "LOCK", "/network", lockA), http.StatusOK)
+		expectStatus(t, do(h, "UNLOCK", "/network", lockB), http.StatusConflict)
+		expectStatus(t, do(h, "LOCK", "/network", lockB), http.StatusLocked)
+	})
+
+	t.Run("UnlockIsIdempotent", func(t *testing.T) {
+		h := newHandler(t)
+		expectStatus(t, do(h, "LOCK", "/network", lockA), http.StatusOK)
+		expectStatus(t, do(h, "UNLOCK", "/network", lockA), http.StatusOK)
+		expectStatus(t, do(h, "UNLOCK", "/network", lockA), http.StatusOK)
+		expectStatus(t, do(h, "LOCK", "/network", lockB), http.StatusOK)
+	})
+
+	t.Run("ForceUnlock", func(t *testing.T) {
+		// terraform force-unlock sends the lock without its holder's details;
+		// an empty ID releases any lock
+		h := newHandler(t)
+		expectStatus(t, do(h, "LOCK", "/network", lockA), http.StatusOK)
+		expectStatus(t, do(h, "UNLOCK", "/network", `{"ID":""}`), http.StatusOK)
+		expectStatus(t, do(h, "LOCK", "/network", lockB), http.StatusOK)
+	})
+
+	t.Run("SerialRegression", func(t *testing.T) {
+		h := newHandler(t)
+		expectStatus(t, do(h, http.MethodPost, "/network", state2), http.StatusOK)
+		expectStatus(t, do(h, http.MethodPost, "/network", state1), http.StatusConflict)
+		expectStatus(t, do(h, http.MethodPost, "/network?force=true", state1), http.StatusOK)
+	})
+
+	t.Run("InvalidLockInfo", func(t *testing.T) {
+		if w := do(newHandler(t), "LOCK", "/network", "not json"); w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+	})
+}
+
+// lockInfo is the part of Terraform's lock info the suite inspects.
+type lockInfo struct {
+	ID  string `json:"ID"`
+	Who string `json:"Who"`
+}
+
+// do sends a request with body to h.
+func do(h http.Handler, method, target, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+	return w
+}
+
+// expectStatus fails the test unless w has the status want.
+func expectStatus(t *testing.T, w *httptest.ResponseRecorder, want int) *httptest.ResponseRecorder {
+	t.Helper()
+	if w.Code != want {
+		t.Fatalf("expected status %d, got %d: %s", want, w.Code, w.Body.String())
+	}
+	return w
+}
+
+// decodeLock decodes the lock info in a response body.
+func decodeLock(t *testing.T, w *httptest.ResponseRecorder) lockInfo {
+	t.Helper()
+	var info lockInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil {
+		t.Fatalf("expected lock info in the body, got %s", w.Body.String())
+	}
+	return info
+}
+
+// sameJSON reports whether a and b hold the same JSON value, as handlers may
+// reformat the states they store.
+func sameJSON(a, b []byte) bool {
+	var va, vb any
+	if json.Unmarshal(a, &va) != nil || json.Unmarshal(b, &vb) != nil {
+		return false
+	}
+	ja, _ := json.Marshal(va)
+	jb, _ := json.Marshal(vb)
+	return bytes.Equal(ja, jb)
+}
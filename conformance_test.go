@@ -0,0 +1,33 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"gitea-tf-backend/conformance"
+)
+
+// conformanceBackends are the storage backends checked by the conformance
+// suites.
+var conformanceBackends = map[string]func(t *testing.T) StateStorage{
+	"memory":   func(*testing.T) StateStorage { return NewMockStorage() },
+	"localgit": func(t *testing.T) StateStorage { return newTestLocalGitClient(t) },
+	"gitea":    func(t *testing.T) StateStorage { return newTestGiteaClient(t) },
+	"github":   func(t *testing.T) StateStorage { return newTestGitHubClient(t) },
+	"gitlab":   func(t *testing.T) StateStorage { return newTestGitLabClient(t) },
+}
+
+func TestConformance(t *testing.T) {
+	for name, newStorage := range conformanceBackends {
+		t.Run(name, func(t *testing.T) {
+			t.Run("Storage", func(t *testing.T) {
+				conformance.RunStorage(t, func(t *testing.T) conformance.Storage { return newStorage(t) })
+			})
+			t.Run("Handler", func(t *testing.T) {
+				conformance.RunHandler(t, func(t *testing.T) http.Handler {
+					return NewStateHandler(newStorage(t), DefaultMaxBodySize)
+				})
+			})
+		})
+	}
+}
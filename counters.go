@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Persistent counter keys.
+const (
+	auditSeqCounter     = "audit_seq"
+	stateUpdatesCounter = "state_updates/" // Followed by the state name
+)
+
+// CounterStore holds operational counters that survive restarts, unlike the
+// process-scoped Prometheus metrics. Every change is written through to a
+// small JSON file, replaced atomically. Without a path the counters are kept
+// in memory only.
+type CounterStore struct {
+	path string
+
+	mu       sync.Mutex
+	created  time.Time
+	counters map[string]int64
+}
+
+// counterFile is the on-disk format of a CounterStore.
+type counterFile struct {
+	Created  time.Time        `json:"created"`
+	Counters map[string]int64 `json:"counters"`
+}
+
+// OpenCounterStore loads the counters at path, starting from zero if the file
+// does not exist yet.
+func OpenCounterStore(path string) (*CounterStore, error) {
+	store := &CounterStore{path: path, created: time.Now().UTC(), counters: make(map[string]int64)}
+	if path == "" {
+		return store, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read counters: %w", err)
+	}
+
+	var file counterFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid counters file %s: %w", path, err)
+	}
+	if !file.Created.IsZero() {
+		store.created = file.Created
+	}
+	for key, value := range file.Counters {
+		store.counters[key] = value
+	}
+	return store, nil
+}
+
+// Get returns the value of a counter. It is safe to call on a nil store.
+func (s *CounterStore) Get(key string) int64 {
+	if s == nil {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.counters[key]
+}
+
+// Add increments a counter by delta and returns the new value.
+// It is safe to call on a nil store.
+func (s *CounterStore) Add(key string, delta int64) int64 {
+	if s == nil {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.counters[key] += delta
+	s.saveLocked()
+	return s.counters[key]
+}
+
+// Set sets a counter to value. It is safe to call on a nil store.
+func (s *CounterStore) Set(key string, value int64) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.counters[key] = value
+	s.saveLocked()
+}
+
+// saveLocked writes the counters to disk. Failures are logged rather than
+// returned, as losing a counter update must not fail the operation it counts.
+// Must be called with s.mu held.
+func (s *CounterStore) saveLocked() {
+	if s.path == "" {
+		return
+	}
+	if err := s.writeLocked(); err != nil {
+		slog.Error("Error saving counters", "file", s.path, "error", err)
+	}
+}
+
+func (s *CounterStore) writeLocked() error {
+	data, err := json.Marshal(counterFile{Created: s.created, Counters: s.counters})
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// statsResponse reports the persistent counters.
+type statsResponse struct {
+	Since        time.Time        `json:"since"`
+	AuditSeq     int64            `json:"audit_seq"`
+	StateUpdates map[string]int64 `json:"state_updates"`
+}
+
+// ServeHTTP reports the counters, for reports spanning restarts.
+func (s *CounterStore) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	s.mu.Lock()
+	resp := statsResponse{
+		Since:        s.created,
+		AuditSeq:     s.counters[auditSeqCounter],
+		StateUpdates: make(map[string]int64),
+	}
+	for key, value := range s.counters {
+		if name, ok := strings.CutPrefix(key, stateUpdatesCounter); ok {
+			resp.StateUpdates[name] = value
+		}
+	}
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCounterStore_PersistsAcrossReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "counters.json")
+
+	store, err := OpenCounterStore(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	store.Add(stateUpdatesCounter+"myproject", 1)
+	store.Add(stateUpdatesCounter+"myproject", 1)
+	store.Set(auditSeqCounter, 42)
+
+	store, err = OpenCounterStore(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n := store.Get(stateUpdatesCounter + "myproject"); n != 2 {
+		t.Errorf("expected 2 updates, got %d", n)
+	}
+	if n := store.Get(auditSeqCounter); n != 42 {
+		t.Errorf("expected audit seq 42, got %d", n)
+	}
+}
+
+func TestCounterStore_InvalidFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "counters.json")
+	if err := os.WriteFile(path, []byte("not json"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := OpenCounterStore(path); err == nil {
+		t.Error("expected error for invalid counters file")
+	}
+}
+
+func TestCounterStore_Nil(t *testing.T) {
+	var store *CounterStore
+	if n := store.Add("x", 1); n != 0 {
+		t.Errorf("expected 0 from nil store, got %d", n)
+	}
+	store.Set("x", 1)
+	if n := store.Get("x"); n != 0 {
+		t.Errorf("expected 0 from nil store, got %d", n)
+	}
+}
+
+func TestAuditLog_SeqSurvivesRotation(t *testing.T) {
+	dir := t.TempDir()
+	counters, err := OpenCounterStore(filepath.Join(dir, "counters.json"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	auditLog, err := OpenAuditLog(filepath.Join(dir, "audit.jsonl"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	auditLog.PersistSeq(counters)
+	_ = auditLog.Record(AuditEntry{Repo: "o/r", Action: "create", Path: "states/a/terraform.tfstate"})
+	_ = auditLog.Record(AuditEntry{Repo: "o/r", Action: "update", Path: "states/a/terraform.tfstate"})
+	_ = auditLog.Close()
+
+	// A fresh log file continues the numbering
+	rotated := filepath.Join(dir, "audit-2.jsonl")
+	auditLog, err = OpenAuditLog(rotated)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	auditLog.PersistSeq(counters)
+	_ = auditLog.Record(AuditEntry{Repo: "o/r", Action: "delete", Path: "states/a/terraform.tfstate"})
+	_ = auditLog.Close()
+
+	entries, err := ReadAuditLog(rotated)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Seq != 3 {
+		t.Errorf("expected a single entry with seq 3, got %+v", entries)
+	}
+}
+
+func TestPostState_CountsUpdates(t *testing.T) {
+	handler, _ := newTestHandler()
+	handler.counters, _ = OpenCounterStore("")
+
+	for i := 1; i <= 2; i++ {
+		body := strings.NewReader(fmt.Sprintf(`{"version":4,"serial":%d,"lineage":"abc"}`, i))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/myproject", body))
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	handler.counters.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/stats", nil))
+
+	var resp statsResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if resp.StateUpdates["myproject"] != 2 {
+		t.Errorf("expected 2 updates of myproject, got %v", resp.StateUpdates)
+	}
+	if resp.Since.IsZero() {
+		t.Error("expected since to be set")
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"runtime"
+	"runtime/metrics"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Reasons the backend degrades, as exported in tfstate_degradations_total.
+const (
+	DegradeReasonHeap       = "heap"
+	DegradeReasonGoroutines = "goroutines"
+	DegradeReasonBudget     = "gitea_budget"
+)
+
+// DefaultDegradeCheckInterval is the time between checks of the resources a
+// Degrader watches.
+const DefaultDegradeCheckInterval = 5 * time.Second
+
+// degradeRecovery is the share of a limit a resource must fall below before
+// the backend recovers, so that it does not flap around the limit.
+const degradeRecovery = 0.8
+
+// heapMetric is the runtime metric of the memory held by heap objects, live
+// or not yet swept. Reading it does not stop the world, unlike ReadMemStats.
+const heapMetric = "/memory/classes/heap/objects:bytes"
+
+// Degrader pauses non-essential background jobs while the backend is under
+// resource pressure: its heap or goroutines above their limits, or the Gitea
+// API budget strained by request traffic. Serving Terraform comes first; the
+// search index, archiving and the like catch up once the pressure is gone.
+//
+// A nil Degrader never degrades.
+type Degrader struct {
+	heapLimit      uint64 // Bytes; 0 disables
+	goroutineLimit int    // 0 disables
+	budget         *APIBudget
+
+	mu       sync.Mutex
+	reasons  []string // Why the backend is degraded; empty when healthy
+	degraded atomic.Bool
+
+	heap       func() uint64 // Overridden in tests
+	goroutines func() int
+}
+
+// NewDegrader creates a Degrader watching the heap and goroutine limits,
+// each disabled if 0, and budget, if not nil.
+func NewDegrader(heapLimit uint64, goroutineLimit int, budget *APIBudget) *Degrader {
+	return &Degrader{
+		heapLimit:      heapLimit,
+		goroutineLimit: goroutineLimit,
+		budget:         budget,
+		heap:           heapBytes,
+		goroutines:     runtime.NumGoroutine,
+	}
+}
+
+// heapBytes returns the memory held by heap objects.
+func heapBytes() uint64 {
+	sample := []metrics.Sample{{Name: heapMetric}}
+	metrics.Read(sample)
+	if sample[0].Value.Kind() != metrics.KindUint64 {
+		return 0
+	}
+	return sample[0].Value.Uint64()
+}
+
+// Degraded reports whether non-essential jobs are paused.
+func (d *Degrader) Degraded() bool {
+	return d != nil && d.degraded.Load()
+}
+
+// Check samples the watched resources and degrades or recovers accordingly.
+// Transitions are logged and exported. It is run periodically.
+func (d *Degrader) Check(context.Context) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// Limits are left at their recovery share once degraded
+	factor := 1.0
+	if len(d.reasons) > 0 {
+		factor = degradeRecovery
+	}
+	var reasons []string
+	if d.heapLimit > 0 && float64(d.heap()) > float64(d.heapLimit)*factor {
+		reasons = append(reasons, DegradeReasonHeap)
+	}
+	if d.goroutineLimit > 0 && float64(d.goroutines()) > float64(d.goroutineLimit)*factor {
+		reasons = append(reasons, DegradeReasonGoroutines)
+	}
+	if d.budget != nil && d.budget.Strained() {
+		reasons = append(reasons, DegradeReasonBudget)
+	}
+
+	switch {
+	case len(reasons) > 0 && len(d.reasons) == 0:
+		slog.Warn("Pausing non-essential background jobs under resource pressure", "reasons", reasons)
+		for _, reason := range reasons {
+			IncrementDegradations(reason)
+		}
+	case len(reasons) == 0 && len(d.reasons) > 0:
+		slog.Info("Resuming non-essential background jobs", "recovered", d.reasons)
+	}
+	d.reasons = reasons
+	d.degraded.Store(len(reasons) > 0)
+	SetDegraded(len(reasons) > 0)
+	return nil
+}
+
+// Pausable returns the background job fn, named name, made to skip its runs
+// while the backend is degraded. Its first run is never skipped, so that
+// startup work such as the warmup of the search index completes.
+func (d *Degrader) Pausable(name string, fn func(context.Context) error) func(context.Context) error {
+	if d == nil {
+		return fn
+	}
+	var ran atomic.Bool
+	return func(ctx context.Context) error {
+		if ran.Swap(true) && d.Degraded() {
+			IncrementSkippedJobRuns(name)
+			return nil
+		}
+		return fn(ctx)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestDegrader_Hysteresis(t *testing.T) {
+	var heap uint64
+	d := NewDegrader(100, 0, nil)
+	d.heap = func() uint64 { return heap }
+
+	for _, step := range []struct {
+		heap     uint64
+		degraded bool
+	}{
+		{50, false},
+		{101, true},
+		{90, true}, // Still above the recovery share of the limit
+		{79, false},
+		{90, false},
+	} {
+		heap = step.heap
+		if err := d.Check(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if d.Degraded() != step.degraded {
+			t.Errorf("heap at %d: expected degraded=%v", step.heap, step.degraded)
+		}
+	}
+}
+
+func TestDegrader_Goroutines(t *testing.T) {
+	d := NewDegrader(0, 10, nil)
+	d.goroutines = func() int { return 11 }
+	_ = d.Check(context.Background())
+	if !d.Degraded() {
+		t.Fatal("expected too many goroutines to degrade")
+	}
+	if len(d.reasons) != 1 || d.reasons[0] != DegradeReasonGoroutines {
+		t.Errorf("expected the goroutine limit as the reason, got %v", d.reasons)
+	}
+}
+
+func TestDegrader_Budget(t *testing.T) {
+	budget := NewAPIBudget(60)
+	now := time.Now()
+	budget.now = func() time.Time { return now }
+	budget.last = now
+	d := NewDegrader(0, 0, budget)
+
+	_ = d.Check(context.Background())
+	if d.Degraded() {
+		t.Error("expected a full budget not to degrade")
+	}
+	budget.tokens = budget.capacity / 4
+	_ = d.Check(context.Background())
+	if !d.Degraded() {
+		t.Error("expected a drained budget to degrade")
+	}
+	budget.tokens = budget.capacity
+	budget.waiting = 1
+	_ = d.Check(context.Background())
+	if !d.Degraded() {
+		t.Error("expected calls waiting for the budget to keep it degraded")
+	}
+}
+
+func TestDegrader_Pausable(t *testing.T) {
+	heap := uint64(200)
+	d := NewDegrader(100, 0, nil)
+	d.heap = func() uint64 { return heap }
+	_ = d.Check(context.Background())
+
+	runs := 0
+	job := d.Pausable("test", func(context.Context) error {
+		runs++
+		return nil
+	})
+	_ = job(context.Background())
+	_ = job(context.Background())
+	if runs != 1 {
+		t.Errorf("expected only the first run while degraded, got %d runs", runs)
+	}
+
+	heap = 0
+	_ = d.Check(context.Background())
+	_ = job(context.Background())
+	if runs != 2 {
+		t.Errorf("expected the job to resume after recovery, got %d runs", runs)
+	}
+}
+
+func TestDegrader_Nil(t *testing.T) {
+	var d *Degrader
+	if d.Degraded() {
+		t.Error("expected a nil Degrader never to degrade")
+	}
+	runs := 0
+	job := d.Pausable("test", func(context.Context) error {
+		runs++
+		return nil
+	})
+	_ = job(context.Background())
+	_ = job(context.Background())
+	if runs != 2 {
+		t.Errorf("expected every run, got %d", runs)
+	}
+}
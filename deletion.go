@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// deletionPath returns the path to the marker of a scheduled state deletion.
+func deletionPath(name string) string {
+	return sidecarPath(name, "deletion.json")
+}
+
+// pendingDeletion is a scheduled state deletion, stored as its marker file.
+type pendingDeletion struct {
+	RequestedAt time.Time `json:"requested_at"`
+	RequestedBy string    `json:"requested_by,omitempty"`
+	DeleteAt    time.Time `json:"delete_at"`
+}
+
+// StateDeleter removes states on request. With a grace period, a deletion is
+// only scheduled: a marker file is committed next to the state, and a
+// background job removes the state once the period has passed unless the
+// deletion was cancelled. Markers live in the repository, so scheduled
+// deletions survive restarts.
+type StateDeleter struct {
+	storage  ArchiveStorage
+	grace    time.Duration
+	isLocked func(name string) bool
+	notifier *Notifier   // Optional - receives deletion events
+	index    *StateIndex // Optional - forgets deleted states
+	now      func() time.Time
+
+	mu      sync.Mutex
+	pending map[string]pendingDeletion // Known markers, keyed by state name
+}
+
+// NewStateDeleter creates a StateDeleter. A grace of 0 deletes immediately.
+func NewStateDeleter(storage ArchiveStorage, grace time.Duration, isLocked func(name string) bool) *StateDeleter {
+	return &StateDeleter{
+		storage:  storage,
+		grace:    grace,
+		isLocked: isLocked,
+		now:      time.Now,
+		pending:  make(map[string]pendingDeletion),
+	}
+}
+
+// Pending returns the scheduled deletion of the named state, if any.
+// It is safe to call on a nil deleter.
+func (d *StateDeleter) Pending(name string) (pendingDeletion, bool) {
+	if d == nil {
+		return pendingDeletion{}, false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	p, ok := d.pending[name]
+	return p, ok
+}
+
+// Request deletes the named state, or schedules its deletion if a grace
+// period is configured. The returned deletion is nil if the state was
+// deleted immediately.
+func (d *StateDeleter) Request(ctx context.Context, name, requestedBy string) (*pendingDeletion, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.pending[name]; ok {
+		return nil, ErrDeletionPending
+	}
+	content, sha, err := d.storage.GetFile(ctx, statePath(name))
+	if err != nil {
+		return nil, err
+	}
+	if content == nil {
+		return nil, ErrStateNotFound
+	}
+
+	if d.grace == 0 {
+		if err := d.deleteState(ctx, name, content, sha, "", stateCommitMessage(OpDelete, name, fmt.Sprintf("Delete state: %s", name))); err != nil {
+			return nil, err
+		}
+		slog.Info("Deleted state", "state", name, "requested_by", requestedBy)
+		d.index.Remove(name)
+		d.notifier.Notify(EventStateDeleted, name, fmt.Sprintf("State %s was deleted.", name), map[string]any{"requested_by": requestedBy})
+		return nil, nil
+	}
+
+	now := d.now().UTC()
+	p := pendingDeletion{RequestedAt: now, RequestedBy: requestedBy, DeleteAt: now.Add(d.grace)}
+	marker, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := d.storage.CreateOrUpdateFile(ctx, deletionPath(name), marker, stateCommitMessage(OpScheduleDeletion, name, fmt.Sprintf("Schedule deletion of state: %s", name))); err != nil {
+		return nil, err
+	}
+	d.pending[name] = p
+
+	slog.Info("Deletion of state scheduled", "state", name, "delete_at", p.DeleteAt.Format(time.RFC3339), "requested_by", requestedBy)
+	d.notifier.Notify(EventStateDeletionScheduled, name,
+		fmt.Sprintf("State %s will be deleted at %s unless the deletion is cancelled.", name, p.DeleteAt.Format(time.RFC3339)), p)
+	return &p, nil
+}
+
+// Cancel cancels the scheduled deletion of the named state.
+func (d *StateDeleter) Cancel(ctx context.Context, name string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	p, ok := d.pending[name]
+	if !ok {
+		return ErrNoDeletionPending
+	}
+	_, sha, err := d.storage.GetFile(ctx, deletionPath(name))
+	if err != nil {
+		return err
+	}
+	if sha != "" {
+		if err := d.storage.DeleteFile(ctx, deletionPath(name), sha, stateCommitMessage(OpCancelDeletion, name, fmt.Sprintf("Cancel deletion of state: %s", name))); err != nil {
+			return err
+		}
+	}
+	delete(d.pending, name)
+
+	slog.Info("Deletion of state cancelled", "state", name)
+	d.notifier.Notify(EventStateDeletionCancelled, name, fmt.Sprintf("The deletion of state %s was cancelled.", name), p)
+	return nil
+}
+
+// Run loads all deletion markers and deletes the states that are due.
+// Locked states are skipped until a later run.
+func (d *StateDeleter) Run(ctx context.Context) error {
+	paths, err := d.storage.ListFiles(layout.prefix)
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	pending := make(map[string]pendingDeletion)
+	for _, path := range paths {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		name, ok := stateNameFromSidecar(path, "deletion.json")
+		if !ok {
+			continue
+		}
+
+		content, markerSHA, err := d.storage.GetFile(ctx, path)
+		if err != nil {
+			return err
+		}
+		var p pendingDeletion
+		if err := json.Unmarshal(content, &p); err != nil {
+			slog.Warn("Ignoring invalid deletion marker", "path", path, "error", err)
+			continue
+		}
+
+		if d.now().Before(p.DeleteAt) || d.isLocked(name) {
+			pending[name] = p
+			continue
+		}
+
+		content, sha, err := d.storage.GetFile(ctx, statePath(name))
+		if err != nil {
+			return err
+		}
+		if err := d.deleteState(ctx, name, content, sha, markerSHA, stateCommitMessage(OpDelete, name, fmt.Sprintf("Delete state: %s", name))); err != nil {
+			return err
+		}
+		slog.Info("Deleted state as scheduled", "state", name, "requested_by", p.RequestedBy)
+		d.index.Remove(name)
+		d.notifier.Notify(EventStateDeleted, name, fmt.Sprintf("State %s was deleted as scheduled.", name), map[string]any{"requested_by": p.RequestedBy})
+	}
+	d.pending = pending
+	return nil
+}
+
+// deleteState removes a state stored as stored with its sidecars, chunks and
+// deletion marker, in a single commit where the storage supports it. Empty
+// SHAs mark absent files. Must be called with d.mu held.
+func (d *StateDeleter) deleteState(ctx context.Context, name string, stored []byte, sha, markerSHA, message string) error {
+	if committer, ok := d.storage.(FileCommitter); ok {
+		return committer.CommitFiles(ctx, message, append([]FileChange{
+			{Path: statePath(name), SHA: sha},
+			{Path: checksumPath(name)},
+			{Path: metadataPath(name)},
+			{Path: deletionPath(name), SHA: markerSHA},
+		}, chunkDeletions(name, stored)...))
+	}
+
+	if sha != "" {
+		if err := d.storage.DeleteFile(ctx, statePath(name), sha, message); err != nil {
+			return err
+		}
+	}
+	if markerSHA != "" {
+		return d.storage.DeleteFile(ctx, deletionPath(name), markerSHA, message)
+	}
+	return nil
+}
+
+// handleDelete deletes a state or schedules its deletion. The state name must
+// be repeated in the confirm query parameter to guard against accidents.
+func (h *StateHandler) handleDelete(w http.ResponseWriter, r *http.Request, name string) {
+	if h.deleter == nil {
+		h.methodNotAllowed(w, r, h.stateMethods()...)
+		return
+	}
+	if r.URL.Query().Get("confirm") != name {
+		writeError(w, fmt.Errorf("%w: confirm the deletion by repeating the state name: ?confirm=%s", ErrInvalidRequest, name))
+		return
+	}
+
+	h.mu.RLock()
+	lock, locked := h.locks[name]
+	h.mu.RUnlock()
+	if locked {
+		writeLockError(w, ErrLockConflict, lock)
+		return
+	}
+
+	p, err := h.deleter.Request(r.Context(), name, principalFromContext(r.Context()).Username)
+	switch {
+	case errors.Is(err, ErrStateNotFound), errors.Is(err, ErrDeletionPending):
+		writeError(w, err)
+	case err != nil:
+		slog.Error("Error deleting state", "state", name, "error", err)
+		writeError(w, err)
+	case p == nil:
+		w.WriteHeader(http.StatusOK)
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		_ = json.NewEncoder(w).Encode(p)
+	}
+}
+
+// handleDeletion routes requests for /{name}/deletion.
+//
+// GET reports the scheduled deletion and DELETE cancels it.
+func (h *StateHandler) handleDeletion(w http.ResponseWriter, r *http.Request, name string) {
+	if h.deleter == nil {
+		writeError(w, ErrNoDeletionPending)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		p, ok := h.deleter.Pending(name)
+		if !ok {
+			writeError(w, ErrNoDeletionPending)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(p)
+	case http.MethodDelete:
+		err := h.deleter.Cancel(r.Context(), name)
+		switch {
+		case errors.Is(err, ErrNoDeletionPending):
+			writeError(w, err)
+		case err != nil:
+			slog.Error("Error cancelling deletion", "state", name, "error", err)
+			writeError(w, err)
+		default:
+			w.WriteHeader(http.StatusOK)
+		}
+	default:
+		h.methodNotAllowed(w, r, http.MethodGet, http.MethodDelete)
+	}
+}
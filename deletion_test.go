@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestDeletionHandler(t *testing.T, grace time.Duration) (*StateHandler, *LocalGitClient) {
+	t.Helper()
+
+	storage := newTestLocalGitClient(t)
+	handler := NewStateHandler(storage, DefaultMaxBodySize)
+	handler.deleter = NewStateDeleter(storage, grace, handler.IsLocked)
+
+	req := httptest.NewRequest(http.MethodPost, "/myproject", strings.NewReader(`{"version":4,"serial":1,"lineage":"abc"}`))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+	return handler, storage
+}
+
+func serve(handler http.Handler, method, target string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(method, target, nil))
+	return w
+}
+
+func TestDeleteState_RequiresConfirmation(t *testing.T) {
+	handler, storage := newTestDeletionHandler(t, 0)
+
+	for _, target := range []string{"/myproject", "/myproject?confirm=other"} {
+		if w := serve(handler, http.MethodDelete, target); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %d", target, w.Code)
+		}
+	}
+	if content, _, _ := storage.GetFile(context.Background(), statePath("myproject")); content == nil {
+		t.Error("expected state to be kept")
+	}
+}
+
+func TestDeleteState_Immediate(t *testing.T) {
+	handler, storage := newTestDeletionHandler(t, 0)
+
+	if w := serve(handler, http.MethodDelete, "/myproject?confirm=myproject"); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
+	for _, path := range []string{statePath("myproject"), checksumPath("myproject"), metadataPath("myproject")} {
+		if content, _, _ := storage.GetFile(context.Background(), path); content != nil {
+			t.Errorf("expected %s to be deleted", path)
+		}
+	}
+	if w := serve(handler, http.MethodDelete, "/myproject?confirm=myproject"); w.Code != http.StatusNotFound {
+		t.Errorf("expected status 404, got %d", w.Code)
+	}
+}
+
+func TestDeleteState_Locked(t *testing.T) {
+	handler, _ := newTestDeletionHandler(t, 0)
+	handler.locks["myproject"] = LockInfo{ID: "lock-123"}
+
+	if w := serve(handler, http.MethodDelete, "/myproject?confirm=myproject"); w.Code != http.StatusLocked {
+		t.Errorf("expected status 423, got %d", w.Code)
+	}
+}
+
+func TestDeleteState_NotEnabled(t *testing.T) {
+	handler, _ := newTestHandler()
+
+	if w := serve(handler, http.MethodDelete, "/myproject?confirm=myproject"); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected status 405, got %d", w.Code)
+	}
+}
+
+func TestDeleteState_GracePeriod(t *testing.T) {
+	handler, storage := newTestDeletionHandler(t, time.Hour)
+	now := time.Now()
+	handler.deleter.now = func() time.Time { return now }
+
+	if w := serve(handler, http.MethodDelete, "/myproject?confirm=myproject"); w.Code != http.StatusAccepted {
+		t.Fatalf("expected status 202, got %d", w.Code)
+	}
+	if w := serve(handler, http.MethodGet, "/myproject/deletion"); w.Code != http.StatusOK {
+		t.Errorf("expected pending deletion, got status %d", w.Code)
+	}
+
+	// Writes are refused while the deletion is pending
+	req := httptest.NewRequest(http.MethodPost, "/myproject", strings.NewReader(`{"version":4,"serial":2,"lineage":"abc"}`))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusConflict {
+		t.Errorf("expected status 409, got %d", w.Code)
+	}
+
+	// Nothing is deleted before the grace period has passed
+	if err := handler.deleter.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if content, _, _ := storage.GetFile(context.Background(), statePath("myproject")); content == nil {
+		t.Fatal("expected state to be kept during the grace period")
+	}
+
+	now = now.Add(2 * time.Hour)
+	if err := handler.deleter.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	for _, path := range []string{statePath("myproject"), deletionPath("myproject")} {
+		if content, _, _ := storage.GetFile(context.Background(), path); content != nil {
+			t.Errorf("expected %s to be deleted", path)
+		}
+	}
+	if _, pending := handler.deleter.Pending("myproject"); pending {
+		t.Error("expected no pending deletion")
+	}
+}
+
+func TestDeleteState_Cancel(t *testing.T) {
+	handler, storage := newTestDeletionHandler(t, time.Hour)
+
+	if w := serve(handler, http.MethodDelete, "/myproject?confirm=myproject"); w.Code != http.StatusAccepted {
+		t.Fatalf("expected status 202, got %d", w.Code)
+	}
+	if w := serve(handler, http.MethodDelete, "/myproject/deletion"); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
+	if content, _, _ := storage.GetFile(context.Background(), deletionPath("myproject")); content != nil {
+		t.Error("expected deletion marker to be removed")
+	}
+	if w := serve(handler, http.MethodGet, "/myproject/deletion"); w.Code != http.StatusNotFound {
+		t.Errorf("expected status 404, got %d", w.Code)
+	}
+	if w := serve(handler, http.MethodDelete, "/myproject/deletion"); w.Code != http.StatusNotFound {
+		t.Errorf("expected status 404, got %d", w.Code)
+	}
+}
+
+func TestStateDeleter_RestoresPendingOnRun(t *testing.T) {
+	handler, storage := newTestDeletionHandler(t, time.Hour)
+
+	if w := serve(handler, http.MethodDelete, "/myproject?confirm=myproject"); w.Code != http.StatusAccepted {
+		t.Fatalf("expected status 202, got %d", w.Code)
+	}
+
+	// A restarted backend picks up the marker
+	deleter := NewStateDeleter(storage, time.Hour, handler.IsLocked)
+	if err := deleter.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if _, pending := deleter.Pending("myproject"); !pending {
+		t.Error("expected the deletion to be pending after a restart")
+	}
+}
@@ -0,0 +1,558 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// devGiteaVersion is reported to the SDK, which refuses servers older than 1.11.
+const devGiteaVersion = "1.22.0"
+
+// DevGitea is an in-memory stand-in for the subset of the Gitea API the
+// backend uses to read and write files. It exists for local development
+// (DEV_MODE) and tests; it performs no authentication and keeps no history.
+type DevGitea struct {
+	mux *http.ServeMux
+
+	version     string // Reported server version
+	maxBlobSize int    // Size above which file content is only served raw, as by Gitea; 0 for no limit
+
+	rejectMerges bool // Refuse to merge pull requests, as branch protection may
+
+	mu       sync.Mutex
+	files    map[string]devFile // keyed by owner/repo@branch:path
+	tags     map[string]string  // Commit SHAs keyed by owner/repo:tag
+	branches map[string]bool    // Created branches, keyed by owner/repo@branch
+	pulls    map[int64]*devPull
+	topics   map[string][]string // keyed by owner/repo
+	commits  int
+}
+
+// devPull is a pull request between two branches of a repository.
+type devPull struct {
+	repo     string // owner/repo
+	head     string
+	base     string
+	mergeSHA string
+}
+
+type devFile struct {
+	content []byte
+	sha     string
+}
+
+// NewDevGitea creates an empty in-memory Gitea stub.
+func NewDevGitea() *DevGitea {
+	d := &DevGitea{
+		mux:      http.NewServeMux(),
+		version:  devGiteaVersion,
+		files:    make(map[string]devFile),
+		tags:     make(map[string]string),
+		branches: make(map[string]bool),
+		pulls:    make(map[int64]*devPull),
+		topics:   make(map[string][]string),
+	}
+	d.mux.HandleFunc("GET /api/v1/version", d.handleVersion)
+	d.mux.HandleFunc("GET /api/v1/repos/{owner}/{repo}", d.handleRepo)
+	d.mux.HandleFunc("POST /api/v1/repos/{owner}/{repo}/contents", d.handleChangeFiles)
+	d.mux.HandleFunc("GET /api/v1/repos/{owner}/{repo}/contents/{path...}", d.handleGet)
+	d.mux.HandleFunc("GET /api/v1/repos/{owner}/{repo}/raw/{path...}", d.handleRaw)
+	d.mux.HandleFunc("POST /api/v1/repos/{owner}/{repo}/contents/{path...}", d.handleWrite)
+	d.mux.HandleFunc("PUT /api/v1/repos/{owner}/{repo}/contents/{path...}", d.handleWrite)
+	d.mux.HandleFunc("DELETE /api/v1/repos/{owner}/{repo}/contents/{path...}", d.handleDelete)
+	d.mux.HandleFunc("POST /api/v1/repos/{owner}/{repo}/tags", d.handleCreateTag)
+	d.mux.HandleFunc("GET /api/v1/repos/{owner}/{repo}/topics", d.handleListTopics)
+	d.mux.HandleFunc("PUT /api/v1/repos/{owner}/{repo}/topics/{topic}", d.handleAddTopic)
+	d.mux.HandleFunc("POST /api/v1/repos/{owner}/{repo}/branches", d.handleCreateBranch)
+	d.mux.HandleFunc("DELETE /api/v1/repos/{owner}/{repo}/branches/{branch}", d.handleDeleteBranch)
+	d.mux.HandleFunc("POST /api/v1/repos/{owner}/{repo}/pulls", d.handleCreatePull)
+	d.mux.HandleFunc("GET /api/v1/repos/{owner}/{repo}/pulls/{index}", d.handleGetPull)
+	d.mux.HandleFunc("POST /api/v1/repos/{owner}/{repo}/pulls/{index}/merge", d.handleMergePull)
+	return d
+}
+
+// startDevGitea serves a DevGitea on a random loopback port and returns its URL.
+func startDevGitea() (string, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", fmt.Errorf("failed to start dev Gitea: %w", err)
+	}
+	server := &http.Server{Handler: NewDevGitea(), ReadHeaderTimeout: 10 * time.Second}
+	go func() { _ = server.Serve(listener) }()
+	return "http://" + listener.Addr().String(), nil
+}
+
+// ServeHTTP routes the supported Gitea API endpoints.
+func (d *DevGitea) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d.mux.ServeHTTP(w, r)
+}
+
+func (d *DevGitea) handleVersion(w http.ResponseWriter, _ *http.Request) {
+	writeDevJSON(w, http.StatusOK, map[string]string{"version": d.version})
+}
+
+// handleRepo reports repository metadata. The size is the total size of the
+// stored files in KiB, rounded up.
+func (d *DevGitea) handleRepo(w http.ResponseWriter, r *http.Request) {
+	owner, repo := r.PathValue("owner"), r.PathValue("repo")
+	prefix := owner + "/" + repo + "@"
+
+	d.mu.Lock()
+	var size int
+	for key, file := range d.files {
+		if strings.HasPrefix(key, prefix) {
+			size += len(file.content)
+		}
+	}
+	d.mu.Unlock()
+
+	writeDevJSON(w, http.StatusOK, map[string]any{
+		"name":           repo,
+		"full_name":      owner + "/" + repo,
+		"owner":          map[string]string{"login": owner},
+		"size":           (size + 1023) / 1024,
+		"default_branch": "main",
+	})
+}
+
+func (d *DevGitea) handleGet(w http.ResponseWriter, r *http.Request) {
+	key := devFileKey(r, r.URL.Query().Get("ref"))
+
+	d.mu.Lock()
+	file, exists := d.files[key]
+	d.mu.Unlock()
+
+	if exists {
+		contents := devContents(r.PathValue("path"), file)
+		if d.maxBlobSize > 0 && len(file.content) > d.maxBlobSize {
+			contents["content"] = nil
+		}
+		writeDevJSON(w, http.StatusOK, contents)
+		return
+	}
+
+	// List the directory's files; subdirectories are omitted
+	var entries []map[string]any
+	d.mu.Lock()
+	for k, file := range d.files {
+		if rest, ok := strings.CutPrefix(k, key+"/"); ok && !strings.Contains(rest, "/") {
+			entry := devContents(r.PathValue("path")+"/"+rest, file)
+			delete(entry, "content")
+			entries = append(entries, entry)
+		}
+	}
+	d.mu.Unlock()
+
+	if entries == nil {
+		writeDevError(w, http.StatusNotFound, "file does not exist")
+		return
+	}
+	writeDevJSON(w, http.StatusOK, entries)
+}
+
+func (d *DevGitea) handleRaw(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	file, exists := d.files[devFileKey(r, r.URL.Query().Get("ref"))]
+	d.mu.Unlock()
+
+	if !exists {
+		writeDevError(w, http.StatusNotFound, "file does not exist")
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	_, _ = w.Write(file.content)
+}
+
+// devFileRequest covers the create, update and delete request bodies.
+type devFileRequest struct {
+	Branch  string `json:"branch"`
+	Message string `json:"message"`
+	Content string `json:"content"`
+	SHA     string `json:"sha"`
+}
+
+func (d *DevGitea) handleWrite(w http.ResponseWriter, r *http.Request) {
+	var req devFileRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeDevError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	content, err := base64.StdEncoding.DecodeString(req.Content)
+	if err != nil {
+		writeDevError(w, http.StatusBadRequest, "content must be base64 encoded")
+		return
+	}
+
+	key := devFileKey(r, req.Branch)
+	path := r.PathValue("path")
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	existing, exists := d.files[key]
+	status := http.StatusCreated
+	if r.Method == http.MethodPost {
+		if exists {
+			writeDevError(w, http.StatusUnprocessableEntity, "repository file already exists")
+			return
+		}
+	} else {
+		if !exists {
+			writeDevError(w, http.StatusNotFound, "file does not exist")
+			return
+		}
+		if req.SHA != existing.sha {
+			writeDevError(w, http.StatusUnprocessableEntity, "sha does not match")
+			return
+		}
+		status = http.StatusOK
+	}
+
+	file := devFile{content: content, sha: gitBlobSHA(content)}
+	d.files[key] = file
+	writeDevJSON(w, status, map[string]any{
+		"content": devContents(path, file),
+		"commit":  d.nextCommit(req.Message),
+	})
+}
+
+// handleChangeFiles applies several file operations in one commit. Nothing is
+// changed unless every operation is valid.
+func (d *DevGitea) handleChangeFiles(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Branch  string `json:"branch"`
+		Message string `json:"message"`
+		Files   []struct {
+			Operation string `json:"operation"`
+			Path      string `json:"path"`
+			Content   string `json:"content"`
+			SHA       string `json:"sha"`
+		} `json:"files"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeDevError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	if req.Branch == "" {
+		req.Branch = "main"
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	updates := make(map[string]*devFile)
+	for _, file := range req.Files {
+		key := fmt.Sprintf("%s/%s@%s:%s", r.PathValue("owner"), r.PathValue("repo"), req.Branch, file.Path)
+		existing, exists := d.files[key]
+		switch {
+		case file.Operation == "create" && exists:
+			writeDevError(w, http.StatusUnprocessableEntity, "repository file already exists")
+			return
+		case file.Operation != "create" && !exists:
+			writeDevError(w, http.StatusNotFound, "file does not exist")
+			return
+		case file.Operation != "create" && file.SHA != existing.sha:
+			writeDevError(w, http.StatusUnprocessableEntity, "sha does not match")
+			return
+		}
+
+		if file.Operation == "delete" {
+			updates[key] = nil
+			continue
+		}
+		content, err := base64.StdEncoding.DecodeString(file.Content)
+		if err != nil {
+			writeDevError(w, http.StatusBadRequest, "content must be base64 encoded")
+			return
+		}
+		updates[key] = &devFile{content: content, sha: gitBlobSHA(content)}
+	}
+
+	for key, file := range updates {
+		if file == nil {
+			delete(d.files, key)
+		} else {
+			d.files[key] = *file
+		}
+	}
+	writeDevJSON(w, http.StatusCreated, map[string]any{"commit": d.nextCommit(req.Message)})
+}
+
+func (d *DevGitea) handleDelete(w http.ResponseWriter, r *http.Request) {
+	var req devFileRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeDevError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	key := devFileKey(r, req.Branch)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	existing, exists := d.files[key]
+	if !exists {
+		writeDevError(w, http.StatusNotFound, "file does not exist")
+		return
+	}
+	if req.SHA != existing.sha {
+		writeDevError(w, http.StatusUnprocessableEntity, "sha does not match")
+		return
+	}
+
+	delete(d.files, key)
+	writeDevJSON(w, http.StatusOK, map[string]any{
+		"content": nil,
+		"commit":  d.nextCommit(req.Message),
+	})
+}
+
+// handleCreateTag records a tag. The target is not checked, as commits are
+// not kept.
+func (d *DevGitea) handleCreateTag(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		TagName string `json:"tag_name"`
+		Target  string `json:"target"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.TagName == "" {
+		writeDevError(w, http.StatusBadRequest, "invalid request")
+		return
+	}
+
+	key := r.PathValue("owner") + "/" + r.PathValue("repo") + ":" + req.TagName
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, exists := d.tags[key]; exists {
+		writeDevError(w, http.StatusConflict, "tag already exists")
+		return
+	}
+	d.tags[key] = req.Target
+	writeDevJSON(w, http.StatusCreated, map[string]any{"name": req.TagName, "commit": map[string]string{"sha": req.Target}})
+}
+
+func (d *DevGitea) handleListTopics(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	topics := d.topics[r.PathValue("owner")+"/"+r.PathValue("repo")]
+	writeDevJSON(w, http.StatusOK, map[string][]string{"topics": append([]string{}, topics...)})
+}
+
+func (d *DevGitea) handleAddTopic(w http.ResponseWriter, r *http.Request) {
+	repo, topic := r.PathValue("owner")+"/"+r.PathValue("repo"), r.PathValue("topic")
+	if !repoTopicPattern.MatchString(topic) {
+		writeDevError(w, http.StatusUnprocessableEntity, "invalid topic")
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !slices.Contains(d.topics[repo], topic) {
+		d.topics[repo] = append(d.topics[repo], topic)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleCreateBranch creates a branch with the files of another.
+func (d *DevGitea) handleCreateBranch(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		NewBranchName string `json:"new_branch_name"`
+		OldBranchName string `json:"old_branch_name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.NewBranchName == "" {
+		writeDevError(w, http.StatusBadRequest, "invalid request")
+		return
+	}
+	if req.OldBranchName == "" {
+		req.OldBranchName = "main"
+	}
+
+	repo := r.PathValue("owner") + "/" + r.PathValue("repo")
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.branches[repo+"@"+req.NewBranchName] || req.NewBranchName == "main" {
+		writeDevError(w, http.StatusConflict, "branch already exists")
+		return
+	}
+	d.branches[repo+"@"+req.NewBranchName] = true
+	d.copyBranch(repo, req.OldBranchName, req.NewBranchName)
+	writeDevJSON(w, http.StatusCreated, map[string]any{"name": req.NewBranchName})
+}
+
+func (d *DevGitea) handleDeleteBranch(w http.ResponseWriter, r *http.Request) {
+	repo := r.PathValue("owner") + "/" + r.PathValue("repo")
+	branch := r.PathValue("branch")
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.branches[repo+"@"+branch] {
+		writeDevError(w, http.StatusNotFound, "branch does not exist")
+		return
+	}
+	d.deleteBranch(repo, branch)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (d *DevGitea) handleCreatePull(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Head string `json:"head"`
+		Base string `json:"base"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Head == "" || req.Base == "" {
+		writeDevError(w, http.StatusBadRequest, "invalid request")
+		return
+	}
+
+	repo := r.PathValue("owner") + "/" + r.PathValue("repo")
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.branches[repo+"@"+req.Head] {
+		writeDevError(w, http.StatusNotFound, "head branch does not exist")
+		return
+	}
+	index := int64(len(d.pulls) + 1)
+	d.pulls[index] = &devPull{repo: repo, head: req.Head, base: req.Base}
+	writeDevJSON(w, http.StatusCreated, devPullJSON(r, index, d.pulls[index]))
+}
+
+func (d *DevGitea) handleGetPull(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	index, pull, ok := d.lookupPull(r)
+	if !ok {
+		writeDevError(w, http.StatusNotFound, "pull request does not exist")
+		return
+	}
+	writeDevJSON(w, http.StatusOK, devPullJSON(r, index, pull))
+}
+
+// handleMergePull replaces the files of the base branch with those of the
+// head branch, which is deleted. Merge styles are not told apart.
+func (d *DevGitea) handleMergePull(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	_, pull, ok := d.lookupPull(r)
+	if !ok {
+		writeDevError(w, http.StatusNotFound, "pull request does not exist")
+		return
+	}
+	if pull.mergeSHA != "" {
+		writeDevError(w, http.StatusMethodNotAllowed, "pull request is already merged")
+		return
+	}
+	if d.rejectMerges {
+		writeDevError(w, http.StatusMethodNotAllowed, "Not all required status checks successful")
+		return
+	}
+
+	prefix := pull.repo + "@" + pull.base + ":"
+	for key := range d.files {
+		if strings.HasPrefix(key, prefix) {
+			delete(d.files, key)
+		}
+	}
+	d.copyBranch(pull.repo, pull.head, pull.base)
+	d.deleteBranch(pull.repo, pull.head)
+	pull.mergeSHA, _ = d.nextCommit("Merge " + pull.head)["sha"].(string)
+	w.WriteHeader(http.StatusOK)
+}
+
+// lookupPull returns the pull request addressed by r. Must be called with
+// d.mu held.
+func (d *DevGitea) lookupPull(r *http.Request) (int64, *devPull, bool) {
+	index, err := strconv.ParseInt(r.PathValue("index"), 10, 64)
+	if err != nil {
+		return 0, nil, false
+	}
+	pull, ok := d.pulls[index]
+	if !ok || pull.repo != r.PathValue("owner")+"/"+r.PathValue("repo") {
+		return 0, nil, false
+	}
+	return index, pull, true
+}
+
+func devPullJSON(r *http.Request, index int64, pull *devPull) map[string]any {
+	return map[string]any{
+		"number":           index,
+		"html_url":         fmt.Sprintf("http://%s/%s/pulls/%d", r.Host, pull.repo, index),
+		"merged":           pull.mergeSHA != "",
+		"merge_commit_sha": pull.mergeSHA,
+	}
+}
+
+// copyBranch copies the files of branch from to branch to. Must be called
+// with d.mu held.
+func (d *DevGitea) copyBranch(repo, from, to string) {
+	prefix := repo + "@" + from + ":"
+	for key, file := range d.files {
+		if path, ok := strings.CutPrefix(key, prefix); ok {
+			d.files[repo+"@"+to+":"+path] = file
+		}
+	}
+}
+
+// deleteBranch removes a created branch and its files. Must be called with
+// d.mu held.
+func (d *DevGitea) deleteBranch(repo, branch string) {
+	delete(d.branches, repo+"@"+branch)
+	prefix := repo + "@" + branch + ":"
+	for key := range d.files {
+		if strings.HasPrefix(key, prefix) {
+			delete(d.files, key)
+		}
+	}
+}
+
+// nextCommit fabricates commit metadata for a write. Must be called with d.mu held.
+func (d *DevGitea) nextCommit(message string) map[string]any {
+	d.commits++
+	return map[string]any{
+		"sha":     gitBlobSHA([]byte(strconv.Itoa(d.commits))),
+		"message": message,
+		"created": time.Now().UTC(),
+	}
+}
+
+func devFileKey(r *http.Request, branch string) string {
+	if branch == "" {
+		branch = "main"
+	}
+	return fmt.Sprintf("%s/%s@%s:%s", r.PathValue("owner"), r.PathValue("repo"), branch, r.PathValue("path"))
+}
+
+func devContents(path string, file devFile) map[string]any {
+	return map[string]any{
+		"name":     path,
+		"path":     path,
+		"sha":      file.sha,
+		"type":     "file",
+		"size":     len(file.content),
+		"encoding": "base64",
+		"content":  base64.StdEncoding.EncodeToString(file.content),
+	}
+}
+
+// gitBlobSHA computes the Git object ID of a blob with the given content.
+func gitBlobSHA(content []byte) string {
+	h := sha1.New()
+	fmt.Fprintf(h, "blob %d\x00", len(content))
+	h.Write(content)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func writeDevJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeDevError(w http.ResponseWriter, status int, message string) {
+	writeDevJSON(w, status, map[string]string{"message": message})
+}
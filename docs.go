@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	texttemplate "text/template"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+)
+
+//go:embed README.md docs/*.md
+var docsFS embed.FS
+
+// docPage is a single page served under /docs.
+type docPage struct {
+	Slug      string
+	Title     string
+	File      string
+	Templated bool // Substitute docsData into the Markdown before rendering
+}
+
+var docPages = []docPage{
+	{Slug: "usage", Title: "Usage", File: "README.md"},
+	{Slug: "examples", Title: "Backend Configuration Examples", File: "docs/examples.md", Templated: true},
+	{Slug: "api", Title: "API Reference", File: "docs/api.md"},
+	{Slug: "events", Title: "Events", File: "docs/events.md"},
+}
+
+var docsLayout = template.Must(template.New("docs").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>{{.Title}} - gitea-tf-backend</title>
+<style>
+body { font-family: sans-serif; max-width: 60rem; margin: 2rem auto; padding: 0 1rem; line-height: 1.5; }
+nav a { margin-right: 1rem; }
+pre { background: #f4f4f4; padding: 1rem; overflow-x: auto; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 0.25rem 0.5rem; text-align: left; }
+footer { margin-top: 3rem; color: #777; font-size: 0.9rem; }
+</style>
+</head>
+<body>
+<nav>{{range .Pages}}<a href="/docs/{{.Slug}}">{{.Title}}</a>{{end}}</nav>
+<main>{{.Body}}</main>
+<footer>gitea-tf-backend{{with .Version}} {{.}}{{end}}</footer>
+</body>
+</html>
+`))
+
+// docsData is substituted into the embedded Markdown before rendering.
+type docsData struct {
+	BaseURL string
+}
+
+// DocsHandler serves the embedded documentation rendered as HTML.
+type DocsHandler struct {
+	markdown goldmark.Markdown
+	version  string // Shown in the footer unless empty
+}
+
+// NewDocsHandler creates a handler for the embedded documentation.
+func NewDocsHandler() *DocsHandler {
+	return &DocsHandler{
+		markdown: goldmark.New(goldmark.WithExtensions(extension.GFM)),
+		version:  buildVersion(),
+	}
+}
+
+// ServeHTTP renders the requested page. /docs redirects to the usage page.
+func (d *DocsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	slug := strings.Trim(strings.TrimPrefix(r.URL.Path, "/docs"), "/")
+	if slug == "" {
+		http.Redirect(w, r, "/docs/usage", http.StatusFound)
+		return
+	}
+
+	var page *docPage
+	for i := range docPages {
+		if docPages[i].Slug == slug {
+			page = &docPages[i]
+		}
+	}
+	if page == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	body, err := d.render(page, docsData{BaseURL: baseURL(r)})
+	if err != nil {
+		slog.Error("Error rendering docs page", "page", page.Slug, "error", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_ = docsLayout.Execute(w, map[string]any{
+		"Title":   page.Title,
+		"Pages":   docPages,
+		"Body":    template.HTML(body), // rendered from embedded files only
+		"Version": d.version,
+	})
+}
+
+// render converts an embedded Markdown page to HTML, substituting data first if the page is templated.
+func (d *DocsHandler) render(page *docPage, data docsData) ([]byte, error) {
+	source, err := docsFS.ReadFile(page.File)
+	if err != nil {
+		return nil, err
+	}
+
+	if page.Templated {
+		tmpl, err := texttemplate.New(page.File).Parse(string(source))
+		if err != nil {
+			return nil, err
+		}
+		var markdown bytes.Buffer
+		if err := tmpl.Execute(&markdown, data); err != nil {
+			return nil, err
+		}
+		source = markdown.Bytes()
+	}
+
+	var html bytes.Buffer
+	if err := d.markdown.Convert(source, &html); err != nil {
+		return nil, err
+	}
+	return html.Bytes(), nil
+}
+
+// baseURL reconstructs the externally visible URL of this instance from the request.
+func baseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto == "http" || proto == "https" {
+		scheme = proto
+	}
+	return scheme + "://" + r.Host
+}
+
+// buildVersion returns the module version or VCS revision the binary was built from.
+func buildVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	if v := info.Main.Version; v != "" && v != "(devel)" {
+		return v
+	}
+	for _, setting := range info.Settings {
+		if setting.Key == "vcs.revision" && len(setting.Value) >= 12 {
+			return setting.Value[:12]
+		}
+	}
+	return "dev"
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDocsHandler_Redirect(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/docs", nil)
+	w := httptest.NewRecorder()
+
+	NewDocsHandler().ServeHTTP(w, req)
+
+	if w.Code != http.StatusFound {
+		t.Errorf("expected status 302, got %d", w.Code)
+	}
+	if loc := w.Header().Get("Location"); loc != "/docs/usage" {
+		t.Errorf("expected redirect to /docs/usage, got %q", loc)
+	}
+}
+
+func TestDocsHandler_Pages(t *testing.T) {
+	for _, page := range docPages {
+		req := httptest.NewRequest(http.MethodGet, "/docs/"+page.Slug, nil)
+		w := httptest.NewRecorder()
+
+		NewDocsHandler().ServeHTTP(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: expected status 200, got %d", page.Slug, w.Code)
+		}
+		if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+			t.Errorf("%s: expected HTML content type, got %s", page.Slug, ct)
+		}
+		if !strings.Contains(w.Body.String(), "<h1") {
+			t.Errorf("%s: expected rendered Markdown heading", page.Slug)
+		}
+	}
+}
+
+func TestDocsHandler_ExamplesUseInstanceURL(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/docs/examples", nil)
+	req.Host = "tf-state.internal:8443"
+	req.Header.Set("X-Forwarded-Proto", "https")
+	w := httptest.NewRecorder()
+
+	NewDocsHandler().ServeHTTP(w, req)
+
+	if !strings.Contains(w.Body.String(), "https://tf-state.internal:8443/myproject") {
+		t.Error("expected examples to reference the instance URL")
+	}
+}
+
+func TestDocsHandler_UnknownPage(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/docs/nope", nil)
+	w := httptest.NewRecorder()
+
+	NewDocsHandler().ServeHTTP(w, req)
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected status 404, got %d", w.Code)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+)
+
+// apiError is a class of failed request. Its code is stable across releases
+// and identifies the failure in JSON error bodies and in the code label of
+// tfstate_errors_total; status is the HTTP status it is answered with.
+//
+// Wrap an apiError with fmt.Errorf and %w to add detail for the client.
+type apiError struct {
+	code    string
+	status  int
+	message string
+}
+
+func (e *apiError) Error() string {
+	return e.message
+}
+
+// Errors returned by the backend's operations, by status.
+var (
+	ErrInvalidRequest   = &apiError{"invalid_request", http.StatusBadRequest, "invalid request"}
+	ErrInvalidState     = &apiError{"invalid_state", http.StatusBadRequest, "invalid state"}
+	ErrInvalidLockInfo  = &apiError{"invalid_lock_info", http.StatusBadRequest, "invalid lock info"}
+	ErrLockRequired     = &apiError{"lock_required", http.StatusBadRequest, "state writes require a lock"}
+	ErrChecksumMismatch = &apiError{"checksum_mismatch", http.StatusBadRequest, "request body does not match its checksum"}
+
+	ErrUnauthorized  = &apiError{"unauthorized", http.StatusUnauthorized, "unauthorized"}
+	ErrNotLockHolder = &apiError{"not_lock_holder", http.StatusForbidden, "only the current lock holder may do this"}
+
+	ErrNotFound          = &apiError{"not_found", http.StatusNotFound, "not found"}
+	ErrStateNotFound     = &apiError{"state_not_found", http.StatusNotFound, "state not found"}
+	ErrRefNotFound       = &apiError{"ref_not_found", http.StatusNotFound, "ref not found"}
+	ErrStateNotArchived  = &apiError{"state_not_archived", http.StatusNotFound, "state is not archived"}
+	ErrNoDeletionPending = &apiError{"no_deletion_pending", http.StatusNotFound, "no deletion is scheduled"}
+	ErrNoStealPending    = &apiError{"no_takeover_pending", http.StatusNotFound, "no takeover is pending"}
+
+	ErrMethodNotAllowed = &apiError{"method_not_allowed", http.StatusMethodNotAllowed, "method not allowed"}
+
+	ErrLockMismatch     = &apiError{"lock_mismatch", http.StatusConflict, "lock is held by another ID"}
+	ErrNotLocked        = &apiError{"not_locked", http.StatusConflict, "state is not locked"}
+	ErrLockAlreadyHeld  = &apiError{"lock_already_held", http.StatusConflict, "lock is already held by the requester"}
+	ErrStealPending     = &apiError{"takeover_pending", http.StatusConflict, "a takeover of this lock is already pending"}
+	ErrSerialRegression = &apiError{"serial_regression", http.StatusConflict, "serial regression"}
+	ErrConcurrentUpdate = &apiError{"concurrent_update", http.StatusConflict, "state was modified concurrently"}
+	ErrDeletionPending  = &apiError{"deletion_pending", http.StatusConflict, "state is already scheduled for deletion"}
+	ErrStateActive      = &apiError{"state_exists", http.StatusConflict, "state already exists"}
+	ErrReadOnlyRef      = &apiError{"read_only_ref", http.StatusConflict, "states read at a ref are read-only"}
+	ErrJobNotRunning    = &apiError{"job_not_running", http.StatusConflict, "background job is not running"}
+
+	ErrStateArchived       = &apiError{"state_archived", http.StatusGone, "state is archived"}
+	ErrBodyTooLarge        = &apiError{"body_too_large", http.StatusRequestEntityTooLarge, "request body is too large"}
+	ErrUnsupportedEncoding = &apiError{"unsupported_encoding", http.StatusUnsupportedMediaType, "content encoding is not supported"}
+	ErrLockInfoRejected    = &apiError{"lock_info_rejected", http.StatusUnprocessableEntity, "lock info is not valid"}
+	ErrLockConflict        = &apiError{"lock_conflict", http.StatusLocked, "state is locked"}
+	ErrRateLimited         = &apiError{"rate_limited", http.StatusTooManyRequests, "too many requests"}
+
+	ErrInternal           = &apiError{"internal", http.StatusInternalServerError, "internal server error"}
+	ErrMergeFailed        = &apiError{"merge_failed", http.StatusInternalServerError, "the pull request of the write could not be merged"}
+	ErrStateIntegrity     = &apiError{"state_integrity", http.StatusInternalServerError, "state does not match its checksum"}
+	ErrStorageUnavailable = &apiError{"storage_unavailable", http.StatusServiceUnavailable, "storage is unavailable"}
+	ErrOverloaded         = &apiError{"overloaded", http.StatusServiceUnavailable, "too many requests are in flight"}
+	ErrRepoMoved          = &apiError{"repo_moved", http.StatusServiceUnavailable, "the state repository has moved; an administrator must confirm the move"}
+)
+
+// classifyError returns the class of err. Storage errors that a retry may
+// resolve, such as timeouts and Gitea being unavailable, are
+// ErrStorageUnavailable; other unclassified errors are ErrInternal.
+func classifyError(err error) *apiError {
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+	if errors.Is(err, ErrFileChanged) || errors.Is(err, ErrFileAlreadyExists) {
+		return ErrConcurrentUpdate
+	}
+	if storageUnavailable(err) {
+		return ErrStorageUnavailable
+	}
+	return ErrInternal
+}
+
+// storageUnavailable reports whether err means the storage could not be
+// reached or is temporarily unable to serve requests.
+func storageUnavailable(err error) bool {
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) {
+		return true
+	}
+
+	status := 0
+	var giteaErr *giteaError
+	var githubErr *githubError
+	var gitlabErr *gitlabError
+	switch {
+	case errors.As(err, &giteaErr):
+		status = giteaErr.StatusCode
+	case errors.As(err, &githubErr):
+		status = githubErr.StatusCode
+	case errors.As(err, &gitlabErr):
+		status = gitlabErr.StatusCode
+	}
+	switch status {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// writeError answers a failed request with the status and code of err's
+// class, and counts it in tfstate_errors_total. Server errors only carry the
+// class's message, as the details may reveal storage internals; callers log
+// them instead. Merge failures keep their details, which name the pull
+// request and why Gitea refused it, as do integrity failures, which name the
+// files to restore.
+func writeError(w http.ResponseWriter, err error) {
+	writeErrorFields(w, err, nil)
+}
+
+// writeErrorFields is writeError with additional fields in the JSON body.
+func writeErrorFields(w http.ResponseWriter, err error, fields map[string]any) {
+	class := classifyError(err)
+	message := err.Error()
+	if class.status >= 500 && class != ErrMergeFailed && class != ErrStateIntegrity {
+		message = class.message
+	}
+
+	body := map[string]any{"error": message, "code": class.code}
+	if id := w.Header().Get(requestIDHeader); id != "" {
+		body["request_id"] = id
+	}
+	for k, v := range fields {
+		body[k] = v
+	}
+
+	IncrementErrors(class.code)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(class.status)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+// writeLockError answers a lock conflict with the current lock, which
+// Terraform shows the user, instead of an error body.
+func writeLockError(w http.ResponseWriter, class *apiError, lock LockInfo) {
+	IncrementErrors(class.code)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(class.status)
+	_ = json.NewEncoder(w).Encode(lock)
+}
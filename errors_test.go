@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want *apiError
+	}{
+		{fmt.Errorf("%w: serial 1 is older than stored serial 2", ErrSerialRegression), ErrSerialRegression},
+		{fmt.Errorf("update failed: %w", ErrFileChanged), ErrConcurrentUpdate},
+		{ErrFileAlreadyExists, ErrConcurrentUpdate},
+		{fmt.Errorf("get file: %w", context.DeadlineExceeded), ErrStorageUnavailable},
+		{&giteaError{StatusCode: http.StatusServiceUnavailable}, ErrStorageUnavailable},
+		{&githubError{StatusCode: http.StatusTooManyRequests}, ErrStorageUnavailable},
+		{&giteaError{StatusCode: http.StatusInternalServerError}, ErrInternal},
+		{errors.New("unexpected"), ErrInternal},
+	}
+
+	for _, tt := range tests {
+		if got := classifyError(tt.err); got != tt.want {
+			t.Errorf("classifyError(%v) = %s, want %s", tt.err, got.code, tt.want.code)
+		}
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	before := testutil.ToFloat64(errorsTotal.WithLabelValues("storage_unavailable"))
+
+	w := httptest.NewRecorder()
+	w.Header().Set(requestIDHeader, "req-1")
+	writeError(w, fmt.Errorf("get states/myproject/terraform.tfstate: %w", &giteaError{StatusCode: http.StatusBadGateway, Message: "bad gateway"}))
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status 503, got %d", w.Code)
+	}
+	var body map[string]string
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("expected a JSON body: %v", err)
+	}
+	if body["code"] != "storage_unavailable" || body["request_id"] != "req-1" {
+		t.Errorf("unexpected body %v", body)
+	}
+	if strings.Contains(body["error"], "states/") {
+		t.Errorf("expected storage details to be withheld, got %q", body["error"])
+	}
+	if after := testutil.ToFloat64(errorsTotal.WithLabelValues("storage_unavailable")); after != before+1 {
+		t.Errorf("expected the error to be counted, got %v -> %v", before, after)
+	}
+}
+
+func TestPostState_ErrorCodes(t *testing.T) {
+	handler, mock := newTestHandler()
+	mock.files["states/myproject/terraform.tfstate"] = []byte(`{"version":4,"serial":5,"lineage":"abc"}`)
+
+	tests := map[string]struct {
+		body   string
+		status int
+		code   string
+	}{
+		"serial regression": {`{"version":4,"serial":4,"lineage":"abc"}`, http.StatusConflict, "serial_regression"},
+		"invalid state":     {`{"serial":6}`, http.StatusBadRequest, "invalid_state"},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/myproject", strings.NewReader(tt.body)))
+			if w.Code != tt.status {
+				t.Fatalf("expected status %d, got %d", tt.status, w.Code)
+			}
+			var body map[string]string
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body["code"] != tt.code {
+				t.Errorf("expected code %s, got %s", tt.code, w.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+)
+
+// readFallbackDepth is the number of commits of a state searched for its last
+// valid version.
+const readFallbackDepth = 20
+
+// errCorruptState is returned for a state that cannot be decoded, or is not
+// JSON when read with READ_FALLBACK.
+var errCorruptState = errors.New("state is corrupt")
+
+// VersionReader is implemented by storages that can read files as of an
+// earlier commit.
+type VersionReader interface {
+	ListCommits(path string, limit int) ([]CommitInfo, error)
+	ResolveRef(ctx context.Context, ref string) (string, error)
+	GetFileAt(ctx context.Context, path, commit string) ([]byte, error)
+}
+
+// versionStorage reads the files of a storage as of a commit.
+type versionStorage struct {
+	reader VersionReader
+	commit string
+}
+
+// GetFile implements StateStorage.
+func (s versionStorage) GetFile(ctx context.Context, path string) ([]byte, string, error) {
+	content, err := s.reader.GetFileAt(ctx, path, s.commit)
+	return content, "", err
+}
+
+// CreateOrUpdateFile implements StateStorage; earlier versions are read-only.
+func (s versionStorage) CreateOrUpdateFile(ctx context.Context, path string, content []byte, message string) error {
+	return fmt.Errorf("cannot write %s as of commit %s", path, s.commit)
+}
+
+// isCorruptState reports whether err means the state as stored is unusable,
+// as opposed to unreachable.
+func isCorruptState(err error) bool {
+	return errors.Is(err, errCorruptState) || errors.Is(err, errChunksChanged) || errors.Is(err, ErrStateIntegrity)
+}
+
+// readState reads the named state from storage as served to Terraform,
+// checking it against its checksum sidecar if verifyReads is set. With
+// READ_FALLBACK, a state that is not JSON is reported as corrupt too, unless
+// raw states are allowed.
+func (h *StateHandler) readState(ctx context.Context, storage StateStorage, name string) ([]byte, error) {
+	var content []byte
+	var err error
+	if h.verifyReads {
+		content, err = readVerifiedState(ctx, storage, name)
+	} else {
+		content, _, err = loadState(ctx, storage, name)
+	}
+	if err == nil && content != nil && h.readFallback && !h.allowRawState && !json.Valid(content) {
+		return nil, fmt.Errorf("%w: %s is not valid JSON", errCorruptState, statePath(name))
+	}
+	return content, err
+}
+
+// readFallbackVersion returns the most recent version of the named state in
+// the history that reads without error, and the commit it is from. cause, the
+// error reading the current version, is returned if there is none.
+func (h *StateHandler) readFallbackVersion(ctx context.Context, name string, cause error) ([]byte, *CommitInfo, error) {
+	reader, ok := h.storage.(VersionReader)
+	if !ok {
+		return nil, nil, cause
+	}
+	commits, err := reader.ListCommits(statePath(name), readFallbackDepth)
+	if err != nil {
+		slog.Error("Error listing the history of corrupt state", "state", name, "error", err)
+		return nil, nil, cause
+	}
+	for _, commit := range commits {
+		content, err := h.readState(ctx, versionStorage{reader: reader, commit: commit.SHA}, name)
+		if err == nil && content != nil {
+			return content, &commit, nil
+		}
+		if ctx.Err() != nil {
+			return nil, nil, ctx.Err()
+		}
+	}
+	slog.Error("No valid version of corrupt state in its recent commits", "state", name, "commits", len(commits))
+	return nil, nil, cause
+}
+
+// warnFallback marks a response serving the version of the named state from
+// commit in place of its corrupt current version: the response gets a Warning
+// header, and the first such read since the state last read cleanly is
+// logged and announced to the notifier.
+func (h *StateHandler) warnFallback(w http.ResponseWriter, name string, commit *CommitInfo, cause error) {
+	IncrementReadFallbacks()
+	message := fmt.Sprintf("state %s is corrupt; serving its version of commit %s from %s until it is repaired", name, commit.SHA, commit.Created.UTC().Format("2006-01-02T15:04:05Z"))
+	w.Header().Add("Warning", fmt.Sprintf("299 gitea-tf-backend %q", message))
+
+	h.mu.Lock()
+	warned := h.fallbackWarned[name]
+	h.fallbackWarned[name] = true
+	h.mu.Unlock()
+	if !warned {
+		slog.Warn("State is corrupt; serving an earlier version until it is repaired", "state", name, "commit", commit.SHA, "error", cause)
+		h.notifier.Notify(EventStateCorrupt, name, fmt.Sprintf("State %s is corrupt; reads are served from commit %.12s until it is repaired.", name, commit.SHA),
+			map[string]any{"error": cause.Error(), "fallback_commit": commit.SHA, "fallback_created": commit.Created})
+	}
+}
+
+// clearFallback notes that the named state read cleanly, so that it is
+// announced again if it turns corrupt once more.
+func (h *StateHandler) clearFallback(name string) {
+	h.mu.RLock()
+	warned := h.fallbackWarned[name]
+	h.mu.RUnlock()
+	if warned {
+		h.mu.Lock()
+		delete(h.fallbackWarned, name)
+		h.mu.Unlock()
+		slog.Info("State reads cleanly again", "state", name)
+	}
+}
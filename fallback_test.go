@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestHandleGet_FallsBackOnCorruptState(t *testing.T) {
+	storage := newTestLocalGitClient(t)
+	handler := NewStateHandler(storage, DefaultMaxBodySize)
+	postState(t, handler, `{"version":4,"serial":1,"lineage":"abc"}`)
+	postState(t, handler, `{"version":4,"serial":2,"lineage":"abc"}`)
+	if err := storage.CreateOrUpdateFile(context.Background(), statePath("network"), []byte(`{"version":4,"ser`), "truncated"); err != nil {
+		t.Fatal(err)
+	}
+
+	if w := serve(handler, http.MethodGet, "/network"); w.Code != http.StatusInternalServerError {
+		t.Fatalf("expected the corrupt state to fail the read without READ_FALLBACK, got %d", w.Code)
+	}
+
+	handler.readFallback = true
+	commits, err := storage.ListCommits(statePath("network"), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := serve(handler, http.MethodGet, "/network")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"serial": 2`) {
+		t.Fatalf("expected the last valid version, got %d: %s", w.Code, w.Body.String())
+	}
+	if warning := w.Header().Get("Warning"); !strings.Contains(warning, commits[1].SHA) {
+		t.Errorf("expected a warning naming commit %s, got %q", commits[1].SHA, warning)
+	}
+	if !handler.fallbackWarned["network"] {
+		t.Error("expected the fallback to be announced")
+	}
+
+	// A write repairs the state
+	postState(t, handler, `{"version":4,"serial":3,"lineage":"abc"}`)
+	w = serve(handler, http.MethodGet, "/network")
+	if w.Code != http.StatusOK || w.Header().Get("Warning") != "" || !strings.Contains(w.Body.String(), `"serial": 3`) {
+		t.Errorf("expected the repaired state without a warning, got %d: %s", w.Code, w.Body.String())
+	}
+	if handler.fallbackWarned["network"] {
+		t.Error("expected the announcement to be reset by a clean read")
+	}
+}
+
+func TestHandleGet_FallbackWithoutValidVersion(t *testing.T) {
+	storage := newTestLocalGitClient(t)
+	handler := NewStateHandler(storage, DefaultMaxBodySize)
+	handler.readFallback = true
+	if err := storage.CreateOrUpdateFile(context.Background(), statePath("network"), []byte("not json"), "manual edit"); err != nil {
+		t.Fatal(err)
+	}
+
+	w := serve(handler, http.MethodGet, "/network")
+	if w.Code != http.StatusInternalServerError || w.Header().Get("Warning") != "" {
+		t.Errorf("expected the read to fail without a version to fall back to, got %d", w.Code)
+	}
+}
@@ -1,9 +1,19 @@
 package main
 
 import (
+	"context"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"code.gitea.io/sdk/gitea"
 )
@@ -12,44 +22,241 @@ import (
 // This enables callers to handle conflict scenarios (e.g., concurrent lock creation).
 var ErrFileAlreadyExists = errors.New("file already exists")
 
+// ErrFileChanged is returned when a file was written against a SHA that is no
+// longer current, because it was changed concurrently.
+var ErrFileChanged = errors.New("file changed since it was read")
+
 type GiteaClient struct {
-	client *gitea.Client
-	owner  string
-	repo   string
-	branch string
+	session *atomic.Pointer[giteaSession] // Shared with the copies made by WithRepo
+	owner   string
+	repo    string
+	branch  string
+	audit   *AuditLog // Optional - records every commit made through this client
+
+	// File operations are made without the SDK, see do
+	baseURL  string
+	features giteaFeatures
+}
+
+// giteaSession holds the credentials for Gitea API calls and the clients
+// sending them. Reloading the credentials replaces the session as a whole,
+// so requests already under way finish with the credentials they started with.
+type giteaSession struct {
+	client   *gitea.Client
+	http     *http.Client
+	token    string
+	username string // With password, used instead of the token
+	password string
+}
+
+// CommitInfo describes a commit in the repository history.
+type CommitInfo struct {
+	SHA     string    `json:"sha"`
+	Author  string    `json:"author"`
+	Message string    `json:"message"`
+	Created time.Time `json:"created"`
+}
+
+// Default HTTP client settings for Gitea API calls.
+const (
+	DefaultGiteaTimeout         = 60 * time.Second
+	DefaultGiteaMaxIdleConns    = 10
+	DefaultGiteaIdleConnTimeout = 90 * time.Second
+	DefaultGiteaKeepAlive       = 30 * time.Second
+)
+
+// newGiteaHTTPClient returns the HTTP client for Gitea API calls. Its timeout
+// covers each call including retries, so a hung connection cannot stall a
+// Terraform run indefinitely. Requests go through the proxy named by
+// HTTP_PROXY, HTTPS_PROXY and NO_PROXY unless GITEA_PROXY is set.
+func newGiteaHTTPClient(cfg *Config) *http.Client {
+	var transport *http.Transport
+	if t, ok := http.DefaultTransport.(*http.Transport); ok {
+		transport = t.Clone()
+	} else {
+		// Something replaced the default transport
+		transport = &http.Transport{Proxy: http.ProxyFromEnvironment, ForceAttemptHTTP2: true, TLSHandshakeTimeout: 10 * time.Second}
+	}
+	if cfg.GiteaProxy != nil {
+		transport.Proxy = http.ProxyURL(cfg.GiteaProxy)
+	}
+	transport.DialContext = (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: cfg.GiteaKeepAlive}).DialContext
+	transport.MaxIdleConns = cfg.GiteaMaxIdleConns
+	transport.MaxIdleConnsPerHost = cfg.GiteaMaxIdleConns
+	transport.IdleConnTimeout = cfg.GiteaIdleConnTimeout
+	transport.DisableKeepAlives = cfg.GiteaKeepAlive == 0
+
+	client := &http.Client{Timeout: cfg.GiteaTimeout, Transport: transport}
+	if cfg.GiteaTOTPSecret != nil {
+		// Below the retries, so that every attempt sends a current code
+		client.Transport = &otpTransport{next: client.Transport, secret: cfg.GiteaTOTPSecret, now: time.Now}
+	}
+	if giteaBudget != nil {
+		// Below the retries, so that every attempt counts against the budget
+		client.Transport = &budgetTransport{next: client.Transport, budget: giteaBudget}
+	}
+	if giteaLimiter != nil {
+		// Below the retries, so that every attempt waits out a rate limit,
+		// and above the budget, so that calls held back do not drain it
+		client.Transport = &rateLimitTransport{next: client.Transport, limiter: giteaLimiter}
+	}
+	if repoMoves != nil {
+		// Below the retries, so that a retried write goes to the new location
+		client.Transport = &repoMoveTransport{next: client.Transport, moves: repoMoves}
+	}
+	if cfg.Retry.MaxAttempts > 1 {
+		client.Transport = newRetryTransport(client.Transport, cfg.Retry)
+	}
+	return client
 }
 
 func NewGiteaClient(cfg *Config) (*GiteaClient, error) {
-	client, err := gitea.NewClient(cfg.GiteaURL, gitea.SetToken(cfg.GiteaToken))
+	s, err := newGiteaSession(cfg)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create gitea client: %w", err)
+		return nil, err
 	}
 
+	session := new(atomic.Pointer[giteaSession])
+	session.Store(s)
 	return &GiteaClient{
-		client: client,
-		owner:  cfg.GiteaOwner,
-		repo:   cfg.GiteaRepo,
-		branch: cfg.GiteaBranch,
+		session:  session,
+		owner:    cfg.GiteaOwner,
+		repo:     cfg.GiteaRepo,
+		branch:   cfg.GiteaBranch,
+		baseURL:  strings.TrimSuffix(cfg.GiteaURL, "/"),
+		features: probeGiteaFeatures(s.client),
+	}, nil
+}
+
+// newGiteaSession creates the clients for the credentials in cfg.
+func newGiteaSession(cfg *Config) (*giteaSession, error) {
+	httpClient := newGiteaHTTPClient(cfg)
+	auth := gitea.SetToken(cfg.GiteaToken)
+	if cfg.GiteaToken == "" && cfg.GiteaUsername != "" {
+		auth = gitea.SetBasicAuth(cfg.GiteaUsername, cfg.GiteaPassword)
+	}
+	client, err := gitea.NewClient(cfg.GiteaURL, auth, gitea.SetHTTPClient(httpClient))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create gitea client: %w", err)
+	}
+
+	return &giteaSession{
+		client:   client,
+		http:     httpClient,
+		token:    cfg.GiteaToken,
+		username: cfg.GiteaUsername,
+		password: cfg.GiteaPassword,
 	}, nil
 }
 
+// ReloadCredentials switches to the credentials in cfg once they are shown
+// to give access to the repository. Requests under way are not interrupted.
+func (g *GiteaClient) ReloadCredentials(cfg *Config) error {
+	s, err := newGiteaSession(cfg)
+	if err != nil {
+		return err
+	}
+	if _, _, err := s.client.GetRepo(g.owner, g.repo); err != nil {
+		return fmt.Errorf("failed to get repository %s/%s with the new credentials: %w", g.owner, g.repo, err)
+	}
+	g.session.Store(s)
+	return nil
+}
+
+// sdk returns the SDK client for the current credentials.
+func (g *GiteaClient) sdk() *gitea.Client {
+	return g.session.Load().client
+}
+
+// WithRepo returns a copy of the client operating on another repository of the same owner.
+func (g *GiteaClient) WithRepo(repo string) Repository {
+	c := *g
+	c.repo = repo
+	return &c
+}
+
+// ForRepo returns a copy of the client operating on the repository
+// owner/repo. It shares the client's credentials and audit log.
+func (g *GiteaClient) ForRepo(owner, repo string) *GiteaClient {
+	c := *g
+	c.owner, c.repo = owner, repo
+	return &c
+}
+
+// RepoExists reports whether the client's repository exists and is visible
+// with its credentials.
+func (g *GiteaClient) RepoExists() (bool, error) {
+	_, resp, err := g.sdk().GetRepo(g.owner, g.repo)
+	if resp != nil && resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to get repository %s/%s: %w", g.owner, g.repo, err)
+	}
+	return true, nil
+}
+
+// SetAuditLog records every commit made through this client in audit.
+func (g *GiteaClient) SetAuditLog(audit *AuditLog) {
+	g.audit = audit
+}
+
 // GetFile retrieves a file's content and SHA from the repository.
 // Returns content, SHA, and error. If file doesn't exist, returns nil content with no error.
-func (g *GiteaClient) GetFile(path string) ([]byte, string, error) {
-	content, resp, err := g.client.GetContents(g.owner, g.repo, g.branch, path)
+func (g *GiteaClient) GetFile(ctx context.Context, path string) ([]byte, string, error) {
+	return g.getFile(ctx, path, g.branch)
+}
+
+// GetFileAt retrieves a file's content as of commit. If the file didn't
+// exist then, returns nil content with no error.
+func (g *GiteaClient) GetFileAt(ctx context.Context, path, commit string) ([]byte, error) {
+	content, _, err := g.getFile(ctx, path, commit)
+	return content, err
+}
+
+// ResolveRef returns the SHA of the commit ref names, such as a tag, a branch
+// or an abbreviated SHA. Returns ErrRefNotFound if it names none.
+func (g *GiteaClient) ResolveRef(ctx context.Context, ref string) (string, error) {
+	var commit struct {
+		SHA string `json:"sha"`
+	}
+	err := g.do(ctx, http.MethodGet, fmt.Sprintf("/repos/%s/%s/git/commits/%s", url.PathEscape(g.owner), url.PathEscape(g.repo), url.PathEscape(ref)), nil, &commit)
+	if isGiteaStatus(err, http.StatusNotFound, http.StatusUnprocessableEntity) {
+		return "", fmt.Errorf("%w: %s", ErrRefNotFound, ref)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %s: %w", ref, err)
+	}
+	return commit.SHA, nil
+}
+
+// getFile retrieves a file's content and SHA as of ref, a branch or commit.
+func (g *GiteaClient) getFile(ctx context.Context, path, ref string) ([]byte, string, error) {
+	var content gitea.ContentsResponse
+	start := time.Now()
+	err := g.do(ctx, http.MethodGet, g.contentsPath(path)+"?ref="+url.QueryEscape(ref), nil, &content)
+	ObserveProcessingTime("transfer", start)
 	if err != nil {
-		if resp != nil && resp.StatusCode == 404 {
+		if isGiteaStatus(err, http.StatusNotFound) {
 			return nil, "", nil // File doesn't exist
 		}
 		return nil, "", fmt.Errorf("failed to get file %s: %w", path, err)
 	}
 
-	if content == nil {
+	if content.Content == nil {
+		if content.Type == "file" && content.Size > 0 {
+			// Gitea leaves out the content of blobs above its API's maximum blob size
+			raw, err := g.raw(ctx, path, ref)
+			if err != nil {
+				return nil, "", fmt.Errorf("failed to get file %s: %w", path, err)
+			}
+			return raw, content.SHA, nil
+		}
 		return nil, "", nil
 	}
 
 	// Content is base64 encoded
-	decoded, err := base64.StdEncoding.DecodeString(*content.Content)
+	decoded, err := decodeBase64(*content.Content)
 	if err != nil {
 		return nil, "", fmt.Errorf("failed to decode file content: %w", err)
 	}
@@ -58,8 +265,8 @@ func (g *GiteaClient) GetFile(path string) ([]byte, string, error) {
 }
 
 // FileExists checks if a file exists and returns its SHA if it does.
-func (g *GiteaClient) FileExists(path string) (bool, string, error) {
-	content, sha, err := g.GetFile(path)
+func (g *GiteaClient) FileExists(ctx context.Context, path string) (bool, string, error) {
+	content, sha, err := g.GetFile(ctx, path)
 	if err != nil {
 		return false, "", err
 	}
@@ -68,64 +275,465 @@ func (g *GiteaClient) FileExists(path string) (bool, string, error) {
 
 // CreateFile creates a new file in the repository.
 // Returns ErrFileAlreadyExists if the file already exists (HTTP 422 from Gitea).
-func (g *GiteaClient) CreateFile(path string, content []byte, message string) error {
-	_, resp, err := g.client.CreateFile(g.owner, g.repo, path, gitea.CreateFileOptions{
-		FileOptions: gitea.FileOptions{
+func (g *GiteaClient) CreateFile(ctx context.Context, path string, content []byte, message string) error {
+	var fr gitea.FileResponse
+	start := time.Now()
+	err := g.do(ctx, http.MethodPost, g.contentsPath(path), bodyWriter(contentObject{
+		fields: gitea.FileOptions{
 			Message:    message,
 			BranchName: g.branch,
+			Author:     giteaAuthor(ctx),
 		},
-		Content: base64.StdEncoding.EncodeToString(content),
-	})
+		content: content,
+	}.writeTo), &fr)
+	ObserveProcessingTime("transfer", start)
 	if err != nil {
 		// Gitea returns 422 Unprocessable Entity when file already exists
-		if resp != nil && resp.StatusCode == 422 {
+		if isGiteaStatus(err, http.StatusUnprocessableEntity) {
 			return ErrFileAlreadyExists
 		}
 		return fmt.Errorf("failed to create file %s: %w", path, err)
 	}
+	g.recordCommit(ctx, "create", path, commitSHA(&fr), message)
 	return nil
 }
 
 // UpdateFile updates an existing file in the repository.
-func (g *GiteaClient) UpdateFile(path string, content []byte, sha string, message string) error {
-	_, _, err := g.client.UpdateFile(g.owner, g.repo, path, gitea.UpdateFileOptions{
-		FileOptions: gitea.FileOptions{
-			Message:    message,
-			BranchName: g.branch,
+func (g *GiteaClient) UpdateFile(ctx context.Context, path string, content []byte, sha string, message string) error {
+	var fr gitea.FileResponse
+	start := time.Now()
+	err := g.do(ctx, http.MethodPut, g.contentsPath(path), bodyWriter(contentObject{
+		fields: struct {
+			gitea.FileOptions
+			SHA string `json:"sha"`
+		}{
+			FileOptions: gitea.FileOptions{
+				Message:    message,
+				BranchName: g.branch,
+				Author:     giteaAuthor(ctx),
+			},
+			SHA: sha,
 		},
-		SHA:     sha,
-		Content: base64.StdEncoding.EncodeToString(content),
-	})
+		content: content,
+	}.writeTo), &fr)
+	ObserveProcessingTime("transfer", start)
 	if err != nil {
+		// Gitea returns 422 Unprocessable Entity when the SHA does not match
+		if isGiteaStatus(err, http.StatusUnprocessableEntity, http.StatusConflict) {
+			return fmt.Errorf("failed to update file %s: %w", path, ErrFileChanged)
+		}
 		return fmt.Errorf("failed to update file %s: %w", path, err)
 	}
+	g.recordCommit(ctx, "update", path, commitSHA(&fr), message)
 	return nil
 }
 
 // DeleteFile deletes a file from the repository.
-func (g *GiteaClient) DeleteFile(path string, sha string, message string) error {
-	_, err := g.client.DeleteFile(g.owner, g.repo, path, gitea.DeleteFileOptions{
+func (g *GiteaClient) DeleteFile(ctx context.Context, path string, sha string, message string) error {
+	var fr gitea.FileResponse
+	err := g.do(ctx, http.MethodDelete, g.contentsPath(path), gitea.DeleteFileOptions{
 		FileOptions: gitea.FileOptions{
 			Message:    message,
 			BranchName: g.branch,
+			Author:     giteaAuthor(ctx),
 		},
 		SHA: sha,
-	})
+	}, &fr)
 	if err != nil {
 		return fmt.Errorf("failed to delete file %s: %w", path, err)
 	}
+	g.recordCommit(ctx, "delete", path, commitSHA(&fr), message)
 	return nil
 }
 
 // CreateOrUpdateFile creates a file if it doesn't exist, or updates it if it does.
-func (g *GiteaClient) CreateOrUpdateFile(path string, content []byte, message string) error {
-	exists, sha, err := g.FileExists(path)
+func (g *GiteaClient) CreateOrUpdateFile(ctx context.Context, path string, content []byte, message string) error {
+	exists, sha, err := g.FileExists(ctx, path)
 	if err != nil {
 		return err
 	}
 
 	if exists {
-		return g.UpdateFile(path, content, sha, message)
+		return g.UpdateFile(ctx, path, content, sha, message)
+	}
+	return g.CreateFile(ctx, path, content, message)
+}
+
+// giteaAuthor returns the commit author set in ctx. Gitea commits as the
+// authenticated user when it is empty.
+func giteaAuthor(ctx context.Context) gitea.Identity {
+	author, _ := commitAuthorFrom(ctx)
+	return gitea.Identity{Name: author.Name, Email: author.Email}
+}
+
+// changeFileOperation is a file operation of the multi-file contents endpoint.
+type changeFileOperation struct {
+	Operation string                  `json:"operation"`
+	Path      string                  `json:"path"`
+	SHA       string                  `json:"sha,omitempty"`
+	content   []byte                  // Sent as "content" unless deleting
+	stream    func(w io.Writer) error // Writes the content instead, if set
+}
+
+// changeFilesRequest is a request to the multi-file contents endpoint.
+type changeFilesRequest struct {
+	Branch  string          `json:"branch"`
+	Message string          `json:"message"`
+	Author  *gitea.Identity `json:"author,omitempty"`
+	files   []changeFileOperation
+}
+
+// writeTo writes the request as JSON to w, encoding the files' contents as
+// they are written.
+func (r changeFilesRequest) writeTo(w io.Writer) error {
+	if err := openObject(w, r); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, `"files":[`); err != nil {
+		return err
+	}
+	for i, file := range r.files {
+		if i > 0 {
+			if _, err := io.WriteString(w, ","); err != nil {
+				return err
+			}
+		}
+		var err error
+		if file.Operation == "delete" {
+			err = json.NewEncoder(w).Encode(file)
+		} else {
+			err = contentObject{fields: file, content: file.content, stream: file.stream}.writeTo(w)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, "]}")
+	return err
+}
+
+// StreamsFiles reports whether CommitFiles takes streamed changes: only
+// commits through the multi-file contents endpoint are sent as one request.
+func (g *GiteaClient) StreamsFiles() bool {
+	return g.features.multiFileCommits
+}
+
+// CommitFiles applies all changes in a single commit through Gitea's
+// multi-file contents endpoint, or one commit per file on servers predating it. The current SHAs of the affected files are
+// looked up with one directory listing per directory, unless given.
+func (g *GiteaClient) CommitFiles(ctx context.Context, message string, changes []FileChange) error {
+	shas := make(map[string]string)
+	listed := make(map[string]bool)
+	for _, change := range changes {
+		dir := path.Dir(change.Path)
+		if change.SHA != "" || change.Create || listed[dir] {
+			continue
+		}
+		listed[dir] = true
+		var entries []gitea.ContentsResponse
+		err := g.do(ctx, http.MethodGet, g.contentsPath(dir)+"?ref="+url.QueryEscape(g.branch), nil, &entries)
+		if err != nil && !isGiteaStatus(err, http.StatusNotFound) {
+			return fmt.Errorf("failed to list %s: %w", dir, err)
+		}
+		for _, entry := range entries {
+			if entry.Type == "file" {
+				shas[entry.Path] = entry.SHA
+			}
+		}
+	}
+
+	if !g.features.multiFileCommits {
+		return g.commitFilesSeparately(ctx, message, changes, shas)
+	}
+
+	var files []changeFileOperation
+	for _, change := range changes {
+		sha := change.SHA
+		if sha == "" {
+			sha = shas[change.Path]
+		}
+		deleted := change.Content == nil && change.Stream == nil
+		switch {
+		case deleted && sha == "":
+			continue
+		case deleted:
+			files = append(files, changeFileOperation{Operation: "delete", Path: change.Path, SHA: sha})
+		case sha == "" || change.Create:
+			files = append(files, changeFileOperation{Operation: "create", Path: change.Path, content: change.Content, stream: change.Stream})
+		default:
+			files = append(files, changeFileOperation{Operation: "update", Path: change.Path, SHA: sha, content: change.Content, stream: change.Stream})
+		}
+	}
+	if len(files) == 0 {
+		return nil
+	}
+
+	body := changeFilesRequest{Branch: g.branch, Message: message, files: files}
+	if author, ok := commitAuthorFrom(ctx); ok {
+		body.Author = &gitea.Identity{Name: author.Name, Email: author.Email}
+	}
+	var result struct {
+		Commit *struct {
+			SHA string `json:"sha"`
+		} `json:"commit"`
+	}
+	start := time.Now()
+	err := g.do(ctx, http.MethodPost, fmt.Sprintf("/repos/%s/%s/contents", url.PathEscape(g.owner), url.PathEscape(g.repo)), bodyWriter(body.writeTo), &result)
+	ObserveProcessingTime("transfer", start)
+	if isGiteaStatus(err, http.StatusUnprocessableEntity, http.StatusConflict) {
+		// A file to create exists, or a SHA does not match
+		return fmt.Errorf("failed to commit %d files: %w: %v", len(files), ErrFileChanged, err)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to commit %d files: %w", len(files), err)
+	}
+
+	var sha string
+	if result.Commit != nil {
+		sha = result.Commit.SHA
+	}
+	for _, file := range files {
+		g.recordCommit(ctx, file.Operation, file.Path, sha, message)
+	}
+	return nil
+}
+
+// commitFilesSeparately applies changes one commit at a time, for servers
+// without the multi-file contents endpoint. A failure leaves the changes
+// before it applied.
+func (g *GiteaClient) commitFilesSeparately(ctx context.Context, message string, changes []FileChange, shas map[string]string) error {
+	for _, change := range changes {
+		sha := change.SHA
+		if sha == "" {
+			sha = shas[change.Path]
+		}
+		var err error
+		switch {
+		case change.Content == nil && sha == "":
+			continue
+		case change.Content == nil:
+			err = g.DeleteFile(ctx, change.Path, sha, message)
+		case sha == "" || change.Create:
+			err = g.CreateFile(ctx, change.Path, change.Content, message)
+			if errors.Is(err, ErrFileAlreadyExists) {
+				err = fmt.Errorf("failed to create file %s: %w", change.Path, ErrFileChanged)
+			}
+		default:
+			err = g.UpdateFile(ctx, change.Path, change.Content, sha, message)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CreateTag creates a lightweight tag pointing at commit.
+// Returns ErrTagExists if the tag already exists.
+func (g *GiteaClient) CreateTag(ctx context.Context, tag, commit string) error {
+	err := g.do(ctx, http.MethodPost, fmt.Sprintf("/repos/%s/%s/tags", url.PathEscape(g.owner), url.PathEscape(g.repo)),
+		gitea.CreateTagOption{TagName: tag, Target: commit}, nil)
+	if isGiteaStatus(err, http.StatusConflict, http.StatusUnprocessableEntity) {
+		return ErrTagExists
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create tag %s: %w", tag, err)
+	}
+	return nil
+}
+
+// RepoTopics returns the topics of the repository.
+func (g *GiteaClient) RepoTopics(ctx context.Context) ([]string, error) {
+	var out struct {
+		Topics []string `json:"topics"`
+	}
+	err := g.do(ctx, http.MethodGet, fmt.Sprintf("/repos/%s/%s/topics?limit=50", url.PathEscape(g.owner), url.PathEscape(g.repo)), nil, &out)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list topics of %s/%s: %w", g.owner, g.repo, err)
+	}
+	return out.Topics, nil
+}
+
+// AddRepoTopic adds a topic to the repository, keeping its other topics.
+func (g *GiteaClient) AddRepoTopic(ctx context.Context, topic string) error {
+	err := g.do(ctx, http.MethodPut, fmt.Sprintf("/repos/%s/%s/topics/%s", url.PathEscape(g.owner), url.PathEscape(g.repo), url.PathEscape(topic)), nil, nil)
+	if err != nil {
+		return fmt.Errorf("failed to add topic %s to %s/%s: %w", topic, g.owner, g.repo, err)
+	}
+	return nil
+}
+
+// ListFiles returns the paths of all files below the given prefix.
+// An empty repository or missing branch yields an empty list.
+func (g *GiteaClient) ListFiles(prefix string) ([]string, error) {
+	var paths []string
+	for page := 1; ; page++ {
+		tree, resp, err := g.sdk().GetTrees(g.owner, g.repo, gitea.ListTreeOptions{
+			ListOptions: gitea.ListOptions{Page: page, PageSize: 1000},
+			Ref:         g.branch,
+			Recursive:   true,
+		})
+		if err != nil {
+			if resp != nil && resp.StatusCode == 404 {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("failed to list files under %s: %w", prefix, err)
+		}
+
+		for _, entry := range tree.Entries {
+			if entry.Type == "blob" && strings.HasPrefix(entry.Path, prefix) {
+				paths = append(paths, entry.Path)
+			}
+		}
+
+		if !tree.Truncated || len(tree.Entries) == 0 {
+			return paths, nil
+		}
+	}
+}
+
+// RepoSize returns the size of the repository in bytes as reported by Gitea.
+// Gitea reports sizes in KiB and refreshes them asynchronously after pushes.
+func (g *GiteaClient) RepoSize() (int64, error) {
+	repo, _, err := g.sdk().GetRepo(g.owner, g.repo)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get repository %s/%s: %w", g.owner, g.repo, err)
+	}
+	return int64(repo.Size) << 10, nil
+}
+
+// Ping verifies that the repository is reachable.
+func (g *GiteaClient) Ping() error {
+	if _, _, err := g.sdk().GetRepo(g.owner, g.repo); err != nil {
+		return fmt.Errorf("failed to get repository %s/%s: %w", g.owner, g.repo, err)
+	}
+	return nil
+}
+
+// LastCommitTime returns the time of the most recent commit touching path.
+// Returns the zero time if the path has no history.
+func (g *GiteaClient) LastCommitTime(path string) (time.Time, error) {
+	commits, err := g.ListCommits(path, 1)
+	if err != nil || len(commits) == 0 {
+		return time.Time{}, err
+	}
+	return commits[0].Created, nil
+}
+
+// ListCommits returns commits touching path, newest first.
+// A limit of 0 returns the complete history.
+func (g *GiteaClient) ListCommits(path string, limit int) ([]CommitInfo, error) {
+	pageSize := 50
+	if limit > 0 && limit < pageSize {
+		pageSize = limit
+	}
+
+	var result []CommitInfo
+	for page := 1; ; page++ {
+		commits, _, err := g.sdk().ListRepoCommits(g.owner, g.repo, gitea.ListCommitOptions{
+			ListOptions: gitea.ListOptions{Page: page, PageSize: pageSize},
+			SHA:         g.branch,
+			Path:        path,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list commits for %s: %w", path, err)
+		}
+
+		for _, commit := range commits {
+			if commit.CommitMeta == nil {
+				continue
+			}
+			info := CommitInfo{SHA: commit.SHA, Created: commit.Created}
+			if commit.RepoCommit != nil {
+				info.Message = commit.RepoCommit.Message
+				if commit.RepoCommit.Author != nil {
+					info.Author = commit.RepoCommit.Author.Name
+				}
+			}
+			result = append(result, info)
+			if limit > 0 && len(result) >= limit {
+				return result, nil
+			}
+		}
+
+		if len(commits) < pageSize {
+			return result, nil
+		}
+	}
+}
+
+// recordCommit appends a commit made through this client to the audit log, if configured.
+func (g *GiteaClient) recordCommit(ctx context.Context, action, path, sha, message string) {
+	recordCommit(ctx, g.audit, g.owner+"/"+g.repo, action, path, sha, message)
+}
+
+// decodeBase64 decodes file content straight from the API string, without
+// first copying it into a byte slice.
+func decodeBase64(s string) ([]byte, error) {
+	start := time.Now()
+	defer ObserveProcessingTime("base64", start)
+
+	dec := base64.NewDecoder(base64.StdEncoding, strings.NewReader(s))
+	// One spare byte, so that trailing garbage is read and reported
+	buf := make([]byte, base64.StdEncoding.DecodedLen(len(s))+1)
+	n := 0
+	for {
+		m, err := dec.Read(buf[n:])
+		n += m
+		if err == io.EOF {
+			return buf[:n], nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if n == len(buf) {
+			return nil, fmt.Errorf("base64 content is longer than expected")
+		}
+	}
+}
+
+// encodeBase64 writes file content to w encoded for the API.
+func encodeBase64(w io.Writer, content []byte) error {
+	return streamBase64(w, func(w io.Writer) error {
+		_, err := w.Write(content)
+		return err
+	})
+}
+
+// streamBase64 writes the content write writes to w, encoded for the API.
+// The time spent encoding is recorded as base64 processing time; the time
+// spent waiting for w to take the encoding is part of the transfer.
+func streamBase64(w io.Writer, write func(w io.Writer) error) error {
+	sent := &timedWriter{w: w}
+	encoder := base64.NewEncoder(base64.StdEncoding, sent)
+	encoding := &timedWriter{w: encoder}
+	err := write(encoding)
+	if err == nil {
+		start := time.Now()
+		err = encoder.Close()
+		encoding.spent += time.Since(start)
+	}
+	ObserveProcessingDuration("base64", encoding.spent-sent.spent)
+	return err
+}
+
+// timedWriter adds up the time spent writing to w.
+type timedWriter struct {
+	w     io.Writer
+	spent time.Duration
+}
+
+func (t *timedWriter) Write(p []byte) (int, error) {
+	start := time.Now()
+	n, err := t.w.Write(p)
+	t.spent += time.Since(start)
+	return n, err
+}
+
+// commitSHA extracts the commit SHA from a file API response.
+func commitSHA(fr *gitea.FileResponse) string {
+	if fr == nil || fr.Commit == nil {
+		return ""
 	}
-	return g.CreateFile(path, content, message)
+	return fr.Commit.SHA
 }
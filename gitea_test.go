@@ -0,0 +1,452 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestGiteaClient returns a GiteaClient backed by an in-memory DevGitea.
+func newTestGiteaClient(t *testing.T) *GiteaClient {
+	t.Helper()
+	return newTestGiteaClientFor(t, NewDevGitea())
+}
+
+// newTestGiteaClientFor returns a GiteaClient backed by the given DevGitea.
+func newTestGiteaClientFor(t *testing.T, dev *DevGitea) *GiteaClient {
+	t.Helper()
+
+	server := httptest.NewServer(dev)
+	t.Cleanup(server.Close)
+
+	client, err := NewGiteaClient(&Config{
+		GiteaURL:    server.URL,
+		GiteaToken:  "test-token",
+		GiteaOwner:  "testowner",
+		GiteaRepo:   "testrepo",
+		GiteaBranch: "main",
+	})
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	return client
+}
+
+func TestGiteaClient_GetFileMissing(t *testing.T) {
+	client := newTestGiteaClient(t)
+
+	content, sha, err := client.GetFile(context.Background(), "states/missing/terraform.tfstate")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if content != nil || sha != "" {
+		t.Errorf("expected no content for missing file, got %q (sha %q)", content, sha)
+	}
+}
+
+func TestGiteaClient_CreateOrUpdateFile(t *testing.T) {
+	client := newTestGiteaClient(t)
+	path := "states/myproject/terraform.tfstate"
+
+	if err := client.CreateOrUpdateFile(context.Background(), path, []byte(`{"serial":1}`), "create"); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	if err := client.CreateOrUpdateFile(context.Background(), path, []byte(`{"serial":2}`), "update"); err != nil {
+		t.Fatalf("update failed: %v", err)
+	}
+
+	content, sha, err := client.GetFile(context.Background(), path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(content) != `{"serial":2}` {
+		t.Errorf("expected updated content, got %s", content)
+	}
+	if sha != gitBlobSHA(content) {
+		t.Errorf("expected blob SHA %s, got %s", gitBlobSHA(content), sha)
+	}
+}
+
+func TestGiteaClient_CreateFileAlreadyExists(t *testing.T) {
+	client := newTestGiteaClient(t)
+	path := "states/myproject/terraform.tfstate"
+
+	if err := client.CreateFile(context.Background(), path, []byte("{}"), "create"); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	if err := client.CreateFile(context.Background(), path, []byte("{}"), "create"); !errors.Is(err, ErrFileAlreadyExists) {
+		t.Errorf("expected ErrFileAlreadyExists, got %v", err)
+	}
+}
+
+func TestGiteaClient_UpdateFileStaleSHA(t *testing.T) {
+	client := newTestGiteaClient(t)
+	path := "states/myproject/terraform.tfstate"
+
+	if err := client.CreateFile(context.Background(), path, []byte("{}"), "create"); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	if err := client.UpdateFile(context.Background(), path, []byte(`{"serial":1}`), "stale", "update"); !errors.Is(err, ErrFileChanged) {
+		t.Errorf("expected ErrFileChanged, got %v", err)
+	}
+}
+
+func TestGiteaClient_DeleteFile(t *testing.T) {
+	client := newTestGiteaClient(t)
+	path := "states/myproject/terraform.tfstate"
+
+	if err := client.CreateFile(context.Background(), path, []byte("{}"), "create"); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	_, sha, _ := client.GetFile(context.Background(), path)
+
+	if err := client.DeleteFile(context.Background(), path, "wrong-sha", "delete"); err == nil {
+		t.Error("expected error when deleting with a stale SHA")
+	}
+	if err := client.DeleteFile(context.Background(), path, sha, "delete"); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+	if exists, _, _ := client.FileExists(context.Background(), path); exists {
+		t.Error("file should be deleted")
+	}
+}
+
+func TestGiteaClient_CancelledContext(t *testing.T) {
+	client := newTestGiteaClient(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, _, err := client.GetFile(ctx, "states/myproject/terraform.tfstate"); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+	if err := client.CreateFile(ctx, "states/myproject/terraform.tfstate", []byte("{}"), "create"); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+	if exists, _, _ := client.FileExists(context.Background(), "states/myproject/terraform.tfstate"); exists {
+		t.Error("expected the cancelled create to be abandoned")
+	}
+}
+
+func TestGiteaClient_Timeout(t *testing.T) {
+	hang := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v1/version" {
+			_, _ = w.Write([]byte(`{"version":"1.21.0"}`))
+			return
+		}
+		<-hang
+	}))
+	t.Cleanup(server.Close)
+	t.Cleanup(func() { close(hang) })
+
+	client, err := NewGiteaClient(&Config{
+		GiteaURL:     server.URL,
+		GiteaOwner:   "testowner",
+		GiteaRepo:    "testrepo",
+		GiteaBranch:  "main",
+		GiteaTimeout: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := client.GetFile(context.Background(), "states/myproject/terraform.tfstate")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("expected a timeout error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the call to time out")
+	}
+}
+
+func TestGiteaClient_Proxy(t *testing.T) {
+	dev := NewDevGitea()
+	var proxied int
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Host == "gitea.internal" {
+			proxied++
+		}
+		dev.ServeHTTP(w, r)
+	}))
+	t.Cleanup(proxy.Close)
+
+	proxyURL, _ := url.Parse(proxy.URL)
+	client, err := NewGiteaClient(&Config{
+		GiteaURL:    "http://gitea.internal",
+		GiteaOwner:  "testowner",
+		GiteaRepo:   "testrepo",
+		GiteaBranch: "main",
+		GiteaProxy:  proxyURL,
+	})
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	if _, _, err := client.GetFile(context.Background(), "states/myproject/terraform.tfstate"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if proxied != 2 {
+		t.Errorf("expected the version probe and the read to go through the proxy, got %d requests", proxied)
+	}
+}
+
+func TestNewGiteaHTTPClient_ReplacedDefaultTransport(t *testing.T) {
+	previous := http.DefaultTransport
+	http.DefaultTransport = roundTripperFunc(func(*http.Request) (*http.Response, error) {
+		return nil, errors.New("not used")
+	})
+	t.Cleanup(func() { http.DefaultTransport = previous })
+
+	client := newGiteaHTTPClient(&Config{GiteaKeepAlive: DefaultGiteaKeepAlive})
+	transport, ok := client.Transport.(*http.Transport)
+	if !ok || transport.Proxy == nil {
+		t.Fatalf("expected a transport using the proxy of the environment, got %#v", client.Transport)
+	}
+}
+
+func TestGiteaClient_PasswordAuth(t *testing.T) {
+	dev := NewDevGitea()
+	var unauthenticated int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		if !ok || user != "tf-backend" || password != "secret" || len(r.Header.Get("X-Gitea-OTP")) != 6 {
+			unauthenticated++
+		}
+		dev.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	client, err := NewGiteaClient(&Config{
+		GiteaURL:        server.URL,
+		GiteaUsername:   "tf-backend",
+		GiteaPassword:   "secret",
+		GiteaTOTPSecret: []byte("12345678901234567890"),
+		GiteaOwner:      "testowner",
+		GiteaRepo:       "testrepo",
+		GiteaBranch:     "main",
+	})
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	if err := client.CreateOrUpdateFile(context.Background(), "states/myproject/terraform.tfstate", []byte("{}"), "create"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := client.ListFiles("states/"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if unauthenticated != 0 {
+		t.Errorf("expected every request to carry the password and a one-time code, %d did not", unauthenticated)
+	}
+}
+
+func TestGiteaClient_BranchesAreIsolated(t *testing.T) {
+	client := newTestGiteaClient(t)
+	path := "states/myproject/terraform.tfstate"
+
+	if err := client.CreateFile(context.Background(), path, []byte("{}"), "create"); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+
+	other := *client
+	other.branch = "other"
+	if exists, _, _ := other.FileExists(context.Background(), path); exists {
+		t.Error("file should not be visible on another branch")
+	}
+}
+
+func TestGiteaClient_CommitFiles(t *testing.T) {
+	client := newTestGiteaClient(t)
+	if err := client.CreateFile(context.Background(), "states/a/terraform.tfstate", []byte(`{"serial":1}`), "create"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	err := client.CommitFiles(context.Background(), "update", []FileChange{
+		{Path: "states/a/terraform.tfstate", Content: []byte(`{"serial":2}`)},
+		{Path: "states/a/terraform.tfstate.sha256", Content: []byte("abc")},
+		{Path: "states/a/old.json"}, // Deleting a missing file is a no-op
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	content, _, _ := client.GetFile(context.Background(), "states/a/terraform.tfstate")
+	if string(content) != `{"serial":2}` {
+		t.Errorf("expected updated state, got %s", content)
+	}
+	content, sha, _ := client.GetFile(context.Background(), "states/a/terraform.tfstate.sha256")
+	if string(content) != "abc" {
+		t.Errorf("expected created sidecar, got %s", content)
+	}
+
+	// A stale SHA fails the whole commit
+	err = client.CommitFiles(context.Background(), "update", []FileChange{
+		{Path: "states/a/terraform.tfstate", Content: []byte(`{"serial":3}`)},
+		{Path: "states/a/terraform.tfstate.sha256", Content: []byte("def"), SHA: "stale"},
+	})
+	if err == nil {
+		t.Fatal("expected error for stale SHA")
+	}
+	content, _, _ = client.GetFile(context.Background(), "states/a/terraform.tfstate")
+	if string(content) != `{"serial":2}` {
+		t.Errorf("expected state unchanged after failed commit, got %s", content)
+	}
+
+	if err := client.CommitFiles(context.Background(), "delete", []FileChange{{Path: "states/a/terraform.tfstate.sha256", SHA: sha}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if content, _, _ := client.GetFile(context.Background(), "states/a/terraform.tfstate.sha256"); content != nil {
+		t.Error("expected sidecar to be deleted")
+	}
+}
+
+func TestGiteaClient_StreamedWritesAreRetried(t *testing.T) {
+	dev := NewDevGitea()
+	failed := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost && !failed {
+			failed = true
+			_, _ = io.Copy(io.Discard, r.Body)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if r.Method == http.MethodPost && r.ContentLength != -1 {
+			t.Errorf("expected the write to be streamed, got a body of %d bytes", r.ContentLength)
+		}
+		dev.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	client, err := NewGiteaClient(&Config{
+		GiteaURL:    server.URL,
+		GiteaOwner:  "testowner",
+		GiteaRepo:   "testrepo",
+		GiteaBranch: "main",
+		Retry:       RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond},
+	})
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+
+	state := []byte(`{"serial":1,"outputs":{"padding":"` + strings.Repeat("x", 1<<20) + `"}}`)
+	err = client.CommitFiles(context.Background(), "create", []FileChange{
+		{Path: "states/a/terraform.tfstate", Content: state, Create: true},
+		{Path: "states/a/terraform.tfstate.sha256", Content: []byte("abc"), Create: true},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !failed {
+		t.Fatal("expected the first attempt to fail")
+	}
+	if content, _, _ := client.GetFile(context.Background(), "states/a/terraform.tfstate"); string(content) != string(state) {
+		t.Errorf("expected the state to be committed intact, got %d bytes", len(content))
+	}
+}
+
+func TestGiteaClient_CommitFilesBeforeGitea120(t *testing.T) {
+	dev := NewDevGitea()
+	dev.version = "1.19.4"
+	client := newTestGiteaClientFor(t, dev)
+	if client.features.multiFileCommits {
+		t.Fatal("expected multi-file commits to be unavailable")
+	}
+
+	err := client.CommitFiles(context.Background(), "update", []FileChange{
+		{Path: "states/a/terraform.tfstate", Content: []byte(`{"serial":1}`)},
+		{Path: "states/a/terraform.tfstate.sha256", Content: []byte("abc")},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	dev.mu.Lock()
+	commits := dev.commits
+	dev.mu.Unlock()
+	if commits != 2 {
+		t.Errorf("expected one commit per file, got %d", commits)
+	}
+	if content, _, _ := client.GetFile(context.Background(), "states/a/terraform.tfstate.sha256"); string(content) != "abc" {
+		t.Errorf("expected created sidecar, got %s", content)
+	}
+
+	err = client.CommitFiles(context.Background(), "update", []FileChange{
+		{Path: "states/a/terraform.tfstate", Content: []byte(`{"serial":2}`), Create: true},
+	})
+	if !errors.Is(err, ErrFileChanged) {
+		t.Errorf("expected ErrFileChanged, got %v", err)
+	}
+}
+
+func TestGiteaClient_GetFileAboveMaxBlobSize(t *testing.T) {
+	dev := NewDevGitea()
+	dev.maxBlobSize = 8
+	client := newTestGiteaClientFor(t, dev)
+	path := "states/myproject/terraform.tfstate"
+
+	if err := client.CreateFile(context.Background(), path, []byte(`{"serial":1}`), "create"); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	content, sha, err := client.GetFile(context.Background(), path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(content) != `{"serial":1}` || sha != gitBlobSHA(content) {
+		t.Errorf("expected the raw content, got %q (sha %q)", content, sha)
+	}
+}
+
+func TestGiteaClient_RepoSize(t *testing.T) {
+	client := newTestGiteaClient(t)
+
+	if err := client.CreateOrUpdateFile(context.Background(), "states/myproject/terraform.tfstate", make([]byte, 3000), "create"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	size, err := client.RepoSize()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if size != 3<<10 {
+		t.Errorf("expected size %d, got %d", 3<<10, size)
+	}
+}
+
+func TestBase64RoundTrip(t *testing.T) {
+	for _, content := range []string{"", "a", "ab", "abc", `{"version":4,"serial":1}`} {
+		var encoded strings.Builder
+		if err := encodeBase64(&encoded, []byte(content)); err != nil {
+			t.Fatalf("unexpected error for %q: %v", content, err)
+		}
+		decoded, err := decodeBase64(encoded.String())
+		if err != nil {
+			t.Fatalf("unexpected error for %q: %v", content, err)
+		}
+		if string(decoded) != content {
+			t.Errorf("expected %q, got %q", content, decoded)
+		}
+	}
+
+	if _, err := decodeBase64("YWJj!"); err == nil {
+		t.Error("expected error for invalid base64")
+	}
+	if _, err := decodeBase64("YWJ"); err == nil {
+		t.Error("expected error for truncated base64")
+	}
+}
+
+// roundTripperFunc is an http.RoundTripper calling itself.
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
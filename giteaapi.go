@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"code.gitea.io/sdk/gitea"
+)
+
+// The SDK covers most of the Gitea API, but lags behind it: it lacks the
+// multi-file contents endpoint and raw file downloads, and binds all requests
+// to a single context. Endpoints it lacks or handles poorly are called
+// directly through do, gated on the server version seen at startup where
+// they are not available in every supported release.
+
+// giteaFeatures records which optional API endpoints the server offers.
+type giteaFeatures struct {
+	multiFileCommits bool // POST /repos/{owner}/{repo}/contents, Gitea 1.20+
+}
+
+// probeGiteaFeatures derives the available features from the server version,
+// which the SDK looks up when the client is created. Features whose support
+// cannot be determined are assumed available.
+func probeGiteaFeatures(client *gitea.Client) giteaFeatures {
+	features := giteaFeatures{multiFileCommits: true}
+	if err := client.CheckServerVersionConstraint(">= 1.20"); err != nil {
+		slog.Info("Gitea server predates 1.20; multi-file changes are made one commit per file", "error", err)
+		features.multiFileCommits = false
+	}
+	return features
+}
+
+// giteaError is returned for unsuccessful API responses.
+type giteaError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *giteaError) Error() string {
+	return fmt.Sprintf("gitea returned %d: %s", e.StatusCode, e.Message)
+}
+
+// isGiteaStatus reports whether err is an API error with one of the given status codes.
+func isGiteaStatus(err error, statuses ...int) bool {
+	var apiErr *giteaError
+	return errors.As(err, &apiErr) && slices.Contains(statuses, apiErr.StatusCode)
+}
+
+// do sends an API request and decodes the JSON response into out, if non-nil.
+// File operations use it instead of the SDK, whose client only supports a
+// single context for all requests; ctx cancels the individual request.
+//
+// A body that is a bodyWriter is streamed: it is written as it is sent, and
+// written again for a retry.
+func (g *GiteaClient) do(ctx context.Context, method, apiPath string, body, out any) error {
+	var reader io.Reader
+	stream, streamed := body.(bodyWriter)
+	if body != nil && !streamed {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, g.baseURL+"/api/v1"+apiPath, reader)
+	if err != nil {
+		return err
+	}
+	if streamed {
+		// Sent chunked, as the length is not known up front
+		req.Body, _ = stream.open()
+		req.GetBody = stream.open
+	}
+	session := g.session.Load()
+	session.authorize(req)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := session.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var apiErr struct {
+			Message string `json:"message"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&apiErr)
+		return &giteaError{StatusCode: resp.StatusCode, Message: apiErr.Message}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// bodyWriter writes a request body as it is sent.
+type bodyWriter func(w io.Writer) error
+
+// open returns a reader of the body, written by a goroutine that ends when
+// the reader is drained or closed.
+func (write bodyWriter) open() (io.ReadCloser, error) {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(withPooledWriter(pw, write))
+	}()
+	return pr, nil
+}
+
+// contentObject is a JSON object of a contents API request with file
+// content. The content is base64-encoded while the request is sent, so that a
+// large state is not also held in memory as a base64 string and as part of
+// the marshalled request.
+type contentObject struct {
+	fields  any // The object's other fields
+	content []byte
+	stream  func(w io.Writer) error // Writes the content instead, if set
+}
+
+// writeTo writes the object as JSON to w, with the content as its "content"
+// field.
+func (o contentObject) writeTo(w io.Writer) error {
+	if err := openObject(w, o.fields); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, `"content":"`); err != nil {
+		return err
+	}
+	var err error
+	if o.stream != nil {
+		err = streamBase64(w, o.stream)
+	} else {
+		err = encodeBase64(w, o.content)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, `"}`)
+	return err
+}
+
+// openObject writes fields, which must marshal to a JSON object, to w without
+// the closing brace, ready for another field to be written.
+func openObject(w io.Writer, fields any) error {
+	b, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	b = bytes.TrimSuffix(b, []byte("}"))
+	if len(b) > 1 {
+		b = append(b, ',')
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// contentsPath returns the contents API path of a file, escaping each segment.
+func (g *GiteaClient) contentsPath(filePath string) string {
+	segments := strings.Split(filePath, "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+	return fmt.Sprintf("/repos/%s/%s/contents/%s", url.PathEscape(g.owner), url.PathEscape(g.repo), strings.Join(segments, "/"))
+}
+
+// authorize adds the session's credentials to req.
+func (s *giteaSession) authorize(req *http.Request) {
+	if s.token == "" && s.username != "" {
+		req.SetBasicAuth(s.username, s.password)
+		return
+	}
+	req.Header.Set("Authorization", "token "+s.token)
+}
+
+// raw downloads a file's content as of ref, regardless of its size.
+func (g *GiteaClient) raw(ctx context.Context, filePath, ref string) ([]byte, error) {
+	apiPath := strings.Replace(g.contentsPath(filePath), "/contents/", "/raw/", 1) + "?ref=" + url.QueryEscape(ref)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, g.baseURL+"/api/v1"+apiPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	session := g.session.Load()
+	session.authorize(req)
+
+	resp, err := session.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &giteaError{StatusCode: resp.StatusCode, Message: resp.Status}
+	}
+	return readAllSized(resp.Body, resp.ContentLength)
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// DefaultGitHubURL is the API endpoint of github.com.
+const DefaultGitHubURL = "https://api.github.com"
+
+// GitHubClient stores states in a GitHub repository through the contents API,
+// with the same semantics as GiteaClient.
+type GitHubClient struct {
+	baseURL string
+	token   string
+	owner   string
+	repo    string
+	branch  string
+	http    *http.Client
+	audit   *AuditLog // Optional - records every commit made through this client
+}
+
+// NewGitHubClient creates a client for the repository configured in cfg.
+func NewGitHubClient(cfg *Config) (*GitHubClient, error) {
+	baseURL := strings.TrimSuffix(cfg.GiteaURL, "/")
+	if baseURL == "" {
+		baseURL = DefaultGitHubURL
+	}
+	if _, err := url.Parse(baseURL); err != nil {
+		return nil, fmt.Errorf("invalid GitHub API URL: %w", err)
+	}
+
+	return &GitHubClient{
+		baseURL: baseURL,
+		token:   cfg.GiteaToken,
+		owner:   cfg.GiteaOwner,
+		repo:    cfg.GiteaRepo,
+		branch:  cfg.GiteaBranch,
+		http:    &http.Client{Timeout: 60 * time.Second},
+	}, nil
+}
+
+// WithRepo returns a copy of the client operating on another repository of the same owner.
+func (g *GitHubClient) WithRepo(repo string) Repository {
+	c := *g
+	c.repo = repo
+	return &c
+}
+
+// SetAuditLog records every commit made through this client in audit.
+func (g *GitHubClient) SetAuditLog(audit *AuditLog) {
+	g.audit = audit
+}
+
+// githubError is returned for unsuccessful API responses.
+type githubError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *githubError) Error() string {
+	return fmt.Sprintf("github API returned %d: %s", e.StatusCode, e.Message)
+}
+
+// isStatus reports whether err is an API error with the given status code.
+func isStatus(err error, status int) bool {
+	ghErr, ok := err.(*githubError)
+	return ok && ghErr.StatusCode == status
+}
+
+// do sends an API request and decodes the JSON response into out, if non-nil.
+func (g *GitHubClient) do(ctx context.Context, method, path string, query url.Values, body, out any) error {
+	u := g.baseURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("X-GitHub-Api-Version", "2022-11-28")
+	if g.token != "" {
+		req.Header.Set("Authorization", "Bearer "+g.token)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := g.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var apiErr struct {
+			Message string `json:"message"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&apiErr)
+		return &githubError{StatusCode: resp.StatusCode, Message: apiErr.Message}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (g *GitHubClient) repoPath(format string, args ...any) string {
+	return fmt.Sprintf("/repos/%s/%s", url.PathEscape(g.owner), url.PathEscape(g.repo)) + fmt.Sprintf(format, args...)
+}
+
+// contentsPath returns the contents API path of a file, escaping each segment.
+func (g *GitHubClient) contentsPath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+	return g.repoPath("/contents/%s", strings.Join(segments, "/"))
+}
+
+type githubContent struct {
+	SHA      string `json:"sha"`
+	Type     string `json:"type"`
+	Encoding string `json:"encoding"`
+	Content  string `json:"content"`
+}
+
+type githubFileResponse struct {
+	Commit struct {
+		SHA string `json:"sha"`
+	} `json:"commit"`
+}
+
+// GetFile retrieves a file's content and SHA from the repository.
+// Returns content, SHA, and error. If file doesn't exist, returns nil content with no error.
+func (g *GitHubClient) GetFile(ctx context.Context, path string) ([]byte, string, error) {
+	var content githubContent
+	err := g.do(ctx, http.MethodGet, g.contentsPath(path), url.Values{"ref": {g.branch}}, nil, &content)
+	if err != nil {
+		if isStatus(err, http.StatusNotFound) {
+			return nil, "", nil
+		}
+		return nil, "", fmt.Errorf("failed to get file %s: %w", path, err)
+	}
+	if content.Type != "file" {
+		return nil, "", nil
+	}
+
+	// Files over 1 MB are returned without content; fetch them as blobs instead
+	if content.Encoding == "none" {
+		if err := g.do(ctx, http.MethodGet, g.repoPath("/git/blobs/%s", content.SHA), nil, nil, &content); err != nil {
+			return nil, "", fmt.Errorf("failed to get blob of %s: %w", path, err)
+		}
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(strings.ReplaceAll(content.Content, "\n", ""))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to decode file content: %w", err)
+	}
+	return decoded, content.SHA, nil
+}
+
+// FileExists checks if a file exists and returns its SHA if it does.
+func (g *GitHubClient) FileExists(ctx context.Context, path string) (bool, string, error) {
+	content, sha, err := g.GetFile(ctx, path)
+	if err != nil {
+		return false, "", err
+	}
+	return content != nil, sha, nil
+}
+
+// withGitHubAuthor adds the commit author set in ctx to a contents request
+// body. GitHub uses the authenticated user when there is none.
+func withGitHubAuthor(ctx context.Context, body map[string]any) map[string]any {
+	if author, ok := commitAuthorFrom(ctx); ok {
+		body["author"] = map[string]string{"name": author.Name, "email": author.Email}
+	}
+	return body
+}
+
+// CreateFile creates a new file in the repository.
+// Returns ErrFileAlreadyExists if the file already exists (HTTP 422 from GitHub).
+func (g *GitHubClient) CreateFile(ctx context.Context, path string, content []byte, message string) error {
+	var fr githubFileResponse
+	err := g.do(ctx, http.MethodPut, g.contentsPath(path), nil, withGitHubAuthor(ctx, map[string]any{
+		"message": message,
+		"content": base64.StdEncoding.EncodeToString(content),
+		"branch":  g.branch,
+	}), &fr)
+	if err != nil {
+		// GitHub returns 422 Unprocessable Entity when the file exists and no SHA was given
+		if isStatus(err, http.StatusUnprocessableEntity) {
+			return ErrFileAlreadyExists
+		}
+		return fmt.Errorf("failed to create file %s: %w", path, err)
+	}
+	g.recordCommit(ctx, "create", path, fr.Commit.SHA, message)
+	return nil
+}
+
+// UpdateFile updates an existing file in the repository.
+func (g *GitHubClient) UpdateFile(ctx context.Context, path string, content []byte, sha string, message string) error {
+	var fr githubFileResponse
+	err := g.do(ctx, http.MethodPut, g.contentsPath(path), nil, withGitHubAuthor(ctx, map[string]any{
+		"message": message,
+		"content": base64.StdEncoding.EncodeToString(content),
+		"branch":  g.branch,
+		"sha":     sha,
+	}), &fr)
+	if err != nil {
+		// GitHub returns 409 Conflict when the SHA does not match
+		if isStatus(err, http.StatusConflict) {
+			return fmt.Errorf("failed to update file %s: %w", path, ErrFileChanged)
+		}
+		return fmt.Errorf("failed to update file %s: %w", path, err)
+	}
+	g.recordCommit(ctx, "update", path, fr.Commit.SHA, message)
+	return nil
+}
+
+// DeleteFile deletes a file from the repository.
+func (g *GitHubClient) DeleteFile(ctx context.Context, path string, sha string, message string) error {
+	var fr githubFileResponse
+	err := g.do(ctx, http.MethodDelete, g.contentsPath(path), nil, withGitHubAuthor(ctx, map[string]any{
+		"message": message,
+		"branch":  g.branch,
+		"sha":     sha,
+	}), &fr)
+	if err != nil {
+		return fmt.Errorf("failed to delete file %s: %w", path, err)
+	}
+	g.recordCommit(ctx, "delete", path, fr.Commit.SHA, message)
+	return nil
+}
+
+// CreateOrUpdateFile creates a file if it doesn't exist, or updates it if it does.
+func (g *GitHubClient) CreateOrUpdateFile(ctx context.Context, path string, content []byte, message string) error {
+	exists, sha, err := g.FileExists(ctx, path)
+	if err != nil {
+		return err
+	}
+
+	if exists {
+		return g.UpdateFile(ctx, path, content, sha, message)
+	}
+	return g.CreateFile(ctx, path, content, message)
+}
+
+// CreateTag creates a lightweight tag pointing at commit.
+// Returns ErrTagExists if the tag already exists.
+func (g *GitHubClient) CreateTag(ctx context.Context, tag, commit string) error {
+	err := g.do(ctx, http.MethodPost, g.repoPath("/git/refs"), nil, map[string]string{
+		"ref": "refs/tags/" + tag,
+		"sha": commit,
+	}, nil)
+	if err != nil {
+		// GitHub returns 422 Unprocessable Entity when the reference exists
+		if isStatus(err, http.StatusUnprocessableEntity) {
+			return ErrTagExists
+		}
+		return fmt.Errorf("failed to create tag %s: %w", tag, err)
+	}
+	return nil
+}
+
+// ListFiles returns the paths of all files below the given prefix.
+// An empty repository or missing branch yields an empty list.
+func (g *GitHubClient) ListFiles(prefix string) ([]string, error) {
+	var tree struct {
+		Tree []struct {
+			Path string `json:"path"`
+			Type string `json:"type"`
+		} `json:"tree"`
+		Truncated bool `json:"truncated"`
+	}
+	err := g.do(context.Background(), http.MethodGet, g.repoPath("/git/trees/%s", url.PathEscape(g.branch)), url.Values{"recursive": {"1"}}, nil, &tree)
+	if err != nil {
+		// GitHub returns 409 for trees of empty repositories
+		if isStatus(err, http.StatusNotFound) || isStatus(err, http.StatusConflict) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to list files under %s: %w", prefix, err)
+	}
+	if tree.Truncated {
+		return nil, fmt.Errorf("failed to list files under %s: repository tree is too large for the GitHub API", prefix)
+	}
+
+	var paths []string
+	for _, entry := range tree.Tree {
+		if entry.Type == "blob" && strings.HasPrefix(entry.Path, prefix) {
+			paths = append(paths, entry.Path)
+		}
+	}
+	return paths, nil
+}
+
+// RepoSize returns the size of the repository in bytes as reported by GitHub.
+// GitHub reports sizes in KiB and refreshes them asynchronously after pushes.
+func (g *GitHubClient) RepoSize() (int64, error) {
+	var repo struct {
+		Size int64 `json:"size"`
+	}
+	if err := g.do(context.Background(), http.MethodGet, g.repoPath(""), nil, nil, &repo); err != nil {
+		return 0, fmt.Errorf("failed to get repository %s/%s: %w", g.owner, g.repo, err)
+	}
+	return repo.Size << 10, nil
+}
+
+// Ping verifies that the repository is reachable.
+func (g *GitHubClient) Ping() error {
+	if err := g.do(context.Background(), http.MethodGet, g.repoPath(""), nil, nil, nil); err != nil {
+		return fmt.Errorf("failed to get repository %s/%s: %w", g.owner, g.repo, err)
+	}
+	return nil
+}
+
+// LastCommitTime returns the time of the most recent commit touching path.
+// Returns the zero time if the path has no history.
+func (g *GitHubClient) LastCommitTime(path string) (time.Time, error) {
+	commits, err := g.ListCommits(path, 1)
+	if err != nil || len(commits) == 0 {
+		return time.Time{}, err
+	}
+	return commits[0].Created, nil
+}
+
+// ListCommits returns commits touching path, newest first.
+// A limit of 0 returns the complete history.
+func (g *GitHubClient) ListCommits(path string, limit int) ([]CommitInfo, error) {
+	pageSize := 100
+	if limit > 0 && limit < pageSize {
+		pageSize = limit
+	}
+
+	var result []CommitInfo
+	for page := 1; ; page++ {
+		var commits []struct {
+			SHA    string `json:"sha"`
+			Commit struct {
+				Message string `json:"message"`
+				Author  struct {
+					Name string    `json:"name"`
+					Date time.Time `json:"date"`
+				} `json:"author"`
+			} `json:"commit"`
+		}
+		query := url.Values{
+			"sha":      {g.branch},
+			"path":     {path},
+			"page":     {fmt.Sprint(page)},
+			"per_page": {fmt.Sprint(pageSize)},
+		}
+		if err := g.do(context.Background(), http.MethodGet, g.repoPath("/commits"), query, nil, &commits); err != nil {
+			// GitHub returns 409 for the history of empty repositories
+			if isStatus(err, http.StatusConflict) {
+				return result, nil
+			}
+			return nil, fmt.Errorf("failed to list commits for %s: %w", path, err)
+		}
+
+		for _, commit := range commits {
+			result = append(result, CommitInfo{
+				SHA:     commit.SHA,
+				Author:  commit.Commit.Author.Name,
+				Message: commit.Commit.Message,
+				Created: commit.Commit.Author.Date,
+			})
+			if limit > 0 && len(result) >= limit {
+				return result, nil
+			}
+		}
+
+		if len(commits) < pageSize {
+			return result, nil
+		}
+	}
+}
+
+// recordCommit appends a commit made through this client to the audit log, if configured.
+func (g *GitHubClient) recordCommit(ctx context.Context, action, path, sha, message string) {
+	recordCommit(ctx, g.audit, g.owner+"/"+g.repo, action, path, sha, message)
+}
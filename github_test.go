@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeGitHub implements the subset of the GitHub contents API used by GitHubClient.
+type fakeGitHub struct {
+	mu      sync.Mutex
+	files   map[string][]byte
+	commits []string // paths touched, newest last
+}
+
+func (f *fakeGitHub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.Header.Get("Authorization") != "Bearer test-token" {
+		writeDevJSON(w, http.StatusUnauthorized, map[string]string{"message": "Bad credentials"})
+		return
+	}
+
+	rest, _ := strings.CutPrefix(r.URL.Path, "/repos/testowner/testrepo")
+	switch {
+	case rest == "":
+		writeDevJSON(w, http.StatusOK, map[string]any{"size": 2})
+	case strings.HasPrefix(rest, "/contents/"):
+		f.handleContents(w, r, strings.TrimPrefix(rest, "/contents/"))
+	case strings.HasPrefix(rest, "/git/trees/"):
+		var tree []map[string]string
+		for path := range f.files {
+			tree = append(tree, map[string]string{"path": path, "type": "blob"})
+		}
+		writeDevJSON(w, http.StatusOK, map[string]any{"tree": tree, "truncated": false})
+	case rest == "/commits":
+		var commits []map[string]any
+		for i := len(f.commits) - 1; i >= 0; i-- {
+			if strings.HasPrefix(f.commits[i], r.URL.Query().Get("path")) {
+				commits = append(commits, map[string]any{
+					"sha":    gitBlobSHA([]byte{byte(i)}),
+					"commit": map[string]any{"message": "update", "author": map[string]any{"name": "bot", "date": "2024-01-01T00:00:00Z"}},
+				})
+			}
+		}
+		writeDevJSON(w, http.StatusOK, commits)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakeGitHub) handleContents(w http.ResponseWriter, r *http.Request, path string) {
+	existing, exists := f.files[path]
+
+	if r.Method == http.MethodGet {
+		if !exists {
+			writeDevJSON(w, http.StatusNotFound, map[string]string{"message": "Not Found"})
+			return
+		}
+		writeDevJSON(w, http.StatusOK, map[string]string{
+			"type":     "file",
+			"sha":      gitBlobSHA(existing),
+			"encoding": "base64",
+			"content":  base64.StdEncoding.EncodeToString(existing),
+		})
+		return
+	}
+
+	var req struct {
+		Content string `json:"content"`
+		SHA     string `json:"sha"`
+	}
+	_ = json.NewDecoder(r.Body).Decode(&req)
+	if exists && req.SHA == "" {
+		writeDevJSON(w, http.StatusUnprocessableEntity, map[string]string{"message": `"sha" wasn't supplied.`})
+		return
+	}
+	if exists && req.SHA != gitBlobSHA(existing) {
+		writeDevJSON(w, http.StatusConflict, map[string]string{"message": "does not match"})
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		content, _ := base64.StdEncoding.DecodeString(req.Content)
+		f.files[path] = content
+	case http.MethodDelete:
+		if !exists {
+			writeDevJSON(w, http.StatusNotFound, map[string]string{"message": "Not Found"})
+			return
+		}
+		delete(f.files, path)
+	}
+	f.commits = append(f.commits, path)
+	writeDevJSON(w, http.StatusOK, map[string]any{"commit": map[string]string{"sha": gitBlobSHA([]byte{byte(len(f.commits) - 1)})}})
+}
+
+func newTestGitHubClient(t *testing.T) *GitHubClient {
+	t.Helper()
+
+	server := httptest.NewServer(&fakeGitHub{files: make(map[string][]byte)})
+	t.Cleanup(server.Close)
+
+	client, err := NewGitHubClient(&Config{
+		GiteaURL:    server.URL,
+		GiteaToken:  "test-token",
+		GiteaOwner:  "testowner",
+		GiteaRepo:   "testrepo",
+		GiteaBranch: "main",
+	})
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	return client
+}
+
+func TestGitHubClient_FileLifecycle(t *testing.T) {
+	client := newTestGitHubClient(t)
+	path := "states/myproject/terraform.tfstate"
+
+	content, _, err := client.GetFile(context.Background(), path)
+	if err != nil || content != nil {
+		t.Fatalf("expected missing file, got %q, %v", content, err)
+	}
+
+	if err := client.CreateOrUpdateFile(context.Background(), path, []byte(`{"serial":1}`), "create"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := client.CreateOrUpdateFile(context.Background(), path, []byte(`{"serial":2}`), "update"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := client.CreateFile(context.Background(), path, []byte(`{}`), "create"); !errors.Is(err, ErrFileAlreadyExists) {
+		t.Errorf("expected ErrFileAlreadyExists, got %v", err)
+	}
+
+	content, sha, err := client.GetFile(context.Background(), path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(content) != `{"serial":2}` {
+		t.Errorf("expected updated content, got %s", content)
+	}
+	if err := client.UpdateFile(context.Background(), path, []byte(`{}`), "stale", "update"); !errors.Is(err, ErrFileChanged) {
+		t.Errorf("expected ErrFileChanged for a stale SHA, got %v", err)
+	}
+
+	paths, err := client.ListFiles("states/")
+	if err != nil || len(paths) != 1 || paths[0] != path {
+		t.Errorf("expected [%s], got %v (%v)", path, paths, err)
+	}
+
+	commits, err := client.ListCommits(path, 0)
+	if err != nil || len(commits) != 2 {
+		t.Errorf("expected 2 commits, got %d (%v)", len(commits), err)
+	}
+
+	if err := client.DeleteFile(context.Background(), path, sha, "delete"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if content, _, _ := client.GetFile(context.Background(), path); content != nil {
+		t.Error("expected file to be deleted")
+	}
+}
+
+func TestGitHubClient_RepoSize(t *testing.T) {
+	client := newTestGitHubClient(t)
+
+	size, err := client.RepoSize()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if size != 2<<10 {
+		t.Errorf("expected size %d, got %d", 2<<10, size)
+	}
+}
+
+func TestGitHubClient_BadCredentials(t *testing.T) {
+	client := newTestGitHubClient(t)
+	client.token = "wrong"
+
+	if err := client.Ping(); !isStatus(errors.Unwrap(err), http.StatusUnauthorized) {
+		t.Errorf("expected 401 error, got %v", err)
+	}
+}
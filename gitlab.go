@@ -0,0 +1,397 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// DefaultGitLabURL is the address of gitlab.com.
+const DefaultGitLabURL = "https://gitlab.com"
+
+// GitLabClient stores states in a GitLab project through the repository files
+// and commits APIs, with the same semantics as GiteaClient. Where the other
+// clients use blob SHAs for optimistic concurrency, GitLab uses the ID of the
+// last commit touching the file, so that is what GetFile returns as the SHA.
+type GitLabClient struct {
+	baseURL string
+	token   string
+	owner   string // Namespace of the project, e.g. a group path
+	repo    string
+	branch  string
+	http    *http.Client
+	audit   *AuditLog // Optional - records every commit made through this client
+}
+
+// NewGitLabClient creates a client for the project configured in cfg.
+func NewGitLabClient(cfg *Config) (*GitLabClient, error) {
+	baseURL := strings.TrimSuffix(cfg.GiteaURL, "/")
+	if baseURL == "" {
+		baseURL = DefaultGitLabURL
+	}
+	if _, err := url.Parse(baseURL); err != nil {
+		return nil, fmt.Errorf("invalid GitLab URL: %w", err)
+	}
+
+	return &GitLabClient{
+		baseURL: baseURL,
+		token:   cfg.GiteaToken,
+		owner:   cfg.GiteaOwner,
+		repo:    cfg.GiteaRepo,
+		branch:  cfg.GiteaBranch,
+		http:    &http.Client{Timeout: 60 * time.Second},
+	}, nil
+}
+
+// WithRepo returns a copy of the client operating on another project in the same namespace.
+func (g *GitLabClient) WithRepo(repo string) Repository {
+	c := *g
+	c.repo = repo
+	return &c
+}
+
+// SetAuditLog records every commit made through this client in audit.
+func (g *GitLabClient) SetAuditLog(audit *AuditLog) {
+	g.audit = audit
+}
+
+// gitlabError is returned for unsuccessful API responses.
+type gitlabError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *gitlabError) Error() string {
+	return fmt.Sprintf("gitlab API returned %d: %s", e.StatusCode, e.Message)
+}
+
+// isGitLabStatus reports whether err is an API error with the given status code.
+func isGitLabStatus(err error, status int) bool {
+	glErr, ok := err.(*gitlabError)
+	return ok && glErr.StatusCode == status
+}
+
+// do sends an API request and decodes the JSON response into out, if non-nil.
+func (g *GitLabClient) do(ctx context.Context, method, path string, query url.Values, body, out any) error {
+	u := g.baseURL + "/api/v4" + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("PRIVATE-TOKEN", g.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := g.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		// GitLab reports errors as either "message" or "error"
+		var apiErr struct {
+			Message any    `json:"message"`
+			Error   string `json:"error"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&apiErr)
+		message := apiErr.Error
+		if apiErr.Message != nil {
+			message = fmt.Sprint(apiErr.Message)
+		}
+		return &gitlabError{StatusCode: resp.StatusCode, Message: message}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// projectPath returns the API path of the project, which GitLab identifies by its URL-encoded full path.
+func (g *GitLabClient) projectPath(format string, args ...any) string {
+	return "/projects/" + url.PathEscape(g.owner+"/"+g.repo) + fmt.Sprintf(format, args...)
+}
+
+// GetFile retrieves a file's content and last commit ID from the repository.
+// Returns content, commit ID, and error. If file doesn't exist, returns nil content with no error.
+func (g *GitLabClient) GetFile(ctx context.Context, path string) ([]byte, string, error) {
+	var file struct {
+		Content      string `json:"content"`
+		LastCommitID string `json:"last_commit_id"`
+	}
+	err := g.do(ctx, http.MethodGet, g.projectPath("/repository/files/%s", url.PathEscape(path)), url.Values{"ref": {g.branch}}, nil, &file)
+	if err != nil {
+		if isGitLabStatus(err, http.StatusNotFound) {
+			return nil, "", nil
+		}
+		return nil, "", fmt.Errorf("failed to get file %s: %w", path, err)
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(file.Content)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to decode file content: %w", err)
+	}
+	return decoded, file.LastCommitID, nil
+}
+
+// FileExists checks if a file exists and returns its last commit ID if it does.
+func (g *GitLabClient) FileExists(ctx context.Context, path string) (bool, string, error) {
+	content, sha, err := g.GetFile(ctx, path)
+	if err != nil {
+		return false, "", err
+	}
+	return content != nil, sha, nil
+}
+
+// gitlabAction is a single file change in a commit.
+type gitlabAction struct {
+	Action       string `json:"action"`
+	FilePath     string `json:"file_path"`
+	Content      string `json:"content,omitempty"`
+	Encoding     string `json:"encoding,omitempty"`
+	LastCommitID string `json:"last_commit_id,omitempty"`
+}
+
+// commit creates a commit with the given actions and returns its ID. The
+// author set in ctx, if any, replaces the authenticated user as author.
+func (g *GitLabClient) commit(ctx context.Context, message string, actions ...gitlabAction) (string, error) {
+	var commit struct {
+		ID string `json:"id"`
+	}
+	body := map[string]any{
+		"branch":         g.branch,
+		"commit_message": message,
+		"actions":        actions,
+	}
+	if author, ok := commitAuthorFrom(ctx); ok {
+		body["author_name"], body["author_email"] = author.Name, author.Email
+	}
+	err := g.do(ctx, http.MethodPost, g.projectPath("/repository/commits"), nil, body, &commit)
+	return commit.ID, err
+}
+
+// CreateFile creates a new file in the repository.
+// Returns ErrFileAlreadyExists if the file already exists.
+func (g *GitLabClient) CreateFile(ctx context.Context, path string, content []byte, message string) error {
+	sha, err := g.commit(ctx, message, gitlabAction{
+		Action:   "create",
+		FilePath: path,
+		Content:  base64.StdEncoding.EncodeToString(content),
+		Encoding: "base64",
+	})
+	if err != nil {
+		// GitLab returns 400 Bad Request when the file already exists
+		if isGitLabStatus(err, http.StatusBadRequest) && strings.Contains(err.Error(), "already exists") {
+			return ErrFileAlreadyExists
+		}
+		return fmt.Errorf("failed to create file %s: %w", path, err)
+	}
+	g.recordCommit(ctx, "create", path, sha, message)
+	return nil
+}
+
+// UpdateFile updates an existing file in the repository. sha is the last
+// commit ID returned by GetFile; the update fails if the file changed since.
+func (g *GitLabClient) UpdateFile(ctx context.Context, path string, content []byte, sha string, message string) error {
+	commitID, err := g.commit(ctx, message, gitlabAction{
+		Action:       "update",
+		FilePath:     path,
+		Content:      base64.StdEncoding.EncodeToString(content),
+		Encoding:     "base64",
+		LastCommitID: sha,
+	})
+	if err != nil {
+		// GitLab returns 400 Bad Request when the file changed since last_commit_id
+		if isGitLabStatus(err, http.StatusBadRequest) && strings.Contains(err.Error(), "has changed") {
+			return fmt.Errorf("failed to update file %s: %w", path, ErrFileChanged)
+		}
+		return fmt.Errorf("failed to update file %s: %w", path, err)
+	}
+	g.recordCommit(ctx, "update", path, commitID, message)
+	return nil
+}
+
+// DeleteFile deletes a file from the repository.
+func (g *GitLabClient) DeleteFile(ctx context.Context, path string, sha string, message string) error {
+	commitID, err := g.commit(ctx, message, gitlabAction{
+		Action:       "delete",
+		FilePath:     path,
+		LastCommitID: sha,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete file %s: %w", path, err)
+	}
+	g.recordCommit(ctx, "delete", path, commitID, message)
+	return nil
+}
+
+// CreateOrUpdateFile creates a file if it doesn't exist, or updates it if it does.
+func (g *GitLabClient) CreateOrUpdateFile(ctx context.Context, path string, content []byte, message string) error {
+	exists, sha, err := g.FileExists(ctx, path)
+	if err != nil {
+		return err
+	}
+
+	if exists {
+		return g.UpdateFile(ctx, path, content, sha, message)
+	}
+	return g.CreateFile(ctx, path, content, message)
+}
+
+// CreateTag creates a lightweight tag pointing at commit.
+// Returns ErrTagExists if the tag already exists.
+func (g *GitLabClient) CreateTag(ctx context.Context, tag, commit string) error {
+	err := g.do(ctx, http.MethodPost, g.projectPath("/repository/tags"), nil, map[string]string{
+		"tag_name": tag,
+		"ref":      commit,
+	}, nil)
+	if err != nil {
+		// GitLab returns 400 Bad Request when the tag exists
+		if isGitLabStatus(err, http.StatusBadRequest) && strings.Contains(err.Error(), "already exists") {
+			return ErrTagExists
+		}
+		return fmt.Errorf("failed to create tag %s: %w", tag, err)
+	}
+	return nil
+}
+
+// ListFiles returns the paths of all files below the given prefix.
+// An empty repository or missing branch yields an empty list.
+func (g *GitLabClient) ListFiles(prefix string) ([]string, error) {
+	const pageSize = 100
+
+	var paths []string
+	for page := 1; ; page++ {
+		var entries []struct {
+			Path string `json:"path"`
+			Type string `json:"type"`
+		}
+		query := url.Values{
+			"ref":       {g.branch},
+			"recursive": {"true"},
+			"page":      {fmt.Sprint(page)},
+			"per_page":  {fmt.Sprint(pageSize)},
+		}
+		if dir, ok := strings.CutSuffix(prefix, "/"); ok && dir != "" {
+			query.Set("path", dir)
+		}
+		if err := g.do(context.Background(), http.MethodGet, g.projectPath("/repository/tree"), query, nil, &entries); err != nil {
+			if isGitLabStatus(err, http.StatusNotFound) {
+				return paths, nil
+			}
+			return nil, fmt.Errorf("failed to list files under %s: %w", prefix, err)
+		}
+
+		for _, entry := range entries {
+			if entry.Type == "blob" && strings.HasPrefix(entry.Path, prefix) {
+				paths = append(paths, entry.Path)
+			}
+		}
+
+		if len(entries) < pageSize {
+			return paths, nil
+		}
+	}
+}
+
+// RepoSize returns the size of the repository in bytes as reported by GitLab.
+// Requires at least Reporter access to the project.
+func (g *GitLabClient) RepoSize() (int64, error) {
+	var project struct {
+		Statistics struct {
+			RepositorySize int64 `json:"repository_size"`
+		} `json:"statistics"`
+	}
+	if err := g.do(context.Background(), http.MethodGet, g.projectPath(""), url.Values{"statistics": {"true"}}, nil, &project); err != nil {
+		return 0, fmt.Errorf("failed to get project %s/%s: %w", g.owner, g.repo, err)
+	}
+	return project.Statistics.RepositorySize, nil
+}
+
+// Ping verifies that the project is reachable.
+func (g *GitLabClient) Ping() error {
+	if err := g.do(context.Background(), http.MethodGet, g.projectPath(""), nil, nil, nil); err != nil {
+		return fmt.Errorf("failed to get project %s/%s: %w", g.owner, g.repo, err)
+	}
+	return nil
+}
+
+// LastCommitTime returns the time of the most recent commit touching path.
+// Returns the zero time if the path has no history.
+func (g *GitLabClient) LastCommitTime(path string) (time.Time, error) {
+	commits, err := g.ListCommits(path, 1)
+	if err != nil || len(commits) == 0 {
+		return time.Time{}, err
+	}
+	return commits[0].Created, nil
+}
+
+// ListCommits returns commits touching path, newest first.
+// A limit of 0 returns the complete history.
+func (g *GitLabClient) ListCommits(path string, limit int) ([]CommitInfo, error) {
+	pageSize := 100
+	if limit > 0 && limit < pageSize {
+		pageSize = limit
+	}
+
+	var result []CommitInfo
+	for page := 1; ; page++ {
+		var commits []struct {
+			ID         string    `json:"id"`
+			Message    string    `json:"message"`
+			AuthorName string    `json:"author_name"`
+			CreatedAt  time.Time `json:"created_at"`
+		}
+		query := url.Values{
+			"ref_name": {g.branch},
+			"path":     {path},
+			"page":     {fmt.Sprint(page)},
+			"per_page": {fmt.Sprint(pageSize)},
+		}
+		if err := g.do(context.Background(), http.MethodGet, g.projectPath("/repository/commits"), query, nil, &commits); err != nil {
+			return nil, fmt.Errorf("failed to list commits for %s: %w", path, err)
+		}
+
+		for _, commit := range commits {
+			result = append(result, CommitInfo{
+				SHA:     commit.ID,
+				Author:  commit.AuthorName,
+				Message: commit.Message,
+				Created: commit.CreatedAt,
+			})
+			if limit > 0 && len(result) >= limit {
+				return result, nil
+			}
+		}
+
+		if len(commits) < pageSize {
+			return result, nil
+		}
+	}
+}
+
+// recordCommit appends a commit made through this client to the audit log, if configured.
+func (g *GitLabClient) recordCommit(ctx context.Context, action, path, sha, message string) {
+	recordCommit(ctx, g.audit, g.owner+"/"+g.repo, action, path, sha, message)
+}
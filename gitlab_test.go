@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeGitLab implements the subset of the GitLab API used by GitLabClient.
+type fakeGitLab struct {
+	mu         sync.Mutex
+	files      map[string][]byte
+	lastCommit map[string]string
+	commits    int
+}
+
+func (f *fakeGitLab) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.Header.Get("PRIVATE-TOKEN") != "test-token" {
+		writeDevJSON(w, http.StatusUnauthorized, map[string]string{"message": "401 Unauthorized"})
+		return
+	}
+
+	rest, ok := strings.CutPrefix(r.URL.EscapedPath(), "/api/v4/projects/infra%2Fplatform%2Ftf-state")
+	if !ok {
+		writeDevJSON(w, http.StatusNotFound, map[string]string{"message": "404 Project Not Found"})
+		return
+	}
+
+	switch {
+	case rest == "":
+		writeDevJSON(w, http.StatusOK, map[string]any{"statistics": map[string]any{"repository_size": 4096}})
+	case strings.HasPrefix(rest, "/repository/files/"):
+		path, _ := url.PathUnescape(strings.TrimPrefix(rest, "/repository/files/"))
+		content, exists := f.files[path]
+		if !exists {
+			writeDevJSON(w, http.StatusNotFound, map[string]string{"message": "404 File Not Found"})
+			return
+		}
+		writeDevJSON(w, http.StatusOK, map[string]string{
+			"content":        base64.StdEncoding.EncodeToString(content),
+			"last_commit_id": f.lastCommit[path],
+		})
+	case rest == "/repository/commits" && r.Method == http.MethodPost:
+		f.handleCommit(w, r)
+	case rest == "/repository/tree":
+		var entries []map[string]string
+		for path := range f.files {
+			entries = append(entries, map[string]string{"path": path, "type": "blob"})
+		}
+		writeDevJSON(w, http.StatusOK, entries)
+	case rest == "/repository/commits":
+		var commits []map[string]any
+		for path, id := range f.lastCommit {
+			if strings.HasPrefix(path, r.URL.Query().Get("path")) {
+				commits = append(commits, map[string]any{"id": id, "message": "update", "author_name": "bot", "created_at": "2024-01-01T00:00:00Z"})
+			}
+		}
+		writeDevJSON(w, http.StatusOK, commits)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakeGitLab) handleCommit(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Actions []gitlabAction `json:"actions"`
+	}
+	_ = json.NewDecoder(r.Body).Decode(&req)
+
+	f.commits++
+	id := gitBlobSHA([]byte{byte(f.commits)})
+	for _, action := range req.Actions {
+		_, exists := f.files[action.FilePath]
+		switch {
+		case action.Action == "create" && exists:
+			writeDevJSON(w, http.StatusBadRequest, map[string]string{"message": "A file with this name already exists"})
+			return
+		case action.Action != "create" && action.LastCommitID != f.lastCommit[action.FilePath]:
+			writeDevJSON(w, http.StatusBadRequest, map[string]string{"message": "You are attempting to update a file that has changed since you started editing it."})
+			return
+		case action.Action == "delete":
+			delete(f.files, action.FilePath)
+			delete(f.lastCommit, action.FilePath)
+		default:
+			content, _ := base64.StdEncoding.DecodeString(action.Content)
+			f.files[action.FilePath] = content
+			f.lastCommit[action.FilePath] = id
+		}
+	}
+	writeDevJSON(w, http.StatusCreated, map[string]string{"id": id})
+}
+
+func newTestGitLabClient(t *testing.T) *GitLabClient {
+	t.Helper()
+
+	server := httptest.NewServer(&fakeGitLab{files: make(map[string][]byte), lastCommit: make(map[string]string)})
+	t.Cleanup(server.Close)
+
+	client, err := NewGitLabClient(&Config{
+		GiteaURL:    server.URL,
+		GiteaToken:  "test-token",
+		GiteaOwner:  "infra/platform",
+		GiteaRepo:   "tf-state",
+		GiteaBranch: "main",
+	})
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	return client
+}
+
+func TestGitLabClient_FileLifecycle(t *testing.T) {
+	client := newTestGitLabClient(t)
+	path := "states/myproject/terraform.tfstate"
+
+	content, _, err := client.GetFile(context.Background(), path)
+	if err != nil || content != nil {
+		t.Fatalf("expected missing file, got %q, %v", content, err)
+	}
+
+	if err := client.CreateOrUpdateFile(context.Background(), path, []byte(`{"serial":1}`), "create"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := client.CreateOrUpdateFile(context.Background(), path, []byte(`{"serial":2}`), "update"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := client.CreateFile(context.Background(), path, []byte(`{}`), "create"); !errors.Is(err, ErrFileAlreadyExists) {
+		t.Errorf("expected ErrFileAlreadyExists, got %v", err)
+	}
+
+	content, sha, err := client.GetFile(context.Background(), path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(content) != `{"serial":2}` {
+		t.Errorf("expected updated content, got %s", content)
+	}
+	if err := client.UpdateFile(context.Background(), path, []byte(`{}`), "stale", "update"); !errors.Is(err, ErrFileChanged) {
+		t.Errorf("expected ErrFileChanged for a stale commit ID, got %v", err)
+	}
+
+	paths, err := client.ListFiles("states/")
+	if err != nil || len(paths) != 1 || paths[0] != path {
+		t.Errorf("expected [%s], got %v (%v)", path, paths, err)
+	}
+
+	modified, err := client.LastCommitTime(path)
+	if err != nil || modified.IsZero() {
+		t.Errorf("expected last commit time, got %v (%v)", modified, err)
+	}
+
+	if err := client.DeleteFile(context.Background(), path, sha, "delete"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if content, _, _ := client.GetFile(context.Background(), path); content != nil {
+		t.Error("expected file to be deleted")
+	}
+}
+
+func TestGitLabClient_RepoSize(t *testing.T) {
+	client := newTestGitLabClient(t)
+
+	size, err := client.RepoSize()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if size != 4096 {
+		t.Errorf("expected size 4096, got %d", size)
+	}
+}
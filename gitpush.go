@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	gitssh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
+)
+
+// Gitea write modes selectable with GITEA_WRITE_MODE.
+const (
+	WriteModeAPI = "api"
+	WriteModeGit = "git"
+	WriteModePR  = "pr"
+)
+
+// gitRemote is the repository a LocalGitClient mirrors. Before each operation
+// the branch is fetched, and commits are pushed instead of only being stored
+// locally.
+type gitRemote struct {
+	url  string
+	auth transport.AuthMethod
+}
+
+// GitPushClient stores states in a Gitea repository through a local shallow
+// clone: files are read from the clone and changes are committed locally and
+// pushed over HTTPS or SSH. This takes one fetch and one push per write instead
+// of several contents API calls, and is not subject to API rate limits.
+// History and repository metadata, which a shallow clone lacks, still come
+// from the API.
+type GitPushClient struct {
+	*LocalGitClient
+	api *GiteaClient
+}
+
+// NewGitPushClient creates a client pushing to the repository configured in cfg.
+func NewGitPushClient(cfg *Config) (*GitPushClient, error) {
+	api, err := NewGiteaClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	url := cfg.GiteaGitURL
+	if url == "" {
+		url = fmt.Sprintf("%s/%s/%s.git", strings.TrimSuffix(cfg.GiteaURL, "/"), cfg.GiteaOwner, cfg.GiteaRepo)
+	}
+	auth, err := gitAuth(url, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := cfg.GiteaCloneDir
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), "gitea-tf-backend", cfg.GiteaOwner, cfg.GiteaRepo+".git")
+	}
+	if err := os.MkdirAll(filepath.Dir(dir), 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create clone directory: %w", err)
+	}
+
+	return &GitPushClient{
+		LocalGitClient: &LocalGitClient{
+			path:   dir,
+			name:   cfg.GiteaOwner + "/" + cfg.GiteaRepo,
+			branch: cfg.GiteaBranch,
+			remote: &gitRemote{url: url, auth: auth},
+			mu:     &sync.Mutex{},
+		},
+		api: api,
+	}, nil
+}
+
+// gitAuth returns the credentials for pushing to url: the token or password
+// over HTTPS, or the key file over SSH.
+func gitAuth(url string, cfg *Config) (transport.AuthMethod, error) {
+	endpoint, err := transport.NewEndpoint(url)
+	if err != nil {
+		return nil, fmt.Errorf("invalid git URL %s: %w", url, err)
+	}
+
+	switch endpoint.Protocol {
+	case "http", "https":
+		if cfg.GiteaToken == "" && cfg.GiteaUsername != "" {
+			if cfg.GiteaTOTPSecret != nil {
+				return nil, fmt.Errorf("pushing over HTTPS with two-factor authentication requires GITEA_TOKEN or an SSH URL")
+			}
+			return &githttp.BasicAuth{Username: cfg.GiteaUsername, Password: cfg.GiteaPassword}, nil
+		}
+		// Gitea accepts a token as the username with an empty password
+		return &githttp.BasicAuth{Username: cfg.GiteaToken}, nil
+	case "ssh":
+		if cfg.GiteaSSHKeyFile == "" {
+			return nil, fmt.Errorf("GITEA_SSH_KEY_FILE is required to push over SSH")
+		}
+		user := endpoint.User
+		if user == "" {
+			user = "git"
+		}
+		auth, err := gitssh.NewPublicKeysFromFile(user, cfg.GiteaSSHKeyFile, "")
+		if err != nil {
+			return nil, fmt.Errorf("failed to load SSH key: %w", err)
+		}
+		return auth, nil
+	case "file":
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unsupported git URL scheme %q", endpoint.Protocol)
+	}
+}
+
+// WithRepo returns an API client for another repository of the same owner.
+func (g *GitPushClient) WithRepo(repo string) Repository {
+	return g.api.WithRepo(repo)
+}
+
+// SetAuditLog records every commit made through this client in audit.
+func (g *GitPushClient) SetAuditLog(audit *AuditLog) {
+	g.LocalGitClient.SetAuditLog(audit)
+	g.api.SetAuditLog(audit)
+}
+
+// RepoSize returns the size of the repository as reported by Gitea.
+func (g *GitPushClient) RepoSize() (int64, error) {
+	return g.api.RepoSize()
+}
+
+// RepoTopics returns the topics of the repository.
+func (g *GitPushClient) RepoTopics(ctx context.Context) ([]string, error) {
+	return g.api.RepoTopics(ctx)
+}
+
+// AddRepoTopic adds a topic to the repository, keeping its other topics.
+func (g *GitPushClient) AddRepoTopic(ctx context.Context, topic string) error {
+	return g.api.AddRepoTopic(ctx, topic)
+}
+
+// Ping verifies that the repository is reachable.
+func (g *GitPushClient) Ping() error {
+	return g.api.Ping()
+}
+
+// LastCommitTime returns the time of the most recent commit touching path.
+func (g *GitPushClient) LastCommitTime(path string) (time.Time, error) {
+	return g.api.LastCommitTime(path)
+}
+
+// ListCommits returns commits touching path, newest first.
+func (g *GitPushClient) ListCommits(path string, limit int) ([]CommitInfo, error) {
+	return g.api.ListCommits(path, limit)
+}
+
+// cloneRemote creates the local clone. An empty remote yields an empty
+// repository with the remote configured, ready for the first push.
+func (g *LocalGitClient) cloneRemote(ctx context.Context) (*git.Repository, error) {
+	repo, err := git.PlainCloneContext(ctx, g.path, true, &git.CloneOptions{
+		URL:           g.remote.url,
+		Auth:          g.remote.auth,
+		ReferenceName: g.branchRef(),
+		SingleBranch:  true,
+		Depth:         1,
+	})
+	if err == nil {
+		return repo, nil
+	}
+	// Leave no partial clone behind
+	_ = os.RemoveAll(g.path)
+	if !errors.Is(err, transport.ErrEmptyRemoteRepository) && !isMissingRef(err) {
+		return nil, err
+	}
+
+	if repo, err = git.PlainInit(g.path, true); err != nil {
+		return nil, err
+	}
+	_, err = repo.CreateRemote(&config.RemoteConfig{Name: git.DefaultRemoteName, URLs: []string{g.remote.url}})
+	return repo, err
+}
+
+// fetch updates the local branch to the remote's. A branch missing on the
+// remote is removed locally. Must be called with g.mu held.
+func (g *LocalGitClient) fetch(ctx context.Context, repo *git.Repository) error {
+	refSpec := config.RefSpec(fmt.Sprintf("+%s:%s", g.branchRef(), g.branchRef()))
+	err := repo.FetchContext(ctx, &git.FetchOptions{
+		RemoteName: git.DefaultRemoteName,
+		RefSpecs:   []config.RefSpec{refSpec},
+		Auth:       g.remote.auth,
+		Depth:      1,
+	})
+	switch {
+	case err == nil, errors.Is(err, git.NoErrAlreadyUpToDate):
+		return nil
+	case errors.Is(err, transport.ErrEmptyRemoteRepository), isMissingRef(err):
+		if err := repo.Storer.RemoveReference(g.branchRef()); err != nil {
+			return fmt.Errorf("failed to reset branch %s: %w", g.branch, err)
+		}
+		return nil
+	default:
+		return fmt.Errorf("failed to fetch %s: %w", g.remote.url, err)
+	}
+}
+
+// push publishes the local branch, which must extend the remote's. Must be
+// called with g.mu held.
+func (g *LocalGitClient) push(ctx context.Context) error {
+	return g.pushRef(ctx, g.branchRef())
+}
+
+// pushRef publishes a local reference. Must be called with g.mu held.
+func (g *LocalGitClient) pushRef(ctx context.Context, ref plumbing.ReferenceName) error {
+	refSpec := config.RefSpec(fmt.Sprintf("%s:%s", ref, ref))
+	err := g.repo.PushContext(ctx, &git.PushOptions{
+		RemoteName: git.DefaultRemoteName,
+		RefSpecs:   []config.RefSpec{refSpec},
+		Auth:       g.remote.auth,
+	})
+	if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+		return fmt.Errorf("failed to push to %s: %w", g.remote.url, err)
+	}
+	return nil
+}
+
+// isMissingRef reports whether err means the branch does not exist on the remote.
+func isMissingRef(err error) bool {
+	var noMatch git.NoMatchingRefSpecError
+	return errors.As(err, &noMatch) || errors.Is(err, plumbing.ErrReferenceNotFound)
+}
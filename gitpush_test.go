@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+)
+
+// newTestClone returns a client working on its own clone of remote.
+func newTestClone(t *testing.T, remote string) *LocalGitClient {
+	t.Helper()
+	return &LocalGitClient{
+		path:   filepath.Join(t.TempDir(), "clone.git"),
+		name:   "owner/repo",
+		branch: "main",
+		remote: &gitRemote{url: "file://" + remote},
+		mu:     &sync.Mutex{},
+	}
+}
+
+func TestLocalGitClient_PushesToRemote(t *testing.T) {
+	gitBin, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git not installed")
+	}
+	remote := filepath.Join(t.TempDir(), "remote.git")
+	if out, err := exec.Command(gitBin, "init", "--bare", remote).CombinedOutput(); err != nil {
+		t.Fatalf("git init failed: %v\n%s", err, out)
+	}
+	path := "states/myproject/terraform.tfstate"
+
+	// The first write to an empty remote creates the branch
+	first := newTestClone(t, remote)
+	if err := first.CreateOrUpdateFile(context.Background(), path, []byte(`{"serial":1}`), "create"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// A second clone sees it and updates it
+	second := newTestClone(t, remote)
+	content, _, err := second.GetFile(context.Background(), path)
+	if err != nil || string(content) != `{"serial":1}` {
+		t.Fatalf("expected pushed content, got %q (%v)", content, err)
+	}
+	if err := second.CreateOrUpdateFile(context.Background(), path, []byte(`{"serial":2}`), "update"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The first clone fetches the update before writing on top of it
+	content, sha, err := first.GetFile(context.Background(), path)
+	if err != nil || string(content) != `{"serial":2}` {
+		t.Fatalf("expected fetched content, got %q (%v)", content, err)
+	}
+	if err := first.UpdateFile(context.Background(), path, []byte(`{"serial":3}`), sha, "update"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	out, err := exec.Command(gitBin, "--git-dir", remote, "log", "--format=%s", "main").Output()
+	if err != nil {
+		t.Fatalf("git log failed: %v", err)
+	}
+	if log := strings.Fields(string(out)); len(log) != 3 || log[0] != "update" || log[2] != "create" {
+		t.Errorf("expected three commits on the remote, got %v", log)
+	}
+}
+
+func TestGitAuth(t *testing.T) {
+	if _, err := gitAuth("https://gitea.example.com/owner/repo.git", &Config{GiteaToken: "token"}); err != nil {
+		t.Errorf("unexpected error for HTTPS: %v", err)
+	}
+	if _, err := gitAuth("ssh://git@gitea.example.com/owner/repo.git", &Config{GiteaToken: "token"}); err == nil {
+		t.Error("expected error for SSH without a key file")
+	}
+	if _, err := gitAuth("git@gitea.example.com:owner/repo.git", &Config{GiteaSSHKeyFile: filepath.Join(t.TempDir(), "missing")}); err == nil {
+		t.Error("expected error for a missing key file")
+	}
+
+	password := &Config{GiteaUsername: "tf-backend", GiteaPassword: "secret"}
+	auth, err := gitAuth("https://gitea.example.com/owner/repo.git", password)
+	if basic, ok := auth.(*githttp.BasicAuth); err != nil || !ok || basic.Password != "secret" {
+		t.Errorf("expected password authentication over HTTPS, got %v, %v", auth, err)
+	}
+	password.GiteaTOTPSecret = []byte("12345678901234567890")
+	if _, err := gitAuth("https://gitea.example.com/owner/repo.git", password); err == nil {
+		t.Error("expected error for HTTPS with two-factor authentication")
+	}
+}
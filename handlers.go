@@ -1,13 +1,19 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
+	"slices"
 	"strings"
 	"sync"
+	"time"
 )
 
 // LockInfo represents the Terraform lock information structure.
@@ -21,10 +27,11 @@ type LockInfo struct {
 	Path      string `json:"Path"`
 }
 
-// StateStorage defines the interface for state file operations.
+// StateStorage defines the interface for state file operations. The context
+// cancels the operation, e.g. when the client making the request disconnects.
 type StateStorage interface {
-	GetFile(path string) ([]byte, string, error)
-	CreateOrUpdateFile(path string, content []byte, message string) error
+	GetFile(ctx context.Context, path string) ([]byte, string, error)
+	CreateOrUpdateFile(ctx context.Context, path string, content []byte, message string) error
 }
 
 // StateHandler handles Terraform state HTTP requests.
@@ -32,23 +39,86 @@ type StateStorage interface {
 type StateHandler struct {
 	storage     StateStorage
 	maxBodySize int64
+	sizeLimits  []SizeLimit // Per-state overrides of maxBodySize, most specific first
 
-	mu    sync.RWMutex
-	locks map[string]LockInfo // keyed by state name
+	versionLimits []VersionLimit // Versions to keep of the states matching each, most specific first
+
+	sizeWarnPercent int             // Share of the size limit above which writes are warned about; 0 disables
+	sizeWarned      map[string]bool // States whose size warning was announced, guarded by mu
+	fallbackWarned  map[string]bool // Corrupt states whose fallback was announced, guarded by mu
+
+	mu          sync.RWMutex
+	locks       map[string]LockInfo   // keyed by state name
+	lockSources map[string]lockSource // Where each lock was acquired from, keyed by state name
+
+	archiver    *Archiver     // Optional - consulted when a state is not found
+	deleter     *StateDeleter // Optional - enables DELETE
+	replicas    *ReplicaSet   // Optional - serves reads made without a lock
+	requireLock bool          // Reject writes that are not made under a lock
+
+	lockWait time.Duration            // How long LOCK waits for a held lock; 0 fails immediately
+	waiters  map[string][]*lockWaiter // Clients waiting for a lock, in arrival order
+
+	lockMethod   string // HTTP method that acquires a lock (LOCK by default)
+	unlockMethod string // HTTP method that releases a lock (UNLOCK by default)
+
+	allowRawState bool // Store bodies that are not well-formed tfstate as-is
+	routeHints    bool // List the supported operations in 404 and 405 responses
+	lockAuthors   bool // Author commits made under a lock as the lock's holder
+	tagUpdates    bool // Tag the commit of every state update with the state's serial
+	applyChecks   bool // Warn about writes that look like concurrent applies
+	verifyReads   bool // Check states read against their checksum sidecars
+	readFallback  bool // Serve the last valid version of a corrupt state
+
+	steals     map[string]*lockSteal // Pending lock takeovers, keyed by state name
+	pins       map[string]*refPin    // Read-only sessions on states at a ref, keyed by lock ID
+	stealGrace time.Duration         // Time the holder has to object to a takeover
+	notifier   *Notifier             // Optional - receives state and lock events
+	shadow     *Shadow               // Optional - repeats writes against a second storage for comparison
+	index      *StateIndex           // Optional - makes states searchable
+	commits    *CommitWindow         // Optional - lets shutdown wait for commits of protected states
+	runs       *RunLog               // Optional - correlates the requests made under each lock into runs
+	audit      *AuditLog             // Optional - records lock takeovers
+	auditRepo  string                // Repository named in audit entries
+
+	counters  *CounterStore   // Optional - counts updates per state across restarts
+	coalescer *WriteCoalescer // Optional - commits a lock holder's rapid writes together
+	reads     *ReadGroup      // Coalesces concurrent reads of the same state
+	writes    *StateMutex     // Serializes the writes, locks and unlocks of each state
 }
 
 // NewStateHandler creates a new StateHandler with the given storage backend.
 func NewStateHandler(storage StateStorage, maxBodySize int64) *StateHandler {
 	return &StateHandler{
-		storage:     storage,
-		maxBodySize: maxBodySize,
-		locks:       make(map[string]LockInfo),
+		storage:        storage,
+		maxBodySize:    maxBodySize,
+		locks:          make(map[string]LockInfo),
+		lockSources:    make(map[string]lockSource),
+		sizeWarned:     make(map[string]bool),
+		fallbackWarned: make(map[string]bool),
+		waiters:        make(map[string][]*lockWaiter),
+		lockMethod:     "LOCK",
+		unlockMethod:   "UNLOCK",
+		steals:         make(map[string]*lockSteal),
+		pins:           make(map[string]*refPin),
+		stealGrace:     DefaultLockStealGrace,
+		routeHints:     true,
+		lockAuthors:    true,
+		applyChecks:    true,
+		verifyReads:    true,
+		reads:          NewReadGroup(0),
+		writes:         NewStateMutex(),
 	}
 }
 
-// statePath returns the path to the state file for a given state name.
-func statePath(name string) string {
-	return fmt.Sprintf("states/%s/terraform.tfstate", name)
+// checksumPath returns the path to the SHA-256 sidecar of a state file.
+func checksumPath(name string) string {
+	return statePath(name) + ".sha256"
+}
+
+// metadataPath returns the path to the metadata sidecar of a state file.
+func metadataPath(name string) string {
+	return sidecarPath(name, "metadata.json")
 }
 
 // extractStateName extracts the state name from the URL path.
@@ -58,11 +128,77 @@ func extractStateName(path string) string {
 	return name
 }
 
+// stateEndpoint is an endpoint of a state besides the state itself, served
+// at /{name}{suffix}.
+type stateEndpoint struct {
+	suffix  string
+	methods []string
+	serve   func(h *StateHandler, w http.ResponseWriter, r *http.Request, name string)
+}
+
+// stateEndpoints take the paths of states whose names end in their
+// suffixes, so such names are reserved.
+var stateEndpoints = []stateEndpoint{
+	{"/lock/steal", []string{http.MethodPost, http.MethodGet, http.MethodDelete}, (*StateHandler).handleLockSteal},
+	{"/lock/transfer", []string{http.MethodPost}, (*StateHandler).handleLockTransfer},
+	{"/deletion", []string{http.MethodGet, http.MethodDelete}, (*StateHandler).handleDeletion},
+	{"/runs", []string{http.MethodGet}, (*StateHandler).handleRuns},
+	{"/versions", []string{http.MethodGet}, (*StateHandler).handleVersions},
+}
+
+// cutStateEndpoint splits the path of an endpoint in stateEndpoints into the
+// name of its state and the endpoint.
+func cutStateEndpoint(name string) (string, stateEndpoint, bool) {
+	for _, endpoint := range stateEndpoints {
+		if stateName, ok := strings.CutSuffix(name, endpoint.suffix); ok && stateName != "" {
+			return stateName, endpoint, true
+		}
+	}
+	return "", stateEndpoint{}, false
+}
+
+// reservedStateName rejects a write or lock request for a state whose name
+// ends in the suffix of endpoint, which cannot be created.
+func (h *StateHandler) reservedStateName(w http.ResponseWriter, r *http.Request, endpoint stateEndpoint) {
+	h.writeRouteError(w, ErrInvalidRequest, routeError{
+		Error:          fmt.Sprintf("state names cannot end in %s, which is reserved for an endpoint of the state", endpoint.suffix),
+		AllowedMethods: endpoint.methods,
+		Hint:           fmt.Sprintf("%s %s is not a state; choose a state name not ending in %s", r.Method, r.URL.Path, strings.Join(reservedSuffixes(), ", ")),
+	})
+}
+
+// reservedSuffixes returns the suffixes state names cannot end in.
+func reservedSuffixes() []string {
+	suffixes := make([]string, 0, len(stateEndpoints))
+	for _, endpoint := range stateEndpoints {
+		suffixes = append(suffixes, endpoint.suffix)
+	}
+	return suffixes
+}
+
 // ServeHTTP handles all state-related requests.
 func (h *StateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	name := extractStateName(r.URL.Path)
 	if name == "" {
-		http.Error(w, "state name required", http.StatusBadRequest)
+		h.writeRouteError(w, ErrInvalidRequest, routeError{Error: "state name required", Hint: "states are served at /{name}; the API is described at /docs"})
+		return
+	}
+	if strings.HasPrefix(name, "api/") {
+		h.unknownRoute(w, r)
+		return
+	}
+
+	if stateName, endpoint, ok := cutStateEndpoint(name); ok {
+		if !slices.Contains(endpoint.methods, r.Method) && slices.Contains([]string{http.MethodPost, h.lockMethod, h.unlockMethod}, r.Method) {
+			h.reservedStateName(w, r, endpoint)
+			return
+		}
+		endpoint.serve(h, w, r, stateName)
+		return
+	}
+
+	if ref := r.URL.Query().Get("ref"); ref != "" {
+		h.handleRef(w, r, name, ref)
 		return
 	}
 
@@ -71,144 +207,841 @@ func (h *StateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		h.handleGet(w, r, name)
 	case http.MethodPost:
 		h.handlePost(w, r, name)
-	case "LOCK":
+	case h.lockMethod:
 		h.handleLock(w, r, name)
-	case "UNLOCK":
+	case h.unlockMethod:
 		h.handleUnlock(w, r, name)
+	case http.MethodDelete:
+		// Unreachable when DELETE is configured as the unlock method
+		h.handleDelete(w, r, name)
+	default:
+		h.methodNotAllowed(w, r, h.stateMethods()...)
+	}
+}
+
+// statusClientClosedRequest records requests the client abandoned before a
+// response was sent, following nginx's convention. It is never seen by clients.
+const statusClientClosedRequest = 499
+
+// requestCancelled reports whether the client disconnected before the request
+// was handled.
+func requestCancelled(r *http.Request) bool {
+	return errors.Is(r.Context().Err(), context.Canceled)
+}
+
+// cancelledByClient handles a failed request whose client has disconnected:
+// the failure is logged as a cancellation rather than an error, and recorded
+// with status 499 so it does not show up as a server error. Returns false if
+// the client is still connected.
+func cancelledByClient(w http.ResponseWriter, r *http.Request, err error) bool {
+	if !requestCancelled(r) {
+		return false
+	}
+	if err != nil {
+		slog.Info("Request cancelled by client", "method", r.Method, "path", r.URL.Path, "error", err)
+	} else {
+		slog.Info("Request cancelled by client", "method", r.Method, "path", r.URL.Path)
+	}
+	w.WriteHeader(statusClientClosedRequest)
+	return true
+}
+
+// readBody reads the request body up to the size limit for the named state.
+// On failure it writes the error response and returns false; oversized bodies
+// get 413 with the applicable limit in the response. Bodies sent with
+// Content-Encoding: gzip are decompressed, and the limit applies to their
+// decompressed size.
+func (h *StateHandler) readBody(w http.ResponseWriter, r *http.Request, name, kind string) ([]byte, bool) {
+	body, ok := h.openBody(w, r, name, kind)
+	if !ok {
+		return nil, false
+	}
+	return body.readAll(w, r, name, kind)
+}
+
+// requestBody is a request body as it is read: decompressed, limited in size
+// and hashed for its digests.
+type requestBody struct {
+	io.Reader
+	size       int64 // The size expected, or -1
+	compressed bool
+	pattern    string // The BODY_SIZE_LIMITS pattern the size limit is from, if any
+	digests    []*bodyDigest
+}
+
+// openBody prepares the request body for reading up to the size limit for
+// the named state, as readBody does. On failure it writes the error response
+// and returns false.
+func (h *StateHandler) openBody(w http.ResponseWriter, r *http.Request, name, kind string) (*requestBody, bool) {
+	limit, pattern := h.bodyLimit(name)
+	// Checksums cover the body as sent, before decompression
+	digests, err := bodyDigests(r)
+	if err != nil {
+		writeError(w, err)
+		return nil, false
+	}
+	if len(digests) > 0 {
+		r.Body = digestReader(r.Body, digests)
+	}
+	compressed := false
+	switch encoding := strings.ToLower(r.Header.Get("Content-Encoding")); encoding {
+	case "", "identity":
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+	case "gzip", "x-gzip":
+		gz, err := gzip.NewReader(http.MaxBytesReader(w, r.Body, limit))
+		if err != nil {
+			slog.Warn("Error decompressing body", "state", name, "body", kind, "error", err)
+			writeError(w, fmt.Errorf("%w: body is not valid gzip", ErrInvalidRequest))
+			return nil, false
+		}
+		r.Body = http.MaxBytesReader(w, gz, limit)
+		compressed = true
 	default:
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, fmt.Errorf("%w: %s; send the body uncompressed or with gzip", ErrUnsupportedEncoding, encoding))
+		return nil, false
+	}
+	size := r.ContentLength
+	if compressed || size > limit {
+		size = -1
+	}
+	return &requestBody{Reader: r.Body, size: size, compressed: compressed, pattern: pattern, digests: digests}, true
+}
+
+// readAll reads the body to the end and checks it against its digests. On
+// failure it writes the error response and returns false.
+func (b *requestBody) readAll(w http.ResponseWriter, r *http.Request, name, kind string) ([]byte, bool) {
+	body, err := readAllSized(b, b.size)
+	if err != nil {
+		b.failed(w, r, name, kind, err)
+		return nil, false
+	}
+	if err := verifyDigests(b.digests); err != nil {
+		slog.Warn("Rejected body", "state", name, "body", kind, "error", err)
+		writeError(w, err)
+		return nil, false
+	}
+	return body, true
+}
+
+// failed answers a request whose body could not be read.
+func (b *requestBody) failed(w http.ResponseWriter, r *http.Request, name, kind string, err error) {
+	if b.compressed && (errors.Is(err, gzip.ErrChecksum) || errors.Is(err, gzip.ErrHeader) || errors.Is(err, io.ErrUnexpectedEOF)) && !requestCancelled(r) {
+		slog.Warn("Error decompressing body", "state", name, "body", kind, "error", err)
+		writeError(w, fmt.Errorf("%w: body is not valid gzip", ErrInvalidRequest))
+		return
+	}
+
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		slog.Warn("Rejected body exceeding the size limit", "state", name, "body", kind, "limit", tooLarge.Limit)
+		err := fmt.Errorf("%w: it exceeds the limit of %d bytes; raise MAX_BODY_SIZE_MB to accept it", ErrBodyTooLarge, tooLarge.Limit)
+		fields := map[string]any{"max_body_bytes": tooLarge.Limit}
+		if b.pattern != "" {
+			err = fmt.Errorf("%w: it exceeds the limit of %d bytes for %s; raise it in BODY_SIZE_LIMITS to accept it", ErrBodyTooLarge, tooLarge.Limit, b.pattern)
+			fields["limit_pattern"] = b.pattern
+		}
+		writeErrorFields(w, err, fields)
+		return
 	}
+
+	if cancelledByClient(w, r, err) {
+		return
+	}
+	slog.Error("Error reading body", "state", name, "body", kind, "error", err)
+	writeError(w, fmt.Errorf("%w: failed to read request body", ErrInvalidRequest))
+}
+
+// IsLocked reports whether the named state is currently locked.
+func (h *StateHandler) IsLocked(name string) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	_, locked := h.locks[name]
+	return locked
+}
+
+// replicaReadable reports whether the named state may be read from a replica.
+// Replicas may lag behind, so reads under a lock that precedes a write use the
+// primary. Plans may use a replica: applying a plan made from stale state fails
+// Terraform's own staleness check.
+func (h *StateHandler) replicaReadable(name string) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	lock, locked := h.locks[name]
+	return !locked || lock.Operation == "OperationTypePlan"
 }
 
 // handleGet retrieves the current state.
 func (h *StateHandler) handleGet(w http.ResponseWriter, r *http.Request, name string) {
-	content, _, err := h.storage.GetFile(statePath(name))
+	h.runs.Read(name)
+
+	storage := h.storage
+	if h.replicas != nil && h.replicaReadable(name) {
+		storage = h.replicas.Reader()
+	}
+
+	// Writes waiting to be committed are served as the current state
+	if content, ok := h.coalescer.Content(name); ok {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(content)
+		return
+	}
+
+	content, err := h.reads.Get(r.Context(), storage, name, func(ctx context.Context) ([]byte, error) {
+		return h.readState(ctx, storage, name)
+	})
+	var fallback *CommitInfo
+	if err != nil && h.readFallback && isCorruptState(err) {
+		cause := err
+		content, fallback, err = h.readFallbackVersion(r.Context(), name, cause)
+		if fallback != nil {
+			h.warnFallback(w, name, fallback, cause)
+		}
+	} else if err == nil && h.readFallback {
+		h.clearFallback(name)
+	}
 	if err != nil {
-		log.Printf("Error getting state %s: %v", name, err)
-		http.Error(w, "internal server error", http.StatusInternalServerError)
+		if cancelledByClient(w, r, err) {
+			return
+		}
+		slog.Error("Error getting state", "state", name, "error", err)
+		writeError(w, err)
 		return
 	}
 
 	if content == nil {
-		http.NotFound(w, r)
+		// Refuse to report an archived state as missing, as Terraform would
+		// treat it as empty and plan to recreate everything
+		if h.archiver != nil {
+			archived, err := h.archiver.IsArchived(r.Context(), name)
+			if err != nil {
+				if cancelledByClient(w, r, err) {
+					return
+				}
+				slog.Error("Error checking archive", "state", name, "error", err)
+				writeError(w, err)
+				return
+			}
+			if archived {
+				writeError(w, fmt.Errorf("%w; rehydrate it via POST /admin/rehydrate/%s", ErrStateArchived, name))
+				return
+			}
+		}
+		writeError(w, ErrStateNotFound)
 		return
 	}
 
+	if storage == h.storage && fallback == nil {
+		h.shadow.Read(name, content)
+	}
 	w.Header().Set("Content-Type", "application/json")
 	_, _ = w.Write(content)
 }
 
+// serializeState waits for the requests changing the named state ahead of r
+// to finish, and returns the function letting the next one go ahead. On
+// failure it writes the error response and returns false.
+func (h *StateHandler) serializeState(w http.ResponseWriter, r *http.Request, name string) (func(), bool) {
+	release, err := h.writes.Lock(r.Context(), name)
+	if err != nil {
+		if !cancelledByClient(w, r, err) {
+			writeError(w, err)
+		}
+		return nil, false
+	}
+	return release, true
+}
+
 // handlePost saves the state.
 func (h *StateHandler) handlePost(w http.ResponseWriter, r *http.Request, name string) {
+	// The lock checked is held until the write is committed
+	release, ok := h.serializeState(w, r, name)
+	if !ok {
+		return
+	}
+	defer release()
+
 	// Check if there's a lock and validate the lock ID
 	h.mu.RLock()
 	existingLock, locked := h.locks[name]
+	holder := h.lockSources[name]
 	h.mu.RUnlock()
 
-	if locked {
-		lockID := r.Header.Get("Lock-Id")
+	lockID := r.Header.Get("Lock-Id")
+	if lockID == "" {
+		// Terraform may also send it as a query param
+		lockID = r.URL.Query().Get("ID")
+	}
+
+	if h.requireLock {
 		if lockID == "" {
-			// Terraform may also send it as a query param
-			lockID = r.URL.Query().Get("ID")
+			writeError(w, fmt.Errorf("%w; run terraform with -lock=true", ErrLockRequired))
+			return
 		}
+		if !locked {
+			writeError(w, fmt.Errorf("%w: lock %s is not held; acquire the lock before writing state", ErrLockRequired, lockID))
+			return
+		}
+	}
 
+	if locked {
+		h.checkConcurrentApply(w, r, name, lockID, existingLock, holder)
 		if lockID != existingLock.ID {
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusLocked)
-			_ = json.NewEncoder(w).Encode(existingLock)
+			writeLockError(w, ErrLockConflict, existingLock)
 			return
 		}
 	}
 
-	// Read the state body with size limit
-	r.Body = http.MaxBytesReader(w, r.Body, h.maxBodySize)
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		log.Printf("Error reading body for %s: %v", name, err)
-		http.Error(w, "failed to read request body", http.StatusBadRequest)
+	if p, pending := h.deleter.Pending(name); pending {
+		writeError(w, fmt.Errorf("%w at %s; cancel the deletion with DELETE /%s/deletion", ErrDeletionPending, p.DeleteAt.Format(time.RFC3339), name))
 		return
 	}
 
-	// Prettify the JSON for better readability in git diffs
-	var prettyBody []byte
-	var rawState json.RawMessage
-	if err := json.Unmarshal(body, &rawState); err == nil {
-		prettyBody, _ = json.MarshalIndent(rawState, "", "  ")
+	// A lock holder's writes in quick succession are committed together
+	heldLockID := ""
+	if locked {
+		heldLockID = lockID
+	}
+	body, ok := h.openBody(w, r, name, "state")
+	if !ok {
+		h.runs.Write(name, lockID, nil, false)
+		return
+	}
+	if checksum := uploadChecksum(r); checksum != "" {
+		r = r.WithContext(withUploadChecksum(r.Context(), checksum))
+	}
+
+	var header *stateHeader
+	var size int
+	stream, ok := h.openStream(w, r, name, heldLockID, body)
+	switch {
+	case !ok:
+	case stream != nil:
+		header = stream.header
+		ok = h.writeStream(w, r, name, stream, heldLockID)
+		size = stream.size
+	default:
+		header, size, ok = h.writeBody(w, r, name, body, heldLockID)
+	}
+	if !ok {
+		h.runs.Write(name, lockID, nil, false)
+		return
+	}
+	h.runs.Write(name, lockID, header, true)
+
+	h.counters.Add(stateUpdatesCounter+name, 1)
+	h.warnSize(w, name, int64(size))
+
+	if h.notifier != nil {
+		data := map[string]any{"lock_id": lockID}
+		if header != nil {
+			data["serial"] = header.Serial
+			data["lineage"] = header.Lineage
+			data["terraform_version"] = header.TerraformVersion
+		}
+		h.notifier.Notify(EventStateUpdated, name, fmt.Sprintf("State %s was updated.", name), data)
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// writeBody reads, checks and commits a state write, or spools it to be
+// committed with the lock holder's next write. It returns the state's header
+// and size. On failure it writes the error response and returns false.
+func (h *StateHandler) writeBody(w http.ResponseWriter, r *http.Request, name string, body *requestBody, heldLockID string) (*stateHeader, int, bool) {
+	content, ok := body.readAll(w, r, name, "state")
+	if !ok {
+		return nil, 0, false
+	}
+
+	start := time.Now()
+	var header *stateHeader
+	if h.allowRawState {
+		header, _ = parseStateHeader(content)
+	} else {
+		var err error
+		if header, err = validateState(content); err != nil {
+			writeError(w, fmt.Errorf("%w: %v", ErrInvalidState, err))
+			return nil, 0, false
+		}
+	}
+	ObserveProcessingTime("json", start)
+
+	if h.coalescer.Defers(name, heldLockID) && r.URL.Query().Get("force") != "true" {
+		// The write is acknowledged before it is committed, so it is
+		// checked against the latest state now
+		if err := h.checkSpooledSerial(r.Context(), name, header); err != nil {
+			if errors.Is(err, ErrSerialRegression) {
+				writeError(w, fmt.Errorf("%w; retry with ?force=true to override", err))
+				return nil, 0, false
+			}
+			slog.Error("Error reading current state", "state", name, "error", err)
+			writeError(w, err)
+			return nil, 0, false
+		}
+	}
+	deferred, err := h.coalescer.Defer(name, heldLockID, content)
+	if err != nil {
+		slog.Error("Error deferring write", "state", name, "error", err)
+		writeError(w, err)
+		return nil, 0, false
+	}
+	if !deferred && !h.writeState(w, r, name, content, header, heldLockID) {
+		return nil, 0, false
+	}
+	return header, len(content), true
+}
+
+// writeState commits a state write. On failure it writes the error response
+// and returns false.
+func (h *StateHandler) writeState(w http.ResponseWriter, r *http.Request, name string, body []byte, header *stateHeader, lockID string) bool {
+	current, ok := h.prepareWrite(w, r, name, header)
+	if !ok {
+		return false
 	}
-	if prettyBody == nil {
-		// Fall back to original if prettification fails
-		prettyBody = body
+
+	// Prettify the JSON for better readability in git diffs
+	start := time.Now()
+	prettyBody := indentState(body)
+	ObserveProcessingTime("json", start)
+
+	// Terraform reports a write it abandoned as failed, so don't make it
+	if cancelledByClient(w, r, nil) {
+		return false
 	}
 
 	// Save the state
-	err = h.storage.CreateOrUpdateFile(statePath(name), prettyBody, fmt.Sprintf("Update state: %s", name))
+	if err := h.saveState(r.Context(), name, prettyBody, header, lockID, current); err != nil {
+		saveFailed(w, r, name, err)
+		return false
+	}
+	h.coalescer.Committed(name, lockID)
+	return true
+}
+
+// openStream starts streaming the state in body to storage if the write can
+// be: the storage commits streams, nothing needs the whole state at once, and
+// the state's header is at its beginning. Otherwise it returns nil, with the
+// body left to be read whole. On failure it writes the error response and
+// returns false.
+func (h *StateHandler) openStream(w http.ResponseWriter, r *http.Request, name, heldLockID string, body *requestBody) (*stateStream, bool) {
+	committer, ok := h.storage.(StreamCommitter)
+	if !ok || !committer.StreamsFiles() || h.allowRawState || stateCompression != "" || stateChunkSize > 0 ||
+		h.shadow != nil || h.index != nil || h.coalescer.Defers(name, heldLockID) {
+		return nil, true
+	}
+	start := time.Now()
+	stream, err := openStateStream(body, committer)
+	if err != nil {
+		body.failed(w, r, name, "state", err)
+		return nil, false
+	}
+	ObserveProcessingDuration("json", time.Since(start)-stream.read.spent)
+	if stream.header == nil {
+		body.Reader = stream.unread()
+		return nil, true
+	}
+	return stream, true
+}
+
+// writeStream commits a state write streamed from the request body. On
+// failure it writes the error response and returns false.
+func (h *StateHandler) writeStream(w http.ResponseWriter, r *http.Request, name string, stream *stateStream, lockID string) bool {
+	current, ok := h.prepareWrite(w, r, name, stream.header)
+	if !ok {
+		return false
+	}
+	_, _, err := h.commitState(r.Context(), name, stream.header, lockID, func(ctx context.Context, message string) error {
+		return stream.committer.CommitFiles(ctx, message, stream.changes(name, lockID, current))
+	})
+	// The body must no longer be read once the request has been answered
+	stream.wait()
+	if stream.failed(w, r, name) {
+		return false
+	}
+	if err != nil {
+		saveFailed(w, r, name, err)
+		return false
+	}
+	h.coalescer.Committed(name, lockID)
+	return true
+}
+
+// prepareWrite commits a write spooled before this one, and checks the write
+// against the stored state, whose version it returns. On failure it writes
+// the error response and returns false.
+func (h *StateHandler) prepareWrite(w http.ResponseWriter, r *http.Request, name string, header *stateHeader) (*storedState, bool) {
+	// A write spooled under an earlier lock goes first
+	if err := h.coalescer.Flush(r.Context(), name); err != nil {
+		slog.Error("Error committing spooled write", "state", name, "error", err)
+		writeError(w, err)
+		return nil, false
+	}
+
+	// Read the stored state's version, so the write fails if the state is
+	// changed underneath us, e.g. by an out-of-band edit. Unless forced, also
+	// refuse to move the serial backwards, e.g. a stale CI runner pushing old state.
+	incoming := header
+	if r.URL.Query().Get("force") == "true" {
+		incoming = nil
+	}
+	current, err := h.checkSerialRegression(r.Context(), name, incoming)
 	if err != nil {
-		log.Printf("Error saving state %s: %v", name, err)
-		http.Error(w, "failed to save state", http.StatusInternalServerError)
+		if errors.Is(err, ErrSerialRegression) {
+			writeError(w, fmt.Errorf("%w; retry with ?force=true to override", err))
+			return nil, false
+		}
+		if cancelledByClient(w, r, err) {
+			return nil, false
+		}
+		slog.Error("Error reading current state", "state", name, "error", err)
+		writeError(w, err)
+		return nil, false
+	}
+	return current, true
+}
+
+// saveFailed answers a write whose commit failed.
+func saveFailed(w http.ResponseWriter, r *http.Request, name string, err error) {
+	if errors.Is(err, ErrFileChanged) || errors.Is(err, ErrFileAlreadyExists) {
+		slog.Warn("State changed while it was being saved", "state", name, "error", err)
+		writeError(w, fmt.Errorf("%w; refresh and retry", ErrConcurrentUpdate))
+		return
+	}
+	if cancelledByClient(w, r, err) {
 		return
 	}
+	slog.Error("Error saving state", "state", name, "error", err)
+	writeError(w, err)
+}
 
-	w.WriteHeader(http.StatusOK)
+// checkSpooledSerial refuses a write about to be spooled whose serial is
+// behind the state's latest content, the write spooled before it or else the
+// stored state.
+func (h *StateHandler) checkSpooledSerial(ctx context.Context, name string, incoming *stateHeader) error {
+	if incoming == nil || incoming.Serial == nil {
+		return nil
+	}
+	content, ok := h.coalescer.Content(name)
+	if !ok {
+		var err error
+		if content, _, err = loadState(ctx, h.storage, name); err != nil {
+			return err
+		}
+	}
+	current, err := parseStateHeader(content)
+	if content == nil || err != nil {
+		return nil
+	}
+	if err := checkSerial(current, incoming); err != nil {
+		return fmt.Errorf("%w: %v", ErrSerialRegression, err)
+	}
+	return nil
+}
+
+// commitSpooled commits a write spooled by the coalescer. Its serial was
+// checked when it was spooled; the state changing since is caught by the
+// stored version.
+func (h *StateHandler) commitSpooled(ctx context.Context, name, lockID string, content []byte) error {
+	current, err := h.checkSerialRegression(ctx, name, nil)
+	if err != nil {
+		return err
+	}
+	header, _ := parseStateHeader(content)
+	return h.saveState(ctx, name, content, header, lockID, current)
+}
+
+// storedState identifies the stored version of a state, or its absence.
+type storedState struct {
+	exists bool
+	sha    string
+	chunks int // Chunks the state file is split into, 0 if it is not
+}
+
+// loadState reads the named state from storage, reassembled from its chunks
+// and decompressed, with the version of its state file. A missing state is nil.
+func loadState(ctx context.Context, storage StateStorage, name string) ([]byte, *storedState, error) {
+	stored, sha, err := storage.GetFile(ctx, statePath(name))
+	if err != nil {
+		return nil, nil, err
+	}
+	if stored == nil {
+		return nil, &storedState{}, nil
+	}
+	stored, chunks, err := joinChunks(ctx, storage, name, stored)
+	if err != nil {
+		return nil, nil, err
+	}
+	content, err := decodeState(stored)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", errCorruptState, err)
+	}
+	return content, &storedState{exists: true, sha: sha, chunks: chunks}, nil
+}
+
+// checkSerialRegression compares the incoming state's serial with the stored state,
+// and returns the stored state's version. The check is skipped if incoming is
+// nil or has no serial.
+func (h *StateHandler) checkSerialRegression(ctx context.Context, name string, incoming *stateHeader) (*storedState, error) {
+	content, stored, err := loadState(ctx, h.storage, name)
+	if err != nil || content == nil {
+		return stored, err
+	}
+
+	if incoming == nil || incoming.Serial == nil {
+		return stored, nil
+	}
+	current, err := parseStateHeader(content)
+	if err != nil {
+		return stored, nil
+	}
+	if err := checkSerial(current, incoming); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrSerialRegression, err)
+	}
+	return stored, nil
+}
+
+// shaStorage is implemented by storages that write against a known file SHA.
+type shaStorage interface {
+	CreateFile(ctx context.Context, path string, content []byte, message string) error
+	UpdateFile(ctx context.Context, path string, content []byte, sha string, message string) error
+}
+
+// stateMetadata is stored next to each state for tooling that should not
+// have to parse the state itself.
+type stateMetadata struct {
+	Serial           *uint64   `json:"serial,omitempty"`
+	Lineage          string    `json:"lineage,omitempty"`
+	TerraformVersion string    `json:"terraform_version,omitempty"`
+	LockID           string    `json:"lock_id,omitempty"`
+	Size             int       `json:"size"`
+	Compression      string    `json:"compression,omitempty"` // Format the state file is compressed with
+	Updated          time.Time `json:"updated"`
+}
+
+// saveState writes the state against its stored version, failing with
+// ErrFileChanged or ErrFileAlreadyExists if that is no longer current.
+// Storages supporting multi-file commits get the state, its checksum sidecar
+// and metadata in one atomic commit. Otherwise only the state is written.
+// Writes made under a lock are authored by the lock's holder, unless
+// COMMIT_AUTHOR_FROM_LOCK is disabled.
+func (h *StateHandler) saveState(ctx context.Context, name string, content []byte, header *stateHeader, lockID string, current *storedState) error {
+	message, author, err := h.commitState(ctx, name, header, lockID, func(ctx context.Context, message string) error {
+		return saveStateTo(ctx, h.storage, name, content, header, lockID, current, message)
+	})
+	if err != nil {
+		return err
+	}
+	h.shadow.Write(name, content, header, lockID, message, author)
+	h.index.Update(name, content)
+	return nil
+}
+
+// commitState makes the commit of a state write with save, given the commit
+// message, and returns the message and the commit's author, if not the
+// backend's own.
+func (h *StateHandler) commitState(ctx context.Context, name string, header *stateHeader, lockID string, save func(ctx context.Context, message string) error) (string, *commitAuthor, error) {
+	data := commitMessageData{Name: name, Operation: OpUpdate, LockID: lockID, Default: fmt.Sprintf("Update state: %s", name)}
+	if lockID != "" {
+		h.mu.RLock()
+		if lock, ok := h.locks[name]; ok && lock.ID == lockID {
+			data.LockHolder = lock.Who
+		}
+		h.mu.RUnlock()
+	}
+	if header != nil {
+		data.TerraformVersion = header.TerraformVersion
+		if header.Serial != nil {
+			data.Serial = *header.Serial
+		}
+	}
+	if checksum := uploadChecksumFrom(ctx); checksum != "" {
+		data.UploadChecksum = checksum
+		data.Default += "\n\nUpload-Checksum: " + checksum
+	}
+	message := commitMessage(data)
+
+	var author *commitAuthor
+	if a, ok := lockAuthor(data.LockHolder); ok && h.lockAuthors {
+		author = &a
+		ctx = withCommitAuthor(ctx, a)
+	}
+	ctx, commit := withCommitCapture(ctx)
+	exit := h.commits.Enter(name)
+	err := save(ctx, message)
+	exit()
+	h.reads.Forget(name)
+	if err != nil {
+		return "", nil, err
+	}
+	h.tagUpdate(ctx, name, header, *commit)
+	return message, author, nil
+}
+
+// saveStateTo saves a state to storage, replacing the stored version current.
+func saveStateTo(ctx context.Context, storage StateStorage, name string, content []byte, header *stateHeader, lockID string, current *storedState, message string) error {
+	path := statePath(name)
+	if committer, ok := storage.(FileCommitter); ok {
+		changes, err := stateChanges(name, content, header, lockID, current)
+		if err != nil {
+			return err
+		}
+		return committer.CommitFiles(ctx, message, changes)
+	}
+
+	content, err := encodeState(content)
+	if err != nil {
+		return err
+	}
+	shaStore, ok := storage.(shaStorage)
+	switch {
+	case !ok:
+		return storage.CreateOrUpdateFile(ctx, path, content, message)
+	case current.exists:
+		return shaStore.UpdateFile(ctx, path, content, current.sha, message)
+	default:
+		return shaStore.CreateFile(ctx, path, content, message)
+	}
+}
+
+// stateChanges returns the file changes that save a state with its checksum
+// and metadata sidecars, split into chunks if it is large. The checksum and
+// size are those of the state Terraform reads, even when the file is stored
+// compressed.
+func stateChanges(name string, content []byte, header *stateHeader, lockID string, current *storedState) ([]FileChange, error) {
+	stored, err := encodeState(content)
+	if err != nil {
+		return nil, err
+	}
+	metadata := stateMetadata{LockID: lockID, Size: len(content), Compression: stateCompression, Updated: time.Now().UTC()}
+	if header != nil {
+		metadata.Serial = header.Serial
+		metadata.Lineage = header.Lineage
+		metadata.TerraformVersion = header.TerraformVersion
+	}
+	metadataJSON, err := json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	changes, err := chunkChanges(name, stored, current)
+	if err != nil {
+		return nil, err
+	}
+	return append(changes,
+		FileChange{Path: checksumPath(name), Content: []byte(stateChecksum(content) + "  terraform.tfstate\n")},
+		FileChange{Path: metadataPath(name), Content: metadataJSON},
+	), nil
+}
+
+// indentState prettifies a JSON document with two-space indentation. The input
+// is returned unchanged if it is not valid JSON.
+func indentState(body []byte) []byte {
+	trimmed := bytes.TrimRight(body, " \t\r\n")
+	indented, err := pooledBytes(func(b *bytes.Buffer) error {
+		b.Grow(len(trimmed) + len(trimmed)/2)
+		return json.Indent(b, trimmed, "", "  ")
+	})
+	if err != nil {
+		return body
+	}
+	return indented
 }
 
 // handleLock acquires a lock for the state.
 func (h *StateHandler) handleLock(w http.ResponseWriter, r *http.Request, name string) {
-	r.Body = http.MaxBytesReader(w, r.Body, h.maxBodySize)
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		log.Printf("Error reading lock body for %s: %v", name, err)
-		http.Error(w, "failed to read request body", http.StatusBadRequest)
+	body, ok := h.readBody(w, r, name, "lock")
+	if !ok {
 		return
 	}
 
-	var lockInfo LockInfo
-	if err := json.Unmarshal(body, &lockInfo); err != nil {
-		log.Printf("Error parsing lock body for %s: %v", name, err)
-		http.Error(w, "invalid lock info", http.StatusBadRequest)
+	lockInfo, ok := parseLockInfo(w, body, name, "lock", true)
+	if !ok {
 		return
 	}
 
-	h.mu.Lock()
-	defer h.mu.Unlock()
+	release, ok := h.serializeState(w, r, name)
+	if !ok {
+		return
+	}
+	defer release()
 
-	if existingLock, locked := h.locks[name]; locked {
-		if existingLock.ID == lockInfo.ID {
-			// Same lock ID - idempotent success
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusOK)
-			_ = json.NewEncoder(w).Encode(existingLock)
-			return
-		}
+	h.mu.Lock()
+	existingLock, locked := h.locks[name]
+	switch {
+	case !locked:
+		// Acquire the lock
+		h.acquireLocked(name, lockInfo, requestSource(r))
+		h.mu.Unlock()
+	case existingLock.ID == lockInfo.ID:
+		// Same lock ID - idempotent success
+		h.mu.Unlock()
+		lockInfo = existingLock
+	case h.lockWait > 0:
+		// Wait for the holder to release the lock
+		waiter := h.enqueueWaiter(name, lockInfo, requestSource(r))
+		h.mu.Unlock()
+		release() // The holder's writes and unlock must go ahead
+		h.waitForLock(w, r, name, waiter)
+		return
+	default:
 		// Different lock - return 423 Locked
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusLocked)
-		_ = json.NewEncoder(w).Encode(existingLock)
+		h.mu.Unlock()
+		writeLockError(w, ErrLockConflict, existingLock)
 		return
 	}
 
-	// Acquire the lock
-	h.locks[name] = lockInfo
-	IncrementActiveLocks()
-
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	_ = json.NewEncoder(w).Encode(lockInfo)
 }
 
+// acquireLocked records lockInfo, acquired from source, as the holder of the
+// named state's lock. Must be called with h.mu held.
+func (h *StateHandler) acquireLocked(name string, lockInfo LockInfo, source lockSource) {
+	h.locks[name] = lockInfo
+	h.lockSources[name] = source
+	h.runs.Start(name, lockInfo)
+	IncrementActiveLocks()
+	slog.Debug("Lock acquired", "state", name, "lock_id", lockInfo.ID, "who", lockInfo.Who, "operation", lockInfo.Operation)
+	h.notifier.Notify(EventLockAcquired, name, fmt.Sprintf("%s locked %s for %s.", lockInfo.Who, name, strings.ToLower(strings.TrimPrefix(lockInfo.Operation, "OperationType"))), lockInfo)
+}
+
+// releaseLocked releases the named state's lock and hands it to the next
+// waiting client, if any. Must be called with h.mu held.
+func (h *StateHandler) releaseLocked(name string) {
+	existingLock := h.locks[name]
+	delete(h.locks, name)
+	delete(h.lockSources, name)
+	h.finishRun(name, "")
+	DecrementActiveLocks()
+	slog.Debug("Lock released", "state", name, "lock_id", existingLock.ID, "who", existingLock.Who)
+	h.notifier.Notify(EventLockReleased, name, fmt.Sprintf("%s released the lock on %s.", existingLock.Who, name), existingLock)
+
+	h.grantNextWaiterLocked(name)
+}
+
 // handleUnlock releases a lock for the state.
 func (h *StateHandler) handleUnlock(w http.ResponseWriter, r *http.Request, name string) {
-	r.Body = http.MaxBytesReader(w, r.Body, h.maxBodySize)
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		log.Printf("Error reading unlock body for %s: %v", name, err)
-		http.Error(w, "failed to read request body", http.StatusBadRequest)
+	body, ok := h.readBody(w, r, name, "unlock")
+	if !ok {
 		return
 	}
 
-	var unlockInfo LockInfo
-	if err := json.Unmarshal(body, &unlockInfo); err != nil {
-		log.Printf("Error parsing unlock body for %s: %v", name, err)
-		http.Error(w, "invalid lock info", http.StatusBadRequest)
+	unlockInfo, ok := parseLockInfo(w, body, name, "unlock", false)
+	if !ok {
+		return
+	}
+
+	// Writes in flight under the lock are committed before it is released
+	release, ok := h.serializeState(w, r, name)
+	if !ok {
+		return
+	}
+	defer release()
+
+	// Commit the writes spooled under the lock before it is released
+	if err := h.coalescer.Flush(r.Context(), name); err != nil {
+		slog.Error("Error committing spooled write", "state", name, "error", err)
+		writeError(w, err)
 		return
 	}
 
@@ -224,15 +1057,15 @@ func (h *StateHandler) handleUnlock(w http.ResponseWriter, r *http.Request, name
 
 	// Verify the lock ID matches (unless force unlock with empty ID)
 	if unlockInfo.ID != "" && unlockInfo.ID != existingLock.ID {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusConflict)
-		_ = json.NewEncoder(w).Encode(existingLock)
+		writeLockError(w, ErrLockMismatch, existingLock)
 		return
 	}
 
 	// Release the lock
-	delete(h.locks, name)
-	DecrementActiveLocks()
+	if unlockInfo.ID == "" {
+		h.finishRun(name, RunForceUnlocked)
+	}
+	h.releaseLocked(name)
 
 	w.WriteHeader(http.StatusOK)
 }
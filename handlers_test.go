@@ -2,36 +2,76 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"sort"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 // MockStorage implements StateStorage for testing.
 type MockStorage struct {
-	files map[string][]byte
+	files    map[string][]byte
+	modified map[string]time.Time
 }
 
 func NewMockStorage() *MockStorage {
 	return &MockStorage{
-		files: make(map[string][]byte),
+		files:    make(map[string][]byte),
+		modified: make(map[string]time.Time),
 	}
 }
 
-func (m *MockStorage) GetFile(path string) ([]byte, string, error) {
+func (m *MockStorage) GetFile(_ context.Context, path string) ([]byte, string, error) {
 	content, exists := m.files[path]
 	if !exists {
 		return nil, "", nil
 	}
-	return content, "sha-" + path, nil
+	return content, mockSHA(content), nil
+}
+
+// mockSHA returns the version MockStorage reports for content.
+func mockSHA(content []byte) string {
+	sum := sha256.Sum256(content)
+	return "sha-" + hex.EncodeToString(sum[:8])
 }
 
-func (m *MockStorage) CreateOrUpdateFile(path string, content []byte, _ string) error {
+func (m *MockStorage) CreateOrUpdateFile(_ context.Context, path string, content []byte, _ string) error {
 	m.files[path] = content
+	m.modified[path] = time.Now()
+	return nil
+}
+
+func (m *MockStorage) DeleteFile(_ context.Context, path string, _ string, _ string) error {
+	delete(m.files, path)
+	delete(m.modified, path)
 	return nil
 }
 
+func (m *MockStorage) ListFiles(prefix string) ([]string, error) {
+	var paths []string
+	for path := range m.files {
+		if strings.HasPrefix(path, prefix) {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+func (m *MockStorage) LastCommitTime(path string) (time.Time, error) {
+	return m.modified[path], nil
+}
+
 // Test helpers
 
 func newTestHandler() (*StateHandler, *MockStorage) {
@@ -105,10 +145,25 @@ func TestGetState_Found(t *testing.T) {
 	}
 }
 
+func TestGetState_Archived(t *testing.T) {
+	handler, mock := newTestHandler()
+	handler.archiver = NewArchiver(mock, mock, 6, handler.IsLocked)
+	mock.files["archive/myproject/terraform.tfstate"] = []byte(`{"version":4}`)
+
+	req := httptest.NewRequest(http.MethodGet, "/myproject", nil)
+	w := httptest.NewRecorder()
+
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusGone {
+		t.Errorf("expected status 410, got %d", w.Code)
+	}
+}
+
 func TestPostState_NoLock(t *testing.T) {
 	handler, mock := newTestHandler()
 
-	stateData := []byte(`{"version":4,"terraform_version":"1.0.0"}`)
+	stateData := []byte(`{"version":4,"terraform_version":"1.0.0","serial":1,"lineage":"abc"}`)
 	req := httptest.NewRequest(http.MethodPost, "/myproject", bytes.NewReader(stateData))
 	w := httptest.NewRecorder()
 
@@ -120,19 +175,344 @@ func TestPostState_NoLock(t *testing.T) {
 
 	// State should be prettified when saved
 	saved := mock.files["states/myproject/terraform.tfstate"]
-	expectedPretty := "{\n  \"version\": 4,\n  \"terraform_version\": \"1.0.0\"\n}"
+	expectedPretty := "{\n  \"version\": 4,\n  \"terraform_version\": \"1.0.0\",\n  \"serial\": 1,\n  \"lineage\": \"abc\"\n}"
 	if string(saved) != expectedPretty {
 		t.Errorf("state not saved correctly, got: %s", saved)
 	}
 }
 
+// shaMockStorage records how a SHA-aware storage is written to.
+type shaMockStorage struct {
+	*MockStorage
+	gets    int
+	updates []string
+}
+
+func (m *shaMockStorage) GetFile(ctx context.Context, path string) ([]byte, string, error) {
+	m.gets++
+	return m.MockStorage.GetFile(ctx, path)
+}
+
+func (m *shaMockStorage) CreateFile(ctx context.Context, path string, content []byte, message string) error {
+	return m.CreateOrUpdateFile(ctx, path, content, message)
+}
+
+func (m *shaMockStorage) UpdateFile(ctx context.Context, path string, content []byte, sha string, message string) error {
+	m.updates = append(m.updates, sha)
+	return m.CreateOrUpdateFile(ctx, path, content, message)
+}
+
+func TestPostState_ReusesStoredSHA(t *testing.T) {
+	mock := &shaMockStorage{MockStorage: NewMockStorage()}
+	stored := []byte(`{"version":4,"serial":1,"lineage":"abc"}`)
+	mock.files["states/myproject/terraform.tfstate"] = stored
+	handler := NewStateHandler(mock, DefaultMaxBodySize)
+
+	req := httptest.NewRequest(http.MethodPost, "/myproject", strings.NewReader(`{"version":4,"serial":2,"lineage":"abc"}`+"\n"))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+	if mock.gets != 1 {
+		t.Errorf("expected the stored state to be read once, got %d", mock.gets)
+	}
+	if len(mock.updates) != 1 || mock.updates[0] != mockSHA(stored) {
+		t.Errorf("expected an update against the stored SHA, got %v", mock.updates)
+	}
+	if saved := string(mock.files["states/myproject/terraform.tfstate"]); strings.HasSuffix(saved, "\n") {
+		t.Errorf("expected trailing whitespace to be dropped, got %q", saved)
+	}
+}
+
+func TestPostState_WritesSidecars(t *testing.T) {
+	storage := newTestLocalGitClient(t)
+	handler := NewStateHandler(storage, DefaultMaxBodySize)
+
+	req := httptest.NewRequest(http.MethodPost, "/myproject", strings.NewReader(`{"version":4,"serial":3,"lineage":"abc"}`))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
+	state, _, _ := storage.GetFile(context.Background(), statePath("myproject"))
+	checksum, _, _ := storage.GetFile(context.Background(), checksumPath("myproject"))
+	sum := sha256.Sum256(state)
+	if string(checksum) != hex.EncodeToString(sum[:])+"  terraform.tfstate\n" {
+		t.Errorf("checksum sidecar does not match state, got %q", checksum)
+	}
+
+	var metadata stateMetadata
+	content, _, _ := storage.GetFile(context.Background(), metadataPath("myproject"))
+	if err := json.Unmarshal(content, &metadata); err != nil {
+		t.Fatalf("failed to decode metadata: %v", err)
+	}
+	if metadata.Serial == nil || *metadata.Serial != 3 || metadata.Lineage != "abc" || metadata.Size != len(state) {
+		t.Errorf("unexpected metadata: %+v", metadata)
+	}
+
+	// All three files are written in a single commit
+	if commits, _ := storage.ListCommits("states", 0); len(commits) != 1 {
+		t.Errorf("expected 1 commit, got %d", len(commits))
+	}
+}
+
+// racingStorage edits the state out of band right after it has been read.
+type racingStorage struct {
+	*LocalGitClient
+	raced bool
+}
+
+func (s *racingStorage) GetFile(ctx context.Context, path string) ([]byte, string, error) {
+	content, sha, err := s.LocalGitClient.GetFile(ctx, path)
+	if !s.raced && path == statePath("myproject") {
+		s.raced = true
+		if err := s.LocalGitClient.CreateOrUpdateFile(ctx, path, []byte("edited"), "manual edit"); err != nil {
+			return nil, "", err
+		}
+	}
+	return content, sha, err
+}
+
+func TestPostState_ConcurrentModification(t *testing.T) {
+	for _, existing := range []bool{false, true} {
+		storage := &racingStorage{LocalGitClient: newTestLocalGitClient(t)}
+		if existing {
+			if err := storage.LocalGitClient.CreateOrUpdateFile(context.Background(), statePath("myproject"), []byte(`{"version":4,"serial":1,"lineage":"abc"}`), "create"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		handler := NewStateHandler(storage, DefaultMaxBodySize)
+
+		req := httptest.NewRequest(http.MethodPost, "/myproject", strings.NewReader(`{"version":4,"serial":2,"lineage":"abc"}`))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		if w.Code != http.StatusConflict {
+			t.Errorf("existing=%v: expected status 409, got %d", existing, w.Code)
+		}
+		if content, _, _ := storage.LocalGitClient.GetFile(context.Background(), statePath("myproject")); string(content) != "edited" {
+			t.Errorf("existing=%v: expected the out-of-band edit to be kept, got %q", existing, content)
+		}
+	}
+}
+
+// cancellingStorage fails reads as if the client disconnected during them.
+type cancellingStorage struct {
+	*MockStorage
+	cancel context.CancelFunc
+}
+
+func (s *cancellingStorage) GetFile(context.Context, string) ([]byte, string, error) {
+	s.cancel()
+	return nil, "", context.Canceled
+}
+
+func TestGetState_CancelledByClient(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	handler := metricsMiddleware(NewStateHandler(&cancellingStorage{MockStorage: NewMockStorage(), cancel: cancel}, DefaultMaxBodySize))
+	before := testutil.ToFloat64(httpRequestsTotal.WithLabelValues(http.MethodGet, "499"))
+
+	req := httptest.NewRequest(http.MethodGet, "/myproject", nil).WithContext(ctx)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if w.Code != statusClientClosedRequest {
+		t.Errorf("expected status 499, got %d", w.Code)
+	}
+	if after := testutil.ToFloat64(httpRequestsTotal.WithLabelValues(http.MethodGet, "499")); after != before+1 {
+		t.Errorf("expected the request to be counted as cancelled, got %v", after-before)
+	}
+}
+
+func TestPostState_CancelledByClient(t *testing.T) {
+	handler, mock := newTestHandler()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	req := httptest.NewRequest(http.MethodPost, "/myproject", strings.NewReader(`{"version":4,"serial":1,"lineage":"abc"}`)).WithContext(ctx)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if w.Code != statusClientClosedRequest {
+		t.Errorf("expected status 499, got %d", w.Code)
+	}
+	if _, saved := mock.files[statePath("myproject")]; saved {
+		t.Error("expected an abandoned write not to be saved")
+	}
+}
+
+func TestApplyCycle_SingleCommit(t *testing.T) {
+	storage := newTestLocalGitClient(t)
+	handler := NewStateHandler(storage, DefaultMaxBodySize)
+	lockJSON := `{"ID":"lock-123","Operation":"OperationTypeApply","Who":"alice"}`
+
+	for _, step := range []struct {
+		method, body string
+	}{
+		{"LOCK", lockJSON},
+		{http.MethodPost, `{"version":4,"serial":1,"lineage":"abc"}`},
+		{"UNLOCK", lockJSON},
+	} {
+		req := httptest.NewRequest(step.method, "/myproject?ID=lock-123", strings.NewReader(step.body))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200 for %s, got %d", step.method, w.Code)
+		}
+	}
+
+	// Locks live in memory, so only the state write is committed
+	if commits, _ := storage.ListCommits("states", 0); len(commits) != 1 {
+		t.Errorf("expected 1 commit, got %d", len(commits))
+	}
+}
+
+func TestPostState_InvalidState(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"not json", `not json`},
+		{"json array", `[1,2,3]`},
+		{"missing version", `{"serial":1,"lineage":"abc"}`},
+		{"missing serial", `{"version":4,"lineage":"abc"}`},
+		{"missing lineage", `{"version":4,"serial":1}`},
+	}
+
+	for _, tt := range tests {
+		handler, mock := newTestHandler()
+
+		req := httptest.NewRequest(http.MethodPost, "/myproject", bytes.NewReader([]byte(tt.body)))
+		w := httptest.NewRecorder()
+
+		handler.ServeHTTP(w, req)
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %d", tt.name, w.Code)
+		}
+		if _, saved := mock.files["states/myproject/terraform.tfstate"]; saved {
+			t.Errorf("%s: invalid state should not be saved", tt.name)
+		}
+	}
+}
+
+func TestPostState_AllowRawState(t *testing.T) {
+	handler, mock := newTestHandler()
+	handler.allowRawState = true
+
+	req := httptest.NewRequest(http.MethodPost, "/myproject", bytes.NewReader([]byte("not json")))
+	w := httptest.NewRecorder()
+
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status 200, got %d", w.Code)
+	}
+	if string(mock.files["states/myproject/terraform.tfstate"]) != "not json" {
+		t.Errorf("raw state not saved as-is, got: %s", mock.files["states/myproject/terraform.tfstate"])
+	}
+}
+
+func TestPostState_TooLarge(t *testing.T) {
+	mock := NewMockStorage()
+	handler := NewStateHandler(mock, 16)
+
+	req := httptest.NewRequest(http.MethodPost, "/myproject", bytes.NewReader([]byte(`{"version":4,"serial":1,"lineage":"abc"}`)))
+	w := httptest.NewRecorder()
+
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected status 413, got %d", w.Code)
+	}
+	var resp map[string]any
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("expected JSON error body: %v", err)
+	}
+	if resp["max_body_bytes"] != float64(16) {
+		t.Errorf("expected max_body_bytes 16, got %v", resp["max_body_bytes"])
+	}
+	if _, saved := mock.files["states/myproject/terraform.tfstate"]; saved {
+		t.Error("oversized state should not be saved")
+	}
+}
+
+// gzipped compresses s.
+func gzipped(t *testing.T, s string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write([]byte(s)); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestPostState_Gzip(t *testing.T) {
+	handler, mock := newTestHandler()
+	state := `{"version":4,"serial":1,"lineage":"abc"}`
+
+	req := httptest.NewRequest(http.MethodPost, "/myproject", bytes.NewReader(gzipped(t, state)))
+	req.Header.Set("Content-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if stored := mock.files["states/myproject/terraform.tfstate"]; !bytes.Contains(stored, []byte(`"lineage": "abc"`)) {
+		t.Errorf("expected the decompressed state to be stored, got %s", stored)
+	}
+}
+
+func TestPostState_GzipRejected(t *testing.T) {
+	state := `{"version":4,"serial":1,"lineage":"abc","outputs":{}}`
+	tests := []struct {
+		name     string
+		encoding string
+		body     []byte
+		limit    int64
+		want     int
+	}{
+		{"not gzip", "gzip", []byte(state), DefaultMaxBodySize, http.StatusBadRequest},
+		{"truncated", "gzip", gzipped(t, state)[:20], DefaultMaxBodySize, http.StatusBadRequest},
+		{"decompressed too large", "gzip", gzipped(t, state+strings.Repeat(" ", 4096)), 1024, http.StatusRequestEntityTooLarge},
+		{"unsupported encoding", "br", []byte(state), DefaultMaxBodySize, http.StatusUnsupportedMediaType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := NewMockStorage()
+			handler := NewStateHandler(mock, tt.limit)
+
+			req := httptest.NewRequest(http.MethodPost, "/myproject", bytes.NewReader(tt.body))
+			req.Header.Set("Content-Encoding", tt.encoding)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if w.Code != tt.want {
+				t.Errorf("expected status %d, got %d: %s", tt.want, w.Code, w.Body.String())
+			}
+			if len(mock.files) != 0 {
+				t.Error("expected nothing to be stored")
+			}
+		})
+	}
+}
+
 func TestPostState_WithMatchingLock(t *testing.T) {
 	handler, _ := newTestHandler()
 
 	// Create a lock
-	handler.locks["myproject"] = LockInfo{ID: "lock-123", Operation: "apply"}
+	handler.locks["myproject"] = LockInfo{ID: "lock-123", Operation: "OperationTypeApply"}
 
-	stateData := []byte(`{"version":4}`)
+	stateData := []byte(`{"version":4,"serial":1,"lineage":"abc"}`)
 	req := httptest.NewRequest(http.MethodPost, "/myproject", bytes.NewReader(stateData))
 	req.Header.Set("Lock-Id", "lock-123")
 	w := httptest.NewRecorder()
@@ -148,9 +528,9 @@ func TestPostState_WithMatchingLockQueryParam(t *testing.T) {
 	handler, _ := newTestHandler()
 
 	// Create a lock
-	handler.locks["myproject"] = LockInfo{ID: "lock-123", Operation: "apply"}
+	handler.locks["myproject"] = LockInfo{ID: "lock-123", Operation: "OperationTypeApply"}
 
-	stateData := []byte(`{"version":4}`)
+	stateData := []byte(`{"version":4,"serial":1,"lineage":"abc"}`)
 	req := httptest.NewRequest(http.MethodPost, "/myproject?ID=lock-123", bytes.NewReader(stateData))
 	w := httptest.NewRecorder()
 
@@ -165,9 +545,9 @@ func TestPostState_WithWrongLock(t *testing.T) {
 	handler, _ := newTestHandler()
 
 	// Create a lock
-	handler.locks["myproject"] = LockInfo{ID: "lock-123", Operation: "apply"}
+	handler.locks["myproject"] = LockInfo{ID: "lock-123", Operation: "OperationTypeApply"}
 
-	stateData := []byte(`{"version":4}`)
+	stateData := []byte(`{"version":4,"serial":1,"lineage":"abc"}`)
 	req := httptest.NewRequest(http.MethodPost, "/myproject", bytes.NewReader(stateData))
 	req.Header.Set("Lock-Id", "wrong-lock")
 	w := httptest.NewRecorder()
@@ -179,10 +559,97 @@ func TestPostState_WithWrongLock(t *testing.T) {
 	}
 }
 
+func TestPostState_RequireLock_NoLockID(t *testing.T) {
+	handler, mock := newTestHandler()
+	handler.requireLock = true
+
+	req := httptest.NewRequest(http.MethodPost, "/myproject", bytes.NewReader([]byte(`{"version":4,"serial":1,"lineage":"abc"}`)))
+	w := httptest.NewRecorder()
+
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400, got %d", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("expected Content-Type application/json, got %s", ct)
+	}
+	var body map[string]string
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil || body["error"] == "" {
+		t.Errorf("expected JSON error body, got %v", err)
+	}
+	if _, exists := mock.files["states/myproject/terraform.tfstate"]; exists {
+		t.Error("state should not be saved")
+	}
+}
+
+func TestPostState_RequireLock_LockNotHeld(t *testing.T) {
+	handler, _ := newTestHandler()
+	handler.requireLock = true
+
+	req := httptest.NewRequest(http.MethodPost, "/myproject", bytes.NewReader([]byte(`{"version":4,"serial":1,"lineage":"abc"}`)))
+	req.Header.Set("Lock-Id", "lock-123")
+	w := httptest.NewRecorder()
+
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400, got %d", w.Code)
+	}
+}
+
+func TestPostState_RequireLock_WithLock(t *testing.T) {
+	handler, _ := newTestHandler()
+	handler.requireLock = true
+	handler.locks["myproject"] = LockInfo{ID: "lock-123", Operation: "OperationTypeApply"}
+
+	req := httptest.NewRequest(http.MethodPost, "/myproject", bytes.NewReader([]byte(`{"version":4,"serial":1,"lineage":"abc"}`)))
+	req.Header.Set("Lock-Id", "lock-123")
+	w := httptest.NewRecorder()
+
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status 200, got %d", w.Code)
+	}
+}
+
+func TestPostState_SerialRegression(t *testing.T) {
+	handler, mock := newTestHandler()
+	stored := []byte(`{"version":4,"serial":5,"lineage":"abc"}`)
+	mock.files["states/myproject/terraform.tfstate"] = stored
+
+	req := httptest.NewRequest(http.MethodPost, "/myproject", bytes.NewReader([]byte(`{"version":4,"serial":4,"lineage":"abc"}`)))
+	w := httptest.NewRecorder()
+
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusConflict {
+		t.Errorf("expected status 409, got %d", w.Code)
+	}
+	if !bytes.Equal(mock.files["states/myproject/terraform.tfstate"], stored) {
+		t.Error("stored state should not be overwritten")
+	}
+}
+
+func TestPostState_SerialRegressionForced(t *testing.T) {
+	handler, mock := newTestHandler()
+	mock.files["states/myproject/terraform.tfstate"] = []byte(`{"version":4,"serial":5,"lineage":"abc"}`)
+
+	req := httptest.NewRequest(http.MethodPost, "/myproject?force=true", bytes.NewReader([]byte(`{"version":4,"serial":4,"lineage":"abc"}`)))
+	w := httptest.NewRecorder()
+
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status 200, got %d", w.Code)
+	}
+}
+
 func TestLock_Success(t *testing.T) {
 	handler, _ := newTestHandler()
 
-	lockInfo := LockInfo{ID: "lock-123", Operation: "apply", Who: "user@host"}
+	lockInfo := LockInfo{ID: "lock-123", Operation: "OperationTypeApply", Who: "user@host"}
 	lockJSON, _ := json.Marshal(lockInfo)
 
 	req := httptest.NewRequest("LOCK", "/myproject", bytes.NewReader(lockJSON))
@@ -216,14 +683,105 @@ func TestLock_InvalidJSON(t *testing.T) {
 	}
 }
 
+func TestLock_RejectsInvalidLockInfo(t *testing.T) {
+	for _, body := range []string{
+		`{"Operation":"OperationTypeApply"}`,
+		`{"ID":"lock-123","Created":"yesterday"}`,
+	} {
+		handler, _ := newTestHandler()
+		w := serveAs(handler, "LOCK", "/myproject", "", body)
+		if w.Code != http.StatusUnprocessableEntity {
+			t.Errorf("%s: expected status 422, got %d", body, w.Code)
+		}
+		var resp struct {
+			Code    string   `json:"code"`
+			Details []string `json:"details"`
+		}
+		_ = json.NewDecoder(w.Body).Decode(&resp)
+		if resp.Code != "lock_info_rejected" || len(resp.Details) != 1 {
+			t.Errorf("%s: expected the problem in the details, got %+v", body, resp)
+		}
+		if handler.IsLocked("myproject") {
+			t.Errorf("%s: lock should not be acquired", body)
+		}
+	}
+}
+
+func TestLock_AcceptsTerraformOperations(t *testing.T) {
+	for _, operation := range []string{
+		"OperationTypePlan",
+		"OperationTypeApply",
+		"OperationTypeRefresh",
+		"import",
+		"migration source state",
+		"migration destination state",
+		"state-mv",
+		"state-rm",
+		"state-push",
+		"state-replace-provider",
+		"taint",
+		"untaint",
+		"workspace-new",
+		"workspace-delete",
+		"some-future-command",
+	} {
+		handler, _ := newTestHandler()
+		body := fmt.Sprintf(`{"ID":"lock-123","Operation":%q}`, operation)
+		if w := serveAs(handler, "LOCK", "/myproject", "", body); w.Code != http.StatusOK {
+			t.Errorf("%s: expected status 200, got %d: %s", operation, w.Code, w.Body)
+		}
+	}
+}
+
+func TestLock_FillsInCreated(t *testing.T) {
+	handler, _ := newTestHandler()
+
+	if w := serveAs(handler, "LOCK", "/myproject", "", `{"ID":"lock-123","Operation":"state-mv"}`); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+	created := handler.locks["myproject"].Created
+	if _, err := time.Parse(time.RFC3339, created); err != nil {
+		t.Errorf("expected an RFC 3339 Created time, got %q", created)
+	}
+}
+
+func TestUnlock_RejectsInvalidLockInfo(t *testing.T) {
+	handler, _ := newTestHandler()
+	handler.locks["myproject"] = LockInfo{ID: "lock-123", Operation: "OperationTypeApply"}
+
+	if w := serveAs(handler, "UNLOCK", "/myproject", "", `{"ID":"lock-123","Created":"now"}`); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("expected status 422, got %d", w.Code)
+	}
+	if !handler.IsLocked("myproject") {
+		t.Error("lock should still be held")
+	}
+}
+
+func TestLock_TooLarge(t *testing.T) {
+	handler := NewStateHandler(NewMockStorage(), 16)
+
+	lockJSON, _ := json.Marshal(LockInfo{ID: "lock-123", Operation: "OperationTypeApply", Who: "user@host"})
+	req := httptest.NewRequest("LOCK", "/myproject", bytes.NewReader(lockJSON))
+	w := httptest.NewRecorder()
+
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected status 413, got %d", w.Code)
+	}
+	if handler.IsLocked("myproject") {
+		t.Error("lock should not be acquired")
+	}
+}
+
 func TestLock_AlreadyLocked(t *testing.T) {
 	handler, _ := newTestHandler()
 
 	// Create existing lock
-	handler.locks["myproject"] = LockInfo{ID: "existing-lock", Operation: "apply"}
+	handler.locks["myproject"] = LockInfo{ID: "existing-lock", Operation: "OperationTypeApply"}
 
 	// Try to acquire new lock
-	newLock := LockInfo{ID: "new-lock", Operation: "apply"}
+	newLock := LockInfo{ID: "new-lock", Operation: "OperationTypeApply"}
 	newJSON, _ := json.Marshal(newLock)
 
 	req := httptest.NewRequest("LOCK", "/myproject", bytes.NewReader(newJSON))
@@ -246,10 +804,10 @@ func TestLock_Idempotent(t *testing.T) {
 	handler, _ := newTestHandler()
 
 	// Create existing lock with same ID
-	handler.locks["myproject"] = LockInfo{ID: "lock-123", Operation: "apply"}
+	handler.locks["myproject"] = LockInfo{ID: "lock-123", Operation: "OperationTypeApply"}
 
 	// Try to acquire same lock again
-	lockInfo := LockInfo{ID: "lock-123", Operation: "apply"}
+	lockInfo := LockInfo{ID: "lock-123", Operation: "OperationTypeApply"}
 	lockJSON, _ := json.Marshal(lockInfo)
 
 	req := httptest.NewRequest("LOCK", "/myproject", bytes.NewReader(lockJSON))
@@ -262,11 +820,47 @@ func TestLock_Idempotent(t *testing.T) {
 	}
 }
 
+func TestLock_CustomMethods(t *testing.T) {
+	handler, _ := newTestHandler()
+	handler.lockMethod = http.MethodPut
+	handler.unlockMethod = http.MethodDelete
+
+	lockJSON, _ := json.Marshal(LockInfo{ID: "lock-123", Operation: "OperationTypeApply"})
+
+	req := httptest.NewRequest(http.MethodPut, "/myproject", bytes.NewReader(lockJSON))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200 for PUT lock, got %d", w.Code)
+	}
+	if !handler.IsLocked("myproject") {
+		t.Fatal("expected state to be locked")
+	}
+
+	// The default verbs are no longer routed
+	req = httptest.NewRequest("UNLOCK", "/myproject", bytes.NewReader(lockJSON))
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected status 405 for UNLOCK, got %d", w.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodDelete, "/myproject", bytes.NewReader(lockJSON))
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status 200 for DELETE unlock, got %d", w.Code)
+	}
+	if handler.IsLocked("myproject") {
+		t.Error("expected state to be unlocked")
+	}
+}
+
 func TestUnlock_Success(t *testing.T) {
 	handler, _ := newTestHandler()
 
 	// Create existing lock
-	handler.locks["myproject"] = LockInfo{ID: "lock-123", Operation: "apply"}
+	handler.locks["myproject"] = LockInfo{ID: "lock-123", Operation: "OperationTypeApply"}
 
 	lockInfo := LockInfo{ID: "lock-123"}
 	lockJSON, _ := json.Marshal(lockInfo)
@@ -302,7 +896,7 @@ func TestUnlock_WrongID(t *testing.T) {
 	handler, _ := newTestHandler()
 
 	// Create existing lock
-	handler.locks["myproject"] = LockInfo{ID: "lock-123", Operation: "apply"}
+	handler.locks["myproject"] = LockInfo{ID: "lock-123", Operation: "OperationTypeApply"}
 
 	// Try to unlock with wrong ID
 	wrongLock := LockInfo{ID: "wrong-id"}
@@ -342,7 +936,7 @@ func TestUnlock_ForceUnlock(t *testing.T) {
 	handler, _ := newTestHandler()
 
 	// Create existing lock
-	handler.locks["myproject"] = LockInfo{ID: "lock-123", Operation: "apply"}
+	handler.locks["myproject"] = LockInfo{ID: "lock-123", Operation: "OperationTypeApply"}
 
 	// Force unlock with empty ID
 	forceLock := LockInfo{ID: ""}
@@ -381,6 +975,27 @@ func TestStatePath(t *testing.T) {
 	}
 }
 
+func TestStateNameFromPath(t *testing.T) {
+	tests := []struct {
+		path     string
+		expected string
+		ok       bool
+	}{
+		{"states/myproject/terraform.tfstate", "myproject", true},
+		{"states/org/project/terraform.tfstate", "org/project", true},
+		{"states/terraform.tfstate", "", false},
+		{"archive/myproject/terraform.tfstate", "", false},
+		{"states/myproject/other.json", "", false},
+	}
+
+	for _, tt := range tests {
+		result, ok := stateNameFromPath(tt.path)
+		if result != tt.expected || ok != tt.ok {
+			t.Errorf("stateNameFromPath(%q) = (%q, %v), expected (%q, %v)", tt.path, result, ok, tt.expected, tt.ok)
+		}
+	}
+}
+
 func TestExtractStateName(t *testing.T) {
 	tests := []struct {
 		path     string
@@ -401,3 +1016,31 @@ func TestExtractStateName(t *testing.T) {
 		}
 	}
 }
+
+func TestServeHTTP_ReservedStateNames(t *testing.T) {
+	handler, mock := newTestHandler()
+	state := `{"version":4,"serial":1,"lineage":"abc"}`
+
+	for _, tt := range []struct{ method, target string }{
+		{http.MethodPost, "/team/runs"},
+		{http.MethodPost, "/team/deletion"},
+		{"LOCK", "/team/lock/transfer"},
+		{"UNLOCK", "/team/lock/steal"},
+	} {
+		w := serveAs(handler, tt.method, tt.target, "", state)
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "reserved") {
+			t.Errorf("%s %s: expected status 400 for a reserved name, got %d: %s", tt.method, tt.target, w.Code, w.Body.String())
+		}
+	}
+	if len(mock.files) != 0 {
+		t.Errorf("expected no state to be written, got %d files", len(mock.files))
+	}
+
+	// The endpoints themselves are still served
+	if w := serveAs(handler, http.MethodGet, "/team/runs", "", ""); w.Code != http.StatusOK {
+		t.Errorf("expected the runs of team, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := serveAs(handler, http.MethodPut, "/team/runs", "", ""); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected status 405 for other methods, got %d", w.Code)
+	}
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of search results.
+const (
+	SearchResource  = "resource"
+	SearchOutput    = "output"
+	SearchAttribute = "attribute"
+)
+
+// maxSearchResults limits the results of a search.
+const maxSearchResults = 500
+
+// indexedState is what the index knows about a state.
+type indexedState struct {
+	sha       string // Version the entry was built from; empty after a write
+	resources []indexedResource
+	outputs   []indexedValue // Sensitive outputs are indexed without their values
+}
+
+// indexedResource is a resource instance in a state.
+type indexedResource struct {
+	address    string
+	attributes []indexedValue
+}
+
+// indexedValue is a scalar value in a state: a resource attribute, with
+// its path within the instance, or an output.
+type indexedValue struct {
+	path  string
+	value string
+}
+
+// SearchResult is a match of a search.
+type SearchResult struct {
+	State     string `json:"state"`
+	Kind      string `json:"kind"`
+	Address   string `json:"address,omitempty"`   // Resource address, for resources and attributes
+	Output    string `json:"output,omitempty"`    // Output name, for outputs
+	Attribute string `json:"attribute,omitempty"` // Attribute path, for attributes
+	Value     string `json:"value,omitempty"`     // Matching value, for attributes and outputs
+}
+
+// SearchResponse is the response of GET /api/v1/search.
+type SearchResponse struct {
+	Query     string         `json:"query"`
+	Kind      string         `json:"kind,omitempty"`
+	Results   []SearchResult `json:"results"`
+	Truncated bool           `json:"truncated"`
+	States    int            `json:"states"`     // States in the index
+	IndexedAt time.Time      `json:"indexed_at"` // Completion of the last full pass
+}
+
+// StateIndex keeps the resources, attributes and outputs of every state in
+// memory, so they can be searched without reading the states. It is rebuilt
+// periodically in the background, rereading only states whose version
+// changed, and states written through the backend are updated right away.
+type StateIndex struct {
+	storage ArchiveStorage
+
+	mu      sync.RWMutex
+	states  map[string]*indexedState
+	indexed time.Time
+}
+
+// NewStateIndex creates an empty index of the states in storage.
+func NewStateIndex(storage ArchiveStorage) *StateIndex {
+	return &StateIndex{storage: storage, states: make(map[string]*indexedState)}
+}
+
+// Rebuild brings the index up to date with the storage, rereading only the
+// states whose version changed.
+func (x *StateIndex) Rebuild(ctx context.Context) error {
+	x.mu.RLock()
+	previous := x.states
+	x.mu.RUnlock()
+	return x.rebuild(ctx, previous)
+}
+
+// RebuildAll rebuilds the index from scratch, rereading every state.
+func (x *StateIndex) RebuildAll(ctx context.Context) error {
+	return x.rebuild(ctx, nil)
+}
+
+// rebuild indexes the states in the storage, reusing the entries of previous
+// whose version is unchanged.
+func (x *StateIndex) rebuild(ctx context.Context, previous map[string]*indexedState) error {
+	paths, err := x.storage.ListFiles(layout.prefix)
+	if err != nil {
+		return err
+	}
+
+	states := make(map[string]*indexedState, len(paths))
+	for _, path := range paths {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		name, ok := stateNameFromPath(path)
+		if !ok {
+			continue
+		}
+		content, sha, err := x.storage.GetFile(ctx, path)
+		if err != nil {
+			return fmt.Errorf("failed to index state %s: %w", name, err)
+		}
+		if content == nil {
+			continue
+		}
+		if entry, ok := previous[name]; ok && entry.sha == sha {
+			states[name] = entry
+			continue
+		}
+		if content, _, err = joinChunks(ctx, x.storage, name, content); err != nil {
+			return fmt.Errorf("failed to index state %s: %w", name, err)
+		}
+		if content, err = decodeState(content); err != nil {
+			return fmt.Errorf("failed to index state %s: %w", name, err)
+		}
+		entry := indexState(content)
+		entry.sha = sha
+		states[name] = entry
+	}
+
+	x.mu.Lock()
+	x.states = states
+	x.indexed = time.Now().UTC()
+	x.mu.Unlock()
+	return nil
+}
+
+// Update indexes a state written through the backend. It is safe to call on
+// a nil index.
+func (x *StateIndex) Update(name string, content []byte) {
+	if x == nil {
+		return
+	}
+	entry := indexState(content)
+	x.mu.Lock()
+	x.states[name] = entry
+	x.mu.Unlock()
+}
+
+// Remove drops a deleted state from the index. It is safe to call on a nil
+// index.
+func (x *StateIndex) Remove(name string) {
+	if x == nil {
+		return
+	}
+	x.mu.Lock()
+	delete(x.states, name)
+	x.mu.Unlock()
+}
+
+// Search returns the entries of the given kind, or of every kind if kind is
+// empty, that contain query, ignoring case: resources by address, outputs by
+// name or value and attributes by value.
+func (x *StateIndex) Search(query, kind string) SearchResponse {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+
+	resp := SearchResponse{Query: query, Kind: kind, Results: []SearchResult{}, States: len(x.states), IndexedAt: x.indexed}
+	q := strings.ToLower(query)
+	match := func(s string) bool { return strings.Contains(strings.ToLower(s), q) }
+	add := func(r SearchResult) bool {
+		if len(resp.Results) == maxSearchResults {
+			resp.Truncated = true
+			return false
+		}
+		resp.Results = append(resp.Results, r)
+		return true
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(x.states)) {
+		entry := x.states[name]
+		for _, res := range entry.resources {
+			if (kind == "" || kind == SearchResource) && match(res.address) {
+				if !add(SearchResult{State: name, Kind: SearchResource, Address: res.address}) {
+					return resp
+				}
+			}
+			if kind != "" && kind != SearchAttribute {
+				continue
+			}
+			for _, attr := range res.attributes {
+				if match(attr.value) {
+					if !add(SearchResult{State: name, Kind: SearchAttribute, Address: res.address, Attribute: attr.path, Value: attr.value}) {
+						return resp
+					}
+				}
+			}
+		}
+		if kind != "" && kind != SearchOutput {
+			continue
+		}
+		for _, out := range entry.outputs {
+			if match(out.path) || (out.value != "" && match(out.value)) {
+				if !add(SearchResult{State: name, Kind: SearchOutput, Output: out.path, Value: out.value}) {
+					return resp
+				}
+			}
+		}
+	}
+	return resp
+}
+
+// ServeHTTP serves GET /api/v1/search?q={query}&kind={kind}.
+func (x *StateIndex) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query().Get("q")
+	if query == "" {
+		writeError(w, fmt.Errorf("%w: q is required", ErrInvalidRequest))
+		return
+	}
+	kind := r.URL.Query().Get("kind")
+	switch kind {
+	case "", SearchResource, SearchOutput, SearchAttribute:
+	default:
+		writeError(w, fmt.Errorf("%w: kind must be %s, %s or %s", ErrInvalidRequest, SearchResource, SearchOutput, SearchAttribute))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(x.Search(query, kind))
+}
+
+// IndexDrift compares the index with the repository, as served by
+// GET /admin/index/verify.
+type IndexDrift struct {
+	Checked  int      `json:"checked"`  // States in the repository
+	Missing  []string `json:"missing"`  // In the repository but not in the index
+	Stale    []string `json:"stale"`    // Indexed with other contents than stored
+	Orphaned []string `json:"orphaned"` // In the index but no longer in the repository
+	InSync   bool     `json:"in_sync"`
+}
+
+// Verify reads every state and compares it with its index entry, without
+// changing the index.
+func (x *StateIndex) Verify(ctx context.Context) (*IndexDrift, error) {
+	paths, err := x.storage.ListFiles(layout.prefix)
+	if err != nil {
+		return nil, err
+	}
+	x.mu.RLock()
+	indexed := maps.Clone(x.states)
+	x.mu.RUnlock()
+
+	drift := &IndexDrift{Missing: []string{}, Stale: []string{}, Orphaned: []string{}}
+	stored := make(map[string]bool, len(paths))
+	for _, path := range paths {
+		name, ok := stateNameFromPath(path)
+		if !ok {
+			continue
+		}
+		content, _, err := loadState(ctx, x.storage, name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read state %s: %w", name, err)
+		}
+		if content == nil {
+			continue
+		}
+		stored[name] = true
+		drift.Checked++
+
+		entry, ok := indexed[name]
+		if !ok {
+			drift.Missing = append(drift.Missing, name)
+			continue
+		}
+		actual := indexState(content)
+		if !reflect.DeepEqual(entry.resources, actual.resources) || !reflect.DeepEqual(entry.outputs, actual.outputs) {
+			drift.Stale = append(drift.Stale, name)
+		}
+	}
+	for name := range indexed {
+		if !stored[name] {
+			drift.Orphaned = append(drift.Orphaned, name)
+		}
+	}
+	slices.Sort(drift.Missing)
+	slices.Sort(drift.Stale)
+	slices.Sort(drift.Orphaned)
+	drift.InSync = len(drift.Missing)+len(drift.Stale)+len(drift.Orphaned) == 0
+	return drift, nil
+}
+
+// handleRebuild serves POST /admin/index/rebuild, rebuilding the index from
+// scratch.
+func (x *StateIndex) handleRebuild(w http.ResponseWriter, r *http.Request) {
+	if err := x.RebuildAll(r.Context()); err != nil {
+		slog.Error("Error rebuilding the search index", "error", err)
+		writeError(w, err)
+		return
+	}
+	x.mu.RLock()
+	resp := map[string]any{"states": len(x.states), "indexed_at": x.indexed}
+	x.mu.RUnlock()
+	slog.Info("Rebuilt the search index", "states", resp["states"])
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// handleVerify serves GET /admin/index/verify.
+func (x *StateIndex) handleVerify(w http.ResponseWriter, r *http.Request) {
+	drift, err := x.Verify(r.Context())
+	if err != nil {
+		slog.Error("Error verifying the search index", "error", err)
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(drift)
+}
+
+// indexedStateFile is the part of a state the index reads.
+type indexedStateFile struct {
+	Outputs map[string]struct {
+		Value     any  `json:"value"`
+		Sensitive bool `json:"sensitive"`
+	} `json:"outputs"`
+	Resources []struct {
+		Module    string `json:"module"`
+		Mode      string `json:"mode"`
+		Type      string `json:"type"`
+		Name      string `json:"name"`
+		Instances []struct {
+			IndexKey            any               `json:"index_key"`
+			Attributes          map[string]any    `json:"attributes"`
+			SensitiveAttributes []json.RawMessage `json:"sensitive_attributes"`
+		} `json:"instances"`
+	} `json:"resources"`
+}
+
+// indexState extracts the searchable entries of a state. Values Terraform
+// marks as sensitive are left out. Content that is not a state yields an
+// empty entry.
+func indexState(content []byte) *indexedState {
+	entry := &indexedState{}
+	var file indexedStateFile
+	if err := json.Unmarshal(content, &file); err != nil {
+		return entry
+	}
+
+	for _, res := range file.Resources {
+		base := res.Type + "." + res.Name
+		if res.Mode == "data" {
+			base = "data." + base
+		}
+		if res.Module != "" {
+			base = res.Module + "." + base
+		}
+		for _, inst := range res.Instances {
+			address := base
+			switch key := inst.IndexKey.(type) {
+			case float64:
+				address += "[" + strconv.FormatFloat(key, 'f', -1, 64) + "]"
+			case string:
+				address += "[" + strconv.Quote(key) + "]"
+			}
+			sensitive := sensitiveAttributes(inst.SensitiveAttributes)
+			r := indexedResource{address: address}
+			for _, attr := range slices.Sorted(maps.Keys(inst.Attributes)) {
+				if !sensitive[attr] {
+					r.attributes = flattenValue(r.attributes, attr, inst.Attributes[attr])
+				}
+			}
+			entry.resources = append(entry.resources, r)
+		}
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(file.Outputs)) {
+		out := file.Outputs[name]
+		if out.Sensitive {
+			entry.outputs = append(entry.outputs, indexedValue{path: name})
+			continue
+		}
+		values := flattenValue(nil, name, out.Value)
+		if len(values) == 0 {
+			entry.outputs = append(entry.outputs, indexedValue{path: name})
+		}
+		for _, v := range values {
+			entry.outputs = append(entry.outputs, indexedValue{path: name, value: v.value})
+		}
+	}
+	return entry
+}
+
+// sensitiveAttributes returns the top-level attributes that a resource
+// instance's sensitive_attributes mark as sensitive in whole or in part.
+func sensitiveAttributes(paths []json.RawMessage) map[string]bool {
+	sensitive := make(map[string]bool)
+	for _, raw := range paths {
+		var steps []struct {
+			Type  string `json:"type"`
+			Value any    `json:"value"`
+		}
+		if json.Unmarshal(raw, &steps) != nil || len(steps) == 0 {
+			continue
+		}
+		if name, ok := steps[0].Value.(string); ok && steps[0].Type == "get_attr" {
+			sensitive[name] = true
+		}
+	}
+	return sensitive
+}
+
+// flattenValue appends the scalar values within v to values, with their
+// paths below path.
+func flattenValue(values []indexedValue, path string, v any) []indexedValue {
+	switch v := v.(type) {
+	case map[string]any:
+		for _, k := range slices.Sorted(maps.Keys(v)) {
+			values = flattenValue(values, path+"."+k, v[k])
+		}
+	case []any:
+		for i, item := range v {
+			values = flattenValue(values, path+"["+strconv.Itoa(i)+"]", item)
+		}
+	case string:
+		if v != "" {
+			values = append(values, indexedValue{path: path, value: v})
+		}
+	case float64:
+		values = append(values, indexedValue{path: path, value: strconv.FormatFloat(v, 'f', -1, 64)})
+	case bool:
+		values = append(values, indexedValue{path: path, value: strconv.FormatBool(v)})
+	}
+	return values
+}
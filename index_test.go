@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"testing"
+)
+
+const indexTestState = `{
+  "version": 4,
+  "serial": 3,
+  "lineage": "abc",
+  "outputs": {
+    "vpc_id": {"value": "vpc-0a1b2c", "type": "string"},
+    "db_password": {"value": "hunter2", "type": "string", "sensitive": true}
+  },
+  "resources": [
+    {
+      "mode": "managed", "type": "aws_instance", "name": "nat",
+      "instances": [
+        {"index_key": 0, "attributes": {"id": "i-123", "private_ip": "10.0.3.17", "tags": {"Name": "nat-a"}}, "sensitive_attributes": []}
+      ]
+    },
+    {
+      "module": "module.db", "mode": "managed", "type": "aws_db_instance", "name": "main",
+      "instances": [
+        {"attributes": {"arn": "arn:aws:rds:eu-west-1:123:db:main", "password": "hunter2"}, "sensitive_attributes": [[{"type": "get_attr", "value": "password"}]]}
+      ]
+    },
+    {
+      "mode": "data", "type": "aws_ami", "name": "ubuntu",
+      "instances": [{"index_key": "jammy", "attributes": {"id": "ami-42"}}]
+    }
+  ]
+}`
+
+func newTestIndex(t *testing.T) *StateIndex {
+	t.Helper()
+	mock := NewMockStorage()
+	mock.files[statePath("network/prod")] = []byte(indexTestState)
+	mock.files[statePath("empty")] = []byte(`{"version":4,"serial":1,"lineage":"x"}`)
+	index := NewStateIndex(mock)
+	if err := index.Rebuild(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return index
+}
+
+func TestStateIndex_Search(t *testing.T) {
+	index := newTestIndex(t)
+
+	tests := []struct {
+		query, kind string
+		want        []SearchResult
+	}{
+		{"10.0.3.17", SearchAttribute, []SearchResult{
+			{State: "network/prod", Kind: SearchAttribute, Address: "aws_instance.nat[0]", Attribute: "private_ip", Value: "10.0.3.17"},
+		}},
+		{"NAT-A", "", []SearchResult{
+			{State: "network/prod", Kind: SearchAttribute, Address: "aws_instance.nat[0]", Attribute: "tags.Name", Value: "nat-a"},
+		}},
+		{"db_instance", SearchResource, []SearchResult{
+			{State: "network/prod", Kind: SearchResource, Address: "module.db.aws_db_instance.main"},
+		}},
+		{"ubuntu", SearchResource, []SearchResult{
+			{State: "network/prod", Kind: SearchResource, Address: `data.aws_ami.ubuntu["jammy"]`},
+		}},
+		{"vpc-0a", SearchOutput, []SearchResult{
+			{State: "network/prod", Kind: SearchOutput, Output: "vpc_id", Value: "vpc-0a1b2c"},
+		}},
+		{"db_password", SearchOutput, []SearchResult{
+			{State: "network/prod", Kind: SearchOutput, Output: "db_password"},
+		}},
+		{"hunter2", "", nil},
+		{"i-123", SearchOutput, nil},
+	}
+	for _, tt := range tests {
+		resp := index.Search(tt.query, tt.kind)
+		if len(resp.Results) != len(tt.want) {
+			t.Errorf("%s/%s: expected %d results, got %+v", tt.query, tt.kind, len(tt.want), resp.Results)
+			continue
+		}
+		for i := range tt.want {
+			if resp.Results[i] != tt.want[i] {
+				t.Errorf("%s/%s: expected %+v, got %+v", tt.query, tt.kind, tt.want[i], resp.Results[i])
+			}
+		}
+		if resp.States != 2 {
+			t.Errorf("expected 2 indexed states, got %d", resp.States)
+		}
+	}
+}
+
+func TestStateIndex_UpdatedOnWrite(t *testing.T) {
+	handler, _ := newTestHandler()
+	handler.index = NewStateIndex(NewMockStorage())
+
+	w := serveAs(handler, http.MethodPost, "/network/prod", "", indexTestState)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+	if resp := handler.index.Search("i-123", SearchAttribute); len(resp.Results) != 1 {
+		t.Errorf("expected the written state to be searchable, got %+v", resp.Results)
+	}
+
+	handler.index.Remove("network/prod")
+	if resp := handler.index.Search("i-123", ""); len(resp.Results) != 0 {
+		t.Errorf("expected a removed state not to be found, got %+v", resp.Results)
+	}
+}
+
+func TestStateIndex_ServeHTTP(t *testing.T) {
+	index := newTestIndex(t)
+
+	w := serve(index, http.MethodGet, "/api/v1/search?q=vpc&kind=output")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+	var resp SearchResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil || len(resp.Results) != 1 || resp.IndexedAt.IsZero() {
+		t.Errorf("unexpected response %+v, %v", resp, err)
+	}
+
+	for _, target := range []string{"/api/v1/search", "/api/v1/search?q=vpc&kind=module"} {
+		if w := serve(index, http.MethodGet, target); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %d", target, w.Code)
+		}
+	}
+}
+
+func TestStateIndex_Verify(t *testing.T) {
+	mock := NewMockStorage()
+	mock.files[statePath("network/prod")] = []byte(indexTestState)
+	mock.files[statePath("dns")] = []byte(`{"version":4,"serial":1,"lineage":"x","outputs":{"zone":{"value":"example.com"}}}`)
+	index := NewStateIndex(mock)
+	if err := index.Rebuild(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	drift, err := index.Verify(context.Background())
+	if err != nil || !drift.InSync || drift.Checked != 2 {
+		t.Fatalf("expected the index to be in sync, got %+v, %v", drift, err)
+	}
+
+	// Manual changes to the repository
+	mock.files[statePath("dns")] = []byte(`{"version":4,"serial":2,"lineage":"x","outputs":{"zone":{"value":"example.org"}}}`)
+	mock.files[statePath("added")] = []byte(`{"version":4,"serial":1,"lineage":"y"}`)
+	delete(mock.files, statePath("network/prod"))
+
+	drift, err = index.Verify(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if drift.InSync || !slices.Equal(drift.Missing, []string{"added"}) || !slices.Equal(drift.Stale, []string{"dns"}) || !slices.Equal(drift.Orphaned, []string{"network/prod"}) {
+		t.Errorf("unexpected drift %+v", drift)
+	}
+
+	if w := serve(http.HandlerFunc(index.handleRebuild), http.MethodPost, "/admin/index/rebuild"); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+	w := serve(http.HandlerFunc(index.handleVerify), http.MethodGet, "/admin/index/verify")
+	if err := json.NewDecoder(w.Body).Decode(&drift); err != nil || !drift.InSync {
+		t.Errorf("expected the rebuilt index to be in sync, got %+v, %v", drift, err)
+	}
+}
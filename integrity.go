@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"net/http"
+)
+
+// stateChecksum returns the SHA-256 checksum of a state as recorded in its
+// sidecar.
+func stateChecksum(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// parseChecksumSidecar returns the checksum recorded in a sidecar in
+// sha256sum format.
+func parseChecksumSidecar(sidecar []byte) string {
+	checksum, _, _ := bytes.Cut(bytes.TrimSpace(sidecar), []byte(" "))
+	return string(checksum)
+}
+
+// readVerifiedState reads the named state from storage, decompressed, and
+// checks it against its checksum sidecar. States without a sidecar, such as
+// those written to GitHub or GitLab, are returned unchecked. A nil state is
+// missing.
+//
+// The state, its chunks and its sidecar are read one after the other, so a
+// mismatch is read again once in case a commit landed in between.
+func readVerifiedState(ctx context.Context, storage StateStorage, name string) ([]byte, error) {
+	for attempt := 1; ; attempt++ {
+		content, _, err := loadState(ctx, storage, name)
+		if errors.Is(err, errChunksChanged) && attempt < 2 {
+			continue
+		}
+		if err != nil || content == nil {
+			return nil, err
+		}
+		sidecar, _, err := storage.GetFile(ctx, checksumPath(name))
+		if err != nil {
+			return nil, err
+		}
+		if sidecar == nil {
+			return content, nil
+		}
+		want, got := parseChecksumSidecar(sidecar), stateChecksum(content)
+		if got == want {
+			return content, nil
+		}
+		if attempt < 2 {
+			continue
+		}
+		slog.Error("Integrity check of state failed", "state", name, "sha256", got, "recorded", want)
+		return nil, fmt.Errorf("%w: %s has SHA-256 %s but %s records %s; it was changed outside the backend or corrupted. Restore it from the repository history, or update %s if the change was intended",
+			ErrStateIntegrity, statePath(name), got, checksumPath(name), want, checksumPath(name))
+	}
+}
+
+// bodyDigest is a checksum sent with a request body, in Content-MD5 or
+// X-Checksum-SHA256.
+type bodyDigest struct {
+	header    string
+	algorithm string // md5 or sha256
+	want      []byte
+	hash      hash.Hash
+}
+
+// decodeDigest decodes a digest of size bytes sent in hex or base64.
+func decodeDigest(value string, size int) ([]byte, bool) {
+	if b, err := hex.DecodeString(value); err == nil && len(b) == size {
+		return b, true
+	}
+	if b, err := base64.StdEncoding.DecodeString(value); err == nil && len(b) == size {
+		return b, true
+	}
+	return nil, false
+}
+
+// bodyDigests returns the checksums sent with the body of r, if any.
+func bodyDigests(r *http.Request) ([]*bodyDigest, error) {
+	var digests []*bodyDigest
+	for _, d := range []struct {
+		header, algorithm string
+		new               func() hash.Hash
+		size              int
+	}{
+		{"Content-MD5", "md5", md5.New, md5.Size},
+		{"X-Checksum-SHA256", "sha256", sha256.New, sha256.Size},
+	} {
+		value := r.Header.Get(d.header)
+		if value == "" {
+			continue
+		}
+		want, ok := decodeDigest(value, d.size)
+		if !ok {
+			return nil, fmt.Errorf("%w: %s must be a %s digest in base64 or hex", ErrInvalidRequest, d.header, d.algorithm)
+		}
+		digests = append(digests, &bodyDigest{header: d.header, algorithm: d.algorithm, want: want, hash: d.new()})
+	}
+	return digests, nil
+}
+
+// digestReader feeds the body it reads to the digests' hashes.
+func digestReader(body io.ReadCloser, digests []*bodyDigest) io.ReadCloser {
+	writers := make([]io.Writer, len(digests))
+	for i, d := range digests {
+		writers[i] = d.hash
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.TeeReader(body, io.MultiWriter(writers...)), body}
+}
+
+// verifyDigests checks a body read through digestReader against the
+// checksums sent with it.
+func verifyDigests(digests []*bodyDigest) error {
+	for _, d := range digests {
+		if got := d.hash.Sum(nil); !bytes.Equal(got, d.want) {
+			return fmt.Errorf("%w: %s is %s but the body received has %s; the upload was truncated or corrupted on the way, retry it",
+				ErrChecksumMismatch, d.header, hex.EncodeToString(d.want), hex.EncodeToString(got))
+		}
+	}
+	return nil
+}
+
+// uploadChecksum returns the strongest checksum sent with the body of r, as
+// algorithm:hex, or "" if none was sent.
+func uploadChecksum(r *http.Request) string {
+	digests, err := bodyDigests(r)
+	if err != nil || len(digests) == 0 {
+		return ""
+	}
+	d := digests[len(digests)-1]
+	return d.algorithm + ":" + hex.EncodeToString(d.want)
+}
+
+type uploadChecksumKey struct{}
+
+// withUploadChecksum returns a context naming the verified checksum of the
+// state upload being committed, for its commit message.
+func withUploadChecksum(ctx context.Context, checksum string) context.Context {
+	return context.WithValue(ctx, uploadChecksumKey{}, checksum)
+}
+
+// uploadChecksumFrom returns the checksum set with withUploadChecksum, if any.
+func uploadChecksumFrom(ctx context.Context) string {
+	checksum, _ := ctx.Value(uploadChecksumKey{}).(string)
+	return checksum
+}
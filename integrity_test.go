@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGetState_VerifiesChecksum(t *testing.T) {
+	storage := newTestLocalGitClient(t)
+	handler := NewStateHandler(storage, DefaultMaxBodySize)
+	postState(t, handler, `{"version":4,"serial":1,"lineage":"abc"}`)
+	if w := serve(handler, http.MethodGet, "/network"); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// An edit outside the backend leaves the sidecar behind
+	ctx := context.Background()
+	if err := storage.CreateOrUpdateFile(ctx, statePath("network"), []byte(`{"version":4,"serial":9,"lineage":"abc"}`), "manual edit"); err != nil {
+		t.Fatal(err)
+	}
+	w := serve(handler, http.MethodGet, "/network")
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("expected status 500, got %d: %s", w.Code, w.Body.String())
+	}
+	var body struct {
+		Code  string `json:"code"`
+		Error string `json:"error"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Code != "state_integrity" || !strings.Contains(body.Error, checksumPath("network")) {
+		t.Errorf("expected an integrity error naming the sidecar, got %+v", body)
+	}
+
+	handler.verifyReads = false
+	if w := serve(handler, http.MethodGet, "/network"); w.Code != http.StatusOK {
+		t.Errorf("expected status 200 without verification, got %d", w.Code)
+	}
+}
+
+func TestGetState_WithoutChecksum(t *testing.T) {
+	// Storages without multi-file commits write no sidecar
+	handler, _ := newTestHandler()
+	postState(t, handler, `{"version":4,"serial":1,"lineage":"abc"}`)
+	if w := serve(handler, http.MethodGet, "/network"); w.Code != http.StatusOK {
+		t.Errorf("expected status 200, got %d", w.Code)
+	}
+}
+
+func TestGetState_VerifiesCompressedState(t *testing.T) {
+	withStateCompression(t, CompressionZstd)
+	handler := NewStateHandler(newTestLocalGitClient(t), DefaultMaxBodySize)
+	postState(t, handler, `{"version":4,"serial":1,"lineage":"abc"}`)
+	if w := serve(handler, http.MethodGet, "/network"); w.Code != http.StatusOK {
+		t.Errorf("expected the checksum of the uncompressed state to match, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func postWithHeader(handler http.Handler, header, value, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/network", strings.NewReader(body))
+	req.Header.Set(header, value)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+func TestPostState_VerifiesUploadChecksum(t *testing.T) {
+	storage := newTestLocalGitClient(t)
+	handler := NewStateHandler(storage, DefaultMaxBodySize)
+	body := `{"version":4,"serial":1,"lineage":"abc"}`
+	md5sum := md5.Sum([]byte(body))
+	sha := sha256.Sum256([]byte(body))
+
+	// Terraform sends Content-MD5 in base64
+	if w := postWithHeader(handler, "Content-MD5", base64.StdEncoding.EncodeToString(md5sum[:]), body); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	commits, err := storage.ListCommits(statePath("network"), 1)
+	if err != nil || len(commits) != 1 {
+		t.Fatalf("expected a commit, got %v, %v", commits, err)
+	}
+	if !strings.Contains(commits[0].Message, "Upload-Checksum: md5:"+hex.EncodeToString(md5sum[:])) {
+		t.Errorf("expected the checksum in the commit message, got %q", commits[0].Message)
+	}
+
+	// A truncated upload is not committed
+	w := postWithHeader(handler, "X-Checksum-SHA256", hex.EncodeToString(sha[:]), body[:len(body)-5])
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "checksum_mismatch") {
+		t.Errorf("expected a checksum mismatch, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := postWithHeader(handler, "X-Checksum-SHA256", "not-a-digest", body); w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for a malformed checksum, got %d", w.Code)
+	}
+	if commits, _ := storage.ListCommits(statePath("network"), 0); len(commits) != 1 {
+		t.Errorf("expected no further commits, got %d", len(commits))
+	}
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// backgroundJobs are the names of the periodic background jobs, as they are
+// configured in JOB_TIMEOUTS and JOBS_PAUSED and controlled at /admin/jobs.
+var backgroundJobs = []string{
+	"credential-reload",
+	"tenant-reload",
+	"degradation",
+	"search-index",
+	"archive",
+	"state-deletion",
+	"replica-probe",
+	"repo-topics",
+	"repo-size",
+}
+
+// parseJobTimeouts parses a comma-separated list of job=duration pairs.
+func parseJobTimeouts(s string) (map[string]time.Duration, error) {
+	timeouts := make(map[string]time.Duration)
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(entry, "=")
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		if !ok || value == "" {
+			return nil, fmt.Errorf("invalid timeout %q: must be job=duration", entry)
+		}
+		if !slices.Contains(backgroundJobs, name) {
+			return nil, fmt.Errorf("unknown job %q; jobs are %s", name, strings.Join(backgroundJobs, ", "))
+		}
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("timeout of %s must be a valid duration: %w", name, err)
+		}
+		if d < 0 {
+			return nil, fmt.Errorf("timeout of %s must not be negative", name)
+		}
+		timeouts[name] = d
+	}
+	return timeouts, nil
+}
+
+// parseJobNames parses a comma-separated list of job names.
+func parseJobNames(s string) ([]string, error) {
+	var names []string
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !slices.Contains(backgroundJobs, name) {
+			return nil, fmt.Errorf("unknown job %q; jobs are %s", name, strings.Join(backgroundJobs, ", "))
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// errJobCancelled is the cause of a run cancelled at /admin/jobs.
+var errJobCancelled = errors.New("cancelled by an administrator")
+
+// Jobs schedules the periodic background jobs. Each run is limited by the
+// job's timeout, and by the number of runs allowed at once across jobs. Jobs
+// can be paused, resumed, triggered and their running run cancelled at
+// /admin/jobs, so that a misbehaving one is stopped without a redeploy.
+type Jobs struct {
+	timeout  time.Duration            // Limit on a run; 0 is none
+	timeouts map[string]time.Duration // Per job, overriding timeout
+	paused   []string                 // Jobs paused at startup
+	slots    chan struct{}            // Runs allowed at once; nil is unlimited
+
+	mu   sync.Mutex
+	jobs map[string]*job
+}
+
+// job is a scheduled background job.
+type job struct {
+	name     string
+	interval time.Duration
+	timeout  time.Duration
+	trigger  chan struct{} // Signalled to run now
+	paused   atomic.Bool
+
+	mu       sync.Mutex
+	cancel   context.CancelCauseFunc // Of the running run; nil if idle
+	started  time.Time               // Of the running or last run
+	finished time.Time
+	lastErr  error
+	runs     int
+}
+
+// NewJobs creates a scheduler limiting each run to timeout, or a job's own
+// entry in timeouts, with the jobs named in paused paused, and concurrency
+// runs at once. Zero timeouts and concurrency are unlimited.
+func NewJobs(timeout time.Duration, timeouts map[string]time.Duration, paused []string, concurrency int) *Jobs {
+	js := &Jobs{
+		timeout:  timeout,
+		timeouts: timeouts,
+		paused:   paused,
+		jobs:     make(map[string]*job),
+	}
+	if concurrency > 0 {
+		js.slots = make(chan struct{}, concurrency)
+	}
+	return js
+}
+
+// Run runs fn as the job name immediately, then every interval and whenever
+// it is triggered, until ctx is cancelled. Runs are skipped while the job is
+// paused, unless triggered. Errors and panics are logged and do not stop the
+// schedule.
+func (js *Jobs) Run(ctx context.Context, name string, interval time.Duration, fn func(context.Context) error) {
+	j := js.add(name, interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	triggered := false
+	for {
+		if triggered || !j.paused.Load() {
+			if err := js.run(ctx, j, fn); err != nil && ctx.Err() == nil {
+				slog.Error("Background job failed", "job", name, "error", err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			triggered = false
+		case <-j.trigger:
+			triggered = true
+		}
+	}
+}
+
+// add registers the job name.
+func (js *Jobs) add(name string, interval time.Duration) *job {
+	j := &job{name: name, interval: interval, timeout: js.timeout, trigger: make(chan struct{}, 1)}
+	if timeout, ok := js.timeouts[name]; ok {
+		j.timeout = timeout
+	}
+	if slices.Contains(js.paused, name) {
+		j.paused.Store(true)
+		slog.Info("Background job is paused; resume it with POST /admin/jobs/{job}/resume", "job", name)
+	}
+	js.mu.Lock()
+	js.jobs[name] = j
+	js.mu.Unlock()
+	return j
+}
+
+// run runs fn once as j, once a slot is free, within j's timeout.
+func (js *Jobs) run(ctx context.Context, j *job, fn func(context.Context) error) error {
+	if js.slots != nil {
+		select {
+		case js.slots <- struct{}{}:
+			defer func() { <-js.slots }()
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	runCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	if j.timeout > 0 {
+		var cancelTimeout context.CancelFunc
+		runCtx, cancelTimeout = context.WithTimeoutCause(runCtx, j.timeout, fmt.Errorf("timed out after %s", j.timeout))
+		defer cancelTimeout()
+	}
+
+	j.mu.Lock()
+	j.cancel, j.started = cancel, time.Now()
+	j.mu.Unlock()
+
+	err := runJob(runCtx, j.name, fn)
+	if err != nil && runCtx.Err() != nil && ctx.Err() == nil {
+		// Report why the run was cut short rather than how fn noticed
+		err = context.Cause(runCtx)
+	}
+
+	j.mu.Lock()
+	j.cancel, j.finished, j.lastErr = nil, time.Now(), err
+	j.runs++
+	j.mu.Unlock()
+	return err
+}
+
+// runJob runs fn once, recovering from a panic in it.
+func runJob(ctx context.Context, name string, fn func(context.Context) error) error {
+	defer recoverJob(name)
+	return fn(ctx)
+}
+
+// jobStatus is a job as reported at /admin/jobs.
+type jobStatus struct {
+	Name         string     `json:"name"`
+	Interval     string     `json:"interval"`
+	Timeout      string     `json:"timeout,omitempty"`
+	Paused       bool       `json:"paused"`
+	Running      bool       `json:"running"`
+	Runs         int        `json:"runs"`
+	LastStarted  *time.Time `json:"last_started,omitempty"`
+	LastFinished *time.Time `json:"last_finished,omitempty"`
+	LastError    string     `json:"last_error,omitempty"`
+}
+
+// status reports j.
+func (j *job) status() jobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	s := jobStatus{
+		Name:     j.name,
+		Interval: j.interval.String(),
+		Paused:   j.paused.Load(),
+		Running:  j.cancel != nil,
+		Runs:     j.runs,
+	}
+	if j.timeout > 0 {
+		s.Timeout = j.timeout.String()
+	}
+	if !j.started.IsZero() {
+		started := j.started.UTC()
+		s.LastStarted = &started
+	}
+	if !j.finished.IsZero() {
+		finished := j.finished.UTC()
+		s.LastFinished = &finished
+	}
+	if j.lastErr != nil {
+		s.LastError = j.lastErr.Error()
+	}
+	return s
+}
+
+// handleList serves GET /admin/jobs, listing the scheduled jobs.
+func (js *Jobs) handleList(w http.ResponseWriter, r *http.Request) {
+	js.mu.Lock()
+	statuses := make([]jobStatus, 0, len(js.jobs))
+	for _, j := range js.jobs {
+		statuses = append(statuses, j.status())
+	}
+	js.mu.Unlock()
+	sort.Slice(statuses, func(a, b int) bool { return statuses[a].Name < statuses[b].Name })
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(statuses)
+}
+
+// handleControl serves POST /admin/jobs/{name}/{action}: pause and resume
+// the job's schedule, run it now, or cancel its running run.
+func (js *Jobs) handleControl(w http.ResponseWriter, r *http.Request) {
+	name, action := r.PathValue("name"), r.PathValue("action")
+	js.mu.Lock()
+	j, ok := js.jobs[name]
+	js.mu.Unlock()
+	if !ok {
+		writeError(w, fmt.Errorf("%w: no background job %s is scheduled", ErrNotFound, name))
+		return
+	}
+
+	switch action {
+	case "pause":
+		if !j.paused.Swap(true) {
+			slog.Info("Paused background job", "job", name)
+		}
+	case "resume":
+		if j.paused.Swap(false) {
+			slog.Info("Resumed background job", "job", name)
+		}
+	case "run":
+		select {
+		case j.trigger <- struct{}{}:
+			slog.Info("Triggered background job", "job", name)
+		default:
+			// A run is already due
+		}
+	case "cancel":
+		j.mu.Lock()
+		cancel := j.cancel
+		j.mu.Unlock()
+		if cancel == nil {
+			writeError(w, fmt.Errorf("%w: background job %s is not running", ErrJobNotRunning, name))
+			return
+		}
+		cancel(errJobCancelled)
+		slog.Info("Cancelled the running run of background job", "job", name)
+	default:
+		writeError(w, fmt.Errorf("%w: unknown action %q; use pause, resume, run or cancel", ErrNotFound, action))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(j.status())
+}
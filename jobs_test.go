@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJobs_RunsUntilCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	runs := make(chan struct{}, 10)
+
+	done := make(chan struct{})
+	go func() {
+		NewJobs(0, nil, nil, 0).Run(ctx, "test", time.Millisecond, func(context.Context) error {
+			select {
+			case runs <- struct{}{}:
+			default:
+			}
+			return errors.New("keep going")
+		})
+		close(done)
+	}()
+
+	// Errors must not stop the schedule
+	for i := 0; i < 3; i++ {
+		select {
+		case <-runs:
+		case <-time.After(time.Second):
+			t.Fatalf("job ran %d times, expected at least 3", i)
+		}
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Run did not return after cancellation")
+	}
+}
+
+// waitForJob blocks until the job name of js matches cond.
+func waitForJob(t *testing.T, js *Jobs, name string, cond func(jobStatus) bool) jobStatus {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		js.mu.Lock()
+		j := js.jobs[name]
+		js.mu.Unlock()
+		if j != nil {
+			if s := j.status(); cond(s) {
+				return s
+			}
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("job %s did not reach the expected state", name)
+	return jobStatus{}
+}
+
+// blockingJob runs until it is cancelled.
+func blockingJob(ctx context.Context) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func newTestJobsMux(js *Jobs) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /admin/jobs", js.handleList)
+	mux.HandleFunc("POST /admin/jobs/{name}/{action}", js.handleControl)
+	return mux
+}
+
+func TestJobs_Timeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	js := NewJobs(time.Hour, map[string]time.Duration{"test": 10 * time.Millisecond}, nil, 0)
+	go js.Run(ctx, "test", time.Hour, blockingJob)
+
+	s := waitForJob(t, js, "test", func(s jobStatus) bool { return s.Runs == 1 })
+	if !strings.Contains(s.LastError, "timed out after 10ms") {
+		t.Errorf("expected the run to time out, got %q", s.LastError)
+	}
+}
+
+func TestJobs_AdminControls(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	js := NewJobs(0, nil, []string{"test"}, 0)
+	mux := newTestJobsMux(js)
+	go js.Run(ctx, "test", time.Hour, blockingJob)
+
+	// Paused at startup, the job does not run until triggered
+	waitForJob(t, js, "test", func(s jobStatus) bool { return s.Paused })
+	time.Sleep(10 * time.Millisecond)
+	if s := waitForJob(t, js, "test", func(jobStatus) bool { return true }); s.Running || s.Runs != 0 {
+		t.Fatalf("expected the paused job not to run, got %+v", s)
+	}
+	if w := serve(mux, http.MethodPost, "/admin/jobs/test/run"); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+	}
+	waitForJob(t, js, "test", func(s jobStatus) bool { return s.Running })
+
+	if w := serve(mux, http.MethodPost, "/admin/jobs/test/cancel"); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+	}
+	s := waitForJob(t, js, "test", func(s jobStatus) bool { return s.Runs == 1 })
+	if s.LastError != errJobCancelled.Error() {
+		t.Errorf("expected the run to be cancelled, got %q", s.LastError)
+	}
+	if w := serve(mux, http.MethodPost, "/admin/jobs/test/cancel"); w.Code != http.StatusConflict {
+		t.Errorf("expected status 409 cancelling an idle job, got %d", w.Code)
+	}
+
+	if w := serve(mux, http.MethodPost, "/admin/jobs/test/resume"); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+	w := serve(mux, http.MethodGet, "/admin/jobs")
+	var statuses []jobStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &statuses); err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != 1 || statuses[0].Name != "test" || statuses[0].Paused {
+		t.Errorf("expected the resumed job to be listed, got %+v", statuses)
+	}
+
+	for _, target := range []string{"/admin/jobs/other/run", "/admin/jobs/test/restart"} {
+		if w := serve(mux, http.MethodPost, target); w.Code != http.StatusNotFound {
+			t.Errorf("%s: expected status 404, got %d", target, w.Code)
+		}
+	}
+}
+
+func TestJobs_Concurrency(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	js := NewJobs(0, nil, nil, 1)
+	go js.Run(ctx, "first", time.Hour, blockingJob)
+	waitForJob(t, js, "first", func(s jobStatus) bool { return s.Running })
+
+	second := make(chan struct{})
+	go js.Run(ctx, "second", time.Hour, func(context.Context) error {
+		close(second)
+		return nil
+	})
+	select {
+	case <-second:
+		t.Fatal("expected the second job to wait for the running one")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	js.mu.Lock()
+	js.jobs["first"].cancel(errJobCancelled)
+	js.mu.Unlock()
+	select {
+	case <-second:
+	case <-time.After(time.Second):
+		t.Fatal("expected the second job to run once the first finished")
+	}
+}
+
+func TestParseJobTimeouts(t *testing.T) {
+	timeouts, err := parseJobTimeouts("archive=30m, search-index=5m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if timeouts["archive"] != 30*time.Minute || timeouts["search-index"] != 5*time.Minute {
+		t.Errorf("unexpected timeouts %v", timeouts)
+	}
+	for _, invalid := range []string{"archive", "archive=soon", "archive=-1m", "reaper=1m"} {
+		if _, err := parseJobTimeouts(invalid); err == nil {
+			t.Errorf("expected error for %q", invalid)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// DefaultStatePathTemplate is where states are stored in the repository.
+const DefaultStatePathTemplate = "states/{name}/terraform.tfstate"
+
+// stateLayout places state files in the repository: a state's file is
+// prefix + name + suffix.
+type stateLayout struct {
+	prefix string
+	suffix string
+}
+
+// layout is the layout in use, set from STATE_PATH_TEMPLATE at startup.
+var layout = stateLayout{prefix: "states/", suffix: "/terraform.tfstate"}
+
+// parseStatePathTemplate parses a STATE_PATH_TEMPLATE such as
+// "{name}.tfstate", in which {name} stands for the state name.
+func parseStatePathTemplate(tmpl string) (stateLayout, error) {
+	prefix, suffix, ok := strings.Cut(tmpl, "{name}")
+	switch {
+	case !ok || strings.Contains(suffix, "{name}"):
+		return stateLayout{}, fmt.Errorf("must contain {name} once")
+	case suffix == "" || suffix == "/":
+		return stateLayout{}, fmt.Errorf("must not end with {name}")
+	case strings.HasPrefix(tmpl, "/") || path.Clean(tmpl) != tmpl || strings.Contains(tmpl, ".."):
+		return stateLayout{}, fmt.Errorf("must be a clean relative path")
+	case strings.HasPrefix(tmpl, "archive/"):
+		return stateLayout{}, fmt.Errorf("archive/ is reserved for archived states")
+	}
+	return stateLayout{prefix: prefix, suffix: suffix}, nil
+}
+
+// useStatePathTemplate switches to the layout of tmpl.
+func useStatePathTemplate(tmpl string) error {
+	l, err := parseStatePathTemplate(tmpl)
+	if err != nil {
+		return fmt.Errorf("STATE_PATH_TEMPLATE %w", err)
+	}
+	layout = l
+	return nil
+}
+
+// statePath returns the path to the state file for a given state name.
+func statePath(name string) string {
+	return layout.prefix + name + layout.suffix
+}
+
+// stateNameFromPath is the inverse of statePath.
+// Returns false if path is not a state file path.
+func stateNameFromPath(p string) (string, bool) {
+	if strings.HasPrefix(p, "archive/") {
+		return "", false
+	}
+	rest, ok := strings.CutPrefix(p, layout.prefix)
+	if !ok {
+		return "", false
+	}
+	name, ok := strings.CutSuffix(rest, layout.suffix)
+	if !ok || name == "" {
+		return "", false
+	}
+	return name, true
+}
+
+// sidecarPath returns the path of a file kept with the named state: in the
+// state's directory when each state has one, as in the default layout, or
+// next to the state file otherwise.
+func sidecarPath(name, file string) string {
+	if strings.HasPrefix(layout.suffix, "/") {
+		return layout.prefix + name + "/" + file
+	}
+	return statePath(name) + "." + file
+}
+
+// stateNameFromSidecar is the inverse of sidecarPath.
+func stateNameFromSidecar(p, file string) (string, bool) {
+	if strings.HasPrefix(p, "archive/") {
+		return "", false
+	}
+	rest, ok := strings.CutPrefix(p, layout.prefix)
+	if !ok {
+		return "", false
+	}
+	suffix := "/" + file
+	if !strings.HasPrefix(layout.suffix, "/") {
+		suffix = layout.suffix + "." + file
+	}
+	name, ok := strings.CutSuffix(rest, suffix)
+	if !ok || name == "" {
+		return "", false
+	}
+	return name, true
+}
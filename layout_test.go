@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+// withStatePathTemplate switches to the layout of tmpl for the test.
+func withStatePathTemplate(t *testing.T, tmpl string) {
+	t.Helper()
+	previous := layout
+	t.Cleanup(func() { layout = previous })
+	if err := useStatePathTemplate(tmpl); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseStatePathTemplate(t *testing.T) {
+	valid := map[string]stateLayout{
+		DefaultStatePathTemplate:     {"states/", "/terraform.tfstate"},
+		"{name}.tfstate":             {"", ".tfstate"},
+		"env/{name}/default.tfstate": {"env/", "/default.tfstate"},
+	}
+	for tmpl, want := range valid {
+		if got, err := parseStatePathTemplate(tmpl); err != nil || got != want {
+			t.Errorf("parseStatePathTemplate(%q) = %+v, %v; want %+v", tmpl, got, err, want)
+		}
+	}
+
+	for _, tmpl := range []string{"states/terraform.tfstate", "{name}/{name}.tfstate", "states/{name}", "/{name}.tfstate", "a/../{name}.tfstate", "archive/{name}.tfstate"} {
+		if _, err := parseStatePathTemplate(tmpl); err == nil {
+			t.Errorf("expected error for %q", tmpl)
+		}
+	}
+}
+
+func TestStatePaths(t *testing.T) {
+	if path := deletionPath("a/b"); path != "states/a/b/deletion.json" {
+		t.Errorf("unexpected default deletion marker path %q", path)
+	}
+
+	withStatePathTemplate(t, "{name}.tfstate")
+	tests := []struct{ got, want string }{
+		{statePath("network"), "network.tfstate"},
+		{checksumPath("network"), "network.tfstate.sha256"},
+		{metadataPath("network"), "network.tfstate.metadata.json"},
+		{deletionPath("network"), "network.tfstate.deletion.json"},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("expected %q, got %q", tt.want, tt.got)
+		}
+	}
+
+	if name, ok := stateNameFromPath("team/network.tfstate"); !ok || name != "team/network" {
+		t.Errorf("unexpected state name %q, %v", name, ok)
+	}
+	for _, path := range []string{"network.tfstate.sha256", "archive/network/terraform.tfstate", ".tfstate"} {
+		if _, ok := stateNameFromPath(path); ok {
+			t.Errorf("expected %q not to be a state path", path)
+		}
+	}
+	if name, ok := stateNameFromSidecar("network.tfstate.deletion.json", "deletion.json"); !ok || name != "network" {
+		t.Errorf("unexpected state name %q, %v", name, ok)
+	}
+}
+
+func TestFlatLayout(t *testing.T) {
+	withStatePathTemplate(t, "{name}.tfstate")
+	storage := newTestLocalGitClient(t)
+	handler := NewStateHandler(storage, DefaultMaxBodySize)
+	ctx := context.Background()
+
+	// An existing state in the flat layout is served as it is
+	if err := storage.CreateOrUpdateFile(ctx, "network.tfstate", []byte(`{"version":4,"serial":3,"lineage":"abc"}`), "manual commit"); err != nil {
+		t.Fatal(err)
+	}
+	if w := serve(handler, http.MethodGet, "/network"); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+	if states, err := findLegacyStates(storage); err != nil || len(states) != 0 {
+		t.Errorf("expected states in the layout in use not to be reported as legacy, got %v", states)
+	}
+
+	if w := serveAs(handler, http.MethodPost, "/network", "", `{"version":4,"serial":4,"lineage":"abc"}`); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+	for _, path := range []string{"network.tfstate.sha256", "network.tfstate.metadata.json"} {
+		if content, _, _ := storage.GetFile(ctx, path); content == nil {
+			t.Errorf("expected %s next to the state", path)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// legacyState is a state stored outside the states/ layout, as left behind by
+// committing Terraform's local state files to the repository.
+type legacyState struct {
+	Path string `json:"path"`
+	Name string `json:"name"` // State name the file migrates to
+}
+
+// legacyStateName returns the state name for a file in a legacy layout:
+// {name}.tfstate in the repository root, with terraform.tfstate mapping to
+// "default", or terraform.tfstate.d/{workspace}/terraform.tfstate as written
+// by Terraform's local backend for workspaces.
+func legacyStateName(path string) (string, bool) {
+	if workspace, ok := strings.CutPrefix(path, "terraform.tfstate.d/"); ok {
+		name, ok := strings.CutSuffix(workspace, "/terraform.tfstate")
+		return name, ok && name != "" && !strings.Contains(name, "/")
+	}
+	if strings.Contains(path, "/") {
+		return "", false
+	}
+	if path == "terraform.tfstate" {
+		return "default", true
+	}
+	name, ok := strings.CutSuffix(path, ".tfstate")
+	return name, ok && name != ""
+}
+
+// findLegacyStates lists the states stored in a legacy layout.
+func findLegacyStates(storage ArchiveStorage) ([]legacyState, error) {
+	paths, err := storage.ListFiles("")
+	if err != nil {
+		return nil, err
+	}
+
+	var states []legacyState
+	for _, path := range paths {
+		if _, ok := stateNameFromPath(path); ok {
+			continue // Already in the layout in use
+		}
+		if name, ok := legacyStateName(path); ok {
+			states = append(states, legacyState{Path: path, Name: name})
+		}
+	}
+	return states, nil
+}
+
+// reportLegacyStates logs the states found in a legacy layout at startup.
+func reportLegacyStates(storage ArchiveStorage) {
+	states, err := findLegacyStates(storage)
+	if err != nil {
+		slog.Error("Failed to scan for states in a legacy layout", "error", err)
+		return
+	}
+	for _, s := range states {
+		slog.Warn("Found state in a legacy layout", "state", s.Name, "path", s.Path, "migrates_to", statePath(s.Name))
+	}
+	if len(states) > 0 {
+		slog.Warn("Migrate the legacy states with POST /admin/migrate", "states", len(states))
+	}
+}
+
+// migrationResult reports the outcome of migrating one legacy state.
+type migrationResult struct {
+	legacyState
+	Error string `json:"error,omitempty"`
+}
+
+// migrateLegacyState moves a legacy state into states/, with its sidecars,
+// in a single commit where the storage supports it. States that already
+// exist in states/ or are locked are left alone.
+func (h *StateHandler) migrateLegacyState(ctx context.Context, storage ArchiveStorage, s legacyState) error {
+	if _, endpoint, ok := cutStateEndpoint(s.Name); ok {
+		return fmt.Errorf("state name %s ends in %s, which is reserved; rename %s first", s.Name, endpoint.suffix, s.Path)
+	}
+	if h.IsLocked(s.Name) {
+		return fmt.Errorf("state %s is locked", s.Name)
+	}
+	current, err := h.checkSerialRegression(ctx, s.Name, nil)
+	if err != nil {
+		return err
+	}
+	if current.exists {
+		return fmt.Errorf("%s already exists", statePath(s.Name))
+	}
+
+	content, sha, err := storage.GetFile(ctx, s.Path)
+	if err != nil {
+		return err
+	}
+	if content == nil {
+		return fmt.Errorf("%s no longer exists", s.Path)
+	}
+	header, _ := parseStateHeader(content)
+	content = indentState(content)
+
+	message := stateCommitMessage(OpMigrate, s.Name, fmt.Sprintf("Migrate state %s to %s", s.Path, statePath(s.Name)))
+	if committer, ok := storage.(FileCommitter); ok {
+		changes, err := stateChanges(s.Name, content, header, "", current)
+		if err != nil {
+			return err
+		}
+		return committer.CommitFiles(ctx, message, append(changes, FileChange{Path: s.Path, SHA: sha}))
+	}
+
+	stored, err := encodeState(content)
+	if err != nil {
+		return err
+	}
+	if err := storage.CreateOrUpdateFile(ctx, statePath(s.Name), stored, message); err != nil {
+		return err
+	}
+	return storage.DeleteFile(ctx, s.Path, sha, message)
+}
+
+// handleMigrate serves /admin/migrate: GET lists the states found in a legacy
+// layout, POST migrates them into states/.
+func (h *StateHandler) handleMigrate(w http.ResponseWriter, r *http.Request) {
+	storage, ok := h.storage.(ArchiveStorage)
+	if !ok {
+		writeError(w, fmt.Errorf("%w: the storage backend cannot list legacy states", ErrNotFound))
+		return
+	}
+
+	states, err := findLegacyStates(storage)
+	if err != nil {
+		slog.Error("Error scanning for legacy states", "error", err)
+		writeError(w, err)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if states == nil {
+			states = []legacyState{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(states)
+	case http.MethodPost:
+		results := []migrationResult{}
+		for _, s := range states {
+			result := migrationResult{legacyState: s}
+			if err := h.migrateLegacyState(r.Context(), storage, s); err != nil {
+				slog.Error("Failed to migrate legacy state", "state", s.Name, "path", s.Path, "error", err)
+				result.Error = err.Error()
+			} else {
+				slog.Info("Migrated legacy state", "state", s.Name, "path", s.Path, "migrated_to", statePath(s.Name))
+			}
+			results = append(results, result)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(results)
+	default:
+		h.methodNotAllowed(w, r, http.MethodGet, http.MethodPost)
+	}
+}
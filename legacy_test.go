@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestLegacyStateName(t *testing.T) {
+	tests := []struct {
+		path string
+		name string
+		ok   bool
+	}{
+		{"terraform.tfstate", "default", true},
+		{"network.tfstate", "network", true},
+		{"terraform.tfstate.d/prod/terraform.tfstate", "prod", true},
+		{"terraform.tfstate.backup", "", false},
+		{"states/myproject/terraform.tfstate", "", false},
+		{"modules/vpc/terraform.tfstate", "", false},
+		{"terraform.tfstate.d/prod/nested/terraform.tfstate", "", false},
+		{".tfstate", "", false},
+	}
+
+	for _, tt := range tests {
+		name, ok := legacyStateName(tt.path)
+		if ok != tt.ok || ok && name != tt.name {
+			t.Errorf("legacyStateName(%q) = %q, %v; want %q, %v", tt.path, name, ok, tt.name, tt.ok)
+		}
+	}
+}
+
+func TestMigrateLegacyStates(t *testing.T) {
+	storage := newTestLocalGitClient(t)
+	handler := NewStateHandler(storage, DefaultMaxBodySize)
+	ctx := context.Background()
+
+	legacy := map[string]string{
+		"terraform.tfstate":                          `{"version":4,"serial":3,"lineage":"abc"}`,
+		"terraform.tfstate.d/prod/terraform.tfstate": `{"version":4,"serial":7,"lineage":"def"}`,
+		"taken.tfstate":                              `{"version":4,"serial":1,"lineage":"ghi"}`,
+	}
+	for path, content := range legacy {
+		if err := storage.CreateOrUpdateFile(ctx, path, []byte(content), "manual commit"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := storage.CreateOrUpdateFile(ctx, statePath("taken"), []byte(`{"version":4,"serial":9,"lineage":"jkl"}`), "create"); err != nil {
+		t.Fatal(err)
+	}
+
+	w := serve(http.HandlerFunc(handler.handleMigrate), http.MethodGet, "/admin/migrate")
+	var found []legacyState
+	if err := json.Unmarshal(w.Body.Bytes(), &found); err != nil || len(found) != 3 {
+		t.Fatalf("expected 3 legacy states, got %s", w.Body.String())
+	}
+
+	w = serve(http.HandlerFunc(handler.handleMigrate), http.MethodPost, "/admin/migrate")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+	var results []migrationResult
+	if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil {
+		t.Fatalf("expected JSON results: %v", err)
+	}
+	for _, result := range results {
+		if (result.Name == "taken") != (result.Error != "") {
+			t.Errorf("unexpected result for %s: %q", result.Path, result.Error)
+		}
+	}
+
+	for path, name := range map[string]string{"terraform.tfstate": "default", "terraform.tfstate.d/prod/terraform.tfstate": "prod"} {
+		if content, _, _ := storage.GetFile(ctx, path); content != nil {
+			t.Errorf("expected %s to be removed", path)
+		}
+		content, _, _ := storage.GetFile(ctx, statePath(name))
+		header, err := parseStateHeader(content)
+		if err != nil || header.Lineage != map[string]string{"default": "abc", "prod": "def"}[name] {
+			t.Errorf("expected %s to hold the migrated state, got %s", statePath(name), content)
+		}
+		if content, _, _ := storage.GetFile(ctx, checksumPath(name)); content == nil {
+			t.Errorf("expected a checksum for %s", name)
+		}
+	}
+	if content, _, _ := storage.GetFile(ctx, "taken.tfstate"); content == nil {
+		t.Error("expected the conflicting legacy state to be kept")
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// unixSocketPrefix precedes the path of a Unix domain socket in a listener
+// address, as in unix:///run/tf-backend.sock.
+const unixSocketPrefix = "unix://"
+
+// Listener is one address the server listens on, with its own options.
+type Listener struct {
+	Addr string // host:port, unix:// and the path of a Unix domain socket, or systemd: and a socket name
+
+	// TLS serves HTTPS with TLS_CERT_FILE and TLS_KEY_FILE
+	TLS bool
+
+	// Redirect answers every request with a redirect to the same URL on the
+	// first TLS listener, for clients being moved over to HTTPS
+	Redirect bool
+
+	// SecurityHeaders overrides SECURITY_HEADERS for this listener, if set
+	SecurityHeaders *bool
+}
+
+// String returns the listener as given in LISTENERS.
+func (l Listener) String() string {
+	s := l.Addr
+	if l.TLS {
+		s += " tls"
+	}
+	if l.Redirect {
+		s += " redirect"
+	}
+	if l.SecurityHeaders != nil {
+		s += " security_headers=" + strconv.FormatBool(*l.SecurityHeaders)
+	}
+	return s
+}
+
+// parseListeners parses LISTENERS: comma-separated addresses, each followed
+// by its options, such as "0.0.0.0:8080 redirect, [::]:8443 tls".
+func parseListeners(s string) ([]Listener, error) {
+	var listeners []Listener
+	hasTLS := false
+	for _, entry := range strings.Split(s, ",") {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 {
+			continue
+		}
+		l := Listener{Addr: fields[0]}
+		if path, ok := socketPath(l.Addr); ok {
+			if path == "" {
+				return nil, fmt.Errorf("invalid address %q: the socket path is missing", l.Addr)
+			}
+		} else if strings.HasPrefix(l.Addr, systemdPrefix) {
+			// Checked once systemd's sockets are taken
+		} else if _, _, err := net.SplitHostPort(l.Addr); err != nil {
+			return nil, fmt.Errorf("invalid address %q: %w", l.Addr, err)
+		}
+		for _, option := range fields[1:] {
+			key, value, hasValue := strings.Cut(option, "=")
+			switch {
+			case key == "tls" && !hasValue:
+				l.TLS = true
+			case key == "redirect" && !hasValue:
+				l.Redirect = true
+			case key == "security_headers" && hasValue:
+				b, err := strconv.ParseBool(value)
+				if err != nil {
+					return nil, fmt.Errorf("%s: security_headers must be a boolean: %w", l.Addr, err)
+				}
+				l.SecurityHeaders = &b
+			default:
+				return nil, fmt.Errorf("%s: unknown option %q; options are tls, redirect and security_headers=true|false", l.Addr, option)
+			}
+		}
+		if l.TLS && l.Redirect {
+			return nil, fmt.Errorf("%s: a TLS listener cannot redirect to itself", l.Addr)
+		}
+		if _, unix := socketPath(l.Addr); !unix {
+			hasTLS = hasTLS || l.TLS
+		}
+		listeners = append(listeners, l)
+	}
+	if len(listeners) == 0 {
+		return nil, fmt.Errorf("no listeners given")
+	}
+	for _, l := range listeners {
+		if l.Redirect && !hasTLS {
+			return nil, fmt.Errorf("%s: redirect needs a TCP tls listener to redirect to", l.Addr)
+		}
+	}
+	return listeners, nil
+}
+
+// socketPath returns the path of the Unix domain socket addr names, if it
+// names one.
+func socketPath(addr string) (string, bool) {
+	return strings.CutPrefix(addr, unixSocketPrefix)
+}
+
+// listen listens on addr, or takes the socket an upgrade or systemd passed
+// for it. A socket left behind by a backend that did not shut down cleanly
+// is replaced; one still being served is not.
+func listen(addr string) (net.Listener, error) {
+	if ln, ok := upgradeListeners[addr]; ok {
+		return ln, nil
+	}
+	if name, ok := strings.CutPrefix(addr, systemdPrefix); ok {
+		return systemdListener(name)
+	}
+	path, unix := socketPath(addr)
+	if !unix {
+		return net.Listen(listenNetwork(addr), addr)
+	}
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use by another process", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("failed to remove stale socket: %w", err)
+		}
+	}
+	return net.Listen("unix", path)
+}
+
+// listenNetwork returns the network to listen on at addr. Addresses given
+// as IPv4 or IPv6 literals listen on that family only, so that 0.0.0.0 and
+// [::] can be listed side by side; host names and empty hosts listen on both.
+func listenNetwork(addr string) string {
+	if _, unix := socketPath(addr); unix {
+		return "unix"
+	}
+	host, _, err := net.SplitHostPort(addr)
+	ip := net.ParseIP(host)
+	switch {
+	case err != nil || ip == nil:
+		return "tcp"
+	case ip.To4() != nil:
+		return "tcp4"
+	default:
+		return "tcp6"
+	}
+}
+
+// tcpPort returns the port ln listens on, if it is a TCP listener.
+func tcpPort(ln net.Listener) (string, bool) {
+	addr, ok := ln.Addr().(*net.TCPAddr)
+	if !ok {
+		return "", false
+	}
+	return strconv.Itoa(addr.Port), true
+}
+
+// httpsRedirect redirects every request to the same URL over HTTPS on port,
+// keeping the method and body.
+func httpsRedirect(port string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.Trim(host, "[]")
+		if port != "443" {
+			host = net.JoinHostPort(host, port)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
+
+// shutdownServers shuts the servers down gracefully and concurrently, so
+// that they share the grace period of ctx.
+func shutdownServers(ctx context.Context, servers []*http.Server) error {
+	errs := make([]error, len(servers))
+	var wg sync.WaitGroup
+	for i, server := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = server.Shutdown(ctx)
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
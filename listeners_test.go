@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseListeners(t *testing.T) {
+	listeners, err := parseListeners("0.0.0.0:8080 redirect, [::]:8443 tls,, 127.0.0.1:9090 security_headers=false")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listeners) != 3 {
+		t.Fatalf("expected three listeners, got %v", listeners)
+	}
+	if l := listeners[0]; l.Addr != "0.0.0.0:8080" || !l.Redirect || l.TLS {
+		t.Errorf("unexpected first listener %v", l)
+	}
+	if l := listeners[1]; l.Addr != "[::]:8443" || !l.TLS {
+		t.Errorf("unexpected second listener %v", l)
+	}
+	if l := listeners[2]; l.SecurityHeaders == nil || *l.SecurityHeaders {
+		t.Errorf("expected security headers to be turned off, got %v", l)
+	}
+
+	listeners, err = parseListeners("unix:///run/tf-backend.sock, :8443 tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l := listeners[0]; l.Addr != "unix:///run/tf-backend.sock" {
+		t.Errorf("unexpected socket listener %v", l)
+	}
+
+	for _, invalid := range []string{
+		"8080",    // No port separator
+		"unix://", // No socket path
+		":8080 redirect, unix:///run/tf.sock tls", // Nothing to redirect to over TCP
+		":8080 http2",            // Unknown option
+		":8080 security_headers", // Missing value
+		":8080 redirect",         // Nothing to redirect to
+		":8443 tls redirect",     // Redirecting to itself
+		" , ",
+	} {
+		if _, err := parseListeners(invalid); err == nil {
+			t.Errorf("expected an error for %q", invalid)
+		}
+	}
+}
+
+func TestListenNetwork(t *testing.T) {
+	cases := map[string]string{
+		"0.0.0.0:8080":                "tcp4",
+		"[::]:8080":                   "tcp6",
+		"[::1]:8080":                  "tcp6",
+		":8080":                       "tcp",
+		"localhost:8080":              "tcp",
+		"unix:///run/tf-backend.sock": "unix",
+	}
+	for addr, want := range cases {
+		if got := listenNetwork(addr); got != want {
+			t.Errorf("listenNetwork(%q) = %s, want %s", addr, got, want)
+		}
+	}
+}
+
+func TestListen_UnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tf-backend.sock")
+	ln, err := listen(unixSocketPrefix + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	resp, err := client.Get("http://backend/health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected 200 over the socket, got %d", resp.StatusCode)
+	}
+
+	if _, err := listen(unixSocketPrefix + path); err == nil {
+		t.Error("expected error for a socket in use")
+	}
+
+	// A socket left behind by an unclean shutdown is replaced
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	ln.Close()
+	ln, err = listen(unixSocketPrefix + path)
+	if err != nil {
+		t.Fatalf("expected the stale socket to be replaced, got %v", err)
+	}
+	ln.Close()
+}
+
+func TestHTTPSRedirect(t *testing.T) {
+	cases := []struct {
+		host, port, want string
+	}{
+		{"tf.example.com:8080", "8443", "https://tf.example.com:8443/network?ID=1"},
+		{"tf.example.com", "443", "https://tf.example.com/network?ID=1"},
+		{"[2001:db8::1]:8080", "443", "https://[2001:db8::1]/network?ID=1"},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("LOCK", "/network?ID=1", nil)
+		req.Host = c.host
+		w := httptest.NewRecorder()
+		httpsRedirect(c.port).ServeHTTP(w, req)
+
+		if w.Code != http.StatusPermanentRedirect || w.Header().Get("Location") != c.want {
+			t.Errorf("%s: expected a 308 redirect to %s, got %d %s", c.host, c.want, w.Code, w.Header().Get("Location"))
+		}
+	}
+}
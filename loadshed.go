@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+// shedRetryAfter is the Retry-After, in seconds, of the requests shed beyond
+// the limit on requests in flight.
+const shedRetryAfter = "1"
+
+// Shedder serves a limited number of requests at once, and answers those
+// beyond it with a 503 straight away rather than queueing them. Hundreds of
+// simultaneous state pushes would otherwise each hold their state in memory
+// until the backend runs out of it; a shed request is retried by Terraform.
+type Shedder struct {
+	limit    atomic.Int64 // 0 is unlimited
+	inFlight atomic.Int64
+}
+
+// NewShedder creates a Shedder serving limit requests at once, unlimited if
+// 0.
+func NewShedder(limit int) *Shedder {
+	s := &Shedder{}
+	s.SetLimit(limit)
+	return s
+}
+
+// SetLimit changes the number of requests served at once. Requests in
+// flight beyond a lowered limit are finished.
+func (s *Shedder) SetLimit(limit int) {
+	s.limit.Store(int64(limit))
+}
+
+// Middleware sheds the requests beyond the limit.
+func (s *Shedder) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if unlimited(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		n := s.inFlight.Add(1)
+		defer func() { SetRequestsInFlight(int(s.inFlight.Add(-1))) }()
+		if limit := s.limit.Load(); limit > 0 && n > limit {
+			IncrementShedRequests()
+			w.Header().Set("Retry-After", shedRetryAfter)
+			writeError(w, fmt.Errorf("%w: more than %d requests are in flight", ErrOverloaded, limit))
+			return
+		}
+		SetRequestsInFlight(int(n))
+		next.ServeHTTP(w, r)
+	})
+}
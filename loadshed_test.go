@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestShedder(t *testing.T) {
+	entered, release := make(chan struct{}), make(chan struct{})
+	shedder := NewShedder(1)
+	handler := shedder.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			entered <- struct{}{}
+			<-release
+		}
+	}))
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		serve(handler, http.MethodPost, "/slow")
+	}()
+	<-entered
+
+	before := testutil.ToFloat64(shedRequestsTotal)
+	rec := serve(handler, http.MethodPost, "/myproject")
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 beyond the limit, got %d", rec.Code)
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Error("expected a Retry-After header")
+	}
+	if got := testutil.ToFloat64(shedRequestsTotal) - before; got != 1 {
+		t.Errorf("expected 1 shed request, got %v", got)
+	}
+	if rec := serve(handler, http.MethodGet, "/health"); rec.Code != http.StatusOK {
+		t.Errorf("expected /health not to be shed, got %d", rec.Code)
+	}
+
+	// Raising the limit lets more requests in at once
+	shedder.SetLimit(2)
+	if rec := serve(handler, http.MethodPost, "/myproject"); rec.Code != http.StatusOK {
+		t.Errorf("expected a request within the raised limit, got %d", rec.Code)
+	}
+
+	close(release)
+	wg.Wait()
+	shedder.SetLimit(1)
+	if rec := serve(handler, http.MethodPost, "/myproject"); rec.Code != http.StatusOK {
+		t.Errorf("expected a request once a slot is free, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,591 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+)
+
+// emptyTreeHash is the object ID of a tree without entries.
+var emptyTreeHash = plumbing.NewHash("4b825dc642cb6eb9a060e54bf8d69288fbee4904")
+
+// localGitAuthor is the identity used for commits made by LocalGitClient.
+var localGitAuthor = object.Signature{Name: "gitea-tf-backend", Email: "gitea-tf-backend@localhost"}
+
+// LocalGitClient stores states in a bare Git repository on the local disk,
+// with the same semantics as GiteaClient. The repository is created on first
+// use. Writes are serialized within the process and applied with a
+// compare-and-swap on the branch, so concurrent writers never lose commits.
+type LocalGitClient struct {
+	path   string
+	name   string // Repository named in audit entries; defaults to path
+	branch string
+	remote *gitRemote // Optional - remote the repository is a clone of, see GitPushClient
+	audit  *AuditLog  // Optional - records every commit made through this client
+
+	mu   *sync.Mutex
+	repo *git.Repository // Opened lazily, guarded by mu
+}
+
+// NewLocalGitClient creates a client for the bare repository at
+// cfg.GiteaOwner/cfg.GiteaRepo, as set from GIT_REPO_PATH.
+func NewLocalGitClient(cfg *Config) (*LocalGitClient, error) {
+	path := filepath.Join(cfg.GiteaOwner, cfg.GiteaRepo)
+	if info, err := os.Stat(path); err == nil && !info.IsDir() {
+		return nil, fmt.Errorf("git repository path %s is not a directory", path)
+	}
+	return &LocalGitClient{path: path, branch: cfg.GiteaBranch, mu: &sync.Mutex{}}, nil
+}
+
+// WithRepo returns a client for another bare repository in the same directory.
+func (g *LocalGitClient) WithRepo(repo string) Repository {
+	path := filepath.Join(filepath.Dir(g.path), repo)
+	if path == g.path {
+		return g
+	}
+	return &LocalGitClient{
+		path:   path,
+		branch: g.branch,
+		audit:  g.audit,
+		mu:     &sync.Mutex{},
+	}
+}
+
+// SetAuditLog records every commit made through this client in audit.
+func (g *LocalGitClient) SetAuditLog(audit *AuditLog) {
+	g.audit = audit
+}
+
+// open returns the repository, initializing it if it does not exist yet.
+// Must be called with g.mu held.
+func (g *LocalGitClient) open(ctx context.Context) (*git.Repository, error) {
+	if g.repo != nil {
+		return g.repo, nil
+	}
+	repo, err := git.PlainOpen(g.path)
+	if errors.Is(err, git.ErrRepositoryNotExists) && g.remote != nil {
+		repo, err = g.cloneRemote(ctx)
+	} else if errors.Is(err, git.ErrRepositoryNotExists) {
+		repo, err = git.PlainInit(g.path, true)
+		if err == nil {
+			// Point HEAD at the state branch so clones check it out
+			head := plumbing.NewSymbolicReference(plumbing.HEAD, g.branchRef())
+			err = repo.Storer.SetReference(head)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open git repository %s: %w", g.path, err)
+	}
+	g.repo = repo
+	return repo, nil
+}
+
+func (g *LocalGitClient) branchRef() plumbing.ReferenceName {
+	return plumbing.NewBranchReferenceName(g.branch)
+}
+
+// head returns the branch reference and the tree of its commit.
+// Both are nil if the branch does not exist yet. Must be called with g.mu held.
+func (g *LocalGitClient) head(ctx context.Context) (*plumbing.Reference, *object.Tree, error) {
+	repo, err := g.open(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	if g.remote != nil {
+		if err := g.fetch(ctx, repo); err != nil {
+			return nil, nil, err
+		}
+	}
+	ref, err := repo.Reference(g.branchRef(), true)
+	if errors.Is(err, plumbing.ErrReferenceNotFound) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to resolve branch %s: %w", g.branch, err)
+	}
+	commit, err := repo.CommitObject(ref.Hash())
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read commit %s: %w", ref.Hash(), err)
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read tree of %s: %w", ref.Hash(), err)
+	}
+	return ref, tree, nil
+}
+
+// GetFile retrieves a file's content and blob SHA from the branch.
+// If the file doesn't exist, returns nil content with no error.
+func (g *LocalGitClient) GetFile(ctx context.Context, path string) ([]byte, string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	_, tree, err := g.head(ctx)
+	if err != nil || tree == nil {
+		return nil, "", err
+	}
+	file, err := tree.File(path)
+	if errors.Is(err, object.ErrFileNotFound) || errors.Is(err, object.ErrDirectoryNotFound) {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to get file %s: %w", path, err)
+	}
+	contents, err := file.Contents()
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read file %s: %w", path, err)
+	}
+	return []byte(contents), file.Hash.String(), nil
+}
+
+// GetFileAt retrieves a file's content as of commit. If the file didn't
+// exist then, returns nil content with no error.
+func (g *LocalGitClient) GetFileAt(ctx context.Context, path, commit string) ([]byte, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	repo, err := g.open(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c, err := repo.CommitObject(plumbing.NewHash(commit))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read commit %s: %w", commit, err)
+	}
+	file, err := c.File(path)
+	if errors.Is(err, object.ErrFileNotFound) || errors.Is(err, object.ErrDirectoryNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get file %s at %s: %w", path, commit, err)
+	}
+	contents, err := file.Contents()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file %s at %s: %w", path, commit, err)
+	}
+	return []byte(contents), nil
+}
+
+// ResolveRef returns the SHA of the commit ref names, such as a tag, a branch
+// or an abbreviated SHA. Returns ErrRefNotFound if it names none.
+func (g *LocalGitClient) ResolveRef(ctx context.Context, ref string) (string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	repo, err := g.open(ctx)
+	if err != nil {
+		return "", err
+	}
+	hash, err := repo.ResolveRevision(plumbing.Revision(ref))
+	if errors.Is(err, plumbing.ErrReferenceNotFound) || errors.Is(err, plumbing.ErrObjectNotFound) {
+		return "", fmt.Errorf("%w: %s", ErrRefNotFound, ref)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %s: %w", ref, err)
+	}
+	return hash.String(), nil
+}
+
+// FileExists checks if a file exists and returns its SHA if it does.
+func (g *LocalGitClient) FileExists(ctx context.Context, path string) (bool, string, error) {
+	content, sha, err := g.GetFile(ctx, path)
+	if err != nil {
+		return false, "", err
+	}
+	return content != nil, sha, nil
+}
+
+// CreateFile creates a new file on the branch.
+// Returns ErrFileAlreadyExists if the file already exists.
+func (g *LocalGitClient) CreateFile(ctx context.Context, path string, content []byte, message string) error {
+	return g.write(ctx, "create", path, content, "", message)
+}
+
+// UpdateFile updates an existing file. sha must be the file's current blob SHA.
+func (g *LocalGitClient) UpdateFile(ctx context.Context, path string, content []byte, sha string, message string) error {
+	return g.write(ctx, "update", path, content, sha, message)
+}
+
+// DeleteFile deletes a file. sha must be the file's current blob SHA.
+func (g *LocalGitClient) DeleteFile(ctx context.Context, path string, sha string, message string) error {
+	return g.write(ctx, "delete", path, nil, sha, message)
+}
+
+// CreateOrUpdateFile creates a file if it doesn't exist, or updates it if it does.
+func (g *LocalGitClient) CreateOrUpdateFile(ctx context.Context, path string, content []byte, message string) error {
+	exists, sha, err := g.FileExists(ctx, path)
+	if err != nil {
+		return err
+	}
+
+	if exists {
+		return g.UpdateFile(ctx, path, content, sha, message)
+	}
+	return g.CreateFile(ctx, path, content, message)
+}
+
+// write commits a single file change to the branch.
+func (g *LocalGitClient) write(ctx context.Context, action, path string, content []byte, sha, message string) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	ref, tree, err := g.head(ctx)
+	if err != nil {
+		return err
+	}
+
+	var current string
+	if tree != nil {
+		if file, err := tree.File(path); err == nil {
+			current = file.Hash.String()
+		}
+	}
+	switch {
+	case action == "create" && current != "":
+		return ErrFileAlreadyExists
+	case action != "create" && current == "":
+		return fmt.Errorf("failed to %s file %s: file does not exist", action, path)
+	case action != "create" && current != sha:
+		return fmt.Errorf("failed to %s file %s: %w", action, path, ErrFileChanged)
+	}
+
+	if err := g.commit(ctx, ref, tree, message, []localChange{{action, path, content}}); err != nil {
+		return fmt.Errorf("failed to %s file %s: %w", action, path, err)
+	}
+	return nil
+}
+
+// localChange is a validated file operation; content is nil for deletions.
+type localChange struct {
+	action  string
+	path    string
+	content []byte
+}
+
+// CommitFiles applies all changes in a single commit.
+func (g *LocalGitClient) CommitFiles(ctx context.Context, message string, changes []FileChange) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	ref, tree, err := g.head(ctx)
+	if err != nil {
+		return err
+	}
+
+	var resolved []localChange
+	for _, change := range changes {
+		var current string
+		if tree != nil {
+			if file, err := tree.File(change.Path); err == nil {
+				current = file.Hash.String()
+			}
+		}
+		if (change.SHA != "" && change.SHA != current) || (change.Create && current != "") {
+			return fmt.Errorf("failed to commit file %s: %w", change.Path, ErrFileChanged)
+		}
+		switch {
+		case change.Content == nil && current == "":
+			continue
+		case change.Content == nil:
+			resolved = append(resolved, localChange{"delete", change.Path, nil})
+		case current == "":
+			resolved = append(resolved, localChange{"create", change.Path, change.Content})
+		default:
+			resolved = append(resolved, localChange{"update", change.Path, change.Content})
+		}
+	}
+	if len(resolved) == 0 {
+		return nil
+	}
+	if err := g.commit(ctx, ref, tree, message, resolved); err != nil {
+		return fmt.Errorf("failed to commit %d files: %w", len(resolved), err)
+	}
+	return nil
+}
+
+// commit records changes on top of the branch at ref, whose tree is tree,
+// and moves the branch to the new commit. Must be called with g.mu held.
+func (g *LocalGitClient) commit(ctx context.Context, ref *plumbing.Reference, tree *object.Tree, message string, changes []localChange) error {
+	s := g.repo.Storer
+	treeHash := emptyTreeHash
+	for _, change := range changes {
+		var blob *plumbing.Hash
+		if change.content != nil {
+			hash, err := writeBlob(s, change.content)
+			if err != nil {
+				return err
+			}
+			blob = &hash
+		}
+
+		var err error
+		if treeHash, err = writeTreeChange(s, tree, strings.Split(change.path, "/"), blob); err != nil {
+			return err
+		}
+		if tree, err = object.GetTree(s, treeHash); err != nil {
+			return err
+		}
+	}
+
+	committer := localGitAuthor
+	committer.When = time.Now()
+	author := committer
+	if a, ok := commitAuthorFrom(ctx); ok {
+		author = object.Signature{Name: a.Name, Email: a.Email, When: committer.When}
+	}
+	commit := &object.Commit{
+		Author:    author,
+		Committer: committer,
+		Message:   message,
+		TreeHash:  treeHash,
+	}
+	if ref != nil {
+		commit.ParentHashes = []plumbing.Hash{ref.Hash()}
+	}
+	obj := s.NewEncodedObject()
+	if err := commit.Encode(obj); err != nil {
+		return err
+	}
+	commitHash, err := s.SetEncodedObject(obj)
+	if err != nil {
+		return err
+	}
+
+	// Fails if another process moved the branch since we read it
+	if err := s.CheckAndSetReference(plumbing.NewHashReference(g.branchRef(), commitHash), ref); err != nil {
+		return err
+	}
+	if g.remote != nil {
+		if err := g.push(ctx); err != nil {
+			// The next fetch overwrites the branch, but don't leave it pointing at a commit the remote lacks
+			_ = s.RemoveReference(g.branchRef())
+			return err
+		}
+	}
+
+	name := g.name
+	if name == "" {
+		name = g.path
+	}
+	for _, change := range changes {
+		recordCommit(ctx, g.audit, name, change.action, change.path, commitHash.String(), message)
+	}
+	return nil
+}
+
+// CreateTag creates a lightweight tag pointing at commit, and pushes it when
+// the repository is a clone. Returns ErrTagExists if the tag already exists.
+func (g *LocalGitClient) CreateTag(ctx context.Context, tag, commit string) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	repo, err := g.open(ctx)
+	if err != nil {
+		return err
+	}
+	ref := plumbing.NewTagReferenceName(tag)
+	if _, err := repo.Storer.Reference(ref); err == nil {
+		return ErrTagExists
+	}
+	if err := repo.Storer.SetReference(plumbing.NewHashReference(ref, plumbing.NewHash(commit))); err != nil {
+		return fmt.Errorf("failed to create tag %s: %w", tag, err)
+	}
+	if g.remote != nil {
+		if err := g.pushRef(ctx, ref); err != nil {
+			_ = repo.Storer.RemoveReference(ref)
+			return err
+		}
+	}
+	return nil
+}
+
+// writeBlob stores content as a blob object.
+func writeBlob(s storer.EncodedObjectStorer, content []byte) (plumbing.Hash, error) {
+	obj := s.NewEncodedObject()
+	obj.SetType(plumbing.BlobObject)
+	w, err := obj.Writer()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	if _, err := w.Write(content); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	if err := w.Close(); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return s.SetEncodedObject(obj)
+}
+
+// writeTreeChange stores a copy of tree (nil for an empty tree) with the file
+// at parts set to blob, or removed if blob is nil, and returns its hash.
+// Subdirectories left empty by a removal are dropped.
+func writeTreeChange(s storer.EncodedObjectStorer, tree *object.Tree, parts []string, blob *plumbing.Hash) (plumbing.Hash, error) {
+	var entries []object.TreeEntry
+	var existing *object.TreeEntry
+	if tree != nil {
+		for i, entry := range tree.Entries {
+			if entry.Name == parts[0] {
+				existing = &tree.Entries[i]
+				continue
+			}
+			entries = append(entries, entry)
+		}
+	}
+
+	if len(parts) == 1 {
+		if blob != nil {
+			entries = append(entries, object.TreeEntry{Name: parts[0], Mode: filemode.Regular, Hash: *blob})
+		}
+	} else {
+		var subtree *object.Tree
+		if existing != nil && existing.Mode == filemode.Dir {
+			var err error
+			if subtree, err = object.GetTree(s, existing.Hash); err != nil {
+				return plumbing.ZeroHash, err
+			}
+		}
+		hash, err := writeTreeChange(s, subtree, parts[1:], blob)
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		if hash != emptyTreeHash {
+			entries = append(entries, object.TreeEntry{Name: parts[0], Mode: filemode.Dir, Hash: hash})
+		}
+	}
+
+	// Git orders entries by name, comparing directories as if they had a trailing slash
+	sort.Slice(entries, func(i, j int) bool {
+		return treeSortKey(entries[i]) < treeSortKey(entries[j])
+	})
+
+	obj := s.NewEncodedObject()
+	if err := (&object.Tree{Entries: entries}).Encode(obj); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return s.SetEncodedObject(obj)
+}
+
+func treeSortKey(entry object.TreeEntry) string {
+	if entry.Mode == filemode.Dir {
+		return entry.Name + "/"
+	}
+	return entry.Name
+}
+
+// ListFiles returns the paths of all files below the given prefix.
+// An empty repository yields an empty list.
+func (g *LocalGitClient) ListFiles(prefix string) ([]string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	_, tree, err := g.head(context.Background())
+	if err != nil || tree == nil {
+		return nil, err
+	}
+
+	var paths []string
+	err = tree.Files().ForEach(func(f *object.File) error {
+		if strings.HasPrefix(f.Name, prefix) {
+			paths = append(paths, f.Name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list files under %s: %w", prefix, err)
+	}
+	return paths, nil
+}
+
+// RepoSize returns the size of the repository directory on disk in bytes.
+func (g *LocalGitClient) RepoSize() (int64, error) {
+	var size int64
+	err := filepath.WalkDir(g.path, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			size += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to get repository size of %s: %w", g.path, err)
+	}
+	return size, nil
+}
+
+// Ping verifies that the repository can be opened.
+func (g *LocalGitClient) Ping() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	_, err := g.open(context.Background())
+	return err
+}
+
+// LastCommitTime returns the time of the most recent commit touching path.
+// Returns the zero time if the path has no history.
+func (g *LocalGitClient) LastCommitTime(path string) (time.Time, error) {
+	commits, err := g.ListCommits(path, 1)
+	if err != nil || len(commits) == 0 {
+		return time.Time{}, err
+	}
+	return commits[0].Created, nil
+}
+
+// ListCommits returns commits touching path, a file or directory, newest first.
+// A limit of 0 returns the complete history.
+func (g *LocalGitClient) ListCommits(path string, limit int) ([]CommitInfo, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	ref, _, err := g.head(context.Background())
+	if err != nil || ref == nil {
+		return nil, err
+	}
+
+	iter, err := g.repo.Log(&git.LogOptions{
+		From: ref.Hash(),
+		PathFilter: func(p string) bool {
+			return path == "" || p == path || strings.HasPrefix(p, path+"/")
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list commits for %s: %w", path, err)
+	}
+	defer iter.Close()
+
+	var result []CommitInfo
+	err = iter.ForEach(func(c *object.Commit) error {
+		result = append(result, CommitInfo{
+			SHA:     c.Hash.String(),
+			Author:  c.Author.Name,
+			Message: c.Message,
+			Created: c.Author.When,
+		})
+		if limit > 0 && len(result) >= limit {
+			return storer.ErrStop
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list commits for %s: %w", path, err)
+	}
+	return result, nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestLocalGitClient(t *testing.T) *LocalGitClient {
+	t.Helper()
+
+	client, err := NewLocalGitClient(&Config{
+		GiteaOwner:  t.TempDir(),
+		GiteaRepo:   "tf-state.git",
+		GiteaBranch: "main",
+	})
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	return client
+}
+
+func TestLocalGitClient_FileLifecycle(t *testing.T) {
+	client := newTestLocalGitClient(t)
+	path := "states/myproject/terraform.tfstate"
+
+	content, _, err := client.GetFile(context.Background(), path)
+	if err != nil || content != nil {
+		t.Fatalf("expected missing file, got %q, %v", content, err)
+	}
+
+	if err := client.CreateOrUpdateFile(context.Background(), path, []byte(`{"serial":1}`), "create"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := client.CreateOrUpdateFile(context.Background(), "states/other/terraform.tfstate", []byte(`{}`), "create"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := client.CreateOrUpdateFile(context.Background(), path, []byte(`{"serial":2}`), "update"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := client.CreateFile(context.Background(), path, []byte(`{}`), "create"); !errors.Is(err, ErrFileAlreadyExists) {
+		t.Errorf("expected ErrFileAlreadyExists, got %v", err)
+	}
+
+	content, sha, err := client.GetFile(context.Background(), path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(content) != `{"serial":2}` {
+		t.Errorf("expected updated content, got %s", content)
+	}
+	if sha != gitBlobSHA(content) {
+		t.Errorf("expected blob SHA %s, got %s", gitBlobSHA(content), sha)
+	}
+	if err := client.UpdateFile(context.Background(), path, []byte(`{}`), "stale", "update"); !errors.Is(err, ErrFileChanged) {
+		t.Errorf("expected ErrFileChanged for a stale SHA, got %v", err)
+	}
+
+	paths, err := client.ListFiles("states/myproject/")
+	if err != nil || len(paths) != 1 || paths[0] != path {
+		t.Errorf("expected [%s], got %v (%v)", path, paths, err)
+	}
+
+	commits, err := client.ListCommits(path, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(commits) != 2 || commits[0].Message != "update" {
+		t.Errorf("expected 2 commits with the update first, got %+v", commits)
+	}
+
+	if err := client.DeleteFile(context.Background(), path, sha, "delete"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if content, _, _ := client.GetFile(context.Background(), path); content != nil {
+		t.Error("expected file to be deleted")
+	}
+	if paths, _ := client.ListFiles("states/"); len(paths) != 1 {
+		t.Errorf("expected the other state to remain, got %v", paths)
+	}
+}
+
+func TestLocalGitClient_ValidRepository(t *testing.T) {
+	gitBin, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git not installed")
+	}
+
+	client := newTestLocalGitClient(t)
+	for _, path := range []string{"states/a/terraform.tfstate", "states/b-c/terraform.tfstate", "states/b/terraform.tfstate"} {
+		if err := client.CreateFile(context.Background(), path, []byte(`{}`), "create "+path); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	out, err := exec.Command(gitBin, "--git-dir", client.path, "fsck", "--strict").CombinedOutput()
+	if err != nil {
+		t.Fatalf("git fsck failed: %v\n%s", err, out)
+	}
+	out, err = exec.Command(gitBin, "--git-dir", client.path, "ls-tree", "-r", "--name-only", "main").Output()
+	if err != nil {
+		t.Fatalf("git ls-tree failed: %v", err)
+	}
+	if files := strings.Fields(string(out)); len(files) != 3 {
+		t.Errorf("expected 3 files, got %v", files)
+	}
+}
+
+func TestLocalGitClient_WithRepo(t *testing.T) {
+	client := newTestLocalGitClient(t)
+
+	if client.WithRepo("tf-state.git") != Repository(client) {
+		t.Error("expected the same client for its own repository")
+	}
+
+	archive := client.WithRepo("tf-archive.git").(*LocalGitClient)
+	if archive.path != filepath.Join(filepath.Dir(client.path), "tf-archive.git") {
+		t.Errorf("expected sibling repository, got %s", archive.path)
+	}
+	if err := archive.CreateFile(context.Background(), "archive/x/terraform.tfstate", []byte(`{}`), "archive"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if content, _, _ := client.GetFile(context.Background(), "archive/x/terraform.tfstate"); content != nil {
+		t.Error("expected the file only in the archive repository")
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// knownLockOperations are the Operation values Terraform and OpenTofu send:
+// the operation types of plan, apply and refresh, and the reasons given by
+// commands that lock the state themselves. Operation is free text to both,
+// so other values are accepted and only logged.
+var knownLockOperations = map[string]bool{
+	"OperationTypeInvalid":        true,
+	"OperationTypeRefresh":        true,
+	"OperationTypePlan":           true,
+	"OperationTypeApply":          true,
+	"import":                      true,
+	"migration":                   true,
+	"migration source state":      true,
+	"migration destination state": true,
+	"state-mv":                    true,
+	"state-rm":                    true,
+	"state-push":                  true,
+	"state-replace-provider":      true,
+	"taint":                       true,
+	"untaint":                     true,
+	"workspace-new":               true,
+	"workspace-delete":            true,
+}
+
+// validateLockInfo checks a lock body and fills in a missing Created time.
+// Lock bodies require an ID; unlock bodies may leave it empty, as
+// terraform force-unlock does. It returns the problems found, if any.
+func validateLockInfo(info *LockInfo, requireID bool) []string {
+	var problems []string
+	if requireID && info.ID == "" {
+		problems = append(problems, "ID is required")
+	}
+	if info.Created == "" {
+		if requireID {
+			info.Created = time.Now().UTC().Format(time.RFC3339Nano)
+		}
+	} else if _, err := time.Parse(time.RFC3339, info.Created); err != nil {
+		problems = append(problems, fmt.Sprintf("Created %q is not an RFC 3339 time", info.Created))
+	}
+	return problems
+}
+
+// parseLockInfo decodes and validates the lock info in body. On failure it
+// writes the error response and returns false: malformed JSON gets 400, and
+// lock info that does not validate gets 422 with the problems in details.
+func parseLockInfo(w http.ResponseWriter, body []byte, name, kind string, requireID bool) (LockInfo, bool) {
+	var info LockInfo
+	if err := json.Unmarshal(body, &info); err != nil {
+		slog.Warn("Error parsing lock body", "state", name, "body", kind, "error", err)
+		writeError(w, ErrInvalidLockInfo)
+		return info, false
+	}
+	if problems := validateLockInfo(&info, requireID); len(problems) > 0 {
+		slog.Warn("Rejected lock body", "state", name, "body", kind, "problems", problems)
+		writeErrorFields(w, ErrLockInfoRejected, map[string]any{"details": problems})
+		return info, false
+	}
+	if info.Operation != "" && !knownLockOperations[info.Operation] {
+		slog.Info("Lock body with an unfamiliar operation", "state", name, "body", kind, "lock_id", info.ID, "operation", info.Operation)
+	}
+	return info, true
+}
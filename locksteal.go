@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// lockSteal is a pending request to take over a held lock.
+type lockSteal struct {
+	Holder    LockInfo  `json:"holder"`
+	Requester LockInfo  `json:"requester"`
+	Deadline  time.Time `json:"deadline"`
+
+	source lockSource // Where the takeover was requested from
+	timer  *time.Timer
+}
+
+// handleLockSteal routes requests for /{name}/lock/steal.
+//
+// POST requests a takeover, GET reports the pending takeover and DELETE lets
+// the current holder object to it.
+func (h *StateHandler) handleLockSteal(w http.ResponseWriter, r *http.Request, name string) {
+	switch r.Method {
+	case http.MethodPost:
+		h.handleStealRequest(w, r, name)
+	case http.MethodGet:
+		h.mu.RLock()
+		steal, pending := h.steals[name]
+		h.mu.RUnlock()
+		if !pending {
+			writeError(w, ErrNoStealPending)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(steal)
+	case http.MethodDelete:
+		h.handleStealObjection(w, r, name)
+	default:
+		h.methodNotAllowed(w, r, http.MethodPost, http.MethodGet, http.MethodDelete)
+	}
+}
+
+// handleStealRequest notifies the current holder and schedules the takeover
+// after the grace period. The requester's lock info is the request body.
+func (h *StateHandler) handleStealRequest(w http.ResponseWriter, r *http.Request, name string) {
+	body, ok := h.readBody(w, r, name, "steal")
+	if !ok {
+		return
+	}
+
+	requester, ok := parseLockInfo(w, body, name, "steal", true)
+	if !ok {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	holder, locked := h.locks[name]
+	if !locked {
+		writeError(w, fmt.Errorf("%w; acquire it with LOCK instead", ErrNotLocked))
+		return
+	}
+	if holder.ID == requester.ID {
+		writeError(w, ErrLockAlreadyHeld)
+		return
+	}
+	if _, pending := h.steals[name]; pending {
+		writeError(w, ErrStealPending)
+		return
+	}
+
+	steal := &lockSteal{
+		Holder:    holder,
+		Requester: requester,
+		Deadline:  time.Now().Add(h.stealGrace).UTC(),
+		source:    requestSource(r),
+	}
+	steal.timer = time.AfterFunc(h.stealGrace, func() { h.completeSteal(name, steal) })
+	h.steals[name] = steal
+
+	slog.Info("Lock takeover requested", "state", name, "lock_id", holder.ID, "who", requester.Who, "holder", holder.Who, "effective", steal.Deadline.Format(time.RFC3339))
+	h.notifier.Notify(EventLockStealRequested, name,
+		fmt.Sprintf("%s requested takeover of the lock on %s held by %s. It transfers at %s unless the holder objects.",
+			requester.Who, name, holder.Who, steal.Deadline.Format(time.RFC3339)),
+		*steal)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	_ = json.NewEncoder(w).Encode(steal)
+}
+
+// handleStealObjection cancels a pending takeover. Only the current holder,
+// identified by its lock ID in the Lock-Id header, may object.
+func (h *StateHandler) handleStealObjection(w http.ResponseWriter, r *http.Request, name string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	steal, pending := h.steals[name]
+	if !pending {
+		writeError(w, ErrNoStealPending)
+		return
+	}
+	if r.Header.Get("Lock-Id") != steal.Holder.ID {
+		writeError(w, fmt.Errorf("%w; send its lock ID in the Lock-Id header to object", ErrNotLockHolder))
+		return
+	}
+
+	steal.timer.Stop()
+	delete(h.steals, name)
+
+	slog.Info("Lock takeover cancelled by holder", "state", name, "lock_id", steal.Holder.ID, "who", steal.Requester.Who, "holder", steal.Holder.Who)
+	h.notifier.Notify(EventLockStealCancelled, name,
+		fmt.Sprintf("%s objected; the lock on %s stays with them and will not be transferred to %s.", steal.Holder.Who, name, steal.Requester.Who),
+		*steal)
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// completeSteal transfers the lock once the grace period passed without objection.
+// The transfer is abandoned if another client acquired the lock in the meantime,
+// or if a write spooled under the holder's lock cannot be committed.
+func (h *StateHandler) completeSteal(name string, steal *lockSteal) {
+	// Writes of the holder in flight or spooled are committed before the
+	// lock changes hands, and later ones see the new holder
+	ctx := context.Background()
+	release, err := h.writes.Lock(ctx, name)
+	if err != nil {
+		return
+	}
+	defer release()
+	flushErr := h.coalescer.Flush(ctx, name)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.steals[name] != steal {
+		return
+	}
+	delete(h.steals, name)
+	if flushErr != nil {
+		slog.Error("Lock takeover abandoned: the holder's spooled write could not be committed", "state", name, "lock_id", steal.Holder.ID, "who", steal.Requester.Who, "error", flushErr)
+		return
+	}
+
+	current, locked := h.locks[name]
+	if locked && current.ID != steal.Holder.ID {
+		slog.Info("Lock takeover abandoned: lock is now held by another", "state", name, "lock_id", current.ID, "holder", current.Who)
+		return
+	}
+
+	h.locks[name] = steal.Requester
+	h.lockSources[name] = steal.source
+	h.finishRun(name, RunStolen)
+	h.runs.Start(name, steal.Requester)
+	if !locked {
+		IncrementActiveLocks()
+	}
+
+	slog.Info("Lock transferred", "state", name, "lock_id", steal.Requester.ID, "from", steal.Holder.Who, "to", steal.Requester.Who)
+	h.recordAudit("lock-steal", name, fmt.Sprintf("Lock taken over from %s (%s) by %s (%s)",
+		steal.Holder.Who, steal.Holder.ID, steal.Requester.Who, steal.Requester.ID))
+	h.notifier.Notify(EventLockStolen, name,
+		fmt.Sprintf("The lock on %s was transferred from %s to %s.", name, steal.Holder.Who, steal.Requester.Who),
+		map[string]any{"holder": steal.Requester, "previous_holder": steal.Holder})
+}
+
+// recordAudit appends a non-commit event for the named state to the audit log, if configured.
+func (h *StateHandler) recordAudit(action, name, message string) {
+	if h.audit == nil {
+		return
+	}
+	err := h.audit.Record(AuditEntry{
+		Repo:    h.auditRepo,
+		Action:  action,
+		Path:    statePath(name),
+		Message: message,
+	})
+	if err != nil {
+		slog.Error("Error recording audit entry", "state", name, "action", action, "error", err)
+	}
+}
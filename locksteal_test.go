@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func requestSteal(handler *StateHandler, name, lockID string) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(LockInfo{ID: lockID, Who: "bob"})
+	req := httptest.NewRequest(http.MethodPost, "/"+name+"/lock/steal", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+func TestLockSteal_NotLocked(t *testing.T) {
+	handler, _ := newTestHandler()
+
+	w := requestSteal(handler, "myproject", "lock-456")
+
+	if w.Code != http.StatusConflict {
+		t.Errorf("expected status 409, got %d", w.Code)
+	}
+}
+
+func TestLockSteal_TransfersAfterGrace(t *testing.T) {
+	handler, _ := newTestHandler()
+	handler.stealGrace = 10 * time.Millisecond
+	auditLog, err := OpenAuditLog(filepath.Join(t.TempDir(), "audit.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auditLog.Close()
+	handler.audit = auditLog
+	handler.locks["myproject"] = LockInfo{ID: "lock-123", Who: "alice"}
+
+	w := requestSteal(handler, "myproject", "lock-456")
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("expected status 202, got %d", w.Code)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		handler.mu.RLock()
+		holder := handler.locks["myproject"].ID
+		handler.mu.RUnlock()
+		if holder == "lock-456" {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	handler.mu.RLock()
+	holder := handler.locks["myproject"].ID
+	handler.mu.RUnlock()
+	if holder != "lock-456" {
+		t.Fatalf("expected lock to be transferred to lock-456, got %s", holder)
+	}
+
+	entries, err := ReadAuditLog(auditLog.file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Action != "lock-steal" {
+		t.Errorf("expected one lock-steal audit entry, got %+v", entries)
+	}
+}
+
+func TestLockSteal_Objection(t *testing.T) {
+	handler, _ := newTestHandler()
+	handler.stealGrace = 20 * time.Millisecond
+	handler.locks["myproject"] = LockInfo{ID: "lock-123", Who: "alice"}
+
+	if w := requestSteal(handler, "myproject", "lock-456"); w.Code != http.StatusAccepted {
+		t.Fatalf("expected status 202, got %d", w.Code)
+	}
+
+	// Only the holder may object
+	req := httptest.NewRequest(http.MethodDelete, "/myproject/lock/steal", nil)
+	req.Header.Set("Lock-Id", "lock-456")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected status 403, got %d", w.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodDelete, "/myproject/lock/steal", nil)
+	req.Header.Set("Lock-Id", "lock-123")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	handler.mu.RLock()
+	holder := handler.locks["myproject"].ID
+	handler.mu.RUnlock()
+	if holder != "lock-123" {
+		t.Errorf("expected lock to remain with lock-123, got %s", holder)
+	}
+}
+
+func TestLockSteal_AlreadyPending(t *testing.T) {
+	handler, _ := newTestHandler()
+	handler.stealGrace = time.Hour
+	handler.locks["myproject"] = LockInfo{ID: "lock-123", Who: "alice"}
+
+	if w := requestSteal(handler, "myproject", "lock-456"); w.Code != http.StatusAccepted {
+		t.Fatalf("expected status 202, got %d", w.Code)
+	}
+	defer handler.steals["myproject"].timer.Stop()
+
+	if w := requestSteal(handler, "myproject", "lock-789"); w.Code != http.StatusConflict {
+		t.Errorf("expected status 409, got %d", w.Code)
+	}
+}
+
+func TestLockSteal_WaitsForHolderWrite(t *testing.T) {
+	storage := &gatedStorage{MockStorage: NewMockStorage(), release: make(chan struct{})}
+	handler := NewStateHandler(storage, DefaultMaxBodySize)
+	handler.stealGrace = time.Millisecond
+	handler.locks["network"] = LockInfo{ID: "lock-123", Who: "alice"}
+
+	// The holder's write has passed the lock check and is reading the state
+	written := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		written <- serveAs(handler, http.MethodPost, "/network?ID=lock-123", "", `{"version":4,"serial":1,"lineage":"abc"}`)
+	}()
+	waitForReads(t, storage, 1)
+
+	if w := requestSteal(handler, "network", "lock-456"); w.Code != http.StatusAccepted {
+		t.Fatalf("expected status 202, got %d", w.Code)
+	}
+	time.Sleep(50 * time.Millisecond)
+	handler.mu.RLock()
+	holder := handler.locks["network"]
+	handler.mu.RUnlock()
+	if holder.ID != "lock-123" {
+		t.Fatalf("expected the takeover to wait for the holder's write, lock held by %+v", holder)
+	}
+
+	close(storage.release)
+	if w := <-written; w.Code != http.StatusOK {
+		t.Errorf("expected the holder's write to be committed, got %d: %s", w.Code, w.Body.String())
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		handler.mu.RLock()
+		holder = handler.locks["network"]
+		handler.mu.RUnlock()
+		if holder.ID == "lock-456" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the lock to be taken over after the write, held by %+v", holder)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+)
+
+// handleLockTransfer hands a held lock to another holder at
+// POST /{name}/lock/transfer, such as from the agent that ran terraform plan
+// to the one that applies it, without releasing it in between. Only the
+// current holder, identified by its lock ID in the Lock-Id header, may
+// transfer the lock; the new holder's lock info is the request body and may
+// keep the lock ID.
+func (h *StateHandler) handleLockTransfer(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Method != http.MethodPost {
+		h.methodNotAllowed(w, r, http.MethodPost)
+		return
+	}
+
+	body, ok := h.readBody(w, r, name, "transfer")
+	if !ok {
+		return
+	}
+	recipient, ok := parseLockInfo(w, body, name, "transfer", true)
+	if !ok {
+		return
+	}
+
+	// Writes of the holder in flight are committed before the lock changes
+	// hands, and later ones see the new holder
+	release, ok := h.serializeState(w, r, name)
+	if !ok {
+		return
+	}
+	defer release()
+
+	lockID := r.Header.Get("Lock-Id")
+	h.mu.RLock()
+	holder, locked := h.locks[name]
+	h.mu.RUnlock()
+	if !locked {
+		writeError(w, ErrNotLocked)
+		return
+	}
+	if lockID != holder.ID {
+		writeError(w, fmt.Errorf("%w; send its lock ID in the Lock-Id header to transfer it", ErrNotLockHolder))
+		return
+	}
+
+	// Commit the writes spooled under the lock before it changes hands
+	if err := h.coalescer.Flush(r.Context(), name); err != nil {
+		slog.Error("Error committing spooled write", "state", name, "error", err)
+		writeError(w, err)
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// The lock may have been released or taken over meanwhile
+	if holder, locked = h.locks[name]; !locked || holder.ID != lockID {
+		writeError(w, fmt.Errorf("%w; the lock changed while it was being transferred", ErrNotLockHolder))
+		return
+	}
+
+	h.locks[name] = recipient
+	// The recipient's address is not known until it writes, so writes under
+	// the lock are not checked for concurrent applies
+	delete(h.lockSources, name)
+	h.finishRun(name, RunTransferred)
+	h.runs.Start(name, recipient)
+	// A pending takeover now concerns the new holder, who may object to it
+	if steal, pending := h.steals[name]; pending {
+		steal.Holder = recipient
+	}
+
+	slog.Info("Lock transferred by its holder", "state", name, "lock_id", recipient.ID, "from", holder.Who, "to", recipient.Who)
+	h.recordAudit("lock-transfer", name, fmt.Sprintf("Lock transferred from %s (%s) to %s (%s) by its holder",
+		holder.Who, holder.ID, recipient.Who, recipient.ID))
+	h.notifier.Notify(EventLockTransferred, name,
+		fmt.Sprintf("%s handed the lock on %s to %s.", holder.Who, name, recipient.Who),
+		map[string]any{"holder": recipient, "previous_holder": holder})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(recipient)
+}
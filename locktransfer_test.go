@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func requestTransfer(handler *StateHandler, name, lockID string, recipient LockInfo) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(recipient)
+	req := httptest.NewRequest(http.MethodPost, "/"+name+"/lock/transfer", bytes.NewReader(body))
+	if lockID != "" {
+		req.Header.Set("Lock-Id", lockID)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+func TestLockTransfer_HandsOverLock(t *testing.T) {
+	handler, _ := newTestHandler()
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	auditLog, err := OpenAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auditLog.Close()
+	handler.audit = auditLog
+	handler.locks["myproject"] = LockInfo{ID: "lock-plan", Who: "ci@plan-agent"}
+
+	w := requestTransfer(handler, "myproject", "lock-plan", LockInfo{ID: "lock-apply", Who: "ci@apply-agent", Operation: "OperationTypeApply"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if holder := handler.locks["myproject"]; holder.ID != "lock-apply" || holder.Who != "ci@apply-agent" || holder.Created == "" {
+		t.Errorf("expected the lock to be held by the recipient, got %+v", holder)
+	}
+
+	// The previous holder's lock ID no longer works, the recipient's does
+	state := `{"version":4,"serial":1,"lineage":"abc"}`
+	req := httptest.NewRequest(http.MethodPost, "/myproject", strings.NewReader(state))
+	req.Header.Set("Lock-Id", "lock-plan")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusLocked {
+		t.Errorf("expected the previous holder's write to get 423, got %d", w.Code)
+	}
+	req = httptest.NewRequest(http.MethodPost, "/myproject", strings.NewReader(state))
+	req.Header.Set("Lock-Id", "lock-apply")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("expected the recipient's write to succeed, got %d", w.Code)
+	}
+
+	entries, err := ReadAuditLog(path)
+	if err != nil || len(entries) != 1 || entries[0].Action != "lock-transfer" {
+		t.Errorf("expected a lock-transfer audit entry, got %+v, %v", entries, err)
+	}
+}
+
+func TestLockTransfer_KeepsLockID(t *testing.T) {
+	handler, _ := newTestHandler()
+	handler.locks["myproject"] = LockInfo{ID: "lock-123", Who: "ci@plan-agent"}
+
+	w := requestTransfer(handler, "myproject", "lock-123", LockInfo{ID: "lock-123", Who: "ci@apply-agent"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if holder := handler.locks["myproject"]; holder.Who != "ci@apply-agent" {
+		t.Errorf("expected the new holder's identity, got %+v", holder)
+	}
+}
+
+func TestLockTransfer_Rejected(t *testing.T) {
+	tests := []struct {
+		name   string
+		locked bool
+		lockID string
+		body   LockInfo
+		want   int
+	}{
+		{"not locked", false, "lock-123", LockInfo{ID: "lock-456"}, http.StatusConflict},
+		{"no lock ID", true, "", LockInfo{ID: "lock-456"}, http.StatusForbidden},
+		{"wrong lock ID", true, "lock-999", LockInfo{ID: "lock-456"}, http.StatusForbidden},
+		{"recipient without ID", true, "lock-123", LockInfo{Who: "bob"}, http.StatusUnprocessableEntity},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler, _ := newTestHandler()
+			if tt.locked {
+				handler.locks["myproject"] = LockInfo{ID: "lock-123", Who: "alice"}
+			}
+
+			w := requestTransfer(handler, "myproject", tt.lockID, tt.body)
+			if w.Code != tt.want {
+				t.Errorf("expected status %d, got %d: %s", tt.want, w.Code, w.Body.String())
+			}
+			if tt.locked && handler.locks["myproject"].ID != "lock-123" {
+				t.Error("expected the lock to stay with its holder")
+			}
+		})
+	}
+}
+
+func TestLockTransfer_MethodNotAllowed(t *testing.T) {
+	handler, _ := newTestHandler()
+
+	w := serve(handler, http.MethodGet, "/myproject/lock/transfer")
+	if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != http.MethodPost {
+		t.Errorf("expected 405 allowing POST, got %d with %q", w.Code, w.Header().Get("Allow"))
+	}
+}
+
+func TestLockTransfer_WaitsForHolderWrite(t *testing.T) {
+	storage := &gatedStorage{MockStorage: NewMockStorage(), release: make(chan struct{})}
+	handler := NewStateHandler(storage, DefaultMaxBodySize)
+	handler.locks["network"] = LockInfo{ID: "lock-plan", Who: "ci@plan-agent"}
+
+	// The holder's write has passed the lock check and is reading the state
+	written := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		written <- serveAs(handler, http.MethodPost, "/network?ID=lock-plan", "", `{"version":4,"serial":1,"lineage":"abc"}`)
+	}()
+	waitForReads(t, storage, 1)
+
+	transferred := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		transferred <- requestTransfer(handler, "network", "lock-plan", LockInfo{ID: "lock-apply", Who: "ci@apply-agent"})
+	}()
+	select {
+	case w := <-transferred:
+		t.Fatalf("expected the transfer to wait for the holder's write, got %d", w.Code)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(storage.release)
+	if w := <-written; w.Code != http.StatusOK {
+		t.Errorf("expected the holder's write to be committed, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := <-transferred; w.Code != http.StatusOK {
+		t.Errorf("expected the transfer to succeed after the write, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// The previous holder cannot write anymore
+	if w := serveAs(handler, http.MethodPost, "/network?ID=lock-plan", "", `{"version":4,"serial":2,"lineage":"abc"}`); w.Code == http.StatusOK {
+		t.Error("expected a write of the previous holder to be refused")
+	}
+}
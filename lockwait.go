@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// lockWaiter is a LOCK request waiting for the current holder to release the lock.
+type lockWaiter struct {
+	info    LockInfo
+	source  lockSource
+	ready   chan struct{} // closed when the lock is granted
+	granted bool          // guarded by StateHandler.mu
+}
+
+// enqueueWaiter adds a waiter for the named state's lock. Must be called with h.mu held.
+func (h *StateHandler) enqueueWaiter(name string, info LockInfo, source lockSource) *lockWaiter {
+	waiter := &lockWaiter{info: info, source: source, ready: make(chan struct{})}
+	h.waiters[name] = append(h.waiters[name], waiter)
+	return waiter
+}
+
+// removeWaiterLocked drops a waiter from the queue. Must be called with h.mu held.
+func (h *StateHandler) removeWaiterLocked(name string, waiter *lockWaiter) {
+	queue := h.waiters[name]
+	for i, wt := range queue {
+		if wt == waiter {
+			queue = append(queue[:i], queue[i+1:]...)
+			break
+		}
+	}
+	if len(queue) == 0 {
+		delete(h.waiters, name)
+	} else {
+		h.waiters[name] = queue
+	}
+}
+
+// grantNextWaiterLocked hands the free lock of the named state to the longest
+// waiting client. Must be called with h.mu held.
+func (h *StateHandler) grantNextWaiterLocked(name string) {
+	queue := h.waiters[name]
+	if len(queue) == 0 {
+		return
+	}
+	waiter := queue[0]
+	h.removeWaiterLocked(name, waiter)
+
+	h.acquireLocked(name, waiter.info, waiter.source)
+	waiter.granted = true
+	close(waiter.ready)
+}
+
+// waitForLock blocks until the waiter is granted the lock, the wait times out,
+// or the client disconnects. A client that disconnects is removed from the
+// queue, and a lock granted to it in the meantime is released again, so an
+// abandoned CI job never ends up holding a lock it will not release.
+func (h *StateHandler) waitForLock(w http.ResponseWriter, r *http.Request, name string, waiter *lockWaiter) {
+	timer := time.NewTimer(h.lockWait)
+	defer timer.Stop()
+
+	select {
+	case <-waiter.ready:
+		// The select picks at random when the client went away as well
+		if r.Context().Err() == nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			_ = json.NewEncoder(w).Encode(waiter.info)
+			return
+		}
+	case <-r.Context().Done():
+	case <-timer.C:
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if r.Context().Err() != nil {
+		if waiter.granted {
+			// Granted just as the client went away
+			if current, locked := h.locks[name]; locked && current.ID == waiter.info.ID {
+				slog.Info("Client waiting for lock disconnected after it was granted; releasing", "state", name, "lock_id", waiter.info.ID)
+				h.releaseLocked(name)
+			}
+			return
+		}
+		slog.Info("Client waiting for lock disconnected; removed from queue", "state", name, "lock_id", waiter.info.ID)
+		h.removeWaiterLocked(name, waiter)
+		return
+	}
+
+	if waiter.granted {
+		// Granted just as the wait timed out
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(w).Encode(waiter.info)
+		return
+	}
+
+	h.removeWaiterLocked(name, waiter)
+	writeLockError(w, ErrLockConflict, h.locks[name])
+}
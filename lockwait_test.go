@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// lockAsync sends a LOCK request in the background and returns its recorder once done.
+func lockAsync(handler *StateHandler, ctx context.Context, lockID string) <-chan *httptest.ResponseRecorder {
+	done := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		body, _ := json.Marshal(LockInfo{ID: lockID})
+		req := httptest.NewRequest("LOCK", "/myproject", bytes.NewReader(body)).WithContext(ctx)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		done <- w
+	}()
+	return done
+}
+
+// waitForWaiters blocks until n clients wait for the lock on myproject.
+func waitForWaiters(t *testing.T, handler *StateHandler, n int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		handler.mu.RLock()
+		waiting := len(handler.waiters["myproject"])
+		handler.mu.RUnlock()
+		if waiting == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("expected %d waiters", n)
+}
+
+func unlock(handler *StateHandler, lockID string) {
+	body, _ := json.Marshal(LockInfo{ID: lockID})
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("UNLOCK", "/myproject", bytes.NewReader(body)))
+}
+
+func TestLockWait_GrantedOnRelease(t *testing.T) {
+	handler, _ := newTestHandler()
+	handler.lockWait = time.Second
+	handler.locks["myproject"] = LockInfo{ID: "lock-123"}
+
+	done := lockAsync(handler, context.Background(), "lock-456")
+	waitForWaiters(t, handler, 1)
+	unlock(handler, "lock-123")
+
+	w := <-done
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+	if !handler.IsLocked("myproject") || handler.locks["myproject"].ID != "lock-456" {
+		t.Errorf("expected lock to be held by lock-456, got %+v", handler.locks["myproject"])
+	}
+}
+
+func TestLockWait_Timeout(t *testing.T) {
+	handler, _ := newTestHandler()
+	handler.lockWait = 10 * time.Millisecond
+	handler.locks["myproject"] = LockInfo{ID: "lock-123"}
+
+	w := <-lockAsync(handler, context.Background(), "lock-456")
+
+	if w.Code != http.StatusLocked {
+		t.Errorf("expected status 423, got %d", w.Code)
+	}
+	if len(handler.waiters["myproject"]) != 0 {
+		t.Error("expected waiter to be removed after timeout")
+	}
+}
+
+func TestLockWait_DisconnectedClientNeverGranted(t *testing.T) {
+	handler, _ := newTestHandler()
+	handler.lockWait = time.Second
+	handler.locks["myproject"] = LockInfo{ID: "lock-123"}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	abandoned := lockAsync(handler, ctx, "lock-abandoned")
+	waitForWaiters(t, handler, 1)
+	waiting := lockAsync(handler, context.Background(), "lock-456")
+	waitForWaiters(t, handler, 2)
+
+	// The first client goes away before the lock is released
+	cancel()
+	<-abandoned
+	waitForWaiters(t, handler, 1)
+
+	unlock(handler, "lock-123")
+	if w := <-waiting; w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
+	handler.mu.RLock()
+	defer handler.mu.RUnlock()
+	if handler.locks["myproject"].ID != "lock-456" {
+		t.Errorf("expected lock to skip the disconnected client, got %+v", handler.locks["myproject"])
+	}
+}
+
+func TestLockWait_GrantedAfterDisconnectIsReleased(t *testing.T) {
+	handler, _ := newTestHandler()
+	handler.lockWait = time.Second
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// The lock is granted while the client is already gone, so both cases
+	// of the wait are ready at once; the select picks either at random
+	for range 20 {
+		handler.mu.Lock()
+		handler.acquireLocked("myproject", LockInfo{ID: "lock-123"}, lockSource{})
+		waiter := handler.enqueueWaiter("myproject", LockInfo{ID: "lock-abandoned"}, lockSource{})
+		handler.releaseLocked("myproject")
+		handler.mu.Unlock()
+
+		req := httptest.NewRequest("LOCK", "/myproject", nil).WithContext(ctx)
+		w := httptest.NewRecorder()
+		handler.waitForLock(w, req, "myproject", waiter)
+		if handler.IsLocked("myproject") {
+			t.Fatalf("expected the lock granted to the disconnected client to be released, got %+v", handler.locks["myproject"])
+		}
+		if w.Code == http.StatusOK && w.Body.Len() > 0 {
+			t.Fatal("expected no lock to be reported to the disconnected client")
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Formats of the log, set with LOG_FORMAT.
+const (
+	LogFormatText = "text" // One line per entry with its fields as key=value
+	LogFormatJSON = "json" // One JSON object per line, for Loki, Elasticsearch and the like
+)
+
+var logFormats = []string{LogFormatText, LogFormatJSON}
+
+// logLevel is the least severe level logged, set from LOG_LEVEL at startup
+// and on SIGHUP.
+var logLevel = new(slog.LevelVar)
+
+// logLevels are the values of LOG_LEVEL.
+var logLevels = []string{"debug", "info", "warn", "error"}
+
+// parseLogLevel parses a LOG_LEVEL, one of logLevels.
+func parseLogLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(s)); err != nil || strings.ContainsAny(s, "+-") {
+		return 0, fmt.Errorf("LOG_LEVEL must be one of %s", strings.Join(logLevels, ", "))
+	}
+	return level, nil
+}
+
+// newLogHandler returns the handler writing entries at level or above to w
+// in format.
+func newLogHandler(w io.Writer, level slog.Leveler, format string) slog.Handler {
+	opts := &slog.HandlerOptions{Level: level}
+	if format == LogFormatJSON {
+		return slog.NewJSONHandler(w, opts)
+	}
+	return slog.NewTextHandler(w, opts)
+}
+
+// setupLogging makes the default logger write entries as configured to
+// standard error. What is still logged with the log package, such as the
+// errors of net/http, is written at the info level. The level can be changed
+// later through logLevel.
+func setupLogging(level slog.Level, format string) {
+	logLevel.Set(level)
+	slog.SetDefault(slog.New(newLogHandler(os.Stderr, logLevel, format)))
+}
+
+// fatal logs msg and its fields as an error and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
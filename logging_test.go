@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestParseLogLevel(t *testing.T) {
+	tests := map[string]slog.Level{
+		"debug": slog.LevelDebug,
+		"info":  slog.LevelInfo,
+		"WARN":  slog.LevelWarn,
+		"error": slog.LevelError,
+	}
+	for s, want := range tests {
+		if got, err := parseLogLevel(s); err != nil || got != want {
+			t.Errorf("%s: expected %v, got %v, %v", s, want, got, err)
+		}
+	}
+	for _, s := range []string{"verbose", "info+2", ""} {
+		if _, err := parseLogLevel(s); err == nil {
+			t.Errorf("%q: expected error", s)
+		}
+	}
+}
+
+func TestNewLogHandler_JSON(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(newLogHandler(&buf, slog.LevelWarn, LogFormatJSON))
+	logger.Info("Lock acquired", "state", "network")
+	logger.Warn("Apply released its lock without writing the state", "state", "network", "lock_id", "abc")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("expected entries below the level to be dropped, got %q", buf.String())
+	}
+	var entry map[string]any
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatalf("expected a JSON entry, got %q: %v", lines[0], err)
+	}
+	if entry["level"] != "WARN" || entry["state"] != "network" || entry["lock_id"] != "abc" {
+		t.Errorf("unexpected entry %v", entry)
+	}
+}
+
+func TestNewLogHandler_Text(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(newLogHandler(&buf, slog.LevelInfo, LogFormatText))
+	logger.Info("Lock acquired", "state", "network")
+
+	if got := buf.String(); !strings.Contains(got, `msg="Lock acquired" state=network`) {
+		t.Errorf("unexpected entry %q", got)
+	}
+}
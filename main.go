@@ -3,124 +3,601 @@ package main
 import (
 	"context"
 	"crypto/subtle"
-	"log"
+	"crypto/tls"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"strings"
 	"syscall"
 	"time"
+
+	"golang.org/x/crypto/acme/autocert"
 )
 
 func main() {
+	// Run a CLI subcommand instead of the server if one is given
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:]))
+	}
+
 	// Load configuration
 	cfg, err := LoadConfig()
 	if err != nil {
-		log.Fatalf("Failed to load configuration: %v", err)
+		fatal("Failed to load configuration", "error", err)
+	}
+	setupLogging(cfg.LogLevel, cfg.LogFormat)
+	if cfg.AccessLogFormat == AccessLogCombined {
+		combinedLog = os.Stdout
+	}
+
+	// Store states where the repository keeps them
+	if err := useStatePathTemplate(cfg.StatePathTemplate); err != nil {
+		fatal("Failed to load configuration", "error", err)
+	}
+	if cfg.StatePathTemplate != DefaultStatePathTemplate {
+		slog.Info("State layout", "template", cfg.StatePathTemplate)
+	}
+	stateCompression = cfg.StateCompression
+	if cfg.StateCompression != "" {
+		slog.Info("Compressing state files", "compression", cfg.StateCompression)
+	}
+	stateChunkSize = cfg.StateChunkSize
+	if cfg.StateChunkSize > 0 {
+		slog.Info("Splitting state files into chunks", "chunk_size_mb", cfg.StateChunkSize>>20)
+	}
+	if err := useCommitMessageTemplate(cfg.CommitMessageTemplate); err != nil {
+		fatal("Failed to load configuration", "error", err)
+	}
+
+	if cfg.GiteaAPIBudget > 0 {
+		giteaBudget = NewAPIBudget(cfg.GiteaAPIBudget)
+		slog.Info("Limiting Gitea API calls per minute", "calls", cfg.GiteaAPIBudget)
+	}
+	giteaLimiter = NewRateLimiter(cfg.GiteaMaxConcurrency)
+	if cfg.GiteaMaxConcurrency > 0 {
+		slog.Info("Limiting Gitea API calls at once", "calls", cfg.GiteaMaxConcurrency)
+	}
+	repoMoves = NewRepoMoves(cfg.RepoMoves == RepoMovesFollow)
+
+	// In development mode, point the client at an in-memory Gitea stub
+	if cfg.DevMode {
+		cfg.StorageBackend = BackendGitea
+		cfg.GiteaURL, err = startDevGitea()
+		if err != nil {
+			fatal("Failed to start dev Gitea", "error", err)
+		}
+		slog.Warn("DEV_MODE enabled - states are held in memory and lost on exit")
+	}
+
+	// Initialize the repository client
+	repo, err := NewRepository(cfg)
+	if err != nil {
+		fatal("Failed to create storage client", "storage", cfg.StorageBackend, "error", err)
+	}
+
+	// When started by an upgrade, wait for the backend being upgraded to
+	// finish its requests and hand over its locks
+	handedLocks, err := takeOver()
+	if err != nil {
+		fatal("Failed to take over from the backend being upgraded", "error", err)
 	}
 
-	// Initialize Gitea client
-	giteaClient, err := NewGiteaClient(cfg)
+	// Keep operational counters across restarts, if configured
+	counters, err := OpenCounterStore(cfg.CountersFile)
 	if err != nil {
-		log.Fatalf("Failed to create Gitea client: %v", err)
+		fatal("Failed to open counters", "error", err)
+	}
+	if cfg.CountersFile != "" {
+		slog.Info("Counters", "file", cfg.CountersFile)
+	}
+
+	// Record every commit in the audit log, if configured
+	var auditLog *AuditLog
+	if cfg.AuditLogFile != "" {
+		auditLog, err = OpenAuditLog(cfg.AuditLogFile)
+		if err != nil {
+			fatal("Failed to open audit log", "error", err)
+		}
+		defer auditLog.Close()
+		auditLog.PersistSeq(counters)
+		repo.SetAuditLog(auditLog)
+		slog.Info("Audit log", "file", cfg.AuditLogFile)
 	}
 
 	// Create state handler
-	stateHandler := NewStateHandler(giteaClient, cfg.MaxBodySize)
+	stateHandler := NewStateHandler(repo, cfg.MaxBodySize)
+	stateHandler.sizeLimits = cfg.SizeLimits
+	stateHandler.versionLimits = cfg.VersionLimits
+	stateHandler.sizeWarnPercent = cfg.SizeWarnPercent
+	stateHandler.requireLock = cfg.RequireLock
+	if cfg.RequireLock {
+		slog.Info("State writes require a lock")
+	}
+	stateHandler.lockWait = cfg.LockWait
+	if cfg.LockWait > 0 {
+		slog.Info("LOCK requests wait for a held lock", "timeout", cfg.LockWait)
+	}
+	stateHandler.lockMethod = cfg.LockMethod
+	stateHandler.unlockMethod = cfg.UnlockMethod
+	if cfg.LockMethod != "LOCK" || cfg.UnlockMethod != "UNLOCK" {
+		slog.Info("Lock methods", "lock", cfg.LockMethod, "unlock", cfg.UnlockMethod)
+	}
+	stateHandler.allowRawState = cfg.AllowRawState
+	if cfg.AllowRawState {
+		slog.Warn("State validation disabled - bodies are stored as-is")
+	}
+	stateHandler.routeHints = cfg.RouteHints
+	stateHandler.lockAuthors = cfg.CommitAuthorFromLock
+	stateHandler.applyChecks = cfg.ConcurrentApplyWarnings
+	stateHandler.verifyReads = cfg.VerifyChecksums
+	stateHandler.readFallback = cfg.ReadFallback
+	if len(cfg.ProtectedStates) > 0 {
+		stateHandler.commits = NewCommitWindow(cfg.ProtectedStates)
+	}
+	stateHandler.tagUpdates = cfg.TagOnUpdate
+	if cfg.TagOnUpdate {
+		slog.Info("Tagging state updates", "tag", "tfstate/{name}/serial-{n}")
+	}
+	stateHandler.stealGrace = cfg.LockStealGrace
+	if cfg.RunHistory > 0 {
+		stateHandler.runs = NewRunLog(cfg.RunHistory)
+	}
+	stateHandler.reads.missTTL = cfg.ReadMissCacheTTL
+	stateHandler.audit = auditLog
+	stateHandler.auditRepo = cfg.GiteaOwner + "/" + cfg.GiteaRepo
+	stateHandler.counters = counters
+	if cfg.WriteCoalesceWindow > 0 {
+		stateHandler.coalescer, err = NewWriteCoalescer(cfg.WriteCoalesceWindow, cfg.WriteCoalesceDir, stateHandler.writes.Lock, stateHandler.commitSpooled)
+		if err != nil {
+			fatal("Failed to open write spool", "error", err)
+		}
+		slog.Info("Coalescing writes made soon after the lock holder's last commit", "window", cfg.WriteCoalesceWindow)
+	}
+	if cfg.NotifyWebhookURL != "" {
+		stateHandler.notifier = NewNotifier(cfg.NotifyWebhookURL, cfg.RepoURL())
+		repoMoves.notifier = stateHandler.notifier
+		slog.Info("Sending events to webhook")
+	}
+
+	// Background jobs run until shutdown
+	jobCtx, stopJobs := context.WithCancel(context.Background())
+	defer stopJobs()
+	jobs := NewJobs(cfg.JobTimeout, cfg.JobTimeouts, cfg.JobsPaused, cfg.JobConcurrency)
 
-	// Create the main handler with optional auth middleware
-	var stateHandlerWithAuth http.Handler = stateHandler
+	// Optionally repeat writes against a shadow storage to validate it
+	if cfg.Shadow {
+		shadowStorage, target, err := newShadowStorage(cfg)
+		if err != nil {
+			fatal("Failed to create shadow storage", "error", err)
+		}
+		stateHandler.shadow = NewShadow(shadowStorage, target)
+		go stateHandler.shadow.Run(jobCtx)
+		slog.Info("Shadowing writes; divergences are reported at /admin/shadow", "target", target)
+	}
+
+	// Rotated credentials are put into use without a restart
+	credentials := newCredentialReloader(cfg, repo)
+
+	// Protect state and admin endpoints with optional auth middleware
+	protect := func(h http.Handler) http.Handler { return h }
 	if cfg.AuthToken != "" {
-		stateHandlerWithAuth = authMiddleware(cfg.AuthToken, stateHandler)
-		log.Printf("Authentication enabled")
+		protect = func(h http.Handler) http.Handler { return authMiddleware(credentials.AuthToken, h) }
+		slog.Info("Authentication enabled")
 	} else {
-		log.Printf("WARNING: Authentication disabled - AUTH_TOKEN not set")
+		slog.Warn("Authentication disabled - AUTH_TOKEN not set")
+	}
+
+	// Limit the requests of each client, told apart by token when
+	// authentication is enabled, and the requests served at once
+	var tenants *TenantRouter
+	var authenticates func(token string) bool
+	if cfg.AuthToken != "" || cfg.TenantsFile != "" {
+		authenticates = func(token string) bool {
+			if tenants != nil {
+				return tenants.Authenticates(token)
+			}
+			return validToken(token, credentials.AuthToken())
+		}
+	}
+	clientLimiter := NewClientLimiter(cfg.RequestRateLimit, authenticates)
+	if cfg.RequestRateLimit > 0 {
+		slog.Info("Limiting each client's requests per minute", "requests", cfg.RequestRateLimit)
+	}
+	shedder := NewShedder(cfg.MaxConcurrentRequests)
+	if cfg.MaxConcurrentRequests > 0 {
+		slog.Info("Shedding requests beyond a number in flight", "requests", cfg.MaxConcurrentRequests)
+	}
+	credentials.limits, credentials.shedder = clientLimiter, shedder
+
+	// Reload credentials and limits on SIGHUP, and credentials when their
+	// files change
+	hup, tenantHup := make(chan os.Signal, 1), make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	signal.Notify(tenantHup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			slog.Info("Reloading configuration")
+			if err := credentials.Reload(jobCtx); err != nil {
+				slog.Error("Failed to reload configuration", "error", err)
+			}
+		}
+	}()
+	if secretFilesSet() && cfg.CredentialReloadInterval > 0 {
+		go jobs.Run(jobCtx, "credential-reload", cfg.CredentialReloadInterval, credentials.Reload)
+		slog.Info("Checking secret files for rotated credentials", "interval", cfg.CredentialReloadInterval)
 	}
 
 	// Set up routes
 	mux := http.NewServeMux()
 	mux.HandleFunc("/health", handleHealth)
-	mux.Handle("/metrics", MetricsHandler())
-	mux.Handle("/", stateHandlerWithAuth)
+	readiness := &Readiness{}
+	mux.Handle("/ready", readiness)
+	mux.Handle("/metrics", MetricsHandler(cfg.MetricsLabels))
+	docs := NewDocsHandler()
+	if cfg.HideVersion {
+		docs.version = ""
+	}
+	mux.Handle("/docs", docs)
+	mux.Handle("/docs/", docs)
+	var states http.Handler = stateHandler
+	var repoRouter *RepoRouter
+	if cfg.MultiRepo {
+		gitea, ok := repo.(*GiteaClient)
+		if !ok {
+			fatal("MULTI_REPO needs the storage to be a Gitea repository written through the API", "storage", cfg.StorageBackend)
+		}
+		repoRouter = NewRepoRouter(stateHandler, gitea, cfg.MultiRepoAllowlist)
+		states = repoRouter
+		slog.Info("Serving states of other repositories at /{owner}/{repo}/{name}", "allowlist", cfg.MultiRepoAllowlist)
+	}
+	if cfg.TenantsFile != "" {
+		// Tenants authenticate with their own tokens, so they are routed
+		// before the server-wide authentication
+		tenants, err = NewTenantRouter(cfg, stateHandler, credentials.AuthToken, protect(states))
+		if err != nil {
+			fatal("Failed to load tenants", "error", err)
+		}
+		mux.Handle("/", tenants)
+		if cfg.MetricsTenantLabel {
+			EnableTenantLabel(tenants.Tenant)
+		}
+		go func() {
+			for range tenantHup {
+				slog.Info("Reloading tenants")
+				if err := tenants.Reload(jobCtx); err != nil {
+					slog.Error("Failed to reload tenants", "error", err)
+				}
+			}
+		}()
+		if cfg.CredentialReloadInterval > 0 {
+			go jobs.Run(jobCtx, "tenant-reload", cfg.CredentialReloadInterval, tenants.Reload)
+		}
+		slog.Info("Tenants", "file", cfg.TenantsFile)
+	} else {
+		mux.Handle("/", protect(states))
+		if cfg.MetricsTenantLabel {
+			EnableTenantLabel(pathTenant)
+		}
+	}
+	whoami := whoamiHandler(clientLimiter)
+	if tenants != nil {
+		whoami = tenants.Protect(whoami, protect(whoami))
+	} else {
+		whoami = protect(whoami)
+	}
+	mux.Handle("GET /api/v1/whoami", whoami)
+	mux.Handle("GET /api/v1/stats", protect(counters))
+	mux.Handle("/admin/migrate", protect(http.HandlerFunc(stateHandler.handleMigrate)))
+	mux.Handle("GET /admin/config-schema", protect(http.HandlerFunc(handleConfigSchema)))
+	if stateHandler.shadow != nil {
+		mux.Handle("GET /admin/shadow", protect(stateHandler.shadow))
+	}
+	mux.Handle("GET /admin/jobs", protect(http.HandlerFunc(jobs.handleList)))
+	mux.Handle("GET /admin/repo-moves", protect(repoMoves))
+	mux.Handle("POST /admin/repo-moves/{owner}/{repo}", protect(http.HandlerFunc(repoMoves.handleConfirm)))
+	mux.Handle("POST /admin/jobs/{name}/{action}", protect(http.HandlerFunc(jobs.handleControl)))
 
-	// Add middleware (metrics wraps logging wraps routes)
-	handler := metricsMiddleware(loggingMiddleware(mux))
+	// Pause non-essential background jobs under resource pressure
+	var degrader *Degrader
+	if cfg.DegradeHeapMB > 0 || cfg.DegradeGoroutines > 0 || giteaBudget != nil {
+		degrader = NewDegrader(uint64(cfg.DegradeHeapMB)<<20, cfg.DegradeGoroutines, giteaBudget)
+		go jobs.Run(jobCtx, "degradation", DefaultDegradeCheckInterval, degrader.Check)
+	}
 
-	// Configure server with timeouts
-	server := &http.Server{
-		Addr:         cfg.ListenAddr,
-		Handler:      handler,
-		ReadTimeout:  30 * time.Second,
-		WriteTimeout: 60 * time.Second, // Higher to allow for slow Gitea responses
-		IdleTimeout:  120 * time.Second,
+	// Optionally index the states for GET /api/v1/search
+	if cfg.SearchIndexInterval > 0 {
+		stateHandler.index = NewStateIndex(repo)
+		mux.Handle("GET /api/v1/search", protect(stateHandler.index))
+		mux.Handle("POST /admin/index/rebuild", protect(http.HandlerFunc(stateHandler.index.handleRebuild)))
+		mux.Handle("GET /admin/index/verify", protect(http.HandlerFunc(stateHandler.index.handleVerify)))
+		rebuild := stateHandler.index.Rebuild
+		if cfg.StartupWarmup {
+			// Hold traffic back until the first pass has read every state
+			rebuild = readiness.Track(rebuild)
+			slog.Info("Reporting ready once the search index is built")
+		}
+		go jobs.Run(jobCtx, "search-index", cfg.SearchIndexInterval, degrader.Pausable("search-index", rebuild))
+		slog.Info("Indexing states for search", "interval", cfg.SearchIndexInterval)
 	}
 
-	// Start the server in a goroutine
-	log.Printf("Starting server on %s", cfg.ListenAddr)
-	log.Printf("Gitea: %s/%s/%s (branch: %s)", cfg.GiteaURL, cfg.GiteaOwner, cfg.GiteaRepo, cfg.GiteaBranch)
+	// Point out states committed in a layout the backend does not serve
+	reportLegacyStates(repo)
 
+	// Optionally archive inactive states
+	if cfg.ArchiveAfterMonths > 0 {
+		archiver := NewArchiver(repo, repo.WithRepo(cfg.ArchiveRepo), cfg.ArchiveAfterMonths, stateHandler.IsLocked)
+		archiver.reads = stateHandler.reads
+		stateHandler.archiver = archiver
+		mux.Handle("POST /admin/rehydrate/{name...}", protect(archiver))
+		go jobs.Run(jobCtx, "archive", cfg.ArchiveInterval, degrader.Pausable("archive", archiver.Run))
+		slog.Info("Archiving inactive states", "months", cfg.ArchiveAfterMonths, "repo", cfg.GiteaOwner+"/"+cfg.ArchiveRepo)
+	}
+
+	// Delete states on confirmed request, optionally after a grace period
+	deleter := NewStateDeleter(repo, cfg.StateDeleteGrace, stateHandler.IsLocked)
+	deleter.notifier = stateHandler.notifier
+	deleter.index = stateHandler.index
+	stateHandler.deleter = deleter
+	if cfg.StateDeleteGrace > 0 {
+		go jobs.Run(jobCtx, "state-deletion", min(cfg.StateDeleteGrace, time.Hour), deleter.Run)
+		slog.Info("Deleting states after a grace period", "grace", cfg.StateDeleteGrace)
+	}
+
+	// Optionally serve unlocked reads from the nearest Gitea mirror
+	if len(cfg.ReadReplicas) > 0 {
+		replicas := NewReplicaSet(repo)
+		for _, rc := range cfg.ReadReplicas {
+			client, err := newReplicaClient(rc, cfg.ReadReplicaToken, cfg.GiteaBranch)
+			if err != nil {
+				fatal("Failed to create replica client", "error", err)
+			}
+			replicas.Add(rc.URL, client, client.Ping)
+		}
+		stateHandler.replicas = replicas
+		go jobs.Run(jobCtx, "replica-probe", cfg.ReplicaProbeInterval, replicas.Probe)
+		slog.Info("Serving unlocked reads from read replicas", "replicas", len(cfg.ReadReplicas))
+	}
+
+	// Optionally keep topics on the state repositories
+	if len(cfg.RepoTopics) > 0 {
+		topics := NewRepoTopics(cfg.RepoTopics)
+		topics.Add(cfg.GiteaOwner+"/"+cfg.GiteaRepo, repo)
+		if cfg.ArchiveAfterMonths > 0 && cfg.ArchiveRepo != cfg.GiteaRepo {
+			topics.Add(cfg.GiteaOwner+"/"+cfg.ArchiveRepo, repo.WithRepo(cfg.ArchiveRepo))
+		}
+		topics.tenants = tenants
+		go jobs.Run(jobCtx, "repo-topics", repoTopicsInterval, degrader.Pausable("repo-topics", topics.Run))
+		slog.Info("Keeping topics on the state repositories", "topics", cfg.RepoTopics)
+	}
+
+	// Track repository size and growth
+	repoSize := NewRepoSizeMonitor(repo, cfg.RepoGrowthWarnMBDay)
+	go jobs.Run(jobCtx, "repo-size", cfg.RepoSizeInterval, degrader.Pausable("repo-size", repoSize.Run))
+
+	// Add middleware (metrics wraps recovery wraps security wraps logging wraps foreground wraps the request limits wraps routes)
+	routes := shedder.Middleware(clientLimiter.Middleware(mux))
+	newHandler := func(securityHeaders bool) http.Handler {
+		return metricsMiddleware(recoveryMiddleware(securityMiddleware(securityHeaders, cfg.HSTSMaxAge, loggingMiddleware(foregroundMiddleware(routes)))))
+	}
+
+	// Requests, and the storage calls made for them, are cancelled if they
+	// outlast the shutdown grace period
+	requestCtx, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
+
+	var tlsConfig *tls.Config
+	var acme *autocert.Manager
+	switch {
+	case cfg.TLSCertFile != "":
+		certs, err := NewCertReloader(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			fatal("Failed to load the TLS certificate", "error", err)
+		}
+		tlsConfig = certs.TLSConfig()
+	case len(cfg.ACMEDomains) > 0:
+		acme = newACMEManager(cfg)
+		tlsConfig = acme.TLSConfig()
+		tlsConfig.MinVersion = tls.VersionTLS12
+		slog.Info("Getting certificates from Let's Encrypt", "domains", cfg.ACMEDomains, "cache", cfg.ACMECacheDir)
+	}
+
+	// Hold the locks handed over by an upgrade before serving, in the
+	// handlers that held them
+	stateHandler.takeOverLocks(handedLocks)
+	tenants.takeOverLocks(handedLocks)
+	repoRouter.takeOverLocks(handedLocks)
+
+	// Listen before serving, so that an address in use stops the start;
+	// plaintext listeners may redirect to the port of the first TLS one
+	lns := make([]net.Listener, len(cfg.Listeners))
+	tlsPort := ""
+	for i, l := range cfg.Listeners {
+		if lns[i], err = listen(l.Addr); err != nil {
+			fatal("Failed to listen", "addr", l.Addr, "error", err)
+		}
+		if port, ok := tcpPort(lns[i]); ok && l.TLS && tlsPort == "" {
+			tlsPort = port
+		}
+	}
+
+	// Configure a server with timeouts for every listener
+	var servers []*http.Server
+	for i, l := range cfg.Listeners {
+		securityHeaders := cfg.SecurityHeaders
+		if l.SecurityHeaders != nil {
+			securityHeaders = *l.SecurityHeaders
+		}
+		handler := newHandler(securityHeaders)
+		if l.Redirect {
+			if tlsPort == "" {
+				fatal("Failed to listen: redirect needs a TCP tls listener to redirect to", "addr", l.Addr)
+			}
+			handler = httpsRedirect(tlsPort)
+		}
+		if acme != nil && !l.TLS {
+			// Answer the HTTP challenges of the CA on plaintext listeners
+			handler = acme.HTTPHandler(handler)
+		}
+		server := &http.Server{
+			Addr:         l.Addr,
+			Handler:      handler,
+			BaseContext:  func(net.Listener) context.Context { return requestCtx },
+			ReadTimeout:  30 * time.Second,
+			WriteTimeout: 60 * time.Second, // Higher to allow for slow Gitea responses
+			IdleTimeout:  120 * time.Second,
+		}
+		if l.TLS {
+			server.TLSConfig = tlsConfig
+		}
+		servers = append(servers, server)
+
+		ln := lns[i]
+		slog.Info("Starting server", "listener", l.String())
+		go func() {
+			var err error
+			if l.TLS {
+				err = server.ServeTLS(ln, "", "")
+			} else {
+				err = server.Serve(ln)
+			}
+			if err != nil && err != http.ErrServerClosed {
+				fatal("Server failed", "addr", l.Addr, "error", err)
+			}
+		}()
+	}
+	slog.Info("Storage", "storage", cfg.StorageBackend, "repo", cfg.RepoURL(), "branch", cfg.GiteaBranch)
+
+	// Tell systemd, if it started the backend, once the storage is reachable
+	go notifyReady(jobCtx, repo.Ping)
+
+	// Upgrade to the binary installed at the same path on SIGUSR2
+	upgrader := NewUpgrader(cfg.Listeners, lns)
+	usr2 := make(chan os.Signal, 1)
+	signal.Notify(usr2, syscall.SIGUSR2)
 	go func() {
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("Server failed: %v", err)
+		for range usr2 {
+			if err := upgrader.Start(); err != nil {
+				slog.Error("Upgrade failed", "error", err)
+			}
 		}
 	}()
 
-	// Wait for interrupt signal
+	// Wait for interrupt signal, or for an upgrade to take over
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
-	<-quit
-
-	log.Println("Shutting down server...")
+	upgrading := false
+	select {
+	case <-quit:
+		slog.Info("Shutting down server")
+		_ = sdNotify("STOPPING=1")
+	case <-upgrader.Ready():
+		upgrading = true
+		slog.Info("Handing over to the upgraded backend")
+	}
+	stopJobs()
 
 	// Give outstanding requests 30 seconds to complete
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
-	if err := server.Shutdown(ctx); err != nil {
-		log.Fatalf("Server forced to shutdown: %v", err)
+	if err := shutdownServers(ctx, servers); err != nil {
+		// Commits of protected states get longer, but not forever; the
+		// other requests still running are aborted
+		stateHandler.commits.Drain(cfg.ProtectedWriteDrain, quit)
+		cancelRequests()
+		fatal("Server forced to shutdown", "error", err)
+	}
+	stateHandler.coalescer.FlushAll(ctx)
+	if upgrading {
+		if err := upgrader.HandOver(stateHandler, tenants, repoRouter); err != nil {
+			slog.Error("Upgrade failed", "error", err)
+		}
 	}
 
-	log.Println("Server stopped")
+	slog.Info("Server stopped")
 }
 
-// authMiddleware checks for a valid Bearer token.
-func authMiddleware(token string, next http.Handler) http.Handler {
+// authMiddleware checks for a valid Bearer token. The token is looked up on
+// every request, so it can be rotated while the server runs.
+func authMiddleware(token func() string, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		auth := r.Header.Get("Authorization")
-
-		// Support both "Bearer <token>" and basic auth (Terraform sends password as basic auth)
-		var providedToken string
-
-		if strings.HasPrefix(auth, "Bearer ") {
-			providedToken = strings.TrimPrefix(auth, "Bearer ")
-		} else if strings.HasPrefix(auth, "Basic ") {
-			// Terraform's http backend sends the password as basic auth
-			// The password is in the format "username:password" base64 encoded
-			// We only care about the password part
-			username, password, ok := r.BasicAuth()
-			if ok {
-				// Use password as the token (username is ignored)
-				_ = username
-				providedToken = password
-			}
-		}
-
-		if subtle.ConstantTimeCompare([]byte(providedToken), []byte(token)) != 1 {
-			w.Header().Set("WWW-Authenticate", `Bearer realm="terraform-state"`)
-			http.Error(w, "unauthorized", http.StatusUnauthorized)
+		r, ok := authenticate(r, token())
+		if !ok {
+			writeUnauthorized(w)
 			return
 		}
-
 		next.ServeHTTP(w, r)
 	})
 }
 
-// loggingMiddleware logs each request.
-func loggingMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("%s %s", r.Method, r.URL.Path)
-		next.ServeHTTP(w, r)
-	})
+// authenticate checks the token a request presents against tokens, ignoring
+// empty ones, and returns the request carrying the caller's Principal.
+func authenticate(r *http.Request, tokens ...string) (*http.Request, bool) {
+	auth := r.Header.Get("Authorization")
+
+	// Support both "Bearer <token>" and basic auth (Terraform sends password as basic auth)
+	var providedToken string
+
+	if strings.HasPrefix(auth, "Bearer ") {
+		providedToken = strings.TrimPrefix(auth, "Bearer ")
+	} else if strings.HasPrefix(auth, "Basic ") {
+		// Terraform's http backend sends the password as basic auth
+		// The password is in the format "username:password" base64 encoded
+		// We only care about the password part
+		_, password, ok := r.BasicAuth()
+		if ok {
+			// Use password as the token (username is ignored)
+			providedToken = password
+		}
+	}
+
+	if !validToken(providedToken, tokens...) {
+		return r, false
+	}
+
+	principal := Principal{Method: "bearer"}
+	if username, _, ok := r.BasicAuth(); ok {
+		principal = Principal{Method: "basic", Username: username}
+	}
+	recordPrincipal(r.Context(), principal)
+	return r.WithContext(context.WithValue(r.Context(), principalKey{}, principal)), true
+}
+
+// validToken reports whether provided is one of tokens, ignoring empty ones.
+func validToken(provided string, tokens ...string) bool {
+	valid := false
+	for _, token := range tokens {
+		if token != "" && subtle.ConstantTimeCompare([]byte(provided), []byte(token)) == 1 {
+			valid = true
+		}
+	}
+	return valid
+}
+
+// writeUnauthorized rejects a request that failed authentication.
+func writeUnauthorized(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="terraform-state"`)
+	writeError(w, ErrUnauthorized)
+}
+
+// Principal identifies the authenticated caller of a request.
+type Principal struct {
+	Method   string // "bearer", "basic" or "none" when authentication is disabled
+	Username string // Basic auth username; informational only, never verified
+	Tenant   string // Prefix of the tenant whose auth_token was presented, if any
+}
+
+type principalKey struct{}
+
+// principalFromContext returns the caller set by authMiddleware.
+// Requests that did not pass through it are unauthenticated.
+func principalFromContext(ctx context.Context) Principal {
+	if principal, ok := ctx.Value(principalKey{}).(Principal); ok {
+		return principal
+	}
+	return Principal{Method: "none"}
 }
 
 // handleHealth responds to health check requests.
@@ -34,7 +34,7 @@ func TestAuthMiddleware_ValidBearerToken(t *testing.T) {
 		w.WriteHeader(http.StatusOK)
 	})
 
-	handler := authMiddleware("secret-token", next)
+	handler := authMiddleware(func() string { return "secret-token" }, next)
 
 	req := httptest.NewRequest(http.MethodGet, "/test", nil)
 	req.Header.Set("Authorization", "Bearer secret-token")
@@ -57,7 +57,7 @@ func TestAuthMiddleware_ValidBasicAuth(t *testing.T) {
 		w.WriteHeader(http.StatusOK)
 	})
 
-	handler := authMiddleware("secret-token", next)
+	handler := authMiddleware(func() string { return "secret-token" }, next)
 
 	req := httptest.NewRequest(http.MethodGet, "/test", nil)
 	// Basic auth with username "user" and password "secret-token"
@@ -81,7 +81,7 @@ func TestAuthMiddleware_InvalidToken(t *testing.T) {
 		called = true
 	})
 
-	handler := authMiddleware("secret-token", next)
+	handler := authMiddleware(func() string { return "secret-token" }, next)
 
 	req := httptest.NewRequest(http.MethodGet, "/test", nil)
 	req.Header.Set("Authorization", "Bearer wrong-token")
@@ -106,7 +106,7 @@ func TestAuthMiddleware_NoToken(t *testing.T) {
 		called = true
 	})
 
-	handler := authMiddleware("secret-token", next)
+	handler := authMiddleware(func() string { return "secret-token" }, next)
 
 	req := httptest.NewRequest(http.MethodGet, "/test", nil)
 	w := httptest.NewRecorder()
@@ -127,7 +127,7 @@ func TestAuthMiddleware_InvalidBasicAuth(t *testing.T) {
 		called = true
 	})
 
-	handler := authMiddleware("secret-token", next)
+	handler := authMiddleware(func() string { return "secret-token" }, next)
 
 	req := httptest.NewRequest(http.MethodGet, "/test", nil)
 	credentials := base64.StdEncoding.EncodeToString([]byte("user:wrong-password"))
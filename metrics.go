@@ -1,54 +1,320 @@
 package main
 
 import (
+	"fmt"
 	"net/http"
+	"regexp"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
 )
 
 var (
-	httpRequestsTotal = promauto.NewCounterVec(
+	httpRequestsOpts = prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "Total number of HTTP requests",
+	}
+	httpRequestDurationOpts = prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "HTTP request duration in seconds",
+		Buckets: prometheus.DefBuckets,
+	}
+
+	httpRequestsTotal   = promauto.NewCounterVec(httpRequestsOpts, []string{"method", "status"})
+	httpRequestDuration = promauto.NewHistogramVec(httpRequestDurationOpts, []string{"method"})
+
+	// requestTenant derives the tenant label of the request metrics from the
+	// request path, when EnableTenantLabel added it
+	requestTenant func(path string) string
+
+	activeLocksGauge = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "tfstate_locks_active",
+			Help: "Number of currently held state locks",
+		},
+	)
+
+	archivedStatesTotal = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "tfstate_archived_total",
+			Help: "Total number of states moved to the archive",
+		},
+	)
+
+	storageRetriesTotal = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "tfstate_storage_retries_total",
+			Help: "Total number of Gitea API requests retried after a transient failure",
+		},
+	)
+
+	errorsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tfstate_errors_total",
+			Help: "Total number of failed requests, by error code",
+		},
+		[]string{"code"},
+	)
+
+	coalescedWritesTotal = promauto.NewCounter(
 		prometheus.CounterOpts{
-			Name: "http_requests_total",
-			Help: "Total number of HTTP requests",
+			Name: "tfstate_coalesced_writes_total",
+			Help: "Total number of state writes spooled to be committed with a later one",
 		},
-		[]string{"method", "status"},
 	)
 
-	httpRequestDuration = promauto.NewHistogramVec(
+	spooledCommitFailuresTotal = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "tfstate_spooled_commit_failures_total",
+			Help: "Total number of failed attempts to commit a spooled state write",
+		},
+	)
+
+	coalescedReadsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tfstate_coalesced_reads_total",
+			Help: "Total number of state reads served without a fetch of their own, by reason: inflight or miss_cache",
+		},
+		[]string{"reason"},
+	)
+
+	degradedGauge = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "tfstate_degraded",
+			Help: "1 while non-essential background jobs are paused under resource pressure, 0 otherwise",
+		},
+	)
+
+	degradationsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tfstate_degradations_total",
+			Help: "Total number of times non-essential background jobs were paused, by reason: heap, goroutines or gitea_budget",
+		},
+		[]string{"reason"},
+	)
+
+	skippedJobRunsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tfstate_skipped_job_runs_total",
+			Help: "Total number of background job runs skipped under resource pressure, by job",
+		},
+		[]string{"job"},
+	)
+
+	readFallbacksTotal = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "tfstate_read_fallbacks_total",
+			Help: "Total number of state reads served from an earlier version because the current one is corrupt",
+		},
+	)
+
+	repoMovesTotal = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "tfstate_repo_moves_total",
+			Help: "Total number of state repositories found renamed or transferred",
+		},
+	)
+
+	concurrentApplySuspectsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tfstate_concurrent_apply_suspects_total",
+			Help: "Total number of state writes that looked like concurrent applies, by reason: shared_lock or foreign_lock",
+		},
+		[]string{"reason"},
+	)
+
+	applyWithoutWriteRunsTotal = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "tfstate_apply_without_write_runs_total",
+			Help: "Total number of applies that released their lock without writing the state",
+		},
+	)
+
+	shadowDivergencesTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tfstate_shadow_divergences_total",
+			Help: "Total number of differences found between the primary and the shadow storage, by operation: write or read",
+		},
+		[]string{"op"},
+	)
+
+	panicsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tfstate_panics_total",
+			Help: "Total number of recovered panics, by source: http (request handlers) or job (background jobs)",
+		},
+		[]string{"source"},
+	)
+
+	repoSizeGauge = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "tfstate_repo_size_bytes",
+			Help: "Size of the state repository as reported by Gitea",
+		},
+	)
+
+	repoGrowthGauge = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "tfstate_repo_growth_bytes_per_day",
+			Help: "Growth rate of the state repository over the last day",
+		},
+	)
+
+	runDuration = promauto.NewHistogramVec(
 		prometheus.HistogramOpts{
-			Name:    "http_request_duration_seconds",
-			Help:    "HTTP request duration in seconds",
-			Buckets: prometheus.DefBuckets,
+			Name:    "tfstate_run_duration_seconds",
+			Help:    "Time from acquiring to releasing a state lock, by outcome of the run",
+			Buckets: prometheus.ExponentialBuckets(1, 2, 14),
 		},
-		[]string{"method"},
+		[]string{"outcome"},
 	)
 
-	activeLocksGauge = promauto.NewGauge(
+	giteaBudgetWait = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "tfstate_gitea_budget_wait_seconds",
+			Help:    "Time Gitea API calls waited for the API budget, by priority: foreground or background",
+			Buckets: []float64{0.001, 0.01, 0.1, 0.5, 1, 2.5, 5, 10, 30, 60},
+		},
+		[]string{"priority"},
+	)
+
+	giteaRateLimitsTotal = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "tfstate_gitea_rate_limits_total",
+			Help: "Total number of Gitea API calls answered with 429 Too Many Requests",
+		},
+	)
+
+	giteaCallsInFlight = promauto.NewGauge(
 		prometheus.GaugeOpts{
-			Name: "tfstate_locks_active",
-			Help: "Number of currently held state locks",
+			Name: "tfstate_gitea_calls_in_flight",
+			Help: "Gitea API calls in flight, counted with GITEA_MAX_CONCURRENCY set",
 		},
 	)
+
+	requestsInFlight = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "tfstate_requests_in_flight",
+			Help: "Requests being served, counted with MAX_CONCURRENT_REQUESTS set",
+		},
+	)
+
+	shedRequestsTotal = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "tfstate_shed_requests_total",
+			Help: "Total number of requests refused beyond MAX_CONCURRENT_REQUESTS",
+		},
+	)
+
+	processingDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "tfstate_processing_duration_seconds",
+			Help:    "Time spent handling state contents, by stage: transfer (Gitea API calls), base64 and json",
+			Buckets: prometheus.ExponentialBuckets(0.001, 4, 8),
+		},
+		[]string{"stage"},
+	)
 )
 
-// MetricsHandler returns the Prometheus metrics HTTP handler.
-func MetricsHandler() http.Handler {
-	return promhttp.Handler()
+// metricLabelName matches valid Prometheus label names.
+var metricLabelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// parseMetricLabels parses a comma-separated list of name=value pairs, e.g.
+// "cluster=eu-1,environment=prod".
+func parseMetricLabels(s string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(entry, "=")
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		if !ok || value == "" {
+			return nil, fmt.Errorf("invalid label %q: must be name=value", entry)
+		}
+		if !metricLabelName.MatchString(name) || strings.HasPrefix(name, "__") {
+			return nil, fmt.Errorf("invalid label name %q", name)
+		}
+		if _, ok := labels[name]; ok {
+			return nil, fmt.Errorf("label %q is set twice", name)
+		}
+		labels[name] = value
+	}
+	return labels, nil
 }
 
-// responseWriter wraps http.ResponseWriter to capture the status code.
+// MetricsHandler returns the Prometheus metrics HTTP handler. labels are
+// added to every exported metric, so that the metrics of several instances
+// can be told apart once aggregated.
+func MetricsHandler(labels map[string]string) http.Handler {
+	var gatherer prometheus.Gatherer = prometheus.DefaultGatherer
+	if len(labels) > 0 {
+		gatherer = labeledGatherer{gatherer, labels}
+	}
+	return promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer, promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{}))
+}
+
+// labeledGatherer adds static labels to the metrics of a Gatherer. A label a
+// metric already has is left as it is.
+type labeledGatherer struct {
+	prometheus.Gatherer
+	labels map[string]string
+}
+
+// Gather implements prometheus.Gatherer.
+func (g labeledGatherer) Gather() ([]*dto.MetricFamily, error) {
+	families, err := g.Gatherer.Gather()
+	for _, family := range families {
+		for _, metric := range family.Metric {
+			for name, value := range g.labels {
+				if !slices.ContainsFunc(metric.Label, func(l *dto.LabelPair) bool { return l.GetName() == name }) {
+					metric.Label = append(metric.Label, &dto.LabelPair{Name: proto.String(name), Value: proto.String(value)})
+				}
+			}
+			slices.SortFunc(metric.Label, func(a, b *dto.LabelPair) int { return strings.Compare(a.GetName(), b.GetName()) })
+		}
+	}
+	return families, err
+}
+
+// EnableTenantLabel adds a tenant label, derived from the request path by
+// tenant, to the HTTP request metrics. It must be called before serving.
+func EnableTenantLabel(tenant func(path string) string) {
+	prometheus.Unregister(httpRequestsTotal)
+	prometheus.Unregister(httpRequestDuration)
+	httpRequestsTotal = promauto.NewCounterVec(httpRequestsOpts, []string{"method", "status", "tenant"})
+	httpRequestDuration = promauto.NewHistogramVec(httpRequestDurationOpts, []string{"method", "tenant"})
+	requestTenant = tenant
+}
+
+// pathTenant returns the tenant of a state path: the first segment of a
+// nested state name, as in /{tenant}/{name}. Other paths have no tenant.
+func pathTenant(path string) string {
+	tenant, rest, ok := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+	if !ok || rest == "" || tenant == "api" || tenant == "admin" || tenant == "docs" {
+		return ""
+	}
+	return tenant
+}
+
+// responseWriter wraps http.ResponseWriter to capture the status code and
+// the size of the body written.
 type responseWriter struct {
 	http.ResponseWriter
 	statusCode int
+	written    int64
 }
 
 func newResponseWriter(w http.ResponseWriter) *responseWriter {
-	return &responseWriter{w, http.StatusOK}
+	return &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
 }
 
 func (rw *responseWriter) WriteHeader(code int) {
@@ -56,6 +322,17 @@ func (rw *responseWriter) WriteHeader(code int) {
 	rw.ResponseWriter.WriteHeader(code)
 }
 
+func (rw *responseWriter) Write(b []byte) (int, error) {
+	n, err := rw.ResponseWriter.Write(b)
+	rw.written += int64(n)
+	return n, err
+}
+
+// Unwrap returns the wrapped writer, for http.ResponseController.
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
 // metricsMiddleware records HTTP metrics for each request.
 func metricsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -72,7 +349,17 @@ func metricsMiddleware(next http.Handler) http.Handler {
 
 		duration := time.Since(start).Seconds()
 		status := strconv.Itoa(rw.statusCode)
+		if rw.statusCode >= 500 && requestCancelled(r) {
+			// Failures after the client disconnected are not outages
+			status = strconv.Itoa(statusClientClosedRequest)
+		}
 
+		if requestTenant != nil {
+			tenant := requestTenant(r.URL.Path)
+			httpRequestsTotal.WithLabelValues(r.Method, status, tenant).Inc()
+			httpRequestDuration.WithLabelValues(r.Method, tenant).Observe(duration)
+			return
+		}
 		httpRequestsTotal.WithLabelValues(r.Method, status).Inc()
 		httpRequestDuration.WithLabelValues(r.Method).Observe(duration)
 	})
@@ -89,3 +376,140 @@ func IncrementActiveLocks() {
 func DecrementActiveLocks() {
 	activeLocksGauge.Dec()
 }
+
+// IncrementArchivedStates records a state being archived.
+func IncrementArchivedStates() {
+	archivedStatesTotal.Inc()
+}
+
+// IncrementStorageRetries records a Gitea API request being retried.
+func IncrementStorageRetries() {
+	storageRetriesTotal.Inc()
+}
+
+// SetRepoSize records the current size of the state repository.
+func SetRepoSize(bytes int64) {
+	repoSizeGauge.Set(float64(bytes))
+}
+
+// SetRepoGrowthRate records the growth rate of the state repository.
+func SetRepoGrowthRate(bytesPerDay float64) {
+	repoGrowthGauge.Set(bytesPerDay)
+}
+
+// ObserveProcessingTime records the time spent in a processing stage since start.
+func ObserveProcessingTime(stage string, start time.Time) {
+	processingDuration.WithLabelValues(stage).Observe(time.Since(start).Seconds())
+}
+
+// ObserveProcessingDuration records time spent in a processing stage that is
+// not spent in one go, such as while a request is sent.
+func ObserveProcessingDuration(stage string, d time.Duration) {
+	processingDuration.WithLabelValues(stage).Observe(d.Seconds())
+}
+
+// ObserveGiteaBudgetWait records the time a Gitea API call waited for the API budget.
+func ObserveGiteaBudgetWait(priority string, d time.Duration) {
+	giteaBudgetWait.WithLabelValues(priority).Observe(d.Seconds())
+}
+
+// IncrementGiteaRateLimits counts a Gitea API call answered with 429.
+func IncrementGiteaRateLimits() {
+	giteaRateLimitsTotal.Inc()
+}
+
+// SetGiteaCallsInFlight sets the number of Gitea API calls in flight.
+func SetGiteaCallsInFlight(n int) {
+	giteaCallsInFlight.Set(float64(n))
+}
+
+// SetRequestsInFlight sets the number of requests being served.
+func SetRequestsInFlight(n int) {
+	requestsInFlight.Set(float64(n))
+}
+
+// IncrementShedRequests counts a request refused beyond the limit on
+// requests in flight.
+func IncrementShedRequests() {
+	shedRequestsTotal.Inc()
+}
+
+// ObserveRunDuration records the duration of a finished run.
+func ObserveRunDuration(outcome string, seconds float64) {
+	runDuration.WithLabelValues(outcome).Observe(seconds)
+}
+
+// IncrementErrors counts a failed request.
+func IncrementErrors(code string) {
+	errorsTotal.WithLabelValues(code).Inc()
+}
+
+// IncrementCoalescedWrites counts a spooled state write.
+func IncrementCoalescedWrites() {
+	coalescedWritesTotal.Inc()
+}
+
+// IncrementSpooledCommitFailures counts a failed commit of a spooled write.
+func IncrementSpooledCommitFailures() {
+	spooledCommitFailuresTotal.Inc()
+}
+
+// IncrementCoalescedReads counts a state read served by another read's
+// fetch, or by a miss remembered from one.
+func IncrementCoalescedReads(reason string) {
+	coalescedReadsTotal.WithLabelValues(reason).Inc()
+}
+
+// SetDegraded records whether non-essential background jobs are paused.
+func SetDegraded(degraded bool) {
+	if degraded {
+		degradedGauge.Set(1)
+	} else {
+		degradedGauge.Set(0)
+	}
+}
+
+// IncrementDegradations counts a pause of non-essential background jobs
+// caused by reason.
+func IncrementDegradations(reason string) {
+	degradationsTotal.WithLabelValues(reason).Inc()
+}
+
+// IncrementSkippedJobRuns counts a run of a background job skipped under
+// resource pressure.
+func IncrementSkippedJobRuns(job string) {
+	skippedJobRunsTotal.WithLabelValues(job).Inc()
+}
+
+// IncrementReadFallbacks counts a read of a corrupt state served from an
+// earlier version.
+func IncrementReadFallbacks() {
+	readFallbacksTotal.Inc()
+}
+
+// IncrementRepoMoves counts a repository found renamed or transferred.
+func IncrementRepoMoves() {
+	repoMovesTotal.Inc()
+}
+
+// IncrementConcurrentApplySuspects counts a write suspected to be part of a
+// concurrent apply.
+func IncrementConcurrentApplySuspects(reason string) {
+	concurrentApplySuspectsTotal.WithLabelValues(reason).Inc()
+}
+
+// IncrementApplyWithoutWriteRuns counts an apply that released its lock
+// without writing the state.
+func IncrementApplyWithoutWriteRuns() {
+	applyWithoutWriteRunsTotal.Inc()
+}
+
+// IncrementShadowDivergences counts a difference found by the shadow.
+func IncrementShadowDivergences(op string) {
+	shadowDivergencesTotal.WithLabelValues(op).Inc()
+}
+
+// IncrementPanics counts a recovered panic.
+func IncrementPanics(source string) {
+	panicsTotal.WithLabelValues(source).Inc()
+}
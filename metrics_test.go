@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestParseMetricLabels(t *testing.T) {
+	labels, err := parseMetricLabels("cluster=eu-1, environment = prod,")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(labels) != 2 || labels["cluster"] != "eu-1" || labels["environment"] != "prod" {
+		t.Errorf("unexpected labels %v", labels)
+	}
+
+	for _, s := range []string{"cluster", "cluster=", "1st=a", "__name__=a", "team-name=a", "a=1,a=2"} {
+		if _, err := parseMetricLabels(s); err == nil {
+			t.Errorf("expected error for %q", s)
+		}
+	}
+}
+
+func TestLabeledGatherer(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	counter := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_total", Help: "Test counter"}, []string{"team"})
+	registry.MustRegister(counter)
+	counter.WithLabelValues("payments").Inc()
+
+	families, err := labeledGatherer{registry, map[string]string{"cluster": "eu-1", "team": "platform"}}.Gather()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	labels := families[0].Metric[0].Label
+	if len(labels) != 2 || labels[0].GetName() != "cluster" || labels[0].GetValue() != "eu-1" {
+		t.Fatalf("expected the static label to be added, got %v", labels)
+	}
+	if labels[1].GetValue() != "payments" {
+		t.Errorf("expected the metric's own label to be kept, got %v", labels[1])
+	}
+}
+
+func TestMetricsHandler_StaticLabels(t *testing.T) {
+	IncrementErrors("test_code")
+
+	w := httptest.NewRecorder()
+	MetricsHandler(map[string]string{"environment": "prod"}).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if !strings.Contains(w.Body.String(), `tfstate_errors_total{code="test_code",environment="prod"}`) {
+		t.Errorf("expected the label on the exported metrics, got:\n%s", w.Body.String())
+	}
+}
+
+func TestPathTenant(t *testing.T) {
+	tests := map[string]string{
+		"/team-a/prod":        "team-a",
+		"/team-a/network/dev": "team-a",
+		"/prod":               "",
+		"/team-a/":            "",
+		"/api/v1/stats":       "",
+		"/admin/migrate":      "",
+	}
+	for path, want := range tests {
+		if got := pathTenant(path); got != want {
+			t.Errorf("pathTenant(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+)
+
+// parseRepoPatterns parses a comma-separated list of owner/repo patterns.
+// Either part may use path.Match wildcards, as in "infra/*".
+func parseRepoPatterns(s string) ([]string, error) {
+	var patterns []string
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		owner, repo, ok := strings.Cut(entry, "/")
+		if !ok || owner == "" || repo == "" || strings.Contains(repo, "/") {
+			return nil, fmt.Errorf("invalid pattern %q: must be owner/repo", entry)
+		}
+		if _, err := path.Match(entry, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", entry, err)
+		}
+		patterns = append(patterns, entry)
+	}
+	return patterns, nil
+}
+
+// RepoRouter serves states from several repositories of one Gitea instance,
+// addressed as /{owner}/{repo}/{name}. Each repository gets its own
+// StateHandler, created on first use from the default one, so locks are
+// tracked per repository. Only repositories matching the allowlist are served.
+type RepoRouter struct {
+	base      *StateHandler // Serves the default repository
+	baseRepo  string        // owner/repo of the default repository
+	client    *GiteaClient
+	allowlist []string
+
+	mu       sync.Mutex
+	handlers map[string]*StateHandler // keyed by owner/repo
+}
+
+// NewRepoRouter creates a RepoRouter. base serves the repository client is
+// configured for, which is always allowed.
+func NewRepoRouter(base *StateHandler, client *GiteaClient, allowlist []string) *RepoRouter {
+	return &RepoRouter{
+		base:      base,
+		baseRepo:  client.owner + "/" + client.repo,
+		client:    client,
+		allowlist: allowlist,
+		handlers:  make(map[string]*StateHandler),
+	}
+}
+
+// allowed reports whether the repository owner/repo may be served.
+func (rr *RepoRouter) allowed(repo string) bool {
+	if repo == rr.baseRepo {
+		return true
+	}
+	for _, pattern := range rr.allowlist {
+		if ok, _ := path.Match(pattern, repo); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// handler returns the StateHandler for the repository owner/repo, creating
+// it if the repository exists.
+func (rr *RepoRouter) handler(owner, repo string) (*StateHandler, error) {
+	key := owner + "/" + repo
+	if key == rr.baseRepo {
+		return rr.base, nil
+	}
+
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	if h, ok := rr.handlers[key]; ok {
+		return h, nil
+	}
+
+	client := rr.client.ForRepo(owner, repo)
+	exists, err := client.RepoExists()
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, fmt.Errorf("%w: repository %s does not exist", ErrNotFound, key)
+	}
+	h := rr.base.forStorage(client, key)
+	rr.handlers[key] = h
+	slog.Info("Serving states from repository", "repo", key)
+	return h, nil
+}
+
+// ServeHTTP routes /{owner}/{repo}/{name} to the repository's StateHandler,
+// which sees the request as /{name}.
+func (rr *RepoRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.Trim(r.URL.Path, "/"), "/", 3)
+	if len(parts) < 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		if strings.HasPrefix(r.URL.Path, "/api/") {
+			rr.base.unknownRoute(w, r)
+			return
+		}
+		rr.base.writeRouteError(w, ErrNotFound, routeError{
+			Error: fmt.Sprintf("no state at %s", r.URL.Path),
+			Hint:  "with MULTI_REPO, states are served at /{owner}/{repo}/{name}",
+		})
+		return
+	}
+
+	owner, repo := parts[0], parts[1]
+	if !rr.allowed(owner + "/" + repo) {
+		writeError(w, fmt.Errorf("%w: repository %s/%s is not in MULTI_REPO_ALLOWLIST", ErrNotFound, owner, repo))
+		return
+	}
+	h, err := rr.handler(owner, repo)
+	if err != nil {
+		if classifyError(err) == ErrInternal {
+			slog.Error("Error opening repository", "repo", owner+"/"+repo, "error", err)
+		}
+		writeError(w, err)
+		return
+	}
+
+	r2 := r.Clone(r.Context())
+	r2.URL.Path = "/" + parts[2]
+	r2.URL.RawPath = ""
+	h.ServeHTTP(w, r2)
+}
+
+// forStorage returns a handler with h's settings serving the states in
+// storage. Archiving, deletion, read replicas, write coalescing, shadow
+// writes, events and the update counters identify states by name alone, so
+// they stay with the default repository.
+func (h *StateHandler) forStorage(storage StateStorage, repo string) *StateHandler {
+	c := NewStateHandler(storage, h.maxBodySize)
+	c.sizeLimits = h.sizeLimits
+	c.versionLimits = h.versionLimits
+	c.sizeWarnPercent = h.sizeWarnPercent
+	c.requireLock = h.requireLock
+	c.lockWait = h.lockWait
+	c.lockMethod, c.unlockMethod = h.lockMethod, h.unlockMethod
+	c.allowRawState = h.allowRawState
+	c.routeHints = h.routeHints
+	c.lockAuthors = h.lockAuthors
+	c.tagUpdates = h.tagUpdates
+	c.applyChecks = h.applyChecks
+	c.verifyReads = h.verifyReads
+	c.readFallback = h.readFallback
+	c.commits = h.commits
+	if h.runs != nil {
+		c.runs = NewRunLog(h.runs.limit)
+	}
+	c.reads = NewReadGroup(h.reads.missTTL)
+	c.stealGrace = h.stealGrace
+	c.audit = h.audit
+	c.auditRepo = repo
+	return c
+}
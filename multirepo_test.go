@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newTestRepoRouter(t *testing.T) (*RepoRouter, *GiteaClient) {
+	t.Helper()
+	dev := NewDevGitea()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/api/v1/repos/infra/missing") {
+			http.Error(w, `{"message":"repository not found"}`, http.StatusNotFound)
+			return
+		}
+		dev.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	client, err := NewGiteaClient(&Config{
+		GiteaURL:    server.URL,
+		GiteaToken:  "test-token",
+		GiteaOwner:  "testowner",
+		GiteaRepo:   "testrepo",
+		GiteaBranch: "main",
+	})
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	return NewRepoRouter(NewStateHandler(client, DefaultMaxBodySize), client, []string{"infra/*"}), client
+}
+
+func TestRepoRouter_RoutesToRepository(t *testing.T) {
+	router, client := newTestRepoRouter(t)
+	state := `{"version":4,"serial":1,"lineage":"abc"}`
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/infra/network/prod", strings.NewReader(state)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	if content, _, _ := client.ForRepo("infra", "network").GetFile(context.Background(), statePath("prod")); content == nil {
+		t.Error("expected the state in infra/network")
+	}
+	if content, _, _ := client.GetFile(context.Background(), statePath("prod")); content != nil {
+		t.Error("expected no state in the default repository")
+	}
+	if w := serve(router, http.MethodGet, "/infra/network/prod"); w.Code != http.StatusOK {
+		t.Errorf("expected status 200, got %d", w.Code)
+	}
+	if w := serve(router, http.MethodGet, "/testowner/testrepo/prod"); w.Code != http.StatusNotFound {
+		t.Errorf("expected the default repository to be served separately, got %d", w.Code)
+	}
+}
+
+func TestRepoRouter_LocksArePerRepository(t *testing.T) {
+	router, _ := newTestRepoRouter(t)
+
+	for _, target := range []string{"/infra/network/prod", "/infra/dns/prod"} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("LOCK", target, strings.NewReader(`{"ID":"`+target+`"}`)))
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: expected status 200, got %d", target, w.Code)
+		}
+	}
+}
+
+func TestRepoRouter_Rejects(t *testing.T) {
+	router, _ := newTestRepoRouter(t)
+
+	for _, target := range []string{"/other/repo/prod", "/infra/missing/prod", "/prod", "/infra/network"} {
+		if w := serve(router, http.MethodGet, target); w.Code != http.StatusNotFound {
+			t.Errorf("%s: expected status 404, got %d", target, w.Code)
+		}
+	}
+	if _, cached := router.handlers["infra/missing"]; cached {
+		t.Error("expected no handler for a missing repository")
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// Event types emitted by the backend. The set is documented in docs/events.md.
+const (
+	EventStateUpdated       = "io.tfbackend.state.updated"
+	EventLockAcquired       = "io.tfbackend.lock.acquired"
+	EventLockReleased       = "io.tfbackend.lock.released"
+	EventLockStealRequested = "io.tfbackend.lock.steal_requested"
+	EventLockStealCancelled = "io.tfbackend.lock.steal_cancelled"
+	EventLockStolen         = "io.tfbackend.lock.stolen"
+	EventLockTransferred    = "io.tfbackend.lock.transferred"
+
+	EventStateDeletionScheduled = "io.tfbackend.state.deletion_scheduled"
+	EventStateDeletionCancelled = "io.tfbackend.state.deletion_cancelled"
+	EventStateDeleted           = "io.tfbackend.state.deleted"
+
+	EventStateSizeWarning = "io.tfbackend.state.size_warning"
+	EventStateCorrupt     = "io.tfbackend.state.corrupt"
+
+	EventConcurrentApplySuspected = "io.tfbackend.state.concurrent_apply_suspected"
+	EventApplyWithoutWrite        = "io.tfbackend.run.apply_without_write"
+
+	EventRepoMoved = "io.tfbackend.repo.moved"
+)
+
+// CloudEvent is a CloudEvents 1.0 event in the structured JSON format.
+//
+// Text is an extension attribute with a human-readable summary, so chat
+// webhooks that only understand a "text" field (such as Slack) can display
+// events without a translation layer.
+type CloudEvent struct {
+	SpecVersion     string    `json:"specversion"`
+	ID              string    `json:"id"`
+	Source          string    `json:"source"`
+	Type            string    `json:"type"`
+	Subject         string    `json:"subject,omitempty"`
+	Time            time.Time `json:"time"`
+	DataContentType string    `json:"datacontenttype"`
+	Text            string    `json:"text,omitempty"`
+	Data            any       `json:"data,omitempty"`
+}
+
+// Notifier posts events to a webhook as CloudEvents.
+type Notifier struct {
+	url    string
+	source string
+	client *http.Client
+}
+
+// NewNotifier creates a Notifier posting to url. source identifies this
+// backend in the events. A nil Notifier discards all events.
+func NewNotifier(url, source string) *Notifier {
+	return &Notifier{
+		url:    url,
+		source: source,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Notify sends an event about the named state asynchronously. Delivery failures are logged.
+func (n *Notifier) Notify(eventType, state, text string, data any) {
+	if n == nil {
+		return
+	}
+
+	event := CloudEvent{
+		SpecVersion:     "1.0",
+		ID:              newEventID(),
+		Source:          n.source,
+		Type:            eventType,
+		Subject:         state,
+		Time:            time.Now().UTC(),
+		DataContentType: "application/json",
+		Text:            text,
+		Data:            data,
+	}
+
+	go func() {
+		if err := n.send(event); err != nil {
+			slog.Error("Error sending event", "event", eventType, "error", err)
+		}
+	}()
+}
+
+func (n *Notifier) send(event CloudEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	resp, err := n.client.Post(n.url, "application/cloudevents+json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// newEventID returns a random identifier for an event.
+func newEventID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newTestNotifier returns a Notifier posting to a test server and a channel of received events.
+func newTestNotifier(t *testing.T) (*Notifier, <-chan CloudEvent) {
+	t.Helper()
+
+	received := make(chan CloudEvent, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ct := r.Header.Get("Content-Type"); ct != "application/cloudevents+json" {
+			t.Errorf("expected structured CloudEvents content type, got %s", ct)
+		}
+		var event CloudEvent
+		_ = json.NewDecoder(r.Body).Decode(&event)
+		received <- event
+	}))
+	t.Cleanup(server.Close)
+
+	return NewNotifier(server.URL, "https://gitea.example.com/infra/tf-state"), received
+}
+
+func waitForEvent(t *testing.T, events <-chan CloudEvent) CloudEvent {
+	t.Helper()
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(time.Second):
+		t.Fatal("event was not delivered")
+		return CloudEvent{}
+	}
+}
+
+func TestNotifier_SendsCloudEvent(t *testing.T) {
+	notifier, events := newTestNotifier(t)
+
+	notifier.Notify(EventLockStolen, "myproject", "hello", map[string]string{"holder": "bob"})
+
+	event := waitForEvent(t, events)
+	if event.SpecVersion != "1.0" || event.ID == "" || event.Time.IsZero() {
+		t.Errorf("missing required CloudEvents attributes: %+v", event)
+	}
+	if event.Type != EventLockStolen || event.Subject != "myproject" || event.Text != "hello" {
+		t.Errorf("unexpected event %+v", event)
+	}
+	if event.Source != "https://gitea.example.com/infra/tf-state" {
+		t.Errorf("unexpected source %s", event.Source)
+	}
+}
+
+func TestStateHandler_EmitsEvents(t *testing.T) {
+	handler, _ := newTestHandler()
+	notifier, events := newTestNotifier(t)
+	handler.notifier = notifier
+
+	lockJSON, _ := json.Marshal(LockInfo{ID: "lock-123", Operation: "OperationTypeApply", Who: "alice"})
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("LOCK", "/myproject", bytes.NewReader(lockJSON)))
+	if event := waitForEvent(t, events); event.Type != EventLockAcquired {
+		t.Errorf("expected %s, got %s", EventLockAcquired, event.Type)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/myproject?ID=lock-123", bytes.NewReader([]byte(`{"version":4,"serial":1,"lineage":"abc"}`)))
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if event := waitForEvent(t, events); event.Type != EventStateUpdated {
+		t.Errorf("expected %s, got %s", EventStateUpdated, event.Type)
+	}
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("UNLOCK", "/myproject", bytes.NewReader(lockJSON)))
+	if event := waitForEvent(t, events); event.Type != EventLockReleased {
+		t.Errorf("expected %s, got %s", EventLockReleased, event.Type)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+)
+
+// refPin is a read-only session on a state at a ref, begun by a lock request
+// with ?ref=. Reads at the ref are served from the commit it named when the
+// session began, even if the ref, such as a branch, moves meanwhile.
+type refPin struct {
+	name   string
+	ref    string
+	commit string
+	lock   LockInfo
+}
+
+// handleRef serves a request for the named state at ref, a commit SHA, tag
+// or branch: reads return the state as of that commit, and locks begin and
+// end read-only sessions pinning it. Writes are refused.
+func (h *StateHandler) handleRef(w http.ResponseWriter, r *http.Request, name, ref string) {
+	reader, ok := h.storage.(VersionReader)
+	if !ok {
+		writeError(w, fmt.Errorf("%w: reading states at a ref needs the %s or %s backend", ErrInvalidRequest, BackendGitea, BackendLocalGit))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		h.handleGetAt(w, r, reader, name, ref)
+	case h.lockMethod:
+		h.handlePin(w, r, reader, name, ref)
+	case h.unlockMethod:
+		h.handleUnpin(w, r, name, ref)
+	case http.MethodPost:
+		writeError(w, fmt.Errorf("%w: %s is read at %s; remove ?ref= from the backend address to write it", ErrReadOnlyRef, name, ref))
+	default:
+		h.methodNotAllowed(w, r, http.MethodGet, h.lockMethod, h.unlockMethod)
+	}
+}
+
+// pinnedCommit returns the commit pinned for the named state at ref by a
+// session, if any.
+func (h *StateHandler) pinnedCommit(name, ref string) (string, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for _, pin := range h.pins {
+		if pin.name == name && pin.ref == ref {
+			return pin.commit, true
+		}
+	}
+	return "", false
+}
+
+// handleGetAt returns the named state as of the commit ref names, or the
+// commit pinned for it by a session.
+func (h *StateHandler) handleGetAt(w http.ResponseWriter, r *http.Request, reader VersionReader, name, ref string) {
+	commit, pinned := h.pinnedCommit(name, ref)
+	if !pinned {
+		var err error
+		if commit, err = reader.ResolveRef(r.Context(), ref); err != nil {
+			if cancelledByClient(w, r, err) {
+				return
+			}
+			slog.Error("Error resolving ref", "state", name, "ref", ref, "error", err)
+			writeError(w, err)
+			return
+		}
+	}
+
+	content, err := h.readState(r.Context(), versionStorage{reader: reader, commit: commit}, name)
+	if err != nil {
+		if cancelledByClient(w, r, err) {
+			return
+		}
+		slog.Error("Error getting state at commit", "state", name, "commit", commit, "error", err)
+		writeError(w, err)
+		return
+	}
+	if content == nil {
+		writeError(w, fmt.Errorf("%w at %s", ErrStateNotFound, ref))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(content)
+}
+
+// handlePin begins a read-only session on the named state at ref. It does
+// not take the state's lock, so it never holds up writers of the current
+// version.
+func (h *StateHandler) handlePin(w http.ResponseWriter, r *http.Request, reader VersionReader, name, ref string) {
+	body, ok := h.readBody(w, r, name, "lock")
+	if !ok {
+		return
+	}
+	lockInfo, ok := parseLockInfo(w, body, name, "lock", true)
+	if !ok {
+		return
+	}
+
+	h.mu.RLock()
+	existing, exists := h.pins[lockInfo.ID]
+	h.mu.RUnlock()
+	if exists && (existing.name != name || existing.ref != ref) {
+		writeLockError(w, ErrLockConflict, existing.lock)
+		return
+	}
+
+	if !exists {
+		commit, err := reader.ResolveRef(r.Context(), ref)
+		if err != nil {
+			if cancelledByClient(w, r, err) {
+				return
+			}
+			slog.Error("Error resolving ref", "state", name, "ref", ref, "error", err)
+			writeError(w, err)
+			return
+		}
+		content, err := h.readState(r.Context(), versionStorage{reader: reader, commit: commit}, name)
+		if err != nil {
+			if cancelledByClient(w, r, err) {
+				return
+			}
+			slog.Error("Error getting state at commit", "state", name, "commit", commit, "error", err)
+			writeError(w, err)
+			return
+		}
+		if content == nil {
+			writeError(w, fmt.Errorf("%w at %s", ErrStateNotFound, ref))
+			return
+		}
+
+		h.mu.Lock()
+		if existing, exists = h.pins[lockInfo.ID]; !exists {
+			h.pins[lockInfo.ID] = &refPin{name: name, ref: ref, commit: commit, lock: lockInfo}
+		}
+		h.mu.Unlock()
+		if !exists {
+			slog.Info("Pinned state for reading", "state", name, "lock_id", lockInfo.ID, "who", lockInfo.Who, "ref", ref, "commit", commit)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(lockInfo)
+}
+
+// handleUnpin ends the read-only session on the named state at ref with the
+// lock ID in the body, or every session on it if the ID is empty.
+func (h *StateHandler) handleUnpin(w http.ResponseWriter, r *http.Request, name, ref string) {
+	body, ok := h.readBody(w, r, name, "unlock")
+	if !ok {
+		return
+	}
+	unlockInfo, ok := parseLockInfo(w, body, name, "unlock", false)
+	if !ok {
+		return
+	}
+
+	h.mu.Lock()
+	for id, pin := range h.pins {
+		if pin.name == name && pin.ref == ref && (unlockInfo.ID == "" || unlockInfo.ID == id) {
+			delete(h.pins, id)
+			slog.Info("Unpinned state", "state", name, "ref", ref, "commit", pin.commit)
+		}
+	}
+	h.mu.Unlock()
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestRefPin_PinsReadsToTheCommit(t *testing.T) {
+	storage := newTestLocalGitClient(t)
+	handler := NewStateHandler(storage, DefaultMaxBodySize)
+	postState(t, handler, `{"version":4,"serial":1,"lineage":"abc"}`)
+
+	lock := `{"ID":"audit-1","Operation":"OperationTypePlan","Who":"auditor"}`
+	if w := serveAs(handler, "LOCK", "/network?ref=main", "", lock); w.Code != http.StatusOK {
+		t.Fatalf("expected the session to begin, got %d: %s", w.Code, w.Body.String())
+	}
+	// The session does not hold up writers
+	if w := serveAs(handler, "LOCK", "/network", "", `{"ID":"apply-1","Operation":"OperationTypeApply"}`); w.Code != http.StatusOK {
+		t.Fatalf("expected the state's lock to be free, got %d", w.Code)
+	}
+	if w := serveAs(handler, http.MethodPost, "/network?ID=apply-1", "", `{"version":4,"serial":2,"lineage":"abc"}`); w.Code != http.StatusOK {
+		t.Fatalf("expected the write to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+
+	if w := serve(handler, http.MethodGet, "/network?ref=main"); !strings.Contains(w.Body.String(), `"serial": 1`) {
+		t.Errorf("expected reads at the ref to stay pinned to serial 1, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := serveAs(handler, http.MethodPost, "/network?ref=main", "", `{"version":4,"serial":3,"lineage":"abc"}`); w.Code != http.StatusConflict {
+		t.Errorf("expected writes at a ref to be refused, got %d", w.Code)
+	}
+
+	if w := serveAs(handler, "UNLOCK", "/network?ref=main", "", lock); w.Code != http.StatusOK {
+		t.Fatalf("expected the session to end, got %d", w.Code)
+	}
+	if w := serve(handler, http.MethodGet, "/network?ref=main"); !strings.Contains(w.Body.String(), `"serial": 2`) {
+		t.Errorf("expected the ref to be resolved again after the session, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestRefPin_Tags(t *testing.T) {
+	storage := newTestLocalGitClient(t)
+	handler := NewStateHandler(storage, DefaultMaxBodySize)
+	handler.tagUpdates = true
+	postState(t, handler, `{"version":4,"serial":1,"lineage":"abc"}`)
+	postState(t, handler, `{"version":4,"serial":2,"lineage":"abc"}`)
+
+	w := serve(handler, http.MethodGet, "/network?ref=tfstate/network/serial-1")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"serial": 1`) {
+		t.Errorf("expected serial 1, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := serve(handler, http.MethodGet, "/network?ref=tfstate/network/serial-9"); w.Code != http.StatusNotFound {
+		t.Errorf("expected an unknown ref to get 404, got %d", w.Code)
+	}
+	if w := serve(handler, http.MethodGet, "/other?ref=tfstate/network/serial-1"); w.Code != http.StatusNotFound {
+		t.Errorf("expected a state missing at the ref to get 404, got %d", w.Code)
+	}
+}
+
+func TestRefPin_UnsupportedStorage(t *testing.T) {
+	handler, _ := newTestHandler()
+	if w := serve(handler, http.MethodGet, "/network?ref=main"); w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 without a storage keeping history, got %d", w.Code)
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Merge styles selectable with PR_MERGE_STYLE, as named by Gitea.
+var prMergeStyles = []string{"merge", "rebase", "rebase-merge", "squash", "fast-forward-only"}
+
+// DefaultPRMergeStyle is how state pull requests are merged by default.
+const DefaultPRMergeStyle = "merge"
+
+// stagingBranchPrefix starts the names of the branches writes are staged on.
+const stagingBranchPrefix = "tfstate-staging-"
+
+// PullRequestClient writes to a Gitea repository whose branch is protected
+// against direct pushes. Each write is committed to a staging branch of its
+// state, created from the protected branch, and merged through a pull
+// request. Reads go to the protected branch as usual.
+//
+// A pull request that cannot be merged, such as because the branch
+// protection requires approvals or status checks the backend cannot
+// provide, fails the write with ErrMergeFailed. It is left open so the
+// reason can be looked at; the next write of the state replaces it.
+type PullRequestClient struct {
+	*GiteaClient
+	mergeStyle string
+
+	mu      sync.Mutex
+	staging map[string]*sync.Mutex // Serializes the writes to each staging branch
+}
+
+// NewPullRequestClient creates a client writing to the repository
+// configured in cfg through pull requests.
+func NewPullRequestClient(cfg *Config) (*PullRequestClient, error) {
+	client, err := NewGiteaClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &PullRequestClient{GiteaClient: client, mergeStyle: cfg.PRMergeStyle, staging: make(map[string]*sync.Mutex)}, nil
+}
+
+// stagingNameChars are the characters state names keep in staging branch names.
+var stagingNameChars = regexp.MustCompile(`[^A-Za-z0-9_.-]+`)
+
+// stagingBranch returns the staging branch for writes to path: one per
+// state, or per file for files outside the states. Branch names are kept
+// flat, so that nested states cannot clash with their parents.
+func stagingBranch(path string) string {
+	name := path
+	if n, ok := stateNameFromPath(path); ok {
+		name = n
+	}
+	name = stagingNameChars.ReplaceAllString(strings.ReplaceAll(name, "/", "--"), "-")
+	return stagingBranchPrefix + strings.Trim(strings.ReplaceAll(name, "..", "-"), ".-")
+}
+
+// branchLock returns the mutex serializing writes to branch.
+func (p *PullRequestClient) branchLock(branch string) *sync.Mutex {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	m, ok := p.staging[branch]
+	if !ok {
+		m = &sync.Mutex{}
+		p.staging[branch] = m
+	}
+	return m
+}
+
+// stagedChange is a file operation made on a staging branch, for the audit
+// log.
+type stagedChange struct {
+	action string
+	path   string
+}
+
+// stage commits a write to the staging branch of path with write, and merges
+// it into the protected branch through a pull request. A write that commits
+// nothing opens no pull request.
+func (p *PullRequestClient) stage(ctx context.Context, path, message string, changes []stagedChange, write func(ctx context.Context, staged *GiteaClient) error) error {
+	branch := stagingBranch(path)
+	lock := p.branchLock(branch)
+	lock.Lock()
+	defer lock.Unlock()
+
+	// Start from the protected branch, replacing the branch of an earlier
+	// write that failed to merge
+	if err := p.deleteBranch(ctx, branch); err != nil {
+		return err
+	}
+	err := p.do(ctx, http.MethodPost, p.repoAPIPath("/branches"), map[string]string{
+		"new_branch_name": branch,
+		"old_branch_name": p.branch,
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create staging branch %s: %w", branch, err)
+	}
+
+	staged := *p.GiteaClient
+	staged.branch = branch
+	staged.audit = nil // The merge is audited instead
+	stagedCtx, commit := withCommitCapture(ctx)
+	if err := write(stagedCtx, &staged); err != nil {
+		_ = p.deleteBranch(ctx, branch)
+		return err
+	}
+	if *commit == "" {
+		return p.deleteBranch(ctx, branch)
+	}
+
+	title, _, _ := strings.Cut(message, "\n")
+	var pr struct {
+		Number  int64  `json:"number"`
+		HTMLURL string `json:"html_url"`
+	}
+	err = p.do(ctx, http.MethodPost, p.repoAPIPath("/pulls"), map[string]string{
+		"head":  branch,
+		"base":  p.branch,
+		"title": title,
+		"body":  message,
+	}, &pr)
+	if err != nil {
+		return fmt.Errorf("%w: opening a pull request from %s failed: %v", ErrMergeFailed, branch, err)
+	}
+
+	err = p.do(ctx, http.MethodPost, p.repoAPIPath("/pulls/%d/merge", pr.Number), map[string]any{
+		"Do":                        p.mergeStyle,
+		"MergeTitleField":           title,
+		"MergeMessageField":         message,
+		"delete_branch_after_merge": true,
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("%w: pull request #%d (%s) was left open: %v", ErrMergeFailed, pr.Number, pr.HTMLURL, err)
+	}
+
+	var merged struct {
+		MergeCommitSHA string `json:"merge_commit_sha"`
+	}
+	// The write is merged; if this fails, only the audit entry lacks the commit
+	_ = p.do(ctx, http.MethodGet, p.repoAPIPath("/pulls/%d", pr.Number), nil, &merged)
+	for _, change := range changes {
+		p.recordCommit(ctx, change.action, change.path, merged.MergeCommitSHA, message)
+	}
+	return nil
+}
+
+// deleteBranch deletes a staging branch, if it exists.
+func (p *PullRequestClient) deleteBranch(ctx context.Context, branch string) error {
+	err := p.do(ctx, http.MethodDelete, p.repoAPIPath("/branches/%s", url.PathEscape(branch)), nil, nil)
+	if err != nil && !isGiteaStatus(err, http.StatusNotFound) {
+		return fmt.Errorf("failed to delete staging branch %s: %w", branch, err)
+	}
+	return nil
+}
+
+// repoAPIPath returns the API path of the repository followed by the
+// formatted suffix.
+func (p *PullRequestClient) repoAPIPath(format string, args ...any) string {
+	return fmt.Sprintf("/repos/%s/%s", url.PathEscape(p.owner), url.PathEscape(p.repo)) + fmt.Sprintf(format, args...)
+}
+
+// CreateFile creates a new file through a pull request.
+func (p *PullRequestClient) CreateFile(ctx context.Context, path string, content []byte, message string) error {
+	return p.stage(ctx, path, message, []stagedChange{{"create", path}}, func(ctx context.Context, staged *GiteaClient) error {
+		return staged.CreateFile(ctx, path, content, message)
+	})
+}
+
+// UpdateFile updates an existing file through a pull request.
+func (p *PullRequestClient) UpdateFile(ctx context.Context, path string, content []byte, sha string, message string) error {
+	return p.stage(ctx, path, message, []stagedChange{{"update", path}}, func(ctx context.Context, staged *GiteaClient) error {
+		return staged.UpdateFile(ctx, path, content, sha, message)
+	})
+}
+
+// DeleteFile deletes a file through a pull request.
+func (p *PullRequestClient) DeleteFile(ctx context.Context, path string, sha string, message string) error {
+	return p.stage(ctx, path, message, []stagedChange{{"delete", path}}, func(ctx context.Context, staged *GiteaClient) error {
+		return staged.DeleteFile(ctx, path, sha, message)
+	})
+}
+
+// CreateOrUpdateFile creates a file if it doesn't exist, or updates it if it does.
+func (p *PullRequestClient) CreateOrUpdateFile(ctx context.Context, path string, content []byte, message string) error {
+	exists, sha, err := p.FileExists(ctx, path)
+	if err != nil {
+		return err
+	}
+
+	if exists {
+		return p.UpdateFile(ctx, path, content, sha, message)
+	}
+	return p.CreateFile(ctx, path, content, message)
+}
+
+// CommitFiles applies all changes through a single pull request.
+func (p *PullRequestClient) CommitFiles(ctx context.Context, message string, changes []FileChange) error {
+	if len(changes) == 0 {
+		return nil
+	}
+	staged := make([]stagedChange, 0, len(changes))
+	for _, change := range changes {
+		action := "update"
+		switch {
+		case change.Content == nil:
+			action = "delete"
+		case change.Create:
+			action = "create"
+		}
+		staged = append(staged, stagedChange{action, change.Path})
+	}
+	return p.stage(ctx, changes[0].Path, message, staged, func(ctx context.Context, g *GiteaClient) error {
+		return g.CommitFiles(ctx, message, changes)
+	})
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func newTestPullRequestClient(t *testing.T, dev *DevGitea) *PullRequestClient {
+	t.Helper()
+	return &PullRequestClient{
+		GiteaClient: newTestGiteaClientFor(t, dev),
+		mergeStyle:  DefaultPRMergeStyle,
+		staging:     make(map[string]*sync.Mutex),
+	}
+}
+
+func TestPullRequestClient_WritesThroughPullRequest(t *testing.T) {
+	dev := NewDevGitea()
+	handler := NewStateHandler(newTestPullRequestClient(t, dev), DefaultMaxBodySize)
+
+	postState(t, handler, `{"version":4,"serial":1,"lineage":"abc"}`)
+	postState(t, handler, `{"version":4,"serial":2,"lineage":"abc"}`)
+
+	if len(dev.pulls) != 2 {
+		t.Errorf("expected a pull request per write, got %d", len(dev.pulls))
+	}
+	for index, pull := range dev.pulls {
+		if pull.head != "tfstate-staging-network" || pull.base != "main" || pull.mergeSHA == "" {
+			t.Errorf("expected pull request #%d to merge the staging branch into main, got %+v", index, pull)
+		}
+	}
+	if len(dev.branches) != 0 {
+		t.Errorf("expected the staging branches to be deleted, got %v", dev.branches)
+	}
+
+	w := serve(handler, http.MethodGet, "/network")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"serial": 2`) {
+		t.Errorf("expected the merged state on main, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestPullRequestClient_MergeFailure(t *testing.T) {
+	dev := NewDevGitea()
+	dev.rejectMerges = true
+	handler := NewStateHandler(newTestPullRequestClient(t, dev), DefaultMaxBodySize)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/network", strings.NewReader(`{"version":4,"serial":1,"lineage":"abc"}`)))
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("expected status 500, got %d: %s", w.Code, w.Body.String())
+	}
+	var body struct {
+		Code  string `json:"code"`
+		Error string `json:"error"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatalf("failed to decode error: %v", err)
+	}
+	if body.Code != "merge_failed" || !strings.Contains(body.Error, "pull request #1") || !strings.Contains(body.Error, "required status checks") {
+		t.Errorf("expected the pull request and reason in the error, got %+v", body)
+	}
+	if !dev.branches["testowner/testrepo@tfstate-staging-network"] {
+		t.Error("expected the staging branch to be left for the open pull request")
+	}
+
+	// The next write replaces the branch of the failed one
+	dev.rejectMerges = false
+	postState(t, handler, `{"version":4,"serial":2,"lineage":"abc"}`)
+	if w := serve(handler, http.MethodGet, "/network"); !strings.Contains(w.Body.String(), `"serial": 2`) {
+		t.Errorf("expected the retried write on main, got %s", w.Body.String())
+	}
+}
+
+func TestStagingBranch(t *testing.T) {
+	tests := map[string]string{
+		statePath("network"):         "tfstate-staging-network",
+		statePath("prod/network"):    "tfstate-staging-prod--network",
+		statePath("team a/db"):       "tfstate-staging-team-a--db",
+		statePath("network") + ".lk": "tfstate-staging-states--network--terraform.tfstate.lk",
+	}
+	for path, want := range tests {
+		if got := stagingBranch(path); got != want {
+			t.Errorf("stagingBranch(%q): expected %q, got %q", path, want, got)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultRateLimitBackoff is how long Gitea API calls are held back after a
+// 429 without a Retry-After header.
+const DefaultRateLimitBackoff = 5 * time.Second
+
+// giteaLimiter holds back the Gitea API calls of every client of the primary
+// Gitea instance while it rate-limits the backend, and limits how many are
+// made at once if GITEA_MAX_CONCURRENCY is set. It is set in main.
+var giteaLimiter *RateLimiter
+
+// RateLimiter queues the calls to a Gitea instance. A 429 answering any call
+// makes every call wait until the Retry-After the instance asked for, rather
+// than only the retries of the call that got it: a burst of Terraform runs
+// that keeps hammering a rate-limited instance gets its service account
+// banned on instances that escalate. Calls beyond the concurrency limit wait
+// for one of those in flight to finish.
+type RateLimiter struct {
+	slots chan struct{} // Calls allowed at once; nil is unlimited
+
+	mu          sync.Mutex
+	pausedUntil time.Time
+	now         func() time.Time
+}
+
+// NewRateLimiter creates a RateLimiter allowing concurrency calls at once,
+// unlimited if 0.
+func NewRateLimiter(concurrency int) *RateLimiter {
+	l := &RateLimiter{now: time.Now}
+	if concurrency > 0 {
+		l.slots = make(chan struct{}, concurrency)
+	}
+	return l
+}
+
+// Acquire blocks until a call may be made, or ctx is done, and returns the
+// function to call once it is finished.
+func (l *RateLimiter) Acquire(ctx context.Context) (func(), error) {
+	for {
+		l.mu.Lock()
+		wait := l.pausedUntil.Sub(l.now())
+		l.mu.Unlock()
+		if wait <= 0 {
+			break
+		}
+		// The pause may be extended meanwhile, so check again after it
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+
+	if l.slots == nil {
+		return func() {}, nil
+	}
+	select {
+	case l.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	SetGiteaCallsInFlight(len(l.slots))
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			<-l.slots
+			SetGiteaCallsInFlight(len(l.slots))
+		})
+	}, nil
+}
+
+// Pause holds back every call for d, unless they are already held back for
+// longer.
+func (l *RateLimiter) Pause(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	until := l.now().Add(d)
+	if until.After(l.pausedUntil) {
+		if !l.pausedUntil.After(l.now()) {
+			slog.Warn("Gitea is rate-limiting the backend; holding back API calls", "duration", d.Round(time.Millisecond))
+		}
+		l.pausedUntil = until
+	}
+}
+
+// retryAfter returns the delay a response asks for in its Retry-After
+// header, given in seconds or as an HTTP date.
+func retryAfter(resp *http.Response, now time.Time) (time.Duration, bool) {
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return max(date.Sub(now), 0), true
+	}
+	return 0, false
+}
+
+// rateLimitTransport makes every request, retries included, wait for the
+// limiter, and pauses it when Gitea answers with a 429.
+type rateLimitTransport struct {
+	next    http.RoundTripper
+	limiter *RateLimiter
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	release, err := t.limiter.Acquire(req.Context())
+	if err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		IncrementGiteaRateLimits()
+		d, ok := retryAfter(resp, t.limiter.now())
+		if !ok {
+			d = DefaultRateLimitBackoff
+		}
+		t.limiter.Pause(d)
+	}
+	// The call is in flight until its response is read
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+// releasingBody calls release once the response body is closed.
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+}
+
+// Close implements io.Closer.
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
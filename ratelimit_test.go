@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRateLimiter_Concurrency(t *testing.T) {
+	limiter := NewRateLimiter(1)
+	release, err := limiter.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := limiter.Acquire(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the second call to wait, got %v", err)
+	}
+
+	release()
+	release() // Releasing twice is harmless
+	next, err := limiter.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	next()
+}
+
+func TestRateLimiter_Pause(t *testing.T) {
+	limiter := NewRateLimiter(0)
+	limiter.Pause(30 * time.Millisecond)
+	limiter.Pause(time.Millisecond) // Does not shorten the pause
+
+	start := time.Now()
+	release, err := limiter.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+	if waited := time.Since(start); waited < 25*time.Millisecond {
+		t.Errorf("expected the call to wait out the pause, waited %v", waited)
+	}
+}
+
+func TestRateLimitTransport_PausesOnTooManyRequests(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "60")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	t.Cleanup(server.Close)
+
+	limiter := NewRateLimiter(1)
+	client := &http.Client{Transport: &rateLimitTransport{next: http.DefaultTransport, limiter: limiter}}
+	before := testutil.ToFloat64(giteaRateLimitsTotal)
+
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	if got := testutil.ToFloat64(giteaRateLimitsTotal) - before; got != 1 {
+		t.Errorf("expected the 429 to be counted, got %v", got)
+	}
+	if until := time.Until(limiter.pausedUntil); until < 59*time.Second {
+		t.Errorf("expected calls to be held back for the Retry-After, got %v", until)
+	}
+	if len(limiter.slots) != 0 {
+		t.Error("expected the slot to be released once the body is closed")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	if _, err := client.Do(req); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the next call to be held back, got %v", err)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	for value, want := range map[string]time.Duration{
+		"30":                            30 * time.Second,
+		"Fri, 16 Oct 2026 12:01:00 GMT": time.Minute,
+		"Fri, 16 Oct 2026 11:00:00 GMT": 0,
+	} {
+		resp := &http.Response{Header: http.Header{"Retry-After": {value}}}
+		if d, ok := retryAfter(resp, now); !ok || d != want {
+			t.Errorf("%q: expected %v, got %v (%v)", value, want, d, ok)
+		}
+	}
+	for _, value := range []string{"", "soon", "-1"} {
+		resp := &http.Response{Header: http.Header{"Retry-After": {value}}}
+		if _, ok := retryAfter(resp, now); ok {
+			t.Errorf("%q: expected no delay", value)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// DefaultReadMissCacheTTL is how long a state found missing is reported
+// missing without asking the repository again, by default.
+const DefaultReadMissCacheTTL = 2 * time.Second
+
+// Reasons a read was served without a fetch of its own.
+const (
+	ReadCoalescedInflight = "inflight"   // Joined a fetch of the same state already under way
+	ReadCoalescedMiss     = "miss_cache" // The state was found missing moments before
+)
+
+// readKey identifies a state as read from one storage: the primary and each
+// replica are fetched separately.
+type readKey struct {
+	storage StateStorage
+	name    string
+}
+
+// readFetch is a fetch of a state shared by every read waiting for it.
+type readFetch struct {
+	done    chan struct{}
+	content []byte
+	err     error
+}
+
+// readGen counts the writes of a state while it is being fetched, so that a
+// fetch can tell whether the state was written under it.
+type readGen struct {
+	gen     uint64 // Bumped by Forget
+	fetches int    // Fetches of the state under way
+}
+
+// ReadGroup coalesces concurrent reads of the same state into one fetch, so
+// that hundreds of plans started at once, as by a monorepo pipeline fanning
+// out, cost one request to Gitea instead of hundreds. A state found missing
+// is remembered for missTTL, as a workspace that does not exist yet is read
+// over and over by the plans creating it. Writes through the handler forget
+// what is remembered about the state.
+type ReadGroup struct {
+	missTTL time.Duration // 0 remembers nothing
+
+	mu       sync.Mutex
+	inflight map[readKey]*readFetch
+	missing  map[string]map[StateStorage]time.Time // When each miss is forgotten, keyed by name
+	swept    time.Time                             // When expired misses were last dropped
+	gens     map[string]*readGen                   // Of the states being fetched, keyed by name
+	now      func() time.Time
+}
+
+// NewReadGroup creates a ReadGroup remembering missing states for missTTL.
+func NewReadGroup(missTTL time.Duration) *ReadGroup {
+	return &ReadGroup{
+		missTTL:  missTTL,
+		inflight: make(map[readKey]*readFetch),
+		missing:  make(map[string]map[StateStorage]time.Time),
+		gens:     make(map[string]*readGen),
+		now:      time.Now,
+	}
+}
+
+// Get returns the named state as fetched from storage by fetch, which
+// returns nil content for a missing state. A fetch already under way for the
+// same state is joined instead of starting another. The fetch is not
+// cancelled when the reader that started it goes away, as others may be
+// waiting for it; each reader only stops waiting when its own ctx is done.
+func (g *ReadGroup) Get(ctx context.Context, storage StateStorage, name string, fetch func(ctx context.Context) ([]byte, error)) ([]byte, error) {
+	key := readKey{storage: storage, name: name}
+
+	g.mu.Lock()
+	if until, ok := g.missing[name][storage]; ok {
+		if g.now().Before(until) {
+			g.mu.Unlock()
+			IncrementCoalescedReads(ReadCoalescedMiss)
+			return nil, nil
+		}
+		g.forgetMiss(key)
+	}
+	f, joined := g.inflight[key]
+	if !joined {
+		f = &readFetch{done: make(chan struct{})}
+		g.inflight[key] = f
+		go g.run(context.WithoutCancel(ctx), key, f, fetch)
+	}
+	g.mu.Unlock()
+
+	if joined {
+		IncrementCoalescedReads(ReadCoalescedInflight)
+	}
+	select {
+	case <-f.done:
+		return f.content, f.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// run performs a shared fetch and hands its result to the readers waiting
+// for it.
+func (g *ReadGroup) run(ctx context.Context, key readKey, f *readFetch, fetch func(ctx context.Context) ([]byte, error)) {
+	g.mu.Lock()
+	rg, ok := g.gens[key.name]
+	if !ok {
+		rg = &readGen{}
+		g.gens[key.name] = rg
+	}
+	rg.fetches++
+	gen := rg.gen
+	g.mu.Unlock()
+
+	f.content, f.err = fetch(ctx)
+
+	g.mu.Lock()
+	if g.inflight[key] == f {
+		delete(g.inflight, key)
+	}
+	// A miss that raced a write is not remembered
+	if f.err == nil && f.content == nil && g.missTTL > 0 && rg.gen == gen {
+		if g.missing[key.name] == nil {
+			g.missing[key.name] = make(map[StateStorage]time.Time)
+		}
+		g.missing[key.name][key.storage] = g.now().Add(g.missTTL)
+	}
+	g.sweepMisses()
+	if rg.fetches--; rg.fetches == 0 {
+		delete(g.gens, key.name)
+	}
+	g.mu.Unlock()
+	close(f.done)
+}
+
+// Forget drops what is remembered about the named state, after it was
+// written. Reads starting afterwards fetch it anew rather than joining a
+// fetch that may predate the write.
+func (g *ReadGroup) Forget(name string) {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if rg, ok := g.gens[name]; ok {
+		rg.gen++
+	}
+	for key := range g.inflight {
+		if key.name == name {
+			delete(g.inflight, key)
+		}
+	}
+	delete(g.missing, name)
+}
+
+// forgetMiss drops the miss remembered for key. g.mu must be held.
+func (g *ReadGroup) forgetMiss(key readKey) {
+	delete(g.missing[key.name], key.storage)
+	if len(g.missing[key.name]) == 0 {
+		delete(g.missing, key.name)
+	}
+}
+
+// sweepMisses drops the misses that have expired, so that names read once
+// and never again are not remembered forever. Sweeps run at most once per
+// missTTL, so an expired miss lingers for up to another missTTL. g.mu must
+// be held.
+func (g *ReadGroup) sweepMisses() {
+	now := g.now()
+	if now.Before(g.swept.Add(g.missTTL)) {
+		return
+	}
+	g.swept = now
+	for name, misses := range g.missing {
+		for storage, until := range misses {
+			if !now.Before(until) {
+				g.forgetMiss(readKey{storage: storage, name: name})
+			}
+		}
+	}
+}
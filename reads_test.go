@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// gatedStorage holds reads until release is closed, counting those of the
+// network state.
+type gatedStorage struct {
+	*MockStorage
+	release chan struct{}
+	reads   atomic.Int32
+}
+
+func (s *gatedStorage) GetFile(ctx context.Context, path string) ([]byte, string, error) {
+	if path == statePath("network") {
+		s.reads.Add(1)
+	}
+	<-s.release
+	return s.MockStorage.GetFile(ctx, path)
+}
+
+func TestReadGroup_CoalescesConcurrentReads(t *testing.T) {
+	storage := &gatedStorage{MockStorage: NewMockStorage(), release: make(chan struct{})}
+	storage.files[statePath("network")] = []byte(`{"version":4,"serial":1,"lineage":"abc"}`)
+	handler := NewStateHandler(storage, DefaultMaxBodySize)
+	joined := coalescedReadsTotal.WithLabelValues(ReadCoalescedInflight)
+	before := testutil.ToFloat64(joined)
+
+	const readers = 50
+	var wg sync.WaitGroup
+	codes := make(chan int, readers)
+	for range readers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes <- serve(handler, http.MethodGet, "/network").Code
+		}()
+	}
+	for deadline := time.Now().Add(5 * time.Second); testutil.ToFloat64(joined) < before+readers-1; {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d reads to join the first, got %v", readers-1, testutil.ToFloat64(joined)-before)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(storage.release)
+	wg.Wait()
+	close(codes)
+
+	for code := range codes {
+		if code != http.StatusOK {
+			t.Errorf("expected status 200, got %d", code)
+		}
+	}
+	if n := storage.reads.Load(); n != 1 {
+		t.Errorf("expected a single fetch, got %d", n)
+	}
+}
+
+func TestReadGroup_RemembersMisses(t *testing.T) {
+	storage := &gatedStorage{MockStorage: NewMockStorage(), release: make(chan struct{})}
+	close(storage.release)
+	handler := NewStateHandler(storage, DefaultMaxBodySize)
+	handler.reads = NewReadGroup(time.Minute)
+
+	for range 3 {
+		if w := serve(handler, http.MethodGet, "/network"); w.Code != http.StatusNotFound {
+			t.Fatalf("expected status 404, got %d", w.Code)
+		}
+	}
+	if n := storage.reads.Load(); n != 1 {
+		t.Errorf("expected the miss to be remembered, got %d fetches", n)
+	}
+
+	// A write ends the remembered miss
+	postState(t, handler, `{"version":4,"serial":1,"lineage":"abc"}`)
+	if w := serve(handler, http.MethodGet, "/network"); w.Code != http.StatusOK {
+		t.Errorf("expected status 200 after the write, got %d", w.Code)
+	}
+}
+
+func TestReadGroup_MissRacingWrite(t *testing.T) {
+	group := NewReadGroup(time.Minute)
+	storage := NewMockStorage()
+	fetches := 0
+	fetch := func(context.Context) ([]byte, error) {
+		fetches++
+		// The state is written while the fetch is under way
+		group.Forget("network")
+		return nil, nil
+	}
+
+	for range 2 {
+		if _, err := group.Get(context.Background(), storage, "network", fetch); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fetches != 2 {
+		t.Errorf("expected a miss racing a write not to be remembered, got %d fetches", fetches)
+	}
+}
+
+func TestReadGroup_ForgetsFinishedFetches(t *testing.T) {
+	group := NewReadGroup(0)
+	storage := NewMockStorage()
+	fetch := func(context.Context) ([]byte, error) { return []byte("{}"), nil }
+
+	for _, name := range []string{"network", "dns", "compute"} {
+		if _, err := group.Get(context.Background(), storage, name, fetch); err != nil {
+			t.Fatal(err)
+		}
+		group.Forget(name)
+	}
+
+	group.mu.Lock()
+	defer group.mu.Unlock()
+	if len(group.gens) != 0 || len(group.inflight) != 0 {
+		t.Errorf("expected nothing kept about finished fetches, got %d generations and %d fetches", len(group.gens), len(group.inflight))
+	}
+}
+
+func TestReadGroup_SweepsExpiredMisses(t *testing.T) {
+	group := NewReadGroup(time.Minute)
+	now := time.Now()
+	group.now = func() time.Time { return now }
+	storage := NewMockStorage()
+	miss := func(context.Context) ([]byte, error) { return nil, nil }
+
+	// Names probed once and never again
+	for _, name := range []string{"network", "dns"} {
+		if _, err := group.Get(context.Background(), storage, name, miss); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now = now.Add(2 * time.Minute)
+	if _, err := group.Get(context.Background(), storage, "compute", miss); err != nil {
+		t.Fatal(err)
+	}
+
+	group.mu.Lock()
+	defer group.mu.Unlock()
+	if len(group.missing) != 1 || group.missing["compute"] == nil {
+		t.Errorf("expected only the unexpired miss to be kept, got %v", group.missing)
+	}
+}
+
+// waitForReads blocks until storage has been asked n times for the network state.
+func waitForReads(t *testing.T, storage *gatedStorage, n int32) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for storage.reads.Load() < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d reads of the state", n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
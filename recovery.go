@@ -0,0 +1,53 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+)
+
+// requestIDHeader carries the ID that ties a response to the backend's logs.
+const requestIDHeader = "X-Request-Id"
+
+// requestID returns the ID a reverse proxy assigned to the request, or a new
+// random one.
+func requestID(r *http.Request) string {
+	if id := r.Header.Get(requestIDHeader); id != "" && len(id) <= 128 {
+		return id
+	}
+	return newEventID()
+}
+
+// recoveryMiddleware turns a panicking request into a 500 response carrying
+// the request ID, which is logged with the stack trace. Other requests, and
+// the locks held for them, are unaffected.
+func recoveryMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := requestID(r)
+		w.Header().Set(requestIDHeader, id)
+
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			if p == http.ErrAbortHandler {
+				// Deliberate aborts are handled by the server
+				panic(p)
+			}
+			slog.Error("Panic serving request", "method", r.Method, "path", r.URL.Path, "request_id", id, "panic", p, "stack", string(debug.Stack()))
+			IncrementPanics("http")
+			writeError(w, ErrInternal)
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// recoverJob logs a panic in the background job name instead of letting it
+// take down the backend. It must be deferred.
+func recoverJob(name string) {
+	if p := recover(); p != nil {
+		slog.Error("Panic in background job", "job", name, "panic", p, "stack", string(debug.Stack()))
+		IncrementPanics("job")
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRecoveryMiddleware(t *testing.T) {
+	before := testutil.ToFloat64(panicsTotal.WithLabelValues("http"))
+	handler := recoveryMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/panic" {
+			panic("boom")
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	w := serve(handler, http.MethodGet, "/panic")
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("expected status 500, got %d", w.Code)
+	}
+	id := w.Header().Get(requestIDHeader)
+	if id == "" || !strings.Contains(w.Body.String(), id) {
+		t.Errorf("expected the request ID in the body, got %q", w.Body.String())
+	}
+	if after := testutil.ToFloat64(panicsTotal.WithLabelValues("http")); after != before+1 {
+		t.Errorf("expected the panic to be counted, got %v -> %v", before, after)
+	}
+
+	// The server keeps serving, and takes the request ID from a proxy
+	req := httptest.NewRequest(http.MethodGet, "/ok", nil)
+	req.Header.Set(requestIDHeader, "proxy-id")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Errorf("expected status 204, got %d", w.Code)
+	}
+	if id := w.Header().Get(requestIDHeader); id != "proxy-id" {
+		t.Errorf("expected the proxy's request ID, got %q", id)
+	}
+}
+
+func TestRunJob_RecoversPanic(t *testing.T) {
+	before := testutil.ToFloat64(panicsTotal.WithLabelValues("job"))
+	err := runJob(context.Background(), "test", func(context.Context) error {
+		panic("boom")
+	})
+	if err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+	if after := testutil.ToFloat64(panicsTotal.WithLabelValues("job")); after != before+1 {
+		t.Errorf("expected the panic to be counted, got %v -> %v", before, after)
+	}
+}
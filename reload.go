@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+)
+
+// CredentialReloader is implemented by storage clients whose credentials can
+// be replaced while the server is running.
+type CredentialReloader interface {
+	ReloadCredentials(cfg *Config) error
+}
+
+// credentialReloader rereads the configuration on SIGHUP, or periodically
+// when secrets are read from files, and puts rotated secrets, changed
+// request limits and a changed log level into use without a restart. Connections are kept open.
+// Settings read only at startup, such as the storage and the listeners, are
+// reported as needing a restart.
+type credentialReloader struct {
+	storage   Repository
+	authToken *atomic.Pointer[string] // Token checked by authMiddleware
+	limits    *ClientLimiter          // Optional - applies REQUEST_RATE_LIMIT
+	shedder   *Shedder                // Optional - applies MAX_CONCURRENT_REQUESTS
+
+	mu  sync.Mutex
+	cfg *Config // Configuration in use
+}
+
+// restartSettings returns the settings of cfg only read at startup, by the
+// variables setting them.
+func restartSettings(cfg *Config) map[string]string {
+	return map[string]string{
+		"STORAGE_BACKEND":                    cfg.StorageBackend,
+		"GITEA_URL, GITEA_OWNER, GITEA_REPO": cfg.RepoURL(),
+		"GITEA_BRANCH":                       cfg.GiteaBranch,
+		"LISTENERS":                          fmt.Sprint(cfg.Listeners),
+		"LOG_FORMAT":                         cfg.LogFormat,
+		"ACCESS_LOG_FORMAT":                  cfg.AccessLogFormat,
+	}
+}
+
+func newCredentialReloader(cfg *Config, storage Repository) *credentialReloader {
+	c := &credentialReloader{storage: storage, authToken: new(atomic.Pointer[string]), cfg: cfg}
+	c.authToken.Store(&cfg.AuthToken)
+	return c
+}
+
+// AuthToken returns the token clients currently authenticate with.
+func (c *credentialReloader) AuthToken() string {
+	return *c.authToken.Load()
+}
+
+// Reload rereads the configuration and switches to any changed credentials.
+// Storage credentials are only switched to once they are shown to work; until
+// then the current ones stay in use and the next reload tries again.
+func (c *credentialReloader) Reload(context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fresh, err := LoadConfig()
+	if err != nil {
+		return fmt.Errorf("failed to reload configuration: %w", err)
+	}
+
+	c.reloadLimits(fresh)
+	if fresh.LogLevel != c.cfg.LogLevel {
+		logLevel.Set(fresh.LogLevel)
+		c.cfg.LogLevel = fresh.LogLevel
+		slog.Info("Reloaded LOG_LEVEL", "level", fresh.LogLevel.String())
+	}
+	current := restartSettings(c.cfg)
+	for name, value := range restartSettings(fresh) {
+		if value != current[name] {
+			slog.Warn("Setting changed; restart the backend to apply it", "setting", name)
+		}
+	}
+
+	if fresh.AuthToken != c.cfg.AuthToken {
+		if fresh.AuthToken == "" || c.cfg.AuthToken == "" {
+			slog.Warn("AUTH_TOKEN can only be set or unset with a restart; keeping the current token")
+		} else {
+			c.authToken.Store(&fresh.AuthToken)
+			c.cfg.AuthToken = fresh.AuthToken
+			slog.Info("Reloaded AUTH_TOKEN")
+		}
+	}
+
+	if fresh.GiteaToken == c.cfg.GiteaToken && fresh.GiteaPassword == c.cfg.GiteaPassword && bytes.Equal(fresh.GiteaTOTPSecret, c.cfg.GiteaTOTPSecret) {
+		return nil
+	}
+	next := *c.cfg
+	next.GiteaToken, next.GiteaPassword, next.GiteaTOTPSecret = fresh.GiteaToken, fresh.GiteaPassword, fresh.GiteaTOTPSecret
+	reloader, ok := c.storage.(CredentialReloader)
+	if !ok {
+		// Reported once; the changed credentials are used after a restart
+		c.cfg = &next
+		slog.Warn("Storage credentials changed, but the backend only reads them at startup", "storage", c.cfg.StorageBackend)
+		return nil
+	}
+	if err := reloader.ReloadCredentials(&next); err != nil {
+		return fmt.Errorf("keeping the current storage credentials: %w", err)
+	}
+	c.cfg = &next
+	slog.Info("Reloaded storage credentials")
+	return nil
+}
+
+// reloadLimits puts the request limits of fresh into use. c.mu must be held.
+func (c *credentialReloader) reloadLimits(fresh *Config) {
+	if c.limits != nil && fresh.RequestRateLimit != c.cfg.RequestRateLimit {
+		c.limits.SetLimit(fresh.RequestRateLimit)
+		c.cfg.RequestRateLimit = fresh.RequestRateLimit
+		slog.Info("Reloaded REQUEST_RATE_LIMIT", "requests_per_minute", fresh.RequestRateLimit)
+	}
+	if c.shedder != nil && fresh.MaxConcurrentRequests != c.cfg.MaxConcurrentRequests {
+		c.shedder.SetLimit(fresh.MaxConcurrentRequests)
+		c.cfg.MaxConcurrentRequests = fresh.MaxConcurrentRequests
+		slog.Info("Reloaded MAX_CONCURRENT_REQUESTS", "requests", fresh.MaxConcurrentRequests)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestCredentialReloader(t *testing.T) {
+	var accepted atomic.Value
+	accepted.Store("old-token")
+	dev := NewDevGitea()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "token "+accepted.Load().(string) {
+			http.Error(w, `{"message":"token is invalid"}`, http.StatusUnauthorized)
+			return
+		}
+		dev.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	dir := t.TempDir()
+	writeSecret := func(name, value string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(value+"\n"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	t.Setenv("GITEA_URL", server.URL)
+	t.Setenv("GITEA_OWNER", "testowner")
+	t.Setenv("GITEA_REPO", "testrepo")
+	t.Setenv("GITEA_TOKEN_FILE", writeSecret("gitea-token", "old-token"))
+	t.Setenv("AUTH_TOKEN_FILE", writeSecret("auth-token", "old-auth"))
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewGiteaClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloader := newCredentialReloader(cfg, client)
+	ctx := context.Background()
+	path := "states/myproject/terraform.tfstate"
+
+	// A token Gitea does not accept yet is not switched to
+	writeSecret("gitea-token", "new-token")
+	if err := reloader.Reload(ctx); err == nil {
+		t.Error("expected the reload to fail")
+	}
+	if err := client.CreateOrUpdateFile(ctx, path, []byte("{}"), "create"); err != nil {
+		t.Fatalf("expected the old token to stay in use: %v", err)
+	}
+
+	accepted.Store("new-token")
+	writeSecret("auth-token", "new-auth")
+	if err := reloader.Reload(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := client.CreateOrUpdateFile(ctx, path, []byte(`{"serial":1}`), "update"); err != nil {
+		t.Errorf("expected the new token to be used: %v", err)
+	}
+	if token := reloader.AuthToken(); token != "new-auth" {
+		t.Errorf("expected AUTH_TOKEN to be reloaded, got %q", token)
+	}
+
+	// Copies for other repositories share the credentials
+	archive := client.WithRepo("testrepo").(*GiteaClient)
+	if _, _, err := archive.GetFile(ctx, path); err != nil {
+		t.Errorf("expected copies to use the new token: %v", err)
+	}
+}
+
+func TestCredentialReloader_Limits(t *testing.T) {
+	t.Setenv("GITEA_URL", "https://gitea.example.com")
+	t.Setenv("GITEA_TOKEN", "test-token")
+	t.Setenv("GITEA_OWNER", "testowner")
+	t.Setenv("GITEA_REPO", "testrepo")
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	c := newCredentialReloader(cfg, nil)
+	c.limits, c.shedder = NewClientLimiter(cfg.RequestRateLimit, nil), NewShedder(cfg.MaxConcurrentRequests)
+
+	t.Setenv("REQUEST_RATE_LIMIT", "60")
+	t.Setenv("MAX_CONCURRENT_REQUESTS", "50")
+	t.Setenv("GITEA_REPO", "otherrepo") // Needs a restart; only logged
+	if err := c.Reload(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.limits.Allow("addr:10.0.0.1"); !ok {
+		t.Fatal("expected the first request to be allowed")
+	}
+	for range minClientBurst * 2 {
+		c.limits.Allow("addr:10.0.0.1")
+	}
+	if _, ok := c.limits.Allow("addr:10.0.0.1"); ok {
+		t.Error("expected the reloaded rate limit to apply")
+	}
+	if got := c.shedder.limit.Load(); got != 50 {
+		t.Errorf("expected 50 requests at once, got %d", got)
+	}
+	if cfg.GiteaRepo != "testrepo" {
+		t.Errorf("expected the repository to stay until a restart, got %s", cfg.GiteaRepo)
+	}
+
+	t.Setenv("REQUEST_RATE_LIMIT", "0")
+	if err := c.Reload(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.limits.Allow("addr:10.0.0.1"); !ok {
+		t.Error("expected the rate limit to be turned off")
+	}
+}
+
+func TestCredentialReloader_LogLevel(t *testing.T) {
+	t.Setenv("GITEA_URL", "https://gitea.example.com")
+	t.Setenv("GITEA_TOKEN", "test-token")
+	t.Setenv("GITEA_OWNER", "testowner")
+	t.Setenv("GITEA_REPO", "testrepo")
+	t.Cleanup(func() { logLevel.Set(slog.LevelInfo) })
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var buf bytes.Buffer
+	logger := slog.New(newLogHandler(&buf, logLevel, LogFormatText))
+	c := newCredentialReloader(cfg, nil)
+
+	logger.Debug("Lock acquired")
+	t.Setenv("LOG_LEVEL", "debug")
+	if err := c.Reload(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	logger.Debug("Lock released")
+
+	if got := buf.String(); strings.Contains(got, "Lock acquired") || !strings.Contains(got, "Lock released") {
+		t.Errorf("expected debug entries only after the reload, got %q", got)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"code.gitea.io/sdk/gitea"
+)
+
+// ReplicaConfig identifies a read-only Gitea pull mirror of the state repository.
+type ReplicaConfig struct {
+	URL   string // Base URL of the Gitea instance hosting the mirror
+	Owner string
+	Repo  string
+}
+
+// parseReplicas parses a comma-separated list of mirror repository URLs such as
+// https://gitea-eu.example.com/infra/terraform-state.
+func parseReplicas(s string) ([]ReplicaConfig, error) {
+	var replicas []ReplicaConfig
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		u, err := url.Parse(entry)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("invalid replica URL %q", entry)
+		}
+		segments := strings.Split(strings.Trim(u.Path, "/"), "/")
+		if len(segments) < 2 || segments[len(segments)-2] == "" || segments[len(segments)-1] == "" {
+			return nil, fmt.Errorf("replica URL %q must end in /<owner>/<repo>", entry)
+		}
+		n := len(segments)
+		base := u.Scheme + "://" + u.Host
+		if n > 2 {
+			base += "/" + strings.Join(segments[:n-2], "/")
+		}
+		replicas = append(replicas, ReplicaConfig{URL: base, Owner: segments[n-2], Repo: segments[n-1]})
+	}
+	return replicas, nil
+}
+
+// newReplicaClient creates a GiteaClient for a mirror. Unlike the primary, a
+// replica may be down at startup, so the server version is not checked.
+func newReplicaClient(rc ReplicaConfig, token, branch string) (*GiteaClient, error) {
+	httpClient := &http.Client{Timeout: 10 * time.Second}
+	client, err := gitea.NewClient(rc.URL,
+		gitea.SetToken(token),
+		gitea.SetGiteaVersion(""),
+		gitea.SetHTTPClient(httpClient),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create gitea client for replica %s: %w", rc.URL, err)
+	}
+
+	session := new(atomic.Pointer[giteaSession])
+	session.Store(&giteaSession{client: client, http: httpClient, token: token})
+	return &GiteaClient{
+		session: session,
+		owner:   rc.Owner,
+		repo:    rc.Repo,
+		branch:  branch,
+		baseURL: strings.TrimSuffix(rc.URL, "/"),
+	}, nil
+}
+
+// replica is a read-only state source with its last measured health.
+type replica struct {
+	name    string
+	storage StateStorage
+	probe   func() error
+
+	healthy bool
+	latency time.Duration
+}
+
+// ReplicaSet routes state reads to the nearest healthy read-only replica,
+// falling back to the primary. Replicas are pull mirrors and may lag behind
+// the primary, so callers must read from the primary whenever freshness
+// matters.
+type ReplicaSet struct {
+	primary  StateStorage
+	replicas []*replica
+
+	mu      sync.RWMutex
+	current *replica // nil selects the primary
+}
+
+// NewReplicaSet creates a ReplicaSet reading from primary until replicas are probed.
+func NewReplicaSet(primary StateStorage) *ReplicaSet {
+	return &ReplicaSet{primary: primary}
+}
+
+// Add registers a replica. probe must return an error if the replica cannot serve reads.
+func (s *ReplicaSet) Add(name string, storage StateStorage, probe func() error) {
+	s.replicas = append(s.replicas, &replica{name: name, storage: storage, probe: probe})
+}
+
+// Reader returns the storage to serve a read from.
+func (s *ReplicaSet) Reader() StateStorage {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.current == nil {
+		return s.primary
+	}
+	return s.current.storage
+}
+
+// Probe measures the latency of every replica and selects the fastest healthy one.
+func (s *ReplicaSet) Probe(ctx context.Context) error {
+	var best *replica
+	for _, r := range s.replicas {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		start := time.Now()
+		err := r.probe()
+		latency := time.Since(start)
+
+		s.mu.Lock()
+		if err != nil && r.healthy {
+			slog.Warn("Replica is unhealthy", "replica", r.name, "error", err)
+		}
+		r.healthy = err == nil
+		r.latency = latency
+		s.mu.Unlock()
+
+		if r.healthy && (best == nil || r.latency < best.latency) {
+			best = r
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if best != s.current {
+		if best == nil {
+			slog.Warn("No healthy replica; reading from primary")
+		} else {
+			slog.Info("Reading from replica", "replica", best.name, "latency", best.latency.Round(time.Millisecond))
+		}
+		s.current = best
+	}
+	return nil
+}
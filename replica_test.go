@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseReplicas(t *testing.T) {
+	replicas, err := parseReplicas("https://gitea-eu.example.com/infra/tf-state, https://example.com/gitea/ops/state")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []ReplicaConfig{
+		{URL: "https://gitea-eu.example.com", Owner: "infra", Repo: "tf-state"},
+		{URL: "https://example.com/gitea", Owner: "ops", Repo: "state"},
+	}
+	if len(replicas) != len(expected) {
+		t.Fatalf("expected %d replicas, got %d", len(expected), len(replicas))
+	}
+	for i := range expected {
+		if replicas[i] != expected[i] {
+			t.Errorf("replica %d: expected %+v, got %+v", i, expected[i], replicas[i])
+		}
+	}
+
+	for _, invalid := range []string{"gitea.example.com/infra/tf-state", "https://gitea.example.com/infra"} {
+		if _, err := parseReplicas(invalid); err == nil {
+			t.Errorf("expected error for %q", invalid)
+		}
+	}
+}
+
+func TestReplicaSet_ProbeSelectsHealthyReplica(t *testing.T) {
+	primary := NewMockStorage()
+	down := NewMockStorage()
+	up := NewMockStorage()
+
+	replicas := NewReplicaSet(primary)
+	if replicas.Reader() != primary {
+		t.Error("expected reads from primary before probing")
+	}
+
+	downErr := errors.New("connection refused")
+	replicas.Add("down", down, func() error { return downErr })
+	replicas.Add("up", up, func() error { return nil })
+
+	if err := replicas.Probe(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if replicas.Reader() != up {
+		t.Error("expected reads from the healthy replica")
+	}
+
+	// Fall back to the primary once no replica is healthy
+	replicas.replicas[1].probe = func() error { return downErr }
+	if err := replicas.Probe(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if replicas.Reader() != primary {
+		t.Error("expected reads from primary without healthy replicas")
+	}
+}
+
+func TestGetState_ReadsFromReplicaUnlessLocked(t *testing.T) {
+	handler, primary := newTestHandler()
+	primary.files["states/myproject/terraform.tfstate"] = []byte(`"primary"`)
+	mirror := NewMockStorage()
+	mirror.files["states/myproject/terraform.tfstate"] = []byte(`"replica"`)
+
+	handler.replicas = NewReplicaSet(primary)
+	handler.replicas.Add("mirror", mirror, func() error { return nil })
+	if err := handler.replicas.Probe(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	get := func() string {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/myproject", nil))
+		return w.Body.String()
+	}
+
+	if got := get(); got != `"replica"` {
+		t.Errorf("expected unlocked read from replica, got %s", got)
+	}
+
+	handler.locks["myproject"] = LockInfo{ID: "lock-123", Operation: "OperationTypePlan"}
+	if got := get(); got != `"replica"` {
+		t.Errorf("expected read under plan lock from replica, got %s", got)
+	}
+
+	handler.locks["myproject"] = LockInfo{ID: "lock-123", Operation: "OperationTypeApply"}
+	if got := get(); got != `"primary"` {
+		t.Errorf("expected read under apply lock from primary, got %s", got)
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Ways of handling a move of a repository, as set by REPO_MOVES.
+const (
+	RepoMovesFollow  = "follow"  // Use the new location at once
+	RepoMovesConfirm = "confirm" // Refuse writes until an administrator confirms the move
+)
+
+// repoAPIPrefix precedes the owner and name of a repository in the paths of
+// the Gitea API.
+const repoAPIPrefix = "/api/v1/repos/"
+
+// maxRepoMoves bounds the moves followed from one repository, should moves
+// form a cycle.
+const maxRepoMoves = 10
+
+// repoMoves tracks the moves of the repositories the Gitea clients use. It is
+// set from REPO_MOVES in main; nil leaves redirects to the HTTP client.
+var repoMoves *RepoMoves
+
+// RepoMove is a repository found renamed or transferred.
+type RepoMove struct {
+	From       string    `json:"from"`
+	To         string    `json:"to"`
+	DetectedAt time.Time `json:"detected_at"`
+	Confirmed  bool      `json:"confirmed"` // Requests are sent to To
+}
+
+// RepoMoves detects the repositories Gitea reports as moved. Gitea answers
+// requests for the old owner or name of a renamed or transferred repository
+// with a redirect to the new one. The HTTP client would follow it for reads,
+// but turn a redirected write into a GET, which Gitea answers without writing
+// anything. Each move is logged and announced once; confirmed ones, all of
+// them when following, have their requests sent to the new location directly,
+// with their method and body.
+type RepoMoves struct {
+	follow   bool
+	notifier *Notifier // Optional - receives repo.moved events
+
+	mu    sync.Mutex
+	moves map[string]*RepoMove // keyed by the lowercased owner/repo moved from
+}
+
+// NewRepoMoves creates a RepoMoves confirming every move if follow is set.
+func NewRepoMoves(follow bool) *RepoMoves {
+	return &RepoMoves{follow: follow, moves: make(map[string]*RepoMove)}
+}
+
+// apiRepo returns the owner/repo an API path is about, and where it is in p.
+func apiRepo(p string) (repo string, start, end int, ok bool) {
+	i := strings.Index(p, repoAPIPrefix)
+	if i < 0 {
+		return "", 0, 0, false
+	}
+	start = i + len(repoAPIPrefix)
+	parts := strings.SplitN(p[start:], "/", 3)
+	if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+		return "", 0, 0, false
+	}
+	end = start + len(parts[0]) + 1 + len(parts[1])
+	return p[start:end], start, end, true
+}
+
+// target returns where the repository from is now, following confirmed
+// moves.
+func (m *RepoMoves) target(from string) (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	to, moved := from, false
+	for range maxRepoMoves {
+		move, ok := m.moves[strings.ToLower(to)]
+		if !ok || !move.Confirmed {
+			break
+		}
+		to, moved = move.To, true
+	}
+	return to, moved
+}
+
+// rewrite returns req sent to where its repository is now, or req itself if
+// the repository has not moved.
+func (m *RepoMoves) rewrite(req *http.Request) *http.Request {
+	from, start, end, ok := apiRepo(req.URL.Path)
+	if !ok {
+		return req
+	}
+	to, moved := m.target(from)
+	if !moved {
+		return req
+	}
+	r := req.Clone(req.Context())
+	r.URL.Path = req.URL.Path[:start] + to + req.URL.Path[end:]
+	r.URL.RawPath = ""
+	return r
+}
+
+// detect records that Gitea redirected a request for the repository from to
+// to, and announces the move if it is new.
+func (m *RepoMoves) detect(from, to string) RepoMove {
+	m.mu.Lock()
+	move, known := m.moves[strings.ToLower(from)]
+	if !known || move.To != to {
+		move = &RepoMove{From: from, To: to, DetectedAt: time.Now().UTC(), Confirmed: m.follow}
+		m.moves[strings.ToLower(from)] = move
+	}
+	detected := *move
+	m.mu.Unlock()
+	if known && detected.To == to {
+		return detected
+	}
+
+	IncrementRepoMoves()
+	if detected.Confirmed {
+		slog.Warn("Repository has moved; following it. Point the configuration at the new one to stop relying on the redirect", "from", from, "to", to)
+	} else {
+		slog.Warn("Repository has moved; writes are refused until the move is confirmed with POST /admin/repo-moves/{from}", "from", from, "to", to)
+	}
+	m.notifier.Notify(EventRepoMoved, from, fmt.Sprintf("Repository %s has moved to %s.", from, to), detected)
+	return detected
+}
+
+// repoMoveTransport sends requests for moved repositories to their new
+// location, and detects the moves Gitea redirects requests for.
+type repoMoveTransport struct {
+	next  http.RoundTripper
+	moves *RepoMoves
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *repoMoveTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = t.moves.rewrite(req)
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		return resp, nil
+	}
+	from, _, _, ok := apiRepo(req.URL.Path)
+	location, err := resp.Location()
+	if !ok || err != nil {
+		return resp, nil
+	}
+	to, _, _, ok := apiRepo(location.Path)
+	if !ok || strings.EqualFold(from, to) {
+		return resp, nil
+	}
+
+	move := t.moves.detect(from, to)
+	if !move.Confirmed {
+		if req.Method == http.MethodGet || req.Method == http.MethodHead {
+			// Reads are safe to redirect
+			return resp, nil
+		}
+		resp.Body.Close()
+		return nil, fmt.Errorf("%w: %s is now %s; confirm the move with POST /admin/repo-moves/%s", ErrRepoMoved, from, to, from)
+	}
+
+	// Send the request again to the new location, rather than let the
+	// client redirect a write as a GET
+	resp.Body.Close()
+	moved := t.moves.rewrite(req)
+	if req.Body != nil && req.Body != http.NoBody {
+		if req.GetBody == nil {
+			return nil, fmt.Errorf("cannot resend %s %s to %s: its body cannot be read again", req.Method, req.URL.Path, to)
+		}
+		if moved.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+	return t.next.RoundTrip(moved)
+}
+
+// ServeHTTP serves GET /admin/repo-moves, listing the moves detected since
+// startup.
+func (m *RepoMoves) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	moves := make([]RepoMove, 0, len(m.moves))
+	for _, move := range m.moves {
+		moves = append(moves, *move)
+	}
+	m.mu.Unlock()
+	sort.Slice(moves, func(a, b int) bool { return moves[a].DetectedAt.Before(moves[b].DetectedAt) })
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(moves)
+}
+
+// handleConfirm serves POST /admin/repo-moves/{owner}/{repo}, confirming the
+// move of the repository so that requests go to its new location.
+func (m *RepoMoves) handleConfirm(w http.ResponseWriter, r *http.Request) {
+	from := r.PathValue("owner") + "/" + r.PathValue("repo")
+	m.mu.Lock()
+	move, ok := m.moves[strings.ToLower(from)]
+	var confirmed RepoMove
+	if ok {
+		move.Confirmed = true
+		confirmed = *move
+	}
+	m.mu.Unlock()
+	if !ok {
+		writeError(w, fmt.Errorf("%w: no move of %s was detected", ErrNotFound, from))
+		return
+	}
+	slog.Info("Confirmed the move of repository; point the configuration at the new one to stop relying on the redirect", "from", confirmed.From, "to", confirmed.To)
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(confirmed)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newMovedRepoClient returns a client of the repository oldowner/testrepo,
+// which Gitea redirects to testowner/testrepo, with moves tracked by moves.
+// redirects counts the requests redirected.
+func newMovedRepoClient(t *testing.T, moves *RepoMoves, redirects *int) *GiteaClient {
+	t.Helper()
+	repoMoves = moves
+	t.Cleanup(func() { repoMoves = nil })
+
+	dev := NewDevGitea()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/repos/oldowner/testrepo") {
+			*redirects++
+			http.Redirect(w, r, strings.Replace(r.URL.RequestURI(), "/repos/oldowner/", "/repos/testowner/", 1), http.StatusMovedPermanently)
+			return
+		}
+		dev.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	client, err := NewGiteaClient(&Config{
+		GiteaURL:    server.URL,
+		GiteaToken:  "test-token",
+		GiteaOwner:  "oldowner",
+		GiteaRepo:   "testrepo",
+		GiteaBranch: "main",
+		Retry:       RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond},
+	})
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	return client
+}
+
+func TestRepoMoves_Follow(t *testing.T) {
+	moves := NewRepoMoves(true)
+	redirects := 0
+	client := newMovedRepoClient(t, moves, &redirects)
+
+	ctx := context.Background()
+	if err := client.CreateOrUpdateFile(ctx, "states/a/terraform.tfstate", []byte(`{"serial":1}`), "create"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := client.CreateOrUpdateFile(ctx, "states/a/terraform.tfstate", []byte(`{"serial":2}`), "update"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if content, _, _ := client.GetFile(ctx, "states/a/terraform.tfstate"); string(content) != `{"serial":2}` {
+		t.Errorf("expected the writes to reach the moved repository, got %q", content)
+	}
+	if redirects != 1 {
+		t.Errorf("expected requests to go to the new location once the move was detected, got %d redirects", redirects)
+	}
+
+	w := serve(moves, http.MethodGet, "/admin/repo-moves")
+	if !strings.Contains(w.Body.String(), `"to":"testowner/testrepo"`) || !strings.Contains(w.Body.String(), `"confirmed":true`) {
+		t.Errorf("expected the move to be listed as confirmed, got %s", w.Body)
+	}
+}
+
+func TestRepoMoves_Confirm(t *testing.T) {
+	moves := NewRepoMoves(false)
+	redirects := 0
+	client := newMovedRepoClient(t, moves, &redirects)
+
+	// Reads follow the redirect, writes wait for the move to be confirmed
+	ctx := context.Background()
+	if _, _, err := client.GetFile(ctx, "states/a/terraform.tfstate"); err != nil {
+		t.Fatalf("unexpected error reading: %v", err)
+	}
+	redirects = 0
+	err := client.CreateOrUpdateFile(ctx, "states/a/terraform.tfstate", []byte(`{"serial":1}`), "create")
+	if !errors.Is(err, ErrRepoMoved) {
+		t.Fatalf("expected the write to be refused, got %v", err)
+	}
+	if classifyError(err) != ErrRepoMoved {
+		t.Errorf("expected the refusal to be answered as repo_moved, got %s", classifyError(err).code)
+	}
+	// The write reads the file it replaces first, and is not retried itself
+	if redirects != 2 {
+		t.Errorf("expected the refused write not to be retried, got %d redirects", redirects)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /admin/repo-moves/{owner}/{repo}", moves.handleConfirm)
+	if w := serve(mux, http.MethodPost, "/admin/repo-moves/other/repo"); w.Code != http.StatusNotFound {
+		t.Errorf("expected status 404 for an unknown move, got %d", w.Code)
+	}
+	if w := serve(mux, http.MethodPost, "/admin/repo-moves/oldowner/testrepo"); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+	}
+	if err := client.CreateOrUpdateFile(ctx, "states/a/terraform.tfstate", []byte(`{"serial":1}`), "create"); err != nil {
+		t.Fatalf("expected the write to succeed once confirmed, got %v", err)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"sync"
+	"time"
+)
+
+// repoGrowthWindow is the period over which the growth rate is measured.
+// Gitea updates repository sizes lazily, so short windows are noisy.
+const repoGrowthWindow = 24 * time.Hour
+
+// RepoSizer reports the size of a repository in bytes.
+type RepoSizer interface {
+	RepoSize() (int64, error)
+}
+
+type sizeSample struct {
+	at   time.Time
+	size int64
+}
+
+// RepoSizeMonitor tracks the size of the state repository and its growth
+// rate, warning when growth is fast enough that retention or compression
+// should be enabled before the repository becomes a burden on Gitea.
+type RepoSizeMonitor struct {
+	repo      RepoSizer
+	warnBytes float64 // Growth in bytes per day above which to warn; 0 disables warnings
+	now       func() time.Time
+
+	mu      sync.Mutex
+	samples []sizeSample // oldest first, spanning at most repoGrowthWindow
+}
+
+// NewRepoSizeMonitor creates a monitor warning when the repository grows by
+// more than warnMBPerDay megabytes per day.
+func NewRepoSizeMonitor(repo RepoSizer, warnMBPerDay int) *RepoSizeMonitor {
+	return &RepoSizeMonitor{
+		repo:      repo,
+		warnBytes: float64(warnMBPerDay) * (1 << 20),
+		now:       time.Now,
+	}
+}
+
+// Run samples the repository size and updates the size and growth metrics.
+func (m *RepoSizeMonitor) Run(_ context.Context) error {
+	size, err := m.repo.RepoSize()
+	if err != nil {
+		return err
+	}
+	SetRepoSize(size)
+
+	growth, ok := m.record(sizeSample{at: m.now(), size: size})
+	if !ok {
+		return nil
+	}
+	SetRepoGrowthRate(growth)
+
+	if m.warnBytes > 0 && growth > m.warnBytes {
+		slog.Warn("State repository is growing fast; consider enabling retention or compression",
+			"mb_per_day", math.Round(growth/(1<<20)*10)/10, "size_mb", math.Round(float64(size)/(1<<20)*10)/10)
+	}
+	return nil
+}
+
+// record adds a sample and returns the growth rate in bytes per day across the
+// retained samples. Returns false until two samples are available.
+func (m *RepoSizeMonitor) record(sample sizeSample) (float64, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.samples = append(m.samples, sample)
+	cutoff := sample.at.Add(-repoGrowthWindow)
+	for len(m.samples) > 2 && m.samples[1].at.Before(cutoff) {
+		m.samples = m.samples[1:]
+	}
+
+	oldest := m.samples[0]
+	elapsed := sample.at.Sub(oldest.at)
+	if elapsed <= 0 {
+		return 0, false
+	}
+	return float64(sample.size-oldest.size) / elapsed.Hours() * 24, true
+}
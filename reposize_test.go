@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// fakeRepoSizer returns the sizes in order, repeating the last one.
+type fakeRepoSizer struct {
+	sizes []int64
+}
+
+func (f *fakeRepoSizer) RepoSize() (int64, error) {
+	size := f.sizes[0]
+	if len(f.sizes) > 1 {
+		f.sizes = f.sizes[1:]
+	}
+	return size, nil
+}
+
+func TestRepoSizeMonitor_GrowthRate(t *testing.T) {
+	sizer := &fakeRepoSizer{sizes: []int64{100 << 20}}
+	monitor := NewRepoSizeMonitor(sizer, 0)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	monitor.now = func() time.Time { return now }
+
+	if err := monitor.Run(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// 10 MB in 6 hours is 40 MB/day
+	now = now.Add(6 * time.Hour)
+	growth, ok := monitor.record(sizeSample{at: now, size: 110 << 20})
+	if !ok {
+		t.Fatal("expected a growth rate after two samples")
+	}
+	if growth != 40<<20 {
+		t.Errorf("expected growth of 40 MB/day, got %.0f", growth)
+	}
+}
+
+func TestRepoSizeMonitor_WindowDropsOldSamples(t *testing.T) {
+	monitor := NewRepoSizeMonitor(&fakeRepoSizer{sizes: []int64{0}}, 0)
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	monitor.record(sizeSample{at: start, size: 0})
+	monitor.record(sizeSample{at: start.Add(30 * time.Hour), size: 1000})
+	growth, _ := monitor.record(sizeSample{at: start.Add(60 * time.Hour), size: 2250})
+
+	// The first sample is older than the window and must be dropped
+	if growth != 1000 {
+		t.Errorf("expected growth of 1000 bytes/day, got %.0f", growth)
+	}
+}
+
+func TestRepoSizeMonitor_FirstSampleHasNoRate(t *testing.T) {
+	monitor := NewRepoSizeMonitor(&fakeRepoSizer{sizes: []int64{0}}, 0)
+
+	if _, ok := monitor.record(sizeSample{at: time.Now(), size: 100}); ok {
+		t.Error("expected no growth rate from a single sample")
+	}
+}
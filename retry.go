@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"time"
+)
+
+// Default retry policy for Gitea API calls.
+const (
+	DefaultRetryMaxAttempts = 3
+	DefaultRetryBaseDelay   = 500 * time.Millisecond
+	DefaultRetryJitter      = 0.2
+)
+
+// RetryPolicy configures how transient Gitea failures are retried: server
+// errors, rate limiting (429) and network errors.
+type RetryPolicy struct {
+	MaxAttempts int           `env:"RETRY_MAX_ATTEMPTS"` // Total attempts, including the first; 1 disables retries
+	BaseDelay   time.Duration `env:"RETRY_BASE_DELAY"`   // Delay before the first retry, doubled for each further one
+	Jitter      float64       `env:"RETRY_JITTER"`       // Fraction by which each delay is randomly varied, from 0 to 1
+}
+
+// delay returns the time to wait after the given failed attempt (counted
+// from 1). A Retry-After header sent with the failed response takes precedence.
+func (p RetryPolicy) delay(attempt int, resp *http.Response) time.Duration {
+	if resp != nil {
+		if d, ok := retryAfter(resp, time.Now()); ok {
+			return d
+		}
+	}
+	d := p.BaseDelay << (attempt - 1)
+	if p.Jitter > 0 {
+		d = time.Duration(float64(d) * (1 + p.Jitter*(2*rand.Float64()-1)))
+	}
+	return d
+}
+
+// retryTransport retries requests failing with transient errors according to
+// policy. Requests are only retried if their body can be replayed.
+//
+// Writes are safe to retry: they are made against the SHA of the file they
+// replace, so a retried write whose first attempt did reach Gitea fails with a
+// conflict instead of being applied twice.
+type retryTransport struct {
+	next   http.RoundTripper
+	policy RetryPolicy
+}
+
+// newRetryTransport wraps next, or http.DefaultTransport if nil.
+func newRetryTransport(next http.RoundTripper, policy RetryPolicy) *retryTransport {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &retryTransport{next: next, policy: policy}
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		attemptReq := req
+		if attempt > 1 && req.Body != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			attemptReq = req.Clone(req.Context())
+			attemptReq.Body = body
+		}
+
+		resp, err := t.next.RoundTrip(attemptReq)
+		if attempt >= t.policy.MaxAttempts || !retryable(resp, err) || req.Context().Err() != nil ||
+			(req.Body != nil && req.GetBody == nil) {
+			return resp, err
+		}
+
+		delay := t.policy.delay(attempt, resp)
+		var reason string
+		if err != nil {
+			reason = err.Error()
+		} else {
+			reason = resp.Status
+			_, _ = io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		slog.Warn("Retrying storage request", "method", req.Method, "path", req.URL.Path, "delay", delay.Round(time.Millisecond), "attempt", attempt, "max_attempts", t.policy.MaxAttempts, "reason", reason)
+		IncrementStorageRetries()
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// retryable reports whether a request failing with resp or err may succeed
+// when retried.
+func retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		// A write refused for a move awaiting confirmation fails alike
+		return !errors.Is(err, ErrRepoMoved)
+	}
+	return resp.StatusCode == http.StatusTooManyRequests ||
+		(resp.StatusCode >= 500 && resp.StatusCode != http.StatusNotImplemented)
+}
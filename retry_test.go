@@ -0,0 +1,100 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// flakyServer fails the first failures requests with status, then echoes the
+// request body.
+func flakyServer(t *testing.T, failures, status int) (*httptest.Server, *int) {
+	t.Helper()
+
+	attempts := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts <= failures {
+			w.WriteHeader(status)
+			return
+		}
+		_, _ = io.Copy(w, r.Body)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &attempts
+}
+
+func newTestRetryClient(maxAttempts int) *http.Client {
+	return &http.Client{Transport: newRetryTransport(nil, RetryPolicy{MaxAttempts: maxAttempts, BaseDelay: time.Millisecond})}
+}
+
+func TestRetryTransport_RetriesTransientFailures(t *testing.T) {
+	for _, status := range []int{http.StatusServiceUnavailable, http.StatusBadGateway, http.StatusTooManyRequests} {
+		srv, attempts := flakyServer(t, 2, status)
+
+		resp, err := newTestRetryClient(3).Post(srv.URL, "application/json", strings.NewReader(`{"serial":1}`))
+		if err != nil {
+			t.Fatalf("status %d: unexpected error: %v", status, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK || string(body) != `{"serial":1}` {
+			t.Errorf("status %d: expected the body to be replayed, got %d %q", status, resp.StatusCode, body)
+		}
+		if *attempts != 3 {
+			t.Errorf("status %d: expected 3 attempts, got %d", status, *attempts)
+		}
+	}
+}
+
+func TestRetryTransport_GivesUp(t *testing.T) {
+	srv, attempts := flakyServer(t, 5, http.StatusInternalServerError)
+
+	resp, err := newTestRetryClient(3).Get(srv.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("expected the last failure to be returned, got %d", resp.StatusCode)
+	}
+	if *attempts != 3 {
+		t.Errorf("expected 3 attempts, got %d", *attempts)
+	}
+}
+
+func TestRetryTransport_NoRetryOnClientErrors(t *testing.T) {
+	for _, status := range []int{http.StatusNotFound, http.StatusUnprocessableEntity, http.StatusNotImplemented} {
+		srv, attempts := flakyServer(t, 1, status)
+
+		resp, err := newTestRetryClient(3).Get(srv.URL)
+		if err != nil {
+			t.Fatalf("status %d: unexpected error: %v", status, err)
+		}
+		resp.Body.Close()
+
+		if *attempts != 1 {
+			t.Errorf("status %d: expected 1 attempt, got %d", status, *attempts)
+		}
+	}
+}
+
+func TestRetryPolicy_Delay(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 5, BaseDelay: 100 * time.Millisecond, Jitter: 0.5}
+
+	for attempt, base := range map[int]time.Duration{1: 100 * time.Millisecond, 3: 400 * time.Millisecond} {
+		if d := policy.delay(attempt, nil); d < base/2 || d > base*3/2 {
+			t.Errorf("attempt %d: expected delay within 50%% of %v, got %v", attempt, base, d)
+		}
+	}
+
+	resp := &http.Response{Header: http.Header{"Retry-After": []string{"2"}}}
+	if d := policy.delay(1, resp); d != 2*time.Second {
+		t.Errorf("expected Retry-After to be honoured, got %v", d)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// routeError is the body of 404 and 405 responses for requests that do not
+// match a supported operation. It lists what the path does support, so a
+// misconfigured backend block fails with an explanation.
+type routeError struct {
+	Error          string   `json:"error"`
+	Code           string   `json:"code"`
+	RequestID      string   `json:"request_id,omitempty"`
+	AllowedMethods []string `json:"allowed_methods,omitempty"`
+	Hint           string   `json:"hint,omitempty"`
+}
+
+// writeRouteError writes a routeError of the given class. Without hints, only
+// the error message and code are sent.
+func (h *StateHandler) writeRouteError(w http.ResponseWriter, class *apiError, resp routeError) {
+	if !h.routeHints {
+		resp.AllowedMethods, resp.Hint = nil, ""
+	}
+	resp.Code = class.code
+	resp.RequestID = w.Header().Get(requestIDHeader)
+
+	IncrementErrors(class.code)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(class.status)
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// stateMethods returns the methods accepted for a state.
+func (h *StateHandler) stateMethods() []string {
+	methods := []string{http.MethodGet, http.MethodPost, h.lockMethod, h.unlockMethod}
+	if h.deleter != nil && !slices.Contains(methods, http.MethodDelete) {
+		methods = append(methods, http.MethodDelete)
+	}
+	return methods
+}
+
+// methodNotAllowed rejects a request whose method the path does not support.
+// The Allow header is always set; lock methods that differ from the
+// configured ones are explained in the hint.
+func (h *StateHandler) methodNotAllowed(w http.ResponseWriter, r *http.Request, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	h.writeRouteError(w, ErrMethodNotAllowed, routeError{
+		Error:          fmt.Sprintf("method %s is not allowed for %s", r.Method, r.URL.Path),
+		AllowedMethods: allowed,
+		Hint:           h.lockMethodHint(r.Method),
+	})
+}
+
+// lockMethodHint explains a mismatch between the lock methods a client uses
+// and the ones the backend is configured with, or returns "" if the method
+// does not look like a lock request.
+func (h *StateHandler) lockMethodHint(method string) string {
+	switch {
+	case h.lockMethod == "LOCK" && h.unlockMethod == "UNLOCK" && slices.Contains([]string{http.MethodPut, http.MethodPatch, http.MethodDelete}, method):
+		return "this backend locks with LOCK and UNLOCK, Terraform's defaults; remove lock_method and unlock_method from the backend block, or set LOCK_METHOD and UNLOCK_METHOD on the backend to match them"
+	case method == "LOCK" || method == "UNLOCK" || method == http.MethodPut || method == http.MethodPatch || method == http.MethodDelete:
+		return fmt.Sprintf("this backend locks with %s and unlocks with %s; set lock_method = %q and unlock_method = %q in the backend block",
+			h.lockMethod, h.unlockMethod, h.lockMethod, h.unlockMethod)
+	}
+	return ""
+}
+
+// unknownRoute rejects a request under the API namespace that matches no
+// endpoint, instead of treating it as a state name.
+func (h *StateHandler) unknownRoute(w http.ResponseWriter, r *http.Request) {
+	h.writeRouteError(w, ErrNotFound, routeError{
+		Error: fmt.Sprintf("no endpoint %s %s", r.Method, r.URL.Path),
+		Hint:  "states are served at /{name}; the API is described at /docs",
+	})
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func decodeRouteError(t *testing.T, body []byte) routeError {
+	t.Helper()
+	var resp routeError
+	if err := json.Unmarshal(body, &resp); err != nil {
+		t.Fatalf("expected JSON error body: %v", err)
+	}
+	return resp
+}
+
+func TestMethodNotAllowed_ListsMethods(t *testing.T) {
+	handler, _ := newTestHandler()
+
+	w := serve(handler, http.MethodPut, "/myproject")
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected status 405, got %d", w.Code)
+	}
+	if allow := w.Header().Get("Allow"); allow != "GET, POST, LOCK, UNLOCK" {
+		t.Errorf("unexpected Allow header %q", allow)
+	}
+	resp := decodeRouteError(t, w.Body.Bytes())
+	if !slices.Equal(resp.AllowedMethods, []string{"GET", "POST", "LOCK", "UNLOCK"}) {
+		t.Errorf("unexpected allowed methods %v", resp.AllowedMethods)
+	}
+	if !strings.Contains(resp.Hint, "remove lock_method and unlock_method") {
+		t.Errorf("expected a hint about the lock methods, got %q", resp.Hint)
+	}
+}
+
+func TestMethodNotAllowed_CustomLockMethods(t *testing.T) {
+	handler, _ := newTestHandler()
+	handler.lockMethod = http.MethodPut
+	handler.unlockMethod = http.MethodDelete
+
+	w := serve(handler, "LOCK", "/myproject")
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected status 405, got %d", w.Code)
+	}
+	resp := decodeRouteError(t, w.Body.Bytes())
+	if !strings.Contains(resp.Hint, `lock_method = "PUT" and unlock_method = "DELETE"`) {
+		t.Errorf("expected a hint naming the configured methods, got %q", resp.Hint)
+	}
+
+	// Methods unrelated to locking get no hint
+	if resp := decodeRouteError(t, serve(handler, http.MethodOptions, "/myproject").Body.Bytes()); resp.Hint != "" {
+		t.Errorf("expected no hint, got %q", resp.Hint)
+	}
+}
+
+func TestMethodNotAllowed_HintsDisabled(t *testing.T) {
+	handler, _ := newTestHandler()
+	handler.routeHints = false
+
+	w := serve(handler, http.MethodPut, "/myproject")
+	if w.Header().Get("Allow") == "" {
+		t.Error("expected the Allow header to be kept")
+	}
+	resp := decodeRouteError(t, w.Body.Bytes())
+	if resp.AllowedMethods != nil || resp.Hint != "" {
+		t.Errorf("expected only the error message, got %+v", resp)
+	}
+}
+
+func TestUnknownRoute(t *testing.T) {
+	handler, storage := newTestHandler()
+
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		w := serve(handler, method, "/api/v1/unknown")
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s: expected status 404, got %d", method, w.Code)
+		}
+		if resp := decodeRouteError(t, w.Body.Bytes()); resp.Hint == "" {
+			t.Errorf("%s: expected a hint", method)
+		}
+	}
+	if len(storage.files) != 0 {
+		t.Error("expected no state to be written")
+	}
+}
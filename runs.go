@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DefaultRunHistory is how many finished runs are kept per state by default.
+const DefaultRunHistory = 20
+
+// Outcomes of a run, as seen by the backend.
+const (
+	RunRunning       = "running"        // The lock is still held
+	RunSucceeded     = "succeeded"      // Unlocked after its last write, if any, was committed
+	RunFailed        = "failed"         // Unlocked after its last write was rejected or failed
+	RunForceUnlocked = "force_unlocked" // Unlocked without the lock ID, as by terraform force-unlock
+	RunStolen        = "stolen"         // The lock was taken over
+	RunTransferred   = "transferred"    // The lock was handed to another holder
+)
+
+// Run is one Terraform run against a state: the requests made while a lock
+// was held, from LOCK to UNLOCK.
+type Run struct {
+	LockID    string     `json:"lock_id"`
+	Who       string     `json:"who,omitempty"`
+	Operation string     `json:"operation,omitempty"`
+	Started   time.Time  `json:"started"`
+	Finished  *time.Time `json:"finished,omitempty"`
+	Duration  float64    `json:"duration_seconds"`
+	Reads     int        `json:"reads"`
+	Writes    int        `json:"writes"`           // Writes committed
+	Failures  int        `json:"failed_writes"`    // Writes rejected or failed
+	Serial    *uint64    `json:"serial,omitempty"` // Serial of the last state committed
+	Outcome   string     `json:"outcome"`
+
+	// ApplyWithoutWrite flags an apply that released its lock without
+	// committing a state, as when it failed before persisting its changes
+	ApplyWithoutWrite bool `json:"apply_without_write,omitempty"`
+
+	lastFailed bool
+}
+
+// RunLog correlates the requests made under each lock into runs, and keeps
+// the latest finished runs of every state in memory. Like the locks, the
+// history does not survive a restart.
+type RunLog struct {
+	limit int // Finished runs kept per state
+
+	mu       sync.Mutex
+	active   map[string]*Run  // Keyed by state name
+	finished map[string][]Run // Keyed by state name, oldest first
+}
+
+// NewRunLog creates a RunLog keeping up to limit finished runs per state.
+func NewRunLog(limit int) *RunLog {
+	return &RunLog{limit: limit, active: make(map[string]*Run), finished: make(map[string][]Run)}
+}
+
+// Start begins a run of the named state under lock.
+func (l *RunLog) Start(name string, lock LockInfo) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.active[name] = &Run{
+		LockID:    lock.ID,
+		Who:       lock.Who,
+		Operation: lock.Operation,
+		Started:   time.Now().UTC(),
+		Outcome:   RunRunning,
+	}
+}
+
+// Read counts a read of the named state in its running run, if any.
+func (l *RunLog) Read(name string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if run, ok := l.active[name]; ok {
+		run.Reads++
+	}
+}
+
+// Write counts a write of the named state made with lockID in its running
+// run, if the run is that lock's. header describes a committed state; failed
+// writes pass committed false.
+func (l *RunLog) Write(name, lockID string, header *stateHeader, committed bool) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	run, ok := l.active[name]
+	if !ok || run.LockID != lockID {
+		return
+	}
+	run.lastFailed = !committed
+	if !committed {
+		run.Failures++
+		return
+	}
+	run.Writes++
+	if header != nil && header.Serial != nil {
+		serial := *header.Serial
+		run.Serial = &serial
+	}
+}
+
+// Finish ends the running run of the named state, if any, and returns it.
+// An empty outcome is derived from the run's last write.
+func (l *RunLog) Finish(name, outcome string) (Run, bool) {
+	if l == nil {
+		return Run{}, false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	run, ok := l.active[name]
+	if !ok {
+		return Run{}, false
+	}
+	delete(l.active, name)
+
+	finished := time.Now().UTC()
+	run.Finished = &finished
+	run.Duration = finished.Sub(run.Started).Seconds()
+	run.Outcome = outcome
+	if outcome == "" {
+		run.Outcome = RunSucceeded
+		if run.lastFailed {
+			run.Outcome = RunFailed
+		}
+	}
+	// A lock handed on is not a sign of a failed apply
+	handedOn := run.Outcome == RunStolen || run.Outcome == RunTransferred
+	run.ApplyWithoutWrite = run.Operation == "OperationTypeApply" && run.Writes == 0 && !handedOn
+	ObserveRunDuration(run.Outcome, run.Duration)
+
+	runs := append(l.finished[name], *run)
+	if len(runs) > l.limit {
+		runs = runs[len(runs)-l.limit:]
+	}
+	l.finished[name] = runs
+	return *run, true
+}
+
+// finishRun ends the running run of the named state with outcome, and
+// announces an apply that never wrote the state: it may have failed after
+// changing infrastructure, leaving changes the state does not record.
+func (h *StateHandler) finishRun(name, outcome string) {
+	run, ok := h.runs.Finish(name, outcome)
+	if !ok || !run.ApplyWithoutWrite {
+		return
+	}
+	slog.Warn("Apply released its lock without writing the state", "state", name, "lock_id", run.LockID, "who", run.Who)
+	IncrementApplyWithoutWriteRuns()
+	h.notifier.Notify(EventApplyWithoutWrite, name,
+		fmt.Sprintf("An apply on %s by %s ended without writing the state; check for infrastructure changes it did not record.", name, run.Who),
+		run)
+}
+
+// Runs returns the runs of the named state, latest first, starting with the
+// running one, if any.
+func (l *RunLog) Runs(name string) []Run {
+	runs := []Run{}
+	if l == nil {
+		return runs
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if run, ok := l.active[name]; ok {
+		current := *run
+		current.Duration = time.Since(run.Started).Seconds()
+		runs = append(runs, current)
+	}
+	finished := l.finished[name]
+	for i := len(finished) - 1; i >= 0; i-- {
+		runs = append(runs, finished[i])
+	}
+	return runs
+}
+
+// handleRuns serves GET /{name}/runs: the recent runs of a state.
+func (h *StateHandler) handleRuns(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Method != http.MethodGet {
+		h.methodNotAllowed(w, r, http.MethodGet)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"runs": h.runs.Runs(name)})
+}
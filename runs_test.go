@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func getRuns(t *testing.T, handler http.Handler, name string) []Run {
+	t.Helper()
+	w := serve(handler, http.MethodGet, "/"+name+"/runs")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var body struct {
+		Runs []Run `json:"runs"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	return body.Runs
+}
+
+func TestRuns_CorrelatesRequests(t *testing.T) {
+	handler, _ := newTestHandler()
+	handler.runs = NewRunLog(DefaultRunHistory)
+
+	lock := `{"ID":"lock-1","Who":"alice@ci","Operation":"OperationTypeApply"}`
+	if w := serveAs(handler, "LOCK", "/network", "", lock); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+	serve(handler, http.MethodGet, "/network")
+
+	runs := getRuns(t, handler, "network")
+	if len(runs) != 1 || runs[0].Outcome != RunRunning || runs[0].Finished != nil {
+		t.Fatalf("expected a running run, got %+v", runs)
+	}
+
+	for _, body := range []string{`{"version":4,"serial":1,"lineage":"abc"}`, `{"version":4,"serial":2,"lineage":"abc"}`} {
+		if w := serveAs(handler, http.MethodPost, "/network?ID=lock-1", "", body); w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+	}
+	// Writes and reads outside the lock belong to no run
+	serveAs(handler, http.MethodPost, "/network?ID=lock-other", "", `{"version":4,"serial":3,"lineage":"abc"}`)
+	serve(handler, http.MethodGet, "/other")
+
+	if w := serveAs(handler, "UNLOCK", "/network", "", lock); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
+	runs = getRuns(t, handler, "network")
+	if len(runs) != 1 {
+		t.Fatalf("expected one run, got %+v", runs)
+	}
+	run := runs[0]
+	if run.LockID != "lock-1" || run.Who != "alice@ci" || run.Operation != "OperationTypeApply" {
+		t.Errorf("expected the run to describe the lock, got %+v", run)
+	}
+	if run.Reads != 1 || run.Writes != 2 || run.Failures != 0 || run.Serial == nil || *run.Serial != 2 {
+		t.Errorf("expected 1 read, 2 writes and serial 2, got %+v", run)
+	}
+	if run.Outcome != RunSucceeded || run.Finished == nil {
+		t.Errorf("expected a succeeded run, got %+v", run)
+	}
+	if runs := getRuns(t, handler, "other"); len(runs) != 0 {
+		t.Errorf("expected no runs of an unlocked state, got %+v", runs)
+	}
+}
+
+func TestRuns_Outcomes(t *testing.T) {
+	handler, _ := newTestHandler()
+	handler.runs = NewRunLog(DefaultRunHistory)
+	postState(t, handler, `{"version":4,"serial":5,"lineage":"abc"}`)
+
+	// A rejected last write fails the run
+	serveAs(handler, "LOCK", "/network", "", `{"ID":"lock-1"}`)
+	if w := serveAs(handler, http.MethodPost, "/network?ID=lock-1", "", `{"version":4,"serial":1,"lineage":"abc"}`); w.Code != http.StatusConflict {
+		t.Fatalf("expected status 409, got %d", w.Code)
+	}
+	serveAs(handler, "UNLOCK", "/network", "", `{"ID":"lock-1"}`)
+
+	// Unlocking without the ID is a force unlock
+	serveAs(handler, "LOCK", "/network", "", `{"ID":"lock-2"}`)
+	serveAs(handler, "UNLOCK", "/network", "", `{}`)
+
+	runs := getRuns(t, handler, "network")
+	if len(runs) != 2 {
+		t.Fatalf("expected two runs, got %+v", runs)
+	}
+	if runs[0].LockID != "lock-2" || runs[0].Outcome != RunForceUnlocked {
+		t.Errorf("expected the latest run to be force-unlocked, got %+v", runs[0])
+	}
+	if runs[1].LockID != "lock-1" || runs[1].Outcome != RunFailed || runs[1].Failures != 1 {
+		t.Errorf("expected the first run to have failed, got %+v", runs[1])
+	}
+}
+
+func TestRuns_Transfer(t *testing.T) {
+	handler, _ := newTestHandler()
+	handler.runs = NewRunLog(DefaultRunHistory)
+	serveAs(handler, "LOCK", "/network", "", `{"ID":"lock-plan"}`)
+
+	if w := requestTransfer(handler, "network", "lock-plan", LockInfo{ID: "lock-apply"}); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
+	runs := getRuns(t, handler, "network")
+	if len(runs) != 2 || runs[0].LockID != "lock-apply" || runs[0].Outcome != RunRunning || runs[1].Outcome != RunTransferred {
+		t.Errorf("expected the transfer to end one run and start another, got %+v", runs)
+	}
+}
+
+func TestRunLog_Limit(t *testing.T) {
+	log := NewRunLog(2)
+	for _, id := range []string{"a", "b", "c"} {
+		log.Start("network", LockInfo{ID: id})
+		log.Finish("network", "")
+	}
+	runs := log.Runs("network")
+	if len(runs) != 2 || runs[0].LockID != "c" || runs[1].LockID != "b" {
+		t.Errorf("expected the two latest runs, latest first, got %+v", runs)
+	}
+
+	var disabled *RunLog
+	disabled.Start("network", LockInfo{ID: "a"})
+	if runs := disabled.Runs("network"); runs == nil || len(runs) != 0 {
+		t.Errorf("expected an empty list without a run log, got %v", runs)
+	}
+}
+
+func TestRuns_ApplyWithoutWrite(t *testing.T) {
+	handler, _ := newTestHandler()
+	handler.runs = NewRunLog(DefaultRunHistory)
+	notifier, events := newTestNotifier(t)
+	handler.notifier = notifier
+
+	run := func(lock string, write bool) {
+		serveAs(handler, "LOCK", "/network", "", lock)
+		if write {
+			serveAs(handler, http.MethodPost, "/network?ID=lock-apply", "", `{"version":4,"serial":1,"lineage":"abc"}`)
+		}
+		serveAs(handler, "UNLOCK", "/network", "", lock)
+	}
+	// A plan that writes nothing is not flagged, nor is an apply that wrote
+	run(`{"ID":"lock-plan","Who":"alice@ci","Operation":"OperationTypePlan"}`, false)
+	run(`{"ID":"lock-apply","Who":"alice@ci","Operation":"OperationTypeApply"}`, true)
+	run(`{"ID":"lock-failed","Who":"alice@ci","Operation":"OperationTypeApply"}`, false)
+
+	runs := getRuns(t, handler, "network")
+	if len(runs) != 3 || !runs[0].ApplyWithoutWrite || runs[1].ApplyWithoutWrite || runs[2].ApplyWithoutWrite {
+		t.Fatalf("expected only the apply without writes to be flagged, got %+v", runs)
+	}
+
+	for {
+		event := waitForEvent(t, events)
+		if event.Type != EventApplyWithoutWrite {
+			continue
+		}
+		var flagged Run
+		data, _ := json.Marshal(event.Data)
+		if err := json.Unmarshal(data, &flagged); err != nil || flagged.LockID != "lock-failed" {
+			t.Errorf("expected the flagged run in the event, got %s", data)
+		}
+		break
+	}
+}
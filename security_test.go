@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSecurityMiddleware_Headers(t *testing.T) {
+	handler := securityMiddleware(true, DefaultHSTSMaxAge, http.HandlerFunc(handleHealth))
+
+	req := httptest.NewRequest(http.MethodGet, "/health", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	for header, expected := range map[string]string{
+		"X-Content-Type-Options": "nosniff",
+		"X-Frame-Options":        "DENY",
+		"Referrer-Policy":        "no-referrer",
+	} {
+		if got := w.Header().Get(header); got != expected {
+			t.Errorf("expected %s %q, got %q", header, expected, got)
+		}
+	}
+	if got := w.Header().Get("Strict-Transport-Security"); got != "" {
+		t.Errorf("expected no HSTS over plain HTTP, got %q", got)
+	}
+
+	req.Header.Set("X-Forwarded-Proto", "https")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if got := w.Header().Get("Strict-Transport-Security"); got != "max-age=31536000" {
+		t.Errorf("expected HSTS behind a TLS proxy, got %q", got)
+	}
+}
+
+func TestSecurityMiddleware_Disabled(t *testing.T) {
+	handler := securityMiddleware(false, time.Hour, http.HandlerFunc(handleHealth))
+
+	req := httptest.NewRequest(http.MethodGet, "/health", nil)
+	req.Header.Set("X-Forwarded-Proto", "https")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if got := w.Header().Get("X-Frame-Options"); got != "" {
+		t.Errorf("expected no security headers, got X-Frame-Options %q", got)
+	}
+	if got := w.Header().Get("Strict-Transport-Security"); got != "" {
+		t.Errorf("expected no HSTS, got %q", got)
+	}
+}
+
+func TestSecurityMiddleware_RejectsTrace(t *testing.T) {
+	handler := securityMiddleware(false, 0, http.HandlerFunc(handleHealth))
+
+	for _, method := range []string{http.MethodTrace, "TRACK"} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(method, "/health", nil))
+		if w.Code != http.StatusMethodNotAllowed {
+			t.Errorf("%s: expected status 405, got %d", method, w.Code)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Limits of the shadow's work queue and of the divergences it keeps.
+const (
+	shadowQueueSize      = 256
+	shadowMaxDivergences = 100
+)
+
+// Divergence is a difference between the primary and the shadow storage.
+type Divergence struct {
+	Time   time.Time `json:"time"`
+	Name   string    `json:"name"`
+	Op     string    `json:"op"` // "write" or "read"
+	Detail string    `json:"detail"`
+}
+
+// ShadowReport summarizes the shadow's comparisons, as served by
+// GET /admin/shadow.
+type ShadowReport struct {
+	Target      string       `json:"target"`
+	Writes      int          `json:"writes"`
+	Reads       int          `json:"reads"`
+	Skipped     int          `json:"skipped"`            // Dropped because the queue was full
+	Divergences int          `json:"divergences"`        // Since startup
+	Recent      []Divergence `json:"recent_divergences"` // Latest first
+}
+
+// shadowOp is a write or read to repeat against the shadow storage.
+type shadowOp struct {
+	name    string
+	content []byte // As committed to, or read from, the primary storage
+	header  *stateHeader
+	lockID  string
+	message string
+	author  *commitAuthor // Author of the primary's commit, if not the default
+	write   bool
+}
+
+// Shadow repeats state writes against a second storage, such as another
+// branch pushed to with a different write mode, and compares the outcome
+// with the primary storage. It never affects responses: the work happens in
+// the background after the primary storage has answered, and differences are
+// only reported. This allows a new storage path to be validated with real
+// traffic before switching to it.
+type Shadow struct {
+	storage StateStorage
+	target  string // Describes the shadow storage in the report
+	queue   chan shadowOp
+
+	mu          sync.Mutex
+	writes      int
+	reads       int
+	skipped     int
+	divergences int
+	recent      []Divergence
+}
+
+// NewShadow creates a Shadow for storage. Run must be started for the
+// operations to be processed.
+func NewShadow(storage StateStorage, target string) *Shadow {
+	return &Shadow{storage: storage, target: target, queue: make(chan shadowOp, shadowQueueSize)}
+}
+
+// newShadowStorage creates the shadow storage configured in cfg: the Gitea
+// repository and branch of SHADOW_REPO and SHADOW_BRANCH, written to with
+// SHADOW_WRITE_MODE.
+func newShadowStorage(cfg *Config) (Repository, string, error) {
+	shadow := *cfg
+	shadow.GiteaOwner, shadow.GiteaRepo, shadow.GiteaBranch = cfg.ShadowOwner, cfg.ShadowRepo, cfg.ShadowBranch
+	shadow.GiteaWriteMode = cfg.ShadowWriteMode
+	if shadow.GiteaOwner != cfg.GiteaOwner || shadow.GiteaRepo != cfg.GiteaRepo {
+		shadow.GiteaGitURL = "" // Derived from the shadow repository
+	}
+	// The shadow must not share the primary's clone
+	if cfg.GiteaCloneDir != "" {
+		shadow.GiteaCloneDir = cfg.GiteaCloneDir + "-shadow"
+	} else {
+		shadow.GiteaCloneDir = filepath.Join(os.TempDir(), "gitea-tf-backend-shadow", shadow.GiteaOwner, shadow.GiteaRepo+".git")
+	}
+
+	storage, err := NewRepository(&shadow)
+	if err != nil {
+		return nil, "", err
+	}
+	return storage, fmt.Sprintf("%s/%s@%s (%s)", shadow.GiteaOwner, shadow.GiteaRepo, shadow.GiteaBranch, shadow.GiteaWriteMode), nil
+}
+
+// Write queues a state write committed to the primary storage to be
+// repeated against the shadow. It is safe to call on a nil shadow.
+func (s *Shadow) Write(name string, content []byte, header *stateHeader, lockID, message string, author *commitAuthor) {
+	s.enqueue(shadowOp{name: name, content: content, header: header, lockID: lockID, message: message, author: author, write: true})
+}
+
+// Read queues a comparison of a state read from the primary storage with
+// the shadow's copy. It is safe to call on a nil shadow.
+func (s *Shadow) Read(name string, content []byte) {
+	s.enqueue(shadowOp{name: name, content: content})
+}
+
+// enqueue adds op to the queue, or drops it when the shadow falls behind
+// rather than slowing down requests.
+func (s *Shadow) enqueue(op shadowOp) {
+	if s == nil {
+		return
+	}
+	select {
+	case s.queue <- op:
+	default:
+		s.mu.Lock()
+		s.skipped++
+		s.mu.Unlock()
+	}
+}
+
+// Run processes queued operations in order until ctx is done.
+func (s *Shadow) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case op := <-s.queue:
+			s.process(ctx, op)
+		}
+	}
+}
+
+// process repeats op against the shadow storage and records any divergence.
+func (s *Shadow) process(ctx context.Context, op shadowOp) {
+	opName := "read"
+	if op.write {
+		opName = "write"
+	}
+	diverge := func(format string, args ...any) {
+		s.record(Divergence{Time: time.Now().UTC(), Name: op.name, Op: opName, Detail: fmt.Sprintf(format, args...)})
+	}
+
+	content, current, err := loadState(ctx, s.storage, op.name)
+	if err != nil {
+		diverge("reading the shadow failed: %v", err)
+		return
+	}
+
+	if op.write {
+		writeCtx := ctx
+		if op.author != nil {
+			writeCtx = withCommitAuthor(ctx, *op.author)
+		}
+		if err := saveStateTo(writeCtx, s.storage, op.name, op.content, op.header, op.lockID, current, op.message); err != nil {
+			diverge("the primary committed the write, the shadow failed: %v", err)
+			return
+		}
+		content, _, err = loadState(ctx, s.storage, op.name)
+		if err != nil {
+			diverge("reading back the shadow failed: %v", err)
+			return
+		}
+	}
+
+	s.mu.Lock()
+	if op.write {
+		s.writes++
+	} else {
+		s.reads++
+	}
+	s.mu.Unlock()
+
+	switch {
+	case content == nil:
+		diverge("the state is missing from the shadow")
+	case !bytes.Equal(content, op.content):
+		diverge("contents differ: primary %s (%d bytes), shadow %s (%d bytes)", shortHash(op.content), len(op.content), shortHash(content), len(content))
+	}
+}
+
+// record adds d to the report.
+func (s *Shadow) record(d Divergence) {
+	slog.Warn("Shadow divergence", "state", d.Name, "operation", d.Op, "detail", d.Detail)
+	IncrementShadowDivergences(d.Op)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.divergences++
+	s.recent = append(s.recent, d)
+	if len(s.recent) > shadowMaxDivergences {
+		s.recent = s.recent[len(s.recent)-shadowMaxDivergences:]
+	}
+}
+
+// Report returns the divergence report.
+func (s *Shadow) Report() ShadowReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	report := ShadowReport{
+		Target:      s.target,
+		Writes:      s.writes,
+		Reads:       s.reads,
+		Skipped:     s.skipped,
+		Divergences: s.divergences,
+		Recent:      make([]Divergence, 0, len(s.recent)),
+	}
+	for i := len(s.recent) - 1; i >= 0; i-- {
+		report.Recent = append(report.Recent, s.recent[i])
+	}
+	return report
+}
+
+// ServeHTTP serves the divergence report at GET /admin/shadow.
+func (s *Shadow) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(s.Report())
+}
+
+// shortHash abbreviates the SHA-256 of content for divergence details.
+func shortHash(content []byte) string {
+	sum := sha256.Sum256(content)
+	return "sha256:" + hex.EncodeToString(sum[:6])
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// drainShadow processes the queued shadow operations.
+func drainShadow(s *Shadow) {
+	for {
+		select {
+		case op := <-s.queue:
+			s.process(context.Background(), op)
+		default:
+			return
+		}
+	}
+}
+
+// failingStorage fails every write.
+type failingStorage struct{ *MockStorage }
+
+func (f failingStorage) CreateOrUpdateFile(context.Context, string, []byte, string) error {
+	return errors.New("push rejected")
+}
+
+func TestShadow_MatchingWrites(t *testing.T) {
+	handler, _ := newTestHandler()
+	shadowStorage := NewMockStorage()
+	handler.shadow = NewShadow(shadowStorage, "test")
+
+	state := `{"version":4,"serial":1,"lineage":"abc"}`
+	if w := serveAs(handler, http.MethodPost, "/myproject", "", state); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+	serve(handler, http.MethodGet, "/myproject")
+	drainShadow(handler.shadow)
+
+	if content := shadowStorage.files[statePath("myproject")]; content == nil {
+		t.Error("expected the write to be repeated against the shadow")
+	}
+	report := handler.shadow.Report()
+	if report.Writes != 1 || report.Reads != 1 || report.Divergences != 0 {
+		t.Errorf("unexpected report %+v", report)
+	}
+}
+
+func TestShadow_ReportsDivergences(t *testing.T) {
+	handler, storage := newTestHandler()
+	handler.shadow = NewShadow(failingStorage{NewMockStorage()}, "test")
+	before := testutil.ToFloat64(shadowDivergencesTotal.WithLabelValues("write"))
+
+	state := `{"version":4,"serial":1,"lineage":"abc"}`
+	if w := serveAs(handler, http.MethodPost, "/myproject", "", state); w.Code != http.StatusOK {
+		t.Fatalf("expected the response to be unaffected by the shadow, got %d", w.Code)
+	}
+	if storage.files[statePath("myproject")] == nil {
+		t.Fatal("expected the state in the primary storage")
+	}
+	drainShadow(handler.shadow)
+
+	report := handler.shadow.Report()
+	if report.Divergences != 1 || report.Recent[0].Op != "write" || !strings.Contains(report.Recent[0].Detail, "push rejected") {
+		t.Errorf("expected a write divergence, got %+v", report)
+	}
+	if after := testutil.ToFloat64(shadowDivergencesTotal.WithLabelValues("write")); after != before+1 {
+		t.Errorf("expected the divergence to be counted, got %v", after-before)
+	}
+
+	// Reads of a state the shadow lacks diverge as well
+	serve(handler, http.MethodGet, "/myproject")
+	drainShadow(handler.shadow)
+	w := serve(handler.shadow, http.MethodGet, "/admin/shadow")
+	var served ShadowReport
+	if err := json.Unmarshal(w.Body.Bytes(), &served); err != nil {
+		t.Fatalf("expected a JSON report: %v", err)
+	}
+	if served.Divergences != 2 || served.Recent[0].Op != "read" {
+		t.Errorf("expected the read divergence first, got %+v", served)
+	}
+}
+
+func TestShadow_DropsWhenFull(t *testing.T) {
+	s := NewShadow(NewMockStorage(), "test")
+	for range shadowQueueSize + 3 {
+		s.Read("myproject", nil)
+	}
+	if report := s.Report(); report.Skipped != 3 {
+		t.Errorf("expected 3 skipped operations, got %d", report.Skipped)
+	}
+}
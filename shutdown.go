@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default time shutdown waits, beyond its grace period, for commits of
+// protected states to finish.
+const DefaultProtectedWriteDrain = 2 * time.Minute
+
+// matchesStatePattern reports whether the named state matches pattern. A
+// pattern ending in "*" matches every state name with that prefix; otherwise
+// it matches a single state.
+func matchesStatePattern(pattern, name string) bool {
+	if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+		return strings.HasPrefix(name, prefix)
+	}
+	return name == pattern
+}
+
+// parseStatePatterns parses a comma-separated list of state name patterns.
+func parseStatePatterns(s string) []string {
+	var patterns []string
+	for _, pattern := range strings.Split(s, ",") {
+		if pattern = strings.Trim(strings.TrimSpace(pattern), "/"); pattern != "" {
+			patterns = append(patterns, pattern)
+		}
+	}
+	return patterns
+}
+
+// CommitWindow tracks the commits of protected states in progress, so that
+// shutdown does not abort a production state push halfway through.
+type CommitWindow struct {
+	patterns []string
+
+	mu     sync.Mutex
+	active map[string]int // Commits in progress, keyed by state name
+	idle   chan struct{}  // Closed when the last commit in progress finishes
+}
+
+// NewCommitWindow creates a CommitWindow for the states matching patterns.
+func NewCommitWindow(patterns []string) *CommitWindow {
+	return &CommitWindow{patterns: patterns, active: make(map[string]int)}
+}
+
+// Enter records a commit of the named state starting, if the state is
+// protected, and returns the function recording its end. A nil CommitWindow
+// protects no states.
+func (c *CommitWindow) Enter(name string) func() {
+	if c == nil || !slices.ContainsFunc(c.patterns, func(p string) bool { return matchesStatePattern(p, name) }) {
+		return func() {}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.active) == 0 {
+		c.idle = make(chan struct{})
+	}
+	c.active[name]++
+	return func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.active[name]--; c.active[name] == 0 {
+			delete(c.active, name)
+		}
+		if len(c.active) == 0 {
+			close(c.idle)
+		}
+	}
+}
+
+// Active returns the protected states being committed, sorted by name.
+func (c *CommitWindow) Active() []string {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	names := make([]string, 0, len(c.active))
+	for name := range c.active {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// Drain waits up to limit for the protected states' commits in progress to
+// finish, and reports whether they did. Further shutdown signals on quit are
+// refused meanwhile, as are the orchestrator's, until it resorts to SIGKILL.
+func (c *CommitWindow) Drain(limit time.Duration, quit <-chan os.Signal) bool {
+	active := c.Active()
+	if len(active) == 0 {
+		return true
+	}
+	slog.Warn("Shutdown is waiting for the commits of protected states; stopping now could leave them half-written", "states", active, "limit", limit)
+
+	c.mu.Lock()
+	idle := c.idle
+	c.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), limit)
+	defer cancel()
+	for {
+		select {
+		case <-idle:
+			slog.Info("Commits of protected states finished")
+			return true
+		case sig := <-quit:
+			slog.Warn("Refusing a signal while committing protected states", "signal", sig.String(), "states", c.Active())
+		case <-ctx.Done():
+			slog.Error("Gave up waiting for the commits of protected states; they may need to be checked", "states", c.Active())
+			return false
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"os"
+	"slices"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestCommitWindow_OnlyTracksProtectedStates(t *testing.T) {
+	window := NewCommitWindow(parseStatePatterns("prod/*, billing"))
+
+	exitProd := window.Enter("prod/network")
+	exitDev := window.Enter("dev/network")
+	exitBilling := window.Enter("billing")
+	if active := window.Active(); !slices.Equal(active, []string{"billing", "prod/network"}) {
+		t.Errorf("expected the protected states to be active, got %v", active)
+	}
+
+	exitProd()
+	exitDev()
+	exitBilling()
+	if active := window.Active(); len(active) != 0 {
+		t.Errorf("expected no active commits, got %v", active)
+	}
+
+	var unprotected *CommitWindow
+	unprotected.Enter("prod/network")()
+	if !unprotected.Drain(time.Second, nil) {
+		t.Error("expected a nil window to drain immediately")
+	}
+}
+
+func TestCommitWindow_DrainWaitsAndRefusesSignals(t *testing.T) {
+	window := NewCommitWindow([]string{"prod/*"})
+	exit := window.Enter("prod/network")
+
+	quit := make(chan os.Signal, 1)
+	quit <- syscall.SIGTERM
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		exit()
+	}()
+	if !window.Drain(5*time.Second, quit) {
+		t.Fatal("expected the drain to wait for the commit")
+	}
+	if len(quit) != 0 {
+		t.Error("expected the signal to be consumed while draining")
+	}
+}
+
+func TestCommitWindow_DrainIsBounded(t *testing.T) {
+	window := NewCommitWindow([]string{"prod/network"})
+	defer window.Enter("prod/network")()
+
+	start := time.Now()
+	if window.Drain(20*time.Millisecond, nil) {
+		t.Error("expected the drain to give up")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the drain to stop after its limit, took %v", elapsed)
+	}
+}
+
+// observedStorage calls observe before each write.
+type observedStorage struct {
+	*MockStorage
+	observe func()
+}
+
+func (o observedStorage) CreateOrUpdateFile(ctx context.Context, path string, content []byte, message string) error {
+	o.observe()
+	return o.MockStorage.CreateOrUpdateFile(ctx, path, content, message)
+}
+
+func TestSaveState_EntersCommitWindow(t *testing.T) {
+	window := NewCommitWindow([]string{"network"})
+	var during []string
+	handler := NewStateHandler(observedStorage{NewMockStorage(), func() { during = window.Active() }}, DefaultMaxBodySize)
+	handler.commits = window
+
+	postState(t, handler, `{"version":4,"serial":1,"lineage":"abc"}`)
+
+	if !slices.Equal(during, []string{"network"}) {
+		t.Errorf("expected the commit to be in the window, got %v", during)
+	}
+	if active := window.Active(); len(active) != 0 {
+		t.Errorf("expected the window to be left after the commit, got %v", active)
+	}
+}
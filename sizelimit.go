@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SizeLimit is a request body size limit for the states matching Pattern.
+// A pattern ending in "*" matches every state name with that prefix;
+// otherwise it matches a single state.
+type SizeLimit struct {
+	Pattern string
+	Bytes   int64
+}
+
+// matches reports whether the limit applies to the named state.
+func (l SizeLimit) matches(name string) bool {
+	return matchesStatePattern(l.Pattern, name)
+}
+
+// parseSizeLimits parses a comma-separated list of pattern=megabytes pairs,
+// e.g. "data-platform/*=200,legacy=100". The result is ordered most specific
+// (longest pattern) first.
+func parseSizeLimits(s string) ([]SizeLimit, error) {
+	var limits []SizeLimit
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		pattern, mb, ok := strings.Cut(entry, "=")
+		pattern = strings.Trim(strings.TrimSpace(pattern), "/")
+		if !ok || pattern == "" {
+			return nil, fmt.Errorf("invalid entry %q, expected <pattern>=<megabytes>", entry)
+		}
+		n, err := strconv.ParseInt(strings.TrimSpace(mb), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("limit for %s must be a valid integer: %w", pattern, err)
+		}
+		if n <= 0 {
+			return nil, fmt.Errorf("limit for %s must be positive", pattern)
+		}
+		limits = append(limits, SizeLimit{Pattern: pattern, Bytes: n << 20})
+	}
+
+	sort.SliceStable(limits, func(i, j int) bool {
+		return len(limits[i].Pattern) > len(limits[j].Pattern)
+	})
+	return limits, nil
+}
+
+// bodyLimit returns the body size limit for the named state and the pattern
+// that set it, or "" if the default applies.
+func (h *StateHandler) bodyLimit(name string) (int64, string) {
+	for _, limit := range h.sizeLimits {
+		if limit.matches(name) {
+			return limit.Bytes, limit.Pattern
+		}
+	}
+	return h.maxBodySize, ""
+}
+
+// Default share of a state's size limit above which writes are warned about.
+const DefaultSizeWarnPercent = 80
+
+// warnSize warns when a state write of size bytes comes close to the state's
+// size limit: the response gets a Warning header, and the first such write
+// since the state was last below the threshold is announced to the notifier.
+func (h *StateHandler) warnSize(w http.ResponseWriter, name string, size int64) {
+	if h.sizeWarnPercent == 0 {
+		return
+	}
+	limit, pattern := h.bodyLimit(name)
+	percent := size * 100 / limit
+	if percent < int64(h.sizeWarnPercent) {
+		h.mu.Lock()
+		delete(h.sizeWarned, name)
+		h.mu.Unlock()
+		return
+	}
+
+	message := fmt.Sprintf("state %s uses %d%% of its size limit of %d bytes", name, percent, limit)
+	w.Header().Add("Warning", fmt.Sprintf("299 gitea-tf-backend %q", message))
+
+	h.mu.Lock()
+	warned := h.sizeWarned[name]
+	h.sizeWarned[name] = true
+	h.mu.Unlock()
+	if !warned {
+		slog.Warn("State is near its size limit", "state", name, "percent", percent, "limit", limit)
+		h.notifier.Notify(EventStateSizeWarning, name, fmt.Sprintf("State %s uses %d%% of its size limit.", name, percent),
+			map[string]any{"size_bytes": size, "max_body_bytes": limit, "limit_pattern": pattern, "percent": percent})
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSizeLimits(t *testing.T) {
+	limits, err := parseSizeLimits("data-platform/*=200, data-platform/huge=500,legacy=1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []SizeLimit{
+		{Pattern: "data-platform/huge", Bytes: 500 << 20},
+		{Pattern: "data-platform/*", Bytes: 200 << 20},
+		{Pattern: "legacy", Bytes: 1 << 20},
+	}
+	if len(limits) != len(expected) {
+		t.Fatalf("expected %d limits, got %d", len(expected), len(limits))
+	}
+	for i := range expected {
+		if limits[i] != expected[i] {
+			t.Errorf("limit %d: expected %+v, got %+v", i, expected[i], limits[i])
+		}
+	}
+
+	for _, invalid := range []string{"data-platform/*", "=5", "legacy=big", "legacy=0"} {
+		if _, err := parseSizeLimits(invalid); err == nil {
+			t.Errorf("expected error for %q", invalid)
+		}
+	}
+}
+
+func TestBodyLimit(t *testing.T) {
+	handler, _ := newTestHandler()
+	handler.sizeLimits, _ = parseSizeLimits("data-platform/*=200,data-platform/huge=500")
+
+	tests := []struct {
+		name    string
+		limit   int64
+		pattern string
+	}{
+		{"myproject", DefaultMaxBodySize, ""},
+		{"data-platform/lake", 200 << 20, "data-platform/*"},
+		{"data-platform/huge", 500 << 20, "data-platform/huge"},
+		{"data-platform-other", DefaultMaxBodySize, ""},
+	}
+
+	for _, tt := range tests {
+		limit, pattern := handler.bodyLimit(tt.name)
+		if limit != tt.limit || pattern != tt.pattern {
+			t.Errorf("bodyLimit(%q) = %d, %q; want %d, %q", tt.name, limit, pattern, tt.limit, tt.pattern)
+		}
+	}
+}
+
+func TestPostState_PrefixLimit(t *testing.T) {
+	handler := NewStateHandler(NewMockStorage(), DefaultMaxBodySize)
+	handler.sizeLimits = []SizeLimit{{Pattern: "tiny/*", Bytes: 16}}
+
+	state := []byte(`{"version":4,"serial":1,"lineage":"abc"}`)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/tiny/app", bytes.NewReader(state)))
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected status 413, got %d", w.Code)
+	}
+	var resp map[string]any
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("expected JSON error body: %v", err)
+	}
+	if resp["limit_pattern"] != "tiny/*" || resp["max_body_bytes"] != float64(16) {
+		t.Errorf("expected limit of 16 bytes for tiny/*, got %v", resp)
+	}
+
+	// Other states keep the default limit
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/other", bytes.NewReader(state)))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status 200, got %d", w.Code)
+	}
+}
+
+func TestPostState_SizeWarning(t *testing.T) {
+	handler := NewStateHandler(NewMockStorage(), DefaultMaxBodySize)
+	handler.sizeLimits = []SizeLimit{{Pattern: "tiny/*", Bytes: 48}}
+	handler.sizeWarnPercent = 80
+	notifier, events := newTestNotifier(t)
+	handler.notifier = notifier
+
+	post := func(name string, serial int) *httptest.ResponseRecorder {
+		state := fmt.Sprintf(`{"version":4,"serial":%d,"lineage":"abc"}`, serial)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/"+name, strings.NewReader(state)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+		return w
+	}
+
+	// 40 of 48 bytes
+	if w := post("tiny/app", 1); !strings.Contains(w.Header().Get("Warning"), "83% of its size limit") {
+		t.Errorf("expected a size warning, got %q", w.Header().Get("Warning"))
+	}
+	var warnings int
+	for range 2 {
+		if event := waitForEvent(t, events); event.Type == EventStateSizeWarning {
+			warnings++
+		}
+	}
+	if warnings != 1 {
+		t.Errorf("expected 1 size warning event, got %d", warnings)
+	}
+
+	// Further writes above the threshold are not announced again
+	if w := post("tiny/app", 2); w.Header().Get("Warning") == "" {
+		t.Error("expected a size warning")
+	}
+	if event := waitForEvent(t, events); event.Type != EventStateUpdated {
+		t.Errorf("expected %s, got %s", EventStateUpdated, event.Type)
+	}
+	select {
+	case event := <-events:
+		t.Errorf("unexpected event %s", event.Type)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// States well within their limit get no warning
+	if w := post("other", 1); w.Header().Get("Warning") != "" {
+		t.Errorf("expected no size warning, got %q", w.Header().Get("Warning"))
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// StateMutex serializes the requests changing each state within the
+// process. A write checks the lock before it commits the state; without it,
+// an UNLOCK, and a LOCK by someone else, could slip in between, and the write
+// of a holder that no longer holds the lock would land after it.
+type StateMutex struct {
+	mu    sync.Mutex
+	slots map[string]*stateSlot // keyed by state name; dropped when unused
+}
+
+// stateSlot is the mutex of one state, as a channel so that waiting for it
+// can be given up.
+type stateSlot struct {
+	held  chan struct{}
+	users int // Holders and waiters, guarded by StateMutex.mu
+}
+
+// NewStateMutex creates a StateMutex.
+func NewStateMutex() *StateMutex {
+	return &StateMutex{slots: make(map[string]*stateSlot)}
+}
+
+// Lock waits until no other request holds the named state, or ctx is done,
+// and returns the function releasing it, which may be called more than once.
+func (m *StateMutex) Lock(ctx context.Context, name string) (func(), error) {
+	m.mu.Lock()
+	slot, ok := m.slots[name]
+	if !ok {
+		slot = &stateSlot{held: make(chan struct{}, 1)}
+		m.slots[name] = slot
+	}
+	slot.users++
+	m.mu.Unlock()
+
+	select {
+	case slot.held <- struct{}{}:
+		var once sync.Once
+		return func() {
+			once.Do(func() {
+				<-slot.held
+				m.leave(name, slot)
+			})
+		}, nil
+	case <-ctx.Done():
+		m.leave(name, slot)
+		return nil, ctx.Err()
+	}
+}
+
+// leave drops a holder or waiter of the named state's slot.
+func (m *StateMutex) leave(name string, slot *stateSlot) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if slot.users--; slot.users == 0 {
+		delete(m.slots, name)
+	}
+}
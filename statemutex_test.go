@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestStateMutex_SerializesEachState(t *testing.T) {
+	m := NewStateMutex()
+	release, err := m.Lock(context.Background(), "network")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Other states go ahead
+	other, err := m.Lock(context.Background(), "dns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := m.Lock(ctx, "network"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the second holder to wait, got %v", err)
+	}
+
+	release()
+	release() // Releasing twice is harmless
+	next, err := m.Lock(context.Background(), "network")
+	if err != nil {
+		t.Fatal(err)
+	}
+	next()
+	if len(m.slots) != 0 {
+		t.Errorf("expected unused states to be dropped, got %d", len(m.slots))
+	}
+}
+
+// gatedWriteStorage holds writes until release is closed.
+type gatedWriteStorage struct {
+	*MockStorage
+	writing chan struct{}
+	release chan struct{}
+}
+
+func (s *gatedWriteStorage) CreateOrUpdateFile(ctx context.Context, path string, content []byte, message string) error {
+	if path == statePath("network") {
+		close(s.writing)
+		<-s.release
+	}
+	return s.MockStorage.CreateOrUpdateFile(ctx, path, content, message)
+}
+
+func TestStateHandler_UnlockWaitsForWrite(t *testing.T) {
+	storage := &gatedWriteStorage{MockStorage: NewMockStorage(), writing: make(chan struct{}), release: make(chan struct{})}
+	handler := NewStateHandler(storage, DefaultMaxBodySize)
+	if w := serveAs(handler, "LOCK", "/network", "", `{"ID":"lock-1","Operation":"OperationTypeApply"}`); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
+	written := make(chan int, 1)
+	go func() {
+		written <- serveAs(handler, http.MethodPost, "/network?ID=lock-1", "", `{"version":4,"serial":1,"lineage":"abc"}`).Code
+	}()
+	<-storage.writing
+
+	unlocked := make(chan int, 1)
+	go func() {
+		unlocked <- serveAs(handler, "UNLOCK", "/network", "", `{"ID":"lock-1"}`).Code
+	}()
+	select {
+	case <-unlocked:
+		t.Fatal("expected the unlock to wait for the write in flight")
+	case <-time.After(20 * time.Millisecond):
+	}
+	if !handler.IsLocked("network") {
+		t.Fatal("expected the lock to be held until the write is committed")
+	}
+
+	close(storage.release)
+	if code := <-written; code != http.StatusOK {
+		t.Errorf("expected the write to succeed, got %d", code)
+	}
+	if code := <-unlocked; code != http.StatusOK {
+		t.Errorf("expected the unlock to succeed, got %d", code)
+	}
+}
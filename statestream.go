@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// A state pushed to a storage that commits streams is not read into memory
+// before it is committed. Its header is parsed from the beginning of the
+// body, which is all the checks before the commit need, and the rest is
+// validated, indented and hashed on its way to storage; a body that turns
+// out to be invalid aborts the commit. The body is read whole as before when
+// the write needs the whole state, such as to compress, chunk, spool, shadow
+// or index it, or when its header is not at its beginning.
+
+// maxStreamedHeader is how far into a state body its header is looked for.
+// Terraform writes the header fields first.
+const maxStreamedHeader = 64 << 10
+
+var (
+	// errHeaderNotFound stops looking for the header of a body to be streamed.
+	errHeaderNotFound = errors.New("state header not found at the beginning of the body")
+	// errStreamSent is returned when a streamed state would be sent twice.
+	errStreamSent = errors.New("the state was streamed from the request body and cannot be sent again")
+)
+
+// stateStream is a state body committed as it is read.
+type stateStream struct {
+	body      *requestBody
+	read      *readRecorder
+	dec       *json.Decoder
+	tee       *streamTee
+	header    *stateHeader
+	committer StreamCommitter
+
+	started atomic.Bool
+	done    chan struct{} // Closed once the body is no longer read
+
+	// Set while the state is streamed, to be read once it no longer is
+	size     int
+	sum      hash.Hash
+	invalid  error // The body is not a JSON document
+	rejected error // The body does not match its digests
+}
+
+// readRecorder records what reading r failed with, and the time spent waiting
+// for it.
+type readRecorder struct {
+	r     io.Reader
+	err   error
+	spent time.Duration
+}
+
+func (r *readRecorder) Read(p []byte) (int, error) {
+	start := time.Now()
+	n, err := r.r.Read(p)
+	r.spent += time.Since(start)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
+
+// streamTee receives the bytes of a body as they are decoded: they are kept
+// while its header is looked for, and passed on once it is streamed.
+type streamTee struct {
+	kept []byte
+	to   io.Writer
+}
+
+func (t *streamTee) Write(p []byte) (int, error) {
+	if t.to != nil {
+		return t.to.Write(p)
+	}
+	t.kept = append(t.kept, p...)
+	if len(t.kept) > maxStreamedHeader {
+		return len(p), errHeaderNotFound
+	}
+	return len(p), nil
+}
+
+// openStateStream reads the beginning of body for the state's header. If it
+// is not found there, or is not valid, the stream has no header, and the
+// bytes read are kept to be read again with the rest of the body. The error
+// returned is the one reading the body failed with.
+func openStateStream(body *requestBody, committer StreamCommitter) (*stateStream, error) {
+	s := &stateStream{
+		body:      body,
+		read:      &readRecorder{r: body.Reader},
+		tee:       &streamTee{},
+		committer: committer,
+		done:      make(chan struct{}),
+		sum:       sha256.New(),
+	}
+	s.dec = json.NewDecoder(io.TeeReader(s.read, s.tee))
+	s.header = s.readHeader()
+	if s.read.err != nil {
+		return nil, s.read.err
+	}
+	return s, nil
+}
+
+// readHeader reads the state up to the last of its header fields, and returns
+// them. It returns nil if they are not all found or are not valid.
+func (s *stateStream) readHeader() *stateHeader {
+	if token, err := s.dec.Token(); err != nil || token != json.Delim('{') {
+		return nil
+	}
+	var fields headerFields
+	for s.dec.More() {
+		key, err := s.dec.Token()
+		if err != nil {
+			return nil
+		}
+		switch key {
+		case "version":
+			err = s.dec.Decode(&fields.Version)
+		case "terraform_version":
+			err = s.dec.Decode(&fields.TerraformVersion)
+		case "serial":
+			err = s.dec.Decode(&fields.Serial)
+		case "lineage":
+			err = s.dec.Decode(&fields.Lineage)
+		default:
+			err = skipValue(s.dec)
+		}
+		if err != nil {
+			return nil
+		}
+		if fields.Version != nil && fields.TerraformVersion != nil && fields.Serial != nil && fields.Lineage != nil {
+			header, err := fields.header()
+			if err != nil {
+				return nil
+			}
+			return header
+		}
+	}
+	return nil
+}
+
+// unread returns the body as it was before its header was looked for.
+func (s *stateStream) unread() io.Reader {
+	return io.MultiReader(bytes.NewReader(s.tee.kept), s.body.Reader)
+}
+
+// skipValue reads past the next value of dec without keeping it.
+func skipValue(dec *json.Decoder) error {
+	depth := 0
+	for {
+		token, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		switch token {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+		if depth == 0 {
+			return nil
+		}
+	}
+}
+
+// writeTo writes the state to w, indented, as the rest of the body is read.
+// The body can only be read once, so a second call fails with errStreamSent.
+func (s *stateStream) writeTo(w io.Writer) error {
+	if !s.started.CompareAndSwap(false, true) {
+		return errStreamSent
+	}
+	defer close(s.done)
+	indenter := &stateIndenter{w: io.MultiWriter(s.sum, w)}
+	err := s.stream(indenter)
+	s.size = indenter.size
+	switch {
+	case err == nil, s.read.err != nil, indenter.err != nil:
+		// Failures reading the body, or sending the state, are reported as such
+	case errors.Is(err, ErrChecksumMismatch):
+		s.rejected = err
+	default:
+		s.invalid = fmt.Errorf("state is not a JSON object: %w", err)
+	}
+	return err
+}
+
+// stream decodes the rest of the state, passing the bytes decoded to
+// indenter, and checks the body against its digests.
+func (s *stateStream) stream(indenter *stateIndenter) error {
+	start, waited := time.Now(), s.read.spent
+	defer func() {
+		ObserveProcessingDuration("json", time.Since(start)-(s.read.spent-waited)-indenter.spent)
+	}()
+	if _, err := indenter.Write(s.tee.kept); err != nil {
+		return err
+	}
+	s.tee.kept = nil
+	s.tee.to = indenter
+	for s.dec.More() {
+		if _, err := s.dec.Token(); err != nil {
+			return err
+		}
+		if err := skipValue(s.dec); err != nil {
+			return err
+		}
+	}
+	if _, err := s.dec.Token(); err != nil {
+		return err
+	}
+	if _, err := s.dec.Token(); err != io.EOF {
+		if err == nil {
+			err = errors.New("invalid data after top-level value")
+		}
+		return err
+	}
+	return verifyDigests(s.body.digests)
+}
+
+// wait returns once the body is no longer read: at once if it has not been
+// sent, and will no longer be, and otherwise when sending it ends.
+func (s *stateStream) wait() {
+	if s.started.CompareAndSwap(false, true) {
+		return
+	}
+	<-s.done
+}
+
+// changes returns the file changes committing the streamed state in place of
+// current, with its checksum and metadata sidecars. These are written once
+// the state has been, from what was streamed.
+func (s *stateStream) changes(name, lockID string, current *storedState) []FileChange {
+	changes := []FileChange{{Path: statePath(name), SHA: current.sha, Create: !current.exists, Stream: s.writeTo}}
+	for i := range current.chunks {
+		changes = append(changes, FileChange{Path: chunkPath(name, i)})
+	}
+	return append(changes,
+		FileChange{Path: checksumPath(name), Stream: func(w io.Writer) error {
+			_, err := fmt.Fprintf(w, "%x  terraform.tfstate\n", s.sum.Sum(nil))
+			return err
+		}},
+		FileChange{Path: metadataPath(name), Stream: func(w io.Writer) error {
+			metadata, err := json.MarshalIndent(stateMetadata{
+				Serial:           s.header.Serial,
+				Lineage:          s.header.Lineage,
+				TerraformVersion: s.header.TerraformVersion,
+				LockID:           lockID,
+				Size:             s.size,
+				Updated:          time.Now().UTC(),
+			}, "", "  ")
+			if err != nil {
+				return err
+			}
+			_, err = w.Write(metadata)
+			return err
+		}},
+	)
+}
+
+// failed answers the request if its body failed while it was streamed: it
+// could not be read, is not a valid state or does not match its digests.
+// Returns false if the body did not fail.
+func (s *stateStream) failed(w http.ResponseWriter, r *http.Request, name string) bool {
+	switch {
+	case s.read.err != nil:
+		s.body.failed(w, r, name, "state", s.read.err)
+	case s.rejected != nil:
+		slog.Warn("Rejected body", "state", name, "body", "state", "error", s.rejected)
+		writeError(w, s.rejected)
+	case s.invalid != nil:
+		writeError(w, fmt.Errorf("%w: %v", ErrInvalidState, s.invalid))
+	default:
+		return false
+	}
+	return true
+}
+
+// stateIndenter indents the JSON written to it as indentState does, as it is
+// written rather than all at once. The JSON is not checked.
+type stateIndenter struct {
+	w          io.Writer
+	buf        []byte
+	depth      int
+	inString   bool
+	escaped    bool
+	needIndent bool // An object or array was opened and its first element is yet to come
+	size       int
+	spent      time.Duration // Writing to w
+	err        error         // What writing to w failed with
+}
+
+func (x *stateIndenter) Write(p []byte) (int, error) {
+	buf := x.buf[:0]
+	for _, c := range p {
+		if x.inString {
+			buf = append(buf, c)
+			switch {
+			case x.escaped:
+				x.escaped = false
+			case c == '\\':
+				x.escaped = true
+			case c == '"':
+				x.inString = false
+			}
+			continue
+		}
+		if c == ' ' || c == '\t' || c == '\r' || c == '\n' {
+			continue
+		}
+		if x.needIndent && c != '}' && c != ']' {
+			x.needIndent = false
+			x.depth++
+			buf = x.newline(buf)
+		}
+		switch c {
+		case '{', '[':
+			x.needIndent = true
+			buf = append(buf, c)
+		case ',':
+			buf = x.newline(append(buf, c))
+		case ':':
+			buf = append(buf, ':', ' ')
+		case '}', ']':
+			if x.needIndent {
+				// Empty objects and arrays stay on one line
+				x.needIndent = false
+			} else {
+				x.depth--
+				buf = x.newline(buf)
+			}
+			buf = append(buf, c)
+		case '"':
+			x.inString = true
+			buf = append(buf, c)
+		default:
+			buf = append(buf, c)
+		}
+	}
+	x.buf = buf
+	start := time.Now()
+	n, err := x.w.Write(buf)
+	x.spent += time.Since(start)
+	x.size += n
+	if err != nil {
+		x.err = err
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// newline appends a line break and the indentation of the current depth.
+func (x *stateIndenter) newline(buf []byte) []byte {
+	buf = append(buf, '\n')
+	for range x.depth {
+		buf = append(buf, ' ', ' ')
+	}
+	return buf
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newStreamingTestHandler returns a handler over a Gitea client whose
+// multi-file commits are counted in received as the server reads them.
+func newStreamingTestHandler(t *testing.T) (*StateHandler, *GiteaClient, *atomic.Int64) {
+	t.Helper()
+	dev := NewDevGitea()
+	var received atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/testrepo/contents") {
+			r.Body = io.NopCloser(&countingReader{r: r.Body, n: &received})
+		}
+		dev.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	client, err := NewGiteaClient(&Config{
+		GiteaURL:    server.URL,
+		GiteaOwner:  "testowner",
+		GiteaRepo:   "testrepo",
+		GiteaBranch: "main",
+	})
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	return NewStateHandler(client, DefaultMaxBodySize), client, &received
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n *atomic.Int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// paddedState returns a state of about size bytes.
+func paddedState(serial, size int) string {
+	return fmt.Sprintf(`{"version":4,"terraform_version":"1.9.0","serial":%d,"lineage":"abc","outputs":{"padding":{"value":"%s","type":"string"}},"resources":[]}`,
+		serial, strings.Repeat("x", size))
+}
+
+func TestStateIndenter_MatchesIndentState(t *testing.T) {
+	for _, doc := range []string{
+		`{}`,
+		`{"a":[],"b":{},"c":[1,2,{"d":null}]}`,
+		"{\n  \"a\" : [ 1 ,\t2 ] ,\r\n\"b\":{ }\n}\n",
+		`{"s":"with \"quotes\", {braces} [brackets]: and \\ backslashes\\","t":"\u00e9 \\\""}`,
+		`{"nested":[[[{"deep":[true,false]}]]],"n":-1.5e10}`,
+	} {
+		want := string(indentState([]byte(doc)))
+		for _, chunk := range []int{1, 3, len(doc)} {
+			var got strings.Builder
+			indenter := &stateIndenter{w: &got}
+			for i := 0; i < len(doc); i += chunk {
+				if _, err := indenter.Write([]byte(doc[i:min(len(doc), i+chunk)])); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			}
+			if got.String() != want {
+				t.Errorf("%q in chunks of %d:\ngot  %q\nwant %q", doc, chunk, got.String(), want)
+			}
+			if indenter.size != len(want) {
+				t.Errorf("%q in chunks of %d: expected a size of %d, got %d", doc, chunk, len(want), indenter.size)
+			}
+		}
+	}
+}
+
+func TestHandlePost_StreamsState(t *testing.T) {
+	handler, client, received := newStreamingTestHandler(t)
+	state := paddedState(1, 4<<20)
+
+	// The body is sent in two halves; the second only once Gitea has
+	// received much of the first, which it cannot unless it is streamed
+	pr, pw := io.Pipe()
+	go func() {
+		half := len(state) / 2
+		if _, err := io.WriteString(pw, state[:half]); err != nil {
+			return
+		}
+		deadline := time.Now().Add(10 * time.Second)
+		for received.Load() < 1<<20 && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		if received.Load() < 1<<20 {
+			pw.CloseWithError(fmt.Errorf("the commit did not start before the body was sent"))
+			return
+		}
+		_, _ = io.WriteString(pw, state[half:])
+		pw.Close()
+	}()
+
+	req := httptest.NewRequest(http.MethodPost, "/streamed", pr)
+	req.ContentLength = -1
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	ctx := context.Background()
+	content, _, err := client.GetFile(ctx, statePath("streamed"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := indentState([]byte(state)); string(content) != string(want) {
+		t.Fatalf("expected the state to be committed indented, got %d bytes for %d", len(content), len(want))
+	}
+	sidecar, _, _ := client.GetFile(ctx, checksumPath("streamed"))
+	if want := stateChecksum(content) + "  terraform.tfstate\n"; string(sidecar) != want {
+		t.Errorf("expected checksum sidecar %q, got %q", want, sidecar)
+	}
+	var metadata stateMetadata
+	raw, _, _ := client.GetFile(ctx, metadataPath("streamed"))
+	if err := json.Unmarshal(raw, &metadata); err != nil {
+		t.Fatalf("invalid metadata: %v", err)
+	}
+	if metadata.Size != len(content) || metadata.Serial == nil || *metadata.Serial != 1 || metadata.Lineage != "abc" {
+		t.Errorf("unexpected metadata %+v", metadata)
+	}
+}
+
+func TestHandlePost_StreamedStateFailures(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		maxBody  int64
+		wantCode int
+		wantErr  string
+	}{
+		{
+			name:     "invalid JSON after the header",
+			body:     strings.TrimSuffix(paddedState(2, 256<<10), "}") + `,"resources":]}`,
+			wantCode: http.StatusBadRequest,
+			wantErr:  "invalid_state",
+		},
+		{
+			name:     "data after the state",
+			body:     paddedState(2, 256<<10) + `{}`,
+			wantCode: http.StatusBadRequest,
+			wantErr:  "invalid_state",
+		},
+		{
+			name:     "exceeds the size limit",
+			body:     paddedState(2, 256<<10),
+			maxBody:  128 << 10,
+			wantCode: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:     "serial regression",
+			body:     paddedState(0, 256<<10),
+			wantCode: http.StatusConflict,
+			wantErr:  "serial_regression",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler, client, _ := newStreamingTestHandler(t)
+			stored := indentState([]byte(paddedState(1, 16)))
+			if err := client.CommitFiles(context.Background(), "seed", []FileChange{{Path: statePath("failing"), Content: stored}}); err != nil {
+				t.Fatal(err)
+			}
+			if tt.maxBody > 0 {
+				handler.maxBodySize = tt.maxBody
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/failing", io.NopCloser(strings.NewReader(tt.body)))
+			req.ContentLength = -1
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			if w.Code != tt.wantCode {
+				t.Fatalf("expected status %d, got %d: %s", tt.wantCode, w.Code, w.Body.String())
+			}
+			if tt.wantErr != "" && !strings.Contains(w.Body.String(), tt.wantErr) {
+				t.Errorf("expected error %s, got %s", tt.wantErr, w.Body.String())
+			}
+			if content, _, _ := client.GetFile(context.Background(), statePath("failing")); string(content) != string(stored) {
+				t.Errorf("expected the stored state to be kept, got %d bytes", len(content))
+			}
+		})
+	}
+}
+
+func TestHandlePost_StateWithLateHeaderIsReadWhole(t *testing.T) {
+	handler, client, _ := newStreamingTestHandler(t)
+	state := fmt.Sprintf(`{"outputs":{"padding":{"value":"%s"}},"version":4,"terraform_version":"1.9.0","serial":1,"lineage":"abc"}`,
+		strings.Repeat("x", 2*maxStreamedHeader))
+
+	w := serveAs(handler, http.MethodPost, "/late", "", state)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	content, _, _ := client.GetFile(context.Background(), statePath("late"))
+	if want := indentState([]byte(state)); string(content) != string(want) {
+		t.Errorf("expected the state to be committed, got %d bytes for %d", len(content), len(want))
+	}
+}
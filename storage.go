@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+)
+
+// Storage backends selectable with STORAGE_BACKEND.
+const (
+	BackendGitea    = "gitea"
+	BackendGitHub   = "github"
+	BackendGitLab   = "gitlab"
+	BackendLocalGit = "localgit"
+)
+
+// Repository is a Git hosting service storing states in a repository.
+type Repository interface {
+	ArchiveStorage
+	RepoSizer
+	Ping() error
+	ListCommits(path string, limit int) ([]CommitInfo, error)
+	WithRepo(repo string) Repository
+	SetAuditLog(audit *AuditLog)
+}
+
+// FileChange is a single file operation in a multi-file commit.
+type FileChange struct {
+	Path    string
+	Content []byte                  // nil deletes the file; deleting a missing file is a no-op
+	SHA     string                  // Optional - expected blob SHA of the current file
+	Create  bool                    // The file must not exist yet
+	Stream  func(w io.Writer) error // Writes the content as it is committed, instead of Content; see StreamCommitter
+}
+
+// FileCommitter is implemented by storages that can change several files in
+// a single atomic commit. If a file does not match its expected SHA, or
+// exists although it is to be created, nothing is committed and an error
+// wrapping ErrFileChanged is returned.
+type FileCommitter interface {
+	CommitFiles(ctx context.Context, message string, changes []FileChange) error
+}
+
+// StreamCommitter is implemented by FileCommitters that can commit files
+// whose content is written while the commit is sent, by FileChange.Stream,
+// rather than held in memory. The streams are called in the order of the
+// changes, so content streamed last can describe what was streamed before.
+// A commit that would have to be sent again, such as to retry it, fails when
+// a stream cannot be written twice.
+type StreamCommitter interface {
+	FileCommitter
+	StreamsFiles() bool
+}
+
+// NewRepository creates a client for the configured storage backend.
+func NewRepository(cfg *Config) (Repository, error) {
+	switch cfg.StorageBackend {
+	case BackendGitHub:
+		return NewGitHubClient(cfg)
+	case BackendGitLab:
+		return NewGitLabClient(cfg)
+	case BackendLocalGit:
+		return NewLocalGitClient(cfg)
+	case BackendGitea, "":
+		switch cfg.GiteaWriteMode {
+		case WriteModeGit:
+			return NewGitPushClient(cfg)
+		case WriteModePR:
+			return NewPullRequestClient(cfg)
+		}
+		return NewGiteaClient(cfg)
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", cfg.StorageBackend)
+	}
+}
+
+// recordCommit appends a commit made in repo to the audit log, if configured,
+// and reports its SHA to a caller that asked for it with withCommitCapture.
+func recordCommit(ctx context.Context, audit *AuditLog, repo, action, path, sha, message string) {
+	if captured, ok := ctx.Value(commitCaptureKey{}).(*string); ok && sha != "" {
+		*captured = sha
+	}
+	if audit == nil {
+		return
+	}
+	err := audit.Record(AuditEntry{
+		Repo:    repo,
+		Action:  action,
+		Path:    path,
+		Commit:  sha,
+		Message: message,
+	})
+	if err != nil {
+		slog.Error("Error recording audit entry", "path", path, "error", err)
+	}
+}
+
+type commitCaptureKey struct{}
+
+// withCommitCapture returns a context in which the storages report the SHA
+// of the commits they make. After a write, the returned string holds the SHA
+// of its last commit, or is empty if the storage did not report one.
+func withCommitCapture(ctx context.Context) (context.Context, *string) {
+	sha := new(string)
+	return context.WithValue(ctx, commitCaptureKey{}, sha), sha
+}
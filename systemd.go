@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// systemdPrefix precedes the name of a socket passed by systemd socket
+// activation in a listener address, as in systemd:https. Without a name, it
+// is the first socket passed.
+const systemdPrefix = "systemd:"
+
+// systemdFirstFD is the file descriptor of the first socket systemd passes.
+const systemdFirstFD = 3
+
+// Bounds of the delay between checks of the storage at startup.
+const (
+	startupCheckMinDelay = time.Second
+	startupCheckMaxDelay = 30 * time.Second
+)
+
+// inherited holds the sockets passed by systemd, taken once.
+var inherited struct {
+	once      sync.Once
+	listeners []net.Listener
+	names     []string
+	err       error
+}
+
+// systemdActivated reports whether systemd passed sockets to this process.
+func systemdActivated() bool {
+	return os.Getenv("LISTEN_PID") == strconv.Itoa(os.Getpid()) && os.Getenv("LISTEN_FDS") != ""
+}
+
+// inheritSockets takes the sockets systemd passed to this process, described
+// by LISTEN_PID, LISTEN_FDS and LISTEN_FDNAMES.
+func inheritSockets() ([]net.Listener, []string, error) {
+	inherited.once.Do(func() {
+		if !systemdActivated() {
+			return
+		}
+		n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+		if err != nil || n < 0 {
+			inherited.err = fmt.Errorf("invalid LISTEN_FDS %q", os.Getenv("LISTEN_FDS"))
+			return
+		}
+		names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+		for i := range n {
+			f := os.NewFile(uintptr(systemdFirstFD+i), "systemd-socket")
+			ln, err := net.FileListener(f)
+			f.Close()
+			if err != nil {
+				inherited.err = fmt.Errorf("socket %d passed by systemd is not a listening socket: %w", systemdFirstFD+i, err)
+				return
+			}
+			name := ""
+			if i < len(names) {
+				name = names[i]
+			}
+			inherited.listeners = append(inherited.listeners, ln)
+			inherited.names = append(inherited.names, name)
+		}
+	})
+	return inherited.listeners, inherited.names, inherited.err
+}
+
+// systemdListener returns the socket systemd passed with the name given in
+// its unit's FileDescriptorName, or the first one if name is empty.
+func systemdListener(name string) (net.Listener, error) {
+	listeners, names, err := inheritSockets()
+	if err != nil {
+		return nil, err
+	}
+	if len(listeners) == 0 {
+		return nil, fmt.Errorf("systemd passed no sockets; start the backend from a socket unit")
+	}
+	if name == "" {
+		return listeners[0], nil
+	}
+	for i, n := range names {
+		if n == name {
+			return listeners[i], nil
+		}
+	}
+	return nil, fmt.Errorf("systemd passed no socket named %q; name it with FileDescriptorName= in the socket unit", name)
+}
+
+// sdNotify sends state, such as READY=1, to the service manager over
+// NOTIFY_SOCKET. It does nothing when the backend was not started by systemd
+// as a Type=notify service.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	if strings.HasPrefix(socket, "@") {
+		// An abstract socket
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("failed to notify systemd: %w", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return fmt.Errorf("failed to notify systemd: %w", err)
+	}
+	return nil
+}
+
+// watchdogInterval returns the interval at which systemd expects the
+// backend to show it is alive, as set by WatchdogSec=, or 0 if it does not.
+func watchdogInterval() time.Duration {
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// notifyReady waits until ping reaches the storage, retrying with backoff
+// until ctx is done, and then tells systemd the backend is ready. Units
+// ordered after it start only once it can serve states. If systemd watches
+// the backend, it is then told the backend is alive at half the interval it
+// expects.
+func notifyReady(ctx context.Context, ping func() error) {
+	delay := startupCheckMinDelay
+	for {
+		err := ping()
+		if err == nil {
+			break
+		}
+		slog.Warn("Storage is not reachable yet; retrying", "delay", delay, "error", err)
+		_ = sdNotify("STATUS=Waiting for the storage: " + err.Error())
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, startupCheckMaxDelay)
+	}
+	// The main process changes when the backend is upgraded
+	if err := sdNotify(fmt.Sprintf("MAINPID=%d\nREADY=1\nSTATUS=Serving states", os.Getpid())); err != nil {
+		slog.Warn("Failed to notify systemd", "error", err)
+	}
+
+	interval := watchdogInterval()
+	if interval == 0 {
+		return
+	}
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := sdNotify("WATCHDOG=1"); err != nil {
+				slog.Warn("Failed to notify systemd", "error", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// listenNotify listens for the messages of sdNotify, as systemd does.
+func listenNotify(t *testing.T) *net.UnixConn {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	t.Setenv("NOTIFY_SOCKET", path)
+	return conn
+}
+
+// readNotify returns the next message sent to conn.
+func readNotify(t *testing.T, conn *net.UnixConn) string {
+	t.Helper()
+	buf := make([]byte, 1024)
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf[:n])
+}
+
+func TestNotifyReady_WaitsForStorage(t *testing.T) {
+	conn := listenNotify(t)
+	t.Setenv("WATCHDOG_USEC", "100000")
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pings := 0
+	go notifyReady(ctx, func() error {
+		if pings++; pings == 1 {
+			return errors.New("connection refused")
+		}
+		return nil
+	})
+
+	if msg := readNotify(t, conn); !strings.HasPrefix(msg, "STATUS=Waiting for the storage") {
+		t.Errorf("expected the wait to be reported, got %q", msg)
+	}
+	if msg := readNotify(t, conn); !strings.Contains(msg, "\nREADY=1\n") || !strings.HasPrefix(msg, "MAINPID="+strconv.Itoa(os.Getpid())) {
+		t.Errorf("expected READY=1 once the storage is reachable, got %q", msg)
+	}
+	if msg := readNotify(t, conn); msg != "WATCHDOG=1" {
+		t.Errorf("expected watchdog keep-alives, got %q", msg)
+	}
+}
+
+func TestSdNotify_WithoutSystemd(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	if err := sdNotify("READY=1"); err != nil {
+		t.Errorf("expected no error outside systemd, got %v", err)
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	t.Setenv("WATCHDOG_USEC", "30000000")
+	t.Setenv("WATCHDOG_PID", "")
+	if got := watchdogInterval(); got != 30*time.Second {
+		t.Errorf("expected 30s, got %s", got)
+	}
+
+	// The watchdog of another process
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()+1))
+	if got := watchdogInterval(); got != 0 {
+		t.Errorf("expected no watchdog, got %s", got)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+)
+
+// ErrTagExists is returned when creating a tag that already exists.
+var ErrTagExists = errors.New("tag already exists")
+
+// Tagger is implemented by storages that can tag commits.
+type Tagger interface {
+	CreateTag(ctx context.Context, tag, commit string) error
+}
+
+// stateTag returns the tag marking the given serial of the named state.
+func stateTag(name string, serial uint64) string {
+	return fmt.Sprintf("tfstate/%s/serial-%d", name, serial)
+}
+
+// tagUpdate tags commit as the given serial of the named state, when
+// TAG_ON_UPDATE is set. The write has been committed already, so failures
+// are only logged.
+func (h *StateHandler) tagUpdate(ctx context.Context, name string, header *stateHeader, commit string) {
+	if !h.tagUpdates || header == nil || header.Serial == nil {
+		return
+	}
+	tagger, ok := h.storage.(Tagger)
+	if !ok || commit == "" {
+		slog.Info("Not tagging state: the storage did not report the commit", "state", name)
+		return
+	}
+
+	tag := stateTag(name, *header.Serial)
+	err := tagger.CreateTag(context.WithoutCancel(ctx), tag, commit)
+	switch {
+	case errors.Is(err, ErrTagExists):
+		slog.Info("Not tagging state: the tag already exists", "state", name, "tag", tag)
+	case err != nil:
+		slog.Error("Error tagging state", "state", name, "error", err)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// postState writes body as the state network.
+func postState(t *testing.T, handler http.Handler, body string) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/network", strings.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestTagOnUpdate_LocalGit(t *testing.T) {
+	storage := newTestLocalGitClient(t)
+	handler := NewStateHandler(storage, DefaultMaxBodySize)
+	handler.tagUpdates = true
+
+	postState(t, handler, `{"version":4,"serial":7,"lineage":"abc"}`)
+
+	commits, err := storage.ListCommits(statePath("network"), 1)
+	if err != nil || len(commits) != 1 {
+		t.Fatalf("expected a commit, got %v, %v", commits, err)
+	}
+	ref, err := storage.repo.Reference(plumbing.NewTagReferenceName("tfstate/network/serial-7"), false)
+	if err != nil {
+		t.Fatalf("expected the update to be tagged: %v", err)
+	}
+	if ref.Hash().String() != commits[0].SHA {
+		t.Errorf("expected the tag to point at %s, got %s", commits[0].SHA, ref.Hash())
+	}
+}
+
+func TestTagOnUpdate_Gitea(t *testing.T) {
+	dev := NewDevGitea()
+	handler := NewStateHandler(newTestGiteaClientFor(t, dev), DefaultMaxBodySize)
+	handler.tagUpdates = true
+
+	postState(t, handler, `{"version":4,"serial":1,"lineage":"abc"}`)
+	// Rewriting a serial keeps its first tag
+	postState(t, handler, `{"version":4,"serial":1,"lineage":"abc","outputs":{}}`)
+	postState(t, handler, `{"version":4,"serial":2,"lineage":"abc"}`)
+
+	if len(dev.tags) != 2 || dev.tags["testowner/testrepo:tfstate/network/serial-1"] == "" || dev.tags["testowner/testrepo:tfstate/network/serial-2"] == "" {
+		t.Errorf("expected a tag per serial, got %v", dev.tags)
+	}
+}
+
+func TestTagOnUpdate_Disabled(t *testing.T) {
+	dev := NewDevGitea()
+	handler := NewStateHandler(newTestGiteaClientFor(t, dev), DefaultMaxBodySize)
+
+	postState(t, handler, `{"version":4,"serial":1,"lineage":"abc"}`)
+	if len(dev.tags) != 0 {
+		t.Errorf("expected no tags without TAG_ON_UPDATE, got %v", dev.tags)
+	}
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// TenantConfig is a tenant's entry in TENANTS_FILE. States under its URL
+// prefix are kept in its own repository, with its own credentials and size
+// limits. Unset fields default to the server-wide setting.
+type TenantConfig struct {
+	Prefix         string `yaml:"prefix"`
+	Owner          string `yaml:"owner"`
+	Repo           string `yaml:"repo"`
+	Branch         string `yaml:"branch"`
+	GiteaToken     string `yaml:"gitea_token"`
+	GiteaTokenFile string `yaml:"gitea_token_file"`
+	AuthToken      string `yaml:"auth_token"`
+	AuthTokenFile  string `yaml:"auth_token_file"`
+	MaxBodySizeMB  int64  `yaml:"max_body_size_mb"`
+	SizeLimits     string `yaml:"size_limits"` // BODY_SIZE_LIMITS syntax
+}
+
+// tenantsFile is the format of TENANTS_FILE.
+type tenantsFile struct {
+	Tenants []TenantConfig `yaml:"tenants"`
+}
+
+// tenantSettings are a tenant's settings resolved against the server
+// configuration, with secrets read from their files.
+type tenantSettings struct {
+	prefix      string
+	owner       string
+	repo        string
+	branch      string
+	giteaToken  string
+	authToken   string
+	maxBodySize int64
+	sizeLimits  []SizeLimit
+}
+
+// loadTenants reads the tenants in path, with unset settings taken from cfg.
+// The file may include fragments and refer to environment variables, as
+// described in yamlfile.go.
+func loadTenants(path string, cfg *Config) ([]tenantSettings, error) {
+	var file tenantsFile
+	if err := decodeYAMLFile(path, &file); err != nil {
+		return nil, fmt.Errorf("invalid tenants file: %w", err)
+	}
+
+	tenants := make([]tenantSettings, 0, len(file.Tenants))
+	for i, t := range file.Tenants {
+		s, err := resolveTenant(t, cfg)
+		if err != nil {
+			return nil, fmt.Errorf("tenant %d: %w", i+1, err)
+		}
+		if slices.ContainsFunc(tenants, func(other tenantSettings) bool { return other.prefix == s.prefix }) {
+			return nil, fmt.Errorf("tenant %d: prefix %q is used twice", i+1, s.prefix)
+		}
+		tenants = append(tenants, s)
+	}
+	return tenants, nil
+}
+
+// resolveTenant validates t and fills in its unset settings from cfg.
+func resolveTenant(t TenantConfig, cfg *Config) (tenantSettings, error) {
+	s := tenantSettings{
+		prefix:      strings.Trim(t.Prefix, "/"),
+		owner:       t.Owner,
+		repo:        t.Repo,
+		branch:      t.Branch,
+		maxBodySize: cfg.MaxBodySize,
+		sizeLimits:  cfg.SizeLimits,
+	}
+	if s.prefix == "" {
+		return s, fmt.Errorf("prefix is required")
+	}
+	if strings.HasPrefix(s.prefix, "api/") || s.prefix == "api" || s.prefix == "admin" {
+		return s, fmt.Errorf("prefix %q is reserved", s.prefix)
+	}
+	if s.repo == "" {
+		return s, fmt.Errorf("repo is required")
+	}
+	if s.owner == "" {
+		s.owner = cfg.GiteaOwner
+	}
+	if s.branch == "" {
+		s.branch = cfg.GiteaBranch
+	}
+
+	var err error
+	if s.giteaToken, err = tenantSecret(t.GiteaToken, t.GiteaTokenFile, "gitea_token"); err != nil {
+		return s, err
+	}
+	if s.authToken, err = tenantSecret(t.AuthToken, t.AuthTokenFile, "auth_token"); err != nil {
+		return s, err
+	}
+
+	if t.MaxBodySizeMB < 0 {
+		return s, fmt.Errorf("max_body_size_mb must be positive")
+	}
+	if t.MaxBodySizeMB > 0 {
+		s.maxBodySize = t.MaxBodySizeMB << 20
+	}
+	if t.SizeLimits != "" {
+		if s.sizeLimits, err = parseSizeLimits(t.SizeLimits); err != nil {
+			return s, fmt.Errorf("size_limits: %w", err)
+		}
+	}
+	return s, nil
+}
+
+// tenantSecret returns a secret given inline or, with key_file, the trimmed
+// content of the file.
+func tenantSecret(value, file, key string) (string, error) {
+	if file == "" {
+		return value, nil
+	}
+	if value != "" {
+		return "", fmt.Errorf("%s and %s_file must not both be set", key, key)
+	}
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("%s_file: %w", key, err)
+	}
+	return strings.TrimSpace(string(content)), nil
+}
+
+// tenant is a tenant being served.
+type tenant struct {
+	settings  tenantSettings // As loaded at startup, apart from the secrets
+	client    *GiteaClient
+	handler   *StateHandler
+	authToken atomic.Pointer[string]
+}
+
+// TenantRouter serves the tenants in TENANTS_FILE at /{prefix}/{name}, each
+// from its own repository and with its own StateHandler. Requests outside
+// every tenant's prefix go to the fallback handler. A tenant's states can be
+// accessed with its auth_token or the server's AUTH_TOKEN; when neither is
+// set, they are open like the rest of the server.
+type TenantRouter struct {
+	cfg       *Config
+	path      string
+	base      *StateHandler // Template for the tenants' handlers
+	fallback  http.Handler
+	authToken func() string // Server-wide token, accepted by every tenant
+
+	mu      sync.RWMutex
+	tenants map[string]*tenant // keyed by prefix
+}
+
+// NewTenantRouter creates a TenantRouter for the tenants in cfg.TenantsFile.
+func NewTenantRouter(cfg *Config, base *StateHandler, authToken func() string, fallback http.Handler) (*TenantRouter, error) {
+	tr := &TenantRouter{
+		cfg:       cfg,
+		path:      cfg.TenantsFile,
+		base:      base,
+		fallback:  fallback,
+		authToken: authToken,
+		tenants:   make(map[string]*tenant),
+	}
+	settings, err := loadTenants(tr.path, cfg)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range settings {
+		t, err := tr.open(s)
+		if err != nil {
+			return nil, fmt.Errorf("tenant %s: %w", s.prefix, err)
+		}
+		tr.tenants[s.prefix] = t
+	}
+	return tr, nil
+}
+
+// tenantConfig returns the server configuration with s's storage settings.
+func (tr *TenantRouter) tenantConfig(s tenantSettings) *Config {
+	cfg := *tr.cfg
+	cfg.GiteaOwner, cfg.GiteaRepo, cfg.GiteaBranch = s.owner, s.repo, s.branch
+	if s.giteaToken != "" {
+		cfg.GiteaToken, cfg.GiteaUsername, cfg.GiteaPassword, cfg.GiteaTOTPSecret = s.giteaToken, "", "", nil
+	}
+	return &cfg
+}
+
+// open connects to a tenant's repository.
+func (tr *TenantRouter) open(s tenantSettings) (*tenant, error) {
+	client, err := NewGiteaClient(tr.tenantConfig(s))
+	if err != nil {
+		return nil, err
+	}
+	exists, err := client.RepoExists()
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, fmt.Errorf("repository %s/%s does not exist", s.owner, s.repo)
+	}
+	client.SetAuditLog(tr.base.audit)
+
+	h := tr.base.forStorage(client, s.owner+"/"+s.repo)
+	h.maxBodySize = s.maxBodySize
+	h.sizeLimits = s.sizeLimits
+	t := &tenant{settings: s, client: client, handler: h}
+	t.authToken.Store(&s.authToken)
+	slog.Info("Serving tenant", "tenant", s.prefix, "repo", s.owner+"/"+s.repo)
+	return t, nil
+}
+
+// Reload rereads the tenants file. Tenants that were added are served and
+// tenants that were removed are no longer served. Rotated tokens of existing
+// tenants are put into use; their other settings only change with a restart.
+func (tr *TenantRouter) Reload(context.Context) error {
+	settings, err := loadTenants(tr.path, tr.cfg)
+	if err != nil {
+		return fmt.Errorf("failed to reload tenants: %w", err)
+	}
+
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	seen := make(map[string]bool, len(settings))
+	var errs []error
+	for _, s := range settings {
+		seen[s.prefix] = true
+		t, ok := tr.tenants[s.prefix]
+		if !ok {
+			t, err := tr.open(s)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("tenant %s: %w", s.prefix, err))
+				continue
+			}
+			tr.tenants[s.prefix] = t
+			continue
+		}
+
+		current := t.settings
+		if s.owner != current.owner || s.repo != current.repo || s.branch != current.branch ||
+			s.maxBodySize != current.maxBodySize || !slices.Equal(s.sizeLimits, current.sizeLimits) {
+			slog.Warn("Repository and size settings of tenants only change with a restart; keeping the current ones", "tenant", s.prefix)
+		}
+		if s.authToken != *t.authToken.Load() {
+			t.authToken.Store(&s.authToken)
+			slog.Info("Reloaded auth token of tenant", "tenant", s.prefix)
+		}
+		if s.giteaToken != current.giteaToken {
+			next := current
+			next.giteaToken = s.giteaToken
+			if err := t.client.ReloadCredentials(tr.tenantConfig(next)); err != nil {
+				errs = append(errs, fmt.Errorf("tenant %s: keeping the current Gitea token: %w", s.prefix, err))
+				continue
+			}
+			t.settings.giteaToken = s.giteaToken
+			slog.Info("Reloaded Gitea token of tenant", "tenant", s.prefix)
+		}
+	}
+	for prefix := range tr.tenants {
+		if !seen[prefix] {
+			delete(tr.tenants, prefix)
+			slog.Info("No longer serving tenant", "tenant", prefix)
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to reload tenants: %w", errs[0])
+	}
+	return nil
+}
+
+// match returns the tenant whose prefix is the longest one containing path,
+// and the rest of the path.
+func (tr *TenantRouter) match(path string) (*tenant, string) {
+	tr.mu.RLock()
+	defer tr.mu.RUnlock()
+
+	var best *tenant
+	var rest string
+	for prefix, t := range tr.tenants {
+		if r, ok := strings.CutPrefix(path, "/"+prefix+"/"); ok && r != "" {
+			if best == nil || len(prefix) > len(best.settings.prefix) {
+				best, rest = t, r
+			}
+		}
+	}
+	return best, rest
+}
+
+// Tenant returns the prefix of the tenant serving path, or "" for paths
+// outside every tenant's prefix. It labels the request metrics.
+func (tr *TenantRouter) Tenant(path string) string {
+	if t, _ := tr.match(path); t != nil {
+		return t.settings.prefix
+	}
+	return ""
+}
+
+// topicTargets returns the tenants' repositories with topics and the topic
+// naming their tenant, for RepoTopics.
+func (tr *TenantRouter) topicTargets(topics []string) []topicTarget {
+	tr.mu.RLock()
+	defer tr.mu.RUnlock()
+
+	targets := make([]topicTarget, 0, len(tr.tenants))
+	for prefix, t := range tr.tenants {
+		targets = append(targets, topicTarget{
+			repo:   t.settings.owner + "/" + t.settings.repo,
+			setter: t.client,
+			topics: append(slices.Clip(topics), tenantTopic(prefix)),
+		})
+	}
+	return targets
+}
+
+// ServeHTTP routes /{prefix}/{name} to the tenant's StateHandler, which sees
+// the request as /{name}, and everything else to the fallback handler.
+func (tr *TenantRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	t, name := tr.match(r.URL.Path)
+	if t == nil {
+		tr.fallback.ServeHTTP(w, r)
+		return
+	}
+
+	if tenantToken, serverToken := *t.authToken.Load(), tr.authToken(); tenantToken != "" || serverToken != "" {
+		var ok bool
+		if r, ok = authenticate(r, tenantToken, serverToken); !ok {
+			writeUnauthorized(w)
+			return
+		}
+	}
+
+	r2 := r.Clone(r.Context())
+	r2.URL.Path = "/" + name
+	r2.URL.RawPath = ""
+	t.handler.ServeHTTP(w, r2)
+}
+
+// Authenticates reports whether token is the auth_token of a tenant or the
+// server-wide token.
+func (tr *TenantRouter) Authenticates(token string) bool {
+	tr.mu.RLock()
+	defer tr.mu.RUnlock()
+	tokens := []string{tr.authToken()}
+	for _, t := range tr.tenants {
+		tokens = append(tokens, *t.authToken.Load())
+	}
+	return validToken(token, tokens...)
+}
+
+// Protect serves next to callers presenting a tenant's auth_token, with a
+// Principal naming the tenant, and everyone else through server, which
+// applies the server-wide authentication.
+func (tr *TenantRouter) Protect(next, server http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tr.mu.RLock()
+		tokens := make(map[string]string, len(tr.tenants))
+		for prefix, t := range tr.tenants {
+			tokens[prefix] = *t.authToken.Load()
+		}
+		tr.mu.RUnlock()
+
+		for prefix, token := range tokens {
+			if token == "" {
+				continue
+			}
+			if r, ok := authenticate(r, token); ok {
+				principal := principalFromContext(r.Context())
+				principal.Tenant = prefix
+				recordPrincipal(r.Context(), principal)
+				next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, principal)))
+				return
+			}
+		}
+		server.ServeHTTP(w, r)
+	})
+}
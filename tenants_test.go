@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestTenantRouter(t *testing.T, tenants string) (*TenantRouter, *Config, string) {
+	t.Helper()
+	server := httptest.NewServer(NewDevGitea())
+	t.Cleanup(server.Close)
+
+	path := filepath.Join(t.TempDir(), "tenants.yaml")
+	if err := os.WriteFile(path, []byte(tenants), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &Config{
+		GiteaURL:    server.URL,
+		GiteaToken:  "test-token",
+		GiteaOwner:  "testowner",
+		GiteaRepo:   "testrepo",
+		GiteaBranch: "main",
+		MaxBodySize: DefaultMaxBodySize,
+		TenantsFile: path,
+	}
+	client, err := NewGiteaClient(cfg)
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	base := NewStateHandler(client, DefaultMaxBodySize)
+	router, err := NewTenantRouter(cfg, base, func() string { return "" }, base)
+	if err != nil {
+		t.Fatalf("failed to load tenants: %v", err)
+	}
+	return router, cfg, path
+}
+
+func serveAs(handler http.Handler, method, target, token, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+func TestLoadTenants(t *testing.T) {
+	cfg := &Config{GiteaOwner: "org", GiteaBranch: "main", MaxBodySize: DefaultMaxBodySize}
+	dir := t.TempDir()
+	tokenFile := filepath.Join(dir, "token")
+	if err := os.WriteFile(tokenFile, []byte("from-file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{"valid", "tenants:\n  - prefix: /team-a/\n    repo: a\n    auth_token_file: " + tokenFile + "\n    max_body_size_mb: 5\n", ""},
+		{"missing repo", "tenants:\n  - prefix: team-a\n", "repo is required"},
+		{"missing prefix", "tenants:\n  - repo: a\n", "prefix is required"},
+		{"reserved prefix", "tenants:\n  - prefix: api/v1\n    repo: a\n", "reserved"},
+		{"duplicate prefix", "tenants:\n  - prefix: a\n    repo: a\n  - prefix: a/\n    repo: b\n", "used twice"},
+		{"unknown field", "tenants:\n  - prefix: a\n    repo: a\n    token: x\n", "field token not found"},
+		{"token and file", "tenants:\n  - prefix: a\n    repo: a\n    auth_token: x\n    auth_token_file: " + tokenFile + "\n", "must not both be set"},
+		{"invalid size limits", "tenants:\n  - prefix: a\n    repo: a\n    size_limits: big\n", "size_limits"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, "tenants.yaml")
+			if err := os.WriteFile(path, []byte(tt.content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			tenants, err := loadTenants(path, cfg)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("expected error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			s := tenants[0]
+			if s.prefix != "team-a" || s.owner != "org" || s.branch != "main" || s.authToken != "from-file" || s.maxBodySize != 5<<20 {
+				t.Errorf("unexpected settings %+v", s)
+			}
+		})
+	}
+}
+
+func TestTenantRouter_RoutesToRepository(t *testing.T) {
+	router, cfg, _ := newTestTenantRouter(t, "tenants:\n  - prefix: team-a\n    owner: teams\n    repo: a\n")
+	state := `{"version":4,"serial":1,"lineage":"abc"}`
+
+	if w := serveAs(router, http.MethodPost, "/team-a/prod", "", state); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	client, _ := NewGiteaClient(cfg)
+	if content, _, _ := client.ForRepo("teams", "a").GetFile(context.Background(), statePath("prod")); content == nil {
+		t.Error("expected the state in the tenant's repository")
+	}
+	if content, _, _ := client.GetFile(context.Background(), statePath("prod")); content != nil {
+		t.Error("expected no state in the default repository")
+	}
+
+	// Other paths are served by the fallback handler
+	if w := serveAs(router, http.MethodPost, "/prod", "", state); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+	if content, _, _ := client.GetFile(context.Background(), statePath("prod")); content == nil {
+		t.Error("expected the state in the default repository")
+	}
+}
+
+func TestTenantRouter_AuthIsolation(t *testing.T) {
+	router, _, _ := newTestTenantRouter(t, `tenants:
+  - prefix: team-a
+    repo: a
+    auth_token: token-a
+  - prefix: team-b
+    repo: b
+    auth_token: token-b
+    max_body_size_mb: 1
+`)
+	router.authToken = func() string { return "server-token" }
+
+	tests := []struct {
+		target string
+		token  string
+		want   int
+	}{
+		{"/team-a/prod", "token-a", http.StatusNotFound},
+		{"/team-a/prod", "token-b", http.StatusUnauthorized},
+		{"/team-a/prod", "", http.StatusUnauthorized},
+		{"/team-b/prod", "token-b", http.StatusNotFound},
+		{"/team-b/prod", "server-token", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if w := serveAs(router, http.MethodGet, tt.target, tt.token, ""); w.Code != tt.want {
+			t.Errorf("GET %s with %q: expected status %d, got %d", tt.target, tt.token, tt.want, w.Code)
+		}
+	}
+
+	// The tenant's size limit applies
+	big := `{"version":4,"serial":1,"lineage":"abc","pad":"` + strings.Repeat("x", 2<<20) + `"}`
+	if w := serveAs(router, http.MethodPost, "/team-b/prod", "token-b", big); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected status 413, got %d", w.Code)
+	}
+}
+
+func TestTenantRouter_Reload(t *testing.T) {
+	router, _, path := newTestTenantRouter(t, "tenants:\n  - prefix: team-a\n    repo: a\n    auth_token: old\n  - prefix: team-b\n    repo: b\n")
+
+	err := os.WriteFile(path, []byte("tenants:\n  - prefix: team-a\n    repo: a\n    auth_token: new\n  - prefix: team-c\n    repo: c\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := router.Reload(context.Background()); err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+
+	if w := serveAs(router, http.MethodGet, "/team-a/prod", "old", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected the old token to be rejected, got %d", w.Code)
+	}
+	if w := serveAs(router, http.MethodGet, "/team-a/prod", "new", ""); w.Code != http.StatusNotFound {
+		t.Errorf("expected the new token to be accepted, got %d", w.Code)
+	}
+	if tn, _ := router.match("/team-b/prod"); tn != nil {
+		t.Error("expected the removed tenant to be unrouted")
+	}
+	if tn, _ := router.match("/team-c/prod"); tn == nil {
+		t.Error("expected the added tenant to be routed")
+	}
+
+	// An invalid file leaves the tenants as they are
+	if err := os.WriteFile(path, []byte("tenants: [oops"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := router.Reload(context.Background()); err == nil {
+		t.Error("expected an error for an invalid file")
+	}
+	if tn, _ := router.match("/team-c/prod"); tn == nil {
+		t.Error("expected the tenants to be kept")
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// stateHeader holds the top-level tfstate fields the backend inspects.
+type stateHeader struct {
+	Version          int     `json:"version"`
+	TerraformVersion string  `json:"terraform_version"`
+	Serial           *uint64 `json:"serial"`
+	Lineage          string  `json:"lineage"`
+}
+
+// parseStateHeader decodes the top-level fields of a tfstate document.
+func parseStateHeader(content []byte) (*stateHeader, error) {
+	var header stateHeader
+	if err := json.Unmarshal(content, &header); err != nil {
+		return nil, err
+	}
+	return &header, nil
+}
+
+// validateState checks that content is a tfstate document with the top-level
+// fields Terraform always writes, and returns them. The document is scanned
+// once, without retaining anything but the top-level fields.
+func validateState(content []byte) (*stateHeader, error) {
+	var fields headerFields
+	if err := json.Unmarshal(content, &fields); err != nil {
+		return nil, fmt.Errorf("state is not a JSON object: %w", err)
+	}
+	return fields.header()
+}
+
+// headerFields are the top-level tfstate fields the backend inspects, as
+// they appear in the document.
+type headerFields struct {
+	Version          json.RawMessage `json:"version"`
+	TerraformVersion json.RawMessage `json:"terraform_version"`
+	Serial           json.RawMessage `json:"serial"`
+	Lineage          json.RawMessage `json:"lineage"`
+}
+
+// header checks that the fields Terraform always writes are present and
+// well-formed, and decodes them.
+func (fields headerFields) header() (*stateHeader, error) {
+	for _, field := range []struct {
+		name  string
+		value json.RawMessage
+	}{{"version", fields.Version}, {"serial", fields.Serial}, {"lineage", fields.Lineage}} {
+		if field.value == nil {
+			return nil, fmt.Errorf("state is missing the %q field", field.name)
+		}
+	}
+
+	var header stateHeader
+	for _, field := range []struct {
+		value json.RawMessage
+		dst   any
+	}{
+		{fields.Version, &header.Version},
+		{fields.TerraformVersion, &header.TerraformVersion},
+		{fields.Serial, &header.Serial},
+		{fields.Lineage, &header.Lineage},
+	} {
+		if field.value == nil {
+			continue
+		}
+		if err := json.Unmarshal(field.value, field.dst); err != nil {
+			return nil, fmt.Errorf("state has malformed top-level fields: %w", err)
+		}
+	}
+	if header.Version <= 0 {
+		return nil, fmt.Errorf("state version must be positive")
+	}
+	if header.Serial == nil {
+		return nil, fmt.Errorf("state serial must be a number")
+	}
+	if header.Lineage == "" {
+		return nil, fmt.Errorf("state lineage must not be empty")
+	}
+	return &header, nil
+}
+
+// checkSerial returns an error if writing incoming over current would move the
+// serial backwards. States of different lineages are unrelated and never conflict.
+func checkSerial(current, incoming *stateHeader) error {
+	if current == nil || incoming == nil || current.Serial == nil || incoming.Serial == nil {
+		return nil
+	}
+	if current.Lineage != incoming.Lineage {
+		return nil
+	}
+	if *incoming.Serial < *current.Serial {
+		return fmt.Errorf("state serial %d is older than stored serial %d", *incoming.Serial, *current.Serial)
+	}
+	return nil
+}
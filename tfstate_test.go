@@ -0,0 +1,42 @@
+package main
+
+import "testing"
+
+func serialPtr(n uint64) *uint64 { return &n }
+
+func TestCheckSerial(t *testing.T) {
+	tests := []struct {
+		name     string
+		current  *stateHeader
+		incoming *stateHeader
+		wantErr  bool
+	}{
+		{"newer serial", &stateHeader{Serial: serialPtr(3), Lineage: "a"}, &stateHeader{Serial: serialPtr(4), Lineage: "a"}, false},
+		{"same serial", &stateHeader{Serial: serialPtr(3), Lineage: "a"}, &stateHeader{Serial: serialPtr(3), Lineage: "a"}, false},
+		{"older serial", &stateHeader{Serial: serialPtr(3), Lineage: "a"}, &stateHeader{Serial: serialPtr(2), Lineage: "a"}, true},
+		{"different lineage", &stateHeader{Serial: serialPtr(3), Lineage: "a"}, &stateHeader{Serial: serialPtr(1), Lineage: "b"}, false},
+		{"no current state", nil, &stateHeader{Serial: serialPtr(1)}, false},
+		{"missing serial", &stateHeader{Lineage: "a"}, &stateHeader{Serial: serialPtr(1), Lineage: "a"}, false},
+	}
+
+	for _, tt := range tests {
+		err := checkSerial(tt.current, tt.incoming)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: checkSerial() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestParseStateHeader(t *testing.T) {
+	header, err := parseStateHeader([]byte(`{"version":4,"terraform_version":"1.5.0","serial":7,"lineage":"abc"}`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if header.Version != 4 || header.TerraformVersion != "1.5.0" || header.Serial == nil || *header.Serial != 7 || header.Lineage != "abc" {
+		t.Errorf("unexpected header: %+v", header)
+	}
+
+	if _, err := parseStateHeader([]byte("not json")); err == nil {
+		t.Error("expected error for invalid JSON")
+	}
+}
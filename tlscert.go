@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// certCheckInterval is the least time between checks of the certificate
+// files for a renewed certificate.
+const certCheckInterval = 10 * time.Second
+
+// CertReloader serves the certificate of the TLS listeners, and puts a
+// renewed one into use without a restart: once certCheckInterval has passed,
+// a handshake checks whether TLS_CERT_FILE or TLS_KEY_FILE have changed, and
+// rereads them if so. A renewal that fails to load, such as a certificate
+// written before its key, is logged and the current certificate stays in use
+// until the next check.
+type CertReloader struct {
+	certFile, keyFile string
+
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	modTimes [2]time.Time // Of certFile and keyFile when cert was loaded
+	checked  time.Time
+	now      func() time.Time
+}
+
+// NewCertReloader loads the certificate in certFile with its private key in
+// keyFile.
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	c := &CertReloader{certFile: certFile, keyFile: keyFile, now: time.Now}
+	modTimes, err := c.stat()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.load(modTimes); err != nil {
+		return nil, err
+	}
+	c.checked = c.now()
+	return c, nil
+}
+
+// stat returns the modification times of the certificate files.
+func (c *CertReloader) stat() ([2]time.Time, error) {
+	var modTimes [2]time.Time
+	for i, name := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return modTimes, fmt.Errorf("failed to read TLS certificate: %w", err)
+		}
+		modTimes[i] = info.ModTime()
+	}
+	return modTimes, nil
+}
+
+// load reads the certificate files, last modified at modTimes.
+func (c *CertReloader) load(modTimes [2]time.Time) error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	c.cert, c.modTimes = &cert, modTimes
+	return nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (c *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now := c.now(); now.Sub(c.checked) >= certCheckInterval {
+		c.checked = now
+		c.reload()
+	}
+	return c.cert, nil
+}
+
+// reload rereads the certificate files if they have changed. c.mu must be
+// held.
+func (c *CertReloader) reload() {
+	modTimes, err := c.stat()
+	if err != nil {
+		slog.Warn("Serving the current certificate", "error", err)
+		return
+	}
+	if modTimes == c.modTimes {
+		return
+	}
+	if err := c.load(modTimes); err != nil {
+		slog.Warn("Serving the current certificate", "error", err)
+		return
+	}
+	slog.Info("Reloaded the TLS certificate", "file", c.certFile)
+}
+
+// TLSConfig returns the TLS configuration of the listeners serving c.
+func (c *CertReloader) TLSConfig() *tls.Config {
+	return &tls.Config{GetCertificate: c.GetCertificate, MinVersion: tls.VersionTLS12}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// repoTopicsInterval is the time between passes restoring REPO_TOPICS.
+const repoTopicsInterval = time.Hour
+
+// maxRepoTopicLength is the longest topic Gitea accepts.
+const maxRepoTopicLength = 35
+
+// repoTopicPattern matches the topics Gitea accepts.
+var repoTopicPattern = regexp.MustCompile(`^[a-z0-9][-.a-z0-9]*$`)
+
+// TopicSetter is implemented by storages whose repository can carry topics.
+type TopicSetter interface {
+	RepoTopics(ctx context.Context) ([]string, error)
+	AddRepoTopic(ctx context.Context, topic string) error
+}
+
+// parseRepoTopics parses a comma-separated list of repository topics, such
+// as "terraform-state,managed-by-gitea-tf-backend".
+func parseRepoTopics(s string) ([]string, error) {
+	var topics []string
+	for _, topic := range strings.Split(s, ",") {
+		topic = strings.TrimSpace(topic)
+		if topic == "" {
+			continue
+		}
+		if !repoTopicPattern.MatchString(topic) || len(topic) > maxRepoTopicLength {
+			return nil, fmt.Errorf("invalid topic %q: topics are lowercase letters, digits, dashes and dots, starting with a letter or digit, and at most %d characters", topic, maxRepoTopicLength)
+		}
+		topics = append(topics, topic)
+	}
+	return topics, nil
+}
+
+// tenantTopicChars are the characters tenant prefixes drop in topics.
+var tenantTopicChars = regexp.MustCompile(`[^a-z0-9.-]+`)
+
+// tenantTopic returns the topic naming the tenant served at prefix, such as
+// tfstate-tenant-team-a. Long prefixes are cut to fit Gitea's limit.
+func tenantTopic(prefix string) string {
+	name := tenantTopicChars.ReplaceAllString(strings.ToLower(prefix), "-")
+	topic := "tfstate-tenant-" + strings.Trim(name, "-.")
+	if len(topic) > maxRepoTopicLength {
+		topic = strings.TrimRight(topic[:maxRepoTopicLength], "-.")
+	}
+	return topic
+}
+
+// topicTarget is a repository whose topics are kept up to date.
+type topicTarget struct {
+	repo   string // owner/repo
+	setter TopicSetter
+	topics []string
+}
+
+// RepoTopics keeps REPO_TOPICS on the repositories holding states, so that
+// searches across a Gitea instance find every repository a backend manages:
+// the state repository, the archive repository and the tenants'
+// repositories, which also get a topic naming their tenant. Topics are only
+// added, never removed, so topics set by hand are left alone; a topic removed
+// by hand comes back on the next pass.
+type RepoTopics struct {
+	topics  []string
+	targets []topicTarget
+	tenants *TenantRouter // Optional - adds the tenants' repositories
+}
+
+// NewRepoTopics creates a RepoTopics keeping topics on the repositories
+// added with Add.
+func NewRepoTopics(topics []string) *RepoTopics {
+	return &RepoTopics{topics: topics}
+}
+
+// Add keeps the topics on the repository repo, accessed through storage.
+func (t *RepoTopics) Add(repo string, storage Repository) {
+	setter, ok := storage.(TopicSetter)
+	if !ok {
+		slog.Warn("Not adding topics: the storage does not support repository topics", "repo", repo)
+		return
+	}
+	t.targets = append(t.targets, topicTarget{repo: repo, setter: setter, topics: t.topics})
+}
+
+// Run adds the missing topics to every repository. A repository that fails
+// does not keep the others from being updated.
+func (t *RepoTopics) Run(ctx context.Context) error {
+	targets := t.targets
+	if t.tenants != nil {
+		targets = append(slices.Clip(targets), t.tenants.topicTargets(t.topics)...)
+	}
+
+	var errs []error
+	for _, target := range targets {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err := t.reconcile(ctx, target); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// reconcile adds the topics missing from a repository.
+func (t *RepoTopics) reconcile(ctx context.Context, target topicTarget) error {
+	current, err := target.setter.RepoTopics(ctx)
+	if err != nil {
+		return err
+	}
+	present := make(map[string]bool, len(current))
+	for _, topic := range current {
+		present[topic] = true
+	}
+	for _, topic := range target.topics {
+		if present[topic] {
+			continue
+		}
+		if err := target.setter.AddRepoTopic(ctx, topic); err != nil {
+			return err
+		}
+		slog.Info("Added topic to repository", "topic", topic, "repo", target.repo)
+	}
+	return nil
+}
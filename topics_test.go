@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+)
+
+func TestParseRepoTopics(t *testing.T) {
+	topics, err := parseRepoTopics(" terraform-state, managed-by-gitea-tf-backend,,v1.2 ")
+	if err != nil || !slices.Equal(topics, []string{"terraform-state", "managed-by-gitea-tf-backend", "v1.2"}) {
+		t.Errorf("unexpected topics %v, %v", topics, err)
+	}
+	for _, invalid := range []string{"Terraform", "managed-by:backend", "-state", "a-topic-longer-than-thirty-five-chars"} {
+		if _, err := parseRepoTopics(invalid); err == nil {
+			t.Errorf("expected an error for %q", invalid)
+		}
+	}
+}
+
+func TestTenantTopic(t *testing.T) {
+	cases := map[string]string{
+		"payments":                         "tfstate-tenant-payments",
+		"Teams/Data_EU":                    "tfstate-tenant-teams-data-eu",
+		"a-rather-long-tenant-prefix-name": "tfstate-tenant-a-rather-long-tenant",
+	}
+	for prefix, want := range cases {
+		got := tenantTopic(prefix)
+		if got != want {
+			t.Errorf("tenantTopic(%q) = %q, want %q", prefix, got, want)
+		}
+		if _, err := parseRepoTopics(got); err != nil {
+			t.Errorf("tenantTopic(%q) is not a valid topic: %v", prefix, err)
+		}
+	}
+}
+
+func TestRepoTopics_AddsMissingTopics(t *testing.T) {
+	dev := NewDevGitea()
+	client := newTestGiteaClientFor(t, dev)
+	ctx := context.Background()
+	if err := client.AddRepoTopic(ctx, "infrastructure"); err != nil {
+		t.Fatal(err)
+	}
+
+	topics := NewRepoTopics([]string{"terraform-state", "managed-by-gitea-tf-backend"})
+	topics.Add("testowner/testrepo", client)
+	topics.Add("testowner/archive", client.WithRepo("archive"))
+	for range 2 {
+		if err := topics.Run(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := client.RepoTopics(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(got, []string{"infrastructure", "terraform-state", "managed-by-gitea-tf-backend"}) {
+		t.Errorf("expected the topics to be added next to the existing one, got %v", got)
+	}
+	archived, _ := client.WithRepo("archive").(*GiteaClient).RepoTopics(ctx)
+	if !slices.Equal(archived, []string{"terraform-state", "managed-by-gitea-tf-backend"}) {
+		t.Errorf("expected the topics on the archive repository, got %v", archived)
+	}
+}
+
+func TestRepoTopics_Tenants(t *testing.T) {
+	router, _, _ := newTestTenantRouter(t, "tenants:\n  - prefix: payments\n    owner: teams\n    repo: payments\n")
+	topics := NewRepoTopics([]string{"terraform-state"})
+	topics.tenants = router
+	ctx := context.Background()
+	if err := topics.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := router.tenants["payments"].client.RepoTopics(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(got, []string{"terraform-state", "tfstate-tenant-payments"}) {
+		t.Errorf("expected the topics and the tenant's topic, got %v", got)
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 test vectors for SHA-1, truncated to six digits
+	secret := []byte("12345678901234567890")
+	for unix, code := range map[int64]string{59: "287082", 1111111109: "081804", 1234567890: "005924", 2000000000: "279037"} {
+		if got := totpCode(secret, time.Unix(unix, 0)); got != code {
+			t.Errorf("totpCode at %d = %s, want %s", unix, got, code)
+		}
+	}
+}
+
+func TestParseTOTPSecret(t *testing.T) {
+	secret, err := parseTOTPSecret("gezd gnbv gy3t qojq gezd gnbv gy3t qojq")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(secret) != "12345678901234567890" {
+		t.Errorf("unexpected secret %q", secret)
+	}
+
+	for _, invalid := range []string{"", "not base32!", "===="} {
+		if _, err := parseTOTPSecret(invalid); err == nil {
+			t.Errorf("expected error for %q", invalid)
+		}
+	}
+}
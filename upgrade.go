@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Environment of a backend started by an upgrade.
+const (
+	upgradeListenersEnv = "UPGRADE_LISTENERS"  // Addresses of the listeners passed, from fd 3 on
+	upgradeControlEnv   = "UPGRADE_CONTROL_FD" // Connection to the backend being upgraded
+)
+
+// upgradeReadyTimeout is how long the backend being upgraded waits for the
+// new one to start before giving up on the upgrade.
+const upgradeReadyTimeout = time.Minute
+
+// upgradeReady is the line the new backend sends once it has started.
+const upgradeReady = "ready"
+
+// handedLock is a lock handed over to the new backend by an upgrade, with
+// the handler holding it: the tenant's, the repository's, or the default one
+// if neither is set.
+type handedLock struct {
+	Name   string     `json:"name"`
+	Lock   LockInfo   `json:"lock"`
+	Source lockSource `json:"source"`
+	Tenant string     `json:"tenant,omitempty"` // Prefix of the tenant
+	Repo   string     `json:"repo,omitempty"`   // owner/repo served with MULTI_REPO
+}
+
+// lockHolder is a handler whose locks an upgrade hands over. Each takes over
+// the handed locks that are its own, and ignores the others.
+type lockHolder interface {
+	handOverLocks() []handedLock
+	takeOverLocks(locks []handedLock)
+}
+
+// upgradeListeners holds the listeners passed by the backend being upgraded,
+// keyed by address.
+var upgradeListeners map[string]net.Listener
+
+// upgradedFrom reports whether the backend was started by an upgrade that
+// passed it the listener at addr.
+func upgradedFrom(addr string) bool {
+	return slices.Contains(strings.Split(os.Getenv(upgradeListenersEnv), ","), addr)
+}
+
+// takeOver completes the start of a backend started by an upgrade: it takes
+// the listeners of the backend being upgraded, tells it that it has started,
+// and returns the locks it held once it has finished its requests. Until
+// then, new connections wait in the listeners' backlog. It returns nothing
+// outside an upgrade.
+func takeOver() ([]handedLock, error) {
+	fd := os.Getenv(upgradeControlEnv)
+	if fd == "" {
+		return nil, nil
+	}
+	addrs := strings.Split(os.Getenv(upgradeListenersEnv), ",")
+	for _, name := range []string{upgradeListenersEnv, upgradeControlEnv} {
+		os.Unsetenv(name)
+	}
+
+	n, err := strconv.Atoi(fd)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s %q", upgradeControlEnv, fd)
+	}
+	control := os.NewFile(uintptr(n), "upgrade-control")
+	defer control.Close()
+	upgradeListeners = make(map[string]net.Listener)
+	for i, addr := range addrs {
+		f := os.NewFile(uintptr(systemdFirstFD+i), addr)
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("listener %s passed by the upgrade is not usable: %w", addr, err)
+		}
+		upgradeListeners[addr] = ln
+	}
+
+	if _, err := fmt.Fprintln(control, upgradeReady); err != nil {
+		return nil, fmt.Errorf("failed to reach the backend being upgraded: %w", err)
+	}
+	slog.Info("Waiting for the backend being upgraded to finish its requests")
+	var locks []handedLock
+	if err := json.NewDecoder(control).Decode(&locks); err != nil {
+		// It stopped without handing over; its locks are lost as in a restart
+		slog.Warn("The backend being upgraded handed over no locks", "error", err)
+		return nil, nil
+	}
+	slog.Info("Took over the locks of the backend being upgraded", "locks", len(locks))
+	return locks, nil
+}
+
+// Upgrader replaces the running backend with a new process of its binary,
+// such as one just installed by a package upgrade, without refusing a
+// connection or failing a request. The new process inherits the listening
+// sockets and starts while this one keeps serving; once it has started, this
+// one stops accepting connections, finishes its requests, and hands it the
+// locks it holds, including those of applies midway through, which the new
+// process serves from then on.
+type Upgrader struct {
+	listeners []Listener
+	lns       []net.Listener
+
+	mu      sync.Mutex
+	control *os.File      // To the new process; nil when no upgrade is under way
+	ready   chan struct{} // Closed once the new process has started
+}
+
+// NewUpgrader creates an Upgrader passing on lns, listening as listeners.
+func NewUpgrader(listeners []Listener, lns []net.Listener) *Upgrader {
+	return &Upgrader{listeners: listeners, lns: lns, ready: make(chan struct{})}
+}
+
+// Ready is closed once a new process has started and this one should hand
+// over to it.
+func (u *Upgrader) Ready() <-chan struct{} {
+	return u.ready
+}
+
+// Start starts the new process and waits until it has started. If it fails
+// to, it is stopped and this one keeps serving.
+func (u *Upgrader) Start() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.control != nil {
+		return errors.New("an upgrade is already under way")
+	}
+
+	path, err := exec.LookPath(os.Args[0])
+	if err != nil {
+		return fmt.Errorf("failed to find the backend binary: %w", err)
+	}
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	addrs := make([]string, len(u.lns))
+	for i, ln := range u.lns {
+		filer, ok := ln.(interface{ File() (*os.File, error) })
+		if !ok {
+			return fmt.Errorf("listener %s cannot be passed on", u.listeners[i].Addr)
+		}
+		f, err := filer.File()
+		if err != nil {
+			return fmt.Errorf("failed to pass on listener %s: %w", u.listeners[i].Addr, err)
+		}
+		files = append(files, f)
+		addrs[i] = u.listeners[i].Addr
+	}
+	pair, err := socketPair()
+	if err != nil {
+		return err
+	}
+	control, remote := pair[0], pair[1]
+	files = append(files, remote)
+
+	cmd := exec.Command(path, os.Args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.ExtraFiles = files
+	for _, env := range os.Environ() {
+		name, _, _ := strings.Cut(env, "=")
+		switch name {
+		case "LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES", "WATCHDOG_PID":
+			// Meant for this process; the sockets are passed as listeners
+		default:
+			cmd.Env = append(cmd.Env, env)
+		}
+	}
+	cmd.Env = append(cmd.Env,
+		upgradeListenersEnv+"="+strings.Join(addrs, ","),
+		upgradeControlEnv+"="+strconv.Itoa(systemdFirstFD+len(files)-1))
+	if err := cmd.Start(); err != nil {
+		control.Close()
+		return fmt.Errorf("failed to start %s: %w", path, err)
+	}
+	slog.Info("Upgrading", "binary", path, "pid", cmd.Process.Pid)
+
+	started := make(chan error, 1)
+	go func() {
+		line, err := bufio.NewReader(control).ReadString('\n')
+		if err == nil && strings.TrimSpace(line) != upgradeReady {
+			err = fmt.Errorf("unexpected %q", line)
+		}
+		started <- err
+	}()
+	select {
+	case err = <-started:
+	case <-time.After(upgradeReadyTimeout):
+		err = fmt.Errorf("it did not start within %s", upgradeReadyTimeout)
+	}
+	if err != nil {
+		control.Close()
+		_ = cmd.Process.Kill()
+		go cmd.Wait()
+		return fmt.Errorf("the new process failed to start, keeping this one: %w", err)
+	}
+	go cmd.Wait()
+
+	// Closing the listeners in this process must leave the sockets in place
+	for _, ln := range u.lns {
+		if unix, ok := ln.(*net.UnixListener); ok {
+			unix.SetUnlinkOnClose(false)
+		}
+	}
+	u.control = control
+	close(u.ready)
+	return nil
+}
+
+// HandOver hands the locks held in holders to the new process, once this one
+// has finished its requests.
+func (u *Upgrader) HandOver(holders ...lockHolder) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.control == nil {
+		return errors.New("no upgrade is under way")
+	}
+	defer u.control.Close()
+	var locks []handedLock
+	for _, h := range holders {
+		locks = append(locks, h.handOverLocks()...)
+	}
+	if err := json.NewEncoder(u.control).Encode(locks); err != nil {
+		return fmt.Errorf("failed to hand over the locks: %w", err)
+	}
+	slog.Info("Handed over the locks to the upgraded backend", "locks", len(locks))
+	return nil
+}
+
+// handOverLocks returns the locks held, for an upgrade.
+func (h *StateHandler) handOverLocks() []handedLock {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	locks := make([]handedLock, 0, len(h.locks))
+	for name, lock := range h.locks {
+		locks = append(locks, handedLock{Name: name, Lock: lock, Source: h.lockSources[name]})
+	}
+	return locks
+}
+
+// takeOverLocks holds the locks handed over by an upgrade that were held in
+// the default handler, as if they had been acquired here.
+func (h *StateHandler) takeOverLocks(locks []handedLock) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, l := range locks {
+		if l.Tenant != "" || l.Repo != "" {
+			continue
+		}
+		h.locks[l.Name] = l.Lock
+		h.lockSources[l.Name] = l.Source
+		h.runs.Start(l.Name, l.Lock)
+		IncrementActiveLocks()
+	}
+}
+
+// handOverLocks returns the locks held by the tenants, for an upgrade. It is
+// safe to call on a nil router.
+func (tr *TenantRouter) handOverLocks() []handedLock {
+	if tr == nil {
+		return nil
+	}
+	tr.mu.RLock()
+	defer tr.mu.RUnlock()
+	var locks []handedLock
+	for prefix, t := range tr.tenants {
+		for _, l := range t.handler.handOverLocks() {
+			l.Tenant = prefix
+			locks = append(locks, l)
+		}
+	}
+	return locks
+}
+
+// takeOverLocks holds the locks handed over by an upgrade in the handlers of
+// their tenants. Locks of tenants no longer served are dropped. It is safe to
+// call on a nil router.
+func (tr *TenantRouter) takeOverLocks(locks []handedLock) {
+	if tr == nil {
+		return
+	}
+	tr.mu.RLock()
+	defer tr.mu.RUnlock()
+	for _, l := range locks {
+		if l.Tenant == "" {
+			continue
+		}
+		t, ok := tr.tenants[l.Tenant]
+		if !ok {
+			slog.Warn("Dropping lock handed over for a tenant no longer served", "tenant", l.Tenant, "state", l.Name, "lock_id", l.Lock.ID)
+			continue
+		}
+		l.Tenant = ""
+		t.handler.takeOverLocks([]handedLock{l})
+	}
+}
+
+// handOverLocks returns the locks held in the repositories other than the
+// default one, for an upgrade. It is safe to call on a nil router.
+func (rr *RepoRouter) handOverLocks() []handedLock {
+	if rr == nil {
+		return nil
+	}
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	var locks []handedLock
+	for repo, h := range rr.handlers {
+		for _, l := range h.handOverLocks() {
+			l.Repo = repo
+			locks = append(locks, l)
+		}
+	}
+	return locks
+}
+
+// takeOverLocks holds the locks handed over by an upgrade in the handlers of
+// their repositories. Locks of repositories that can no longer be served are
+// dropped. It is safe to call on a nil router.
+func (rr *RepoRouter) takeOverLocks(locks []handedLock) {
+	if rr == nil {
+		return
+	}
+	for _, l := range locks {
+		if l.Repo == "" || l.Tenant != "" {
+			continue
+		}
+		owner, repo, _ := strings.Cut(l.Repo, "/")
+		if !rr.allowed(l.Repo) {
+			slog.Warn("Dropping lock handed over for a repository not in MULTI_REPO_ALLOWLIST", "repo", l.Repo, "state", l.Name, "lock_id", l.Lock.ID)
+			continue
+		}
+		h, err := rr.handler(owner, repo)
+		if err != nil {
+			slog.Warn("Dropping lock handed over for a repository that cannot be served", "repo", l.Repo, "state", l.Name, "lock_id", l.Lock.ID, "error", err)
+			continue
+		}
+		l.Repo = ""
+		h.takeOverLocks([]handedLock{l})
+	}
+}
+
+// socketPair returns the two ends of a connected pair of Unix sockets.
+func socketPair() ([2]*os.File, error) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return [2]*os.File{}, fmt.Errorf("failed to create the upgrade connection: %w", err)
+	}
+	return [2]*os.File{os.NewFile(uintptr(fds[0]), "upgrade-control"), os.NewFile(uintptr(fds[1]), "upgrade-control")}, nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestTakeOver_NotUpgrading(t *testing.T) {
+	t.Setenv(upgradeControlEnv, "")
+	locks, err := takeOver()
+	if err != nil || locks != nil {
+		t.Fatalf("expected nothing outside an upgrade, got %v, %v", locks, err)
+	}
+	if upgradedFrom(":8080") {
+		t.Error("expected no listener passed outside an upgrade")
+	}
+}
+
+func TestUpgradedFrom(t *testing.T) {
+	t.Setenv(upgradeListenersEnv, ":8443,unix:///run/tf.sock")
+	if !upgradedFrom("unix:///run/tf.sock") {
+		t.Error("expected the socket to be passed by the upgrade")
+	}
+	if upgradedFrom(":8080") {
+		t.Error("expected :8080 not to be passed by the upgrade")
+	}
+}
+
+func TestHandOverLocks_RoundTrip(t *testing.T) {
+	old := NewStateHandler(newTestLocalGitClient(t), DefaultMaxBodySize)
+	lock := LockInfo{ID: "lock-1", Operation: "OperationTypeApply", Who: "ci@runner"}
+	source := lockSource{Addr: "10.0.0.5", Username: "ci"}
+	old.locks["network"] = lock
+	old.lockSources["network"] = source
+
+	// As sent over the control connection
+	data, err := json.Marshal(old.handOverLocks())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var handed []handedLock
+	if err := json.Unmarshal(data, &handed); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	upgraded := NewStateHandler(newTestLocalGitClient(t), DefaultMaxBodySize)
+	upgraded.takeOverLocks(handed)
+	if got := upgraded.locks["network"]; got != lock {
+		t.Errorf("expected lock %+v, got %+v", lock, got)
+	}
+	if got := upgraded.lockSources["network"]; got != source {
+		t.Errorf("expected source %+v, got %+v", source, got)
+	}
+}
+
+func TestHandOverLocks_TenantsAndRepositories(t *testing.T) {
+	tenantsFile := "tenants:\n  - prefix: team-a\n    repo: a\n"
+	state := `{"ID":"lock-1","Operation":"OperationTypeApply"}`
+
+	// Locks held by the default handler, a tenant and another repository
+	oldTenants, _, _ := newTestTenantRouter(t, tenantsFile)
+	oldRepos, _ := newTestRepoRouter(t)
+	if w := serveAs(oldTenants, "LOCK", "/team-a/prod", "", state); w.Code != http.StatusOK {
+		t.Fatalf("expected the tenant's state to be locked, got %d", w.Code)
+	}
+	if w := serveAs(oldRepos, "LOCK", "/infra/network/prod", "", state); w.Code != http.StatusOK {
+		t.Fatalf("expected the repository's state to be locked, got %d", w.Code)
+	}
+	if w := serveAs(oldRepos.base, "LOCK", "/prod", "", state); w.Code != http.StatusOK {
+		t.Fatalf("expected the default state to be locked, got %d", w.Code)
+	}
+
+	holders := []lockHolder{oldRepos.base, oldTenants, oldRepos}
+	var locks []handedLock
+	for _, h := range holders {
+		locks = append(locks, h.handOverLocks()...)
+	}
+	data, err := json.Marshal(locks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var handed []handedLock
+	if err := json.Unmarshal(data, &handed); err != nil {
+		t.Fatal(err)
+	}
+
+	newTenants, _, _ := newTestTenantRouter(t, tenantsFile)
+	newRepos, _ := newTestRepoRouter(t)
+	for _, h := range []lockHolder{newRepos.base, newTenants, newRepos} {
+		h.takeOverLocks(handed)
+	}
+
+	// Each lock is held by the matching handler, and only there
+	for _, tt := range []struct {
+		handler http.Handler
+		target  string
+	}{
+		{newTenants, "/team-a/prod"},
+		{newRepos, "/infra/network/prod"},
+		{newRepos.base, "/prod"},
+	} {
+		if w := serveAs(tt.handler, "LOCK", tt.target, "", `{"ID":"lock-2"}`); w.Code != http.StatusLocked {
+			t.Errorf("expected %s to stay locked, got %d", tt.target, w.Code)
+		}
+		if w := serveAs(tt.handler, "UNLOCK", tt.target, "", `{"ID":"lock-1"}`); w.Code != http.StatusOK {
+			t.Errorf("expected the holder to unlock %s, got %d", tt.target, w.Code)
+		}
+	}
+	if len(newTenants.base.locks) != 0 {
+		t.Errorf("expected no lock of the tenant in its router's default handler, got %v", newTenants.base.locks)
+	}
+}
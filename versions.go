@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// VersionLimit is the number of versions kept of the states matching
+// Pattern, which matches state names as SizeLimit's does.
+type VersionLimit struct {
+	Pattern  string
+	Versions int
+}
+
+// parseVersionLimits parses a comma-separated list of pattern=versions pairs,
+// e.g. "ci/*=50,prod=500". The result is ordered most specific (longest
+// pattern) first.
+func parseVersionLimits(s string) ([]VersionLimit, error) {
+	var limits []VersionLimit
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		pattern, versions, ok := strings.Cut(entry, "=")
+		pattern = strings.Trim(strings.TrimSpace(pattern), "/")
+		if !ok || pattern == "" {
+			return nil, fmt.Errorf("invalid entry %q, expected <pattern>=<versions>", entry)
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(versions))
+		if err != nil {
+			return nil, fmt.Errorf("limit for %s must be a valid integer: %w", pattern, err)
+		}
+		if n <= 0 {
+			return nil, fmt.Errorf("limit for %s must be positive", pattern)
+		}
+		limits = append(limits, VersionLimit{Pattern: pattern, Versions: n})
+	}
+
+	sort.SliceStable(limits, func(i, j int) bool {
+		return len(limits[i].Pattern) > len(limits[j].Pattern)
+	})
+	return limits, nil
+}
+
+// versionLimit returns the number of versions to keep of the named state and
+// the pattern that set it, or 0 if there is no limit.
+func (h *StateHandler) versionLimit(name string) (int, string) {
+	for _, limit := range h.versionLimits {
+		if matchesStatePattern(limit.Pattern, name) {
+			return limit.Versions, limit.Pattern
+		}
+	}
+	return 0, ""
+}
+
+// commitLister is implemented by storages that can list the commits changing
+// a file.
+type commitLister interface {
+	ListCommits(path string, limit int) ([]CommitInfo, error)
+}
+
+// stateVersions is the response of GET /{name}/versions.
+type stateVersions struct {
+	Name         string `json:"name"`
+	Versions     int    `json:"versions"`
+	MaxVersions  int    `json:"max_versions,omitempty"`
+	LimitPattern string `json:"limit_pattern,omitempty"`
+	OverLimit    bool   `json:"over_limit"`
+}
+
+// handleVersions reports at GET /{name}/versions how many versions of the
+// state the repository holds, and its MAX_STATE_VERSIONS limit. A state over
+// its limit is logged, as its history is not pruned by the backend.
+func (h *StateHandler) handleVersions(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Method != http.MethodGet {
+		h.methodNotAllowed(w, r, http.MethodGet)
+		return
+	}
+	lister, ok := h.storage.(commitLister)
+	if !ok {
+		writeError(w, fmt.Errorf("%w: the storage keeps no version history", ErrNotFound))
+		return
+	}
+	commits, err := lister.ListCommits(statePath(name), 0)
+	if err != nil {
+		slog.Error("Error listing state versions", "state", name, "error", err)
+		writeError(w, err)
+		return
+	}
+
+	versions := stateVersions{Name: name, Versions: len(commits)}
+	versions.MaxVersions, versions.LimitPattern = h.versionLimit(name)
+	if versions.MaxVersions > 0 && versions.Versions > versions.MaxVersions {
+		versions.OverLimit = true
+		slog.Warn("State has more versions than its limit", "state", name, "versions", versions.Versions, "limit", versions.MaxVersions)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(versions)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestParseVersionLimits(t *testing.T) {
+	limits, err := parseVersionLimits("ci/*=50, ci/network=100,prod=500")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []VersionLimit{
+		{Pattern: "ci/network", Versions: 100},
+		{Pattern: "ci/*", Versions: 50},
+		{Pattern: "prod", Versions: 500},
+	}
+	if len(limits) != len(expected) {
+		t.Fatalf("expected %d limits, got %d", len(expected), len(limits))
+	}
+	for i := range expected {
+		if limits[i] != expected[i] {
+			t.Errorf("limit %d: expected %+v, got %+v", i, expected[i], limits[i])
+		}
+	}
+
+	for _, invalid := range []string{"ci/*", "=5", "prod=many", "prod=0"} {
+		if _, err := parseVersionLimits(invalid); err == nil {
+			t.Errorf("expected error for %q", invalid)
+		}
+	}
+}
+
+func TestHandleVersions(t *testing.T) {
+	handler := NewStateHandler(newTestLocalGitClient(t), DefaultMaxBodySize)
+	handler.versionLimits, _ = parseVersionLimits("ci/*=2")
+
+	for serial := 1; serial <= 3; serial++ {
+		body := fmt.Sprintf(`{"version":4,"serial":%d,"lineage":"abc"}`, serial)
+		if w := serveAs(handler, http.MethodPost, "/ci/network", "", body); w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+	}
+	serveAs(handler, http.MethodPost, "/other", "", `{"version":4,"serial":1,"lineage":"def"}`)
+
+	for _, tt := range []struct {
+		name string
+		want stateVersions
+	}{
+		{"ci/network", stateVersions{Name: "ci/network", Versions: 3, MaxVersions: 2, LimitPattern: "ci/*", OverLimit: true}},
+		{"other", stateVersions{Name: "other", Versions: 1}},
+		{"missing", stateVersions{Name: "missing"}},
+	} {
+		w := serve(handler, http.MethodGet, "/"+tt.name+"/versions")
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected status 200, got %d: %s", tt.name, w.Code, w.Body.String())
+		}
+		var got stateVersions
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("%s: expected %+v, got %+v", tt.name, tt.want, got)
+		}
+	}
+
+	if w := serveAs(handler, http.MethodPost, "/ci/network/versions", "", `{"version":4,"serial":4,"lineage":"abc"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("expected writes to a state named like the endpoint to be rejected, got %d", w.Code)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+)
+
+// Readiness serves GET /ready: 503 while startup warm-up tasks are still
+// running, 200 once they all finished. Load balancers and Kubernetes
+// readiness probes can hold traffic back until then, while /health reports
+// the process as alive throughout.
+type Readiness struct {
+	pending atomic.Int32
+}
+
+// Track wraps a periodic job so that its first run is waited for: the
+// server is not ready until it has finished. A first run that fails still
+// ends the wait, as serving without the warm-up beats not serving at all.
+func (rd *Readiness) Track(fn func(context.Context) error) func(context.Context) error {
+	rd.pending.Add(1)
+	var done atomic.Bool
+	return func(ctx context.Context) error {
+		defer func() {
+			if done.CompareAndSwap(false, true) {
+				rd.pending.Add(-1)
+			}
+		}()
+		return fn(ctx)
+	}
+}
+
+// Ready reports whether every tracked task has finished its first run.
+func (rd *Readiness) Ready() bool {
+	return rd.pending.Load() == 0
+}
+
+func (rd *Readiness) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !rd.Ready() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte(`{"status":"warming_up"}`))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte(`{"status":"ok"}`))
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestReadiness_WaitsForFirstRun(t *testing.T) {
+	readiness := &Readiness{}
+	if w := serve(readiness, http.MethodGet, "/ready"); w.Code != http.StatusOK {
+		t.Fatalf("expected ready without tracked tasks, got %d", w.Code)
+	}
+
+	calls := 0
+	index := readiness.Track(func(context.Context) error {
+		calls++
+		return nil
+	})
+	failing := readiness.Track(func(context.Context) error { return errors.New("gitea unavailable") })
+
+	if w := serve(readiness, http.MethodGet, "/ready"); w.Code != http.StatusServiceUnavailable || w.Body.String() != `{"status":"warming_up"}` {
+		t.Fatalf("expected 503 while warming up, got %d: %s", w.Code, w.Body.String())
+	}
+	_ = index(context.Background())
+	if readiness.Ready() {
+		t.Fatal("expected to wait for every tracked task")
+	}
+	if err := failing(context.Background()); err == nil {
+		t.Error("expected the task's error to be returned")
+	}
+	if !readiness.Ready() {
+		t.Fatal("expected ready once every task ran, even if one failed")
+	}
+
+	// Later runs leave readiness alone
+	_ = index(context.Background())
+	if !readiness.Ready() || calls != 2 {
+		t.Errorf("expected to stay ready, got ready=%v after %d calls", readiness.Ready(), calls)
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Configuration files in YAML, such as TENANTS_FILE, can be composed from
+// environment variables and shared fragments:
+//
+//   - ${NAME} in a value is replaced by the variable NAME, and ${NAME:-text}
+//     by text if NAME is unset or empty. $$ stands for a literal $. An unset
+//     variable without a default is an error, so a missing secret does not
+//     go unnoticed.
+//   - A value tagged !include, such as "!include shared/limits.yaml", is
+//     replaced by the contents of that file, relative to the including one.
+//     An included sequence inside a sequence is spliced into it, so lists
+//     can be assembled from several files.
+//
+// Variables are expanded in values only, after parsing, so they cannot
+// change the structure of the file.
+
+// maxIncludeDepth bounds the nesting of includes.
+const maxIncludeDepth = 10
+
+const includeTag = "!include"
+
+var yamlVariable = regexp.MustCompile(`\$\$|\$\{([A-Za-z_][A-Za-z0-9_]*)(?::-([^}]*))?\}`)
+
+// decodeYAMLFile decodes the YAML file at path into out, after resolving its
+// includes and variables. Fields unknown to out are rejected.
+func decodeYAMLFile(path string, out any) error {
+	root, err := (&yamlLoader{}).load(path)
+	if err != nil {
+		return err
+	}
+	// Node.Decode cannot reject unknown fields, so the resolved file is
+	// decoded anew
+	data, err := yaml.Marshal(root)
+	if err != nil {
+		return err
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	return dec.Decode(out)
+}
+
+// yamlLoader resolves the includes of a YAML file.
+type yamlLoader struct {
+	stack []string // Absolute paths of the files being loaded, outermost first
+}
+
+// load parses the file at path and resolves its includes and variables.
+func (l *yamlLoader) load(path string) (*yaml.Node, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	if slices.Contains(l.stack, abs) {
+		return nil, fmt.Errorf("%s includes itself", path)
+	}
+	if len(l.stack) >= maxIncludeDepth {
+		return nil, fmt.Errorf("%s: includes are nested more than %d deep", path, maxIncludeDepth)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(doc.Content) == 0 {
+		return nil, fmt.Errorf("%s is empty", path)
+	}
+
+	l.stack = append(l.stack, abs)
+	defer func() { l.stack = l.stack[:len(l.stack)-1] }()
+	root := doc.Content[0]
+	if err := l.resolve(root, path); err != nil {
+		return nil, err
+	}
+	return root, nil
+}
+
+// resolve replaces the includes and expands the variables in node, which is
+// part of file.
+func (l *yamlLoader) resolve(node *yaml.Node, file string) error {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		if node.Tag == includeTag {
+			included, err := l.include(node, file)
+			if err != nil {
+				return err
+			}
+			*node = *included
+			return nil
+		}
+		return expandYAMLScalar(node, file)
+	case yaml.MappingNode:
+		// Keys are left as they are
+		for i := 1; i < len(node.Content); i += 2 {
+			if err := l.resolve(node.Content[i], file); err != nil {
+				return err
+			}
+		}
+	case yaml.SequenceNode:
+		items := make([]*yaml.Node, 0, len(node.Content))
+		for _, item := range node.Content {
+			if item.Kind == yaml.ScalarNode && item.Tag == includeTag {
+				included, err := l.include(item, file)
+				if err != nil {
+					return err
+				}
+				if included.Kind == yaml.SequenceNode {
+					items = append(items, included.Content...)
+				} else {
+					items = append(items, included)
+				}
+				continue
+			}
+			if err := l.resolve(item, file); err != nil {
+				return err
+			}
+			items = append(items, item)
+		}
+		node.Content = items
+	case yaml.AliasNode:
+		return fmt.Errorf("%s:%d: aliases are not supported", file, node.Line)
+	}
+	return nil
+}
+
+// include loads the file named by the !include node in file.
+func (l *yamlLoader) include(node *yaml.Node, file string) (*yaml.Node, error) {
+	target, err := expandYAMLVariables(node.Value)
+	if err != nil {
+		return nil, fmt.Errorf("%s:%d: %w", file, node.Line, err)
+	}
+	if target == "" {
+		return nil, fmt.Errorf("%s:%d: %s needs a file", file, node.Line, includeTag)
+	}
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(filepath.Dir(file), target)
+	}
+	included, err := l.load(target)
+	if err != nil {
+		return nil, fmt.Errorf("%s:%d: %w", file, node.Line, err)
+	}
+	return included, nil
+}
+
+// expandYAMLScalar expands the variables in a scalar value. A plain value's
+// type is determined anew, so that max_body_size_mb: ${SIZE} is a number.
+func expandYAMLScalar(node *yaml.Node, file string) error {
+	if !strings.Contains(node.Value, "$") {
+		return nil
+	}
+	value, err := expandYAMLVariables(node.Value)
+	if err != nil {
+		return fmt.Errorf("%s:%d: %w", file, node.Line, err)
+	}
+	node.Value = value
+	if node.Style == 0 {
+		node.Tag = ""
+	}
+	return nil
+}
+
+// expandYAMLVariables replaces the variables in s by their values.
+func expandYAMLVariables(s string) (string, error) {
+	var missing []string
+	expanded := yamlVariable.ReplaceAllStringFunc(s, func(match string) string {
+		if match == "$$" {
+			return "$"
+		}
+		m := yamlVariable.FindStringSubmatch(match)
+		name, fallback, hasFallback := m[1], m[2], strings.Contains(match, ":-")
+		if value := os.Getenv(name); value != "" {
+			return value
+		}
+		if !hasFallback {
+			missing = append(missing, name)
+		}
+		return fallback
+	})
+	if len(missing) > 0 {
+		return "", errors.New(strings.Join(missing, ", ") + " not set")
+	}
+	return expanded, nil
+}
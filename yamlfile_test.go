@@ -0,0 +1,109 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeYAMLFiles writes files, keyed by their names, to a temporary
+// directory and returns its path.
+func writeYAMLFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestDecodeYAMLFile_Variables(t *testing.T) {
+	t.Setenv("TEAM_A_TOKEN", "secret")
+	t.Setenv("TEAM_A_SIZE", "5")
+	dir := writeYAMLFiles(t, map[string]string{"tenants.yaml": `tenants:
+  - prefix: team-a
+    repo: ${TEAM_A_REPO:-tfstate}
+    gitea_token: ${TEAM_A_TOKEN}
+    auth_token: "$${TEAM_A_TOKEN}"
+    max_body_size_mb: ${TEAM_A_SIZE}
+`})
+
+	var file tenantsFile
+	if err := decodeYAMLFile(filepath.Join(dir, "tenants.yaml"), &file); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	tenant := file.Tenants[0]
+	if tenant.Repo != "tfstate" || tenant.GiteaToken != "secret" || tenant.AuthToken != "${TEAM_A_TOKEN}" || tenant.MaxBodySizeMB != 5 {
+		t.Errorf("unexpected tenant %+v", tenant)
+	}
+}
+
+func TestDecodeYAMLFile_UnsetVariable(t *testing.T) {
+	dir := writeYAMLFiles(t, map[string]string{"tenants.yaml": "tenants:\n  - prefix: a\n    repo: a\n    gitea_token: ${NO_SUCH_TOKEN}\n"})
+
+	var file tenantsFile
+	err := decodeYAMLFile(filepath.Join(dir, "tenants.yaml"), &file)
+	if err == nil || !strings.Contains(err.Error(), "tenants.yaml:4: NO_SUCH_TOKEN not set") {
+		t.Errorf("expected an error naming the unset variable and its line, got %v", err)
+	}
+}
+
+func TestDecodeYAMLFile_Includes(t *testing.T) {
+	t.Setenv("TEAM", "team-b")
+	dir := writeYAMLFiles(t, map[string]string{
+		"tenants.yaml": `tenants:
+  - prefix: team-a
+    repo: a
+    size_limits: !include shared/limits.yaml
+  - !include teams/${TEAM}.yaml
+`,
+		"shared/limits.yaml": "legacy=200\n",
+		"teams/team-b.yaml": `- prefix: team-b
+  repo: b
+  size_limits: !include ../shared/limits.yaml
+- prefix: team-c
+  repo: c
+`,
+	})
+
+	var file tenantsFile
+	if err := decodeYAMLFile(filepath.Join(dir, "tenants.yaml"), &file); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(file.Tenants) != 3 {
+		t.Fatalf("expected the included tenants to be spliced in, got %+v", file.Tenants)
+	}
+	if file.Tenants[0].SizeLimits != "legacy=200" || file.Tenants[1].Prefix != "team-b" || file.Tenants[1].SizeLimits != "legacy=200" || file.Tenants[2].Repo != "c" {
+		t.Errorf("unexpected tenants %+v", file.Tenants)
+	}
+}
+
+func TestDecodeYAMLFile_IncludeErrors(t *testing.T) {
+	dir := writeYAMLFiles(t, map[string]string{
+		"cycle.yaml":    "tenants: !include cycle2.yaml\n",
+		"cycle2.yaml":   "!include cycle.yaml\n",
+		"missing.yaml":  "tenants: !include nowhere.yaml\n",
+		"unknown.yaml":  "tenants:\n  - !include fragment.yaml\n",
+		"fragment.yaml": "prefix: a\nrepo: a\ntoken: x\n",
+	})
+
+	tests := map[string]string{
+		"cycle.yaml":   "includes itself",
+		"missing.yaml": "nowhere.yaml",
+		"unknown.yaml": "field token not found",
+	}
+	for name, wantErr := range tests {
+		var file tenantsFile
+		err := decodeYAMLFile(filepath.Join(dir, name), &file)
+		if err == nil || !strings.Contains(err.Error(), wantErr) {
+			t.Errorf("%s: expected error containing %q, got %v", name, wantErr, err)
+		}
+	}
+}